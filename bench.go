@@ -0,0 +1,41 @@
+package main
+
+import (
+	"duckserver/pkg/duckserver"
+	"flag"
+	"os"
+	"strings"
+	"time"
+)
+
+// runBench runs the bench subcommand: duck_server bench [flags]
+func runBench(args []string) error {
+	flags := flag.NewFlagSet("bench", flag.ExitOnError)
+	addr := flags.String("addr", "127.0.0.1:5432", "Postgres address of the server")
+	user := flags.String("user", "duckserver", "User")
+	password := flags.String("password", "", "Password")
+	workloads := flags.String("workloads", strings.Join(duckserver.BenchWorkloads, ","), "Workloads to run one after another: point, scan, rows, copy")
+	concurrency := flags.Int("concurrency", 8, "Concurrent connections")
+	duration := flags.Duration("duration", 10*time.Second, "Duration of each workload")
+	rows := flags.Int("rows", 1000000, "Rows of the table queried by point and scan")
+	copyBatch := flags.Int("copy_batch", 10000, "Rows of each COPY of the copy workload")
+	resultRows := flags.Int("result_rows", 10000, "Rows returned by each query of the rows workload")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	results, err := duckserver.RunBench(duckserver.BenchOptions{
+		Addr:        *addr,
+		User:        *user,
+		Password:    *password,
+		Workloads:   strings.Split(*workloads, ","),
+		Concurrency: *concurrency,
+		Duration:    *duration,
+		Rows:        *rows,
+		CopyBatch:   *copyBatch,
+		ResultRows:  *resultRows,
+	})
+	if len(results) > 0 {
+		duckserver.WriteBenchReport(os.Stdout, results)
+	}
+	return err
+}
@@ -1,25 +1,115 @@
 package main
 
 import (
+	"duckserver/pkg/duckserver"
 	"flag"
 	"github.com/sirupsen/logrus"
-	_ "net/http/pprof"
+	"os"
+	"strings"
+	"time"
 )
 
-const VERSION = "0.1.0"
-
 func main() {
-	//go func() {
-	//	http.ListenAndServe("localhost:6060", nil)
-	//}()
-	logrus.Infof("duck_server %s", VERSION)
-	pgListen := flag.String("pg_listen", ":5432", "Postgres listen address")
-	chListen := flag.String("ch_listen", ":8123", "Clickhouse listen address")
-	dbPath := flag.String("db_path", "./test.db", "Path to the database file")
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		if err := runBench(os.Args[2:]); err != nil {
+			logrus.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "service" {
+		if err := runService(os.Args[2:]); err != nil {
+			logrus.Fatal(err)
+		}
+		return
+	}
+	pgListen := duckserver.NewListenFlag(":5432")
+	chListen := duckserver.NewListenFlag(":8123")
+	flag.Var(pgListen, "pg_listen", "Postgres listen address, repeat for multiple listeners, e.g. [::]:5432?auth=false&tls_cert=server.crt&tls_key=server.key")
+	flag.Var(chListen, "ch_listen", "Clickhouse listen address, repeat for multiple listeners, same options as pg_listen")
+	dbPath := flag.String("db_path", "./test.db", "Path to the database file, :memory: for an in-memory database")
 	logLevel := flag.String("log_level", "info", "Log level")
+	pidFile := flag.String("pidfile", "", "Write the process id to this file while running")
+	detachFlag := flag.Bool("detach", false, "Run in background, use with --log_file")
+	logFormat := flag.String("log_format", "text", "Log format: text or json")
+	logFile := flag.String("log_file", "", "Log file, stderr if empty")
+	logMaxSize := flag.Int64("log_max_size", 0, "Rotate log files over this many bytes, 0 to disable")
+	logMaxAge := flag.Duration("log_max_age", 0, "Rotate log files older than this, 0 to disable")
+	logMaxBackups := flag.Int("log_max_backups", 0, "Number of rotated log files kept, 0 keeps all")
+	errorLogFile := flag.String("error_log_file", "", "Also write error logs to this file, rotated like the log file")
 	hack := flag.Bool("hack", true, "hack")
 	auth := flag.Bool("auth", true, "enable auth")
+	asyncInsertMaxRows := flag.Int("async_insert_max_rows", 100000, "Flush buffered async inserts of a table after this many rows")
+	asyncInsertFlushInterval := flag.Duration("async_insert_flush_interval", 200*time.Millisecond, "Flush buffered async inserts of a table after this interval")
+	chCoalesceInsertBytes := flag.Int64("ch_coalesce_insert_bytes", 0, "Buffer clickhouse inserts with a body of at most this many bytes like async_insert=1, 0 disables it")
+	checkpointWalSize := flag.Int64("checkpoint_wal_size", 256<<20, "Checkpoint in background when the WAL grows over this many bytes, 0 to disable")
+	checkpointInterval := flag.Duration("checkpoint_interval", 10*time.Minute, "Checkpoint in background periodically, 0 to disable")
+	diskSoftLimit := flag.Uint64("disk_soft_limit", 0, "Warn when free space of the database volume is below this many bytes, 0 to disable")
+	diskHardLimit := flag.Uint64("disk_hard_limit", 0, "Reject writes when free space of the database volume is below this many bytes, 0 to disable")
+	dataDir := flag.String("data_dir", "", "Directory of the databases of CREATE DATABASE, connections use the database of the startup message")
+	snapshotDir := flag.String("snapshot_dir", "", "With db_path :memory:, restore the database from this directory on start and export it there on stop")
+	snapshotInterval := flag.Duration("snapshot_interval", 0, "With snapshot_dir, also export the database periodically, 0 only exports on stop")
+	replicationPublishDir := flag.String("replication_publish_dir", "", "Make this server the writer of a cluster, publish a copy of the database to this directory shared with the readers")
+	replicationPublishInterval := flag.Duration("replication_publish_interval", 10*time.Second, "With replication_publish_dir, interval between the published copies")
+	replicaOf := flag.String("replica_of", "", "With db_path :memory:, make this server a read-only reader of the copies published to this directory")
+	replicaPollInterval := flag.Duration("replica_poll_interval", 5*time.Second, "With replica_of, interval between the checks for a newer copy")
+	autoUpgrade := flag.Bool("auto_upgrade", false, "Migrate a database file written by another DuckDB version, exported with duckdb_cli and imported into a new file, the old file is kept")
+	duckdbCli := flag.String("duckdb_cli", "duckdb", "DuckDB cli of the version that wrote the database file, used by auto_upgrade")
+	superusers := flag.String("superusers", "", "Comma separated users allowed to run EXPORT DATABASE and IMPORT DATABASE")
+	pprofListen := flag.String("pprof_listen", "", "Admin http listen address serving pprof, /metrics, /replication/status and /sessions without auth, e.g. localhost:6060, empty to disable")
+	queryStats := flag.Bool("query_stats", false, "Profile every query to account the rows and bytes read in the metrics and the clickhouse summary header")
+	queryLog := flag.Bool("query_log", false, "Log the queries of both frontends to duckserver.query_log, shown by system.query_log")
+	poolerCompat := flag.Bool("pooler_compat", false, "Compatibility mode for connection poolers like pgbouncer and odyssey")
+	grafanaCompat := flag.Bool("grafana_compat", false, "Compatibility mode for the grafana postgresql datasource")
+	jwtSpec := flag.String("jwt", "", "Accept bearer tokens on clickhouse http, JWKS url with options, e.g. https://idp/jwks.json?issuer=..&audience=..&user_claim=sub&roles_claim=roles&roles=analyst")
+	resultSpool := flag.Bool("pg_result_spool", false, "Spool postgresql results before sending, so slow clients don't pin DuckDB results")
+	resultSpoolMemory := flag.Int("pg_result_spool_memory", 16<<20, "Bytes of a spooled result kept in memory before spilling to a temporary file")
+	writeBufferSize := flag.Int("pg_write_buffer_size", 64*1024, "Output buffer size of a postgresql connection, responses are flushed when full, on Flush and before waiting for input")
+	maxMessageSize := flag.Int("pg_max_message_size", 64<<20, "Max size of a postgresql message, larger messages are rejected with an error, COPY data is streamed whatever its size")
+	tcpNoDelay := flag.Bool("pg_tcp_nodelay", true, "Set TCP_NODELAY on postgresql connections, responses are batched in the output buffer")
+	socketSendBuffer := flag.Int("pg_socket_send_buffer", 0, "Socket send buffer size of a postgresql connection, 0 keeps the system default")
+	serverVersion := flag.String("pg_server_version", "16.0", "Postgresql server_version reported to clients, the server_version listener option overrides it")
+	chServerVersion := flag.String("ch_server_version", "23.3.1.2823", "Clickhouse version returned by version(), for clients checking the server version")
+	chDisplayName := flag.String("ch_display_name", "", "Clickhouse server display name header, default the hostname")
+	corsOrigins := flag.String("ch_cors_origins", "", "Comma separated origins of browser clients allowed to query clickhouse http, * for any, empty disables CORS")
+	corsMethods := flag.String("ch_cors_methods", "GET,POST", "Comma separated methods allowed to browser clients of other origins")
+	corsHeaders := flag.String("ch_cors_headers", "Authorization,Content-Type,X-ClickHouse-Database", "Comma separated request headers allowed to browser clients of other origins")
+	corsCredentials := flag.Bool("ch_cors_credentials", false, "Allow browser clients of other origins to send credentials")
+	corsMaxAge := flag.Duration("ch_cors_max_age", 10*time.Minute, "Time browsers cache the CORS preflight response")
+	chReadHeaderTimeout := flag.Duration("ch_read_header_timeout", 10*time.Second, "Time to read the headers of a clickhouse http request")
+	chIdleTimeout := flag.Duration("ch_idle_timeout", 2*time.Minute, "Time an idle keep-alive clickhouse http connection is kept open")
+	chMaxConnections := flag.Int("ch_max_connections", 0, "Maximum open connections of each clickhouse listener, 0 is unlimited")
+	chMaxConcurrentStreams := flag.Int("ch_max_concurrent_streams", 250, "Maximum concurrent requests of a clickhouse HTTP/2 connection")
+	ttlInterval := flag.Duration("ttl_interval", time.Hour, "Interval between deletions of the rows expired by duckserver.ttl_policies, 0 to disable")
+	chPartitions := flag.Bool("ch_partitions", false, "Create partitioned tables for the time partition keys of clickhouse tables, e.g. PARTITION BY toYYYYMM(ts)")
+	chFormatSchemaPath := flag.String("ch_format_schema_path", "", "Directory of the .proto files of the clickhouse Protobuf input formats, named by the format_schema setting")
+	chCursorTTL := flag.Duration("ch_cursor_ttl", 10*time.Minute, "Time an unused cursor of the /api/v1/query pagination api is kept")
+	chAppenderIdleTimeout := flag.Duration("ch_appender_idle_timeout", 30*time.Second, "Time the pooled connection and appender of the inserts into a table are kept unused, negative disables the pool")
+	chResultCacheMaxBytes := flag.Int64("ch_result_cache_max_bytes", 256<<20, "Size of the cache of the clickhouse selects with the result_cache_ttl setting or comment hint, 0 disables it")
+	chIngestSpoolDir := flag.String("ch_ingest_spool_dir", "", "Spool the clickhouse async inserts with wait_for_async_insert=0 to this directory, acknowledged once on disk and applied in the background")
+	chResultCacheStale := flag.Duration("ch_result_cache_stale", 5*time.Minute, "Time a cached result is served after its ttl while it is refreshed, unless the query sets result_cache_stale")
+	maxRunningQueries := flag.Int("max_running_queries", 0, "Number of queries running at once, the others wait and start by priority, 0 is unlimited")
+	lowPriorityQueries := flag.Int("low_priority_queries", 2, "Number of low priority queries running at once")
+	tempDirectory := flag.String("temp_directory", "", "Directory DuckDB spills operators larger than memory to, default the database path with .tmp")
+	maxTempDirectorySize := flag.String("max_temp_directory_size", "", "Maximum size of the DuckDB temp directory like 100GB, default 90% of the free space")
+	scratchDir := flag.String("scratch_dir", "", "Directory of the scratch files of the server: spooled results, cursors, exports, result cache and downloads, default the system temporary directory")
+	idleInTransactionTimeout := flag.Duration("idle_in_transaction_session_timeout", 0, "Roll back and terminate the postgresql sessions idle in a transaction for longer, 0 to disable")
+	transactionTimeout := flag.Duration("transaction_timeout", 0, "Roll back and terminate the postgresql sessions whose transaction is open for longer, 0 to disable")
+	remotePeers := flag.String("remote_peers", "", "Comma separated addresses remote() may fetch tables from like node1:8123, * for all addresses, empty disables remote()")
+	remoteMaxBytes := flag.Int64("remote_max_bytes", 1<<30, "Largest table remote() fetches from a shard")
+	remoteURLAllowlist := flag.String("remote_url_allowlist", "", "Comma separated http(s) url prefixes the queries may read parquet and csv files from, * for all urls, empty lets DuckDB read urls with its own http and s3 file systems")
+	remoteURLMaxBytes := flag.Int64("remote_url_max_bytes", 1<<30, "Largest file a query reads from a remote url")
+	authProviderSpec := flag.String("auth_provider", "table", "Authentication provider: table, file:/path/to/passwd or ldap://host:389?bind_dn=uid=%s,dc=example,dc=com")
 	flag.Parse()
+	if err := duckserver.ConfigureLogging(duckserver.LogOptions{
+		Format:     *logFormat,
+		File:       *logFile,
+		MaxSize:    *logMaxSize,
+		MaxAge:     *logMaxAge,
+		MaxBackups: *logMaxBackups,
+		ErrorFile:  *errorLogFile,
+	}); err != nil {
+		logrus.Fatal(err)
+	}
 	switch *logLevel {
 	case "trace":
 		logrus.SetLevel(logrus.TraceLevel)
@@ -32,16 +122,120 @@ func main() {
 	case "error":
 		logrus.SetLevel(logrus.ErrorLevel)
 	}
-	server := PgServer{}
-	err := server.Start(serverOptions{
-		DbPath:  *dbPath,
-		Listen:  *pgListen,
-		UseHack: *hack,
-		ClickhouseOptions: ClickhouseOptions{
-			Enabled: true,
-			Listen:  *chListen,
+	if *detachFlag {
+		if err := detach(); err != nil {
+			logrus.Fatal(err)
+		}
+		return
+	}
+	logrus.Infof("duck_server %s", duckserver.VERSION)
+	pgListeners, err := pgListen.Listeners(*auth)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	chListeners, err := chListen.Listeners(*auth)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	authProvider, err := duckserver.ParseAuthProvider(*authProviderSpec)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	var jwtOptions *duckserver.JWTOptions
+	if *jwtSpec != "" {
+		if jwtOptions, err = duckserver.ParseJWTOptions(*jwtSpec); err != nil {
+			logrus.Fatal(err)
+		}
+	}
+	var corsOptions *duckserver.CORSOptions
+	if *corsOrigins != "" {
+		corsOptions = &duckserver.CORSOptions{
+			AllowedOrigins:   splitList(*corsOrigins),
+			AllowedMethods:   splitList(*corsMethods),
+			AllowedHeaders:   splitList(*corsHeaders),
+			AllowCredentials: *corsCredentials,
+			MaxAge:           *corsMaxAge,
+		}
+	}
+	server := duckserver.NewServer(duckserver.Options{
+		DbPath:    *dbPath,
+		Listeners: pgListeners,
+		UseHack:   *hack,
+		ClickhouseOptions: duckserver.ClickhouseOptions{
+			Enabled:                  true,
+			Listeners:                chListeners,
+			AsyncInsertMaxRows:       *asyncInsertMaxRows,
+			AsyncInsertFlushInterval: *asyncInsertFlushInterval,
+			CoalesceInsertBytes:      *chCoalesceInsertBytes,
+			JWT:                      jwtOptions,
+			ServerVersion:            *chServerVersion,
+			DisplayName:              *chDisplayName,
+			CORS:                     corsOptions,
+			ReadHeaderTimeout:        *chReadHeaderTimeout,
+			IdleTimeout:              *chIdleTimeout,
+			MaxConnections:           *chMaxConnections,
+			MaxConcurrentStreams:     *chMaxConcurrentStreams,
+			CursorTTL:                *chCursorTTL,
+			ResultCacheMaxBytes:      *chResultCacheMaxBytes,
+			ResultCacheStale:         *chResultCacheStale,
+			AppenderIdleTimeout:      *chAppenderIdleTimeout,
+			Partitions:               *chPartitions,
+			FormatSchemaPath:         *chFormatSchemaPath,
+			IngestSpoolDir:           *chIngestSpoolDir,
 		},
-		Auth: *auth,
+		Auth:                       *auth,
+		CheckpointWalSize:          *checkpointWalSize,
+		CheckpointInterval:         *checkpointInterval,
+		DiskSoftLimit:              *diskSoftLimit,
+		DiskHardLimit:              *diskHardLimit,
+		SnapshotDir:                *snapshotDir,
+		DataDir:                    *dataDir,
+		SnapshotInterval:           *snapshotInterval,
+		ReplicationPublishDir:      *replicationPublishDir,
+		ReplicationPublishInterval: *replicationPublishInterval,
+		ReplicaOf:                  *replicaOf,
+		ReplicaPollInterval:        *replicaPollInterval,
+		PoolerCompat:               *poolerCompat,
+		GrafanaCompat:              *grafanaCompat,
+		ResultSpool:                *resultSpool,
+		ResultSpoolMemory:          *resultSpoolMemory,
+		WriteBufferSize:            *writeBufferSize,
+		MaxMessageSize:             *maxMessageSize,
+		TCPDelay:                   !*tcpNoDelay,
+		SocketSendBuffer:           *socketSendBuffer,
+		QueryStats:                 *queryStats,
+		QueryLog:                   *queryLog,
+		TTLInterval:                *ttlInterval,
+		MaxRunningQueries:          *maxRunningQueries,
+		LowPriorityQueries:         *lowPriorityQueries,
+		IdleInTransactionTimeout:   *idleInTransactionTimeout,
+		TempDirectory:              *tempDirectory,
+		MaxTempDirectorySize:       *maxTempDirectorySize,
+		ScratchDir:                 *scratchDir,
+		TransactionTimeout:         *transactionTimeout,
+		RemotePeers:                splitList(*remotePeers),
+		RemoteMaxBytes:             *remoteMaxBytes,
+		RemoteURLAllowlist:         splitList(*remoteURLAllowlist),
+		RemoteURLMaxBytes:          *remoteURLMaxBytes,
+		PprofListen:                *pprofListen,
+		AutoUpgrade:                *autoUpgrade,
+		Superusers:                 splitList(*superusers),
+		DuckDBCli:                  *duckdbCli,
+		ServerVersion:              *serverVersion,
+		AuthProvider:               authProvider,
 	})
-	logrus.Fatal(err)
+	if err = runServer(server, *pidFile); err != nil {
+		logrus.Fatal(err)
+	}
+}
+
+// splitList splits a comma separated flag, empty items are dropped
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
 }
@@ -0,0 +1,53 @@
+package duckserver
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"net/http/pprof"
+)
+
+// newAdminMux returns the handler of the admin listener, the go profiler under /debug/pprof/ and the monitoring
+// endpoints clickhouse http serves after authentication
+func (s *PgServer) newAdminMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/metrics", metrics)
+	mux.HandleFunc("/replication/status", s.serveReplicationStatus)
+	mux.HandleFunc("/sessions", s.serveSessions)
+	return mux
+}
+
+func (s *PgServer) serveSessions(wr http.ResponseWriter, _ *http.Request) {
+	wr.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(wr).Encode(s.Sessions(""))
+}
+
+func (s *PgServer) serveReplicationStatus(wr http.ResponseWriter, _ *http.Request) {
+	wr.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(wr).Encode(s.ReplicationStatus())
+}
+
+// startAdminHttp starts the admin listener on addr, it has no authentication and should be bound to a private
+// address
+func (s *PgServer) startAdminHttp(addr string) error {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{Handler: s.newAdminMux()}
+	s.httpServers = append(s.httpServers, srv)
+	logrus.Infof("Listening pprof and metrics on %s", lis.Addr())
+	go func() {
+		if err := srv.Serve(lis); !errors.Is(err, http.ErrServerClosed) {
+			s.errCh <- err
+		}
+	}()
+	return nil
+}
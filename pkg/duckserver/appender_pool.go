@@ -0,0 +1,207 @@
+package duckserver
+
+import (
+	"context"
+	"database/sql/driver"
+	"github.com/marcboeker/go-duckdb"
+	"github.com/sirupsen/logrus"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultAppenderIdleTimeout = 30 * time.Second
+
+// maxIdleAppenders is the number of idle connections kept per table, concurrent inserts beyond it open their own
+const maxIdleAppenders = 4
+
+type appenderKey struct {
+	schema string
+	table  string
+}
+
+// pooledConn is a connection of the clickhouse inserts into a table with the appender of the table once created.
+// A request has it to itself until it is put back, after its rows were flushed and committed
+type pooledConn struct {
+	key           appenderKey
+	conn          driver.Conn
+	appender      *duckdb.Appender
+	schemaVersion uint64
+	lastUsed      time.Time
+}
+
+// Appender returns the appender of a table, the pooled appender for the table of the connection. Its Close flushes
+// the rows instead, so a failed insert rolls them back with its transaction and the appender stays open
+func (pc *pooledConn) Appender(ctx context.Context, schema, table string) (rowAppender, error) {
+	if pc.key != (appenderKey{schema, table}) {
+		return newRowAppender(ctx, pc.conn, schema, table)
+	}
+	if pc.appender != nil {
+		return pooledAppender{pc.appender}, nil
+	}
+	appender, err := newRowAppender(ctx, pc.conn, schema, table)
+	if err != nil {
+		return nil, err
+	}
+	duckdbAppender, ok := appender.(*duckdb.Appender)
+	if !ok {
+		// the appenders staging columns hold a table of their own
+		return appender, nil
+	}
+	pc.appender = duckdbAppender
+	return pooledAppender{duckdbAppender}, nil
+}
+
+func (pc *pooledConn) close() {
+	if pc.appender != nil {
+		if err := pc.appender.Close(); err != nil {
+			logrus.Debugf("close appender of %s.%s error: %v", pc.key.schema, pc.key.table, err)
+		}
+	}
+	_ = pc.conn.Close()
+}
+
+// pooledAppender is a pooled appender lent to a request
+type pooledAppender struct {
+	*duckdb.Appender
+}
+
+func (a pooledAppender) Close() error {
+	return a.Flush()
+}
+
+// appenderPool keeps the connections and appenders of clickhouse inserts per table, so small inserts don't open a
+// connection and create an appender each. Connections opened before a schema change or idle for idleTimeout are
+// closed, a negative idleTimeout disables the pool
+type appenderPool struct {
+	connector     driver.Connector
+	schemaVersion *atomic.Uint64
+	idleTimeout   time.Duration
+	mu            sync.Mutex
+	idle          map[appenderKey][]*pooledConn
+	done          chan struct{}
+	once          sync.Once
+}
+
+func newAppenderPool(connector driver.Connector, schemaVersion *atomic.Uint64, idleTimeout time.Duration) *appenderPool {
+	if idleTimeout == 0 {
+		idleTimeout = defaultAppenderIdleTimeout
+	}
+	p := &appenderPool{
+		connector:     connector,
+		schemaVersion: schemaVersion,
+		idleTimeout:   idleTimeout,
+		idle:          make(map[appenderKey][]*pooledConn),
+		done:          make(chan struct{}),
+	}
+	if idleTimeout > 0 {
+		go p.expireLoop()
+	}
+	return p
+}
+
+// Get returns an idle connection of the inserts into a table, or a new one
+func (p *appenderPool) Get(schema, table string) (*pooledConn, error) {
+	key := appenderKey{schema, table}
+	version := p.schemaVersion.Load()
+	p.mu.Lock()
+	var stale []*pooledConn
+	var pc *pooledConn
+	for idle := p.idle[key]; len(idle) > 0 && pc == nil; idle = p.idle[key] {
+		last := idle[len(idle)-1]
+		p.idle[key] = idle[:len(idle)-1]
+		if last.schemaVersion == version {
+			pc = last
+		} else {
+			stale = append(stale, last)
+		}
+	}
+	if len(p.idle[key]) == 0 {
+		delete(p.idle, key)
+	}
+	p.mu.Unlock()
+	for _, s := range stale {
+		s.close()
+	}
+	if pc != nil {
+		metrics.Add("duckserver_appender_pool_hits_total", 1)
+		return pc, nil
+	}
+	metrics.Add("duckserver_appender_pool_misses_total", 1)
+	conn, err := p.connector.Connect(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return &pooledConn{key: key, conn: conn, schemaVersion: version}, nil
+}
+
+// Put gives back the connection of a committed insert, the connection of a failed insert is closed
+func (p *appenderPool) Put(pc *pooledConn, committed bool) {
+	if committed && p.idleTimeout > 0 && pc.schemaVersion == p.schemaVersion.Load() {
+		p.mu.Lock()
+		select {
+		case <-p.done:
+		default:
+			if idle := p.idle[pc.key]; len(idle) < maxIdleAppenders {
+				pc.lastUsed = time.Now()
+				p.idle[pc.key] = append(idle, pc)
+				p.mu.Unlock()
+				return
+			}
+		}
+		p.mu.Unlock()
+	}
+	pc.close()
+}
+
+func (p *appenderPool) expireLoop() {
+	ticker := time.NewTicker(p.idleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
+		var expired []*pooledConn
+		p.mu.Lock()
+		for key, idle := range p.idle {
+			kept := idle[:0]
+			for _, pc := range idle {
+				if time.Since(pc.lastUsed) > p.idleTimeout {
+					expired = append(expired, pc)
+				} else {
+					kept = append(kept, pc)
+				}
+			}
+			if len(kept) == 0 {
+				delete(p.idle, key)
+			} else {
+				p.idle[key] = kept
+			}
+		}
+		p.mu.Unlock()
+		for _, pc := range expired {
+			pc.close()
+		}
+	}
+}
+
+// Close closes the idle connections, the connections in use are closed when they are put back
+func (p *appenderPool) Close() {
+	if p == nil {
+		return
+	}
+	p.once.Do(func() {
+		p.mu.Lock()
+		close(p.done)
+		idle := p.idle
+		p.idle = make(map[appenderKey][]*pooledConn)
+		p.mu.Unlock()
+		for _, conns := range idle {
+			for _, pc := range conns {
+				pc.close()
+			}
+		}
+	})
+}
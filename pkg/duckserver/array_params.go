@@ -0,0 +1,224 @@
+package duckserver
+
+import (
+	"database/sql/driver"
+	"encoding/binary"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// pgArrayType is a postgresql array type, the oid of its elements and the DuckDB LIST type it binds to
+type pgArrayType struct {
+	elemOid  int32
+	duckType string
+}
+
+var pgArrayTypes = map[int32]pgArrayType{
+	1000: {16, "BOOLEAN[]"},
+	1001: {17, "BLOB[]"},
+	1005: {21, "SMALLINT[]"},
+	1007: {23, "INTEGER[]"},
+	1016: {20, "BIGINT[]"},
+	1021: {700, "FLOAT[]"},
+	1022: {701, "DOUBLE[]"},
+	1009: {25, "VARCHAR[]"},
+	1015: {1043, "VARCHAR[]"},
+	1231: {1700, "DECIMAL(38,10)[]"},
+	1115: {1114, "TIMESTAMP[]"},
+	1182: {1082, "DATE[]"},
+	1185: {1184, "TIMESTAMPTZ[]"},
+	2951: {2950, "UUID[]"},
+}
+
+func isArrayOid(oid int32) bool {
+	_, ok := pgArrayTypes[oid]
+	return ok
+}
+
+var paramPlaceholderRegexp = regexp.MustCompile(`\$(\d+)`)
+
+// castArrayParams casts the parameters the client declared as arrays to their LIST type, DuckDB can't infer
+// the type of a list parameter in = ANY($1)
+func castArrayParams(query string, paramOids []int32) string {
+	hasArray := false
+	for _, oid := range paramOids {
+		hasArray = hasArray || isArrayOid(oid)
+	}
+	if !hasArray {
+		return query
+	}
+	return paramPlaceholderRegexp.ReplaceAllStringFunc(query, func(s string) string {
+		i, _ := strconv.Atoi(s[1:])
+		if i < 1 || i > len(paramOids) || !isArrayOid(paramOids[i-1]) {
+			return s
+		}
+		return s + "::" + pgArrayTypes[paramOids[i-1]].duckType
+	})
+}
+
+// hasArrayValue reports whether a bound parameter is an array, go-duckdb can't bind lists so the values are
+// inlined in the query
+func hasArrayValue(values []driver.Value) bool {
+	for _, v := range values {
+		if _, ok := v.([]any); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeTextArrayParam decodes an array parameter sent in text format, bytea elements are decoded from hex
+func decodeTextArrayParam(oid int32, s string) ([]any, error) {
+	arr, err := parsePgArray(s)
+	if err != nil || pgArrayTypes[oid].elemOid != 17 {
+		return arr, err
+	}
+	return arr, decodeByteaElements(arr)
+}
+
+func decodeByteaElements(arr []any) error {
+	for i, e := range arr {
+		var err error
+		switch e := e.(type) {
+		case string:
+			arr[i], err = decodeBytea(e)
+		case []any:
+			err = decodeByteaElements(e)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parsePgArray parses the text format of a postgresql array, e.g. {1,2,"a,b",NULL}, the elements are strings
+// cast by DuckDB and nested arrays are nested slices
+func parsePgArray(s string) ([]any, error) {
+	s = strings.TrimSpace(s)
+	// skip the optional dimensions decoration, e.g. [1:3]={1,2,3}
+	if strings.HasPrefix(s, "[") {
+		if i := strings.Index(s, "="); i >= 0 {
+			s = s[i+1:]
+		}
+	}
+	arr, rest, err := parsePgArrayElements(s)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(rest) != "" {
+		return nil, fmt.Errorf("malformed array literal: %q", s)
+	}
+	return arr, nil
+}
+
+func parsePgArrayElements(s string) ([]any, string, error) {
+	if !strings.HasPrefix(s, "{") {
+		return nil, s, fmt.Errorf("malformed array literal: %q", s)
+	}
+	s = s[1:]
+	arr := make([]any, 0)
+	if strings.HasPrefix(strings.TrimSpace(s), "}") {
+		return arr, strings.TrimSpace(s)[1:], nil
+	}
+	for {
+		s = strings.TrimLeft(s, " ")
+		switch {
+		case strings.HasPrefix(s, "{"):
+			elem, rest, err := parsePgArrayElements(s)
+			if err != nil {
+				return nil, s, err
+			}
+			arr = append(arr, elem)
+			s = rest
+		case strings.HasPrefix(s, `"`):
+			var sb strings.Builder
+			i := 1
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				sb.WriteByte(s[i])
+			}
+			if i == len(s) {
+				return nil, s, fmt.Errorf("malformed array literal: unterminated quoted element")
+			}
+			arr = append(arr, sb.String())
+			s = s[i+1:]
+		default:
+			end := strings.IndexAny(s, ",}")
+			if end < 0 {
+				return nil, s, fmt.Errorf("malformed array literal: missing }")
+			}
+			elem := strings.TrimSpace(s[:end])
+			if strings.EqualFold(elem, "NULL") {
+				arr = append(arr, nil)
+			} else {
+				arr = append(arr, elem)
+			}
+			s = s[end:]
+		}
+		s = strings.TrimLeft(s, " ")
+		if s == "" {
+			return nil, s, fmt.Errorf("malformed array literal: missing }")
+		}
+		if s[0] == '}' {
+			return arr, s[1:], nil
+		}
+		if s[0] != ',' {
+			return nil, s, fmt.Errorf("malformed array literal: unexpected %q", s[0])
+		}
+		s = s[1:]
+	}
+}
+
+// decodeBinaryArray decodes a one dimensional array parameter sent in the postgresql binary format: the number of
+// dimensions, the null flag, the element oid, the size and lower bound of each dimension, then the elements
+func decodeBinaryArray(b []byte) ([]any, error) {
+	if len(b) < 12 {
+		return nil, fmt.Errorf("invalid binary array with %d bytes", len(b))
+	}
+	ndim := int32(binary.BigEndian.Uint32(b))
+	elemOid := int32(binary.BigEndian.Uint32(b[8:]))
+	b = b[12:]
+	if ndim == 0 {
+		return []any{}, nil
+	}
+	if ndim != 1 {
+		return nil, fmt.Errorf("binary arrays of %d dimensions are not supported", ndim)
+	}
+	if len(b) < 8 {
+		return nil, fmt.Errorf("invalid binary array dimension")
+	}
+	size := int(int32(binary.BigEndian.Uint32(b)))
+	b = b[8:]
+	// each element takes at least its 4 byte length, a size sent by the client must fit the message before it is
+	// allocated
+	if size < 0 || size > len(b)/4 {
+		return nil, fmt.Errorf("invalid binary array size %d", size)
+	}
+	arr := make([]any, 0, size)
+	for i := 0; i < size; i++ {
+		if len(b) < 4 {
+			return nil, fmt.Errorf("invalid binary array element %d", i)
+		}
+		length := int32(binary.BigEndian.Uint32(b))
+		b = b[4:]
+		if length < 0 {
+			arr = append(arr, nil)
+			continue
+		}
+		if len(b) < int(length) {
+			return nil, fmt.Errorf("invalid binary array element %d", i)
+		}
+		elem, err := decodeBinaryParam(elemOid, b[:length])
+		if err != nil {
+			return nil, err
+		}
+		arr = append(arr, elem)
+		b = b[length:]
+	}
+	return arr, nil
+}
@@ -0,0 +1,189 @@
+package duckserver
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/xdg-go/scram"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errInvalidPassword = errors.New("invalid username or password")
+
+// ErrNoStoredCredentials is returned by LookupCredentials when the provider can only verify plain passwords,
+// postgresql clients then authenticate with cleartext password, so use it with tls
+var ErrNoStoredCredentials = errors.New("no stored credentials")
+
+// AuthProvider looks up and verifies user credentials for both frontends
+type AuthProvider interface {
+	// LookupCredentials returns the SCRAM-SHA-256 credentials of user for postgresql SCRAM authentication
+	LookupCredentials(user string) (scram.StoredCredentials, error)
+	// VerifyPassword verifies a plain password, used by clickhouse basic auth and postgresql cleartext password
+	VerifyPassword(user, password string) error
+}
+
+// ParseAuthProvider creates an auth provider from a spec:
+// "table" for the duckserver.users table (returns nil, the default),
+// "file:/path/to/passwd" for a htpasswd style file with SCRAM-SHA-256 or bcrypt hashes,
+// "ldap://host:389?bind_dn=uid=%s,ou=people,dc=example,dc=com" or ldaps:// for LDAP simple bind
+func ParseAuthProvider(spec string) (AuthProvider, error) {
+	switch {
+	case spec == "" || spec == "table":
+		return nil, nil
+	case strings.HasPrefix(spec, "file:"):
+		return newFileAuthProvider(strings.TrimPrefix(spec, "file:")), nil
+	case strings.HasPrefix(spec, "ldap://") || strings.HasPrefix(spec, "ldaps://"):
+		return newLdapAuthProvider(spec)
+	}
+	return nil, fmt.Errorf("unknown auth provider %s", spec)
+}
+
+var scramPasswordRegexp = regexp.MustCompile(`^SCRAM-SHA-256\$(\d+):(.*?)\$(.*?):(.*?)$`)
+
+// parseScramCredentials parses a SCRAM-SHA-256$iterations:salt$storedKey:serverKey password hash
+func parseScramCredentials(pass string) (scram.StoredCredentials, error) {
+	groups := scramPasswordRegexp.FindStringSubmatch(pass)
+	if len(groups) != 5 {
+		return scram.StoredCredentials{}, errors.New("invalid password format")
+	}
+	salt, _ := base64.StdEncoding.DecodeString(groups[2])
+	iterations, _ := strconv.Atoi(groups[1])
+	storedKey, _ := base64.StdEncoding.DecodeString(groups[3])
+	serverKey, _ := base64.StdEncoding.DecodeString(groups[4])
+	return scram.StoredCredentials{
+		StoredKey: storedKey,
+		ServerKey: serverKey,
+		KeyFactors: scram.KeyFactors{
+			Salt:  string(salt),
+			Iters: iterations,
+		},
+	}, nil
+}
+
+func verifyScramPassword(credentials scram.StoredCredentials, password string) error {
+	digestKey := pbkdf2.Key([]byte(password), []byte(credentials.Salt), credentials.Iters, 32, sha256.New)
+	computed := computeHMAC(digestKey, []byte("Server Key"))
+	if !hmac.Equal(computed, credentials.ServerKey) {
+		return errInvalidPassword
+	}
+	return nil
+}
+
+// tableAuthProvider stores users in the duckserver.users table of the database
+type tableAuthProvider struct {
+	db *sql.DB
+}
+
+func (p *tableAuthProvider) LookupCredentials(user string) (scram.StoredCredentials, error) {
+	var pass string
+	err := p.db.QueryRowContext(context.Background(), "select password from duckserver.users where username = $1", user).Scan(&pass)
+	if err != nil {
+		return scram.StoredCredentials{}, err
+	}
+	return parseScramCredentials(pass)
+}
+
+func (p *tableAuthProvider) VerifyPassword(user, password string) error {
+	credentials, err := p.LookupCredentials(user)
+	if err != nil {
+		return errInvalidPassword
+	}
+	return verifyScramPassword(credentials, password)
+}
+
+// fileAuthProvider reads users from a htpasswd style file of user:hash lines,
+// the file is reloaded when modified
+type fileAuthProvider struct {
+	path    string
+	mu      sync.Mutex
+	modTime time.Time
+	users   map[string]string
+}
+
+func newFileAuthProvider(path string) *fileAuthProvider {
+	return &fileAuthProvider{path: path}
+}
+
+func (p *fileAuthProvider) lookup(user string) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	info, err := os.Stat(p.path)
+	if err != nil {
+		return "", err
+	}
+	if p.users == nil || !info.ModTime().Equal(p.modTime) {
+		if err = p.load(); err != nil {
+			return "", err
+		}
+		p.modTime = info.ModTime()
+	}
+	hash, ok := p.users[user]
+	if !ok {
+		return "", errInvalidPassword
+	}
+	return hash, nil
+}
+
+func (p *fileAuthProvider) load() error {
+	f, err := os.Open(p.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		users[user] = hash
+	}
+	p.users = users
+	return scanner.Err()
+}
+
+func (p *fileAuthProvider) LookupCredentials(user string) (scram.StoredCredentials, error) {
+	hash, err := p.lookup(user)
+	if err != nil {
+		return scram.StoredCredentials{}, err
+	}
+	if !strings.HasPrefix(hash, "SCRAM-SHA-256$") {
+		return scram.StoredCredentials{}, ErrNoStoredCredentials
+	}
+	return parseScramCredentials(hash)
+}
+
+func (p *fileAuthProvider) VerifyPassword(user, password string) error {
+	hash, err := p.lookup(user)
+	if err != nil {
+		return errInvalidPassword
+	}
+	if strings.HasPrefix(hash, "SCRAM-SHA-256$") {
+		credentials, err := parseScramCredentials(hash)
+		if err != nil {
+			return errInvalidPassword
+		}
+		return verifyScramPassword(credentials, password)
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return errInvalidPassword
+	}
+	return nil
+}
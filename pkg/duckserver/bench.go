@@ -0,0 +1,180 @@
+package duckserver
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BenchOptions configures a synthetic workload against a running server over the postgresql protocol
+type BenchOptions struct {
+	Addr     string
+	User     string
+	Password string
+	// Workloads are run one after another, point selects, analytical scans and bulk COPY
+	Workloads   []string
+	Concurrency int
+	Duration    time.Duration
+	// Rows is the size of the table queried by the point and scan workloads
+	Rows int
+	// CopyBatch is the number of rows of a COPY of the copy workload
+	CopyBatch int
+	// ResultRows is the number of rows returned by a query of the rows workload
+	ResultRows int
+}
+
+const (
+	benchTable     = "duckserver_bench"
+	benchCopyTable = "duckserver_bench_copy"
+)
+
+// BenchWorkloads are the workloads of the bench command, rows returns many small rows to measure the result
+// transfer
+var BenchWorkloads = []string{"point", "scan", "rows", "copy"}
+
+// BenchResult is the latency distribution of one workload
+type BenchResult struct {
+	Workload string
+	Queries  int
+	Errors   int
+	Elapsed  time.Duration
+	P50      time.Duration
+	P90      time.Duration
+	P99      time.Duration
+	Max      time.Duration
+}
+
+// RunBench prepares the bench tables, runs the workloads and drops the tables
+func RunBench(options BenchOptions) ([]BenchResult, error) {
+	if options.Concurrency <= 0 {
+		options.Concurrency = 1
+	}
+	if options.Rows <= 0 {
+		options.Rows = 1
+	}
+	for _, workload := range options.Workloads {
+		if !slices.Contains(BenchWorkloads, workload) {
+			return nil, fmt.Errorf("unknown workload %s, expected one of %s", workload, strings.Join(BenchWorkloads, ", "))
+		}
+	}
+	setup, err := dialPg(options.Addr, options.User, options.Password)
+	if err != nil {
+		return nil, err
+	}
+	defer setup.Close()
+	for _, stmt := range []string{
+		fmt.Sprintf("CREATE OR REPLACE TABLE %s AS SELECT i AS id, i %% 100 AS k, random() AS v, md5(i::VARCHAR) AS s FROM range(%d) t(i)", benchTable, options.Rows),
+		fmt.Sprintf("CREATE OR REPLACE TABLE %s (id BIGINT, k INTEGER, v DOUBLE, s VARCHAR)", benchCopyTable),
+	} {
+		if err = setup.Query(stmt); err != nil {
+			return nil, err
+		}
+	}
+	defer func() {
+		_ = setup.Query("DROP TABLE IF EXISTS " + benchTable)
+		_ = setup.Query("DROP TABLE IF EXISTS " + benchCopyTable)
+	}()
+	var results []BenchResult
+	for _, workload := range options.Workloads {
+		result, err := runBenchWorkload(options, workload)
+		if err != nil {
+			return results, err
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func runBenchWorkload(options BenchOptions, workload string) (BenchResult, error) {
+	clients := make([]*pgClient, options.Concurrency)
+	for i := range clients {
+		client, err := dialPg(options.Addr, options.User, options.Password)
+		if err != nil {
+			return BenchResult{}, err
+		}
+		defer client.Close()
+		clients[i] = client
+	}
+	var mu sync.Mutex
+	var latencies []time.Duration
+	errCount := 0
+	var wg sync.WaitGroup
+	start := time.Now()
+	deadline := start.Add(options.Duration)
+	for i, client := range clients {
+		wg.Add(1)
+		go func(client *pgClient, rnd *rand.Rand) {
+			defer wg.Done()
+			var local []time.Duration
+			localErrors := 0
+			for time.Now().Before(deadline) {
+				queryStart := time.Now()
+				var err error
+				switch workload {
+				case "point":
+					err = client.Query(fmt.Sprintf("SELECT * FROM %s WHERE id = %d", benchTable, rnd.Intn(options.Rows)))
+				case "scan":
+					err = client.Query(fmt.Sprintf("SELECT k, count(*), sum(v), avg(length(s)) FROM %s GROUP BY k", benchTable))
+				case "rows":
+					err = client.Query(fmt.Sprintf("SELECT id, k FROM %s LIMIT %d", benchTable, options.ResultRows))
+				case "copy":
+					err = client.CopyIn(fmt.Sprintf("COPY %s FROM STDIN WITH CSV", benchCopyTable), benchCopyData(rnd, options.CopyBatch))
+				}
+				if err != nil {
+					localErrors++
+					continue
+				}
+				local = append(local, time.Since(queryStart))
+			}
+			mu.Lock()
+			latencies = append(latencies, local...)
+			errCount += localErrors
+			mu.Unlock()
+		}(client, rand.New(rand.NewSource(int64(i))))
+	}
+	wg.Wait()
+	result := BenchResult{Workload: workload, Queries: len(latencies), Errors: errCount, Elapsed: time.Since(start)}
+	slices.Sort(latencies)
+	if len(latencies) > 0 {
+		result.P50 = latencies[len(latencies)*50/100]
+		result.P90 = latencies[len(latencies)*90/100]
+		result.P99 = latencies[len(latencies)*99/100]
+		result.Max = latencies[len(latencies)-1]
+	}
+	return result, nil
+}
+
+func benchCopyData(rnd *rand.Rand, rows int) []byte {
+	if rows <= 0 {
+		rows = 1
+	}
+	var buf bytes.Buffer
+	for i := 0; i < rows; i++ {
+		id := rnd.Int63()
+		buf.WriteString(strconv.FormatInt(id, 10))
+		buf.WriteByte(',')
+		buf.WriteString(strconv.FormatInt(id%100, 10))
+		buf.WriteByte(',')
+		buf.WriteString(strconv.FormatFloat(rnd.Float64(), 'f', -1, 64))
+		buf.WriteString(",s")
+		buf.WriteString(strconv.FormatInt(id, 16))
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+// WriteBenchReport writes the results as a table
+func WriteBenchReport(wr io.Writer, results []BenchResult) {
+	_, _ = fmt.Fprintf(wr, "%-8s %10s %8s %10s %10s %10s %10s %10s\n", "workload", "queries", "errors", "qps", "p50", "p90", "p99", "max")
+	for _, r := range results {
+		_, _ = fmt.Fprintf(wr, "%-8s %10d %8d %10.1f %10s %10s %10s %10s\n", r.Workload, r.Queries, r.Errors,
+			float64(r.Queries)/r.Elapsed.Seconds(), r.P50.Round(time.Microsecond), r.P90.Round(time.Microsecond),
+			r.P99.Round(time.Microsecond), r.Max.Round(time.Microsecond))
+	}
+}
@@ -0,0 +1,240 @@
+package duckserver
+
+import (
+	"database/sql/driver"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"github.com/marcboeker/go-duckdb"
+	"math"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// byteaStreamThreshold is the size of a bytea value over which its DataRow is written to the wire in chunks
+// instead of being built in the message buffer
+const byteaStreamThreshold = 1 << 20
+
+// byteaStreamChunk is the number of bytes hex encoded at a time when streaming a bytea value
+const byteaStreamChunk = 32 * 1024
+
+const (
+	formatText   int16 = 0
+	formatBinary int16 = 1
+)
+
+// formatCode returns the format of column or parameter i, no codes mean text and a single code applies to all
+func formatCode(formats []int16, i int) int16 {
+	switch len(formats) {
+	case 0:
+		return formatText
+	case 1:
+		return formats[0]
+	}
+	if i < len(formats) {
+		return formats[i]
+	}
+	return formatText
+}
+
+// encodeBytea encodes b in the hex format of postgresql, \x followed by two hex digits per byte
+func encodeBytea(b []byte) []byte {
+	out := make([]byte, 2+hex.EncodedLen(len(b)))
+	out[0], out[1] = '\\', 'x'
+	hex.Encode(out[2:], b)
+	return out
+}
+
+// decodeBytea decodes the hex format of postgresql, other input is taken as the bytes themselves
+func decodeBytea(s string) ([]byte, error) {
+	if !strings.HasPrefix(s, `\x`) {
+		return []byte(s), nil
+	}
+	return hex.DecodeString(s[2:])
+}
+
+// binaryValue encodes a value in the binary format of the type reported for it in RowDescription
+func binaryValue(v any) ([]byte, error) {
+	switch v := v.(type) {
+	case []byte:
+		return v, nil
+	case string:
+		return []byte(v), nil
+	case bool:
+		if v {
+			return []byte{1}, nil
+		}
+		return []byte{0}, nil
+	case int8:
+		return []byte{byte(v)}, nil
+	case int16:
+		return binary.BigEndian.AppendUint16(nil, uint16(v)), nil
+	case int32:
+		return binary.BigEndian.AppendUint32(nil, uint32(v)), nil
+	case int64:
+		return binary.BigEndian.AppendUint64(nil, uint64(v)), nil
+	case uint8:
+		return binary.BigEndian.AppendUint16(nil, uint16(v)), nil
+	case uint16:
+		return binary.BigEndian.AppendUint32(nil, uint32(v)), nil
+	case uint32:
+		return binary.BigEndian.AppendUint64(nil, uint64(v)), nil
+	case uint64:
+		return numericBinary(new(big.Int).SetUint64(v), 0), nil
+	case float32:
+		return binary.BigEndian.AppendUint32(nil, math.Float32bits(v)), nil
+	case float64:
+		return binary.BigEndian.AppendUint64(nil, math.Float64bits(v)), nil
+	case duckdb.Decimal:
+		return numericBinary(v.Value, int(v.Scale)), nil
+	case *big.Int:
+		return numericBinary(v, 0), nil
+	case duckdb.Interval:
+		return intervalBinary(v), nil
+	}
+	return nil, fmt.Errorf("binary format is not supported for %T", v)
+}
+
+// decodeBinaryParam decodes a parameter sent in binary format by the oid of the parameter
+func decodeBinaryParam(oid int32, b []byte) (driver.Value, error) {
+	switch oid {
+	case 17:
+		return append([]byte(nil), b...), nil
+	case 0, 25, 1043:
+		return string(b), nil
+	case 16:
+		if len(b) == 1 {
+			return b[0] != 0, nil
+		}
+	case 21:
+		if len(b) == 2 {
+			return int64(int16(binary.BigEndian.Uint16(b))), nil
+		}
+	case 23:
+		if len(b) == 4 {
+			return int64(int32(binary.BigEndian.Uint32(b))), nil
+		}
+	case 20:
+		if len(b) == 8 {
+			return int64(binary.BigEndian.Uint64(b)), nil
+		}
+	case 700:
+		if len(b) == 4 {
+			return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), nil
+		}
+	case 701:
+		if len(b) == 8 {
+			return math.Float64frombits(binary.BigEndian.Uint64(b)), nil
+		}
+	case 1186:
+		return decodeIntervalBinary(b)
+	case 1000, 1001, 1005, 1007, 1009, 1015, 1016, 1021, 1022, 1115, 1182, 1185, 1231, 2951:
+		return decodeBinaryArray(b)
+	default:
+		return nil, fmt.Errorf("binary format is not supported for parameters of type oid %d", oid)
+	}
+	return nil, fmt.Errorf("invalid binary parameter of type oid %d with %d bytes", oid, len(b))
+}
+
+// hasLargeBytea reports whether a row holds a bytea value to be streamed
+func hasLargeBytea(values []driver.Value) bool {
+	for _, v := range values {
+		if b, ok := v.([]byte); ok && len(b) > byteaStreamThreshold {
+			return true
+		}
+	}
+	return false
+}
+
+// streamRowData writes a DataRow with large bytea values, the other values are encoded first to compute the
+// message length, then the bytea values are hex encoded to the wire in chunks
+func (c *PgConn) streamRowData(values []driver.Value) error {
+	encoded := make([][]byte, len(values))
+	length := 4 + 2
+	for i, v := range values {
+		length += 4
+		if v == nil {
+			continue
+		}
+		if b, ok := v.([]byte); ok && len(b) > byteaStreamThreshold {
+			if formatCode(c.resultFormats, i) == formatBinary {
+				length += len(b)
+			} else {
+				length += 2 + hex.EncodedLen(len(b))
+			}
+			continue
+		}
+		b, err := c.encodeValue(v, i)
+		if err != nil {
+			return err
+		}
+		encoded[i] = b
+		length += len(b)
+	}
+	header := binary.BigEndian.AppendUint32([]byte{byte(DataRow)}, uint32(length))
+	header = binary.BigEndian.AppendUint16(header, uint16(len(values)))
+	if _, err := c.wire.Write(header); err != nil {
+		return err
+	}
+	chunk := make([]byte, hex.EncodedLen(byteaStreamChunk))
+	for i, v := range values {
+		b, large := v.([]byte)
+		large = large && len(b) > byteaStreamThreshold
+		switch {
+		case v == nil || (!large && encoded[i] == nil):
+			if _, err := c.wire.Write(binary.BigEndian.AppendUint32(nil, math.MaxUint32)); err != nil {
+				return err
+			}
+		case !large:
+			if _, err := c.wire.Write(binary.BigEndian.AppendUint32(nil, uint32(len(encoded[i])))); err != nil {
+				return err
+			}
+			if _, err := c.wire.Write(encoded[i]); err != nil {
+				return err
+			}
+		case formatCode(c.resultFormats, i) == formatBinary:
+			if _, err := c.wire.Write(binary.BigEndian.AppendUint32(nil, uint32(len(b)))); err != nil {
+				return err
+			}
+			if _, err := c.wire.Write(b); err != nil {
+				return err
+			}
+		default:
+			if _, err := c.wire.Write(binary.BigEndian.AppendUint32(nil, uint32(2+hex.EncodedLen(len(b))))); err != nil {
+				return err
+			}
+			if _, err := c.wire.Write([]byte(`\x`)); err != nil {
+				return err
+			}
+			for len(b) > 0 {
+				n := min(len(b), byteaStreamChunk)
+				hex.Encode(chunk, b[:n])
+				if _, err := c.wire.Write(chunk[:hex.EncodedLen(n)]); err != nil {
+					return err
+				}
+				b = b[n:]
+			}
+		}
+	}
+	return nil
+}
+
+// encodeValue encodes the value of column i in the text or binary format requested by the portal,
+// nil is returned for NULL
+func (c *PgConn) encodeValue(v any, i int) ([]byte, error) {
+	if v == nil {
+		return nil, nil
+	}
+	if formatCode(c.resultFormats, i) == formatBinary {
+		return binaryValue(v)
+	}
+	if t, ok := v.(time.Time); ok && i < len(c.tzColumns) && c.tzColumns[i] {
+		return []byte(formatTimestampTZ(t.In(c.location))), nil
+	}
+	pgVal, err := toPgValue(v)
+	if err != nil {
+		return nil, err
+	}
+	return pgVal.val, nil
+}
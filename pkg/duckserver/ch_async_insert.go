@@ -0,0 +1,299 @@
+package duckserver
+
+import (
+	"bufio"
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultAsyncInsertMaxRows = 100000
+const defaultAsyncInsertFlushInterval = 200 * time.Millisecond
+
+// asyncInsertBatch is the rows of an insert buffered and flushed to the table with the other inserts of the queue,
+// or an insert of the ingest spool without queue, done once the spool writer applied it
+type asyncInsertBatch struct {
+	queue *asyncInsertQueue
+	rows  [][]driver.Value
+	done  chan struct{}
+	err   error
+}
+
+// flushed reports whether the batch was flushed
+func (b *asyncInsertBatch) flushed() bool {
+	select {
+	case <-b.done:
+		return true
+	default:
+		return false
+	}
+}
+
+type asyncInsertQueue struct {
+	schema  string
+	table   string
+	mu      sync.Mutex
+	flushMu sync.Mutex
+	inserts []*asyncInsertBatch
+	rows    int
+	timer   *time.Timer
+}
+
+// asyncInserter buffers small inserts per table and flushes them in batches with the pooled appender of the table,
+// like clickhouse async_insert
+type asyncInserter struct {
+	appenders *appenderPool
+	maxRows   int
+	interval  time.Duration
+	mu        sync.Mutex
+	queues    map[string]*asyncInsertQueue
+}
+
+func newAsyncInserter(appenders *appenderPool, maxRows int, interval time.Duration) *asyncInserter {
+	if maxRows <= 0 {
+		maxRows = defaultAsyncInsertMaxRows
+	}
+	if interval <= 0 {
+		interval = defaultAsyncInsertFlushInterval
+	}
+	return &asyncInserter{
+		appenders: appenders,
+		maxRows:   maxRows,
+		interval:  interval,
+		queues:    make(map[string]*asyncInsertQueue),
+	}
+}
+
+func (a *asyncInserter) queue(schema, table string) *asyncInsertQueue {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	key := schema + "." + table
+	q, ok := a.queues[key]
+	if !ok {
+		q = &asyncInsertQueue{schema: schema, table: table}
+		a.queues[key] = q
+	}
+	return q
+}
+
+// Add buffers the rows of an insert and returns its batch, the batch is done once it is flushed
+func (a *asyncInserter) Add(schema, table string, rows [][]driver.Value) *asyncInsertBatch {
+	q := a.queue(schema, table)
+	batch := &asyncInsertBatch{queue: q, rows: rows, done: make(chan struct{})}
+	q.mu.Lock()
+	if len(q.inserts) == 0 {
+		q.timer = time.AfterFunc(a.interval, func() {
+			a.flush(q)
+		})
+	}
+	q.inserts = append(q.inserts, batch)
+	q.rows += len(rows)
+	full := q.rows >= a.maxRows
+	q.mu.Unlock()
+	if full {
+		go a.flush(q)
+	}
+	return batch
+}
+
+// Wait flushes the queue of a batch now when it still buffers the batch, and waits for the flush of the batch
+func (a *asyncInserter) Wait(ctx context.Context, batch *asyncInsertBatch) error {
+	if q := batch.queue; q != nil {
+		q.mu.Lock()
+		buffered := slices.Contains(q.inserts, batch)
+		q.mu.Unlock()
+		if buffered {
+			go a.flush(q)
+		}
+	}
+	select {
+	case <-batch.done:
+		return batch.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (a *asyncInserter) flush(q *asyncInsertQueue) {
+	q.flushMu.Lock()
+	defer q.flushMu.Unlock()
+	q.mu.Lock()
+	inserts := q.inserts
+	q.inserts, q.rows = nil, 0
+	if q.timer != nil {
+		q.timer.Stop()
+		q.timer = nil
+	}
+	q.mu.Unlock()
+	if len(inserts) == 0 {
+		return
+	}
+	var rows [][]driver.Value
+	for _, insert := range inserts {
+		rows = append(rows, insert.rows...)
+	}
+	err := a.write(q.schema, q.table, rows)
+	if err != nil && len(inserts) > 1 {
+		// the inserts of a failed flush are written one by one, so a bad insert fails alone with its own error
+		logrus.Warnf("async insert of %d inserts into %s.%s failed, writing them one by one: %v", len(inserts), q.schema, q.table, err)
+		for _, insert := range inserts {
+			insert.err = a.write(q.schema, q.table, insert.rows)
+		}
+	} else {
+		for _, insert := range inserts {
+			insert.err = err
+		}
+	}
+	for _, insert := range inserts {
+		if insert.err != nil {
+			logrus.Errorf("async insert into %s.%s failed: %v", q.schema, q.table, insert.err)
+		}
+		close(insert.done)
+	}
+	if err == nil {
+		logrus.Debugf("async insert flushed %d rows of %d inserts into %s.%s", len(rows), len(inserts), q.schema, q.table)
+	}
+	metrics.Add("duckserver_async_insert_flushes_total", 1)
+	metrics.Add("duckserver_async_insert_requests_total", float64(len(inserts)))
+}
+
+// write appends the rows of a batch in a transaction, so a failed flush writes none of the inserts
+func (a *asyncInserter) write(schema, table string, rows [][]driver.Value) (err error) {
+	ctx := context.Background()
+	pooled, err := a.appenders.Get(schema, table)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		a.appenders.Put(pooled, err == nil)
+	}()
+	triggers, err := queryInsertTriggers(ctx, pooled.conn, schema, table)
+	if err != nil {
+		return err
+	}
+	if len(triggers) > 0 {
+		return appendWithTriggers(ctx, pooled.conn, false, schema, table, triggers, func(appender rowAppender) error {
+			return appendRows(appender, rows)
+		})
+	}
+	return inTransaction(ctx, pooled.conn.(driver.ExecerContext), false, func() error {
+		appender, err := pooled.Appender(ctx, schema, table)
+		if err != nil {
+			return err
+		}
+		if err = appendRows(appender, rows); err != nil {
+			_ = appender.Close()
+			return err
+		}
+		return appender.Close()
+	})
+}
+
+func appendRows(appender rowAppender, rows [][]driver.Value) error {
+	for _, row := range rows {
+		if err := appender.AppendRow(row...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// coalesceInsert returns the settings of an insert, a small insert not choosing async_insert is buffered with the
+// other small inserts of the table and acknowledged after their flush. Like async_insert=1 an insert of a column list
+// in another order than the table isn't buffered
+func (c *ChServer) coalesceInsert(r *http.Request) url.Values {
+	settings := r.URL.Query()
+	if c.coalesceInsertBytes > 0 && r.ContentLength >= 0 && r.ContentLength <= c.coalesceInsertBytes && !settings.Has("async_insert") {
+		settings.Set("async_insert", "1")
+		settings.Set("wait_for_async_insert", "1")
+	}
+	return settings
+}
+
+// readInsertRows reads the rows of an insert buffered before they are appended, the error is returned with the http
+// status of the response
+func (c *ChServer) readInsertRows(ctx context.Context, schema, table string, columnNames, columnTypes []string, formater ClickhouseFormatReaderFactory,
+	validator *rowValidator, settings url.Values, rd io.Reader, progress *chProgress) ([][]driver.Value, int, error) {
+	formatWriter, err := formater(columnNames, columnTypes, rd)
+	if err != nil {
+		return nil, formatReaderStatus(err), fmt.Errorf("Error creating formater: %s", err)
+	}
+	defaults, err := c.setColumnDefaults(ctx, formatWriter, schema, table, columnNames, columnTypes, settings)
+	if err != nil {
+		return nil, 500, fmt.Errorf("Error looking up column defaults: %s", err)
+	}
+	rows, err := readValidatedRows(ctx, formatWriter, defaults, validator, len(columnNames), progress)
+	if err != nil {
+		return nil, 400, err
+	}
+	return rows, 200, nil
+}
+
+// readValidatedRows reads the rows of a reader with the defaults of their omitted fields, the rows failing the
+// validator are skipped or fail the insert
+func readValidatedRows(ctx context.Context, reader ClickhouseFormatReader, defaults *rowDefaults, validator *rowValidator, columns int,
+	progress *chProgress) ([][]driver.Value, error) {
+	rows := make([][]driver.Value, 0)
+	for {
+		values := make([]driver.Value, columns)
+		validator.Next()
+		err := reader.Read(values)
+		if err == io.EOF {
+			break
+		}
+		// a bad row is rejected before it is buffered, where it would fail the batch of other inserts
+		if err == nil {
+			err = defaults.Fill(ctx, values)
+		}
+		if err == nil {
+			err = validator.Check(values)
+		}
+		if err != nil && validator.Skip(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Error reading values: %s", validator.RowError(err))
+		}
+		rows = append(rows, values)
+		progress.readRows.Add(1)
+	}
+	return rows, nil
+}
+
+func (c *ChServer) asyncInsert(ctx context.Context, schema, table string, columnNames, columnTypes []string, formater ClickhouseFormatReaderFactory,
+	validator *rowValidator, settings url.Values, rd *bufio.Reader, wr http.ResponseWriter, progress *chProgress) {
+	rows, status, err := c.readInsertRows(ctx, schema, table, columnNames, columnTypes, formater, validator, settings, rd, progress)
+	if err != nil {
+		wr.WriteHeader(status)
+		_, _ = fmt.Fprintf(wr, "%s", err)
+		return
+	}
+	batch := c.asyncInserts.Add(schema, table, rows)
+	if settings.Get("wait_for_async_insert") != "0" {
+		select {
+		case <-batch.done:
+		case <-ctx.Done():
+			wr.WriteHeader(500)
+			_, _ = fmt.Fprintf(wr, "Request cancelled")
+			return
+		}
+		if batch.err != nil {
+			wr.WriteHeader(500)
+			_, _ = fmt.Fprintf(wr, "Error flushing async insert: %s", strings.TrimSpace(batch.err.Error()))
+			return
+		}
+		progress.writtenRows.Store(int64(len(rows)))
+	} else if session := chSessionFromContext(ctx); session != nil {
+		session.addPending(batch)
+	}
+	progress.SetSummary(wr)
+	validator.WriteReport(wr)
+}
@@ -0,0 +1,53 @@
+package duckserver
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"github.com/marcboeker/go-duckdb"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestAsyncInsertFailedFlush checks that a bad insert of a flush fails alone and the other inserts are written
+func TestAsyncInsertFailedFlush(t *testing.T) {
+	connector, err := duckdb.NewConnector("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := sql.OpenDB(connector)
+	t.Cleanup(func() { _ = db.Close() })
+	for _, stmt := range []string{
+		"create schema duckserver",
+		"create table duckserver.triggers (name varchar, schema_name varchar, table_name varchar, statement varchar, enabled boolean)",
+		"create table t (a int)",
+	} {
+		if _, err = db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	appenders := newAppenderPool(connector, &atomic.Uint64{}, -1)
+	t.Cleanup(appenders.Close)
+	inserter := newAsyncInserter(appenders, 0, time.Hour)
+	good := inserter.Add("main", "t", [][]driver.Value{{int32(1)}})
+	bad := inserter.Add("main", "t", [][]driver.Value{{"x"}})
+	other := inserter.Add("main", "t", [][]driver.Value{{int32(2)}, {int32(3)}})
+	ctx := context.Background()
+	if err = inserter.Wait(ctx, bad); err == nil {
+		t.Error("bad insert flushed")
+	}
+	if err = inserter.Wait(ctx, good); err != nil {
+		t.Errorf("good insert: %v", err)
+	}
+	if err = inserter.Wait(ctx, other); err != nil {
+		t.Errorf("other insert: %v", err)
+	}
+	var count, sum int
+	if err = db.QueryRow("select count(*), sum(a) from t").Scan(&count, &sum); err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 || sum != 6 {
+		t.Errorf("table has %d rows of sum %d, want 3 rows of sum 6", count, sum)
+	}
+}
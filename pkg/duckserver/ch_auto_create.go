@@ -0,0 +1,198 @@
+package duckserver
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// autoCreateTableSetting creates the missing target table of an insert from the structure of the inserted data
+const autoCreateTableSetting = "auto_create_table"
+
+// autoCreateSampleSize is the size of the head of the inserted data DuckDB sniffs the columns from
+const autoCreateSampleSize = 1 << 20
+
+// autoCreateReaders are the DuckDB table functions sniffing the text input formats, JSONEachRow is sniffed by
+// sniffJsonColumns as the json extension may not be loaded
+var autoCreateReaders = map[string]string{
+	"CSV":                   "read_csv(%s, header = false, delim = ',')",
+	"CSVWithNames":          "read_csv(%s, header = true, delim = ',')",
+	"TabSeparated":          "read_csv(%s, header = false, delim = '\\t', quote = '')",
+	"TabSeparatedWithNames": "read_csv(%s, header = true, delim = '\\t', quote = '')",
+}
+
+// tableExists reports whether schema has the table or view
+func (c *ChServer) tableExists(ctx context.Context, schema, table string) (bool, error) {
+	var exists bool
+	err := c.conn.QueryRowContext(ctx, "select count(*) > 0 from information_schema.tables where table_schema = $1 and table_name = $2",
+		schema, table).Scan(&exists)
+	return exists, err
+}
+
+// autoCreateTable creates a missing table with the columns DuckDB detects in the head of the inserted data, columns
+// names the columns of headerless formats. The returned reader replaces rd, as the head is read ahead, the error comes
+// with its http status.
+func (c *ChServer) autoCreateTable(ctx context.Context, schema, table string, columns []string, format string, rd *bufio.Reader) (*bufio.Reader, int, error) {
+	reader, ok := autoCreateReaders[format]
+	if !ok && format != "JSONEachRow" {
+		return rd, 400, fmt.Errorf("format %s doesn't support %s", format, autoCreateTableSetting)
+	}
+	rd = bufio.NewReaderSize(rd, autoCreateSampleSize)
+	sample, err := rd.Peek(autoCreateSampleSize)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, bufio.ErrBufferFull) {
+		return rd, 500, err
+	}
+	if err == nil {
+		// the last line of a full sample may be cut
+		if i := bytes.LastIndexByte(sample, '\n'); i > 0 {
+			sample = sample[:i+1]
+		}
+	}
+	if len(bytes.TrimSpace(sample)) == 0 {
+		return rd, 400, fmt.Errorf("no data to create table %s.%s from", schema, table)
+	}
+	var defs []string
+	if ok {
+		defs, err = sniffCsvColumns(ctx, c.conn, c.pgServer.scratchDir, reader, sample, columns)
+	} else {
+		defs, err = sniffJsonColumns(sample, columns)
+	}
+	if err != nil {
+		return rd, 400, fmt.Errorf("detect columns: %w", err)
+	}
+	create := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s.%s (%s)", quoteIdent(schema), quoteIdent(table), strings.Join(defs, ", "))
+	if err = c.pgServer.checkQuery(ctx, ProtocolClickhouse, create); err != nil {
+		return rd, 403, err
+	}
+	if _, err = c.conn.ExecContext(ctx, create); err != nil {
+		return rd, 500, err
+	}
+	c.pgServer.notifySchemaChange(create)
+	return rd, 200, nil
+}
+
+// sniffCsvColumns returns the column definitions DuckDB detects in a sample of a text format read by reader, the
+// types the format readers don't convert are VARCHAR. The sample is written to a file of the scratch directory dir
+func sniffCsvColumns(ctx context.Context, conn *sql.DB, dir string, reader string, sample []byte, columns []string) ([]string, error) {
+	f, err := os.CreateTemp(dir, "duckserver-sample-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(sample)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	source := fmt.Sprintf(reader, quoteLiteral(f.Name()))
+	if len(columns) > 0 {
+		source += " AS t(" + quoteIdents(columns) + ")"
+	}
+	rows, err := conn.QueryContext(ctx, "DESCRIBE SELECT * FROM "+source)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var defs []string
+	for rows.Next() {
+		var name, typ string
+		var null, key, def, extra any
+		if err = rows.Scan(&name, &typ, &null, &key, &def, &extra); err != nil {
+			return nil, err
+		}
+		if converters[typ] == nil && !isStagedType(typ) {
+			typ = "VARCHAR"
+		}
+		defs = append(defs, quoteIdent(name)+" "+typ)
+	}
+	return defs, rows.Err()
+}
+
+// sniffJsonColumns returns the column definitions of the keys of the json objects of a sample in the order they show
+// up, or of columns. Booleans are BOOLEAN, integers BIGINT, other numbers DOUBLE, strings, nested values and keys
+// which are only null VARCHAR.
+func sniffJsonColumns(sample []byte, columns []string) ([]string, error) {
+	var names []string
+	types := make(map[string]string)
+	dec := json.NewDecoder(bytes.NewReader(sample))
+	dec.UseNumber()
+	for dec.More() {
+		if tok, err := dec.Token(); err != nil {
+			return nil, err
+		} else if tok != json.Delim('{') {
+			return nil, fmt.Errorf("JSONEachRow row isn't an object")
+		}
+		for dec.More() {
+			tok, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			key := tok.(string)
+			var value any
+			if err = dec.Decode(&value); err != nil {
+				return nil, err
+			}
+			typ := jsonValueType(value)
+			old, seen := types[key]
+			if !seen {
+				names = append(names, key)
+			}
+			switch {
+			case typ == "" || old == typ:
+				if !seen {
+					types[key] = ""
+				}
+			case old == "":
+				types[key] = typ
+			case old == "BIGINT" && typ == "DOUBLE" || old == "DOUBLE" && typ == "BIGINT":
+				types[key] = "DOUBLE"
+			default:
+				types[key] = "VARCHAR"
+			}
+		}
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+	}
+	if len(columns) > 0 {
+		names = columns
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no columns found in JSONEachRow data")
+	}
+	defs := make([]string, len(names))
+	for i, name := range names {
+		typ := types[name]
+		if typ == "" {
+			typ = "VARCHAR"
+		}
+		defs[i] = quoteIdent(name) + " " + typ
+	}
+	return defs, nil
+}
+
+// jsonValueType is the column type of a json value, empty for null
+func jsonValueType(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case bool:
+		return "BOOLEAN"
+	case json.Number:
+		if _, err := v.Int64(); err == nil {
+			return "BIGINT"
+		}
+		return "DOUBLE"
+	default:
+		return "VARCHAR"
+	}
+}
@@ -0,0 +1,561 @@
+package duckserver
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"database/sql/driver"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/goccy/go-json"
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/marcboeker/go-duckdb"
+	"io"
+	"math"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// avroSchemaRegistrySetting is the clickhouse setting of the schema registry of AvroConfluent
+const avroSchemaRegistrySetting = "format_avro_schema_registry_url"
+
+var avroMagic = []byte{'O', 'b', 'j', 1}
+
+// avroSchema is a parsed avro schema, named types referenced by name are the same pointer
+type avroSchema struct {
+	typ      string
+	logical  string
+	scale    int
+	fields   []avroField
+	symbols  []string
+	items    *avroSchema
+	branches []*avroSchema
+	size     int
+}
+
+type avroField struct {
+	name   string
+	schema *avroSchema
+}
+
+// parseAvroSchema parses the json of a schema
+func parseAvroSchema(text []byte) (*avroSchema, error) {
+	var def any
+	if err := json.Unmarshal(text, &def); err != nil {
+		return nil, fmt.Errorf("invalid avro schema: %w", err)
+	}
+	return parseAvroDefinition(def, "", map[string]*avroSchema{})
+}
+
+func parseAvroDefinition(def any, namespace string, names map[string]*avroSchema) (*avroSchema, error) {
+	switch d := def.(type) {
+	case string:
+		switch d {
+		case "null", "boolean", "int", "long", "float", "double", "bytes", "string":
+			return &avroSchema{typ: d}, nil
+		}
+		if s, ok := names[d]; ok {
+			return s, nil
+		}
+		if s, ok := names[namespace+"."+d]; ok {
+			return s, nil
+		}
+		return nil, fmt.Errorf("unknown avro type %s", d)
+	case []any:
+		s := &avroSchema{typ: "union"}
+		for _, branch := range d {
+			b, err := parseAvroDefinition(branch, namespace, names)
+			if err != nil {
+				return nil, err
+			}
+			s.branches = append(s.branches, b)
+		}
+		return s, nil
+	case map[string]any:
+		typ, _ := d["type"].(string)
+		if typ == "" {
+			// {"type": {...}} nests a schema
+			return parseAvroDefinition(d["type"], namespace, names)
+		}
+		s := &avroSchema{typ: typ}
+		s.logical, _ = d["logicalType"].(string)
+		if scale, ok := d["scale"].(float64); ok {
+			s.scale = int(scale)
+		}
+		switch typ {
+		case "record", "error", "enum", "fixed":
+			s.typ = strings.Replace(typ, "error", "record", 1)
+			name, _ := d["name"].(string)
+			if ns, ok := d["namespace"].(string); ok {
+				namespace = ns
+			}
+			if i := strings.LastIndexByte(name, '.'); i >= 0 {
+				namespace = name[:i]
+			} else if namespace != "" {
+				name = namespace + "." + name
+			}
+			names[name] = s
+			names[name[strings.LastIndexByte(name, '.')+1:]] = s
+		}
+		switch s.typ {
+		case "record":
+			fields, _ := d["fields"].([]any)
+			for _, f := range fields {
+				field, _ := f.(map[string]any)
+				name, _ := field["name"].(string)
+				fs, err := parseAvroDefinition(field["type"], namespace, names)
+				if err != nil {
+					return nil, fmt.Errorf("field %s: %w", name, err)
+				}
+				s.fields = append(s.fields, avroField{name: name, schema: fs})
+			}
+		case "enum":
+			symbols, _ := d["symbols"].([]any)
+			for _, symbol := range symbols {
+				name, _ := symbol.(string)
+				s.symbols = append(s.symbols, name)
+			}
+		case "fixed":
+			size, _ := d["size"].(float64)
+			s.size = int(size)
+		case "array":
+			items, err := parseAvroDefinition(d["items"], namespace, names)
+			if err != nil {
+				return nil, err
+			}
+			s.items = items
+		case "map":
+			values, err := parseAvroDefinition(d["values"], namespace, names)
+			if err != nil {
+				return nil, err
+			}
+			s.items = values
+		default:
+			// a primitive or a reference with a logical type
+			prim, err := parseAvroDefinition(typ, namespace, names)
+			if err != nil || s.logical == "" {
+				return prim, err
+			}
+			annotated := *prim
+			annotated.logical, annotated.scale = s.logical, s.scale
+			return &annotated, nil
+		}
+		return s, nil
+	}
+	return nil, fmt.Errorf("invalid avro schema %v", def)
+}
+
+// avroDecoder decodes the binary encoding of avro
+type avroDecoder struct {
+	rd  *bufio.Reader
+	buf []byte
+}
+
+func (d *avroDecoder) long() (int64, error) {
+	return binary.ReadVarint(d.rd)
+}
+
+func (d *avroDecoder) bytes() ([]byte, error) {
+	n, err := d.long()
+	if err != nil {
+		return nil, err
+	}
+	if n < 0 || n > math.MaxInt32 {
+		return nil, fmt.Errorf("invalid avro length %d", n)
+	}
+	b := make([]byte, n)
+	_, err = io.ReadFull(d.rd, b)
+	return b, err
+}
+
+func (d *avroDecoder) fixed(n int) ([]byte, error) {
+	if cap(d.buf) < n {
+		d.buf = make([]byte, n)
+	}
+	_, err := io.ReadFull(d.rd, d.buf[:n])
+	return d.buf[:n], err
+}
+
+// blocks reads the blocks of an array or map, item is called for each item
+func (d *avroDecoder) blocks(item func() error) error {
+	for {
+		count, err := d.long()
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			return nil
+		}
+		if count < 0 {
+			// a negative count is followed by the size of the block in bytes
+			count = -count
+			if _, err = d.long(); err != nil {
+				return err
+			}
+		}
+		for i := int64(0); i < count; i++ {
+			if err = item(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// value decodes a value of s, records and maps are map[string]any and arrays []any
+func (d *avroDecoder) value(s *avroSchema) (any, error) {
+	switch s.typ {
+	case "null":
+		return nil, nil
+	case "boolean":
+		b, err := d.rd.ReadByte()
+		return b != 0, err
+	case "int", "long":
+		v, err := d.long()
+		if err != nil {
+			return nil, err
+		}
+		switch s.logical {
+		case "date":
+			return time.Unix(v*86400, 0).UTC(), nil
+		case "timestamp-millis", "local-timestamp-millis":
+			return time.UnixMilli(v).UTC(), nil
+		case "timestamp-micros", "local-timestamp-micros":
+			return time.UnixMicro(v).UTC(), nil
+		}
+		return v, nil
+	case "float":
+		b, err := d.fixed(4)
+		if err != nil {
+			return nil, err
+		}
+		return float64(math.Float32frombits(binary.LittleEndian.Uint32(b))), nil
+	case "double":
+		b, err := d.fixed(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(binary.LittleEndian.Uint64(b)), nil
+	case "bytes", "fixed":
+		var b []byte
+		var err error
+		if s.typ == "bytes" {
+			b, err = d.bytes()
+		} else {
+			b, err = d.fixed(s.size)
+			b = append([]byte(nil), b...)
+		}
+		if err != nil || s.logical != "decimal" {
+			return b, err
+		}
+		return avroDecimal(b, s.scale), nil
+	case "string":
+		b, err := d.bytes()
+		return string(b), err
+	case "enum":
+		i, err := d.long()
+		if err != nil {
+			return nil, err
+		}
+		if i < 0 || int(i) >= len(s.symbols) {
+			return nil, fmt.Errorf("invalid avro enum index %d", i)
+		}
+		return s.symbols[i], nil
+	case "union":
+		i, err := d.long()
+		if err != nil {
+			return nil, err
+		}
+		if i < 0 || int(i) >= len(s.branches) {
+			return nil, fmt.Errorf("invalid avro union index %d", i)
+		}
+		return d.value(s.branches[i])
+	case "array":
+		items := make([]any, 0)
+		err := d.blocks(func() error {
+			item, err := d.value(s.items)
+			items = append(items, item)
+			return err
+		})
+		return items, err
+	case "map":
+		m := make(map[string]any)
+		err := d.blocks(func() error {
+			key, err := d.bytes()
+			if err != nil {
+				return err
+			}
+			m[string(key)], err = d.value(s.items)
+			return err
+		})
+		return m, err
+	case "record":
+		m := make(map[string]any, len(s.fields))
+		for _, f := range s.fields {
+			v, err := d.value(f.schema)
+			if err != nil {
+				return nil, err
+			}
+			m[f.name] = v
+		}
+		return m, nil
+	}
+	return nil, fmt.Errorf("unsupported avro type %s", s.typ)
+}
+
+// avroDecimal returns the text of a decimal, the two's complement big endian unscaled value
+func avroDecimal(b []byte, scale int) string {
+	v := new(big.Int).SetBytes(b)
+	if len(b) > 0 && b[0]&0x80 != 0 {
+		v.Sub(v, new(big.Int).Lsh(big.NewInt(1), uint(len(b)*8)))
+	}
+	return duckDecimalToString(duckdb.Decimal{Scale: uint8(scale), Value: v})
+}
+
+// avroRecordReader reads records of a schema into the columns of the same names, the other fields are skipped and
+// the columns missing from the record are null
+type avroRecordReader struct {
+	columnTypes []string
+	fields      []int
+	schema      *avroSchema
+}
+
+func newAvroRecordReader(columnNames, columnTypes []string, schema *avroSchema) (*avroRecordReader, error) {
+	if schema.typ != "record" {
+		return nil, fmt.Errorf("avro schema is a %s, not a record", schema.typ)
+	}
+	fields := make([]int, len(schema.fields))
+	for i, f := range schema.fields {
+		fields[i] = -1
+		for j, name := range columnNames {
+			if name == f.name {
+				fields[i] = j
+				break
+			}
+		}
+	}
+	return &avroRecordReader{columnTypes: columnTypes, fields: fields, schema: schema}, nil
+}
+
+func (a *avroRecordReader) read(d *avroDecoder, values []driver.Value) error {
+	if len(a.columnTypes) != len(values) {
+		return errors.New("column length mismatch")
+	}
+	for i := range values {
+		values[i] = nil
+	}
+	for i, f := range a.schema.fields {
+		v, err := d.value(f.schema)
+		if err != nil {
+			return err
+		}
+		if col := a.fields[i]; col >= 0 {
+			if values[col], err = binaryInputValue(v, a.columnTypes[col]); err != nil {
+				return fmt.Errorf("field %s: %w", f.name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// AvroFormatReader reads an avro object container file, the schema is embedded in its header
+type AvroFormatReader struct {
+	columnNames []string
+	columnTypes []string
+	rd          *bufio.Reader
+	codec       string
+	sync        []byte
+	records     *avroRecordReader
+	block       avroDecoder
+	remaining   int64
+	zstd        *zstd.Decoder
+}
+
+func newAvroFormatReader(columnNames, columnTypes []string, reader io.Reader) (ClickhouseFormatReader, error) {
+	a := &AvroFormatReader{columnNames: columnNames, columnTypes: columnTypes, rd: bufio.NewReader(reader)}
+	d := &avroDecoder{rd: a.rd}
+	magic, err := d.fixed(4)
+	if err != nil {
+		return nil, fmt.Errorf("reading avro header: %w", err)
+	}
+	if !bytes.Equal(magic, avroMagic) {
+		return nil, errors.New("not an avro object container file")
+	}
+	meta, err := d.value(&avroSchema{typ: "map", items: &avroSchema{typ: "bytes"}})
+	if err != nil {
+		return nil, fmt.Errorf("reading avro header: %w", err)
+	}
+	header := meta.(map[string]any)
+	codec, _ := header["avro.codec"].([]byte)
+	a.codec = string(codec)
+	switch a.codec {
+	case "", "null", "deflate", "snappy":
+	case "zstandard":
+		if a.zstd, err = zstd.NewReader(nil); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported avro codec %s", a.codec)
+	}
+	schemaText, _ := header["avro.schema"].([]byte)
+	schema, err := parseAvroSchema(schemaText)
+	if err != nil {
+		return nil, err
+	}
+	if a.records, err = newAvroRecordReader(columnNames, columnTypes, schema); err != nil {
+		return nil, err
+	}
+	marker, err := d.fixed(16)
+	if err != nil {
+		return nil, fmt.Errorf("reading avro header: %w", err)
+	}
+	a.sync = append([]byte(nil), marker...)
+	return a, nil
+}
+
+func (a *AvroFormatReader) Read(values []driver.Value) error {
+	for a.remaining == 0 {
+		if err := a.nextBlock(); err != nil {
+			return err
+		}
+	}
+	a.remaining--
+	return a.records.read(&a.block, values)
+}
+
+// nextBlock reads and decompresses the next block of records, io.EOF at the end of the file
+func (a *AvroFormatReader) nextBlock() error {
+	d := &avroDecoder{rd: a.rd}
+	count, err := d.long()
+	if err != nil {
+		return err
+	}
+	data, err := d.bytes()
+	if err != nil {
+		return fmt.Errorf("reading avro block: %w", err)
+	}
+	marker, err := d.fixed(16)
+	if err != nil {
+		return fmt.Errorf("reading avro block: %w", err)
+	}
+	if !bytes.Equal(marker, a.sync) {
+		return errors.New("invalid avro sync marker")
+	}
+	switch a.codec {
+	case "deflate":
+		data, err = io.ReadAll(flate.NewReader(bytes.NewReader(data)))
+	case "snappy":
+		// the block is followed by the crc32 of the uncompressed data
+		if len(data) < 4 {
+			return errors.New("invalid avro snappy block")
+		}
+		data, err = snappy.Decode(nil, data[:len(data)-4])
+	case "zstandard":
+		data, err = a.zstd.DecodeAll(data, nil)
+	}
+	if err != nil {
+		return fmt.Errorf("decompressing avro block: %w", err)
+	}
+	a.block.rd = bufio.NewReader(bytes.NewReader(data))
+	a.remaining = count
+	return nil
+}
+
+func (a *AvroFormatReader) Close() error {
+	if a.zstd != nil {
+		a.zstd.Close()
+	}
+	return nil
+}
+
+// avroRegistrySchemas caches the schemas of a registry by url and id, the schema of an id never changes
+var avroRegistrySchemas sync.Map
+
+var avroRegistryClient = &http.Client{Timeout: 10 * time.Second}
+
+// fetchAvroRegistrySchema returns the schema of id from a confluent schema registry
+func fetchAvroRegistrySchema(registry string, id uint32) (*avroSchema, error) {
+	key := fmt.Sprintf("%s#%d", registry, id)
+	if s, ok := avroRegistrySchemas.Load(key); ok {
+		return s.(*avroSchema), nil
+	}
+	resp, err := avroRegistryClient.Get(fmt.Sprintf("%s/schemas/ids/%d", strings.TrimRight(registry, "/"), id))
+	if err != nil {
+		return nil, fmt.Errorf("fetching avro schema %d: %w", id, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("fetching avro schema %d: %s %s", id, resp.Status, strings.TrimSpace(string(body)))
+	}
+	var body struct {
+		Schema string `json:"schema"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("fetching avro schema %d: %w", id, err)
+	}
+	s, err := parseAvroSchema([]byte(body.Schema))
+	if err != nil {
+		return nil, err
+	}
+	avroRegistrySchemas.Store(key, s)
+	return s, nil
+}
+
+// AvroConfluentFormatReader reads the messages of the confluent wire format, a zero byte, the schema id in 4 bytes
+// and the record, the schemas are fetched from the registry
+type AvroConfluentFormatReader struct {
+	columnNames []string
+	columnTypes []string
+	registry    string
+	decoder     avroDecoder
+	readers     map[uint32]*avroRecordReader
+}
+
+func newAvroConfluentFormatReader(columnNames, columnTypes []string, reader io.Reader, registry string) (ClickhouseFormatReader, error) {
+	if registry == "" {
+		return nil, fmt.Errorf("AvroConfluent requires the %s setting", avroSchemaRegistrySetting)
+	}
+	return &AvroConfluentFormatReader{
+		columnNames: columnNames,
+		columnTypes: columnTypes,
+		registry:    registry,
+		decoder:     avroDecoder{rd: bufio.NewReader(reader)},
+		readers:     make(map[uint32]*avroRecordReader),
+	}, nil
+}
+
+func (a *AvroConfluentFormatReader) Read(values []driver.Value) error {
+	magic, err := a.decoder.rd.ReadByte()
+	if err != nil {
+		return err
+	}
+	if magic != 0 {
+		return fmt.Errorf("invalid avro confluent magic byte %d", magic)
+	}
+	b, err := a.decoder.fixed(4)
+	if err != nil {
+		return err
+	}
+	id := binary.BigEndian.Uint32(b)
+	records, ok := a.readers[id]
+	if !ok {
+		schema, err := fetchAvroRegistrySchema(a.registry, id)
+		if err != nil {
+			return err
+		}
+		if records, err = newAvroRecordReader(a.columnNames, a.columnTypes, schema); err != nil {
+			return err
+		}
+		a.readers[id] = records
+	}
+	return records.read(&a.decoder, values)
+}
+
+func (a *AvroConfluentFormatReader) Close() error {
+	return nil
+}
@@ -0,0 +1,78 @@
+package duckserver
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"strings"
+)
+
+// rowDefault stands for the omitted field of a column whose default is evaluated per row, like now() or nextval()
+type rowDefault struct {
+	expr string
+	typ  string
+}
+
+// rowDefaults evaluates the defaults of the omitted fields which aren't constants, a nil rowDefaults has none
+type rowDefaults struct {
+	conn    *sql.DB
+	columns []int
+}
+
+// Fill replaces the omitted fields of a row read with the evaluated defaults of their columns
+func (d *rowDefaults) Fill(ctx context.Context, values []driver.Value) error {
+	if d == nil {
+		return nil
+	}
+	for _, i := range d.columns {
+		def, ok := values[i].(rowDefault)
+		if !ok {
+			continue
+		}
+		var text sql.NullString
+		if err := d.conn.QueryRowContext(ctx, "select "+def.expr).Scan(&text); err != nil {
+			return err
+		}
+		if !text.Valid {
+			values[i] = nil
+			continue
+		}
+		value, err := convertInputText(text.String, def.typ)
+		if err != nil {
+			return err
+		}
+		values[i] = value
+	}
+	return nil
+}
+
+// generatedColumns returns the generated columns of a table, which are computed and can't be inserted. DuckDB
+// only tells them apart in the DDL of the table
+func generatedColumns(ctx context.Context, conn *sql.DB, schema, table string) (map[string]bool, error) {
+	var ddl string
+	err := conn.QueryRowContext(ctx, "select sql from duckdb_tables() where database_name = current_database() and schema_name = $1 and table_name = $2",
+		schema, table).Scan(&ddl)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	generated := make(map[string]bool)
+	for _, t := range chTokenize(ddl) {
+		if !strings.HasPrefix(t.text, "(") {
+			continue
+		}
+		for _, column := range splitTopLevel(t.text[1 : len(t.text)-1]) {
+			tokens := chTokenize(column)
+			for i := 1; i+2 < len(tokens); i++ {
+				if strings.EqualFold(tokens[i].text, "GENERATED") && strings.EqualFold(tokens[i+1].text, "ALWAYS") && strings.EqualFold(tokens[i+2].text, "AS") {
+					generated[chUnquote(tokens[0].text)] = true
+					break
+				}
+			}
+		}
+		break
+	}
+	return generated, nil
+}
@@ -0,0 +1,210 @@
+package duckserver
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultChSessionTimeout is how long a clickhouse session keeps its database without requests, like clickhouse
+const defaultChSessionTimeout = 60 * time.Second
+
+var chUseRegexp = regexp.MustCompile(`(?i)^\s*USE\s+("[^"]+"|` + "`[^`]+`" + `|\w+)\s*;?\s*$`)
+
+// waitForFlushSetting makes a request of a session wait for the async inserts the session acknowledged before their
+// flush, so it reads its own writes
+const waitForFlushSetting = "wait_for_flush"
+
+// chSession is the state of a clickhouse session_id, the database selected with USE and the async inserts
+// acknowledged before their flush
+type chSession struct {
+	user        string
+	application string
+	started     time.Time
+	mu          sync.Mutex
+	database    string
+	expires     time.Time
+	pending     []*asyncInsertBatch
+}
+
+// addPending records an async insert of the session acknowledged before its flush
+func (s *chSession) addPending(batch *asyncInsertBatch) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending = slices.DeleteFunc(s.pending, (*asyncInsertBatch).flushed)
+	if !slices.Contains(s.pending, batch) {
+		s.pending = append(s.pending, batch)
+	}
+}
+
+// waitPending flushes the async inserts of the session not flushed yet and waits for them, the error is the first
+// failed flush
+func (c *ChServer) waitPending(ctx context.Context, s *chSession) error {
+	s.mu.Lock()
+	pending := s.pending
+	s.pending = nil
+	s.mu.Unlock()
+	var firstErr error
+	for _, batch := range pending {
+		if err := c.asyncInserts.Wait(ctx, batch); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+type databaseContextKey struct{}
+type chSessionContextKey struct{}
+
+func withDatabase(ctx context.Context, database string) context.Context {
+	return context.WithValue(ctx, databaseContextKey{}, database)
+}
+
+func databaseFromContext(ctx context.Context) string {
+	database, _ := ctx.Value(databaseContextKey{}).(string)
+	return database
+}
+
+func withChSession(ctx context.Context, session *chSession) context.Context {
+	return context.WithValue(ctx, chSessionContextKey{}, session)
+}
+
+func chSessionFromContext(ctx context.Context) *chSession {
+	session, _ := ctx.Value(chSessionContextKey{}).(*chSession)
+	return session
+}
+
+// session returns the session of the session_id of a request, a new one when it doesn't exist or expired,
+// nil without session_id
+func (c *ChServer) session(r *http.Request, user, application string) (*chSession, error) {
+	id := r.URL.Query().Get("session_id")
+	if id == "" {
+		return nil, nil
+	}
+	timeout := defaultChSessionTimeout
+	if s := r.URL.Query().Get("session_timeout"); s != "" {
+		seconds, err := strconv.Atoi(s)
+		if err != nil || seconds <= 0 {
+			return nil, fmt.Errorf("invalid session_timeout %s", s)
+		}
+		timeout = time.Duration(seconds) * time.Second
+	}
+	now := time.Now()
+	if v, ok := c.sessions.Load(id); ok {
+		session := v.(*chSession)
+		if session.user != user {
+			return nil, fmt.Errorf("session %s is locked by another user", id)
+		}
+		session.mu.Lock()
+		alive := now.Before(session.expires)
+		if alive {
+			session.expires = now.Add(timeout)
+		}
+		session.mu.Unlock()
+		if alive {
+			return session, nil
+		}
+	}
+	// expired sessions are dropped when a session starts, sessions are only created by their requests
+	c.sessions.Range(func(key, value any) bool {
+		session := value.(*chSession)
+		session.mu.Lock()
+		expired := now.After(session.expires)
+		session.mu.Unlock()
+		if expired {
+			c.sessions.Delete(key)
+		}
+		return true
+	})
+	session := &chSession{user: user, application: application, started: now, expires: now.Add(timeout)}
+	c.sessions.Store(id, session)
+	return session, nil
+}
+
+// requestDatabase returns the database of a clickhouse request, set with the database setting or the
+// X-ClickHouse-Database header, or with USE in the session of the request. It is a DuckDB schema, empty for default
+func requestDatabase(r *http.Request, session *chSession) string {
+	database := r.URL.Query().Get("database")
+	if database == "" {
+		database = r.Header.Get("X-ClickHouse-Database")
+	}
+	if database == "" && session != nil {
+		session.mu.Lock()
+		database = session.database
+		session.mu.Unlock()
+	}
+	if database == "default" {
+		return ""
+	}
+	return database
+}
+
+// use runs USE db, the database is kept in the session of the request for its next requests
+func (c *ChServer) use(ctx context.Context, database string, wr http.ResponseWriter) {
+	session := chSessionFromContext(ctx)
+	if session == nil {
+		wr.WriteHeader(400)
+		_, _ = fmt.Fprintf(wr, "USE requires a session_id, or set the database setting or the X-ClickHouse-Database header")
+		return
+	}
+	database = strings.Trim(database, "\"`")
+	if database != "default" {
+		var count int
+		if err := c.conn.QueryRowContext(ctx, "select count(*) from duckdb_schemas() where database_name = current_database() and schema_name = $1", database).Scan(&count); err != nil {
+			wr.WriteHeader(500)
+			_, _ = fmt.Fprintf(wr, "Error looking up database: %s", err)
+			return
+		}
+		if count == 0 {
+			wr.WriteHeader(404)
+			_, _ = fmt.Fprintf(wr, "Database %s does not exist", database)
+			return
+		}
+	}
+	session.mu.Lock()
+	session.database = database
+	session.mu.Unlock()
+	wr.WriteHeader(200)
+}
+
+// databaseConn returns a dedicated connection with the search_path set to the database of the request,
+// release resets the search_path and returns the connection to the pool
+func (c *ChServer) databaseConn(ctx context.Context) (*sql.Conn, func(), error) {
+	conn, err := c.conn.Conn(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	database := databaseFromContext(ctx)
+	if database == "" {
+		return conn, func() { _ = conn.Close() }, nil
+	}
+	if _, err = conn.ExecContext(ctx, "SET search_path = "+quoteLiteral(quoteIdent(database))); err != nil {
+		_ = conn.Close()
+		return nil, nil, err
+	}
+	return conn, func() {
+		if _, err := conn.ExecContext(context.Background(), "SET search_path = ''"); err != nil {
+			// a connection left with the request search_path is discarded instead of returned to the pool
+			logrus.Warnf("reset search_path error: %v", err)
+			_ = conn.Raw(func(any) error { return driver.ErrBadConn })
+		}
+		_ = conn.Close()
+	}, nil
+}
+
+// requestQueryer returns the connection pool, or a dedicated connection when the request selects a database
+func (c *ChServer) requestQueryer(ctx context.Context) (sqlQueryer, func(), error) {
+	if databaseFromContext(ctx) == "" {
+		return c.conn, func() {}, nil
+	}
+	return c.databaseConn(ctx)
+}
@@ -0,0 +1,613 @@
+package duckserver
+
+import (
+	"context"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const chIdentPattern = `(?:"[^"]+"|` + "`[^`]+`" + `|\w+)`
+
+var chCreateTableRegexp = regexp.MustCompile(`(?is)^\s*CREATE\s+(OR\s+REPLACE\s+)?TABLE\s+(IF\s+NOT\s+EXISTS\s+)?(?:(` + chIdentPattern + `)\.)?(` + chIdentPattern + `)(?:\s+ON\s+CLUSTER\s+` + chIdentPattern + `)?(.*?)[\s;]*$`)
+var chDropTableRegexp = regexp.MustCompile(`(?is)^\s*DROP\s+TABLE\s+(?:IF\s+EXISTS\s+)?(?:(` + chIdentPattern + `)\.)?(` + chIdentPattern + `)[\s;]*$`)
+var chExchangeTablesRegexp = regexp.MustCompile(`(?is)^\s*EXCHANGE\s+TABLES\s+(?:(` + chIdentPattern + `)\.)?(` + chIdentPattern + `)\s+AND\s+(?:(` + chIdentPattern + `)\.)?(` + chIdentPattern + `)(?:\s+ON\s+CLUSTER\s+` + chIdentPattern + `)?[\s;]*$`)
+var chRenameTableRegexp = regexp.MustCompile(`(?is)^\s*RENAME\s+TABLE\s+(.*?)(?:\s+ON\s+CLUSTER\s+` + chIdentPattern + `)?[\s;]*$`)
+var chRenamePairRegexp = regexp.MustCompile(`(?is)^(?:(` + chIdentPattern + `)\.)?(` + chIdentPattern + `)\s+TO\s+(?:(` + chIdentPattern + `)\.)?(` + chIdentPattern + `)$`)
+
+// chSimpleTypes are the clickhouse types without parameters and their DuckDB types
+var chSimpleTypes = map[string]string{
+	"String":   "VARCHAR",
+	"Bool":     "BOOLEAN",
+	"Int8":     "TINYINT",
+	"Int16":    "SMALLINT",
+	"Int32":    "INTEGER",
+	"Int64":    "BIGINT",
+	"Int128":   "HUGEINT",
+	"UInt8":    "UTINYINT",
+	"UInt16":   "USMALLINT",
+	"UInt32":   "UINTEGER",
+	"UInt64":   "UBIGINT",
+	"UInt128":  "UHUGEINT",
+	"Float32":  "FLOAT",
+	"Float64":  "DOUBLE",
+	"Date":     "DATE",
+	"Date32":   "DATE",
+	"DateTime": "TIMESTAMP",
+	"UUID":     "UUID",
+	"IPv4":     "VARCHAR",
+	"IPv6":     "VARCHAR",
+	"JSON":     "JSON",
+}
+
+// chColumnKeywords start the parts of a column definition following its type
+var chColumnKeywords = map[string]bool{
+	"DEFAULT": true, "MATERIALIZED": true, "ALIAS": true, "EPHEMERAL": true, "CODEC": true, "TTL": true,
+	"COMMENT": true, "NOT": true, "NULL": true, "PRIMARY": true, "UNIQUE": true, "CHECK": true, "REFERENCES": true,
+	"GENERATED": true, "AS": true, "COLLATE": true,
+}
+
+// chTableKeywords start the clauses following the columns of a clickhouse CREATE TABLE
+var chTableKeywords = map[string]bool{
+	"ENGINE": true, "ORDER": true, "PARTITION": true, "PRIMARY": true, "SAMPLE": true, "TTL": true,
+	"SETTINGS": true, "COMMENT": true, "AS": true, "EMPTY": true,
+}
+
+// chTableDDL is a clickhouse CREATE TABLE translated to DuckDB with the clickhouse metadata of the table
+type chTableDDL struct {
+	query        string
+	schema       string
+	table        string
+	ifNotExists  bool
+	engine       string
+	sortingKey   string
+	partitionKey string
+	primaryKey   string
+	ttl          string
+	createQuery  string
+	// columns are the translated column definitions of a table created without a source
+	columns string
+	// columnTypes are the clickhouse types of the columns
+	columnTypes map[string]string
+}
+
+// chToken is a word, a quoted string, a parenthesized group or a symbol of a statement
+type chToken struct {
+	text       string
+	start, end int
+}
+
+func isChIdentByte(ch byte) bool {
+	return ch == '_' || ch >= '0' && ch <= '9' || ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z'
+}
+
+func skipChQuoted(s string, i int) int {
+	q := s[i]
+	for i++; i < len(s); i++ {
+		switch {
+		case s[i] == '\\':
+			i++
+		case s[i] == q && i+1 < len(s) && s[i+1] == q:
+			i++
+		case s[i] == q:
+			return i + 1
+		}
+	}
+	return len(s)
+}
+
+func skipChParens(s string, i int) int {
+	depth := 0
+	for i < len(s) {
+		switch s[i] {
+		case '\'', '"', '`':
+			i = skipChQuoted(s, i)
+			continue
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return i + 1
+			}
+		}
+		i++
+	}
+	return len(s)
+}
+
+// chTokenize splits a statement into tokens, a parenthesized group is a single token and comments are skipped
+func chTokenize(s string) []chToken {
+	var tokens []chToken
+	for i := 0; i < len(s); {
+		start := i
+		switch ch := s[i]; {
+		case ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r':
+			i++
+			continue
+		case strings.HasPrefix(s[i:], "--"):
+			// comments, like the hints of a query, aren't tokens
+			if end := strings.IndexByte(s[i:], '\n'); end >= 0 {
+				i += end
+			} else {
+				i = len(s)
+			}
+			continue
+		case strings.HasPrefix(s[i:], "/*"):
+			if end := strings.Index(s[i+2:], "*/"); end >= 0 {
+				i += end + 4
+			} else {
+				i = len(s)
+			}
+			continue
+		case ch == '\'' || ch == '"' || ch == '`':
+			i = skipChQuoted(s, i)
+		case ch == '(':
+			i = skipChParens(s, i)
+		case isChIdentByte(ch):
+			for i < len(s) && isChIdentByte(s[i]) {
+				i++
+			}
+		default:
+			i++
+		}
+		tokens = append(tokens, chToken{s[start:i], start, i})
+	}
+	return tokens
+}
+
+// splitTopLevel splits s on the commas outside of parentheses and quotes
+func splitTopLevel(s string) []string {
+	var parts []string
+	start := 0
+	for _, t := range chTokenize(s) {
+		if t.text == "," {
+			parts = append(parts, strings.TrimSpace(s[start:t.start]))
+			start = t.end
+		}
+	}
+	return append(parts, strings.TrimSpace(s[start:]))
+}
+
+func chUnquote(s string) string {
+	if len(s) >= 2 && (s[0] == '`' || s[0] == '"') && s[len(s)-1] == s[0] {
+		return strings.ReplaceAll(s[1:len(s)-1], s[:1]+s[:1], s[:1])
+	}
+	return s
+}
+
+// chTableName quotes a clickhouse table name for DuckDB, the default database is the main schema
+func chTableName(schema, table string) string {
+	switch schema {
+	case "":
+		return quoteIdent(table)
+	case "default":
+		schema = "main"
+	}
+	return quoteIdent(schema) + "." + quoteIdent(table)
+}
+
+// translateChType maps a clickhouse type to DuckDB, other types are taken as DuckDB types
+func translateChType(t string) string {
+	t = strings.TrimSpace(t)
+	name, args := t, []string(nil)
+	if i := strings.Index(t, "("); i > 0 && strings.HasSuffix(t, ")") {
+		name, args = strings.TrimSpace(t[:i]), splitTopLevel(t[i+1:len(t)-1])
+	}
+	if duckType, ok := chSimpleTypes[name]; ok && args == nil {
+		return duckType
+	}
+	switch {
+	case (name == "Nullable" || name == "LowCardinality") && len(args) == 1:
+		return translateChType(args[0])
+	case name == "SimpleAggregateFunction" && len(args) == 2:
+		return translateChType(args[1])
+	case name == "Array" && len(args) == 1:
+		return translateChType(args[0]) + "[]"
+	case name == "Map" && len(args) == 2:
+		return fmt.Sprintf("MAP(%s, %s)", translateChType(args[0]), translateChType(args[1]))
+	case name == "Tuple" && len(args) > 0:
+		fields := make([]string, len(args))
+		for i, arg := range args {
+			// unnamed elements are named by their position, t.1 in clickhouse
+			field, typ := strconv.Itoa(i+1), arg
+			if tokens := chTokenize(arg); len(tokens) > 1 && !strings.HasPrefix(tokens[1].text, "(") {
+				field, typ = chUnquote(tokens[0].text), arg[tokens[1].start:]
+			}
+			fields[i] = quoteIdent(field) + " " + translateChType(typ)
+		}
+		return "STRUCT(" + strings.Join(fields, ", ") + ")"
+	case name == "FixedString":
+		return "VARCHAR"
+	case name == "DateTime" && len(args) == 1:
+		return "TIMESTAMPTZ"
+	case name == "DateTime64" && len(args) > 0:
+		if len(args) > 1 {
+			return "TIMESTAMPTZ"
+		}
+		if precision, err := strconv.Atoi(args[0]); err == nil && precision > 6 {
+			return "TIMESTAMP_NS"
+		}
+		return "TIMESTAMP"
+	case name == "Decimal" && len(args) == 1:
+		return fmt.Sprintf("DECIMAL(%s,0)", args[0])
+	case name == "Decimal" && len(args) == 2:
+		return fmt.Sprintf("DECIMAL(%s,%s)", args[0], args[1])
+	case name == "Decimal32" && len(args) == 1:
+		return fmt.Sprintf("DECIMAL(9,%s)", args[0])
+	case name == "Decimal64" && len(args) == 1:
+		return fmt.Sprintf("DECIMAL(18,%s)", args[0])
+	case name == "Decimal128" && len(args) == 1:
+		return fmt.Sprintf("DECIMAL(38,%s)", args[0])
+	case name == "Enum8" || name == "Enum16" || name == "Enum":
+		// the values of clickhouse enums are numbered, 'a' = 1, DuckDB enums only have the names
+		values := make([]string, len(args))
+		for i, arg := range args {
+			values[i] = arg
+			if tokens := chTokenize(arg); len(tokens) > 0 {
+				values[i] = tokens[0].text
+			}
+		}
+		return "ENUM(" + strings.Join(values, ", ") + ")"
+	}
+	return t
+}
+
+// translateChColumns translates the column definitions of a CREATE TABLE, the indexes and projections are dropped
+// and the primary key is kept in ddl as clickhouse primary keys are not unique. changed reports clickhouse syntax
+func translateChColumns(ddl *chTableDDL, body string) (defs []string, changed bool) {
+	ddl.columnTypes = make(map[string]string)
+	for _, def := range splitTopLevel(body) {
+		tokens := chTokenize(def)
+		if len(tokens) == 0 {
+			continue
+		}
+		switch strings.ToUpper(tokens[0].text) {
+		case "INDEX", "PROJECTION":
+			changed = true
+			continue
+		case "PRIMARY":
+			if len(tokens) > 1 && strings.EqualFold(tokens[1].text, "KEY") {
+				ddl.primaryKey = strings.TrimSpace(def[tokens[1].end:])
+				continue
+			}
+		case "CONSTRAINT":
+			if len(tokens) > 2 && strings.EqualFold(tokens[2].text, "ASSUME") {
+				changed = true
+				continue
+			}
+			defs = append(defs, def)
+			continue
+		}
+		// the parts of the definition start at keywords, the type is what precedes the first one
+		var starts []int
+		for i := 1; i < len(tokens); i++ {
+			if chColumnKeywords[strings.ToUpper(tokens[i].text)] {
+				starts = append(starts, i)
+			}
+		}
+		typeEnd := len(def)
+		if len(starts) > 0 {
+			typeEnd = tokens[starts[0]].start
+		}
+		name := chUnquote(tokens[0].text)
+		column := quoteIdent(name)
+		if len(tokens) > 1 && tokens[1].start < typeEnd {
+			typ := strings.TrimSpace(def[tokens[1].start:typeEnd])
+			ddl.columnTypes[name] = typ
+			duckType := translateChType(typ)
+			changed = changed || duckType != typ
+			column += " " + duckType
+		}
+		for i, start := range starts {
+			end := len(def)
+			if i+1 < len(starts) {
+				end = tokens[starts[i+1]].start
+			}
+			value := strings.TrimSpace(def[tokens[start].end:end])
+			switch strings.ToUpper(tokens[start].text) {
+			case "MATERIALIZED":
+				column += " DEFAULT " + value
+				changed = true
+			case "ALIAS":
+				column += " GENERATED ALWAYS AS (" + value + ")"
+				changed = true
+			case "EPHEMERAL", "CODEC", "TTL", "COMMENT":
+				changed = true
+			case "PRIMARY":
+			default:
+				column += " " + strings.TrimSpace(def[tokens[start].start:end])
+			}
+		}
+		defs = append(defs, column)
+	}
+	return defs, changed
+}
+
+// translateChCreateTable translates a clickhouse CREATE TABLE to DuckDB: the ENGINE, ORDER BY, PARTITION BY,
+// SETTINGS and the other table clauses are dropped and the types are mapped. It reports false for a CREATE TABLE
+// without clickhouse syntax, which is run as it is
+func translateChCreateTable(query string) (*chTableDDL, bool) {
+	m := chCreateTableRegexp.FindStringSubmatch(query)
+	if m == nil {
+		return nil, false
+	}
+	ddl := &chTableDDL{
+		schema:      chUnquote(m[3]),
+		table:       chUnquote(m[4]),
+		ifNotExists: m[2] != "",
+		createQuery: strings.TrimRight(strings.TrimSpace(query), "; \t\r\n"),
+	}
+	rest := m[5]
+	var defs []string
+	changed := false
+	if trimmed := strings.TrimLeft(rest, " \t\r\n"); strings.HasPrefix(trimmed, "(") {
+		end := skipChParens(trimmed, 0)
+		defs, changed = translateChColumns(ddl, trimmed[1:end-1])
+		rest = trimmed[end:]
+	}
+	var source, from string
+	empty := false
+	tokens := chTokenize(rest)
+	for i := 0; i < len(tokens); i++ {
+		keyword := strings.ToUpper(tokens[i].text)
+		if !chTableKeywords[keyword] {
+			continue
+		}
+		if keyword == "AS" && i+1 < len(tokens) {
+			next := tokens[i+1].text
+			if strings.EqualFold(next, "SELECT") || strings.EqualFold(next, "WITH") || strings.HasPrefix(next, "(") {
+				source = strings.TrimSpace(rest[tokens[i].end:])
+				break
+			}
+			// AS db.table copies the structure of the table
+			from = chTableName("", chUnquote(next))
+			if i+3 < len(tokens) && tokens[i+2].text == "." {
+				from = chTableName(chUnquote(next), chUnquote(tokens[i+3].text))
+				i += 2
+			}
+			i++
+			continue
+		}
+		if keyword == "EMPTY" {
+			empty = true
+			continue
+		}
+		start := tokens[i].end
+		if i+1 < len(tokens) && (strings.EqualFold(tokens[i+1].text, "BY") || strings.EqualFold(tokens[i+1].text, "KEY")) {
+			i++
+			start = tokens[i].end
+		}
+		end := len(rest)
+		for j := i + 1; j < len(tokens); j++ {
+			if chTableKeywords[strings.ToUpper(tokens[j].text)] {
+				end = tokens[j].start
+				break
+			}
+		}
+		value := strings.TrimSpace(rest[start:end])
+		switch keyword {
+		case "ENGINE":
+			ddl.engine = strings.TrimSpace(strings.TrimPrefix(value, "="))
+		case "ORDER":
+			ddl.sortingKey = value
+		case "PARTITION":
+			ddl.partitionKey = value
+		case "PRIMARY":
+			ddl.primaryKey = value
+		case "TTL":
+			ddl.ttl = value
+		}
+	}
+	if ddl.engine == "" && ddl.sortingKey == "" && ddl.partitionKey == "" && !changed {
+		return nil, false
+	}
+	name := chTableName(ddl.schema, ddl.table)
+	head := "CREATE "
+	if m[1] != "" {
+		head += "OR REPLACE "
+	}
+	head += "TABLE "
+	if ddl.ifNotExists {
+		head += "IF NOT EXISTS "
+	}
+	head += name
+	if empty && source != "" {
+		source = "SELECT * FROM (" + source + ") LIMIT 0"
+	}
+	switch {
+	case from != "":
+		ddl.query = head + " AS SELECT * FROM " + from + " LIMIT 0"
+	case source != "" && defs != nil:
+		ddl.query = head + " (" + strings.Join(defs, ", ") + "); INSERT INTO " + name + " " + source
+	case source != "":
+		ddl.query = head + " AS " + source
+	default:
+		ddl.columns = strings.Join(defs, ", ")
+		ddl.query = head + " (" + ddl.columns + ")"
+	}
+	return ddl, true
+}
+
+// dedupKey returns the sorting key columns of a ReplacingMergeTree table, which are its dedup key
+func (ddl *chTableDDL) dedupKey() []string {
+	engine := ddl.engine
+	if i := strings.Index(engine, "("); i >= 0 {
+		engine = engine[:i]
+	}
+	if !strings.HasSuffix(strings.TrimSpace(engine), "ReplacingMergeTree") || ddl.sortingKey == "" {
+		return nil
+	}
+	key := strings.TrimSpace(ddl.sortingKey)
+	if strings.HasPrefix(key, "(") && strings.HasSuffix(key, ")") {
+		key = key[1 : len(key)-1]
+	}
+	var columns []string
+	for _, col := range splitTopLevel(key) {
+		tokens := chTokenize(col)
+		if len(tokens) != 1 || strings.HasPrefix(tokens[0].text, "(") || strings.HasPrefix(tokens[0].text, "'") {
+			return nil
+		}
+		columns = append(columns, chUnquote(tokens[0].text))
+	}
+	return columns
+}
+
+// chSchema returns the DuckDB schema of a clickhouse database, the database of the request when empty
+func chSchema(ctx context.Context, schema string) string {
+	if schema == "" {
+		schema = databaseFromContext(ctx)
+	}
+	if schema == "" || schema == "default" {
+		return "main"
+	}
+	return schema
+}
+
+// recordChTable keeps the clickhouse metadata of a created table in duckserver.ch_tables for SHOW CREATE TABLE,
+// the sorting key of a ReplacingMergeTree table becomes its dedup key and its TTL a ttl policy
+func (c *ChServer) recordChTable(ctx context.Context, ddl *chTableDDL) error {
+	insert := "insert or replace"
+	if ddl.ifNotExists {
+		insert = "insert or ignore"
+	}
+	schema := chSchema(ctx, ddl.schema)
+	if _, err := c.conn.ExecContext(ctx, insert+" into duckserver.ch_tables (schema_name, table_name, engine, sorting_key, partition_key, primary_key, create_table_query) values ($1, $2, $3, $4, $5, $6, $7)",
+		schema, ddl.table, ddl.engine, ddl.sortingKey, ddl.partitionKey, ddl.primaryKey, ddl.createQuery); err != nil {
+		return err
+	}
+	if key := ddl.dedupKey(); key != nil {
+		if _, err := c.conn.ExecContext(ctx, insert+" into duckserver.dedup_keys (schema_name, table_name, key_columns) values ($1, $2, $3)",
+			schema, ddl.table, strings.Join(key, ",")); err != nil {
+			return err
+		}
+	}
+	if ddl.ttl != "" {
+		column, retention, ok := parseChTTL(ddl.ttl)
+		if !ok {
+			logrus.Warnf("ttl %s of %s.%s isn't supported, only column + INTERVAL n unit", ddl.ttl, schema, ddl.table)
+			return nil
+		}
+		if _, err := c.conn.ExecContext(ctx, insert+" into duckserver.ttl_policies (schema_name, table_name, time_column, retention) values ($1, $2, $3, cast($4 as interval))",
+			schema, ddl.table, column, retention); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// forgetChTable removes the metadata of a dropped table
+func (c *ChServer) forgetChTable(ctx context.Context, schema, table string) error {
+	schema = chSchema(ctx, schema)
+	for _, stmt := range []string{
+		"delete from duckserver.ch_tables where schema_name = $1 and table_name = $2",
+		"delete from duckserver.dedup_keys where schema_name = $1 and table_name = $2",
+		"delete from duckserver.ttl_policies where schema_name = $1 and table_name = $2",
+	} {
+		if _, err := c.conn.ExecContext(ctx, stmt, schema, table); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// chRename is a table renamed by RENAME TABLE or EXCHANGE TABLES
+type chRename struct {
+	schema, from, to string
+}
+
+// renameTables runs RENAME TABLE a TO b, c TO d as ALTER TABLE ... RENAME TO of DuckDB, which can't move a table
+// to another schema
+func (c *ChServer) renameTables(ctx context.Context, query, list string, wr http.ResponseWriter) {
+	var renames []chRename
+	for _, pair := range splitTopLevel(list) {
+		m := chRenamePairRegexp.FindStringSubmatch(pair)
+		if m == nil {
+			wr.WriteHeader(400)
+			_, _ = fmt.Fprintf(wr, "Invalid RENAME TABLE: %s", pair)
+			return
+		}
+		schema := chSchema(ctx, chUnquote(m[1]))
+		if chSchema(ctx, chUnquote(m[3])) != schema {
+			wr.WriteHeader(400)
+			_, _ = fmt.Fprintf(wr, "RENAME TABLE to another database is not supported")
+			return
+		}
+		renames = append(renames, chRename{schema, chUnquote(m[2]), chUnquote(m[4])})
+	}
+	c.runRenames(ctx, query, renames, wr)
+}
+
+// exchangeTables runs EXCHANGE TABLES a AND b as three renames in a transaction
+func (c *ChServer) exchangeTables(ctx context.Context, query string, m []string, wr http.ResponseWriter) {
+	schema := chSchema(ctx, chUnquote(m[1]))
+	if chSchema(ctx, chUnquote(m[3])) != schema {
+		wr.WriteHeader(400)
+		_, _ = fmt.Fprintf(wr, "EXCHANGE TABLES of different databases is not supported")
+		return
+	}
+	a, b := chUnquote(m[2]), chUnquote(m[4])
+	tmp := a + "_exchange_" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	c.runRenames(ctx, query, []chRename{{schema, a, tmp}, {schema, b, a}, {schema, tmp, b}}, wr)
+}
+
+// runRenames renames the tables in a transaction, their clickhouse metadata is moved to pending names in the same
+// transaction and to the new names in a second one, as DuckDB can't reuse a key deleted in the same transaction
+func (c *ChServer) runRenames(ctx context.Context, query string, renames []chRename, wr http.ResponseWriter) {
+	// the metadata moves from the original name of a table to its final name
+	type chTableKey struct{ schema, table string }
+	original := map[chTableKey]string{}
+	for _, r := range renames {
+		name, ok := original[chTableKey{r.schema, r.from}]
+		if !ok {
+			name = r.from
+		}
+		delete(original, chTableKey{r.schema, r.from})
+		original[chTableKey{r.schema, r.to}] = name
+	}
+	tx, err := c.conn.BeginTx(ctx, nil)
+	if err != nil {
+		wr.WriteHeader(500)
+		_, _ = fmt.Fprintf(wr, "Error beginning transaction: %s", err)
+		return
+	}
+	defer func() { _ = tx.Rollback() }()
+	for _, r := range renames {
+		if _, err = tx.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s.%s RENAME TO %s", quoteIdent(r.schema), quoteIdent(r.from), quoteIdent(r.to))); err != nil {
+			wr.WriteHeader(500)
+			_, _ = fmt.Fprintf(wr, "Error executing query: %s", err)
+			return
+		}
+	}
+	const pending = "\x1frenaming"
+	metadata := []string{"duckserver.ch_tables", "duckserver.dedup_keys", "duckserver.ttl_policies"}
+	for key, from := range original {
+		for _, table := range metadata {
+			if _, err = tx.ExecContext(ctx, "update "+table+" set table_name = $3 where schema_name = $1 and table_name = $2", key.schema, from, key.table+pending); err != nil {
+				wr.WriteHeader(500)
+				_, _ = fmt.Fprintf(wr, "Error recording table metadata: %s", err)
+				return
+			}
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		wr.WriteHeader(500)
+		_, _ = fmt.Fprintf(wr, "Error committing transaction: %s", err)
+		return
+	}
+	c.pgServer.notifySchemaChange(query)
+	for key := range original {
+		for _, table := range metadata {
+			if _, err = c.conn.ExecContext(ctx, "update "+table+" set table_name = $3 where schema_name = $1 and table_name = $2", key.schema, key.table+pending, key.table); err != nil {
+				wr.WriteHeader(500)
+				_, _ = fmt.Fprintf(wr, "Error recording table metadata: %s", err)
+				return
+			}
+		}
+	}
+	wr.WriteHeader(200)
+}
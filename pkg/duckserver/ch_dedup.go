@@ -0,0 +1,88 @@
+package duckserver
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// lookupDedupKey returns the dedup key columns declared for the table in duckserver.dedup_keys,
+// tables with a dedup key behave like ReplacingMergeTree: inserted rows replace existing rows with the same key
+func (c *ChServer) lookupDedupKey(ctx context.Context, schema, table string) ([]string, error) {
+	var key string
+	err := c.conn.QueryRowContext(ctx, "select key_columns from duckserver.dedup_keys where schema_name = $1 and table_name = $2", schema, table).Scan(&key)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	columns := make([]string, 0)
+	for _, col := range strings.Split(key, ",") {
+		if col = strings.TrimSpace(col); col != "" {
+			columns = append(columns, col)
+		}
+	}
+	return columns, nil
+}
+
+func quoteIdent(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
+
+func quoteIdents(cols []string) string {
+	quoted := make([]string, len(cols))
+	for i, col := range cols {
+		quoted[i] = quoteIdent(col)
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// createStagingTable creates an empty staging table in duckserver schema with the inserted columns of the target table,
+// its name starts with prefix
+func createStagingTable(ctx context.Context, execer driver.ExecerContext, prefix, schema, table string, columns []string) (string, error) {
+	suffix := make([]byte, 8)
+	_, _ = rand.Read(suffix)
+	staging := prefix + hex.EncodeToString(suffix)
+	_, err := execer.ExecContext(ctx, fmt.Sprintf("create table duckserver.%s as select %s from %s.%s limit 0",
+		quoteIdent(staging), quoteIdents(columns), quoteIdent(schema), quoteIdent(table)), nil)
+	return staging, err
+}
+
+// mergeDedupStaging replaces the rows of the target table having the same key as the staged rows,
+// when the same key appears more than once in the batch the last row wins. The staging table is kept.
+func mergeDedupStaging(ctx context.Context, execer driver.ExecerContext, schema, table, staging string, columns, key []string) error {
+	for _, k := range key {
+		found := false
+		for _, col := range columns {
+			if col == k {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("dedup key column %s is not inserted", k)
+		}
+	}
+	target := quoteIdent(schema) + "." + quoteIdent(table)
+	stagingTable := "duckserver." + quoteIdent(staging)
+	conditions := make([]string, len(key))
+	for i, k := range key {
+		conditions[i] = fmt.Sprintf("t.%s = s.%s", quoteIdent(k), quoteIdent(k))
+	}
+	statements := []string{
+		fmt.Sprintf("delete from %s t using %s s where %s", target, stagingTable, strings.Join(conditions, " and ")),
+		fmt.Sprintf("insert into %s (%s) select %s from %s qualify row_number() over (partition by %s order by rowid desc) = 1",
+			target, quoteIdents(columns), quoteIdents(columns), stagingTable, quoteIdents(key)),
+	}
+	for _, stmt := range statements {
+		if _, err := execer.ExecContext(ctx, stmt, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
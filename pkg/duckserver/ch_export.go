@@ -0,0 +1,138 @@
+package duckserver
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// exportPath is the path of the download api of the clickhouse http endpoint
+const exportPath = "/export"
+
+// exportExtensions are the file extensions of the formats of /export
+var exportExtensions = map[string]string{
+	"XLSX":                             "xlsx",
+	"CSV":                              "csv",
+	"CSVWithNames":                     "csv",
+	"TabSeparated":                     "tsv",
+	"TabSeparatedWithNames":            "tsv",
+	"TabSeparatedWithNamesAndTypes":    "tsv",
+	"JSONEachRow":                      "jsonl",
+	"Parquet":                          "parquet",
+	"ORC":                              "orc",
+	"DuckDB":                           "duckdb",
+	"Template":                         "txt",
+	"CustomSeparated":                  "txt",
+	"CustomSeparatedWithNames":         "txt",
+	"CustomSeparatedWithNamesAndTypes": "txt",
+}
+
+var exportFilenameRegexp = regexp.MustCompile(`[^\w.-]+`)
+
+// serveExport answers the select of the query parameter or the body as a file download, in the format parameter or
+// the FORMAT clause of the select, XLSX by default, named after the filename parameter
+func (c *ChServer) serveExport(ctx context.Context, wr http.ResponseWriter, r *http.Request) {
+	d, _ := io.ReadAll(r.Body)
+	query := strings.TrimRight(strings.TrimSpace(r.URL.Query().Get("query")+" "+string(d)), "; \t\r\n")
+	format := "XLSX"
+	if m := selectFormatRegexp.FindStringSubmatch(strings.ReplaceAll(query, "\n", " ")); len(m) > 1 {
+		format = m[1]
+	} else {
+		if f := r.URL.Query().Get("format"); f != "" {
+			format = f
+		}
+		for name := range exportExtensions {
+			if strings.EqualFold(name, format) {
+				format = name
+			}
+		}
+		query += " FORMAT " + format
+	}
+	ext, ok := exportExtensions[format]
+	if !ok {
+		wr.WriteHeader(400)
+		_, _ = fmt.Fprintf(wr, "Unknown export format %s", format)
+		return
+	}
+	filename := exportFilenameRegexp.ReplaceAllString(r.URL.Query().Get("filename"), "_")
+	filename = strings.TrimSuffix(filename, "."+ext)
+	if strings.Trim(filename, "._") == "" {
+		filename = "export"
+	}
+	c.SelectQuery(ctx, query, r.URL.Query(), &exportResponseWriter{
+		ResponseWriter: wr,
+		disposition:    fmt.Sprintf(`attachment; filename="%s.%s"`, filename, ext),
+	})
+}
+
+// exportResponseWriter makes a successful response a download, errors stay plain text responses
+type exportResponseWriter struct {
+	http.ResponseWriter
+	disposition string
+}
+
+func (w *exportResponseWriter) WriteHeader(code int) {
+	if code == http.StatusOK {
+		w.Header().Set("Content-Disposition", w.disposition)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *exportResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// writeDuckDB answers a query in FORMAT DuckDB, the result is created as the table result of a new database file
+// which is sent, for other DuckDB users to attach
+func (c *ChServer) writeDuckDB(ctx context.Context, query string, wr http.ResponseWriter) {
+	dir, err := os.MkdirTemp(c.pgServer.scratchDir, "duckserver-export-*")
+	if err != nil {
+		wr.WriteHeader(500)
+		_, _ = fmt.Fprintf(wr, "Error creating file: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "result.duckdb")
+	suffix := make([]byte, 8)
+	_, _ = rand.Read(suffix)
+	name := "export_" + hex.EncodeToString(suffix)
+	progress := newChProgress()
+	conn, profiled, err := c.profiledConn(ctx, query, wr, progress)
+	if err != nil {
+		wr.WriteHeader(500)
+		_, _ = fmt.Fprintf(wr, "Error getting connection: %s", err)
+		return
+	}
+	// detaching checkpoints the file
+	if _, err = conn.ExecContext(ctx, fmt.Sprintf("ATTACH %s AS %s", quoteLiteral(path), name)); err == nil {
+		_, err = conn.ExecContext(ctx, fmt.Sprintf("CREATE TABLE %s.result AS %s", name, query))
+		if _, detachErr := conn.ExecContext(context.Background(), "DETACH "+name); err == nil {
+			err = detachErr
+		}
+	}
+	profiled.Done()
+	if err != nil {
+		wr.WriteHeader(500)
+		_, _ = fmt.Fprintf(wr, "Error executing query: %s", err)
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		wr.WriteHeader(500)
+		_, _ = fmt.Fprintf(wr, "Error reading result: %s", err)
+		return
+	}
+	defer f.Close()
+	progress.SetSummary(wr)
+	wr.Header().Set("x-clickhouse-format", "DuckDB")
+	wr.Header().Set("Content-Type", "application/octet-stream")
+	wr.WriteHeader(200)
+	_, _ = io.Copy(wr, f)
+}
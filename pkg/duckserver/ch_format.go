@@ -0,0 +1,742 @@
+package duckserver
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"github.com/goccy/go-json"
+	"io"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type ClickhouseFormatWriter interface {
+	Write(value []any) error
+	io.Closer
+}
+
+type ClickhouseFormatReader interface {
+	Read([]driver.Value) error
+	io.Closer
+}
+
+type ClickhouseFormatReaderFactory func(columnNames, columnTypes []string, reader io.Reader) (ClickhouseFormatReader, error)
+
+type ClickhouseFormatWriterFactory func(columnNames, columnTypes []string, writer io.Writer) (ClickhouseFormatWriter, error)
+
+func newJsonLinesFormatReader(columnNames, columnTypes []string, reader io.Reader) (ClickhouseFormatReader, error) {
+	return newJsonLinesFormatReaderSettings(columnNames, columnTypes, reader, nil)
+}
+
+// newJsonLinesFormatReaderSettings returns a JSONEachRow reader, unknown fields are skipped unless
+// input_format_skip_unknown_fields is 0 and omitted fields fail when duckserver_input_missing_fields is error
+func newJsonLinesFormatReaderSettings(columnNames, columnTypes []string, reader io.Reader, settings url.Values) (ClickhouseFormatReader, error) {
+	options, err := parseInputColumnOptions(settings, "")
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(reader)
+	decoder.UseNumber()
+	index := make(map[string]int, len(columnNames))
+	for i, column := range columnNames {
+		index[column] = i
+	}
+	return &JsonLinesFormatReader{
+		index:       index,
+		columnNames: columnNames,
+		columnTypes: columnTypes,
+		decoder:     decoder,
+		options:     options,
+		seen:        make([]bool, len(columnNames)),
+	}, nil
+}
+
+// skipUnknownFieldsSetting is the clickhouse setting ignoring the fields of JSONEachRow without column
+const skipUnknownFieldsSetting = "input_format_skip_unknown_fields"
+
+// JsonLinesFormatReader reads a json object per row into the columns of its fields, the omitted fields are their
+// column defaults and an explicit null is null
+type JsonLinesFormatReader struct {
+	index       map[string]int
+	columnNames []string
+	columnTypes []string
+	defaults    []driver.Value
+	decoder     *json.Decoder
+	options     inputColumnOptions
+	// seen are the columns of the fields of the row, a field twice fails the row
+	seen []bool
+}
+
+func (j *JsonLinesFormatReader) Read(value []driver.Value) error {
+	if len(j.columnTypes) != len(value) {
+		return errors.New("column length mismatch")
+	}
+	tok, err := j.decoder.Token()
+	if err != nil {
+		return err
+	}
+	if tok != json.Delim('{') {
+		return fmt.Errorf("JSONEachRow row isn't an object")
+	}
+	if j.defaults != nil {
+		copy(value, j.defaults)
+	} else {
+		clear(value)
+	}
+	clear(j.seen)
+	// the fields after a bad one are read to end the row, so it can be skipped
+	var rowErr error
+	for j.decoder.More() {
+		tok, err = j.decoder.Token()
+		if err != nil {
+			return err
+		}
+		key, _ := tok.(string)
+		i, ok := j.index[key]
+		var field any
+		if err = j.decoder.Decode(&field); err != nil {
+			return err
+		}
+		if rowErr != nil {
+			continue
+		}
+		if !ok {
+			if !j.options.skipUnknown {
+				rowErr = fmt.Errorf("unknown field %s, set %s=1 to skip it", key, skipUnknownFieldsSetting)
+			}
+			continue
+		}
+		if j.seen[i] {
+			rowErr = fmt.Errorf("duplicate field %s", key)
+			continue
+		}
+		j.seen[i] = true
+		// nested objects and arrays are appended as their json text
+		if value[i], err = binaryInputValue(field, j.columnTypes[i]); err != nil {
+			rowErr = fmt.Errorf("field %s: %w", key, err)
+		}
+	}
+	if _, err = j.decoder.Token(); err != nil {
+		return err
+	}
+	if rowErr == nil && j.options.missingError {
+		if i := slices.Index(j.seen, false); i >= 0 {
+			rowErr = fmt.Errorf("missing field %s", j.columnNames[i])
+		}
+	}
+	if rowErr != nil {
+		return &inputValueError{rowErr}
+	}
+	return nil
+}
+
+// SetColumnDefaults sets the values of the omitted fields
+func (j *JsonLinesFormatReader) SetColumnDefaults(defaults []driver.Value) {
+	j.defaults = defaults
+}
+
+func (j *JsonLinesFormatReader) Close() error {
+	return nil
+}
+
+// columnDefaultsReader is a reader telling omitted fields from nulls, the omitted fields get the column defaults
+type columnDefaultsReader interface {
+	SetColumnDefaults(defaults []driver.Value)
+}
+
+// constantDefaultRegexp matches the column defaults which are literals, the others like now() or nextval() are
+// evaluated per row
+var constantDefaultRegexp = regexp.MustCompile(`(?i)^(?:CAST\()?(?:-?\d+(?:\.\d+)?(?:e[+-]?\d+)?|'(?:[^']|'')*'|true|false)(?:\s+AS\s+[\w ,()]+\))?$`)
+
+// setColumnDefaults gives the omitted fields of a reader the defaults of their columns, unless
+// input_format_defaults_for_omitted_fields is 0. The constant defaults are evaluated once, the others per row by the
+// returned rowDefaults
+func (c *ChServer) setColumnDefaults(ctx context.Context, reader ClickhouseFormatReader, schema, table string, columnNames, columnTypes []string, settings url.Values) (*rowDefaults, error) {
+	if _, ok := reader.(columnDefaultsReader); !ok || settings.Get("input_format_defaults_for_omitted_fields") == "0" {
+		return nil, nil
+	}
+	defaults, err := c.lookupColumnDefaults(ctx, schema, table, columnNames, columnTypes)
+	if err != nil {
+		return nil, err
+	}
+	return defaults.Set(reader, settings), nil
+}
+
+// columnDefaults are the defaults of the columns of an insert, a nil columnDefaults has none
+type columnDefaults struct {
+	values []driver.Value
+	perRow *rowDefaults
+}
+
+// Set gives the omitted fields of a reader the defaults like setColumnDefaults, for the inserts of a table sharing
+// the lookup
+func (d *columnDefaults) Set(reader ClickhouseFormatReader, settings url.Values) *rowDefaults {
+	r, ok := reader.(columnDefaultsReader)
+	if d == nil || !ok || settings.Get("input_format_defaults_for_omitted_fields") == "0" {
+		return nil
+	}
+	r.SetColumnDefaults(d.values)
+	return d.perRow
+}
+
+// lookupColumnDefaults evaluates the constant defaults of columns of a table, nil when they have none
+func (c *ChServer) lookupColumnDefaults(ctx context.Context, schema, table string, columnNames, columnTypes []string) (*columnDefaults, error) {
+	rows, err := c.conn.QueryContext(ctx, "select column_name, column_default, data_type from information_schema.columns where table_schema = ? and table_name = ? and column_default is not null", schema, table)
+	if err != nil {
+		return nil, err
+	}
+	exprs, types := map[string]string{}, map[string]string{}
+	for rows.Next() {
+		var name, expr, typ string
+		if err = rows.Scan(&name, &expr, &typ); err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+		exprs[name] = expr
+		types[name] = typ
+	}
+	_ = rows.Close()
+	if len(exprs) == 0 {
+		return nil, nil
+	}
+	defaults := make([]driver.Value, len(columnNames))
+	var perRow *rowDefaults
+	for i, column := range columnNames {
+		expr, ok := exprs[column]
+		if !ok {
+			continue
+		}
+		constant := constantDefaultRegexp.MatchString(expr)
+		expr = fmt.Sprintf("CAST(CAST((%s) AS %s) AS VARCHAR)", expr, types[column])
+		if !constant {
+			if perRow == nil {
+				perRow = &rowDefaults{conn: c.conn}
+			}
+			perRow.columns = append(perRow.columns, i)
+			defaults[i] = rowDefault{expr: expr, typ: columnTypes[i]}
+			continue
+		}
+		var text string
+		if err = c.conn.QueryRowContext(ctx, "select "+expr).Scan(&text); err != nil {
+			return nil, err
+		}
+		if defaults[i], err = convertInputText(text, columnTypes[i]); err != nil {
+			return nil, err
+		}
+	}
+	return &columnDefaults{values: defaults, perRow: perRow}, nil
+}
+
+func newJsonLinesFormatWriter(columnNames, columnTypes []string, writer io.Writer) (ClickhouseFormatWriter, error) {
+	return newJsonLinesFormatWriterOptions(columnNames, columnTypes, writer, jsonOptions(nil))
+}
+
+func newJsonLinesFormatWriterOptions(columnNames, columnTypes []string, writer io.Writer, options chJSONOptions) (ClickhouseFormatWriter, error) {
+	keys := make([][]byte, len(columnNames))
+	for i, column := range columnNames {
+		keys[i] = appendJSONString(nil, column)
+	}
+	return &JsonLinesFormatWriter{
+		keys:    keys,
+		types:   columnTypes,
+		options: options,
+		writer:  writer,
+	}, nil
+}
+
+// JsonLinesFormatWriter writes a json object per row with the columns in their order
+type JsonLinesFormatWriter struct {
+	keys    [][]byte
+	types   []string
+	options chJSONOptions
+	writer  io.Writer
+	buf     []byte
+}
+
+func (j *JsonLinesFormatWriter) Write(value []any) error {
+	j.buf = append(j.buf[:0], '{')
+	for i, key := range j.keys {
+		if i > 0 {
+			j.buf = append(j.buf, ',')
+		}
+		j.buf = append(j.buf, key...)
+		j.buf = append(j.buf, ':')
+		j.buf = appendChJSON(j.buf, value[i], j.types[i], j.options)
+	}
+	j.buf = append(j.buf, '}', '\n')
+	_, err := j.writer.Write(j.buf)
+	return err
+}
+
+func (j *JsonLinesFormatWriter) Close() error {
+	return nil
+}
+
+func newCSVFormatReaderGeneric(columnNames, columnTypes []string, reader io.Reader, sep rune, header bool) (ClickhouseFormatReader, error) {
+	return newCSVFormatReaderOptions(columnNames, columnTypes, reader, sep, header, inputColumnOptions{skipUnknown: true, useHeader: true})
+}
+
+// newCSVFormatReaderSettings returns a CSV or TabSeparated reader matching the fields to the columns by the
+// settings of the insert
+func newCSVFormatReaderSettings(columnNames, columnTypes []string, reader io.Reader, sep rune, header bool, settings url.Values) (ClickhouseFormatReader, error) {
+	variableSetting := csvVariableColumnsSetting
+	if sep == '\t' {
+		variableSetting = tsvVariableColumnsSetting
+	}
+	options, err := parseInputColumnOptions(settings, variableSetting)
+	if err != nil {
+		return nil, err
+	}
+	return newCSVFormatReaderOptions(columnNames, columnTypes, reader, sep, header, options)
+}
+
+func newCSVFormatReaderOptions(columnNames, columnTypes []string, reader io.Reader, sep rune, header bool, options inputColumnOptions) (ClickhouseFormatReader, error) {
+	r := csv.NewReader(reader)
+	r.ReuseRecord = true
+	r.Comma = sep
+	if options.variableColumns {
+		r.FieldsPerRecord = -1
+	}
+	var fields []int
+	if header {
+		names, err := r.Read()
+		if err != nil {
+			return nil, err
+		}
+		if options.useHeader {
+			if fields, err = options.headerColumns(names, columnNames); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if fields == nil {
+		fields = make([]int, len(columnNames))
+		for i := range fields {
+			fields[i] = i
+		}
+	}
+	columnParsers := make([]func(string) (driver.Value, error), len(columnTypes))
+	for i, columnType := range columnTypes {
+		columnParsers[i] = getDuckDBConverter(columnType)
+	}
+	csvReader := &CSVFormatReader{
+		columns:       columnNames,
+		columnParsers: columnParsers,
+		fields:        fields,
+		options:       options,
+		reader:        r,
+	}
+	if options.variableColumns || len(fields) < len(columnNames) || slices.Contains(fields, -1) {
+		return csvOmittingReader{csvReader}, nil
+	}
+	return csvReader, nil
+}
+func newCSVFormatReader(columnNames, columnTypes []string, reader io.Reader) (ClickhouseFormatReader, error) {
+	return newCSVFormatReaderGeneric(columnNames, columnTypes, reader, ',', false)
+}
+
+func newCSVHeaderFormatReader(columnNames, columnTypes []string, reader io.Reader) (ClickhouseFormatReader, error) {
+	return newCSVFormatReaderGeneric(columnNames, columnTypes, reader, ',', true)
+}
+func newTSVFormatReader(columnNames, columnTypes []string, reader io.Reader) (ClickhouseFormatReader, error) {
+	return newCSVFormatReaderGeneric(columnNames, columnTypes, reader, '\t', false)
+}
+func newTSVHeaderFormatReader(columnNames, columnTypes []string, reader io.Reader) (ClickhouseFormatReader, error) {
+	return newCSVFormatReaderGeneric(columnNames, columnTypes, reader, '\t', true)
+}
+
+// CSVFormatReader reads the CSV and TabSeparated rows, fields maps the fields of a row to the columns, -1 for the
+// skipped fields, and the columns without field get their defaults
+type CSVFormatReader struct {
+	columns       []string
+	columnParsers []func(string) (driver.Value, error)
+	fields        []int
+	options       inputColumnOptions
+	defaults      []driver.Value
+	reader        *csv.Reader
+	closer        io.Closer
+}
+
+func (c *CSVFormatReader) Read(values []driver.Value) error {
+	if len(c.columns) != len(values) {
+		return errors.New("column length mismatch")
+	}
+	record, err := c.reader.Read()
+	if errors.Is(err, csv.ErrFieldCount) {
+		return &inputValueError{err}
+	}
+	if err != nil {
+		return err
+	}
+	if len(record) != len(c.fields) && !c.options.variableColumns {
+		return &inputValueError{fmt.Errorf("row has %d fields, expected %d", len(record), len(c.fields))}
+	}
+	if c.defaults != nil {
+		copy(values, c.defaults)
+	} else {
+		clear(values)
+	}
+	for i, column := range c.fields {
+		if column < 0 {
+			continue
+		}
+		if i >= len(record) {
+			if c.options.missingError {
+				return &inputValueError{fmt.Errorf("missing field for column %s", c.columns[column])}
+			}
+			continue
+		}
+		values[column], err = c.columnParsers[column](record[i])
+		if err != nil {
+			return &inputValueError{fmt.Errorf("column %s: %w", c.columns[column], err)}
+		}
+	}
+	return nil
+}
+
+// csvOmittingReader is a CSVFormatReader with columns which may have no field, they get the column defaults
+type csvOmittingReader struct {
+	*CSVFormatReader
+}
+
+func (c csvOmittingReader) SetColumnDefaults(defaults []driver.Value) {
+	c.defaults = defaults
+}
+
+func (c *CSVFormatReader) Close() error {
+	return c.closer.Close()
+}
+
+// binaryInputValue converts a value decoded by a binary input format to the value appended to a column of typ,
+// the values of other types than the column are converted from their text, records, arrays and maps are json
+func binaryInputValue(value any, typ string) (driver.Value, error) {
+	switch v := value.(type) {
+	case nil:
+		return nil, nil
+	case int64:
+		switch typ {
+		case "BIGINT":
+			return v, nil
+		case "DOUBLE":
+			return float64(v), nil
+		case "BOOLEAN":
+			return v != 0, nil
+		}
+		return convertInputText(strconv.FormatInt(v, 10), typ)
+	case uint64:
+		if typ == "UBIGINT" {
+			return v, nil
+		}
+		return convertInputText(strconv.FormatUint(v, 10), typ)
+	case float64:
+		switch typ {
+		case "DOUBLE":
+			return v, nil
+		case "FLOAT":
+			return float32(v), nil
+		}
+		return convertInputText(strconv.FormatFloat(v, 'g', -1, 64), typ)
+	case bool:
+		if typ == "BOOLEAN" {
+			return v, nil
+		}
+		if v {
+			return convertInputText("1", typ)
+		}
+		return convertInputText("0", typ)
+	case time.Time:
+		switch typ {
+		case "DATE", "TIMESTAMP", "TIMESTAMP_S", "TIMESTAMP_MS", "TIMESTAMP_NS", "TIMESTAMP WITH TIME ZONE", "TIMESTAMPTZ":
+			return v, nil
+		}
+		return convertInputText(v.Format("2006-01-02 15:04:05.999999999"), typ)
+	case []byte:
+		if typ == "BLOB" {
+			return v, nil
+		}
+		return convertInputText(string(v), typ)
+	case string:
+		return convertInputText(v, typ)
+	default:
+		text, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		return convertInputText(string(text), typ)
+	}
+}
+
+// convertInputText converts text to the value appended to a column of typ
+func convertInputText(text, typ string) (driver.Value, error) {
+	if convert := getDuckDBConverter(typ); convert != nil {
+		return convert(text)
+	}
+	return text, nil
+}
+
+type CSVFormatWriter struct {
+	columns []string
+	writer  *csv.Writer
+	closer  io.Closer
+}
+
+func (c *CSVFormatWriter) Write(values []any) error {
+	strValues := make([]string, len(values))
+	for i, value := range values {
+		strValues[i] = duckValueToString(value)
+	}
+	return c.writer.Write(strValues)
+}
+
+func (c *CSVFormatWriter) Close() error {
+	c.writer.Flush()
+	return nil
+}
+
+func (c *CSVFormatWriter) Flush() error {
+	c.writer.Flush()
+	return c.writer.Error()
+}
+
+var typesMapping = map[string]string{
+	"INTEGER":                  "Int32",
+	"VARCHAR":                  "String",
+	"BIGINT":                   "Int64",
+	"BOOLEAN":                  "UInt8",
+	"DOUBLE":                   "Float64",
+	"UTINYINT":                 "UInt8",
+	"USMALLINT":                "UInt16",
+	"UINTEGER":                 "UInt32",
+	"UBIGINT":                  "UInt64",
+	"HUGEINT":                  "Int128",
+	"UHUGEINT":                 "UInt128",
+	"TINYINT":                  "Int8",
+	"SMALLINT":                 "Int16",
+	"FLOAT":                    "Float32",
+	"DATE":                     "Date32",
+	"TIMESTAMP":                "DateTime64(6)",
+	"TIMESTAMP_S":              "DateTime",
+	"TIMESTAMP_MS":             "DateTime64(3)",
+	"TIMESTAMP_NS":             "DateTime64(9)",
+	"TIMESTAMP WITH TIME ZONE": "DateTime64(6, 'UTC')",
+	"UUID":                     "UUID",
+}
+
+// clickhouseType maps a DuckDB type to clickhouse, lists, maps, structs, enums and decimals are spelled out,
+// the types clickhouse doesn't have are String
+func clickhouseType(t string) string {
+	if p, s, ok := parseDecimalType(t); ok {
+		return fmt.Sprintf("Decimal(%d, %d)", p, s)
+	}
+	if strings.HasSuffix(t, "[]") {
+		return "Array(" + clickhouseType(strings.TrimSuffix(t, "[]")) + ")"
+	}
+	if i := strings.Index(t, "("); i > 0 && strings.HasSuffix(t, ")") {
+		args := splitTopLevel(t[i+1 : len(t)-1])
+		switch t[:i] {
+		case "MAP":
+			if len(args) == 2 {
+				return fmt.Sprintf("Map(%s, %s)", clickhouseType(args[0]), clickhouseType(args[1]))
+			}
+		case "STRUCT":
+			fields := make([]string, len(args))
+			for j, arg := range args {
+				fields[j] = clickhouseType(arg)
+				if tokens := chTokenize(arg); len(tokens) > 1 {
+					fields[j] = tokens[0].text + " " + clickhouseType(strings.TrimSpace(arg[tokens[1].start:]))
+				}
+			}
+			return "Tuple(" + strings.Join(fields, ", ") + ")"
+		case "ENUM":
+			values := make([]string, len(args))
+			for j, arg := range args {
+				values[j] = fmt.Sprintf("%s = %d", arg, j+1)
+			}
+			if len(values) > 127 {
+				return "Enum16(" + strings.Join(values, ", ") + ")"
+			}
+			return "Enum8(" + strings.Join(values, ", ") + ")"
+		}
+	}
+	if chType, ok := typesMapping[t]; ok {
+		return chType
+	}
+	return "String"
+}
+
+func typesToClickhouseTypes(types []string) []string {
+	clickhouseTypes := make([]string, len(types))
+	for i, t := range types {
+		clickhouseTypes[i] = clickhouseType(t)
+	}
+	return clickhouseTypes
+}
+
+func newCSVFormatWriterGeneric(columnNames, columnTypes []string, writer io.Writer, sep rune, header bool, types bool) (ClickhouseFormatWriter, error) {
+	w := csv.NewWriter(writer)
+	w.Comma = sep
+	if header {
+		err := w.Write(columnNames)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if types {
+
+		err := w.Write(typesToClickhouseTypes(columnTypes))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &CSVFormatWriter{
+		columns: columnNames,
+		writer:  w,
+	}, nil
+}
+
+func newCSVFormatWriter(columnNames, columnTypes []string, writer io.Writer) (ClickhouseFormatWriter, error) {
+	return newCSVFormatWriterGeneric(columnNames, columnTypes, writer, ',', false, false)
+}
+
+func newCSVHeaderFormatWriter(columnNames, columnTypes []string, writer io.Writer) (ClickhouseFormatWriter, error) {
+	return newCSVFormatWriterGeneric(columnNames, columnTypes, writer, ',', true, false)
+}
+
+func newTSVFormatWriter(columnNames, columnTypes []string, writer io.Writer) (ClickhouseFormatWriter, error) {
+	return newCSVFormatWriterGeneric(columnNames, columnTypes, writer, '\t', false, false)
+}
+
+func newTSVHeaderFormatWriter(columnNames, columnTypes []string, writer io.Writer) (ClickhouseFormatWriter, error) {
+	return newCSVFormatWriterGeneric(columnNames, columnTypes, writer, '\t', true, false)
+}
+
+func newTSVHeaderWithTypesFormatWriter(columnNames, columnTypes []string, writer io.Writer) (ClickhouseFormatWriter, error) {
+	return newCSVFormatWriterGeneric(columnNames, columnTypes, writer, '\t', true, true)
+}
+
+// NullFormatWriter discards the rows of FORMAT Null, the query runs for benchmarks and warming caches
+type NullFormatWriter struct{}
+
+func newNullFormatWriter(columnNames, columnTypes []string, writer io.Writer) (ClickhouseFormatWriter, error) {
+	return NullFormatWriter{}, nil
+}
+
+func (NullFormatWriter) Write(value []any) error {
+	return nil
+}
+
+func (NullFormatWriter) Close() error {
+	return nil
+}
+
+var chInputFormats = map[string]ClickhouseFormatReaderFactory{
+	"Avro":                  newAvroFormatReader,
+	"JSONEachRow":           newJsonLinesFormatReader,
+	"CSV":                   newCSVFormatReader,
+	"CSVWithNames":          newCSVHeaderFormatReader,
+	"TabSeparated":          newTSVFormatReader,
+	"TabSeparatedWithNames": newTSVHeaderFormatReader,
+}
+
+var chOutputFormats = map[string]ClickhouseFormatWriterFactory{
+	"JSONEachRow":                   newJsonLinesFormatWriter,
+	"CSV":                           newCSVFormatWriter,
+	"CSVWithNames":                  newCSVHeaderFormatWriter,
+	"TabSeparated":                  newTSVFormatWriter,
+	"TabSeparatedWithNames":         newTSVHeaderFormatWriter,
+	"TabSeparatedWithNamesAndTypes": newTSVHeaderWithTypesFormatWriter,
+	"XLSX":                          newXLSXFormatWriter,
+	"ORC":                           newORCFormatWriter,
+	"Null":                          newNullFormatWriter,
+}
+
+var chFormatContentTypes = map[string]string{
+	"TabSeparated":                     "text/tab-separated-values; charset=UTF-8",
+	"TabSeparatedWithNames":            "text/tab-separated-values; charset=UTF-8",
+	"TabSeparatedWithNamesAndTypes":    "text/tab-separated-values; charset=UTF-8",
+	"CSV":                              "text/csv; charset=UTF-8",
+	"CSVWithNames":                     "text/csv; charset=UTF-8",
+	"JSONEachRow":                      "application/json; charset=UTF-8",
+	"XLSX":                             xlsxContentType,
+	"ORC":                              "application/octet-stream",
+	"Null":                             "text/plain; charset=UTF-8",
+	"Template":                         "text/plain; charset=UTF-8",
+	"CustomSeparated":                  "text/plain; charset=UTF-8",
+	"CustomSeparatedWithNames":         "text/plain; charset=UTF-8",
+	"CustomSeparatedWithNamesAndTypes": "text/plain; charset=UTF-8",
+}
+
+func GetClickhouseFormatContentType(name string) string {
+	return chFormatContentTypes[name]
+}
+
+func GetClickhouseInputFormat(name string) ClickhouseFormatReaderFactory {
+	return chInputFormats[name]
+}
+
+// inputFormat returns the reader of an insert format, the formats which need a schema read it from the settings
+func (c *ChServer) inputFormat(format string, settings url.Values) ClickhouseFormatReaderFactory {
+	switch format {
+	case "AvroConfluent":
+		registry := settings.Get(avroSchemaRegistrySetting)
+		return func(columnNames, columnTypes []string, reader io.Reader) (ClickhouseFormatReader, error) {
+			return newAvroConfluentFormatReader(columnNames, columnTypes, reader, registry)
+		}
+	case "Protobuf", "ProtobufSingle":
+		schema := settings.Get(protobufSchemaSetting)
+		return func(columnNames, columnTypes []string, reader io.Reader) (ClickhouseFormatReader, error) {
+			return newProtobufFormatReader(columnNames, columnTypes, reader, c.formatSchemaPath, schema, format == "ProtobufSingle")
+		}
+	case "JSONEachRow":
+		return func(columnNames, columnTypes []string, reader io.Reader) (ClickhouseFormatReader, error) {
+			return newJsonLinesFormatReaderSettings(columnNames, columnTypes, reader, settings)
+		}
+	case "CSV", "CSVWithNames", "TabSeparated", "TabSeparatedWithNames":
+		sep := ','
+		if strings.HasPrefix(format, "TabSeparated") {
+			sep = '\t'
+		}
+		return func(columnNames, columnTypes []string, reader io.Reader) (ClickhouseFormatReader, error) {
+			return newCSVFormatReaderSettings(columnNames, columnTypes, reader, sep, strings.HasSuffix(format, "WithNames"), settings)
+		}
+	case "Template":
+		return func(columnNames, columnTypes []string, reader io.Reader) (ClickhouseFormatReader, error) {
+			return newTemplateFormatReader(columnNames, columnTypes, reader, c.formatSchemaPath, settings)
+		}
+	case "CustomSeparated", "CustomSeparatedWithNames", "CustomSeparatedWithNamesAndTypes":
+		return func(columnNames, columnTypes []string, reader io.Reader) (ClickhouseFormatReader, error) {
+			return newCustomSeparatedFormatReader(columnNames, columnTypes, reader, settings, customSeparatedHeaders(format))
+		}
+	}
+	return GetClickhouseInputFormat(format)
+}
+
+func GetClickhouseOutputFormat(name string) ClickhouseFormatWriterFactory {
+	return chOutputFormats[name]
+}
+
+// outputFormat returns the writer of a select format, the formats configured by settings read them
+func (c *ChServer) outputFormat(format string, settings url.Values) ClickhouseFormatWriterFactory {
+	switch format {
+	case "JSONEachRow":
+		options := jsonOptions(settings)
+		return func(columnNames, columnTypes []string, writer io.Writer) (ClickhouseFormatWriter, error) {
+			return newJsonLinesFormatWriterOptions(columnNames, columnTypes, writer, options)
+		}
+	case "Template":
+		return func(columnNames, columnTypes []string, writer io.Writer) (ClickhouseFormatWriter, error) {
+			return newTemplateFormatWriter(columnNames, writer, c.formatSchemaPath, settings)
+		}
+	case "CustomSeparated", "CustomSeparatedWithNames", "CustomSeparatedWithNamesAndTypes":
+		return func(columnNames, columnTypes []string, writer io.Writer) (ClickhouseFormatWriter, error) {
+			return newCustomSeparatedFormatWriter(columnNames, columnTypes, writer, settings, customSeparatedHeaders(format))
+		}
+	}
+	return GetClickhouseOutputFormat(format)
+}
@@ -0,0 +1,65 @@
+package duckserver
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// readJsonLines reads the rows of a JSONEachRow body into columns a INTEGER and b VARCHAR, b defaults to "d". A row
+// failing with an error is its error text
+func readJsonLines(t *testing.T, body string, settings url.Values) []string {
+	t.Helper()
+	reader, err := newJsonLinesFormatReaderSettings([]string{"a", "b"}, []string{"INTEGER", "VARCHAR"}, strings.NewReader(body), settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader.(columnDefaultsReader).SetColumnDefaults([]driver.Value{nil, "d"})
+	var rows []string
+	values := make([]driver.Value, 2)
+	for {
+		err = reader.Read(values)
+		if err == io.EOF {
+			return rows
+		}
+		var valueErr *inputValueError
+		if errors.As(err, &valueErr) {
+			rows = append(rows, "error: "+err.Error())
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows = append(rows, fmt.Sprintf("%v|%v", values[0], values[1]))
+	}
+}
+
+func TestJsonLinesFormatReader(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		settings url.Values
+		rows     []string
+	}{
+		{"missing key after a row with it", `{"a":1,"b":"x"}` + "\n" + `{"a":2}`, nil, []string{"1|x", "2|d"}},
+		{"null and omitted key", `{"a":1,"b":null} {"a":2} {"b":null}`, nil, []string{"1|<nil>", "2|d", "<nil>|<nil>"}},
+		{"unknown field skipped", `{"a":1,"c":{"x":[1]},"b":"x"}`, nil, []string{"1|x"}},
+		{"unknown field", `{"a":1,"c":2,"b":"x"} {"a":2}`, url.Values{skipUnknownFieldsSetting: {"0"}},
+			[]string{"error: unknown field c, set input_format_skip_unknown_fields=1 to skip it", "2|d"}},
+		{"duplicate key", `{"a":1,"a":2} {"a":3,"b":"x","b":"y"} {"a":4}`, nil,
+			[]string{"error: duplicate field a", "error: duplicate field b", "4|d"}},
+		{"missing key error", `{"a":1,"b":null} {"a":2}`, url.Values{missingFieldsSetting: {"error"}},
+			[]string{"1|<nil>", "error: missing field b"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if rows := readJsonLines(t, test.body, test.settings); strings.Join(rows, "\n") != strings.Join(test.rows, "\n") {
+				t.Errorf("rows = %q, want %q", rows, test.rows)
+			}
+		})
+	}
+}
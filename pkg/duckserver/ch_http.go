@@ -0,0 +1,84 @@
+package duckserver
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// default limits of the clickhouse http server, queries may stream their results for long so there's no write timeout
+const (
+	defaultChReadHeaderTimeout    = 10 * time.Second
+	defaultChIdleTimeout          = 2 * time.Minute
+	defaultChMaxConcurrentStreams = 250
+)
+
+// newChHttpServer returns the http server of a clickhouse listener, it serves HTTP/1.1 with keep-alive, HTTP/2 over
+// TLS and unencrypted HTTP/2 with prior knowledge (h2c), so clients can pipeline many small queries on a connection
+func newChHttpServer(handler http.Handler, options ClickhouseOptions) *http.Server {
+	readHeaderTimeout := options.ReadHeaderTimeout
+	if readHeaderTimeout == 0 {
+		readHeaderTimeout = defaultChReadHeaderTimeout
+	}
+	idleTimeout := options.IdleTimeout
+	if idleTimeout == 0 {
+		idleTimeout = defaultChIdleTimeout
+	}
+	maxConcurrentStreams := options.MaxConcurrentStreams
+	if maxConcurrentStreams == 0 {
+		maxConcurrentStreams = defaultChMaxConcurrentStreams
+	}
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(true)
+	protocols.SetUnencryptedHTTP2(true)
+	return &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: readHeaderTimeout,
+		IdleTimeout:       idleTimeout,
+		MaxHeaderBytes:    1 << 20,
+		Protocols:         protocols,
+		HTTP2: &http.HTTP2Config{
+			MaxConcurrentStreams: maxConcurrentStreams,
+			// the body of an insert may be large, a bigger window lets it upload at the speed of HTTP/1.1
+			MaxReceiveBufferPerStream:     4 << 20,
+			MaxReceiveBufferPerConnection: 16 << 20,
+		},
+	}
+}
+
+// limitListener accepts at most max connections at once, Accept waits for a connection to close above it
+type limitListener struct {
+	net.Listener
+	sem chan struct{}
+}
+
+func newLimitListener(lis net.Listener, max int) net.Listener {
+	if max <= 0 {
+		return lis
+	}
+	return &limitListener{Listener: lis, sem: make(chan struct{}, max)}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	l.sem <- struct{}{}
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		<-l.sem
+		return nil, err
+	}
+	return &limitConn{Conn: conn, release: func() { <-l.sem }}, nil
+}
+
+type limitConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
@@ -0,0 +1,99 @@
+package duckserver
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+)
+
+// the settings matching the fields of the input rows to the columns of an insert. The clickhouse settings skip the
+// unknown fields of JSONEachRow and of the header of CSVWithNames and TabSeparatedWithNames, map the fields by the
+// header names and accept CSV and TabSeparated rows with fewer or more fields than the columns
+const (
+	withNamesUseHeaderSetting = "input_format_with_names_use_header"
+	csvVariableColumnsSetting = "input_format_csv_allow_variable_number_of_columns"
+	tsvVariableColumnsSetting = "input_format_tsv_allow_variable_number_of_columns"
+	// missingFieldsSetting is what a column without field in a row gets, 'default' its column default or null and
+	// 'error' fails the row
+	missingFieldsSetting = "duckserver_input_missing_fields"
+)
+
+// inputColumnOptions is how the fields of the input rows not matching the columns are handled
+type inputColumnOptions struct {
+	// skipUnknown ignores the fields without column instead of failing the row
+	skipUnknown bool
+	// missingError fails the rows without field for a column instead of giving it its default
+	missingError bool
+	// useHeader maps the fields of the formats with names by the header instead of their position
+	useHeader bool
+	// variableColumns ignores the extra fields of CSV and TabSeparated rows and gives the missing ones their defaults
+	variableColumns bool
+}
+
+// parseInputColumnOptions reads the options from the settings of an insert, variableSetting is the setting of the
+// number of fields of the format
+func parseInputColumnOptions(settings url.Values, variableSetting string) (inputColumnOptions, error) {
+	o := inputColumnOptions{
+		skipUnknown:     !settings.Has(skipUnknownFieldsSetting) || isTrueSetting(settings.Get(skipUnknownFieldsSetting)),
+		useHeader:       !settings.Has(withNamesUseHeaderSetting) || isTrueSetting(settings.Get(withNamesUseHeaderSetting)),
+		variableColumns: variableSetting != "" && isTrueSetting(settings.Get(variableSetting)),
+	}
+	switch value := settings.Get(missingFieldsSetting); value {
+	case "", "default":
+	case "error":
+		o.missingError = true
+	default:
+		return o, &inputValueError{fmt.Errorf("invalid %s %q, expected default or error", missingFieldsSetting, value)}
+	}
+	return o, nil
+}
+
+// headerColumns maps the fields of a header to the indexes of the columns, -1 for the unknown fields which are
+// skipped. Duplicated fields fail, and so do the columns without field when missing fields are errors
+func (o inputColumnOptions) headerColumns(header, columnNames []string) ([]int, error) {
+	index := make(map[string]int, len(columnNames))
+	for i, column := range columnNames {
+		index[column] = i
+	}
+	fields := make([]int, len(header))
+	found := make([]bool, len(columnNames))
+	matched := false
+	for i, name := range header {
+		column, ok := index[name]
+		if !ok {
+			if !o.skipUnknown {
+				return nil, &inputValueError{fmt.Errorf("unknown column %s in the header, set %s=1 to skip it", name, skipUnknownFieldsSetting)}
+			}
+			fields[i] = -1
+			continue
+		}
+		if found[column] {
+			return nil, &inputValueError{fmt.Errorf("duplicate column %s in the header", name)}
+		}
+		found[column] = true
+		fields[i] = column
+		matched = true
+	}
+	// a header naming none of the columns is rather data, or names of another table
+	if !matched && len(columnNames) > 0 {
+		return nil, &inputValueError{fmt.Errorf("no column of the header matches the columns, set %s=0 to map the fields by position", withNamesUseHeaderSetting)}
+	}
+	if o.missingError {
+		for i, ok := range found {
+			if !ok {
+				return nil, &inputValueError{fmt.Errorf("missing column %s in the header", columnNames[i])}
+			}
+		}
+	}
+	return fields, nil
+}
+
+// formatReaderStatus is the status of an insert failing to create its reader, 400 for a header or settings not
+// matching the columns
+func formatReaderStatus(err error) int {
+	var valueErr *inputValueError
+	if errors.As(err, &valueErr) {
+		return 400
+	}
+	return 500
+}
@@ -0,0 +1,108 @@
+package duckserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// the clickhouse settings skipping the bad rows of an insert, the insert fails once both are exceeded
+const (
+	allowErrorsNumSetting   = "input_format_allow_errors_num"
+	allowErrorsRatioSetting = "input_format_allow_errors_ratio"
+)
+
+// maxReportedInsertErrors is the number of skipped rows described in the response of an insert
+const maxReportedInsertErrors = 10
+
+// inputValueError is an error of a value of an input row, the reader continues with the next row so the row can be
+// skipped
+type inputValueError struct {
+	err error
+}
+
+func (e *inputValueError) Error() string {
+	return e.err.Error()
+}
+
+func (e *inputValueError) Unwrap() error {
+	return e.err
+}
+
+type insertRowError struct {
+	Row   int    `json:"row"`
+	Error string `json:"error"`
+}
+
+// allowErrors counts the rows skipped by input_format_allow_errors_num and input_format_allow_errors_ratio
+type allowErrors struct {
+	num     int
+	ratio   float64
+	skipped int
+	errors  []insertRowError
+}
+
+// parseAllowErrors reads the settings skipping bad rows, nil when none is set
+func parseAllowErrors(settings url.Values) (*allowErrors, error) {
+	if !settings.Has(allowErrorsNumSetting) && !settings.Has(allowErrorsRatioSetting) {
+		return nil, nil
+	}
+	a := &allowErrors{}
+	var err error
+	if value := settings.Get(allowErrorsNumSetting); value != "" {
+		if a.num, err = strconv.Atoi(value); err != nil || a.num < 0 {
+			return nil, fmt.Errorf("invalid %s %q", allowErrorsNumSetting, value)
+		}
+	}
+	if value := settings.Get(allowErrorsRatioSetting); value != "" {
+		if a.ratio, err = strconv.ParseFloat(value, 64); err != nil || a.ratio < 0 || a.ratio > 1 {
+			return nil, fmt.Errorf("invalid %s %q", allowErrorsRatioSetting, value)
+		}
+	}
+	return a, nil
+}
+
+// AllowErrors makes the validator skip bad rows within the allowance
+func (v *rowValidator) AllowErrors(a *allowErrors) {
+	v.allowErrors = a
+}
+
+// Skip tells if the row failing with err is skipped. Only the errors of values and constraints are, the reader is at
+// the next row after them, and like clickhouse the rows are skipped while the errors are within the number or within
+// the ratio of the rows read
+func (v *rowValidator) Skip(err error) bool {
+	a := v.allowErrors
+	var valueErr *inputValueError
+	var dbErr *databaseError
+	if a == nil || !errors.As(err, &valueErr) && !errors.As(err, &dbErr) {
+		return false
+	}
+	if a.skipped+1 > a.num && float64(a.skipped+1)/float64(v.row) > a.ratio {
+		return false
+	}
+	a.skipped++
+	if len(a.errors) < maxReportedInsertErrors {
+		a.errors = append(a.errors, insertRowError{Row: v.row, Error: err.Error()})
+	}
+	return true
+}
+
+// WriteReport answers a successful insert, the rows skipped are counted in X-DuckServer-Skipped-Rows and the first
+// of them are described in a json body
+func (v *rowValidator) WriteReport(wr http.ResponseWriter) {
+	a := v.allowErrors
+	if a == nil || a.skipped == 0 {
+		wr.WriteHeader(200)
+		return
+	}
+	wr.Header().Set("X-DuckServer-Skipped-Rows", strconv.Itoa(a.skipped))
+	wr.Header().Set("Content-Type", "application/json")
+	wr.WriteHeader(200)
+	_ = json.NewEncoder(wr).Encode(struct {
+		SkippedRows int              `json:"skipped_rows"`
+		Errors      []insertRowError `json:"errors"`
+	}{a.skipped, a.errors})
+}
@@ -0,0 +1,229 @@
+package duckserver
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"github.com/goccy/go-json"
+	"github.com/marcboeker/go-duckdb"
+	"math"
+	"math/big"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// the clickhouse settings of the json output, 64 bit integers are quoted by default so javascript keeps their digits
+const (
+	jsonQuote64bitIntegersSetting = "output_format_json_quote_64bit_integers"
+	jsonQuoteDecimalsSetting      = "output_format_json_quote_decimals"
+	jsonQuoteDenormalsSetting     = "output_format_json_quote_denormals"
+)
+
+// chJSONOptions are the json output settings of a query
+type chJSONOptions struct {
+	quote64bitIntegers bool
+	quoteDecimals      bool
+	quoteDenormals     bool
+}
+
+func jsonOptions(settings url.Values) chJSONOptions {
+	options := chJSONOptions{quote64bitIntegers: true}
+	if settings.Has(jsonQuote64bitIntegersSetting) {
+		options.quote64bitIntegers = isTrueSetting(settings.Get(jsonQuote64bitIntegersSetting))
+	}
+	options.quoteDecimals = isTrueSetting(settings.Get(jsonQuoteDecimalsSetting))
+	options.quoteDenormals = isTrueSetting(settings.Get(jsonQuoteDenormalsSetting))
+	return options
+}
+
+// chJSONTimeLayouts are the layouts of the clickhouse types of DuckDB's time types
+var chJSONTimeLayouts = map[string]string{
+	"DATE":                     "2006-01-02",
+	"TIME":                     "15:04:05.999999",
+	"TIMESTAMP":                "2006-01-02 15:04:05.000000",
+	"TIMESTAMP_S":              "2006-01-02 15:04:05",
+	"TIMESTAMP_MS":             "2006-01-02 15:04:05.000",
+	"TIMESTAMP_NS":             "2006-01-02 15:04:05.000000000",
+	"TIMESTAMP WITH TIME ZONE": "2006-01-02 15:04:05.000000",
+	"TIMESTAMPTZ":              "2006-01-02 15:04:05.000000",
+}
+
+// appendChJSON appends the json of a value of a column of typ like clickhouse writes it: timestamps as their text,
+// 64 bit integers and decimals quoted as configured, NaN and infinities null unless quoted, blobs stay base64
+func appendChJSON(buf []byte, value any, typ string, options chJSONOptions) []byte {
+	switch v := value.(type) {
+	case nil:
+		return append(buf, "null"...)
+	case bool:
+		return strconv.AppendBool(buf, v)
+	case int8, int16, int32, uint8, uint16, uint32, int:
+		return append(buf, duckValueToString(v)...)
+	case int64, uint64, *big.Int:
+		if options.quote64bitIntegers {
+			return strconv.AppendQuote(buf, duckValueToString(v))
+		}
+		return append(buf, duckValueToString(v)...)
+	case float32:
+		return appendChJSONFloat(buf, float64(v), 32, options)
+	case float64:
+		return appendChJSONFloat(buf, v, 64, options)
+	case duckdb.Decimal:
+		if options.quoteDecimals {
+			return strconv.AppendQuote(buf, duckDecimalToString(v))
+		}
+		return append(buf, duckDecimalToString(v)...)
+	case time.Time:
+		layout, ok := chJSONTimeLayouts[typ]
+		if !ok {
+			layout = "2006-01-02 15:04:05.999999999"
+		}
+		if typ == "TIMESTAMP WITH TIME ZONE" || typ == "TIMESTAMPTZ" {
+			v = v.UTC()
+		}
+		return appendJSONString(buf, v.Format(layout))
+	case string:
+		return appendJSONString(buf, v)
+	case []byte:
+		if typ == "UUID" && len(v) == 16 {
+			return appendJSONString(buf, formatUUID(v))
+		}
+		return appendJSONString(buf, base64.StdEncoding.EncodeToString(v))
+	case duckdb.Interval:
+		return appendJSONString(buf, formatInterval(v))
+	case []any:
+		elem := strings.TrimSuffix(typ, "[]")
+		buf = append(buf, '[')
+		for i, e := range v {
+			if i > 0 {
+				buf = append(buf, ',')
+			}
+			buf = appendChJSON(buf, e, elem, options)
+		}
+		return append(buf, ']')
+	case map[string]any:
+		names, types := structFields(typ)
+		if len(names) != len(v) {
+			names, types = make([]string, 0, len(v)), make([]string, len(v))
+			for name := range v {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+		}
+		buf = append(buf, '{')
+		for i, name := range names {
+			if i > 0 {
+				buf = append(buf, ',')
+			}
+			buf = appendJSONString(buf, name)
+			buf = append(buf, ':')
+			buf = appendChJSON(buf, v[name], types[i], options)
+		}
+		return append(buf, '}')
+	case duckdb.Map:
+		keyType, valueType := "", ""
+		if args := typeArgs(typ, "MAP"); len(args) == 2 {
+			keyType, valueType = args[0], args[1]
+		}
+		keys := make([]string, 0, len(v))
+		values := make(map[string]any, len(v))
+		for key, value := range v {
+			text := duckValueToString(key)
+			if t, ok := key.(time.Time); ok {
+				if layout, ok := chJSONTimeLayouts[keyType]; ok {
+					text = t.Format(layout)
+				}
+			}
+			keys = append(keys, text)
+			values[text] = value
+		}
+		sort.Strings(keys)
+		buf = append(buf, '{')
+		for i, key := range keys {
+			if i > 0 {
+				buf = append(buf, ',')
+			}
+			buf = appendJSONString(buf, key)
+			buf = append(buf, ':')
+			buf = appendChJSON(buf, values[key], valueType, options)
+		}
+		return append(buf, '}')
+	}
+	text, err := json.Marshal(value)
+	if err != nil {
+		return appendJSONString(buf, duckValueToString(value))
+	}
+	return append(buf, text...)
+}
+
+func appendChJSONFloat(buf []byte, v float64, bitSize int, options chJSONOptions) []byte {
+	switch {
+	case math.IsNaN(v) || math.IsInf(v, 0):
+		if !options.quoteDenormals {
+			return append(buf, "null"...)
+		}
+		switch {
+		case math.IsNaN(v):
+			return append(buf, `"nan"`...)
+		case v > 0:
+			return append(buf, `"inf"`...)
+		}
+		return append(buf, `"-inf"`...)
+	}
+	return strconv.AppendFloat(buf, v, 'g', -1, bitSize)
+}
+
+// appendJSONString appends s as a json string, only quotes, backslashes and control characters are escaped
+func appendJSONString(buf []byte, s string) []byte {
+	buf = append(buf, '"')
+	for _, r := range s {
+		switch {
+		case r == '"' || r == '\\':
+			buf = append(buf, '\\', byte(r))
+		case r == '\n':
+			buf = append(buf, `\n`...)
+		case r == '\r':
+			buf = append(buf, `\r`...)
+		case r == '\t':
+			buf = append(buf, `\t`...)
+		case r < 0x20:
+			buf = append(buf, fmt.Sprintf(`\u%04x`, r)...)
+		default:
+			buf = utf8.AppendRune(buf, r)
+		}
+	}
+	return append(buf, '"')
+}
+
+// formatUUID formats the 16 bytes of a UUID in the 8-4-4-4-12 form
+func formatUUID(b []byte) string {
+	s := hex.EncodeToString(b)
+	return s[:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:]
+}
+
+// typeArgs returns the arguments of a parameterized type like MAP(VARCHAR, INTEGER), nil for other types
+func typeArgs(typ, name string) []string {
+	if !strings.HasPrefix(typ, name+"(") || !strings.HasSuffix(typ, ")") {
+		return nil
+	}
+	return splitTopLevel(typ[len(name)+1 : len(typ)-1])
+}
+
+// structFields returns the field names and types of a STRUCT type in their order
+func structFields(typ string) ([]string, []string) {
+	args := typeArgs(typ, "STRUCT")
+	names := make([]string, 0, len(args))
+	types := make([]string, 0, len(args))
+	for _, arg := range args {
+		tokens := chTokenize(arg)
+		if len(tokens) < 2 {
+			return nil, nil
+		}
+		names = append(names, chUnquote(tokens[0].text))
+		types = append(types, strings.TrimSpace(arg[tokens[1].start:]))
+	}
+	return names, types
+}
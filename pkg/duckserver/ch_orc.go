@@ -0,0 +1,475 @@
+package duckserver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/marcboeker/go-duckdb"
+	"io"
+	"math"
+	"math/big"
+	"time"
+)
+
+// orcStripeRows is the number of rows of a stripe, the stripe being written is held in memory
+const orcStripeRows = 65536
+
+// kinds of the types of orc columns
+const (
+	orcBoolean   = 0
+	orcByte      = 1
+	orcShort     = 2
+	orcInt       = 3
+	orcLong      = 4
+	orcFloat     = 5
+	orcDouble    = 6
+	orcString    = 7
+	orcBinary    = 8
+	orcTimestamp = 9
+	orcStruct    = 12
+	orcDecimal   = 14
+	orcDate      = 15
+)
+
+// kinds of the streams of orc columns
+const (
+	orcPresentStream   = 0
+	orcDataStream      = 1
+	orcLengthStream    = 2
+	orcSecondaryStream = 5
+)
+
+// orcTimestampBase is the base of the seconds of orc timestamps, 2015-01-01 00:00:00
+const orcTimestampBase = 1420070400
+
+var orcDuckTypes = map[string]int{
+	"BOOLEAN":                  orcBoolean,
+	"TINYINT":                  orcByte,
+	"SMALLINT":                 orcShort,
+	"UTINYINT":                 orcShort,
+	"INTEGER":                  orcInt,
+	"USMALLINT":                orcInt,
+	"BIGINT":                   orcLong,
+	"UINTEGER":                 orcLong,
+	"FLOAT":                    orcFloat,
+	"DOUBLE":                   orcDouble,
+	"BLOB":                     orcBinary,
+	"DATE":                     orcDate,
+	"TIMESTAMP":                orcTimestamp,
+	"TIMESTAMP_S":              orcTimestamp,
+	"TIMESTAMP_MS":             orcTimestamp,
+	"TIMESTAMP_NS":             orcTimestamp,
+	"TIMESTAMP WITH TIME ZONE": orcTimestamp,
+	"TIMESTAMPTZ":              orcTimestamp,
+}
+
+// orcColumn holds the values of a column in the current stripe and its statistics of the file
+type orcColumn struct {
+	kind      int
+	precision int
+	scale     int
+	present   []bool
+	nulls     bool
+	bools     []bool
+	ints      []int64
+	nanos     []int64
+	lengths   []int64
+	data      bytes.Buffer
+	// values and hasNull are the statistics of the file
+	values  uint64
+	hasNull bool
+}
+
+// ORCFormatWriter writes an uncompressed orc file of one struct of the result columns, stripes are written every
+// orcStripeRows rows with the DIRECT encodings, timestamps are written in UTC
+type ORCFormatWriter struct {
+	names   []string
+	columns []*orcColumn
+	writer  io.Writer
+	offset  uint64
+	rows    int
+	total   uint64
+	stripes [][]byte
+}
+
+func newORCFormatWriter(columnNames, columnTypes []string, writer io.Writer) (ClickhouseFormatWriter, error) {
+	columns := make([]*orcColumn, len(columnTypes))
+	for i, typ := range columnTypes {
+		c := &orcColumn{kind: orcString}
+		if kind, ok := orcDuckTypes[typ]; ok {
+			c.kind = kind
+		} else if precision, scale, ok := parseDecimalType(typ); ok {
+			c.kind, c.precision, c.scale = orcDecimal, precision, scale
+		}
+		columns[i] = c
+	}
+	return &ORCFormatWriter{names: columnNames, columns: columns, writer: writer}, nil
+}
+
+func (o *ORCFormatWriter) Write(values []any) error {
+	for i, value := range values {
+		if err := o.columns[i].append(value); err != nil {
+			return fmt.Errorf("column %s: %w", o.names[i], err)
+		}
+	}
+	if o.rows++; o.rows == orcStripeRows {
+		return o.flushStripe()
+	}
+	return nil
+}
+
+func (c *orcColumn) append(value any) error {
+	c.present = append(c.present, value != nil)
+	if value == nil {
+		c.nulls, c.hasNull = true, true
+		return nil
+	}
+	c.values++
+	switch c.kind {
+	case orcBoolean:
+		v, ok := value.(bool)
+		if !ok {
+			return fmt.Errorf("unexpected %T value", value)
+		}
+		c.bools = append(c.bools, v)
+	case orcByte, orcShort, orcInt, orcLong:
+		v, ok := orcInteger(value)
+		if !ok {
+			return fmt.Errorf("unexpected %T value", value)
+		}
+		c.ints = append(c.ints, v)
+	case orcFloat:
+		v, ok := value.(float32)
+		if !ok {
+			return fmt.Errorf("unexpected %T value", value)
+		}
+		_ = binary.Write(&c.data, binary.LittleEndian, math.Float32bits(v))
+	case orcDouble:
+		v, ok := value.(float64)
+		if !ok {
+			return fmt.Errorf("unexpected %T value", value)
+		}
+		_ = binary.Write(&c.data, binary.LittleEndian, math.Float64bits(v))
+	case orcDate:
+		v, ok := value.(time.Time)
+		if !ok {
+			return fmt.Errorf("unexpected %T value", value)
+		}
+		c.ints = append(c.ints, time.Date(v.Year(), v.Month(), v.Day(), 0, 0, 0, 0, time.UTC).Unix()/86400)
+	case orcTimestamp:
+		v, ok := value.(time.Time)
+		if !ok {
+			return fmt.Errorf("unexpected %T value", value)
+		}
+		// seconds are truncated toward zero like the java writer, readers take a second off negative timestamps
+		// with a fraction
+		seconds := v.Unix()
+		if seconds < 0 && v.Nanosecond() != 0 {
+			seconds++
+		}
+		c.ints = append(c.ints, seconds-orcTimestampBase)
+		c.nanos = append(c.nanos, orcNanos(v.Nanosecond()))
+	case orcDecimal:
+		v, ok := value.(duckdb.Decimal)
+		if !ok {
+			return fmt.Errorf("unexpected %T value", value)
+		}
+		c.data.Write(orcBigVarint(v.Value))
+		c.ints = append(c.ints, int64(v.Scale))
+	case orcBinary:
+		v, ok := value.([]byte)
+		if !ok {
+			return fmt.Errorf("unexpected %T value", value)
+		}
+		c.data.Write(v)
+		c.lengths = append(c.lengths, int64(len(v)))
+	default:
+		s := duckValueToString(value)
+		c.data.WriteString(s)
+		c.lengths = append(c.lengths, int64(len(s)))
+	}
+	return nil
+}
+
+func orcInteger(value any) (int64, bool) {
+	switch v := value.(type) {
+	case int8:
+		return int64(v), true
+	case int16:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	case uint8:
+		return int64(v), true
+	case uint16:
+		return int64(v), true
+	case uint32:
+		return int64(v), true
+	}
+	return 0, false
+}
+
+// orcNanos encodes nanoseconds with their trailing decimal zeros removed, the count of zeros less one is in the
+// low 3 bits
+func orcNanos(nanos int) int64 {
+	if nanos == 0 {
+		return 0
+	}
+	if nanos%100 != 0 {
+		return int64(nanos) << 3
+	}
+	nanos /= 100
+	zeros := 1
+	for nanos%10 == 0 && zeros < 7 {
+		nanos /= 10
+		zeros++
+	}
+	return int64(nanos)<<3 | int64(zeros)
+}
+
+// orcBigVarint encodes a decimal as the zigzag base 128 varint of any length of orc
+func orcBigVarint(v *big.Int) []byte {
+	z := new(big.Int).Lsh(v, 1)
+	if v.Sign() < 0 {
+		z.Neg(z).Sub(z, big.NewInt(1))
+	}
+	var out []byte
+	low := big.NewInt(0x7f)
+	for {
+		b := byte(new(big.Int).And(z, low).Uint64())
+		z.Rsh(z, 7)
+		if z.Sign() == 0 {
+			return append(out, b)
+		}
+		out = append(out, b|0x80)
+	}
+}
+
+// orcByteRLE encodes bytes in runs of 3 to 130 equal bytes and literals of up to 128 bytes
+func orcByteRLE(b []byte) []byte {
+	var out []byte
+	for i := 0; i < len(b); {
+		run := 1
+		for i+run < len(b) && b[i+run] == b[i] && run < 130 {
+			run++
+		}
+		if run >= 3 {
+			out = append(out, byte(run-3), b[i])
+			i += run
+			continue
+		}
+		j := i
+		for j < len(b) && j-i < 128 && !(j+2 < len(b) && b[j] == b[j+1] && b[j] == b[j+2]) {
+			j++
+		}
+		out = append(out, byte(-(j - i)))
+		out = append(out, b[i:j]...)
+		i = j
+	}
+	return out
+}
+
+// orcBooleans encodes booleans as bits, the first in the high bit, with the byte run length encoding
+func orcBooleans(bools []bool) []byte {
+	b := make([]byte, (len(bools)+7)/8)
+	for i, v := range bools {
+		if v {
+			b[i/8] |= 0x80 >> (i % 8)
+		}
+	}
+	return orcByteRLE(b)
+}
+
+// orcIntRLE encodes integers with the version 1 run length encoding, in runs of 3 to 130 equal values and literals
+// of up to 128 values, signed values are zigzag encoded
+func orcIntRLE(values []int64, signed bool) []byte {
+	varint := func(out []byte, v int64) []byte {
+		if signed {
+			return binary.AppendUvarint(out, uint64(v<<1^v>>63))
+		}
+		return binary.AppendUvarint(out, uint64(v))
+	}
+	var out []byte
+	for i := 0; i < len(values); {
+		run := 1
+		for i+run < len(values) && values[i+run] == values[i] && run < 130 {
+			run++
+		}
+		if run >= 3 {
+			out = append(out, byte(run-3), 0)
+			out = varint(out, values[i])
+			i += run
+			continue
+		}
+		j := i
+		for j < len(values) && j-i < 128 && !(j+2 < len(values) && values[j] == values[j+1] && values[j] == values[j+2]) {
+			j++
+		}
+		out = append(out, byte(-(j - i)))
+		for _, v := range values[i:j] {
+			out = varint(out, v)
+		}
+		i = j
+	}
+	return out
+}
+
+// orcProto appends the fields of a protobuf message of the orc metadata
+type orcProto []byte
+
+func (p orcProto) uint(field int, v uint64) orcProto {
+	p = binary.AppendUvarint(p, uint64(field)<<3)
+	return binary.AppendUvarint(p, v)
+}
+
+func (p orcProto) bytes(field int, b []byte) orcProto {
+	p = binary.AppendUvarint(p, uint64(field)<<3|2)
+	p = binary.AppendUvarint(p, uint64(len(b)))
+	return append(p, b...)
+}
+
+type orcStream struct {
+	kind int
+	data []byte
+}
+
+// streams returns the streams of the stripe, PRESENT is left out when the column has no nulls in the stripe
+func (c *orcColumn) streams() []orcStream {
+	var streams []orcStream
+	if c.nulls {
+		streams = append(streams, orcStream{orcPresentStream, orcBooleans(c.present)})
+	}
+	switch c.kind {
+	case orcBoolean:
+		streams = append(streams, orcStream{orcDataStream, orcBooleans(c.bools)})
+	case orcByte:
+		b := make([]byte, len(c.ints))
+		for i, v := range c.ints {
+			b[i] = byte(v)
+		}
+		streams = append(streams, orcStream{orcDataStream, orcByteRLE(b)})
+	case orcShort, orcInt, orcLong, orcDate:
+		streams = append(streams, orcStream{orcDataStream, orcIntRLE(c.ints, true)})
+	case orcFloat, orcDouble:
+		streams = append(streams, orcStream{orcDataStream, c.data.Bytes()})
+	case orcTimestamp:
+		streams = append(streams, orcStream{orcDataStream, orcIntRLE(c.ints, true)},
+			orcStream{orcSecondaryStream, orcIntRLE(c.nanos, false)})
+	case orcDecimal:
+		streams = append(streams, orcStream{orcDataStream, c.data.Bytes()},
+			orcStream{orcSecondaryStream, orcIntRLE(c.ints, true)})
+	default:
+		streams = append(streams, orcStream{orcDataStream, c.data.Bytes()},
+			orcStream{orcLengthStream, orcIntRLE(c.lengths, false)})
+	}
+	return streams
+}
+
+func (c *orcColumn) reset() {
+	c.present, c.nulls = c.present[:0], false
+	c.bools, c.ints, c.nanos, c.lengths = c.bools[:0], c.ints[:0], c.nanos[:0], c.lengths[:0]
+	c.data.Reset()
+}
+
+func (o *ORCFormatWriter) write(b []byte) error {
+	if o.offset == 0 {
+		if _, err := io.WriteString(o.writer, "ORC"); err != nil {
+			return err
+		}
+		o.offset = 3
+	}
+	_, err := o.writer.Write(b)
+	o.offset += uint64(len(b))
+	return err
+}
+
+// flushStripe writes the rows of the stripe with its footer
+func (o *ORCFormatWriter) flushStripe() error {
+	if o.rows == 0 {
+		return nil
+	}
+	offset := o.offset
+	if offset == 0 {
+		offset = 3
+	}
+	var dataLength uint64
+	var footer orcProto
+	for i, c := range o.columns {
+		for _, s := range c.streams() {
+			if err := o.write(s.data); err != nil {
+				return err
+			}
+			dataLength += uint64(len(s.data))
+			footer = footer.bytes(1, orcProto{}.uint(1, uint64(s.kind)).uint(2, uint64(i+1)).uint(3, uint64(len(s.data))))
+		}
+		c.reset()
+	}
+	for range len(o.columns) + 1 {
+		// DIRECT
+		footer = footer.bytes(2, orcProto{}.uint(1, 0))
+	}
+	footer = footer.bytes(3, []byte("UTC"))
+	if err := o.write(footer); err != nil {
+		return err
+	}
+	o.stripes = append(o.stripes, orcProto{}.uint(1, offset).uint(2, 0).uint(3, dataLength).
+		uint(4, uint64(len(footer))).uint(5, uint64(o.rows)))
+	o.total += uint64(o.rows)
+	o.rows = 0
+	return nil
+}
+
+// Close writes the last stripe, the file footer with the schema and the postscript
+func (o *ORCFormatWriter) Close() error {
+	if err := o.flushStripe(); err != nil {
+		return err
+	}
+	if o.offset == 0 {
+		if err := o.write(nil); err != nil {
+			return err
+		}
+	}
+	contentLength := o.offset
+	var footer orcProto
+	footer = footer.uint(1, 3).uint(2, contentLength)
+	for _, stripe := range o.stripes {
+		footer = footer.bytes(3, stripe)
+	}
+	var subtypes []byte
+	for i := range o.columns {
+		subtypes = binary.AppendUvarint(subtypes, uint64(i+1))
+	}
+	root := orcProto{}.uint(1, orcStruct).bytes(2, subtypes)
+	for _, name := range o.names {
+		root = root.bytes(3, []byte(name))
+	}
+	footer = footer.bytes(4, root)
+	for _, c := range o.columns {
+		t := orcProto{}.uint(1, uint64(c.kind))
+		if c.kind == orcDecimal {
+			t = t.uint(5, uint64(c.precision)).uint(6, uint64(c.scale))
+		}
+		footer = footer.bytes(4, t)
+	}
+	footer = footer.uint(6, o.total)
+	footer = footer.bytes(7, orcProto{}.uint(1, o.total))
+	for _, c := range o.columns {
+		footer = footer.bytes(7, orcProto{}.uint(1, c.values).uint(10, boolUint(c.hasNull)))
+	}
+	footer = footer.uint(8, 0)
+	postscript := orcProto{}.uint(1, uint64(len(footer))).uint(2, 0).bytes(4, []byte{0, 12}).uint(5, 0).
+		bytes(8000, []byte("ORC"))
+	if err := o.write(footer); err != nil {
+		return err
+	}
+	return o.write(append(postscript, byte(len(postscript))))
+}
+
+func boolUint(b bool) uint64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,100 @@
+package duckserver
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultProgressInterval = 100 * time.Millisecond
+
+// chProgress tracks the counters reported in X-ClickHouse-Progress and X-ClickHouse-Summary headers
+type chProgress struct {
+	start        time.Time
+	readRows     atomic.Int64
+	readBytes    atomic.Int64
+	writtenRows  atomic.Int64
+	writtenBytes atomic.Int64
+	resultRows   atomic.Int64
+}
+
+func newChProgress() *chProgress {
+	return &chProgress{start: time.Now()}
+}
+
+func (p *chProgress) String() string {
+	return fmt.Sprintf(`{"read_rows":"%d","read_bytes":"%d","written_rows":"%d","written_bytes":"%d","total_rows_to_read":"0","result_rows":"%d","result_bytes":"0","elapsed_ns":"%d"}`,
+		p.readRows.Load(), p.readBytes.Load(), p.writtenRows.Load(), p.writtenBytes.Load(), p.resultRows.Load(), time.Since(p.start).Nanoseconds())
+}
+
+// SetSummary sets the X-ClickHouse-Summary header, must be called before the final WriteHeader
+func (p *chProgress) SetSummary(wr http.ResponseWriter) {
+	wr.Header().Set("X-ClickHouse-Summary", p.String())
+	if w := queryLogWriterOf(wr); w != nil {
+		w.readRows, w.readBytes = p.readRows.Load(), p.readBytes.Load()
+	}
+}
+
+// StartReporter periodically sends 102 Processing informational responses carrying X-ClickHouse-Progress,
+// which keeps long-running requests alive through proxies. The returned function stops the reporter and
+// must be called before writing the final response.
+func (p *chProgress) StartReporter(wr http.ResponseWriter, interval time.Duration) func() {
+	if interval <= 0 {
+		interval = defaultProgressInterval
+	}
+	stopCh := make(chan struct{})
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopCh:
+				return
+			case <-ticker.C:
+				wr.Header().Set("X-ClickHouse-Progress", p.String())
+				wr.WriteHeader(http.StatusProcessing)
+			}
+		}
+	}()
+	once := sync.Once{}
+	return func() {
+		once.Do(func() {
+			close(stopCh)
+			wg.Wait()
+		})
+	}
+}
+
+// progressInterval reads clickhouse style progress settings from the request,
+// returns 0 if progress headers are not requested
+func progressInterval(settings url.Values) time.Duration {
+	if settings.Get("send_progress_in_http_headers") != "1" {
+		return 0
+	}
+	interval := defaultProgressInterval
+	if ms, err := strconv.Atoi(settings.Get("http_headers_progress_interval_ms")); err == nil && ms > 0 {
+		interval = time.Duration(ms) * time.Millisecond
+	}
+	return interval
+}
+
+// countingReader counts the bytes read from the request body into progress
+type countingReader struct {
+	rd       io.Reader
+	progress *chProgress
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.rd.Read(p)
+	c.progress.readBytes.Add(int64(n))
+	c.progress.writtenBytes.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,771 @@
+package duckserver
+
+import (
+	"bufio"
+	"database/sql/driver"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// protobufSchemaSetting is the clickhouse setting naming the .proto file and the message of the Protobuf formats,
+// e.g. events:Event for events.proto of the format schema directory
+const protobufSchemaSetting = "format_schema"
+
+// protoTimestamp is the well known type decoded as a timestamp, its import is resolved without the file
+const protoTimestamp = "google.protobuf.Timestamp"
+
+type protoField struct {
+	name     string
+	number   int
+	typ      string
+	repeated bool
+	// nullable fields are null when missing, proto3 scalars are their zero value
+	nullable bool
+	scope    string
+	message  *protoMessage
+	enum     *protoEnum
+	// entry is the key and value message of a map field
+	entry *protoMessage
+}
+
+type protoMessage struct {
+	name   string
+	fields []*protoField
+	index  map[int]int
+}
+
+type protoEnum struct {
+	values map[int64]string
+	first  int64
+}
+
+// value returns the enum of number, the numbers missing from the schema are named by their number
+func (e *protoEnum) value(number int64) protoEnumValue {
+	name, ok := e.values[number]
+	if !ok {
+		name = strconv.FormatInt(number, 10)
+	}
+	return protoEnumValue{number: number, name: name}
+}
+
+// protoEnumValue is a decoded enum, appended as its number to numeric columns and as its name otherwise
+type protoEnumValue struct {
+	number int64
+	name   string
+}
+
+// protoSchema holds the messages and enums of a .proto file and its imports by full name
+type protoSchema struct {
+	dir      string
+	messages map[string]*protoMessage
+	enums    map[string]*protoEnum
+	fields   []*protoField
+	loaded   map[string]bool
+}
+
+// loadProtoSchema parses a .proto file of dir with its imports and returns the message of name
+func loadProtoSchema(dir, file, name string) (*protoMessage, error) {
+	s := &protoSchema{dir: dir, messages: map[string]*protoMessage{}, enums: map[string]*protoEnum{}, loaded: map[string]bool{}}
+	s.messages[protoTimestamp] = &protoMessage{name: protoTimestamp}
+	if filepath.Ext(file) == "" {
+		file += ".proto"
+	}
+	if err := s.load(file); err != nil {
+		return nil, err
+	}
+	for _, f := range s.fields {
+		if err := s.resolve(f); err != nil {
+			return nil, err
+		}
+	}
+	if m, ok := s.messages[name]; ok {
+		return m, nil
+	}
+	for full, m := range s.messages {
+		if strings.HasSuffix(full, "."+name) {
+			return m, nil
+		}
+	}
+	return nil, fmt.Errorf("message %s not found in %s", name, file)
+}
+
+func (s *protoSchema) load(file string) error {
+	if s.loaded[file] {
+		return nil
+	}
+	s.loaded[file] = true
+	// the file is looked up in dir only
+	text, err := os.ReadFile(filepath.Join(s.dir, filepath.Clean("/"+file)))
+	if err != nil {
+		return err
+	}
+	p := &protoParser{schema: s, tokens: protoTokenize(string(text))}
+	if err = p.parseFile(); err != nil {
+		return fmt.Errorf("%s: %w", file, err)
+	}
+	return nil
+}
+
+// resolve looks up the message or enum of a field from its scope outwards like protoc
+func (s *protoSchema) resolve(f *protoField) error {
+	if protoScalarTypes[f.typ] || f.entry != nil {
+		return nil
+	}
+	candidates := []string{strings.TrimPrefix(f.typ, ".")}
+	if !strings.HasPrefix(f.typ, ".") {
+		candidates = nil
+		for scope := f.scope; ; scope = scope[:strings.LastIndexByte(scope, '.')] {
+			if scope == "" {
+				candidates = append(candidates, f.typ)
+				break
+			}
+			candidates = append(candidates, scope+"."+f.typ)
+			if !strings.Contains(scope, ".") {
+				candidates = append(candidates, f.typ)
+				break
+			}
+		}
+	}
+	for _, name := range candidates {
+		if m, ok := s.messages[name]; ok {
+			f.message = m
+			return nil
+		}
+		if e, ok := s.enums[name]; ok {
+			f.enum = e
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown type %s of field %s", f.typ, f.name)
+}
+
+var protoScalarTypes = map[string]bool{
+	"double": true, "float": true, "int32": true, "int64": true, "uint32": true, "uint64": true, "sint32": true,
+	"sint64": true, "fixed32": true, "fixed64": true, "sfixed32": true, "sfixed64": true, "bool": true,
+	"string": true, "bytes": true,
+}
+
+// protoTokenize splits a .proto file into identifiers, numbers, strings and symbols, comments are dropped
+func protoTokenize(s string) []string {
+	var tokens []string
+	for i := 0; i < len(s); {
+		ch := s[i]
+		switch {
+		case ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r':
+			i++
+		case strings.HasPrefix(s[i:], "//"):
+			for i < len(s) && s[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(s[i:], "/*"):
+			end := strings.Index(s[i+2:], "*/")
+			if end < 0 {
+				return tokens
+			}
+			i += end + 4
+		case ch == '"' || ch == '\'':
+			j := i + 1
+			for j < len(s) && s[j] != ch {
+				if s[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			tokens = append(tokens, s[i:min(j+1, len(s))])
+			i = j + 1
+		case ch == '_' || ch == '.' || ch == '-' || ch == '+' || 'a' <= ch && ch <= 'z' || 'A' <= ch && ch <= 'Z' || '0' <= ch && ch <= '9':
+			j := i + 1
+			for j < len(s) && (s[j] == '_' || s[j] == '.' || 'a' <= s[j] && s[j] <= 'z' || 'A' <= s[j] && s[j] <= 'Z' || '0' <= s[j] && s[j] <= '9') {
+				j++
+			}
+			tokens = append(tokens, s[i:j])
+			i = j
+		default:
+			tokens = append(tokens, s[i:i+1])
+			i++
+		}
+	}
+	return tokens
+}
+
+type protoParser struct {
+	schema *protoSchema
+	tokens []string
+	pos    int
+	pkg    string
+	proto3 bool
+}
+
+func (p *protoParser) next() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	p.pos++
+	return p.tokens[p.pos-1]
+}
+
+func (p *protoParser) expect(token string) error {
+	if t := p.next(); t != token {
+		return fmt.Errorf("expected %s, got %q", token, t)
+	}
+	return nil
+}
+
+// skipStatement skips to the end of a statement or of its block
+func (p *protoParser) skipStatement() {
+	for depth := 0; p.pos < len(p.tokens); {
+		switch p.next() {
+		case "{":
+			depth++
+		case "}":
+			if depth--; depth <= 0 {
+				return
+			}
+		case ";":
+			if depth == 0 {
+				return
+			}
+		}
+	}
+}
+
+func (p *protoParser) parseFile() error {
+	for p.pos < len(p.tokens) {
+		switch t := p.next(); t {
+		case "syntax", "edition":
+			_ = p.expect("=")
+			p.proto3 = p.next() != `"proto2"`
+			p.skipStatement()
+		case "package":
+			p.pkg = p.next()
+			p.skipStatement()
+		case "import":
+			file := p.next()
+			if file == "public" || file == "weak" {
+				file = p.next()
+			}
+			p.skipStatement()
+			if file = strings.Trim(file, `"'`); !strings.HasPrefix(file, "google/protobuf/") {
+				if err := p.schema.load(file); err != nil {
+					return err
+				}
+			}
+		case "message":
+			if err := p.parseMessage(p.pkg); err != nil {
+				return err
+			}
+		case "enum":
+			if err := p.parseEnum(p.pkg); err != nil {
+				return err
+			}
+		case ";":
+		default:
+			p.skipStatement()
+		}
+	}
+	return nil
+}
+
+func qualifyProtoName(scope, name string) string {
+	if scope == "" {
+		return name
+	}
+	return scope + "." + name
+}
+
+func (p *protoParser) parseMessage(scope string) error {
+	name := qualifyProtoName(scope, p.next())
+	m := &protoMessage{name: name, index: map[int]int{}}
+	p.schema.messages[name] = m
+	if err := p.expect("{"); err != nil {
+		return err
+	}
+	return p.parseFields(m, false)
+}
+
+// parseFields parses the body of a message or of a oneof up to its closing brace
+func (p *protoParser) parseFields(m *protoMessage, oneof bool) error {
+	for {
+		switch t := p.next(); t {
+		case "":
+			return fmt.Errorf("message %s is not closed", m.name)
+		case "}":
+			return nil
+		case ";":
+		case "message":
+			if err := p.parseMessage(m.name); err != nil {
+				return err
+			}
+		case "enum":
+			if err := p.parseEnum(m.name); err != nil {
+				return err
+			}
+		case "oneof":
+			p.next()
+			if err := p.expect("{"); err != nil {
+				return err
+			}
+			if err := p.parseFields(m, true); err != nil {
+				return err
+			}
+		case "option", "reserved", "extensions", "extend":
+			p.pos--
+			p.skipStatement()
+		default:
+			f := &protoField{scope: m.name, nullable: oneof || !p.proto3}
+			switch t {
+			case "repeated":
+				f.repeated = true
+				t = p.next()
+			case "optional":
+				f.nullable = true
+				t = p.next()
+			case "required":
+				t = p.next()
+			}
+			if t == "map" {
+				entry, err := p.parseMapEntry(m.name)
+				if err != nil {
+					return err
+				}
+				f.entry, f.repeated = entry, true
+				t = "map"
+			}
+			f.typ, f.name = t, p.next()
+			if err := p.expect("="); err != nil {
+				return fmt.Errorf("field %s of %s: %w", f.name, m.name, err)
+			}
+			number, err := strconv.Atoi(p.next())
+			if err != nil {
+				return fmt.Errorf("field %s of %s: %w", f.name, m.name, err)
+			}
+			f.number = number
+			p.skipStatement()
+			m.index[number] = len(m.fields)
+			m.fields = append(m.fields, f)
+			p.schema.fields = append(p.schema.fields, f)
+		}
+	}
+}
+
+// parseMapEntry parses <key, value> of a map field as the message of its entries
+func (p *protoParser) parseMapEntry(scope string) (*protoMessage, error) {
+	if err := p.expect("<"); err != nil {
+		return nil, err
+	}
+	key := p.next()
+	if err := p.expect(","); err != nil {
+		return nil, err
+	}
+	value := p.next()
+	if err := p.expect(">"); err != nil {
+		return nil, err
+	}
+	entry := &protoMessage{index: map[int]int{1: 0, 2: 1}}
+	for i, typ := range []string{key, value} {
+		f := &protoField{name: []string{"key", "value"}[i], number: i + 1, typ: typ, scope: scope}
+		entry.fields = append(entry.fields, f)
+		p.schema.fields = append(p.schema.fields, f)
+	}
+	return entry, nil
+}
+
+func (p *protoParser) parseEnum(scope string) error {
+	e := &protoEnum{values: map[int64]string{}}
+	p.schema.enums[qualifyProtoName(scope, p.next())] = e
+	if err := p.expect("{"); err != nil {
+		return err
+	}
+	first := true
+	for {
+		switch t := p.next(); t {
+		case "":
+			return errors.New("enum is not closed")
+		case "}":
+			return nil
+		case ";":
+		case "option", "reserved":
+			p.pos--
+			p.skipStatement()
+		default:
+			if err := p.expect("="); err != nil {
+				return fmt.Errorf("enum value %s: %w", t, err)
+			}
+			number, err := strconv.ParseInt(p.next(), 0, 64)
+			if err != nil {
+				return fmt.Errorf("enum value %s: %w", t, err)
+			}
+			if _, ok := e.values[number]; !ok {
+				e.values[number] = t
+			}
+			if first {
+				e.first, first = number, false
+			}
+			p.skipStatement()
+		}
+	}
+}
+
+// decode decodes a message of the wire format, the values are in the order of the fields
+func (m *protoMessage) decode(b []byte) ([]any, error) {
+	values := make([]any, len(m.fields))
+	var timestamp [2]int64
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, errors.New("invalid protobuf tag")
+		}
+		b = b[n:]
+		number, wire := int(tag>>3), int(tag&7)
+		if m.name == protoTimestamp && (number == 1 || number == 2) && wire == 0 {
+			v, n := binary.Uvarint(b)
+			if n <= 0 {
+				return nil, errors.New("invalid protobuf timestamp")
+			}
+			timestamp[number-1], b = int64(v), b[n:]
+			continue
+		}
+		i, ok := m.index[number]
+		if !ok {
+			var err error
+			if b, err = skipProtoField(b, wire); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		f := m.fields[i]
+		if f.repeated && wire == 2 && f.entry == nil && f.packable() {
+			data, rest, err := protoBytes(b)
+			if err != nil {
+				return nil, err
+			}
+			items, _ := values[i].([]any)
+			for len(data) > 0 {
+				var v any
+				if v, data, err = f.decodeValue(data, f.packedWire()); err != nil {
+					return nil, err
+				}
+				items = append(items, v)
+			}
+			values[i], b = items, rest
+			continue
+		}
+		v, rest, err := f.decodeValue(b, wire)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %w", f.name, err)
+		}
+		b = rest
+		switch {
+		case f.entry != nil:
+			entries, _ := values[i].(map[string]any)
+			if entries == nil {
+				entries = map[string]any{}
+			}
+			entry := v.([]any)
+			entries[fmt.Sprint(protoPlain(entry[0]))] = protoPlain(entry[1])
+			values[i] = entries
+		case f.repeated:
+			items, _ := values[i].([]any)
+			values[i] = append(items, v)
+		default:
+			values[i] = v
+		}
+	}
+	if m.name == protoTimestamp {
+		return []any{time.Unix(timestamp[0], int64(int32(timestamp[1]))).UTC()}, nil
+	}
+	for i, f := range m.fields {
+		if values[i] == nil {
+			values[i] = f.zero()
+		}
+	}
+	return values, nil
+}
+
+// object returns the values of a nested message by field name
+func (m *protoMessage) object(values []any) any {
+	if m.name == protoTimestamp {
+		return values[0]
+	}
+	object := make(map[string]any, len(m.fields))
+	for i, f := range m.fields {
+		object[f.name] = protoPlain(values[i])
+	}
+	return object
+}
+
+// protoPlain replaces the enums of a value with their names
+func protoPlain(v any) any {
+	switch v := v.(type) {
+	case protoEnumValue:
+		return v.name
+	case []any:
+		plain := make([]any, len(v))
+		for i, item := range v {
+			plain[i] = protoPlain(item)
+		}
+		return plain
+	}
+	return v
+}
+
+func (f *protoField) packable() bool {
+	switch f.typ {
+	case "string", "bytes":
+		return false
+	}
+	return f.message == nil
+}
+
+func (f *protoField) packedWire() int {
+	switch f.typ {
+	case "fixed32", "sfixed32", "float":
+		return 5
+	case "fixed64", "sfixed64", "double":
+		return 1
+	}
+	return 0
+}
+
+// zero returns the value of a missing field
+func (f *protoField) zero() any {
+	switch {
+	case f.entry != nil:
+		return map[string]any{}
+	case f.repeated:
+		return []any{}
+	case f.nullable || f.message != nil:
+		return nil
+	case f.enum != nil:
+		return f.enum.value(f.enum.first)
+	}
+	switch f.typ {
+	case "double", "float":
+		return float64(0)
+	case "uint32", "uint64", "fixed64":
+		return uint64(0)
+	case "bool":
+		return false
+	case "string":
+		return ""
+	case "bytes":
+		return []byte{}
+	}
+	return int64(0)
+}
+
+// decodeValue decodes one value of the field, the rest of b is returned
+func (f *protoField) decodeValue(b []byte, wire int) (any, []byte, error) {
+	switch wire {
+	case 0:
+		v, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, nil, errors.New("invalid protobuf varint")
+		}
+		b = b[n:]
+		if f.enum != nil {
+			return f.enum.value(int64(int32(v))), b, nil
+		}
+		switch f.typ {
+		case "int32":
+			return int64(int32(v)), b, nil
+		case "uint32", "uint64":
+			return v, b, nil
+		case "sint32", "sint64":
+			return int64(v>>1) ^ -int64(v&1), b, nil
+		case "bool":
+			return v != 0, b, nil
+		}
+		return int64(v), b, nil
+	case 1:
+		if len(b) < 8 {
+			return nil, nil, io.ErrUnexpectedEOF
+		}
+		v := binary.LittleEndian.Uint64(b)
+		switch f.typ {
+		case "double":
+			return math.Float64frombits(v), b[8:], nil
+		case "fixed64":
+			return v, b[8:], nil
+		}
+		return int64(v), b[8:], nil
+	case 5:
+		if len(b) < 4 {
+			return nil, nil, io.ErrUnexpectedEOF
+		}
+		v := binary.LittleEndian.Uint32(b)
+		switch f.typ {
+		case "float":
+			return float64(math.Float32frombits(v)), b[4:], nil
+		case "sfixed32":
+			return int64(int32(v)), b[4:], nil
+		}
+		return int64(v), b[4:], nil
+	case 2:
+		data, rest, err := protoBytes(b)
+		if err != nil {
+			return nil, nil, err
+		}
+		switch {
+		case f.entry != nil:
+			v, err := f.entry.decode(data)
+			return v, rest, err
+		case f.message != nil:
+			v, err := f.message.decode(data)
+			if err != nil {
+				return nil, nil, err
+			}
+			return f.message.object(v), rest, nil
+		case f.typ == "string":
+			return string(data), rest, nil
+		}
+		return append([]byte(nil), data...), rest, nil
+	}
+	return nil, nil, fmt.Errorf("unsupported protobuf wire type %d", wire)
+}
+
+func protoBytes(b []byte) ([]byte, []byte, error) {
+	n, l := binary.Uvarint(b)
+	if l <= 0 || uint64(len(b)-l) < n {
+		return nil, nil, errors.New("invalid protobuf length")
+	}
+	return b[l : l+int(n)], b[l+int(n):], nil
+}
+
+// skipProtoField skips a field missing from the schema
+func skipProtoField(b []byte, wire int) ([]byte, error) {
+	switch wire {
+	case 0:
+		if _, n := binary.Uvarint(b); n > 0 {
+			return b[n:], nil
+		}
+	case 1:
+		if len(b) >= 8 {
+			return b[8:], nil
+		}
+	case 5:
+		if len(b) >= 4 {
+			return b[4:], nil
+		}
+	case 2:
+		_, rest, err := protoBytes(b)
+		return rest, err
+	default:
+		return nil, fmt.Errorf("unsupported protobuf wire type %d", wire)
+	}
+	return nil, io.ErrUnexpectedEOF
+}
+
+// protoEnumNumberTypes are the column types appended the number of an enum instead of its name
+var protoEnumNumberTypes = map[string]bool{
+	"TINYINT": true, "SMALLINT": true, "INTEGER": true, "BIGINT": true, "HUGEINT": true,
+	"UTINYINT": true, "USMALLINT": true, "UINTEGER": true, "UBIGINT": true,
+}
+
+// ProtobufFormatReader reads messages prefixed by their varint length, or a single message without length
+type ProtobufFormatReader struct {
+	columnTypes []string
+	fields      []int
+	message     *protoMessage
+	rd          *bufio.Reader
+	single      bool
+	buf         []byte
+}
+
+func newProtobufFormatReader(columnNames, columnTypes []string, reader io.Reader, dir, schema string, single bool) (ClickhouseFormatReader, error) {
+	if dir == "" {
+		return nil, errors.New("protobuf formats require --ch_format_schema_path")
+	}
+	file, name, ok := strings.Cut(schema, ":")
+	if !ok || file == "" || name == "" {
+		return nil, fmt.Errorf("protobuf formats require the %s setting as file:Message", protobufSchemaSetting)
+	}
+	message, err := loadProtoSchema(dir, file, name)
+	if err != nil {
+		return nil, err
+	}
+	fields := make([]int, len(message.fields))
+	for i, f := range message.fields {
+		fields[i] = -1
+		for j, column := range columnNames {
+			if strings.EqualFold(column, f.name) {
+				fields[i] = j
+				if column == f.name {
+					break
+				}
+			}
+		}
+	}
+	return &ProtobufFormatReader{
+		columnTypes: columnTypes,
+		fields:      fields,
+		message:     message,
+		rd:          bufio.NewReader(reader),
+		single:      single,
+	}, nil
+}
+
+func (p *ProtobufFormatReader) Read(values []driver.Value) error {
+	if len(p.columnTypes) != len(values) {
+		return errors.New("column length mismatch")
+	}
+	var data []byte
+	if p.single {
+		if p.buf != nil {
+			return io.EOF
+		}
+		var err error
+		if p.buf, err = io.ReadAll(p.rd); err != nil {
+			return err
+		}
+		data = p.buf
+	} else {
+		n, err := binary.ReadUvarint(p.rd)
+		if err != nil {
+			return err
+		}
+		if n > math.MaxInt32 {
+			return fmt.Errorf("invalid protobuf message length %d", n)
+		}
+		if uint64(cap(p.buf)) < n {
+			p.buf = make([]byte, n)
+		}
+		data = p.buf[:n]
+		if _, err = io.ReadFull(p.rd, data); err != nil {
+			return err
+		}
+	}
+	decoded, err := p.message.decode(data)
+	if err != nil {
+		return err
+	}
+	for i := range values {
+		values[i] = nil
+	}
+	for i, f := range p.message.fields {
+		col := p.fields[i]
+		if col < 0 {
+			continue
+		}
+		v := decoded[i]
+		if e, ok := v.(protoEnumValue); ok && protoEnumNumberTypes[p.columnTypes[col]] {
+			v = e.number
+		}
+		if values[col], err = binaryInputValue(protoPlain(v), p.columnTypes[col]); err != nil {
+			return fmt.Errorf("field %s: %w", f.name, err)
+		}
+	}
+	return nil
+}
+
+func (p *ProtobufFormatReader) Close() error {
+	return nil
+}
@@ -0,0 +1,94 @@
+package duckserver
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var chDatabaseStatementRegexp = regexp.MustCompile(`(?is)^\s*(CREATE|DROP)\s+DATABASE\s+(IF\s+(?:NOT\s+)?EXISTS\s+)?(` + chIdentPattern + `)(?:\s+ON\s+CLUSTER\s+` + chIdentPattern + `)?(?:\s+ENGINE\s*=\s*\w+(?:\([^)]*\))?)?(?:\s+SYNC)?[\s;]*$`)
+var chTableColumnRegexp = regexp.MustCompile(`(?i)(\b(?:where|and|or)\s+)table\b`)
+var chSystemTablesJoinRegexp = regexp.MustCompile(`(?is)\bfrom\s+system\.tables\s+as\s+t\s+join\s+system\.databases\s+as\s+db\b`)
+var chUnqualifiedEngineRegexp = regexp.MustCompile(`(?i)([^.\w])engine\b`)
+var chDropSuffixRegexp = regexp.MustCompile(`(?is)^(\s*DROP\s+(?:TABLE|VIEW)\s+(?:IF\s+EXISTS\s+)?(?:` + chIdentPattern + `\.)?` + chIdentPattern + `)(?:\s+ON\s+CLUSTER\s+` + chIdentPattern + `)?(?:\s+SYNC|\s+NO\s+DELAY)?[\s;]*$`)
+
+// rewriteChQuery rewrites the clickhouse syntax of a query to DuckDB: backquoted identifiers, multiIf, the
+// ON CLUSTER and SYNC of DROP, databases which are schemas and the table column of system.columns
+func rewriteChQuery(query string) string {
+	query = rewriteBackquotes(query)
+	if m := chDatabaseStatementRegexp.FindStringSubmatch(query); m != nil {
+		query = m[1] + " SCHEMA " + m[2] + m[3]
+		if strings.EqualFold(m[1], "DROP") {
+			query += " CASCADE"
+		}
+		return query
+	}
+	query = rewriteMultiIf(query)
+	query = chTableColumnRegexp.ReplaceAllString(query, `$1"table"`)
+	// dbt-clickhouse lists relations joining system.tables and system.databases with an unqualified engine column,
+	// which clickhouse resolves to the left table
+	if chSystemTablesJoinRegexp.MatchString(query) {
+		query = chUnqualifiedEngineRegexp.ReplaceAllString(query, "${1}t.engine")
+	}
+	return chDropSuffixRegexp.ReplaceAllString(query, "$1")
+}
+
+// rewriteBackquotes quotes the backquoted identifiers of clickhouse with double quotes
+func rewriteBackquotes(query string) string {
+	if !strings.Contains(query, "`") {
+		return query
+	}
+	var sb strings.Builder
+	for i := 0; i < len(query); {
+		switch query[i] {
+		case '\'', '"':
+			end := skipChQuoted(query, i)
+			sb.WriteString(query[i:end])
+			i = end
+		case '`':
+			end := skipChQuoted(query, i)
+			name := query[i+1 : max(end-1, i+1)]
+			name = strings.ReplaceAll(strings.ReplaceAll(name, "\\`", "`"), "``", "`")
+			sb.WriteString(quoteIdent(name))
+			i = end
+		default:
+			sb.WriteByte(query[i])
+			i++
+		}
+	}
+	return sb.String()
+}
+
+// rewriteMultiIf rewrites multiIf(cond1, then1, cond2, then2, ..., else) to a CASE expression
+func rewriteMultiIf(query string) string {
+	if !strings.Contains(strings.ToLower(query), "multiif") {
+		return query
+	}
+	var sb strings.Builder
+	last := 0
+	tokens := chTokenize(query)
+	for i := 0; i < len(tokens); i++ {
+		t := tokens[i]
+		if !strings.HasPrefix(t.text, "(") || len(t.text) < 2 || t.text[len(t.text)-1] != ')' {
+			continue
+		}
+		inner := t.text[1 : len(t.text)-1]
+		if i > 0 && strings.EqualFold(tokens[i-1].text, "multiIf") && tokens[i-1].end == t.start {
+			if args := splitTopLevel(inner); len(args) >= 3 && len(args)%2 == 1 {
+				sb.WriteString(query[last:tokens[i-1].start])
+				sb.WriteString("(CASE")
+				for j := 0; j+1 < len(args); j += 2 {
+					_, _ = fmt.Fprintf(&sb, " WHEN %s THEN %s", rewriteMultiIf(args[j]), rewriteMultiIf(args[j+1]))
+				}
+				_, _ = fmt.Fprintf(&sb, " ELSE %s END)", rewriteMultiIf(args[len(args)-1]))
+				last = t.end
+				continue
+			}
+		}
+		sb.WriteString(query[last:t.start])
+		sb.WriteString("(" + rewriteMultiIf(inner) + ")")
+		last = t.end
+	}
+	sb.WriteString(query[last:])
+	return sb.String()
+}
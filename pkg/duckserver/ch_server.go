@@ -0,0 +1,1202 @@
+package duckserver
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const authTTL = 60
+
+// defaultClickhouseVersion is the clickhouse version reported when not configured
+const defaultClickhouseVersion = "23.3.1.2823"
+
+type authItem struct {
+	user     string
+	password string
+	time     time.Time
+}
+
+type ChServer struct {
+	conn         *sql.DB
+	connector    driver.Connector
+	pgServer     *PgServer
+	authCache    sync.Map
+	sessions     sync.Map
+	asyncInserts *asyncInserter
+	enableAuth   bool
+	jwt          *jwtVerifier
+	// serverVersion replaces version() in queries, displayName is the X-ClickHouse-Server-Display-Name header
+	serverVersion string
+	displayName   string
+	cors          *corsPolicy
+	// partitions creates partitioned tables for the time partition keys
+	partitions bool
+	// formatSchemaPath is the directory of the .proto files of the Protobuf formats
+	formatSchemaPath string
+	// coalesceInsertBytes is the body size of the inserts coalesced like async_insert=1, 0 disables it
+	coalesceInsertBytes int64
+	// spool acknowledges the async inserts not waiting for their flush once on disk, nil disables it
+	spool *ingestSpool
+	// statements are the statement classes allowed on the listener, empty allows all
+	statements []string
+}
+
+var testInsertFormatRegexp = regexp.MustCompile(`(?i)^\s*INSERT\s+INTO.*?format\s+\S+[\s;]*$`)
+var testInsertValuesQueryRegexp = regexp.MustCompile(`(?i)^\s*INSERT\s+INTO.*VALUES.*[\s;]*$`)
+var testInsertRegexp = regexp.MustCompile(`(?i)^\s*INSERT$`)
+var versionFunctionRegexp = regexp.MustCompile(`(?i)\bversion\(\s*\)`)
+
+func getSHA256Sum(key []byte) []byte {
+	h := sha256.New()
+	_, _ = h.Write(key)
+	return h.Sum(nil)
+}
+
+func (c *ChServer) Auth(user, password string) error {
+	if cacheItem, ok := c.authCache.Load(user); ok {
+		if time.Since(cacheItem.(*authItem).time).Seconds() < authTTL {
+			if cacheItem.(*authItem).password == password {
+				return nil
+			} else {
+				return fmt.Errorf("invalid username or password")
+			}
+		}
+	}
+	if err := c.pgServer.authProvider.VerifyPassword(user, password); err != nil {
+		return fmt.Errorf("invalid username or password")
+	}
+	c.authCache.Store(user, &authItem{user: user, password: password, time: time.Now()})
+	return nil
+}
+
+func (c *ChServer) ServeHTTP(wr http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if c.cors.Handle(wr, r) {
+		return
+	}
+	wr.Header().Set("X-ClickHouse-Server-Display-Name", c.displayName)
+	if r.URL.Path == "/ping" {
+		_, _ = io.WriteString(wr, "Ok.\n")
+		return
+	}
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		user = r.URL.Query().Get("user")
+		password = r.URL.Query().Get("password")
+	}
+	if c.enableAuth && c.jwt != nil && strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+		var err error
+		if user, err = c.jwt.Verify(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")); err != nil {
+			wr.WriteHeader(401)
+			_, _ = fmt.Fprintf(wr, "Unauthorized: %s", err)
+			return
+		}
+	} else if c.enableAuth {
+		if user == "" {
+			wr.WriteHeader(401)
+			_, _ = fmt.Fprintf(wr, "User not specified")
+			return
+		}
+		if password == "" {
+			wr.WriteHeader(401)
+			_, _ = fmt.Fprintf(wr, "Password not specified")
+			return
+		}
+		err := c.Auth(user, password)
+		if err != nil {
+			wr.WriteHeader(401)
+			_, _ = fmt.Fprintf(wr, "Unauthorized: %s", err)
+			return
+		}
+	}
+	if user == "" {
+		user = "default"
+	}
+	// the metrics label users and applications, unauthenticated monitoring uses the admin listener
+	if r.URL.Path == "/metrics" {
+		metrics.ServeHTTP(wr, r)
+		return
+	}
+	if r.URL.Path == "/replication/status" {
+		c.pgServer.serveReplicationStatus(wr, r)
+		return
+	}
+	if r.URL.Path == "/sessions" {
+		// a user lists its own sessions, superusers and the admin listener list all sessions
+		if c.pgServer.isSuperuser(user) {
+			c.pgServer.serveSessions(wr, r)
+			return
+		}
+		wr.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(wr).Encode(c.pgServer.Sessions(user))
+		return
+	}
+	if err := c.pgServer.usage.Check(user); err != nil {
+		wr.WriteHeader(http.StatusTooManyRequests)
+		_, _ = fmt.Fprintf(wr, "%s", err)
+		return
+	}
+	application := requestApplication(r)
+	start := time.Now()
+	var query string
+	if c.pgServer.queryLog != nil {
+		logWriter := &chQueryLogWriter{ResponseWriter: wr}
+		wr = logWriter
+		defer func() {
+			entry := logWriter.entry()
+			entry.start, entry.duration, entry.query = start, time.Since(start), strings.TrimSpace(query)
+			entry.user, entry.application, entry.protocol = user, application, ProtocolClickhouse
+			c.pgServer.queryLog.Record(entry)
+		}()
+	}
+	defer func() {
+		c.pgServer.usage.Record(user, application, time.Since(start))
+	}()
+	ctx := withListenerStatements(withApplication(withUser(r.Context(), user), application), c.statements)
+	if isTrueSetting(r.URL.Query().Get(profilingSetting)) {
+		ctx = withProfiling(ctx)
+	}
+	if isTrueSetting(r.URL.Query().Get(queryStatsSetting)) {
+		ctx = withQueryStats(ctx)
+	}
+	session, err := c.session(r, user, application)
+	if err != nil {
+		wr.WriteHeader(400)
+		_, _ = fmt.Fprintf(wr, "%s", err)
+		return
+	}
+	if session != nil {
+		ctx = withChSession(ctx, session)
+		if isTrueSetting(r.URL.Query().Get(waitForFlushSetting)) {
+			if err = c.waitPending(ctx, session); err != nil {
+				wr.WriteHeader(500)
+				_, _ = fmt.Fprintf(wr, "Error flushing async insert of the session: %s", strings.TrimSpace(err.Error()))
+				return
+			}
+		}
+	}
+	if database := requestDatabase(r, session); database != "" {
+		ctx = withDatabase(ctx, database)
+	}
+	if r.URL.Path == queryCursorPath {
+		c.serveQueryCursor(ctx, wr, r)
+		return
+	}
+	if r.URL.Path == namedQueryPath {
+		c.serveNamedQueries(ctx, wr, r)
+		return
+	}
+	if name := r.URL.Query().Get(namedQuerySetting); name != "" {
+		q := c.pgServer.namedQueries.Get(name)
+		if q == nil {
+			wr.WriteHeader(404)
+			_, _ = fmt.Fprintf(wr, "Named query %s not found", name)
+			return
+		}
+		if query, err = q.Bind(r.URL.Query()); err != nil {
+			wr.WriteHeader(400)
+			_, _ = fmt.Fprintf(wr, "%s", err)
+			return
+		}
+		c.SelectQuery(ctx, query, r.URL.Query(), wr)
+		return
+	}
+	if r.URL.Path == exportPath {
+		c.serveExport(ctx, wr, r)
+		return
+	}
+	if r.URL.Path == "/explain" {
+		d, _ := io.ReadAll(r.Body)
+		query = r.URL.Query().Get("query") + " " + string(d)
+		c.ExplainJSON(ctx, query, wr)
+		return
+	}
+	if r.Method == http.MethodGet {
+		query = r.URL.Query().Get("query")
+		d, _ := io.ReadAll(r.Body)
+		query += " "
+		query += string(d)
+		c.SelectQuery(ctx, query, r.URL.Query(), wr)
+	}
+	if r.Method == http.MethodPost {
+		query = r.URL.Query().Get("query")
+		if query != "" {
+			query += "\n"
+		}
+		progress := newChProgress()
+		rd := bufio.NewReader(&countingReader{rd: r.Body, progress: progress})
+		for {
+			if testSelectQueryRegexp.MatchString(query) || explainRegexp.MatchString(query) {
+				d, _ := io.ReadAll(rd)
+				query += string(d)
+				c.SelectQuery(ctx, query, r.URL.Query(), wr)
+				return
+			}
+			if testInsertFormatRegexp.MatchString(query) {
+				c.InsertFormat(ctx, query, c.coalesceInsert(r), rd, wr, progress)
+				return
+			}
+			if query != "" && (!testInsertRegexp.MatchString(query) || testInsertValuesQueryRegexp.MatchString(query)) {
+				d, _ := io.ReadAll(rd)
+				query += string(d)
+				c.ExecuteQuery(ctx, query, wr, progress)
+				return
+			}
+			line, err := rd.ReadString('\n')
+			query += strings.ReplaceAll(line, "\n", " ")
+			if err != nil {
+				break
+			}
+		}
+		if testSelectQueryRegexp.MatchString(query) || explainRegexp.MatchString(query) {
+			c.SelectQuery(ctx, query, r.URL.Query(), wr)
+			return
+		}
+		if !testInsertRegexp.MatchString(query) || testInsertValuesQueryRegexp.MatchString(query) {
+			c.ExecuteQuery(ctx, query, wr, progress)
+			return
+		}
+	}
+}
+
+// requestApplication returns the application of a clickhouse request, the client_name setting or the User-Agent
+// header like http_user_agent of the clickhouse query log
+func requestApplication(r *http.Request) string {
+	if name := r.URL.Query().Get("client_name"); name != "" {
+		return truncateApplication(name)
+	}
+	return truncateApplication(r.UserAgent())
+}
+
+// defaultFormatSetting is the format of the selects without FORMAT clause, TabSeparated by default
+const defaultFormatSetting = "default_format"
+
+var testSelectQueryRegexp = regexp.MustCompile(`(?i)^\s*SELECT.*$`)
+var selectFormatRegexp = regexp.MustCompile(`(?i)^\s*(?:EXPLAIN\s+(?:ANALYZE\s+)?)?SELECT.* format (\S*?)[\s;]*$`)
+var formatCleanRegexp = regexp.MustCompile(`(?i)^\s*((?:EXPLAIN\s+(?:ANALYZE\s+)?)?SELECT.* )(format \S*?)[\s;]*$`)
+var limitRewriteRegexp = regexp.MustCompile(`(?i)LIMIT\s+(\d+)\s*,\s*(\d+)`)
+
+// rewriteSelectQuery rewrites a clickhouse select for DuckDB and applies the row policies of the user, the error
+// comes with its http status
+func (c *ChServer) rewriteSelectQuery(ctx context.Context, query string) (string, int, error) {
+	//quick fix for datagrip
+	query = strings.TrimSpace(rewriteChQuery(query))
+	query = versionFunctionRegexp.ReplaceAllLiteralString(query, "'"+strings.ReplaceAll(c.serverVersion, "'", "''")+"'")
+	query = strings.Replace(query, "select table", `select "table"`, 1)
+	logrus.Debugf("Executing ch query: %s", query)
+	query = strings.ReplaceAll(query, "\n", " ")
+	query = limitRewriteRegexp.ReplaceAllString(query, "LIMIT $2 OFFSET $1")
+	query, err := c.pgServer.rowPolicies.Rewrite(UserFromContext(ctx), query)
+	if err != nil {
+		return "", 403, err
+	}
+	if !testSelectQueryRegexp.MatchString(query) && !explainRegexp.MatchString(query) {
+		return "", 400, fmt.Errorf("Invalid query")
+	}
+	return query, 200, nil
+}
+
+func (c *ChServer) SelectQuery(ctx context.Context, query string, settings url.Values, wr http.ResponseWriter) {
+	if err := c.pgServer.checkQuery(ctx, ProtocolClickhouse, query); err != nil {
+		wr.WriteHeader(403)
+		_, _ = fmt.Fprintf(wr, "%s", err)
+		return
+	}
+	// a select may be followed by writing statements
+	if err := c.pgServer.diskGuard.CheckQuery(query); err != nil {
+		wr.WriteHeader(http.StatusInsufficientStorage)
+		_, _ = fmt.Fprintf(wr, "%s", err)
+		return
+	}
+	if err := c.pgServer.replica.CheckQuery(query); err != nil {
+		wr.WriteHeader(http.StatusForbidden)
+		_, _ = fmt.Fprintf(wr, "%s", err)
+		return
+	}
+	hints, err := parseQueryHints(query)
+	if err != nil {
+		wr.WriteHeader(400)
+		_, _ = fmt.Fprintf(wr, "%s", err)
+		return
+	}
+	settings = hints.Settings(settings)
+	ctx, done, err := c.pgServer.applyQueryHints(ctx, UserFromContext(ctx), hints)
+	if err != nil {
+		wr.WriteHeader(500)
+		_, _ = fmt.Fprintf(wr, "Error executing query: %s", err)
+		return
+	}
+	defer done()
+	if c.showStatement(ctx, query, wr) {
+		return
+	}
+	query, code, err := c.rewriteSelectQuery(ctx, query)
+	if err != nil {
+		wr.WriteHeader(code)
+		_, _ = fmt.Fprintf(wr, "%s", err)
+		return
+	}
+	format := "TabSeparated"
+	if f := settings.Get(defaultFormatSetting); f != "" {
+		format = f
+	}
+	if m := selectFormatRegexp.FindStringSubmatch(query); len(m) > 1 {
+		format = m[1]
+		query = formatCleanRegexp.ReplaceAllString(query, "$1")
+	}
+	if !explainRegexp.MatchString(query) {
+		if query, err = limitQuery(query, settings); err != nil {
+			wr.WriteHeader(400)
+			_, _ = fmt.Fprintf(wr, "%s", err)
+			return
+		}
+	}
+	if cache := c.pgServer.resultCache; cache != nil && !explainRegexp.MatchString(query) {
+		policy, cached, err := parseResultCachePolicy(settings, cache.defaultStale)
+		if err != nil {
+			wr.WriteHeader(400)
+			_, _ = fmt.Fprintf(wr, "%s", err)
+			return
+		}
+		if cached {
+			run := func(ctx context.Context, wr http.ResponseWriter) {
+				c.runSelect(ctx, query, format, settings, wr)
+			}
+			key := resultCacheKey(ctx, query, format, settings)
+			if cache.Serve(ctx, wr, key, run) {
+				return
+			}
+			w := cache.Writer(wr, key, policy)
+			run(ctx, w)
+			w.Done(ctx)
+			return
+		}
+	}
+	c.runSelect(ctx, query, format, settings, wr)
+}
+
+// runSelect runs a rewritten select and writes its result in format
+func (c *ChServer) runSelect(ctx context.Context, query, format string, settings url.Values, wr http.ResponseWriter) {
+	query, cleanup, err := c.pgServer.fetchRemoteTables(ctx, query)
+	if err != nil {
+		wr.WriteHeader(500)
+		_, _ = fmt.Fprintf(wr, "Error executing query: %s", err)
+		return
+	}
+	defer cleanup()
+	if format == "Parquet" && !explainRegexp.MatchString(query) {
+		c.writeParquet(ctx, query, wr)
+		return
+	}
+	if format == "DuckDB" && !explainRegexp.MatchString(query) {
+		c.writeDuckDB(ctx, query, wr)
+		return
+	}
+	formater := c.outputFormat(format, settings)
+	if formater == nil {
+		wr.WriteHeader(400)
+		_, _ = fmt.Fprintf(wr, "Unknown format %s", format)
+		return
+	}
+	if explainRegexp.MatchString(query) {
+		c.writeExplain(ctx, query, formater, wr)
+		return
+	}
+	progress := newChProgress()
+	conn, profiled, err := c.profiledConn(ctx, query, wr, progress)
+	if err != nil {
+		wr.WriteHeader(500)
+		_, _ = fmt.Fprintf(wr, "Error getting connection: %s", err)
+		return
+	}
+	defer profiled.Done()
+	rows, err := conn.QueryContext(ctx, query)
+	if err != nil {
+		wr.WriteHeader(500)
+		_, _ = fmt.Fprintf(wr, "Error executing query: %s", queryError(ctx, err))
+		return
+	}
+	defer rows.Close()
+	// DuckDB materializes the result, the query already ran
+	profiled.Finish()
+	progress.SetSummary(wr)
+	columnsDesc, err := rows.ColumnTypes()
+	columnNames := make([]string, len(columnsDesc))
+	columnTypes := make([]string, len(columnsDesc))
+	for i, col := range columnsDesc {
+		columnNames[i] = col.Name()
+		columnTypes[i] = col.DatabaseTypeName()
+	}
+	//gz := gzip.NewWriter(wr)
+	fmter, err := formater(columnNames, columnTypes, wr)
+	if err != nil {
+		wr.WriteHeader(500)
+		_, _ = fmt.Fprintf(wr, "Error creating format: %s", err)
+		return
+	}
+	wr.Header().Set("Transfer-Encoding", "chunked")
+	wr.Header().Set("x-clickhouse-format", format)
+	wr.Header().Set("Content-Type", GetClickhouseFormatContentType(format))
+	wr.WriteHeader(200)
+	values := make([]any, len(columnNames))
+	valuePointers := make([]any, len(columnNames))
+	for i := range values {
+		valuePointers[i] = &values[i]
+	}
+	responseController := http.NewResponseController(wr)
+	lastFlush := time.Now()
+	written := 0
+	for rows.Next() {
+		if ctx.Err() != nil {
+			logrus.Debugf("client went away after %d rows of %s", written, query)
+			return
+		}
+		err = rows.Scan(valuePointers...)
+		if err != nil {
+			writeChStreamError(wr, fmter, chErrorUnknownException, "Error scanning row: %s", err)
+			return
+		}
+		err = fmter.Write(values)
+		if err != nil {
+			writeChStreamError(wr, fmter, chErrorCannotConvertType, "Error writing row: %s", err)
+			return
+		}
+		written++
+		if time.Since(lastFlush) >= selectFlushInterval {
+			if err = flushRows(fmter, responseController); err != nil {
+				logrus.Debugf("client went away after %d rows of %s: %s", written, query, err)
+				return
+			}
+			lastFlush = time.Now()
+		}
+	}
+	if err = rows.Err(); err != nil {
+		writeChStreamError(wr, fmter, chErrorUnknownException, "Error reading rows: %s", err)
+		return
+	}
+	if err = fmter.Close(); err != nil {
+		writeChStreamError(wr, nil, chErrorCannotConvertType, "Error writing result: %s", err)
+	}
+}
+
+// limitQuery limits the rows of a select by the limit and offset settings like clickhouse, on top of the LIMIT of
+// the query, 0 is no limit
+func limitQuery(query string, settings url.Values) (string, error) {
+	var limits [2]uint64
+	for i, name := range []string{"limit", "offset"} {
+		if value := settings.Get(name); value != "" {
+			n, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				return "", fmt.Errorf("Cannot parse setting %s: %q is not an unsigned integer", name, value)
+			}
+			limits[i] = n
+		}
+	}
+	if limits[0] == 0 && limits[1] == 0 {
+		return query, nil
+	}
+	query = "SELECT * FROM (" + strings.TrimRight(query, "; ") + ")"
+	if limits[0] > 0 {
+		query += fmt.Sprintf(" LIMIT %d", limits[0])
+	}
+	if limits[1] > 0 {
+		query += fmt.Sprintf(" OFFSET %d", limits[1])
+	}
+	return query, nil
+}
+
+// chExceptionCodeHeader is the clickhouse error code of a failed response, sent as trailer when the error happens
+// after the rows started
+const chExceptionCodeHeader = "X-ClickHouse-Exception-Code"
+
+// the clickhouse error codes of the errors after the headers were sent
+const (
+	chErrorCannotConvertType = 70
+	chErrorUnknownException  = 1002
+)
+
+var chErrorNames = map[int]string{
+	chErrorCannotConvertType: "CANNOT_CONVERT_TYPE",
+	chErrorUnknownException:  "UNKNOWN_EXCEPTION",
+}
+
+// writeChStreamError reports an error after the 200 header like clickhouse, the rows buffered by fmter are sent
+// and the body ends with the exception text, which drivers recognize by its "Code: " prefix, and the code trailer
+func writeChStreamError(wr http.ResponseWriter, fmter ClickhouseFormatWriter, code int, format string, args ...any) {
+	if f, ok := fmter.(formatFlusher); ok {
+		_ = f.Flush()
+	}
+	wr.Header().Set(http.TrailerPrefix+chExceptionCodeHeader, strconv.Itoa(code))
+	if w := queryLogWriterOf(wr); w != nil {
+		w.streamErr = true
+		w.exception = []byte(fmt.Sprintf(format, args...))
+	}
+	_, _ = fmt.Fprintf(wr, "\nCode: %d. DB::Exception: %s. (%s)\n", code, fmt.Sprintf(format, args...), chErrorNames[code])
+}
+
+// selectFlushInterval is how often the rows of a select written so far are sent, so clients see a long result
+// arriving instead of the buffers filling up
+const selectFlushInterval = 200 * time.Millisecond
+
+// formatFlusher is implemented by the formats buffering their rows
+type formatFlusher interface {
+	Flush() error
+}
+
+// flushRows sends the rows written so far to the client, an error means the client went away
+func flushRows(fmter ClickhouseFormatWriter, responseController *http.ResponseController) error {
+	if f, ok := fmter.(formatFlusher); ok {
+		if err := f.Flush(); err != nil {
+			return err
+		}
+	}
+	if err := responseController.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+	return nil
+}
+
+// writeParquet answers a query in FORMAT Parquet, DuckDB writes the result to a temporary file which is sent
+func (c *ChServer) writeParquet(ctx context.Context, query string, wr http.ResponseWriter) {
+	f, err := os.CreateTemp(c.pgServer.scratchDir, "duckserver-*.parquet")
+	if err != nil {
+		wr.WriteHeader(500)
+		_, _ = fmt.Fprintf(wr, "Error creating file: %s", err)
+		return
+	}
+	_ = f.Close()
+	defer os.Remove(f.Name())
+	progress := newChProgress()
+	conn, profiled, err := c.profiledConn(ctx, query, wr, progress)
+	if err != nil {
+		wr.WriteHeader(500)
+		_, _ = fmt.Fprintf(wr, "Error getting connection: %s", err)
+		return
+	}
+	_, err = conn.ExecContext(ctx, fmt.Sprintf("COPY (%s) TO %s (FORMAT PARQUET)", query, quoteLiteral(f.Name())))
+	profiled.Done()
+	if err != nil {
+		wr.WriteHeader(500)
+		_, _ = fmt.Fprintf(wr, "Error executing query: %s", err)
+		return
+	}
+	if f, err = os.Open(f.Name()); err != nil {
+		wr.WriteHeader(500)
+		_, _ = fmt.Fprintf(wr, "Error reading result: %s", err)
+		return
+	}
+	defer f.Close()
+	progress.SetSummary(wr)
+	wr.Header().Set("x-clickhouse-format", "Parquet")
+	wr.Header().Set("Content-Type", "application/octet-stream")
+	wr.WriteHeader(200)
+	_, _ = io.Copy(wr, f)
+}
+
+func (c *ChServer) ExecuteQuery(ctx context.Context, query string, wr http.ResponseWriter, progress *chProgress) {
+	if err := c.pgServer.checkQuery(ctx, ProtocolClickhouse, query); err != nil {
+		wr.WriteHeader(403)
+		_, _ = fmt.Fprintf(wr, "%s", err)
+		return
+	}
+	hints, err := parseQueryHints(query)
+	if err != nil {
+		wr.WriteHeader(400)
+		_, _ = fmt.Fprintf(wr, "%s", err)
+		return
+	}
+	ctx, done, err := c.pgServer.applyQueryHints(ctx, UserFromContext(ctx), hints)
+	if err != nil {
+		wr.WriteHeader(500)
+		_, _ = fmt.Fprintf(wr, "Error executing query: %s", err)
+		return
+	}
+	defer done()
+	if systemCheckpointRegexp.MatchString(query) {
+		if err := c.pgServer.checkpointer.Checkpoint(ctx); err != nil {
+			wr.WriteHeader(500)
+			_, _ = fmt.Fprintf(wr, "Error executing checkpoint: %s", err)
+			return
+		}
+		wr.WriteHeader(200)
+		return
+	}
+	if err := c.pgServer.diskGuard.CheckQuery(query); err != nil {
+		wr.WriteHeader(http.StatusInsufficientStorage)
+		_, _ = fmt.Fprintf(wr, "%s", err)
+		return
+	}
+	if err := c.pgServer.replica.CheckQuery(query); err != nil {
+		wr.WriteHeader(http.StatusForbidden)
+		_, _ = fmt.Fprintf(wr, "%s", err)
+		return
+	}
+	if _, skipped, ok, err := c.pgServer.runExportCommand(ctx, UserFromContext(ctx), query); ok {
+		var dbErr *databaseError
+		if errors.As(err, &dbErr) && dbErr.code == SqlStateInsufficientPrivilege {
+			wr.WriteHeader(http.StatusForbidden)
+			_, _ = fmt.Fprintf(wr, "%s", err)
+			return
+		}
+		if err != nil {
+			wr.WriteHeader(500)
+			_, _ = fmt.Fprintf(wr, "Error executing query: %s", err)
+			return
+		}
+		wr.WriteHeader(200)
+		for _, table := range skipped {
+			_, _ = fmt.Fprintf(wr, "table %s isn't empty, its data wasn't imported\n", table)
+		}
+		return
+	}
+	if m := chUseRegexp.FindStringSubmatch(query); m != nil {
+		c.use(ctx, m[1], wr)
+		return
+	}
+	if c.showStatement(ctx, query, wr) {
+		return
+	}
+	ddl, translated := translateChCreateTable(query)
+	if translated {
+		logrus.Debugf("translated ch create table: %s", ddl.query)
+		query = ddl.query
+		if column, granularity, ok := parsePartitionKey(ddl.partitionKey); ok && c.partitions && ddl.columns != "" {
+			err := c.pgServer.createPartitionedTable(ctx, chSchema(ctx, ddl.schema), ddl.table, ddl.ifNotExists, ddl.columns, column, granularity)
+			if err == nil {
+				c.pgServer.notifySchemaChange(query)
+				err = c.recordChTable(ctx, ddl)
+			}
+			if err != nil {
+				wr.WriteHeader(500)
+				_, _ = fmt.Fprintf(wr, "Error executing query: %s", err)
+				return
+			}
+			wr.WriteHeader(200)
+			return
+		}
+	}
+	query = rewriteChQuery(query)
+	query, err = c.pgServer.rowPolicies.Rewrite(UserFromContext(ctx), query)
+	if err != nil {
+		wr.WriteHeader(403)
+		_, _ = fmt.Fprintf(wr, "%s", err)
+		return
+	}
+	if _, rows, ok, err := c.pgServer.runPartitionCommand(ctx, nil, false, chSchema(ctx, ""), query); ok {
+		if err != nil {
+			wr.WriteHeader(500)
+			_, _ = fmt.Fprintf(wr, "Error executing query: %s", err)
+			return
+		}
+		c.pgServer.notifySchemaChange(query)
+		progress.writtenRows.Store(rows)
+		progress.SetSummary(wr)
+		wr.WriteHeader(200)
+		return
+	}
+	if m := chExchangeTablesRegexp.FindStringSubmatch(query); m != nil {
+		c.exchangeTables(ctx, query, m, wr)
+		return
+	}
+	if m := chRenameTableRegexp.FindStringSubmatch(query); m != nil {
+		c.renameTables(ctx, query, m[1], wr)
+		return
+	}
+	query, cleanup, err := c.pgServer.fetchRemoteTables(ctx, query)
+	if err != nil {
+		wr.WriteHeader(500)
+		_, _ = fmt.Fprintf(wr, "Error executing query: %s", err)
+		return
+	}
+	defer cleanup()
+	conn, profiled, err := c.profiledConn(ctx, query, wr, progress)
+	if err != nil {
+		wr.WriteHeader(500)
+		_, _ = fmt.Fprintf(wr, "Error getting connection: %s", err)
+		return
+	}
+	result, err := conn.ExecContext(ctx, query)
+	profiled.Done()
+	c.pgServer.notifySchemaChange(query)
+	if err != nil {
+		wr.WriteHeader(500)
+		_, _ = fmt.Fprintf(wr, "Error executing query: %s", queryError(ctx, err))
+		return
+	}
+	if translated {
+		err = c.recordChTable(ctx, ddl)
+	} else if m := chDropTableRegexp.FindStringSubmatch(query); m != nil {
+		err = c.forgetChTable(ctx, chUnquote(m[1]), chUnquote(m[2]))
+	}
+	if err != nil {
+		wr.WriteHeader(500)
+		_, _ = fmt.Fprintf(wr, "Error recording table metadata: %s", err)
+		return
+	}
+	if affected, err := result.RowsAffected(); err == nil {
+		progress.writtenRows.Store(affected)
+	}
+	progress.SetSummary(wr)
+	wr.WriteHeader(200)
+}
+
+var insertFormatRegexp = regexp.MustCompile(`(?i)^\s*INSERT\s+INTO(.*?)format\s+(\S+)[\s;]*$`)
+
+func (c *ChServer) InsertFormat(ctx context.Context, query string, settings url.Values, rd *bufio.Reader, wr http.ResponseWriter, progress *chProgress) {
+	if err := c.pgServer.checkQuery(ctx, ProtocolClickhouse, query); err != nil {
+		wr.WriteHeader(403)
+		_, _ = fmt.Fprintf(wr, "%s", err)
+		return
+	}
+	groups := insertFormatRegexp.FindStringSubmatch(query)
+	if len(groups) < 3 {
+		wr.WriteHeader(400)
+		_, _ = fmt.Fprintf(wr, "Invalid query")
+		return
+	}
+	if err := c.pgServer.diskGuard.CheckWrite(); err != nil {
+		wr.WriteHeader(http.StatusInsufficientStorage)
+		_, _ = fmt.Fprintf(wr, "%s", err)
+		return
+	}
+	if err := c.pgServer.replica.CheckWrite(); err != nil {
+		wr.WriteHeader(http.StatusForbidden)
+		_, _ = fmt.Fprintf(wr, "%s", err)
+		return
+	}
+	tableExpr := groups[1]
+	format := groups[2]
+	formater := c.inputFormat(format, settings)
+	if formater == nil {
+		wr.WriteHeader(400)
+		_, _ = fmt.Fprintf(wr, "Unknown format %s", format)
+		return
+	}
+	schema, table, columns, err := parseTablesAndColumns(tableExpr)
+	if err != nil {
+		wr.WriteHeader(400)
+		_, _ = fmt.Fprintf(wr, "Invalid table expression: %s", err)
+		return
+	}
+	if database := databaseFromContext(ctx); database != "" && !strings.Contains(tableExpr, ".") {
+		schema = database
+	}
+	if err = c.pgServer.rowPolicies.CheckWrite(UserFromContext(ctx), schema, table); err != nil {
+		wr.WriteHeader(403)
+		_, _ = fmt.Fprintf(wr, "%s", err)
+		return
+	}
+	transfer, err := parseInsertTransfer(settings)
+	if err != nil {
+		wr.WriteHeader(400)
+		_, _ = fmt.Fprintf(wr, "Invalid transfer: %s", err)
+		return
+	}
+	if transfer != nil {
+		rows, found, err := c.lookupInsertTransfer(ctx, transfer)
+		if err != nil {
+			wr.WriteHeader(500)
+			_, _ = fmt.Fprintf(wr, "Error looking up transfer: %s", err)
+			return
+		}
+		if found {
+			// part already committed by a previous attempt, drain the body and report it again
+			_, _ = io.Copy(io.Discard, rd)
+			progress.writtenRows.Store(rows)
+			progress.SetSummary(wr)
+			wr.Header().Set("X-DuckServer-Transfer-Duplicate", "1")
+			wr.WriteHeader(200)
+			return
+		}
+	}
+	if isTrueSetting(settings.Get(autoCreateTableSetting)) {
+		exists, err := c.tableExists(ctx, schema, table)
+		if err != nil {
+			wr.WriteHeader(500)
+			_, _ = fmt.Fprintf(wr, "Error looking up table: %s", err)
+			return
+		}
+		if !exists {
+			var code int
+			if rd, code, err = c.autoCreateTable(ctx, schema, table, columns, format, rd); err != nil {
+				wr.WriteHeader(code)
+				_, _ = fmt.Fprintf(wr, "Error creating table: %s", err)
+				return
+			}
+		}
+	}
+	rows, err := c.conn.QueryContext(context.Background(), fmt.Sprintf("SELECT * FROM %s.%s LIMIT 0", schema, table))
+	if err != nil {
+		wr.WriteHeader(500)
+		_, _ = fmt.Fprintf(wr, "Error getting table description: %s", err)
+		return
+	}
+	columnDesc, err := rows.ColumnTypes()
+	if err != nil {
+		wr.WriteHeader(500)
+		_, _ = fmt.Fprintf(wr, "Error getting table description: %s", err)
+		return
+	}
+	_ = rows.Close()
+	// generated columns are computed, the appender and the rows of the input leave them out
+	generated, err := generatedColumns(ctx, c.conn, schema, table)
+	if err != nil {
+		wr.WriteHeader(500)
+		_, _ = fmt.Fprintf(wr, "Error getting table description: %s", err)
+		return
+	}
+	if len(generated) > 0 {
+		columnDesc = slices.DeleteFunc(columnDesc, func(col *sql.ColumnType) bool {
+			return generated[col.Name()]
+		})
+	}
+	columnNames := make([]string, 0)
+	columnTypes := make([]string, 0)
+	if len(columns) == 0 {
+		for _, col := range columnDesc {
+			columnNames = append(columnNames, col.Name())
+			columnTypes = append(columnTypes, col.DatabaseTypeName())
+		}
+	} else {
+		for _, c := range columns {
+			if generated[c] {
+				wr.WriteHeader(400)
+				_, _ = fmt.Fprintf(wr, "Cannot insert into generated column %s", c)
+				return
+			}
+			found := false
+			for _, col := range columnDesc {
+				if col.Name() == c {
+					columnNames = append(columnNames, c)
+					columnTypes = append(columnTypes, col.DatabaseTypeName())
+					found = true
+					break
+				}
+			}
+			if !found {
+				wr.WriteHeader(400)
+				_, _ = fmt.Fprintf(wr, "Column %s not found in table", c)
+				return
+			}
+		}
+	}
+	var dedupKey []string
+	if settings.Get("insert_deduplicate") != "0" {
+		if dedupKey, err = c.lookupDedupKey(ctx, schema, table); err != nil {
+			wr.WriteHeader(500)
+			_, _ = fmt.Fprintf(wr, "Error looking up dedup key: %s", err)
+			return
+		}
+	}
+	partitioned := c.pgServer.partitions.Get(schema, table)
+	if partitioned != nil && len(dedupKey) > 0 {
+		wr.WriteHeader(400)
+		_, _ = fmt.Fprintf(wr, "Dedup keys are not supported on partitioned table %s", table)
+		return
+	}
+	// the connection is pooled with the appender of the table when the insert commits
+	pooled, err := c.pgServer.appenders.Get(schema, table)
+	if err != nil {
+		wr.WriteHeader(500)
+		_, _ = fmt.Fprintf(wr, "Error connecting: %s", err)
+		return
+	}
+	committed := false
+	defer func() {
+		c.pgServer.appenders.Put(pooled, committed)
+	}()
+	conn := pooled.conn
+	validator, err := newRowValidator(ctx, conn, schema, table, columnNames)
+	if err != nil {
+		wr.WriteHeader(500)
+		_, _ = fmt.Fprintf(wr, "Error looking up constraints: %s", err)
+		return
+	}
+	allowErrors, err := parseAllowErrors(settings)
+	if err != nil {
+		wr.WriteHeader(400)
+		_, _ = fmt.Fprintf(wr, "%s", err)
+		return
+	}
+	validator.AllowErrors(allowErrors)
+	// the appender writes whole rows in the order of the table, the rows of a column list are staged, and so are the
+	// rows of tables with generated columns which the appender can't leave out
+	reordered := len(columnNames) != len(columnDesc) || len(generated) > 0
+	for i := 0; !reordered && i < len(columnNames); i++ {
+		reordered = columnNames[i] != columnDesc[i].Name()
+	}
+	// the buffered rows are appended as they are, so the inserts of a column list in another order are never buffered
+	if settings.Get("async_insert") == "1" && transfer == nil && len(dedupKey) == 0 && partitioned == nil && !reordered {
+		// nothing is written on the connection, the async inserter appends the rows
+		committed = true
+		if c.spool != nil && settings.Get("wait_for_async_insert") == "0" {
+			c.spoolInsert(ctx, schema, table, format, columnNames, columnTypes, formater, validator, settings, rd, wr, progress)
+			return
+		}
+		c.asyncInsert(ctx, schema, table, columnNames, columnTypes, formater, validator, settings, rd, wr, progress)
+		return
+	}
+	execer := conn.(driver.ExecerContext)
+	triggers, err := queryInsertTriggers(ctx, conn, schema, table)
+	if err != nil {
+		wr.WriteHeader(500)
+		_, _ = fmt.Fprintf(wr, "Error looking up triggers: %s", err)
+		return
+	}
+	// the rows are appended to a staging table when they are merged, routed, read by triggers or reordered
+	staged := len(dedupKey) > 0 || partitioned != nil || len(triggers) > 0 || reordered
+	beginTx := func() bool {
+		// a failed insert leaves no rows, and the rows, the dedup merge and the transfer record are committed
+		// together so a retried part is never applied twice
+		if _, err = execer.ExecContext(ctx, "BEGIN TRANSACTION", nil); err != nil {
+			wr.WriteHeader(500)
+			_, _ = fmt.Fprintf(wr, "Error starting transaction: %s", err)
+			return false
+		}
+		return true
+	}
+	var partitionStaging string
+	defer func() {
+		if !committed {
+			_, _ = execer.ExecContext(context.Background(), "ROLLBACK", nil)
+		}
+		if partitionStaging != "" && !committed {
+			_, _ = execer.ExecContext(context.Background(), "DROP TABLE IF EXISTS duckserver."+quoteIdent(partitionStaging), nil)
+		}
+	}()
+	// the rows of a partitioned table are staged before the transaction, which has to begin after the missing
+	// partitions are created to see them
+	if partitioned == nil && !beginTx() {
+		return
+	}
+	appendSchema, appendTable := schema, table
+	if partitioned != nil {
+		appendSchema = "duckserver"
+		if appendTable, err = createPartitionStaging(ctx, conn, partitioned, columnNames); err != nil {
+			wr.WriteHeader(400)
+			_, _ = fmt.Fprintf(wr, "Error creating partition staging table: %s", err)
+			return
+		}
+		partitionStaging = appendTable
+	}
+	if partitioned == nil && (len(dedupKey) > 0 || len(triggers) > 0 || reordered) {
+		appendSchema = "duckserver"
+		if appendTable, err = createStagingTable(ctx, execer, "insert_staging_", schema, table, columnNames); err != nil {
+			wr.WriteHeader(500)
+			_, _ = fmt.Fprintf(wr, "Error creating staging table: %s", err)
+			return
+		}
+	}
+	appender, err := pooled.Appender(ctx, appendSchema, appendTable)
+	if err != nil {
+		wr.WriteHeader(500)
+		_, _ = fmt.Fprintf(wr, "Error creating appender: %s", err)
+		return
+	}
+	defer appender.Close()
+	formatWriter, err := formater(columnNames, columnTypes, rd)
+	if err != nil {
+		wr.WriteHeader(formatReaderStatus(err))
+		_, _ = fmt.Fprintf(wr, "Error creating formater: %s", err)
+		return
+	}
+	defaults, err := c.setColumnDefaults(ctx, formatWriter, schema, table, columnNames, columnTypes, settings)
+	if err != nil {
+		wr.WriteHeader(500)
+		_, _ = fmt.Fprintf(wr, "Error looking up column defaults: %s", err)
+		return
+	}
+	stopReporter := func() {}
+	if interval := progressInterval(settings); interval > 0 {
+		stopReporter = progress.StartReporter(wr, interval)
+	}
+	defer stopReporter()
+	values := make([]driver.Value, len(columnNames))
+	var done = false
+	go func() {
+		<-ctx.Done()
+		done = true
+	}()
+	for {
+		if done {
+			stopReporter()
+			wr.WriteHeader(500)
+			_, _ = fmt.Fprintf(wr, "Request cancelled")
+			return
+		}
+		validator.Next()
+		err = formatWriter.Read(values)
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			err = defaults.Fill(ctx, values)
+		}
+		if err == nil {
+			err = validator.Check(values)
+		}
+		if err != nil && validator.Skip(err) {
+			continue
+		}
+		if err != nil {
+			stopReporter()
+			wr.WriteHeader(400)
+			_, _ = fmt.Fprintf(wr, "Error reading values: %s", validator.RowError(err))
+			return
+		}
+		if err = appender.AppendRow(values...); err != nil {
+			stopReporter()
+			wr.WriteHeader(500)
+			_, _ = fmt.Fprintf(wr, "Error appending row: %s", err)
+			return
+		}
+		progress.readRows.Add(1)
+		progress.writtenRows.Add(1)
+	}
+	err = appender.Flush()
+	stopReporter()
+	if err != nil {
+		wr.WriteHeader(500)
+		_, _ = fmt.Fprintf(wr, "Error flushing appender: %s", err)
+		return
+	}
+	if partitioned != nil {
+		starts, err := c.pgServer.preparePartitions(ctx, conn, false, partitioned, appendTable)
+		if err != nil {
+			wr.WriteHeader(500)
+			_, _ = fmt.Fprintf(wr, "Error creating partitions: %s", err)
+			return
+		}
+		if !beginTx() {
+			return
+		}
+		if err = routePartitions(ctx, conn, partitioned, appendTable, columnNames, starts); err != nil {
+			wr.WriteHeader(500)
+			_, _ = fmt.Fprintf(wr, "Error routing rows to partitions: %s", err)
+			return
+		}
+	}
+	if len(dedupKey) > 0 {
+		err = mergeDedupStaging(ctx, execer, schema, table, appendTable, columnNames, dedupKey)
+		if err != nil {
+			wr.WriteHeader(500)
+			_, _ = fmt.Fprintf(wr, "Error merging deduplicated rows: %s", err)
+			return
+		}
+	} else if partitioned == nil && (len(triggers) > 0 || reordered) {
+		if _, err = execer.ExecContext(ctx, fmt.Sprintf("insert into %s.%s (%s) select %s from duckserver.%s",
+			quoteIdent(schema), quoteIdent(table), quoteIdents(columnNames), quoteIdents(columnNames), quoteIdent(appendTable)), nil); err != nil {
+			wr.WriteHeader(500)
+			_, _ = fmt.Fprintf(wr, "Error inserting staged rows: %s", err)
+			return
+		}
+	}
+	if err = runInsertTriggers(ctx, execer, triggers, appendTable); err != nil {
+		wr.WriteHeader(500)
+		_, _ = fmt.Fprintf(wr, "Error running triggers: %s", err)
+		return
+	}
+	if staged {
+		if _, err = execer.ExecContext(ctx, "drop table duckserver."+quoteIdent(appendTable), nil); err != nil {
+			wr.WriteHeader(500)
+			_, _ = fmt.Fprintf(wr, "Error dropping staging table: %s", err)
+			return
+		}
+	}
+	if transfer != nil {
+		err = c.recordInsertTransfer(ctx, execer, transfer, schema+"."+table, progress.writtenRows.Load())
+		if err != nil {
+			wr.WriteHeader(500)
+			_, _ = fmt.Fprintf(wr, "Error recording transfer: %s", err)
+			return
+		}
+	}
+	if _, err = execer.ExecContext(ctx, "COMMIT", nil); err != nil {
+		wr.WriteHeader(500)
+		_, _ = fmt.Fprintf(wr, "Error committing: %s", err)
+		return
+	}
+	committed = true
+	progress.SetSummary(wr)
+	validator.WriteReport(wr)
+}
+
+type insertTransfer struct {
+	id   string
+	part int64
+}
+
+// parseInsertTransfer reads the transfer_id and transfer_part settings which let a client split a large insert
+// into parts, and safely retry parts after a network failure
+func parseInsertTransfer(settings url.Values) (*insertTransfer, error) {
+	id := settings.Get("transfer_id")
+	if id == "" {
+		return nil, nil
+	}
+	part := int64(0)
+	if s := settings.Get("transfer_part"); s != "" {
+		var err error
+		if part, err = strconv.ParseInt(s, 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid transfer_part %s", s)
+		}
+	}
+	return &insertTransfer{id: id, part: part}, nil
+}
+
+func (c *ChServer) lookupInsertTransfer(ctx context.Context, t *insertTransfer) (int64, bool, error) {
+	var rows int64
+	err := c.conn.QueryRowContext(ctx, "select rows from duckserver.insert_transfers where transfer_id = $1 and part = $2", t.id, t.part).Scan(&rows)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return rows, true, nil
+}
+
+func (c *ChServer) recordInsertTransfer(ctx context.Context, execer driver.ExecerContext, t *insertTransfer, table string, rows int64) error {
+	_, err := execer.ExecContext(ctx, "insert into duckserver.insert_transfers (transfer_id, part, table_name, rows, finished_at) values ($1, $2, $3, $4, now())", []driver.NamedValue{
+		{Ordinal: 1, Value: t.id},
+		{Ordinal: 2, Value: t.part},
+		{Ordinal: 3, Value: table},
+		{Ordinal: 4, Value: rows},
+	})
+	return err
+}
+
+func parseTablesAndColumns(t string) (string, string, []string, error) {
+	t = regexp.MustCompile(`\s+`).ReplaceAllString(t, "")
+	groups := regexp.MustCompile(`^(\w+\.|)(\w+)(\([\w,]+\)|)$`).FindStringSubmatch(t)
+	if len(groups) != 4 {
+		return "", "", nil, fmt.Errorf("invalid table name %s", t)
+	}
+	schema := strings.TrimSuffix(groups[1], ".")
+	if schema == "" {
+		schema = "main"
+	}
+	table := groups[2]
+	columns := groups[3]
+	if columns == "" {
+		return schema, table, nil, nil
+	}
+	columns = columns[1 : len(columns)-1]
+	return schema, table, strings.Split(columns, ","), nil
+}
@@ -0,0 +1,238 @@
+package duckserver
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+const chFormatPattern = `(?:\s+FORMAT\s+(\S+?))?[\s;]*$`
+const chLikePattern = `(?:\s+((?:NOT\s+)?I?LIKE)\s+('(?:[^']|'')*'))?`
+
+var showCreateTableRegexp = regexp.MustCompile(`(?is)^\s*SHOW\s+CREATE\s+(?:TABLE\s+)?(?:(` + chIdentPattern + `)\.)?(` + chIdentPattern + `)` + chFormatPattern)
+var describeTableRegexp = regexp.MustCompile(`(?is)^\s*(?:DESCRIBE|DESC)\s+(?:TABLE\s+)?(?:(` + chIdentPattern + `)\.)?(` + chIdentPattern + `)` + chFormatPattern)
+var showTablesRegexp = regexp.MustCompile(`(?is)^\s*SHOW\s+(?:FULL\s+)?TABLES(?:\s+(?:FROM|IN)\s+(` + chIdentPattern + `))?` + chLikePattern + chFormatPattern)
+var showDatabasesRegexp = regexp.MustCompile(`(?is)^\s*SHOW\s+DATABASES` + chLikePattern + chFormatPattern)
+
+// chColumn is a column described with its clickhouse type
+type chColumn struct {
+	name              string
+	typ               string
+	defaultExpression string
+	comment           string
+}
+
+// showStatement answers SHOW CREATE TABLE, DESCRIBE TABLE, SHOW TABLES and SHOW DATABASES with results shaped like
+// clickhouse for the introspection of clickhouse clients, it reports false for other queries
+func (c *ChServer) showStatement(ctx context.Context, query string, wr http.ResponseWriter) bool {
+	if m := showCreateTableRegexp.FindStringSubmatch(query); m != nil {
+		c.showCreateTable(ctx, m, wr)
+	} else if m = describeTableRegexp.FindStringSubmatch(query); m != nil {
+		c.describeTable(ctx, m, wr)
+	} else if m = showTablesRegexp.FindStringSubmatch(query); m != nil {
+		c.showTables(ctx, m, wr)
+	} else if m = showDatabasesRegexp.FindStringSubmatch(query); m != nil {
+		c.showDatabases(ctx, m, wr)
+	} else {
+		return false
+	}
+	return true
+}
+
+// chQuoteIdent quotes an identifier with backquotes like clickhouse
+func chQuoteIdent(s string) string {
+	return "`" + strings.ReplaceAll(s, "`", "\\`") + "`"
+}
+
+// chDatabase returns the clickhouse database of a DuckDB schema, main is the default database
+func chDatabase(schema string) string {
+	if schema == "main" {
+		return "default"
+	}
+	return schema
+}
+
+// chColumns returns the columns of a table with their clickhouse types, the types of a table created on the
+// clickhouse endpoint are the ones it was created with
+func (c *ChServer) chColumns(ctx context.Context, schema, table string) ([]chColumn, error) {
+	var createQuery string
+	err := c.conn.QueryRowContext(ctx, "select create_table_query from duckserver.ch_tables where schema_name = $1 and table_name = $2", schema, table).Scan(&createQuery)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	var chTypes map[string]string
+	if ddl, ok := translateChCreateTable(createQuery); ok {
+		chTypes = ddl.columnTypes
+	}
+	rows, err := c.conn.QueryContext(ctx, "select column_name, data_type, is_nullable, coalesce(column_default, ''), coalesce(comment, '') from duckdb_columns() where database_name = current_database() and schema_name = $1 and table_name = $2 order by column_index",
+		schema, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var columns []chColumn
+	for rows.Next() {
+		var col chColumn
+		var dataType string
+		var nullable bool
+		if err = rows.Scan(&col.name, &dataType, &nullable, &col.defaultExpression, &col.comment); err != nil {
+			return nil, err
+		}
+		col.typ = chTypes[col.name]
+		if col.typ == "" {
+			col.typ = clickhouseType(dataType)
+			// clickhouse can't make arrays, maps and tuples Nullable
+			composite := strings.HasPrefix(col.typ, "Array(") || strings.HasPrefix(col.typ, "Map(") || strings.HasPrefix(col.typ, "Tuple(")
+			if nullable && !composite {
+				col.typ = "Nullable(" + col.typ + ")"
+			}
+		}
+		columns = append(columns, col)
+	}
+	return columns, rows.Err()
+}
+
+// showCreateTable answers SHOW CREATE TABLE with the statement the table was created with on the clickhouse
+// endpoint, or a clickhouse statement built from the DuckDB columns
+func (c *ChServer) showCreateTable(ctx context.Context, m []string, wr http.ResponseWriter) {
+	schema, table := chSchema(ctx, chUnquote(m[1])), chUnquote(m[2])
+	var createQuery sql.NullString
+	err := c.conn.QueryRowContext(ctx, "select m.create_table_query from (select database_name, schema_name, table_name from duckdb_tables() union all select current_database(), schema_name, table_name from duckserver.partitioned_tables) t left join duckserver.ch_tables m on m.schema_name = t.schema_name and m.table_name = t.table_name where t.database_name = current_database() and t.schema_name = $1 and t.table_name = $2",
+		schema, table).Scan(&createQuery)
+	if err == sql.ErrNoRows {
+		wr.WriteHeader(404)
+		_, _ = fmt.Fprintf(wr, "Table %s.%s does not exist", chDatabase(schema), table)
+		return
+	}
+	if err != nil {
+		wr.WriteHeader(500)
+		_, _ = fmt.Fprintf(wr, "Error executing query: %s", err)
+		return
+	}
+	statement := createQuery.String
+	if !createQuery.Valid {
+		columns, err := c.chColumns(ctx, schema, table)
+		if err != nil {
+			wr.WriteHeader(500)
+			_, _ = fmt.Fprintf(wr, "Error executing query: %s", err)
+			return
+		}
+		defs := make([]string, len(columns))
+		for i, col := range columns {
+			defs[i] = chQuoteIdent(col.name) + " " + col.typ
+			if col.defaultExpression != "" {
+				defs[i] += " DEFAULT " + col.defaultExpression
+			}
+			if col.comment != "" {
+				defs[i] += " COMMENT " + quoteLiteral(col.comment)
+			}
+		}
+		statement = fmt.Sprintf("CREATE TABLE %s.%s (%s) ENGINE = MergeTree ORDER BY tuple()",
+			chQuoteIdent(chDatabase(schema)), chQuoteIdent(table), strings.Join(defs, ", "))
+	}
+	writeChResult(wr, m[3], []string{"statement"}, [][]any{{statement}})
+}
+
+// describeTable answers DESCRIBE TABLE with the columns of clickhouse
+func (c *ChServer) describeTable(ctx context.Context, m []string, wr http.ResponseWriter) {
+	schema, table := chSchema(ctx, chUnquote(m[1])), chUnquote(m[2])
+	columns, err := c.chColumns(ctx, schema, table)
+	if err != nil {
+		wr.WriteHeader(500)
+		_, _ = fmt.Fprintf(wr, "Error executing query: %s", err)
+		return
+	}
+	if len(columns) == 0 {
+		wr.WriteHeader(404)
+		_, _ = fmt.Fprintf(wr, "Table %s.%s does not exist", chDatabase(schema), table)
+		return
+	}
+	rows := make([][]any, len(columns))
+	for i, col := range columns {
+		defaultType := ""
+		if col.defaultExpression != "" {
+			defaultType = "DEFAULT"
+		}
+		rows[i] = []any{col.name, col.typ, defaultType, col.defaultExpression, col.comment, "", ""}
+	}
+	writeChResult(wr, m[3], []string{"name", "type", "default_type", "default_expression", "comment", "codec_expression", "ttl_expression"}, rows)
+}
+
+// showTables answers SHOW TABLES with the tables and views of the database, without the postgresql catalog views
+// created by duckdbInit
+func (c *ChServer) showTables(ctx context.Context, m []string, wr http.ResponseWriter) {
+	query := "select name from (select table_name as name from duckdb_tables() where database_name = current_database() and schema_name = $1 union all select view_name from duckdb_views() where database_name = current_database() and schema_name = $1 and not internal and view_name not in ('pg_type', 'pg_matviews'))"
+	if m[2] != "" {
+		query += " where name " + m[2] + " " + m[3]
+	}
+	c.writeChNames(ctx, query+" order by name", m[4], wr, chSchema(ctx, chUnquote(m[1])))
+}
+
+// showDatabases answers SHOW DATABASES with the schemas of the database, main is the default database
+func (c *ChServer) showDatabases(ctx context.Context, m []string, wr http.ResponseWriter) {
+	query := "select name from (select case when schema_name = 'main' then 'default' else schema_name end as name from duckdb_schemas() where database_name = current_database() and schema_name not in ('information_schema', 'pg_catalog'))"
+	if m[1] != "" {
+		query += " where name " + m[1] + " " + m[2]
+	}
+	c.writeChNames(ctx, query+" order by name", m[3], wr)
+}
+
+// writeChNames writes the name column of an introspection query
+func (c *ChServer) writeChNames(ctx context.Context, query, format string, wr http.ResponseWriter, args ...any) {
+	rows, err := c.conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		wr.WriteHeader(500)
+		_, _ = fmt.Fprintf(wr, "Error executing query: %s", err)
+		return
+	}
+	defer rows.Close()
+	var names [][]any
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			wr.WriteHeader(500)
+			_, _ = fmt.Fprintf(wr, "Error scanning row: %s", err)
+			return
+		}
+		names = append(names, []any{name})
+	}
+	writeChResult(wr, format, []string{"name"}, names)
+}
+
+// writeChResult writes the rows of String columns in a clickhouse output format, TabSeparated by default
+func writeChResult(wr http.ResponseWriter, format string, columnNames []string, rows [][]any) {
+	if format == "" {
+		format = "TabSeparated"
+	}
+	formater := GetClickhouseOutputFormat(format)
+	if formater == nil {
+		wr.WriteHeader(400)
+		_, _ = fmt.Fprintf(wr, "Unknown format %s", format)
+		return
+	}
+	columnTypes := make([]string, len(columnNames))
+	for i := range columnTypes {
+		columnTypes[i] = "VARCHAR"
+	}
+	fmter, err := formater(columnNames, columnTypes, wr)
+	if err != nil {
+		wr.WriteHeader(500)
+		_, _ = fmt.Fprintf(wr, "Error creating format: %s", err)
+		return
+	}
+	wr.Header().Set("x-clickhouse-format", format)
+	wr.Header().Set("Content-Type", GetClickhouseFormatContentType(format))
+	wr.WriteHeader(200)
+	for _, row := range rows {
+		if err = fmter.Write(row); err != nil {
+			writeChStreamError(wr, fmter, chErrorCannotConvertType, "Error writing row: %s", err)
+			return
+		}
+	}
+	if err = fmter.Close(); err != nil {
+		writeChStreamError(wr, nil, chErrorCannotConvertType, "Error writing result: %s", err)
+	}
+}
@@ -0,0 +1,642 @@
+package duckserver
+
+import (
+	"bufio"
+	"database/sql/driver"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/goccy/go-json"
+	"github.com/marcboeker/go-duckdb"
+	"io"
+	"math"
+	"math/big"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// the settings of the Template format, the row and resultset formats are files of the format schema directory or
+// given inline with the _format settings
+const (
+	templateRowSetting             = "format_template_row"
+	templateRowFormatSetting       = "format_template_row_format"
+	templateResultsetSetting       = "format_template_resultset"
+	templateResultsetFormatSetting = "format_template_resultset_format"
+	templateRowsBetweenSetting     = "format_template_rows_between_delimiter"
+)
+
+// customSeparatedDefaults are the settings of the CustomSeparated formats with their clickhouse defaults
+var customSeparatedDefaults = map[string]string{
+	"format_custom_escaping_rule":           "Escaped",
+	"format_custom_field_delimiter":         "\t",
+	"format_custom_row_before_delimiter":    "",
+	"format_custom_row_after_delimiter":     "\n",
+	"format_custom_row_between_delimiter":   "",
+	"format_custom_result_before_delimiter": "",
+	"format_custom_result_after_delimiter":  "",
+}
+
+func customSeparatedSetting(settings url.Values, name string) string {
+	if settings.Has(name) {
+		return settings.Get(name)
+	}
+	return customSeparatedDefaults[name]
+}
+
+// the escaping rules of the fields of the Template and CustomSeparated formats
+const (
+	escapingEscaped = "Escaped"
+	escapingQuoted  = "Quoted"
+	escapingCSV     = "CSV"
+	escapingJSON    = "JSON"
+	escapingXML     = "XML"
+	escapingRaw     = "Raw"
+)
+
+// parseEscapingRule returns the escaping rule of name, Escaped when empty
+func parseEscapingRule(name string) (string, error) {
+	if name == "" {
+		return escapingEscaped, nil
+	}
+	for _, rule := range []string{escapingEscaped, escapingQuoted, escapingCSV, escapingJSON, escapingXML, escapingRaw} {
+		if strings.EqualFold(rule, name) {
+			return rule, nil
+		}
+	}
+	return "", fmt.Errorf("unknown escaping rule %s", name)
+}
+
+var chEscaper = strings.NewReplacer(`\`, `\\`, "\t", `\t`, "\n", `\n`, "\r", `\r`, "\b", `\b`, "\f", `\f`,
+	"\x00", `\0`, "'", `\'`)
+
+var chUnescapes = map[byte]byte{'t': '\t', 'n': '\n', 'r': '\r', 'b': '\b', 'f': '\f', '0': 0}
+
+// chUnescape reverts chEscaper, other escaped characters stand for themselves
+func chUnescape(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			sb.WriteByte(s[i])
+			continue
+		}
+		i++
+		if c, ok := chUnescapes[s[i]]; ok {
+			sb.WriteByte(c)
+		} else {
+			sb.WriteByte(s[i])
+		}
+	}
+	return sb.String()
+}
+
+// escapeChValue formats a value for a field of rule, numbers are never quoted
+func escapeChValue(rule string, value any) string {
+	switch v := value.(type) {
+	case nil:
+		switch rule {
+		case escapingQuoted:
+			return "NULL"
+		case escapingJSON:
+			return "null"
+		}
+		return `\N`
+	case float64:
+		if rule == escapingJSON && (math.IsNaN(v) || math.IsInf(v, 0)) {
+			return "null"
+		}
+		return duckValueToString(v)
+	case float32:
+		return escapeChValue(rule, float64(v))
+	case int, int8, int16, int32, int64, uint8, uint16, uint32, uint64, bool, *big.Int, duckdb.Decimal:
+		return duckValueToString(v)
+	}
+	text := duckValueToString(value)
+	switch rule {
+	case escapingEscaped:
+		return chEscaper.Replace(text)
+	case escapingQuoted:
+		return "'" + chEscaper.Replace(text) + "'"
+	case escapingCSV:
+		return `"` + strings.ReplaceAll(text, `"`, `""`) + `"`
+	case escapingJSON:
+		return string(appendJSONString(nil, text))
+	case escapingXML:
+		var sb strings.Builder
+		_ = xml.EscapeText(&sb, []byte(text))
+		return sb.String()
+	}
+	return text
+}
+
+type chTemplateField struct {
+	name string
+	rule string
+}
+
+// chTemplate is a parsed format string, delimiters[i] precedes fields[i] and the last delimiter ends it
+type chTemplate struct {
+	delimiters []string
+	fields     []chTemplateField
+}
+
+// parseChTemplate parses a format string with ${name:EscapingRule} placeholders, $$ is a dollar sign
+func parseChTemplate(format string) (*chTemplate, error) {
+	t := &chTemplate{}
+	var delimiter strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] != '$' {
+			delimiter.WriteByte(format[i])
+			continue
+		}
+		if strings.HasPrefix(format[i:], "$$") {
+			delimiter.WriteByte('$')
+			i++
+			continue
+		}
+		end := strings.IndexByte(format[i:], '}')
+		if !strings.HasPrefix(format[i:], "${") || end < 0 {
+			return nil, fmt.Errorf("invalid format string at %d, expected ${column:EscapingRule} or $$", i)
+		}
+		placeholder := format[i+2 : i+end]
+		name, ruleName := placeholder, ""
+		if j := strings.LastIndexByte(placeholder, ':'); j >= 0 {
+			name, ruleName = placeholder[:j], placeholder[j+1:]
+		}
+		rule, err := parseEscapingRule(strings.TrimSpace(ruleName))
+		if err != nil {
+			return nil, err
+		}
+		t.delimiters = append(t.delimiters, delimiter.String())
+		delimiter.Reset()
+		t.fields = append(t.fields, chTemplateField{name: strings.TrimSpace(name), rule: rule})
+		i += end
+	}
+	t.delimiters = append(t.delimiters, delimiter.String())
+	return t, nil
+}
+
+// write writes the format with the values of its fields, the error of w is sticky
+func (t *chTemplate) write(w *bufio.Writer, value func(field int) any) error {
+	for i, f := range t.fields {
+		_, _ = w.WriteString(t.delimiters[i])
+		_, _ = w.WriteString(escapeChValue(f.rule, value(i)))
+	}
+	_, err := w.WriteString(t.delimiters[len(t.fields)])
+	return err
+}
+
+// templateSetting returns a format string of the Template format, given inline or as a file of the format schema
+// directory without its final newline, def when neither is set
+func templateSetting(settings url.Values, inline, file, dir, def string) (*chTemplate, error) {
+	if settings.Has(inline) {
+		return parseChTemplate(settings.Get(inline))
+	}
+	name := settings.Get(file)
+	if name == "" {
+		if def == "" {
+			return nil, fmt.Errorf("the Template format requires the %s or %s setting", file, inline)
+		}
+		return parseChTemplate(def)
+	}
+	if dir == "" {
+		return nil, fmt.Errorf("the %s setting requires --ch_format_schema_path", file)
+	}
+	text, err := os.ReadFile(filepath.Join(dir, filepath.Clean("/"+name)))
+	if err != nil {
+		return nil, err
+	}
+	return parseChTemplate(strings.TrimSuffix(string(text), "\n"))
+}
+
+// templateSettings returns the row format, the text before ${data} and the format after it of the Template settings
+func templateSettings(settings url.Values, dir string) (*chTemplate, string, *chTemplate, error) {
+	row, err := templateSetting(settings, templateRowFormatSetting, templateRowSetting, dir, "")
+	if err != nil {
+		return nil, "", nil, err
+	}
+	resultset, err := templateSetting(settings, templateResultsetFormatSetting, templateResultsetSetting, dir, "${data}")
+	if err != nil {
+		return nil, "", nil, err
+	}
+	if len(resultset.fields) == 0 || resultset.fields[0].name != "data" {
+		return nil, "", nil, errors.New("the resultset format must contain ${data} before its other placeholders")
+	}
+	suffix := &chTemplate{delimiters: resultset.delimiters[1:], fields: resultset.fields[1:]}
+	for _, f := range suffix.fields {
+		switch f.name {
+		case "rows", "rows_read", "time":
+		default:
+			return nil, "", nil, fmt.Errorf("unsupported resultset placeholder ${%s}, use rows, rows_read or time", f.name)
+		}
+	}
+	return row, resultset.delimiters[0], suffix, nil
+}
+
+// templateColumns returns the column of each field of a row format, -1 for the fields without name
+func templateColumns(row *chTemplate, columnNames []string) ([]int, error) {
+	columns := make([]int, len(row.fields))
+	for i, f := range row.fields {
+		columns[i] = -1
+		if f.name == "" {
+			continue
+		}
+		for j, name := range columnNames {
+			if name == f.name {
+				columns[i] = j
+				break
+			}
+		}
+		if columns[i] < 0 {
+			return nil, fmt.Errorf("column %s of the format string doesn't exist", f.name)
+		}
+	}
+	return columns, nil
+}
+
+// customSeparatedTemplate builds the row format of the CustomSeparated formats from their delimiter settings
+func customSeparatedTemplate(columnNames []string, settings url.Values) (*chTemplate, []int, error) {
+	rule, err := parseEscapingRule(customSeparatedSetting(settings, "format_custom_escaping_rule"))
+	if err != nil {
+		return nil, nil, err
+	}
+	t := &chTemplate{delimiters: []string{customSeparatedSetting(settings, "format_custom_row_before_delimiter")}}
+	columns := make([]int, len(columnNames))
+	for i, name := range columnNames {
+		if i > 0 {
+			t.delimiters = append(t.delimiters, customSeparatedSetting(settings, "format_custom_field_delimiter"))
+		}
+		t.fields = append(t.fields, chTemplateField{name: name, rule: rule})
+		columns[i] = i
+	}
+	t.delimiters = append(t.delimiters, customSeparatedSetting(settings, "format_custom_row_after_delimiter"))
+	return t, columns, nil
+}
+
+// customSeparatedHeaders returns the number of header rows of a CustomSeparated format
+func customSeparatedHeaders(format string) int {
+	switch format {
+	case "CustomSeparatedWithNames":
+		return 1
+	case "CustomSeparatedWithNamesAndTypes":
+		return 2
+	}
+	return 0
+}
+
+// TemplateFormatWriter writes the rows of Template and CustomSeparated, the resultset statistics are written on Close
+type TemplateFormatWriter struct {
+	w       *bufio.Writer
+	row     *chTemplate
+	columns []int
+	between string
+	suffix  *chTemplate
+	started bool
+	rows    int64
+	start   time.Time
+}
+
+func newTemplateWriter(writer io.Writer, row *chTemplate, columns []int, between, prefix string, suffix *chTemplate, headers [][]any) (ClickhouseFormatWriter, error) {
+	t := &TemplateFormatWriter{
+		w:       bufio.NewWriter(writer),
+		row:     row,
+		columns: columns,
+		between: between,
+		suffix:  suffix,
+		start:   time.Now(),
+	}
+	_, _ = t.w.WriteString(prefix)
+	for _, header := range headers {
+		if err := t.writeRow(header); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+func newTemplateFormatWriter(columnNames []string, writer io.Writer, dir string, settings url.Values) (ClickhouseFormatWriter, error) {
+	row, prefix, suffix, err := templateSettings(settings, dir)
+	if err != nil {
+		return nil, err
+	}
+	columns, err := templateColumns(row, columnNames)
+	if err != nil {
+		return nil, err
+	}
+	for i, column := range columns {
+		if column < 0 {
+			return nil, fmt.Errorf("field %d of the format string has no column", i+1)
+		}
+	}
+	between := "\n"
+	if settings.Has(templateRowsBetweenSetting) {
+		between = settings.Get(templateRowsBetweenSetting)
+	}
+	return newTemplateWriter(writer, row, columns, between, prefix, suffix, nil)
+}
+
+func newCustomSeparatedFormatWriter(columnNames, columnTypes []string, writer io.Writer, settings url.Values, headers int) (ClickhouseFormatWriter, error) {
+	row, columns, err := customSeparatedTemplate(columnNames, settings)
+	if err != nil {
+		return nil, err
+	}
+	var headerRows [][]any
+	for _, header := range [][]string{columnNames, typesToClickhouseTypes(columnTypes)}[:headers] {
+		values := make([]any, len(header))
+		for i, v := range header {
+			values[i] = v
+		}
+		headerRows = append(headerRows, values)
+	}
+	suffix := &chTemplate{delimiters: []string{customSeparatedSetting(settings, "format_custom_result_after_delimiter")}}
+	return newTemplateWriter(writer, row, columns, customSeparatedSetting(settings, "format_custom_row_between_delimiter"),
+		customSeparatedSetting(settings, "format_custom_result_before_delimiter"), suffix, headerRows)
+}
+
+func (t *TemplateFormatWriter) writeRow(values []any) error {
+	if t.started {
+		_, _ = t.w.WriteString(t.between)
+	}
+	t.started = true
+	return t.row.write(t.w, func(field int) any {
+		return values[t.columns[field]]
+	})
+}
+
+func (t *TemplateFormatWriter) Write(values []any) error {
+	t.rows++
+	return t.writeRow(values)
+}
+
+func (t *TemplateFormatWriter) Flush() error {
+	return t.w.Flush()
+}
+
+func (t *TemplateFormatWriter) Close() error {
+	elapsed := time.Since(t.start).Seconds()
+	_ = t.suffix.write(t.w, func(field int) any {
+		if t.suffix.fields[field].name == "time" {
+			return elapsed
+		}
+		return t.rows
+	})
+	return t.w.Flush()
+}
+
+// TemplateFormatReader reads the rows of Template and CustomSeparated, the fields without column are skipped
+type TemplateFormatReader struct {
+	rd          *bufio.Reader
+	row         *chTemplate
+	columns     []int
+	columnTypes []string
+	// ends are the delimiters ending each field, a field is read until its end unless quoted
+	ends    []string
+	between string
+	suffix  string
+	started bool
+}
+
+func newTemplateReader(reader io.Reader, row *chTemplate, columns []int, columnTypes []string, between, prefix, suffix string, headers int) (ClickhouseFormatReader, error) {
+	t := &TemplateFormatReader{
+		rd:          bufio.NewReader(reader),
+		row:         row,
+		columns:     columns,
+		columnTypes: columnTypes,
+		ends:        make([]string, len(row.fields)),
+		between:     between,
+		suffix:      suffix,
+	}
+	for i, f := range row.fields {
+		if f.rule == escapingXML {
+			return nil, errors.New("the XML escaping rule can only be used in selects")
+		}
+		t.ends[i] = row.delimiters[i+1]
+		if t.ends[i] == "" && i+1 < len(row.fields) {
+			return nil, fmt.Errorf("field %d of the format string is not followed by a delimiter", i+1)
+		}
+	}
+	if n := len(t.ends); n > 0 && t.ends[n-1] == "" {
+		t.ends[n-1] = between
+		if t.ends[n-1] == "" {
+			t.ends[n-1] = suffix
+		}
+	}
+	if err := t.expect(prefix); err != nil {
+		return nil, err
+	}
+	for i := 0; i < headers; i++ {
+		if err := t.next(nil); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+func newTemplateFormatReader(columnNames, columnTypes []string, reader io.Reader, dir string, settings url.Values) (ClickhouseFormatReader, error) {
+	row, prefix, suffix, err := templateSettings(settings, dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(suffix.fields) > 0 {
+		return nil, errors.New("the resultset format of an insert can only contain ${data}")
+	}
+	columns, err := templateColumns(row, columnNames)
+	if err != nil {
+		return nil, err
+	}
+	between := "\n"
+	if settings.Has(templateRowsBetweenSetting) {
+		between = settings.Get(templateRowsBetweenSetting)
+	}
+	return newTemplateReader(reader, row, columns, columnTypes, between, prefix, suffix.delimiters[0], 0)
+}
+
+func newCustomSeparatedFormatReader(columnNames, columnTypes []string, reader io.Reader, settings url.Values, headers int) (ClickhouseFormatReader, error) {
+	row, columns, err := customSeparatedTemplate(columnNames, settings)
+	if err != nil {
+		return nil, err
+	}
+	return newTemplateReader(reader, row, columns, columnTypes,
+		customSeparatedSetting(settings, "format_custom_row_between_delimiter"),
+		customSeparatedSetting(settings, "format_custom_result_before_delimiter"),
+		customSeparatedSetting(settings, "format_custom_result_after_delimiter"), headers)
+}
+
+func (t *TemplateFormatReader) Read(values []driver.Value) error {
+	if len(t.columnTypes) != len(values) {
+		return errors.New("column length mismatch")
+	}
+	for i := range values {
+		values[i] = nil
+	}
+	return t.next(values)
+}
+
+// next reads a row into values, a row is skipped with nil values
+func (t *TemplateFormatReader) next(values []driver.Value) error {
+	if t.atEnd() {
+		return io.EOF
+	}
+	if t.started {
+		if err := t.expect(t.between); err != nil {
+			return err
+		}
+		if t.atEnd() {
+			return io.EOF
+		}
+	}
+	t.started = true
+	for i, f := range t.row.fields {
+		if err := t.expect(t.row.delimiters[i]); err != nil {
+			return err
+		}
+		text, null, err := t.readField(f.rule, t.ends[i])
+		if err != nil {
+			return err
+		}
+		if values == nil || t.columns[i] < 0 || null {
+			continue
+		}
+		if values[t.columns[i]], err = convertInputText(text, t.columnTypes[t.columns[i]]); err != nil {
+			return err
+		}
+	}
+	// the last row may miss its final delimiter
+	if _, err := t.rd.Peek(1); err == io.EOF {
+		return nil
+	}
+	return t.expect(t.row.delimiters[len(t.row.fields)])
+}
+
+// atEnd reports whether the input ends, at its end or at the text after the rows
+func (t *TemplateFormatReader) atEnd() bool {
+	if t.suffix != "" && t.peekIs(t.suffix) {
+		return true
+	}
+	_, err := t.rd.Peek(1)
+	return err != nil
+}
+
+func (t *TemplateFormatReader) peekIs(s string) bool {
+	b, _ := t.rd.Peek(len(s))
+	return string(b) == s
+}
+
+func (t *TemplateFormatReader) expect(delimiter string) error {
+	if delimiter == "" {
+		return nil
+	}
+	if !t.peekIs(delimiter) {
+		b, _ := t.rd.Peek(len(delimiter))
+		return fmt.Errorf("expected %q, got %q", delimiter, b)
+	}
+	_, err := t.rd.Discard(len(delimiter))
+	return err
+}
+
+// readField reads a field of rule ending at end and reports whether it is null
+func (t *TemplateFormatReader) readField(rule, end string) (string, bool, error) {
+	var quote byte
+	if b, err := t.rd.Peek(1); err == nil {
+		switch {
+		case rule == escapingQuoted && b[0] == '\'':
+			quote = '\''
+		case (rule == escapingCSV || rule == escapingJSON) && b[0] == '"':
+			quote = '"'
+		}
+	}
+	if quote != 0 {
+		text, err := t.readQuoted(quote, rule != escapingCSV)
+		if err != nil {
+			return "", false, err
+		}
+		switch rule {
+		case escapingQuoted:
+			return chUnescape(text), false, nil
+		case escapingJSON:
+			var s string
+			err = json.Unmarshal([]byte(`"`+text+`"`), &s)
+			return s, false, err
+		}
+		return text, false, nil
+	}
+	text, err := t.readUntil(end, rule == escapingEscaped)
+	if err != nil {
+		return "", false, err
+	}
+	switch rule {
+	case escapingEscaped:
+		if text == `\N` {
+			return "", true, nil
+		}
+		return chUnescape(text), false, nil
+	case escapingQuoted:
+		return text, strings.EqualFold(text, "NULL"), nil
+	case escapingCSV:
+		return text, text == `\N`, nil
+	case escapingJSON:
+		return text, text == "null", nil
+	}
+	return text, false, nil
+}
+
+// readQuoted reads a quoted field without its quotes, a doubled quote is a quote and backslash escapes are kept
+func (t *TemplateFormatReader) readQuoted(quote byte, backslash bool) (string, error) {
+	_, _ = t.rd.ReadByte()
+	var sb strings.Builder
+	for {
+		c, err := t.rd.ReadByte()
+		if err != nil {
+			return "", errors.New("unterminated quoted field")
+		}
+		switch {
+		case backslash && c == '\\':
+			e, err := t.rd.ReadByte()
+			if err != nil {
+				return "", errors.New("unterminated quoted field")
+			}
+			sb.WriteByte(c)
+			sb.WriteByte(e)
+		case c == quote:
+			if !t.peekIs(string(quote)) {
+				return sb.String(), nil
+			}
+			_, _ = t.rd.ReadByte()
+			sb.WriteByte(quote)
+		default:
+			sb.WriteByte(c)
+		}
+	}
+}
+
+// readUntil reads a field until end or the end of the input, escaped fields keep their backslash escapes
+func (t *TemplateFormatReader) readUntil(end string, escaped bool) (string, error) {
+	var sb strings.Builder
+	for {
+		if end != "" && t.peekIs(end) {
+			return sb.String(), nil
+		}
+		c, err := t.rd.ReadByte()
+		if err == io.EOF {
+			return sb.String(), nil
+		}
+		if err != nil {
+			return "", err
+		}
+		sb.WriteByte(c)
+		if escaped && c == '\\' {
+			if e, err := t.rd.ReadByte(); err == nil {
+				sb.WriteByte(e)
+			}
+		}
+	}
+}
+
+func (t *TemplateFormatReader) Close() error {
+	return nil
+}
@@ -0,0 +1,258 @@
+package duckserver
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"github.com/marcboeker/go-duckdb"
+	"io"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	xlsxContentType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+	xlsxMaxRows     = 1048576
+	xlsxMaxColumns  = 16384
+	xlsxMaxCellLen  = 32767
+	// xlsxMaxInt is the largest integer a spreadsheet shows without losing digits, larger ones are written as text
+	xlsxMaxInt = 999999999999999
+)
+
+// styles of cellXfs in xlsxStyles
+const (
+	xlsxStyleDefault = iota
+	xlsxStyleDate
+	xlsxStyleDateTime
+	xlsxStyleTime
+	xlsxStyleHeader
+)
+
+// xlsxEpoch is day 0 of the 1900 date system for the dates from 1900-03-01, spreadsheets count a 1900-02-29 before
+var xlsxEpoch = time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC)
+
+// xlsxFirstDate is the first date whose serial number is the same in every spreadsheet
+var xlsxFirstDate = time.Date(1900, 3, 1, 0, 0, 0, 0, time.UTC)
+
+const xlsxContentTypes = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types"><Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/><Default Extension="xml" ContentType="application/xml"/><Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/><Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/><Override PartName="/xl/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/></Types>`
+
+const xlsxRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/></Relationships>`
+
+const xlsxWorkbook = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets><sheet name="Result" sheetId="1" r:id="rId1"/></sheets></workbook>`
+
+const xlsxWorkbookRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/><Relationship Id="rId2" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/></Relationships>`
+
+const xlsxStyles = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><numFmts count="2"><numFmt numFmtId="164" formatCode="yyyy-mm-dd hh:mm:ss"/><numFmt numFmtId="165" formatCode="yyyy-mm-dd"/></numFmts><fonts count="2"><font><sz val="11"/><name val="Calibri"/></font><font><b/><sz val="11"/><name val="Calibri"/></font></fonts><fills count="2"><fill><patternFill patternType="none"/></fill><fill><patternFill patternType="gray125"/></fill></fills><borders count="1"><border><left/><right/><top/><bottom/><diagonal/></border></borders><cellStyleXfs count="1"><xf numFmtId="0" fontId="0" fillId="0" borderId="0"/></cellStyleXfs><cellXfs count="5"><xf numFmtId="0" fontId="0" fillId="0" borderId="0" xfId="0"/><xf numFmtId="165" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/><xf numFmtId="164" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/><xf numFmtId="21" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/><xf numFmtId="0" fontId="1" fillId="0" borderId="0" xfId="0" applyFont="1"/></cellXfs></styleSheet>`
+
+const xlsxSheetStart = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetViews><sheetView workbookViewId="0"><pane ySplit="1" topLeftCell="A2" activePane="bottomLeft" state="frozen"/></sheetView></sheetViews><sheetData>`
+
+const xlsxSheetEnd = `</sheetData></worksheet>`
+
+// XLSXFormatWriter streams a result as a workbook of one sheet, the sheet is the last part of the zip so rows are
+// written as they are read. Strings are inline, there is no shared string table to hold in memory.
+type XLSXFormatWriter struct {
+	columns []string
+	types   []string
+	refs    []string
+	zip     *zip.Writer
+	sheet   *bufio.Writer
+	row     int
+}
+
+func newXLSXFormatWriter(columnNames, columnTypes []string, writer io.Writer) (ClickhouseFormatWriter, error) {
+	if len(columnNames) > xlsxMaxColumns {
+		return nil, fmt.Errorf("xlsx sheets have at most %d columns, the result has %d", xlsxMaxColumns, len(columnNames))
+	}
+	refs := make([]string, len(columnNames))
+	for i := range refs {
+		refs[i] = xlsxColumnName(i)
+	}
+	return &XLSXFormatWriter{
+		columns: columnNames,
+		types:   columnTypes,
+		refs:    refs,
+		zip:     zip.NewWriter(writer),
+	}, nil
+}
+
+// xlsxColumnName returns the letters of the column at index i, A to XFD
+func xlsxColumnName(i int) string {
+	name := ""
+	for i++; i > 0; i = (i - 1) / 26 {
+		name = string(rune('A'+(i-1)%26)) + name
+	}
+	return name
+}
+
+// start writes the parts before the sheet and the header row, it runs on the first row so nothing is sent before
+// the response headers are set
+func (x *XLSXFormatWriter) start() error {
+	for _, part := range []struct{ name, content string }{
+		{"[Content_Types].xml", xlsxContentTypes},
+		{"_rels/.rels", xlsxRels},
+		{"xl/workbook.xml", xlsxWorkbook},
+		{"xl/_rels/workbook.xml.rels", xlsxWorkbookRels},
+		{"xl/styles.xml", xlsxStyles},
+	} {
+		w, err := x.zip.Create(part.name)
+		if err != nil {
+			return err
+		}
+		if _, err = io.WriteString(w, part.content); err != nil {
+			return err
+		}
+	}
+	w, err := x.zip.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return err
+	}
+	x.sheet = bufio.NewWriter(w)
+	_, _ = x.sheet.WriteString(xlsxSheetStart)
+	header := make([]any, len(x.columns))
+	for i, name := range x.columns {
+		header[i] = name
+	}
+	return x.writeRow(header, true)
+}
+
+func (x *XLSXFormatWriter) Write(values []any) error {
+	if x.sheet == nil {
+		if err := x.start(); err != nil {
+			return err
+		}
+	}
+	if x.row >= xlsxMaxRows {
+		return fmt.Errorf("xlsx sheets have at most %d rows", xlsxMaxRows)
+	}
+	return x.writeRow(values, false)
+}
+
+func (x *XLSXFormatWriter) writeRow(values []any, header bool) error {
+	x.row++
+	row := strconv.Itoa(x.row)
+	_, _ = x.sheet.WriteString(`<row r="` + row + `">`)
+	for i, value := range values {
+		if value == nil {
+			continue
+		}
+		ref := x.refs[i] + row
+		if header {
+			x.writeString(ref, xlsxStyleHeader, value.(string))
+			continue
+		}
+		x.writeCell(ref, x.types[i], value)
+	}
+	_, err := x.sheet.WriteString(`</row>`)
+	return err
+}
+
+func (x *XLSXFormatWriter) writeCell(ref, typ string, value any) {
+	switch v := value.(type) {
+	case int64:
+		if v > xlsxMaxInt || v < -xlsxMaxInt {
+			x.writeString(ref, xlsxStyleDefault, strconv.FormatInt(v, 10))
+			return
+		}
+		x.writeNumber(ref, xlsxStyleDefault, strconv.FormatInt(v, 10))
+	case uint64:
+		if v > xlsxMaxInt {
+			x.writeString(ref, xlsxStyleDefault, strconv.FormatUint(v, 10))
+			return
+		}
+		x.writeNumber(ref, xlsxStyleDefault, strconv.FormatUint(v, 10))
+	case int, int32, int16, int8, uint32, uint16, uint8:
+		x.writeNumber(ref, xlsxStyleDefault, duckValueToString(v))
+	case float64:
+		x.writeFloat(ref, v)
+	case float32:
+		x.writeFloat(ref, float64(v))
+	case *big.Int:
+		x.writeString(ref, xlsxStyleDefault, v.String())
+	case duckdb.Decimal:
+		if math.Abs(v.Float64()) > xlsxMaxInt {
+			x.writeString(ref, xlsxStyleDefault, duckDecimalToString(v))
+			return
+		}
+		x.writeNumber(ref, xlsxStyleDefault, duckDecimalToString(v))
+	case bool:
+		_, _ = fmt.Fprintf(x.sheet, `<c r="%s" t="b"><v>%s</v></c>`, ref, duckValueToString(v))
+	case time.Time:
+		x.writeTime(ref, typ, v)
+	case string:
+		x.writeString(ref, xlsxStyleDefault, v)
+	default:
+		x.writeString(ref, xlsxStyleDefault, duckValueToString(v))
+	}
+}
+
+func (x *XLSXFormatWriter) writeNumber(ref string, style int, number string) {
+	_, _ = fmt.Fprintf(x.sheet, `<c r="%s" s="%d"><v>%s</v></c>`, ref, style, number)
+}
+
+func (x *XLSXFormatWriter) writeFloat(ref string, v float64) {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		x.writeString(ref, xlsxStyleDefault, strconv.FormatFloat(v, 'f', -1, 64))
+		return
+	}
+	x.writeNumber(ref, xlsxStyleDefault, strconv.FormatFloat(v, 'g', -1, 64))
+}
+
+// writeTime writes dates and timestamps as serial numbers so they sort and filter as dates, the dates out of the
+// range of serial numbers are written as text
+func (x *XLSXFormatWriter) writeTime(ref, typ string, v time.Time) {
+	typ = strings.ToUpper(typ)
+	if strings.HasPrefix(typ, "TIME") && !strings.HasPrefix(typ, "TIMESTAMP") {
+		seconds := v.Hour()*3600 + v.Minute()*60 + v.Second()
+		x.writeNumber(ref, xlsxStyleTime, strconv.FormatFloat((float64(seconds)+float64(v.Nanosecond())/1e9)/86400, 'g', -1, 64))
+		return
+	}
+	wall := time.Date(v.Year(), v.Month(), v.Day(), v.Hour(), v.Minute(), v.Second(), v.Nanosecond(), time.UTC)
+	if wall.Before(xlsxFirstDate) || wall.Year() > 9999 {
+		if typ == "DATE" {
+			x.writeString(ref, xlsxStyleDefault, v.Format("2006-01-02"))
+			return
+		}
+		x.writeString(ref, xlsxStyleDefault, duckValueToString(v))
+		return
+	}
+	serial := float64(wall.Unix()-xlsxEpoch.Unix())/86400 + float64(wall.Nanosecond())/86400e9
+	if typ == "DATE" {
+		x.writeNumber(ref, xlsxStyleDate, strconv.FormatFloat(math.Floor(serial), 'f', -1, 64))
+		return
+	}
+	x.writeNumber(ref, xlsxStyleDateTime, strconv.FormatFloat(serial, 'f', -1, 64))
+}
+
+// writeString writes an inline string, cells hold at most 32767 characters so longer strings are truncated
+func (x *XLSXFormatWriter) writeString(ref string, style int, s string) {
+	if utf8.RuneCountInString(s) > xlsxMaxCellLen {
+		s = string([]rune(s)[:xlsxMaxCellLen])
+	}
+	_, _ = fmt.Fprintf(x.sheet, `<c r="%s" s="%d" t="inlineStr"><is><t xml:space="preserve">`, ref, style)
+	_ = xml.EscapeText(x.sheet, []byte(s))
+	_, _ = x.sheet.WriteString(`</t></is></c>`)
+}
+
+func (x *XLSXFormatWriter) Close() error {
+	if x.sheet == nil {
+		if err := x.start(); err != nil {
+			return err
+		}
+	}
+	_, _ = x.sheet.WriteString(xlsxSheetEnd)
+	if err := x.sheet.Flush(); err != nil {
+		return err
+	}
+	return x.zip.Close()
+}
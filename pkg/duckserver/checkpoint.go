@@ -0,0 +1,90 @@
+package duckserver
+
+import (
+	"context"
+	"github.com/sirupsen/logrus"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+)
+
+const checkpointPollInterval = time.Second
+
+var systemCheckpointRegexp = regexp.MustCompile(`(?i)^\s*SYSTEM\s+CHECKPOINT\s*;?\s*$`)
+
+// checkpointer runs CHECKPOINT in background when the WAL grows over walSize or every interval,
+// so the WAL doesn't grow unbounded under continuous ingest
+type checkpointer struct {
+	server   *PgServer
+	walPath  string
+	walSize  int64
+	interval time.Duration
+	mu       sync.Mutex
+	last     time.Time
+}
+
+func newCheckpointer(server *PgServer, dbPath string, walSize int64, interval time.Duration) *checkpointer {
+	return &checkpointer{
+		server:   server,
+		walPath:  dbPath + ".wal",
+		walSize:  walSize,
+		interval: interval,
+		last:     time.Now(),
+	}
+}
+
+func (c *checkpointer) Run() {
+	if c.walSize <= 0 && c.interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(checkpointPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.server.done:
+			return
+		case <-ticker.C:
+		}
+		walSize := c.currentWalSize()
+		metrics.Set("duckserver_wal_size_bytes", float64(walSize))
+		due := c.interval > 0 && time.Since(c.last) >= c.interval
+		if c.walSize > 0 && walSize >= c.walSize {
+			due = true
+		}
+		if !due {
+			continue
+		}
+		if err := c.Checkpoint(context.Background()); err != nil {
+			logrus.Warnf("background checkpoint error: %v", err)
+		}
+	}
+}
+
+func (c *checkpointer) currentWalSize() int64 {
+	info, err := os.Stat(c.walPath)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// Checkpoint runs a CHECKPOINT immediately and records its duration
+func (c *checkpointer) Checkpoint(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	start := time.Now()
+	_, err := c.server.conn.ExecContext(ctx, "CHECKPOINT")
+	duration := time.Since(start)
+	c.last = time.Now()
+	if err != nil {
+		metrics.Add("duckserver_checkpoint_errors_total", 1)
+		return err
+	}
+	metrics.Add("duckserver_checkpoints_total", 1)
+	metrics.Add("duckserver_checkpoint_duration_seconds_total", duration.Seconds())
+	metrics.Set("duckserver_last_checkpoint_duration_seconds", duration.Seconds())
+	metrics.Set("duckserver_last_checkpoint_timestamp_seconds", float64(c.last.Unix()))
+	logrus.Debugf("checkpoint finished in %s", duration)
+	return nil
+}
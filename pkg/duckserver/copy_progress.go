@@ -0,0 +1,66 @@
+package duckserver
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// copyProgressSetting is the interval between the progress notices of COPY FROM STDIN, like '10s', 0 disables them
+const copyProgressSetting = "duckserver_copy_progress"
+
+// copyCommitRowsSetting commits the rows of COPY FROM STDIN outside a transaction every number of rows, a failure
+// keeps the rows committed before and the client resumes after them, 0 commits once at the end
+const copyCommitRowsSetting = "duckserver_copy_commit_rows"
+
+// setCopyOptions applies SET and RESET of the COPY FROM STDIN settings
+func (c *PgConn) setCopyOptions(cmd *setCommand) error {
+	if cmd.name == copyProgressSetting || cmd.name == "all" {
+		c.copyProgressInterval = 0
+		if !cmd.reset && cmd.name == copyProgressSetting {
+			interval, err := time.ParseDuration(cmd.value)
+			if seconds, secondsErr := strconv.ParseFloat(cmd.value, 64); secondsErr == nil {
+				interval, err = time.Duration(seconds*float64(time.Second)), nil
+			}
+			if err != nil || interval < 0 {
+				return &databaseError{SqlStateInvalidParameterValue, fmt.Sprintf("invalid value for parameter \"%s\": \"%s\"", copyProgressSetting, cmd.value)}
+			}
+			c.copyProgressInterval = interval
+		}
+	}
+	if cmd.name == copyCommitRowsSetting || cmd.name == "all" {
+		c.copyCommitRows = 0
+		if !cmd.reset && cmd.name == copyCommitRowsSetting {
+			rows, err := strconv.Atoi(cmd.value)
+			if err != nil || rows < 0 {
+				return &databaseError{SqlStateInvalidParameterValue, fmt.Sprintf("invalid value for parameter \"%s\": \"%s\"", copyCommitRowsSetting, cmd.value)}
+			}
+			c.copyCommitRows = rows
+		}
+	}
+	return nil
+}
+
+// copyProgress sends the progress notices of a COPY FROM STDIN
+type copyProgress struct {
+	conn   *PgConn
+	reader *copyReader
+	next   time.Time
+}
+
+func (c *PgConn) newCopyProgress(reader *copyReader) *copyProgress {
+	return &copyProgress{conn: c, reader: reader, next: time.Now().Add(c.copyProgressInterval)}
+}
+
+// Row sends a notice with the rows and bytes received when the interval passed, and the rows committed by batches
+func (p *copyProgress) Row(rows, committed int) error {
+	if p.conn.copyProgressInterval <= 0 || time.Now().Before(p.next) {
+		return nil
+	}
+	p.next = time.Now().Add(p.conn.copyProgressInterval)
+	notice := fmt.Sprintf("COPY progress: %d rows, %d bytes received", rows, p.reader.bytes)
+	if committed > 0 {
+		notice += fmt.Sprintf(", %d rows committed", committed)
+	}
+	return p.conn.SendNotice(notice)
+}
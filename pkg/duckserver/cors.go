@@ -0,0 +1,95 @@
+package duckserver
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// corsExposedHeaders are the response headers browsers let the scripts of other origins read
+var corsExposedHeaders = []string{
+	"X-ClickHouse-Summary", "X-ClickHouse-Progress", "X-ClickHouse-Format", "X-ClickHouse-Server-Display-Name",
+	"X-DuckServer-Profile-Id", "X-DuckServer-Transfer-Duplicate",
+}
+
+// CORSOptions lets browser clients of other origins query the clickhouse http endpoint
+type CORSOptions struct {
+	// AllowedOrigins are the origins allowed to send requests, * allows any origin
+	AllowedOrigins []string
+	// AllowedMethods and AllowedHeaders are answered to preflight requests, default GET, POST and the headers of
+	// authentication and the clickhouse database
+	AllowedMethods []string
+	AllowedHeaders []string
+	// AllowCredentials lets the browser send cookies and basic authentication, the origin is echoed instead of *
+	AllowCredentials bool
+	// MaxAge is the time browsers cache a preflight response, 0 leaves it to the browser
+	MaxAge time.Duration
+}
+
+type corsPolicy struct {
+	options CORSOptions
+	any     bool
+	origins map[string]bool
+	methods string
+	headers string
+}
+
+func newCorsPolicy(options CORSOptions) *corsPolicy {
+	p := &corsPolicy{options: options, origins: make(map[string]bool)}
+	for _, origin := range options.AllowedOrigins {
+		if origin == "*" {
+			p.any = true
+		}
+		p.origins[strings.TrimSuffix(origin, "/")] = true
+	}
+	methods := options.AllowedMethods
+	if len(methods) == 0 {
+		methods = []string{http.MethodGet, http.MethodPost}
+	}
+	p.methods = strings.ToUpper(strings.Join(methods, ", "))
+	headers := options.AllowedHeaders
+	if len(headers) == 0 {
+		headers = []string{"Authorization", "Content-Type", "X-ClickHouse-Database"}
+	}
+	p.headers = strings.Join(headers, ", ")
+	return p
+}
+
+// Handle sets the CORS headers of a request from an allowed origin and answers preflight requests, it reports
+// whether the request was answered
+func (p *corsPolicy) Handle(wr http.ResponseWriter, r *http.Request) bool {
+	if p == nil {
+		return false
+	}
+	origin := r.Header.Get("Origin")
+	preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+	header := wr.Header()
+	header.Add("Vary", "Origin")
+	if origin == "" || !p.any && !p.origins[origin] {
+		if preflight {
+			wr.WriteHeader(http.StatusForbidden)
+			return true
+		}
+		return false
+	}
+	if p.any && !p.options.AllowCredentials {
+		header.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		header.Set("Access-Control-Allow-Origin", origin)
+	}
+	if p.options.AllowCredentials {
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if !preflight {
+		header.Set("Access-Control-Expose-Headers", strings.Join(corsExposedHeaders, ", "))
+		return false
+	}
+	header.Set("Access-Control-Allow-Methods", p.methods)
+	header.Set("Access-Control-Allow-Headers", p.headers)
+	if p.options.MaxAge > 0 {
+		header.Set("Access-Control-Max-Age", strconv.Itoa(int(p.options.MaxAge.Seconds())))
+	}
+	wr.WriteHeader(http.StatusNoContent)
+	return true
+}
@@ -0,0 +1,197 @@
+package duckserver
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	// SqlStateDuplicateCursor is the SQLSTATE of DECLARE of a cursor that already exists
+	SqlStateDuplicateCursor = "42P03"
+	// SqlStateInvalidCursorName is the SQLSTATE of a cursor that doesn't exist
+	SqlStateInvalidCursorName = "34000"
+)
+
+var declareCursorRegexp = regexp.MustCompile(`(?is)^\s*DECLARE\s+(` + pgIdentPattern + `)\s+(?:BINARY\s+)?(?:(?:ASENSITIVE|INSENSITIVE)\s+)?(?:(?:NO\s+)?SCROLL\s+)?CURSOR\s+(?:(WITH|WITHOUT)\s+HOLD\s+)?FOR\s+(.*?)[\s;]*$`)
+var fetchCursorRegexp = regexp.MustCompile(`(?is)^\s*(FETCH|MOVE)\s+(?:(NEXT|ALL|FORWARD\s+ALL|FORWARD\s+\d+|FORWARD|\d+)\s+)?(?:(?:FROM|IN)\s+)?(` + pgIdentPattern + `)\s*;?\s*$`)
+var closeCursorRegexp = regexp.MustCompile(`(?is)^\s*CLOSE\s+(` + pgIdentPattern + `)\s*;?\s*$`)
+
+// cursorCommand is a DECLARE, FETCH, MOVE or CLOSE of a cursor, DuckDB has no cursors so the server keeps the
+// result of the query and returns it in batches
+type cursorCommand struct {
+	verb  string
+	name  string
+	query string
+	hold  bool
+	// count is the number of rows to fetch or move, -1 for all
+	count int
+}
+
+// pgCursor is a declared cursor, the result is materialized by DuckDB and read by FETCH
+type pgCursor struct {
+	query   string
+	stmt    driver.Stmt
+	rows    driver.Rows
+	hold    bool
+	columns [][2]string
+}
+
+func (cur *pgCursor) close() {
+	_ = cur.rows.Close()
+	_ = cur.stmt.Close()
+}
+
+// foldIdent folds an unquoted identifier to lower case like postgresql
+func foldIdent(s string) string {
+	if strings.HasPrefix(s, `"`) {
+		return strings.Trim(s, `"`)
+	}
+	return strings.ToLower(s)
+}
+
+// parseCursorCommand parses DECLARE, FETCH, MOVE and CLOSE, the scroll directions backwards aren't supported
+func parseCursorCommand(query string) *cursorCommand {
+	if m := declareCursorRegexp.FindStringSubmatch(query); m != nil {
+		return &cursorCommand{verb: "DECLARE", name: foldIdent(m[1]), hold: strings.EqualFold(m[2], "WITH"), query: m[3]}
+	}
+	if m := fetchCursorRegexp.FindStringSubmatch(query); m != nil {
+		cmd := &cursorCommand{verb: strings.ToUpper(m[1]), name: foldIdent(m[3]), count: 1}
+		fields := strings.Fields(strings.ToUpper(m[2]))
+		if len(fields) > 0 {
+			switch last := fields[len(fields)-1]; last {
+			case "ALL":
+				cmd.count = -1
+			case "NEXT", "FORWARD":
+			default:
+				cmd.count, _ = strconv.Atoi(last)
+			}
+		}
+		return cmd
+	}
+	if m := closeCursorRegexp.FindStringSubmatch(query); m != nil {
+		return &cursorCommand{verb: "CLOSE", name: foldIdent(m[1])}
+	}
+	return nil
+}
+
+// runCursorCommand runs a cursor command, the rows of FETCH are described when sendRowDesc is set
+func (c *PgConn) runCursorCommand(ctx context.Context, cmd *cursorCommand, sendRowDesc bool) error {
+	var err error
+	switch cmd.verb {
+	case "DECLARE":
+		err = c.declareCursor(ctx, cmd)
+	case "CLOSE":
+		err = c.closeCursor(cmd.name)
+	default:
+		err = c.fetchCursor(ctx, cmd, sendRowDesc)
+	}
+	var dbErr *databaseError
+	if errors.As(err, &dbErr) {
+		return c.SendErrorResponseWithCode(dbErr.code, dbErr.msg)
+	}
+	return err
+}
+
+func (c *PgConn) declareCursor(ctx context.Context, cmd *cursorCommand) error {
+	if _, ok := c.cursors[cmd.name]; ok {
+		return &databaseError{SqlStateDuplicateCursor, fmt.Sprintf("cursor \"%s\" already exists", cmd.name)}
+	}
+	stmt, err := c.conn.Prepare(cmd.query)
+	if err != nil {
+		return c.SendErrorResponse(err.Error())
+	}
+	rows, err := stmt.(driver.StmtQueryContext).QueryContext(ctx, nil)
+	if err != nil {
+		_ = stmt.Close()
+		return c.SendErrorResponse(err.Error())
+	}
+	c.cursors[cmd.name] = &pgCursor{query: cmd.query, stmt: stmt, rows: rows, hold: cmd.hold}
+	return c.SendCommandComplete("DECLARE CURSOR")
+}
+
+func (c *PgConn) closeCursor(name string) error {
+	if name == "all" {
+		c.closeCursors(true)
+		return c.SendCommandComplete("CLOSE CURSOR ALL")
+	}
+	cur, ok := c.cursors[name]
+	if !ok {
+		return &databaseError{SqlStateInvalidCursorName, fmt.Sprintf("cursor \"%s\" does not exist", name)}
+	}
+	cur.close()
+	delete(c.cursors, name)
+	return c.SendCommandComplete("CLOSE CURSOR")
+}
+
+// closeCursors closes the cursors of the connection, the cursors declared WITH HOLD only when all is set, as they
+// outlive the transaction
+func (c *PgConn) closeCursors(all bool) {
+	for name, cur := range c.cursors {
+		if all || !cur.hold {
+			cur.close()
+			delete(c.cursors, name)
+		}
+	}
+}
+
+// describeCursor returns the columns of the query of a cursor, for the Describe of a FETCH
+func (c *PgConn) describeCursor(ctx context.Context, name string) ([][2]string, error) {
+	cur, ok := c.cursors[name]
+	if !ok {
+		return nil, &databaseError{SqlStateInvalidCursorName, fmt.Sprintf("cursor \"%s\" does not exist", name)}
+	}
+	if cur.columns == nil {
+		columns, err := c.inferStmtOutputNamesAndTypes(ctx, cur.query)
+		if err != nil {
+			return nil, err
+		}
+		cur.columns = columns
+	}
+	return cur.columns, nil
+}
+
+// fetchCursor sends the next count rows of a cursor, MOVE only skips them
+func (c *PgConn) fetchCursor(ctx context.Context, cmd *cursorCommand, sendRowDesc bool) error {
+	cur, ok := c.cursors[cmd.name]
+	if !ok {
+		return &databaseError{SqlStateInvalidCursorName, fmt.Sprintf("cursor \"%s\" does not exist", cmd.name)}
+	}
+	values := make([]driver.Value, len(cur.rows.Columns()))
+	c.tzColumns = c.timestampTZColumns(cur.rows)
+	rowCount := 0
+	for cmd.count < 0 || rowCount < cmd.count {
+		if err := cur.rows.Next(values); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return c.SendErrorResponse(err.Error())
+		}
+		if cmd.verb == "FETCH" {
+			if sendRowDesc && rowCount == 0 {
+				if err := c.SendRowDescription(cur.rows.Columns(), values, rowsTypeAliases(cur.rows)); err != nil {
+					return err
+				}
+			}
+			if err := c.SendRowData(values); err != nil {
+				return err
+			}
+		}
+		rowCount++
+	}
+	if cmd.verb == "FETCH" && sendRowDesc && rowCount == 0 {
+		columns, err := c.describeCursor(ctx, cmd.name)
+		if err != nil {
+			return c.SendErrorResponse(err.Error())
+		}
+		if err := c.SendRowDescriptionWithColumnNameAndTypes(columns); err != nil {
+			return err
+		}
+	}
+	return c.SendCommandComplete(fmt.Sprintf("%s %d", cmd.verb, rowCount))
+}
@@ -0,0 +1,164 @@
+package duckserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// SqlStateInsufficientPrivilege is the SQLSTATE of an admin statement run by a user who isn't a superuser
+const SqlStateInsufficientPrivilege = "42501"
+
+// exportDatabaseRegexp matches EXPORT DATABASE 'dir' with its options and IMPORT DATABASE 'dir', they read and write
+// files of the server host so only superusers run them
+var exportDatabaseRegexp = regexp.MustCompile(`(?is)^\s*(export|import)\s+database\s+('(?:[^']|'')*')\s*(\(.*\))?\s*;?\s*$`)
+
+// importCreateRegexp matches the statements of schema.sql which accept IF NOT EXISTS
+var importCreateRegexp = regexp.MustCompile(`(?i)^CREATE\s+(SCHEMA|SEQUENCE|TABLE|VIEW|INDEX|UNIQUE\s+INDEX|MACRO)\s+`)
+
+var importCreateTypeRegexp = regexp.MustCompile(`(?i)^CREATE\s+TYPE\s+(\S+)\s+AS\s`)
+
+// importCopyRegexp matches the COPY statements of load.sql
+var importCopyRegexp = regexp.MustCompile(`(?is)^COPY\s+(.+?)\s+FROM\s+'`)
+
+// isSuperuser reports whether user may run the admin statements
+func (s *PgServer) isSuperuser(user string) bool {
+	for _, superuser := range s.superusers {
+		if superuser == user {
+			return true
+		}
+	}
+	return false
+}
+
+// runExportCommand runs EXPORT DATABASE and IMPORT DATABASE for user, ok is false for other statements. The tables
+// whose data wasn't imported are returned.
+func (s *PgServer) runExportCommand(ctx context.Context, user, query string) (tag string, skipped []string, ok bool, err error) {
+	m := exportDatabaseRegexp.FindStringSubmatch(query)
+	if m == nil {
+		return "", nil, false, nil
+	}
+	tag = strings.ToUpper(m[1]) + " DATABASE"
+	if !s.isSuperuser(user) {
+		return tag, nil, true, &databaseError{SqlStateInsufficientPrivilege, fmt.Sprintf("permission denied to %s, it requires a superuser", strings.ToLower(tag))}
+	}
+	dir, _ := unquoteLiteral(m[2])
+	start := time.Now()
+	if tag == "EXPORT DATABASE" {
+		_, err = s.conn.ExecContext(ctx, fmt.Sprintf("EXPORT DATABASE %s %s", m[2], m[3]))
+	} else {
+		skipped, err = s.importDatabase(ctx, dir)
+		s.notifySchemaChange(query)
+	}
+	if err != nil {
+		return tag, nil, true, err
+	}
+	logrus.Infof("%s %s by %s finished in %s", strings.ToLower(tag), dir, user, time.Since(start))
+	return tag, skipped, true, nil
+}
+
+// importDatabase imports an EXPORT DATABASE directory in a transaction. Unlike IMPORT DATABASE of DuckDB, the
+// objects which already exist are kept, e.g. the duckserver schema of the server, and the data is only loaded into
+// the tables which are empty, the others are returned.
+func (s *PgServer) importDatabase(ctx context.Context, dir string) ([]string, error) {
+	schema, err := os.ReadFile(filepath.Join(dir, "schema.sql"))
+	if err != nil {
+		return nil, err
+	}
+	load, err := os.ReadFile(filepath.Join(dir, "load.sql"))
+	if err != nil {
+		return nil, err
+	}
+	tx, err := s.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	for _, stmt := range splitStatements(string(schema)) {
+		if m := importCreateTypeRegexp.FindStringSubmatch(stmt); m != nil {
+			parts := splitQualifiedName(m[1])
+			var exists bool
+			if err = tx.QueryRowContext(ctx, "select count(*) > 0 from duckdb_types() where type_name = $1 and schema_name = coalesce($2, 'main')",
+				parts[len(parts)-1], qualifier(parts)).Scan(&exists); err != nil {
+				return nil, err
+			}
+			if exists {
+				continue
+			}
+		} else if loc := importCreateRegexp.FindStringSubmatchIndex(stmt); loc != nil {
+			stmt = stmt[:loc[1]] + "IF NOT EXISTS " + stmt[loc[1]:]
+		}
+		if _, err = tx.ExecContext(ctx, stmt); err != nil {
+			return nil, fmt.Errorf("import %s: %w", dir, err)
+		}
+	}
+	var skipped []string
+	for _, stmt := range splitStatements(string(load)) {
+		if m := importCopyRegexp.FindStringSubmatch(stmt); m != nil {
+			var empty bool
+			if err = tx.QueryRowContext(ctx, fmt.Sprintf("select count(*) = 0 from (select 1 from %s limit 1)", m[1])).Scan(&empty); err != nil {
+				return nil, err
+			}
+			if !empty {
+				skipped = append(skipped, m[1])
+				continue
+			}
+		}
+		if _, err = tx.ExecContext(ctx, stmt); err != nil {
+			return nil, fmt.Errorf("import %s: %w", dir, err)
+		}
+	}
+	return skipped, tx.Commit()
+}
+
+// qualifier returns the schema of a qualified name split by splitQualifiedName, nil if it has none
+func qualifier(parts []string) any {
+	if len(parts) < 2 {
+		return nil
+	}
+	return parts[len(parts)-2]
+}
+
+// splitStatements splits a script on the semicolons outside of quotes and parentheses
+func splitStatements(s string) []string {
+	var stmts []string
+	start := 0
+	for _, t := range append(chTokenize(s), chToken{";", len(s), len(s)}) {
+		if t.text != ";" {
+			continue
+		}
+		if stmt := strings.TrimSpace(s[start:t.start]); stmt != "" {
+			stmts = append(stmts, stmt)
+		}
+		start = t.end
+	}
+	return stmts
+}
+
+// exportCommand runs EXPORT DATABASE and IMPORT DATABASE on a postgresql connection, it reports false for other
+// statements
+func (c *PgConn) exportCommand(query string) (bool, error) {
+	tag, skipped, ok, err := c.server.runExportCommand(context.Background(), c.user, query)
+	if !ok {
+		return false, nil
+	}
+	var dbErr *databaseError
+	if errors.As(err, &dbErr) {
+		return true, c.SendErrorResponseWithCode(dbErr.code, dbErr.msg)
+	}
+	if err != nil {
+		return true, c.SendErrorResponse(err.Error())
+	}
+	for _, table := range skipped {
+		if err = c.SendNotice(fmt.Sprintf("table %s isn't empty, its data wasn't imported", table)); err != nil {
+			return true, err
+		}
+	}
+	return true, c.SendCommandComplete(tag)
+}
@@ -0,0 +1,194 @@
+package duckserver
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// databaseFileExt is the extension of the database files in the data directory
+const databaseFileExt = ".duckdb"
+
+const (
+	// SqlStateDuplicateDatabase is the SQLSTATE of CREATE DATABASE of an existing database
+	SqlStateDuplicateDatabase = "42P04"
+	// SqlStateInvalidCatalogName is the SQLSTATE of a database that doesn't exist
+	SqlStateInvalidCatalogName = "3D000"
+	// SqlStateObjectInUse is the SQLSTATE of DROP DATABASE of a database with connections
+	SqlStateObjectInUse = "55006"
+)
+
+var createDatabaseRegexp = regexp.MustCompile(`(?i)^\s*create\s+database\s+(if\s+not\s+exists\s+)?("[^"]+"|\w+)(\s+.*)?\s*;?\s*$`)
+var dropDatabaseRegexp = regexp.MustCompile(`(?i)^\s*drop\s+database\s+(if\s+exists\s+)?("[^"]+"|\w+)(\s+.*)?\s*;?\s*$`)
+
+// databaseNameRegexp limits database names to identifiers, the name is also the file name in the data directory
+var databaseNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// databaseError is an error with the SQLSTATE sent to postgresql clients
+type databaseError struct {
+	code string
+	msg  string
+}
+
+func (e *databaseError) Error() string {
+	return e.msg
+}
+
+func databaseName(s string) string {
+	return strings.Trim(s, `"`)
+}
+
+// attachDatabases attaches the database files of the data directory
+func (s *PgServer) attachDatabases() error {
+	if err := s.conn.QueryRow("select current_database()").Scan(&s.mainDatabase); err != nil {
+		return err
+	}
+	if s.dataDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(s.dataDir, 0755); err != nil {
+		return err
+	}
+	files, err := filepath.Glob(filepath.Join(s.dataDir, "*"+databaseFileExt))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), databaseFileExt)
+		if !databaseNameRegexp.MatchString(name) || strings.EqualFold(name, s.mainDatabase) {
+			logrus.Warnf("skip database file %s, the name is not a valid database name", file)
+			continue
+		}
+		if _, err = s.conn.Exec(fmt.Sprintf("ATTACH IF NOT EXISTS %s AS %s", quoteLiteral(file), quoteIdent(name))); err != nil {
+			return fmt.Errorf("attach %s: %w", file, err)
+		}
+		logrus.Infof("attached database %s", name)
+	}
+	return nil
+}
+
+// hasDatabase reports whether name is the main database or an attached database of the data directory
+func (s *PgServer) hasDatabase(name string) bool {
+	if strings.EqualFold(name, s.mainDatabase) {
+		return true
+	}
+	if s.dataDir == "" || !databaseNameRegexp.MatchString(name) {
+		return false
+	}
+	var count int
+	err := s.conn.QueryRow("select count(*) from duckdb_databases() where database_name = $1 and path = $2",
+		name, filepath.Join(s.dataDir, name+databaseFileExt)).Scan(&count)
+	return err == nil && count > 0
+}
+
+// CreateDatabase creates a database file in the data directory and attaches it
+func (s *PgServer) CreateDatabase(name string, ifNotExists bool) error {
+	if s.dataDir == "" {
+		return &databaseError{SqlStateFeatureNotSupported, "create database requires a data directory, start the server with --data_dir"}
+	}
+	if !databaseNameRegexp.MatchString(name) {
+		return fmt.Errorf("invalid database name %s", name)
+	}
+	s.databaseMu.Lock()
+	defer s.databaseMu.Unlock()
+	if s.hasDatabase(name) {
+		if ifNotExists {
+			return nil
+		}
+		return &databaseError{SqlStateDuplicateDatabase, fmt.Sprintf("database \"%s\" already exists", name)}
+	}
+	file := filepath.Join(s.dataDir, name+databaseFileExt)
+	if _, err := s.conn.Exec(fmt.Sprintf("ATTACH %s AS %s", quoteLiteral(file), quoteIdent(name))); err != nil {
+		return err
+	}
+	logrus.Infof("created database %s", name)
+	return nil
+}
+
+// DropDatabase detaches a database of the data directory and removes its files
+func (s *PgServer) DropDatabase(name string, ifExists bool) error {
+	if s.dataDir == "" {
+		return &databaseError{SqlStateFeatureNotSupported, "drop database requires a data directory, start the server with --data_dir"}
+	}
+	if strings.EqualFold(name, s.mainDatabase) {
+		return &databaseError{SqlStateObjectInUse, fmt.Sprintf("cannot drop the main database \"%s\"", name)}
+	}
+	s.databaseMu.Lock()
+	defer s.databaseMu.Unlock()
+	if !s.hasDatabase(name) {
+		if ifExists {
+			return nil
+		}
+		return &databaseError{SqlStateInvalidCatalogName, fmt.Sprintf("database \"%s\" does not exist", name)}
+	}
+	inUse := false
+	s.backends.Range(func(key, value any) bool {
+		if strings.EqualFold(value.(*PgConn).database, name) {
+			inUse = true
+			return false
+		}
+		return true
+	})
+	if inUse {
+		return &databaseError{SqlStateObjectInUse, fmt.Sprintf("database \"%s\" is being accessed by other users", name)}
+	}
+	if _, err := s.conn.Exec("DETACH " + quoteIdent(name)); err != nil {
+		return err
+	}
+	file := filepath.Join(s.dataDir, name+databaseFileExt)
+	if err := os.Remove(file); err != nil {
+		return err
+	}
+	if err := os.Remove(file + ".wal"); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	logrus.Infof("dropped database %s", name)
+	return nil
+}
+
+// useDatabase switches the connection to the database of the startup message, unknown names keep the
+// main database, as clients commonly send the user name or postgres
+func (c *PgConn) useDatabase(name string) error {
+	if name == "" || strings.EqualFold(name, c.server.mainDatabase) || !c.server.hasDatabase(name) {
+		c.database = c.server.mainDatabase
+		if name != "" && !strings.EqualFold(name, c.server.mainDatabase) && !c.hasSchema(name) {
+			c.catalogAlias = name
+		}
+		return nil
+	}
+	if _, err := c.conn.(driver.ExecerContext).ExecContext(context.Background(), "USE "+quoteIdent(name), nil); err != nil {
+		return err
+	}
+	c.database = name
+	return nil
+}
+
+// databaseCommand runs CREATE DATABASE and DROP DATABASE, it reports false for other statements
+func (c *PgConn) databaseCommand(query string) (bool, error) {
+	var err error
+	var tag string
+	if m := createDatabaseRegexp.FindStringSubmatch(query); m != nil {
+		err = c.server.CreateDatabase(databaseName(m[2]), m[1] != "")
+		tag = "CREATE DATABASE"
+	} else if m = dropDatabaseRegexp.FindStringSubmatch(query); m != nil {
+		err = c.server.DropDatabase(databaseName(m[2]), m[1] != "")
+		tag = "DROP DATABASE"
+	} else {
+		return false, nil
+	}
+	var dbErr *databaseError
+	if errors.As(err, &dbErr) {
+		return true, c.SendErrorResponseWithCode(dbErr.code, dbErr.msg)
+	}
+	if err != nil {
+		return true, c.SendErrorResponse(err.Error())
+	}
+	c.server.notifySchemaChange(query)
+	return true, c.SendCommandComplete(tag)
+}
@@ -0,0 +1,92 @@
+package duckserver
+
+import (
+	"context"
+	"database/sql/driver"
+	"regexp"
+	"strings"
+)
+
+const pgIdentPattern = `(?:"[^"]+"|\w+)`
+
+var schemaStatementRegexp = regexp.MustCompile(`(?is)^(\s*(?:CREATE|DROP)\s+SCHEMA\s+(?:IF\s+(?:NOT\s+)?EXISTS\s+)?)("[^"]+")\.`)
+var dbtRelationshipsRegexp = regexp.MustCompile(`(?is)^\s*with\s+relation\s+as\s*\(\s*select\s+pg_rewrite\.ev_class\b.*\bdependent_name\b`)
+var alterTableRenameRegexp = regexp.MustCompile(`(?is)^\s*ALTER\s+TABLE\s+(IF\s+EXISTS\s+)?((?:` + pgIdentPattern + `\.){0,2}` + pgIdentPattern + `)\s+(RENAME\s+TO\s+.*)$`)
+
+// hasSchema reports whether the database of the connection has a schema
+func (c *PgConn) hasSchema(name string) bool {
+	rows, err := c.conn.(driver.QueryerContext).QueryContext(context.Background(), "select count(*) from duckdb_schemas() where database_name = $1 and schema_name = $2",
+		[]driver.NamedValue{{Ordinal: 1, Value: c.database}, {Ordinal: 2, Value: name}})
+	if err != nil {
+		return false
+	}
+	defer rows.Close()
+	values := make([]driver.Value, 1)
+	return rows.Next(values) == nil && values[0].(int64) > 0
+}
+
+// rewriteDbtRelationships answers the query of the view dependencies of dbt-postgres with no rows, DuckDB doesn't
+// track them and binds its GROUP BY to the table aliases
+func rewriteDbtRelationships(query string) string {
+	if !dbtRelationshipsRegexp.MatchString(query) {
+		return query
+	}
+	return "select '' as referenced_schema, '' as referenced_name, '' as dependent_schema, '' as dependent_name limit 0"
+}
+
+// rewriteCatalogAlias qualifies the names of three parts and the schemas of CREATE/DROP SCHEMA qualified with the
+// database of the startup message with the database of the connection, as dbt qualifies relations with the
+// database of its profile, e.g. "postgres"."analytics"."orders"
+func (c *PgConn) rewriteCatalogAlias(query string) string {
+	if c.catalogAlias == "" {
+		return query
+	}
+	prefix := quoteIdent(c.catalogAlias) + "."
+	if !strings.Contains(query, prefix) {
+		return query
+	}
+	if m := schemaStatementRegexp.FindStringSubmatch(query); m != nil && m[2] == quoteIdent(c.catalogAlias) {
+		return m[1] + quoteIdent(c.database) + "." + query[len(m[0]):]
+	}
+	re := regexp.MustCompile(regexp.QuoteMeta(prefix) + `(` + pgIdentPattern + `\.` + pgIdentPattern + `)`)
+	return re.ReplaceAllString(query, quoteIdent(c.database)+".$1")
+}
+
+// splitQualifiedName splits a qualified name into its unquoted parts
+func splitQualifiedName(name string) []string {
+	var parts []string
+	for _, t := range chTokenize(name) {
+		if t.text != "." {
+			parts = append(parts, strings.Trim(t.text, `"`))
+		}
+	}
+	return parts
+}
+
+// rewriteViewRename runs ALTER TABLE ... RENAME TO of a view as ALTER VIEW, postgresql renames views with
+// ALTER TABLE and dbt does so when it swaps a view model in place
+func (c *PgConn) rewriteViewRename(query string) string {
+	m := alterTableRenameRegexp.FindStringSubmatch(query)
+	if m == nil {
+		return query
+	}
+	parts := splitQualifiedName(m[2])
+	var database, schema string
+	switch len(parts) {
+	case 3:
+		database, schema = parts[0], parts[1]
+	case 2:
+		schema = parts[0]
+	}
+	rows, err := c.conn.(driver.QueryerContext).QueryContext(context.Background(), "select count(*) from duckdb_views() where not internal and lower(view_name) = lower($1) and ($2 = '' or lower(schema_name) = lower($2)) and ($3 = '' or lower(database_name) = lower($3))",
+		[]driver.NamedValue{{Ordinal: 1, Value: parts[len(parts)-1]}, {Ordinal: 2, Value: schema}, {Ordinal: 3, Value: database}})
+	if err != nil {
+		return query
+	}
+	defer rows.Close()
+	values := make([]driver.Value, 1)
+	if err = rows.Next(values); err != nil || values[0].(int64) == 0 {
+		return query
+	}
+	return "ALTER VIEW " + m[1] + m[2] + " " + m[3]
+}
@@ -0,0 +1,107 @@
+package duckserver
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+const diskGuardPollInterval = 5 * time.Second
+
+const (
+	diskLevelOk = iota
+	diskLevelSoft
+	diskLevelHard
+)
+
+// writeStatementClasses are the statement classes which may write to the database
+var writeStatementClasses = map[string]bool{"insert": true, "update": true, "delete": true, "ddl": true, "copy": true, "attach": true}
+
+// isWriteQuery reports whether a statement of the query may write to the database, the comments and hints before a
+// statement don't hide it
+func isWriteQuery(query string) bool {
+	for _, stmt := range splitStatements(query) {
+		if writeStatementClasses[classifyStatement(stmt)] {
+			return true
+		}
+	}
+	return false
+}
+
+// diskGuard watches the free space of the database volume, it warns below softLimit
+// and rejects writes below hardLimit while reads are still served
+type diskGuard struct {
+	dir       string
+	softLimit uint64
+	hardLimit uint64
+	free      atomic.Uint64
+	level     atomic.Int32
+}
+
+func newDiskGuard(dbPath string, softLimit, hardLimit uint64) *diskGuard {
+	return &diskGuard{
+		dir:       filepath.Dir(dbPath),
+		softLimit: softLimit,
+		hardLimit: hardLimit,
+	}
+}
+
+func (g *diskGuard) Run(done <-chan struct{}) {
+	if g.softLimit == 0 && g.hardLimit == 0 {
+		return
+	}
+	for {
+		g.check()
+		select {
+		case <-done:
+			return
+		case <-time.After(diskGuardPollInterval):
+		}
+	}
+}
+
+func (g *diskGuard) check() {
+	free, err := diskFreeBytes(g.dir)
+	if err != nil {
+		logrus.Warnf("disk guard: %v", err)
+		return
+	}
+	g.free.Store(free)
+	metrics.Set("duckserver_disk_free_bytes", float64(free))
+	level := int32(diskLevelOk)
+	if g.hardLimit > 0 && free < g.hardLimit {
+		level = diskLevelHard
+	} else if g.softLimit > 0 && free < g.softLimit {
+		level = diskLevelSoft
+	}
+	metrics.Set("duckserver_disk_guard_level", float64(level))
+	if old := g.level.Swap(level); old != level {
+		switch level {
+		case diskLevelHard:
+			logrus.Errorf("free disk space %d bytes is below hard limit %d bytes, rejecting writes", free, g.hardLimit)
+		case diskLevelSoft:
+			logrus.Warnf("free disk space %d bytes is below soft limit %d bytes", free, g.softLimit)
+		default:
+			logrus.Infof("free disk space %d bytes is back to normal", free)
+		}
+	}
+}
+
+// CheckWrite returns an error if writes are rejected because the disk is almost full
+func (g *diskGuard) CheckWrite() error {
+	if g == nil || g.level.Load() != diskLevelHard {
+		return nil
+	}
+	metrics.Add("duckserver_disk_guard_rejected_writes_total", 1)
+	return fmt.Errorf("write rejected: free disk space %d bytes is below the hard limit %d bytes", g.free.Load(), g.hardLimit)
+}
+
+// CheckQuery returns an error if the query writes and writes are rejected
+func (g *diskGuard) CheckQuery(query string) error {
+	if !isWriteQuery(query) {
+		return nil
+	}
+	return g.CheckWrite()
+}
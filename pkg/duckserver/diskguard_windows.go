@@ -0,0 +1,9 @@
+//go:build windows
+
+package duckserver
+
+import "errors"
+
+func diskFreeBytes(path string) (uint64, error) {
+	return 0, errors.New("disk free space is not supported on windows")
+}
@@ -0,0 +1,278 @@
+package duckserver
+
+import (
+	"database/sql/driver"
+	"encoding/hex"
+	"fmt"
+	"github.com/marcboeker/go-duckdb"
+	"github.com/sirupsen/logrus"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var duck2pgTypeMap = map[string]string{
+	"BOOLEAN":                  "bool",
+	"VARCHAR":                  "text",
+	"INTEGER":                  "int4",
+	"BIGINT":                   "int8",
+	"DOUBLE":                   "float8",
+	"TIMESTAMP":                "timestamp",
+	"DECIMAL":                  "numeric",
+	"DATE":                     "date",
+	"VARCHAR[]":                "text",
+	"TIMESTAMP WITH TIME ZONE": "timestamptz",
+	"FLOAT":                    "float4",
+	"SMALLINT":                 "int2",
+	"BLOB":                     "bytea",
+	"JSON":                     "json",
+	"UTINYINT":                 "int2",
+	"USMALLINT":                "int4",
+	"UINTEGER":                 "int8",
+	"UBIGINT":                  "numeric",
+	"HUGEINT":                  "numeric",
+	"INTERVAL":                 "interval",
+}
+
+func duck2pgType(s string) string {
+	if isEnumType(s) {
+		return "text"
+	}
+	if _, _, ok := parseDecimalType(s); ok {
+		return "numeric"
+	}
+	// lists are sent in the text format of arrays
+	if strings.HasSuffix(s, "[]") {
+		return "text"
+	}
+	v, ok := duck2pgTypeMap[s]
+	if ok {
+		return v
+	} else {
+		logrus.Panicf("duck2pgType unsupported type %s", s)
+	}
+	return ""
+}
+
+type converter func(in string) (driver.Value, error)
+
+var converters = map[string]converter{
+	"INTEGER": func(in string) (driver.Value, error) {
+		d, err := strconv.ParseInt(in, 10, 32)
+		return int32(d), err
+	},
+	"VARCHAR": func(in string) (driver.Value, error) {
+		return in, nil
+	},
+	"BIGINT": func(in string) (driver.Value, error) {
+		d, err := strconv.ParseInt(in, 10, 64)
+		return d, err
+	},
+	"UTINYINT": func(in string) (driver.Value, error) {
+		d, err := strconv.ParseUint(in, 10, 8)
+		return uint8(d), err
+	},
+	"USMALLINT": func(in string) (driver.Value, error) {
+		d, err := strconv.ParseUint(in, 10, 16)
+		return uint16(d), err
+	},
+	"UINTEGER": func(in string) (driver.Value, error) {
+		d, err := strconv.ParseUint(in, 10, 32)
+		return uint32(d), err
+	},
+	"UBIGINT": func(in string) (driver.Value, error) {
+		d, err := strconv.ParseUint(in, 10, 64)
+		return d, err
+	},
+	"BOOLEAN": func(in string) (driver.Value, error) {
+		d, err := strconv.ParseBool(in)
+		return d, err
+	},
+	"DOUBLE": func(in string) (driver.Value, error) {
+		d, err := strconv.ParseFloat(in, 64)
+		return d, err
+	},
+	"BIT": func(in string) (driver.Value, error) {
+		d, err := strconv.ParseInt(in, 10, 64)
+		return d, err
+	},
+	"TINYINT": func(in string) (driver.Value, error) {
+		d, err := strconv.ParseInt(in, 10, 8)
+		return int8(d), err
+	},
+	"SMALLINT": func(in string) (driver.Value, error) {
+		d, err := strconv.ParseInt(in, 10, 16)
+		return int16(d), err
+	},
+	"FLOAT": func(in string) (driver.Value, error) {
+		d, err := strconv.ParseFloat(in, 32)
+		return float32(d), err
+	},
+	"DATE": func(in string) (driver.Value, error) {
+		return parseTime(in, dateLayouts, true)
+	},
+	"TIMESTAMP":                convertTimestamp,
+	"TIMESTAMP_S":              convertTimestamp,
+	"TIMESTAMP_MS":             convertTimestamp,
+	"TIMESTAMP_NS":             convertTimestamp,
+	"TIMESTAMP WITH TIME ZONE": convertTimestampTZ,
+	"TIMESTAMPTZ":              convertTimestampTZ,
+	"UUID": func(in string) (driver.Value, error) {
+		return parseUUID(in)
+	},
+	// BLOB takes the \x hex format of postgresql and plain hex of clickhouse
+	"BLOB": func(in string) (driver.Value, error) {
+		return hex.DecodeString(strings.TrimPrefix(in, `\x`))
+	},
+}
+
+// getDuckDBConverter returns the converter of text input to the value appended to a column of typ, the types
+// staged as VARCHAR are cast by DuckDB
+func getDuckDBConverter(typ string) converter {
+	if isStagedType(typ) {
+		return converters["VARCHAR"]
+	}
+	return converters[typ]
+}
+
+// timestampLayouts are the accepted formats of timestamps without a time zone
+var timestampLayouts = []string{
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04",
+	"2006-01-02T15:04",
+	"2006/01/02 15:04:05.999999999",
+	"2006-01-02",
+	"2006/01/02",
+}
+
+// timestampTZLayouts are the accepted formats of timestamps with a time zone offset
+var timestampTZLayouts = []string{
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02T15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999Z07",
+	"2006-01-02T15:04:05.999999999Z07",
+	"2006-01-02 15:04:05.999999999 -0700",
+	time.RFC1123Z,
+}
+
+var dateLayouts = append([]string{"20060102"}, timestampLayouts...)
+
+var anyTimestampLayouts = append(append([]string{}, timestampTZLayouts...), timestampLayouts...)
+
+// convertTimestamp parses a timestamp without time zone, an offset in the input is ignored like postgresql
+func convertTimestamp(in string) (driver.Value, error) {
+	return parseTime(in, anyTimestampLayouts, true)
+}
+
+// convertTimestampTZ parses a timestamp with time zone, input without an offset is taken as UTC
+func convertTimestampTZ(in string) (driver.Value, error) {
+	return parseTime(in, anyTimestampLayouts, false)
+}
+
+// parseTime parses in by the first matching layout, input of only digits is a unix timestamp in seconds as sent
+// by clickhouse clients, wallClock drops the time zone offset keeping the local date and time
+func parseTime(in string, layouts []string, wallClock bool) (time.Time, error) {
+	in = strings.TrimSpace(in)
+	if len(in) > 8 && strings.Trim(in, "0123456789") == "" {
+		sec, err := strconv.ParseInt(in, 10, 64)
+		return time.Unix(sec, 0).UTC(), err
+	}
+	for _, layout := range layouts {
+		t, err := time.Parse(layout, in)
+		if err != nil {
+			continue
+		}
+		if wallClock {
+			return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC), nil
+		}
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid date/time value %q", in)
+}
+
+// parseUUID parses a UUID with or without dashes and braces
+func parseUUID(in string) (duckdb.UUID, error) {
+	var uuid duckdb.UUID
+	s := strings.ReplaceAll(strings.Trim(strings.TrimSpace(in), "{}"), "-", "")
+	if len(s) != hex.EncodedLen(len(uuid)) {
+		return uuid, fmt.Errorf("invalid uuid %q", in)
+	}
+	if _, err := hex.Decode(uuid[:], []byte(s)); err != nil {
+		return uuid, fmt.Errorf("invalid uuid %q", in)
+	}
+	return uuid, nil
+}
+
+func duckDecimalToString(value duckdb.Decimal) string {
+	str := value.Value.String()
+	if value.Scale == 0 {
+		return str
+	}
+	sign := ""
+	if strings.HasPrefix(str, "-") {
+		sign, str = "-", str[1:]
+	}
+	if len(str) <= int(value.Scale) {
+		zeroCount := int(value.Scale) - len(str)
+		return sign + "0." + strings.Repeat("0", zeroCount) + str
+	}
+	return sign + str[:len(str)-int(value.Scale)] + "." + str[len(str)-int(value.Scale):]
+}
+
+func duckValueToString(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return "\\N"
+	case int:
+		return strconv.FormatInt(int64(v), 10)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case int32:
+		return strconv.FormatInt(int64(v), 10)
+	case int16:
+		return strconv.FormatInt(int64(v), 10)
+	case int8:
+		return strconv.FormatInt(int64(v), 10)
+	case uint64:
+		return strconv.FormatUint(v, 10)
+	case uint32:
+		return strconv.FormatUint(uint64(v), 10)
+	case uint16:
+		return strconv.FormatUint(uint64(v), 10)
+	case uint8:
+		return strconv.FormatUint(uint64(v), 10)
+	case *big.Int:
+		return v.String()
+	case string:
+		return v
+	case []byte:
+		return hex.EncodeToString(v)
+	case bool:
+		if v {
+			return "1"
+		} else {
+			return "0"
+		}
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case float32:
+		return strconv.FormatFloat(float64(v), 'f', -1, 64)
+	case time.Time:
+		return v.Format("2006-01-02 15:04:05")
+	case duckdb.Decimal:
+		return duckDecimalToString(v)
+	case duckdb.Interval:
+		return formatInterval(v)
+	case []any:
+		var res []string
+		for _, e := range v {
+			res = append(res, duckValueToString(e))
+		}
+		return "{" + strings.Join(res, ",") + "}"
+	default:
+		logrus.Infof("unsupported type %T", v)
+		return fmt.Sprintf("%v", v)
+	}
+}
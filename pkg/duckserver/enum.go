@@ -0,0 +1,156 @@
+package duckserver
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql/driver"
+	"encoding/hex"
+	"fmt"
+	"github.com/marcboeker/go-duckdb"
+	"io"
+	"strings"
+)
+
+// isEnumType reports whether a column type is an ENUM, describe and information_schema spell out the values,
+// go-duckdb reports just ENUM
+func isEnumType(typ string) bool {
+	return typ == "ENUM" || strings.HasPrefix(typ, "ENUM(")
+}
+
+// rowAppender appends whole rows to a table
+type rowAppender interface {
+	AppendRow(args ...driver.Value) error
+	Flush() error
+	Close() error
+}
+
+// stagedTypes are the column types the go-duckdb appender doesn't support besides ENUM and DECIMAL
+var stagedTypes = map[string]bool{
+	"INTERVAL":            true,
+	"TIME":                true,
+	"TIME WITH TIME ZONE": true,
+	"TIMETZ":              true,
+	"HUGEINT":             true,
+	"UHUGEINT":            true,
+	"DECIMAL":             true,
+}
+
+// isStagedType reports whether a column type is appended as VARCHAR through a staging table, as the go-duckdb
+// appender doesn't support it
+func isStagedType(typ string) bool {
+	if _, _, ok := parseDecimalType(typ); ok {
+		return true
+	}
+	return isEnumType(typ) || stagedTypes[typ]
+}
+
+// newRowAppender returns the DuckDB appender of a table, or a staging appender when the table has columns the
+// go-duckdb appender doesn't support
+func newRowAppender(ctx context.Context, conn driver.Conn, schema, table string) (rowAppender, error) {
+	columns, types, err := queryTableColumnTypes(ctx, conn, schema, table)
+	if err != nil {
+		return nil, err
+	}
+	staged := false
+	for _, typ := range types {
+		staged = staged || isStagedType(typ)
+	}
+	if !staged {
+		return duckdb.NewAppenderFromConn(conn, schema, table)
+	}
+	return newStagingAppender(ctx, conn, schema, table, columns, types)
+}
+
+func queryTableColumnTypes(ctx context.Context, conn driver.Conn, schema, table string) ([]string, []string, error) {
+	rows, err := conn.(driver.QueryerContext).QueryContext(ctx, "select column_name, data_type from information_schema.columns where table_schema = $1 and table_name = $2 order by ordinal_position", []driver.NamedValue{
+		{Ordinal: 1, Value: schema},
+		{Ordinal: 2, Value: table},
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	var columns, types []string
+	values := make([]driver.Value, 2)
+	for {
+		if err = rows.Next(values); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, err
+		}
+		columns = append(columns, values[0].(string))
+		types = append(types, values[1].(string))
+	}
+	return columns, types, nil
+}
+
+// stagingAppender appends to a staging table in duckserver schema having the staged columns as VARCHAR,
+// Flush moves the staged rows to the table, casting the values to the column types
+type stagingAppender struct {
+	ctx      context.Context
+	execer   driver.ExecerContext
+	appender *duckdb.Appender
+	target   string
+	staging  string
+	columns  string
+}
+
+func newStagingAppender(ctx context.Context, conn driver.Conn, schema, table string, columns, types []string) (*stagingAppender, error) {
+	suffix := make([]byte, 8)
+	_, _ = rand.Read(suffix)
+	staging := "staging_" + hex.EncodeToString(suffix)
+	selects := make([]string, len(columns))
+	for i, col := range columns {
+		selects[i] = quoteIdent(col)
+		if isStagedType(types[i]) {
+			selects[i] = fmt.Sprintf("%s::VARCHAR as %s", quoteIdent(col), quoteIdent(col))
+		}
+	}
+	a := &stagingAppender{
+		ctx:     ctx,
+		execer:  conn.(driver.ExecerContext),
+		target:  quoteIdent(schema) + "." + quoteIdent(table),
+		staging: "duckserver." + quoteIdent(staging),
+		columns: quoteIdents(columns),
+	}
+	if _, err := a.execer.ExecContext(ctx, fmt.Sprintf("create table %s as select %s from %s limit 0", a.staging, strings.Join(selects, ", "), a.target), nil); err != nil {
+		return nil, err
+	}
+	appender, err := duckdb.NewAppenderFromConn(conn, "duckserver", staging)
+	if err != nil {
+		_, _ = a.execer.ExecContext(context.Background(), "drop table "+a.staging, nil)
+		return nil, err
+	}
+	a.appender = appender
+	return a, nil
+}
+
+func (a *stagingAppender) AppendRow(args ...driver.Value) error {
+	return a.appender.AppendRow(args...)
+}
+
+func (a *stagingAppender) Flush() error {
+	if err := a.appender.Flush(); err != nil {
+		return err
+	}
+	for _, stmt := range []string{
+		fmt.Sprintf("insert into %s (%s) select %s from %s", a.target, a.columns, a.columns, a.staging),
+		"delete from " + a.staging,
+	} {
+		if _, err := a.execer.ExecContext(a.ctx, stmt, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *stagingAppender) Close() error {
+	err := a.Flush()
+	if closeErr := a.appender.Close(); err == nil {
+		err = closeErr
+	}
+	if _, dropErr := a.execer.ExecContext(context.Background(), "drop table "+a.staging, nil); err == nil {
+		err = dropErr
+	}
+	return err
+}
@@ -0,0 +1,150 @@
+package duckserver
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+var explainRegexp = regexp.MustCompile(`(?i)^\s*EXPLAIN\b`)
+var explainableQueryRegexp = regexp.MustCompile(`(?i)^\s*(SELECT|WITH|VALUES|FROM|TABLE)\b`)
+
+// explainColumns is the postgresql EXPLAIN output, one row per line of the plan
+var explainColumns = [][2]string{{"QUERY PLAN", "VARCHAR"}}
+
+// isExplainResult reports whether columns are the explain_key, explain_value result of DuckDB EXPLAIN
+func isExplainResult(columnNames []string, query string) bool {
+	return len(columnNames) == 2 && columnNames[1] == "explain_value" && explainRegexp.MatchString(query)
+}
+
+// explainLines splits the explain_value of each result row into lines
+func explainLines(values []string) []string {
+	var lines []string
+	for _, value := range values {
+		for _, line := range strings.Split(strings.TrimRight(value, "\n"), "\n") {
+			lines = append(lines, strings.TrimRight(line, " "))
+		}
+	}
+	return lines
+}
+
+func (c *PgConn) sendExplain(rows driver.Rows, sendRowDesc bool) error {
+	var values []string
+	rowValues := make([]driver.Value, 2)
+	for {
+		if err := rows.Next(rowValues); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return c.SendErrorResponse(err.Error())
+		}
+		values = append(values, fmt.Sprint(rowValues[1]))
+	}
+	if sendRowDesc {
+		if err := c.SendRowDescriptionWithColumnNameAndTypes(explainColumns); err != nil {
+			return err
+		}
+	}
+	for _, line := range explainLines(values) {
+		if err := c.SendRowData([]driver.Value{line}); err != nil {
+			return err
+		}
+	}
+	return c.SendCommandComplete("EXPLAIN")
+}
+
+// writeExplain writes the plan as a single explain column with one row per line like clickhouse
+func (c *ChServer) writeExplain(ctx context.Context, query string, formater ClickhouseFormatWriterFactory, wr http.ResponseWriter) {
+	conn, release, err := c.requestQueryer(ctx)
+	if err != nil {
+		wr.WriteHeader(500)
+		_, _ = fmt.Fprintf(wr, "Error getting connection: %s", err)
+		return
+	}
+	defer release()
+	rows, err := conn.QueryContext(ctx, query)
+	if err != nil {
+		wr.WriteHeader(500)
+		_, _ = fmt.Fprintf(wr, "Error executing query: %s", err)
+		return
+	}
+	defer rows.Close()
+	var values []string
+	for rows.Next() {
+		var key, value string
+		if err = rows.Scan(&key, &value); err != nil {
+			wr.WriteHeader(500)
+			_, _ = fmt.Fprintf(wr, "Error scanning row: %s", err)
+			return
+		}
+		values = append(values, value)
+	}
+	if err = rows.Err(); err != nil {
+		wr.WriteHeader(500)
+		_, _ = fmt.Fprintf(wr, "Error executing query: %s", err)
+		return
+	}
+	fmter, err := formater([]string{"explain"}, []string{"VARCHAR"}, wr)
+	if err != nil {
+		wr.WriteHeader(500)
+		_, _ = fmt.Fprintf(wr, "Error creating format: %s", err)
+		return
+	}
+	wr.WriteHeader(200)
+	for _, line := range explainLines(values) {
+		if err = fmter.Write([]any{line}); err != nil {
+			writeChStreamError(wr, fmter, chErrorCannotConvertType, "Error writing row: %s", err)
+			return
+		}
+	}
+	if err = fmter.Close(); err != nil {
+		writeChStreamError(wr, nil, chErrorCannotConvertType, "Error writing result: %s", err)
+	}
+}
+
+// ExplainJSON serves /explain, it runs EXPLAIN ANALYZE of a read query with json profiling and returns DuckDB's
+// profiling output, which plan visualizers accept
+func (c *ChServer) ExplainJSON(ctx context.Context, query string, wr http.ResponseWriter) {
+	if err := c.pgServer.checkQuery(ctx, ProtocolClickhouse, query); err != nil {
+		wr.WriteHeader(403)
+		_, _ = fmt.Fprintf(wr, "%s", err)
+		return
+	}
+	query = strings.TrimRight(strings.TrimSpace(query), ";")
+	if !explainableQueryRegexp.MatchString(query) {
+		wr.WriteHeader(400)
+		_, _ = fmt.Fprintf(wr, "Only read queries can be explained")
+		return
+	}
+	conn, release, err := c.databaseConn(ctx)
+	if err != nil {
+		wr.WriteHeader(500)
+		_, _ = fmt.Fprintf(wr, "Error getting connection: %s", err)
+		return
+	}
+	defer release()
+	if _, err = conn.ExecContext(ctx, "PRAGMA enable_profiling='json'"); err != nil {
+		wr.WriteHeader(500)
+		_, _ = fmt.Fprintf(wr, "Error enabling profiling: %s", err)
+		return
+	}
+	defer func() {
+		if _, err := conn.ExecContext(context.Background(), "PRAGMA disable_profiling"); err != nil {
+			logrus.Warnf("disable profiling error: %v", err)
+		}
+	}()
+	var key, plan string
+	if err = conn.QueryRowContext(ctx, "EXPLAIN ANALYZE "+query).Scan(&key, &plan); err != nil {
+		wr.WriteHeader(500)
+		_, _ = fmt.Fprintf(wr, "Error executing query: %s", err)
+		return
+	}
+	wr.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	wr.WriteHeader(200)
+	_, _ = io.WriteString(wr, plan)
+}
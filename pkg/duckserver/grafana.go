@@ -0,0 +1,64 @@
+package duckserver
+
+import (
+	"context"
+	"database/sql"
+	"regexp"
+	"strings"
+)
+
+// grafanaStatements create the catalog views and functions the grafana postgresql datasource queries, DuckDB is
+// built without ICU so only UTC is a time zone
+var grafanaStatements = []string{
+	`create view if not exists pg_extension as select 0::integer as oid, ''::varchar as extname, ''::varchar as extversion limit 0;`,
+	`create view if not exists pg_timezone_names as select 'UTC' as name, 'UTC' as abbrev, interval 0 second as utc_offset, false as is_dst;`,
+	`create macro if not exists quote_ident(s) as case when regexp_matches(s, '^[a-z_][a-z0-9_$]*$') then s else '"' || replace(s, '"', '""') || '"' end;`,
+}
+
+// grafanaSchemaConstraintRegexp matches the schema constraint of the table and column queries of grafana, which
+// reads the schemas of search_path with string_to_array as a table function
+var grafanaSchemaConstraintRegexp = regexp.MustCompile(`(?is)\(\s*SELECT\s+CASE\s+WHEN\s+trim\(s\[i\]\)\s*=\s*'"\$user"'.*?string_to_array\(current_setting\('search_path'\)\s*,\s*','\)\s+s\s*\)`)
+
+// grafanaEpochRegexp and grafanaTimeBucketRegexp match the expansions of the $__timeGroup macro of grafana,
+// DuckDB without ICU only extracts and buckets timestamps without time zone
+var grafanaEpochRegexp = regexp.MustCompile(`(?i)\bextract\(\s*epoch\s+from\s+(` + pgIdentPattern + `(?:\.` + pgIdentPattern + `)*)\s*\)`)
+var grafanaTimeBucketRegexp = regexp.MustCompile(`(?i)\btime_bucket\(\s*('[^']*')\s*,\s*(` + pgIdentPattern + `(?:\.` + pgIdentPattern + `)*)\s*\)`)
+
+// grafanaInit creates the objects of grafanaStatements
+func grafanaInit(ctx context.Context, db *sql.DB) error {
+	for _, stmt := range grafanaStatements {
+		if _, err := db.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rewriteGrafanaSchemas replaces the search_path subquery of grafana with the schemas of search_path, the public
+// schema is also the main schema of DuckDB
+func (c *PgConn) rewriteGrafanaSchemas(query string) string {
+	if !c.server.grafanaCompat || !grafanaSchemaConstraintRegexp.MatchString(query) {
+		return query
+	}
+	var schemas []string
+	for _, schema := range searchPathSchemas(c.params["search_path"]) {
+		switch schema {
+		case "$user":
+			schema = c.user
+		case "public":
+			schemas = append(schemas, quoteLiteral("main"))
+		}
+		schemas = append(schemas, quoteLiteral(schema))
+	}
+	return grafanaSchemaConstraintRegexp.ReplaceAllLiteralString(query, "("+strings.Join(schemas, ", ")+")")
+}
+
+// rewriteGrafanaTimeGroup casts the time column of the $__timeGroup expansions to timestamp, a timestamptz is UTC
+// without ICU
+func (c *PgConn) rewriteGrafanaTimeGroup(query string) string {
+	if !c.server.grafanaCompat {
+		return query
+	}
+	query = grafanaEpochRegexp.ReplaceAllString(query, "extract(epoch from $1::timestamp)")
+	return grafanaTimeBucketRegexp.ReplaceAllString(query, "time_bucket($1, $2::timestamp)")
+}
@@ -0,0 +1,687 @@
+package duckserver
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ingestSpoolSegmentBytes is the size of a spool segment after which the next insert starts a new one, segments are
+// removed once applied
+const ingestSpoolSegmentBytes = 64 << 20
+
+// ingestSpoolGroupRecords is the number of records of a table applied in one transaction
+const ingestSpoolGroupRecords = 1000
+
+// ingestSpoolRetries is the number of attempts to apply a record before it is moved to rejected.spool
+const ingestSpoolRetries = 3
+
+// ingestSpoolRejected is the file of the records the writer failed to apply, in the format of the segments
+const ingestSpoolRejected = "rejected.spool"
+
+// maxSpooledInsertBytes bounds the body size of a record header, a larger one is corrupt
+const maxSpooledInsertBytes = 1 << 32
+
+// ingestSpoolIgnoredSettings are the settings of a request not kept with its spooled insert
+var ingestSpoolIgnoredSettings = []string{"query", "query_id", "user", "password", "session_id", "quota_key"}
+
+// ingestSpoolRecord is the header of a spooled insert, one JSON line followed by the body of the request
+type ingestSpoolRecord struct {
+	Schema   string   `json:"schema"`
+	Table    string   `json:"table"`
+	Columns  []string `json:"columns"`
+	Types    []string `json:"types"`
+	Format   string   `json:"format"`
+	Settings string   `json:"settings"`
+	Bytes    int64    `json:"bytes"`
+	CRC      uint32   `json:"crc"`
+}
+
+// spooledInsert is a record read from a segment, start and end are its offsets
+type spooledInsert struct {
+	record ingestSpoolRecord
+	body   []byte
+	start  int64
+	end    int64
+}
+
+// spoolWaiter is an insert of a session waiting for the writer to apply it
+type spoolWaiter struct {
+	segment int64
+	end     int64
+	batch   *asyncInsertBatch
+}
+
+// ingestSpool acknowledges the async inserts not waiting for their flush once they are appended and synced to a
+// local segment file, a background writer applies them to DuckDB in order. The applied offset of a segment is
+// committed with the rows in duckserver.ingest_spool, so the inserts acknowledged before a crash are applied once
+// when the server starts again
+type ingestSpool struct {
+	dir    string
+	server *ChServer
+	mu     sync.Mutex
+	cond   *sync.Cond
+	// segment is the segment appended to, size its size and synced the size synced to disk
+	segment int64
+	file    *os.File
+	size    int64
+	synced  int64
+	syncing bool
+	waiters []spoolWaiter
+	notify  chan struct{}
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// newIngestSpool opens the spool in dir, the records of a segment torn by a crash were never acknowledged and are
+// truncated
+func newIngestSpool(dir string, server *ChServer) (*ingestSpool, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	s := &ingestSpool{
+		dir:     dir,
+		server:  server,
+		notify:  make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	s.cond = sync.NewCond(&s.mu)
+	segments, err := s.segments()
+	if err != nil {
+		return nil, err
+	}
+	for _, segment := range segments {
+		if err = s.recoverSegment(segment); err != nil {
+			return nil, err
+		}
+	}
+	s.segment = 1
+	if len(segments) > 0 {
+		s.segment = segments[len(segments)-1]
+	}
+	if err = s.openSegment(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *ingestSpool) segmentPath(segment int64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d.spool", segment))
+}
+
+// segments returns the segments of the spool in order
+func (s *ingestSpool) segments() ([]int64, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var segments []int64
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".spool")
+		if !ok {
+			continue
+		}
+		if segment, err := strconv.ParseInt(name, 10, 64); err == nil {
+			segments = append(segments, segment)
+		}
+	}
+	slices.Sort(segments)
+	return segments, nil
+}
+
+// recoverSegment truncates a segment after its last complete record
+func (s *ingestSpool) recoverSegment(segment int64) error {
+	f, err := os.OpenFile(s.segmentPath(segment), os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	rd := bufio.NewReader(f)
+	var offset int64
+	for {
+		insert, err := readSpooledInsert(rd, offset)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			logrus.Warnf("ingest spool segment %d is torn at offset %d, truncating: %v", segment, offset, err)
+			if err = f.Truncate(offset); err != nil {
+				return err
+			}
+			return f.Sync()
+		}
+		offset = insert.end
+	}
+}
+
+// openSegment opens the segment appended to, mu is held or the spool is being opened
+func (s *ingestSpool) openSegment() error {
+	f, err := os.OpenFile(s.segmentPath(s.segment), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	s.file, s.size, s.synced = f, info.Size(), info.Size()
+	return nil
+}
+
+// readSpooledInsert reads the record at offset, io.EOF at the end of the segment
+func readSpooledInsert(rd *bufio.Reader, offset int64) (*spooledInsert, error) {
+	header, err := rd.ReadBytes('\n')
+	if err == io.EOF && len(header) == 0 {
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, fmt.Errorf("incomplete record header: %w", err)
+	}
+	insert := &spooledInsert{}
+	if err = json.Unmarshal(header, &insert.record); err != nil {
+		return nil, fmt.Errorf("invalid record header: %w", err)
+	}
+	if insert.record.Bytes < 0 || insert.record.Bytes > maxSpooledInsertBytes {
+		return nil, fmt.Errorf("invalid record size %d", insert.record.Bytes)
+	}
+	insert.body = make([]byte, insert.record.Bytes+1)
+	if _, err = io.ReadFull(rd, insert.body); err != nil {
+		return nil, fmt.Errorf("incomplete record: %w", err)
+	}
+	insert.body = insert.body[:insert.record.Bytes]
+	if crc32.ChecksumIEEE(insert.body) != insert.record.CRC {
+		return nil, errors.New("record checksum mismatch")
+	}
+	insert.start, insert.end = offset, offset+int64(len(header))+insert.record.Bytes+1
+	return insert, nil
+}
+
+// encodeSpooledInsert returns a record with its body as it is written to a segment
+func encodeSpooledInsert(record ingestSpoolRecord, body []byte) ([]byte, error) {
+	record.Bytes, record.CRC = int64(len(body)), crc32.ChecksumIEEE(body)
+	header, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, 0, len(header)+len(body)+2)
+	data = append(append(append(data, header...), '\n'), body...)
+	return append(data, '\n'), nil
+}
+
+// Append writes an insert to the spool and returns once it is synced to disk, the batch is done when the writer
+// applied it, it is only returned when wait is set
+func (s *ingestSpool) Append(record ingestSpoolRecord, body []byte, wait bool) (*asyncInsertBatch, error) {
+	data, err := encodeSpooledInsert(record, body)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil, errors.New("ingest spool is closed")
+	}
+	if s.size >= ingestSpoolSegmentBytes {
+		if err = s.rotate(); err != nil {
+			return nil, err
+		}
+	}
+	if _, err = s.file.Write(data); err != nil {
+		// a partial record would tear the segment for the records after it
+		_ = s.file.Truncate(s.size)
+		return nil, err
+	}
+	s.size += int64(len(data))
+	segment, end := s.segment, s.size
+	// the inserts appended while a sync runs are synced together by the next one
+	for s.segment == segment && s.synced < end {
+		if s.syncing {
+			s.cond.Wait()
+			continue
+		}
+		s.syncing = true
+		f, size := s.file, s.size
+		s.mu.Unlock()
+		err = f.Sync()
+		s.mu.Lock()
+		s.syncing = false
+		s.cond.Broadcast()
+		if err != nil {
+			return nil, err
+		}
+		if s.segment == segment {
+			s.synced = max(s.synced, size)
+		}
+	}
+	var batch *asyncInsertBatch
+	if wait {
+		batch = &asyncInsertBatch{done: make(chan struct{})}
+		s.waiters = append(s.waiters, spoolWaiter{segment: segment, end: end, batch: batch})
+	}
+	metrics.Add("duckserver_ingest_spool_records_total", 1)
+	metrics.Add("duckserver_ingest_spool_bytes_total", float64(len(data)))
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+	return batch, nil
+}
+
+// rotate starts a new segment once the segment appended to is synced, mu is held
+func (s *ingestSpool) rotate() error {
+	for s.syncing {
+		s.cond.Wait()
+	}
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	s.segment++
+	return s.openSegment()
+}
+
+// readable returns the size of a segment the writer may read, the synced size of the segment appended to
+func (s *ingestSpool) readable(segment int64) (int64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if segment == s.segment {
+		return s.synced, true
+	}
+	return -1, false
+}
+
+// applied signals the waiting inserts applied up to offset of segment, err is the error of the insert ending at
+// offset, the inserts before it were applied
+func (s *ingestSpool) applied(segment, offset int64, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.waiters = slices.DeleteFunc(s.waiters, func(w spoolWaiter) bool {
+		if w.segment > segment || w.segment == segment && w.end > offset {
+			return false
+		}
+		if w.segment == segment && w.end == offset {
+			w.batch.err = err
+		}
+		close(w.batch.done)
+		return true
+	})
+}
+
+// Run applies the spooled inserts until the spool is closed
+func (s *ingestSpool) Run() {
+	defer close(s.stopped)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		if err := s.applySegments(); err != nil {
+			logrus.Errorf("ingest spool error: %v", err)
+		}
+		select {
+		case <-s.done:
+			return
+		case <-s.notify:
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *ingestSpool) stopping() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// applySegments applies the segments in order, the segments applied to their end are removed except the one
+// appended to
+func (s *ingestSpool) applySegments() error {
+	segments, err := s.segments()
+	if err != nil {
+		return err
+	}
+	for _, segment := range segments {
+		limit, appending := s.readable(segment)
+		offset, err := s.appliedOffset(segment)
+		if err != nil {
+			return err
+		}
+		if offset, err = s.applySegment(segment, offset, limit); err != nil || s.stopping() {
+			return err
+		}
+		if appending {
+			return nil
+		}
+		// a segment is only left by rotate once synced, it was applied to its end
+		if err = os.Remove(s.segmentPath(segment)); err != nil {
+			return err
+		}
+		if _, err = s.server.conn.Exec("delete from duckserver.ingest_spool where segment = ?", segment); err != nil {
+			return err
+		}
+		logrus.Debugf("ingest spool segment %d applied, %d bytes", segment, offset)
+	}
+	return nil
+}
+
+func (s *ingestSpool) appliedOffset(segment int64) (int64, error) {
+	var offset int64
+	err := s.server.conn.QueryRow("select applied_bytes from duckserver.ingest_spool where segment = ?", segment).Scan(&offset)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return offset, err
+}
+
+// applySegment applies the records of a segment from offset up to limit, or its end when limit is negative, and
+// returns the offset applied up to. The consecutive records of a table are applied in one transaction
+func (s *ingestSpool) applySegment(segment, offset, limit int64) (int64, error) {
+	if limit >= 0 && offset >= limit {
+		return offset, nil
+	}
+	f, err := os.Open(s.segmentPath(segment))
+	if err != nil {
+		return offset, err
+	}
+	defer f.Close()
+	var rd io.Reader = io.NewSectionReader(f, offset, 1<<62)
+	if limit >= 0 {
+		rd = io.NewSectionReader(f, offset, limit-offset)
+	}
+	brd := bufio.NewReader(rd)
+	read := offset
+	var group []*spooledInsert
+	for {
+		insert, err := readSpooledInsert(brd, read)
+		if insert != nil && len(group) > 0 && (len(group) >= ingestSpoolGroupRecords ||
+			insert.record.Schema != group[0].record.Schema || insert.record.Table != group[0].record.Table) {
+			offset = s.applyGroup(segment, group)
+			group = nil
+			if s.stopping() {
+				return offset, nil
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return offset, fmt.Errorf("read segment %d at offset %d: %w", segment, read, err)
+		}
+		read = insert.end
+		group = append(group, insert)
+	}
+	if len(group) > 0 {
+		offset = s.applyGroup(segment, group)
+	}
+	return offset, nil
+}
+
+// applyGroup applies records of a table and returns the offset after them. A group failing ingestSpoolRetries times
+// is applied record by record, and a record failing alone is moved to rejected.spool so it doesn't hold up the others
+func (s *ingestSpool) applyGroup(segment int64, group []*spooledInsert) int64 {
+	end := group[len(group)-1].end
+	err := s.apply(segment, group)
+	for attempt := 1; attempt < ingestSpoolRetries && err != nil; attempt++ {
+		logrus.Warnf("apply ingest spool inserts into %s.%s error, retrying: %v", group[0].record.Schema, group[0].record.Table, err)
+		select {
+		case <-s.done:
+			return group[0].start
+		case <-time.After(time.Duration(attempt) * time.Second):
+		}
+		err = s.apply(segment, group)
+	}
+	if err == nil {
+		s.applied(segment, end, nil)
+		return end
+	}
+	if len(group) == 1 {
+		s.reject(segment, group[0], err)
+		return end
+	}
+	for _, insert := range group {
+		if err = s.apply(segment, []*spooledInsert{insert}); err != nil {
+			s.reject(segment, insert, err)
+		} else {
+			s.applied(segment, insert.end, nil)
+		}
+	}
+	return end
+}
+
+// apply appends the rows of records of a table and commits the offset after them in the same transaction
+func (s *ingestSpool) apply(segment int64, group []*spooledInsert) (err error) {
+	ctx := context.Background()
+	schema, table := group[0].record.Schema, group[0].record.Table
+	pooled, err := s.server.pgServer.appenders.Get(schema, table)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		s.server.pgServer.appenders.Put(pooled, err == nil)
+	}()
+	triggers, err := queryInsertTriggers(ctx, pooled.conn, schema, table)
+	if err != nil {
+		return err
+	}
+	// the records of a group share the lookups of the table unless they insert other columns
+	var columns []string
+	var validator *rowValidator
+	var defaults *columnDefaults
+	var order []int
+	fill := func(appender rowAppender) error {
+		for _, insert := range group {
+			if validator == nil || !slices.Equal(columns, insert.record.Columns) {
+				columns = insert.record.Columns
+				if validator, err = newRowValidator(ctx, pooled.conn, schema, table, columns); err != nil {
+					return err
+				}
+				if defaults, err = s.server.lookupColumnDefaults(ctx, schema, table, columns, insert.record.Types); err != nil {
+					return err
+				}
+				if order, err = tableColumnOrder(ctx, pooled.conn, schema, table, columns); err != nil {
+					return err
+				}
+			}
+			rows, err := s.readRows(ctx, insert, validator, defaults)
+			if err != nil {
+				return err
+			}
+			// the appender takes the values in the order of the table
+			for i, row := range rows {
+				if order == nil {
+					break
+				}
+				rows[i] = make([]driver.Value, len(order))
+				for j, k := range order {
+					rows[i][j] = row[k]
+				}
+			}
+			if err = appendRows(appender, rows); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	execer := pooled.conn.(driver.ExecerContext)
+	return inTransaction(ctx, execer, false, func() error {
+		if len(triggers) > 0 {
+			if err := appendWithTriggers(ctx, pooled.conn, true, schema, table, triggers, fill); err != nil {
+				return err
+			}
+		} else {
+			appender, err := pooled.Appender(ctx, schema, table)
+			if err != nil {
+				return err
+			}
+			if err = fill(appender); err != nil {
+				_ = appender.Close()
+				return err
+			}
+			if err = appender.Close(); err != nil {
+				return err
+			}
+		}
+		return s.commitOffset(ctx, execer, segment, group[len(group)-1].end)
+	})
+}
+
+// tableColumnOrder returns the position in columns of each column of the table, or nil when columns are the columns
+// of the table in order. The records of a column list in another order are replayed in the order of the table
+func tableColumnOrder(ctx context.Context, conn driver.Conn, schema, table string, columns []string) ([]int, error) {
+	rows, err := conn.(driver.QueryerContext).QueryContext(ctx, "select column_name from duckdb_columns() where schema_name = $1 and table_name = $2 order by column_index",
+		[]driver.NamedValue{{Ordinal: 1, Value: schema}, {Ordinal: 2, Value: table}})
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var order []int
+	reordered := false
+	values := make([]driver.Value, 1)
+	for {
+		if err = rows.Next(values); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		name, _ := values[0].(string)
+		i := slices.Index(columns, name)
+		if i < 0 {
+			return nil, fmt.Errorf("column %s of table %s.%s is missing from the insert", name, schema, table)
+		}
+		reordered = reordered || i != len(order)
+		order = append(order, i)
+	}
+	if len(order) != len(columns) {
+		return nil, fmt.Errorf("the insert has %d columns, table %s.%s has %d", len(columns), schema, table, len(order))
+	}
+	if !reordered {
+		return nil, nil
+	}
+	return order, nil
+}
+
+func (s *ingestSpool) commitOffset(ctx context.Context, execer driver.ExecerContext, segment, offset int64) error {
+	_, err := execer.ExecContext(ctx, "insert or replace into duckserver.ingest_spool values ($1, $2)", []driver.NamedValue{
+		{Ordinal: 1, Value: segment},
+		{Ordinal: 2, Value: offset},
+	})
+	return err
+}
+
+// readRows reads the rows of a spooled insert like they were read when it was acknowledged
+func (s *ingestSpool) readRows(ctx context.Context, insert *spooledInsert, validator *rowValidator, defaults *columnDefaults) ([][]driver.Value, error) {
+	record := insert.record
+	settings, err := url.ParseQuery(record.Settings)
+	if err != nil {
+		return nil, err
+	}
+	formater := s.server.inputFormat(record.Format, settings)
+	if formater == nil {
+		return nil, fmt.Errorf("unknown format %s", record.Format)
+	}
+	reader, err := formater(record.Columns, record.Types, bytes.NewReader(insert.body))
+	if err != nil {
+		return nil, err
+	}
+	allowErrors, err := parseAllowErrors(settings)
+	if err != nil {
+		return nil, err
+	}
+	validator.row = 0
+	validator.AllowErrors(allowErrors)
+	return readValidatedRows(ctx, reader, defaults.Set(reader, settings), validator, len(record.Columns), newChProgress())
+}
+
+// reject moves a record the writer failed to apply to rejected.spool and commits the offset after it
+func (s *ingestSpool) reject(segment int64, insert *spooledInsert, cause error) {
+	logrus.Errorf("ingest spool insert into %s.%s rejected: %v", insert.record.Schema, insert.record.Table, cause)
+	metrics.Add("duckserver_ingest_spool_rejected_total", 1)
+	data, err := encodeSpooledInsert(insert.record, insert.body)
+	if err == nil {
+		var f *os.File
+		if f, err = os.OpenFile(filepath.Join(s.dir, ingestSpoolRejected), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644); err == nil {
+			if _, err = f.Write(data); err == nil {
+				err = f.Sync()
+			}
+			_ = f.Close()
+		}
+	}
+	if err != nil {
+		logrus.Errorf("write rejected ingest spool insert error: %v", err)
+	}
+	if _, err = s.server.conn.Exec("insert or replace into duckserver.ingest_spool values (?, ?)", segment, insert.end); err != nil {
+		logrus.Errorf("commit ingest spool offset error: %v", err)
+	}
+	s.applied(segment, insert.end, cause)
+}
+
+// Close stops the writer and closes the segment appended to, the inserts not applied yet are applied on the next start
+func (s *ingestSpool) Close() {
+	if s == nil {
+		return
+	}
+	close(s.done)
+	<-s.stopped
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.syncing {
+		s.cond.Wait()
+	}
+	if s.file != nil {
+		_ = s.file.Sync()
+		_ = s.file.Close()
+		s.file = nil
+	}
+}
+
+// spoolInsert acknowledges an async insert not waiting for its flush once it is in the ingest spool, the rows are
+// read and checked first so a bad insert is rejected to the client
+func (c *ChServer) spoolInsert(ctx context.Context, schema, table, format string, columnNames, columnTypes []string, formater ClickhouseFormatReaderFactory,
+	validator *rowValidator, settings url.Values, rd *bufio.Reader, wr http.ResponseWriter, progress *chProgress) {
+	var body bytes.Buffer
+	if _, status, err := c.readInsertRows(ctx, schema, table, columnNames, columnTypes, formater, validator, settings, io.TeeReader(rd, &body), progress); err != nil {
+		wr.WriteHeader(status)
+		_, _ = fmt.Fprintf(wr, "%s", err)
+		return
+	}
+	kept := make(url.Values, len(settings))
+	for name, values := range settings {
+		if !slices.Contains(ingestSpoolIgnoredSettings, name) {
+			kept[name] = values
+		}
+	}
+	record := ingestSpoolRecord{Schema: schema, Table: table, Columns: columnNames, Types: columnTypes, Format: format, Settings: kept.Encode()}
+	session := chSessionFromContext(ctx)
+	batch, err := c.spool.Append(record, body.Bytes(), session != nil)
+	if err != nil {
+		wr.WriteHeader(500)
+		_, _ = fmt.Fprintf(wr, "Error spooling insert: %s", err)
+		return
+	}
+	if session != nil {
+		session.addPending(batch)
+	}
+	progress.SetSummary(wr)
+	validator.WriteReport(wr)
+}
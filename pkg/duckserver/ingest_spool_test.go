@@ -0,0 +1,43 @@
+package duckserver
+
+import (
+	"context"
+	"database/sql/driver"
+	"github.com/marcboeker/go-duckdb"
+	"slices"
+	"testing"
+)
+
+func TestTableColumnOrder(t *testing.T) {
+	connector, err := duckdb.NewConnector("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	conn, err := connector.Connect(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	if _, err = conn.(driver.ExecerContext).ExecContext(ctx, "create table t (a int, b varchar, c double)", nil); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		columns []string
+		order   []int
+		err     bool
+	}{
+		{[]string{"a", "b", "c"}, nil, false},
+		{[]string{"b", "a", "c"}, []int{1, 0, 2}, false},
+		{[]string{"c", "b", "a"}, []int{2, 1, 0}, false},
+		{[]string{"a", "b"}, nil, true},
+		{[]string{"a", "b", "c", "d"}, nil, true},
+		{[]string{"a", "b", "x"}, nil, true},
+	}
+	for _, test := range tests {
+		order, err := tableColumnOrder(ctx, conn, "main", "t", test.columns)
+		if (err != nil) != test.err || !slices.Equal(order, test.order) {
+			t.Errorf("tableColumnOrder(%v) = %v, %v, want %v, error %v", test.columns, order, err, test.order, test.err)
+		}
+	}
+}
@@ -0,0 +1,422 @@
+//go:build integration
+
+// The integration tests start the server in process and run real clients against it: the psql scripts of
+// scripts/integration/psql through the pgx connection, the curl cases of scripts/integration/clickhouse with net/http,
+// the wire protocol traces of scripts/integration/wire and the extended protocol of pgx. The SQLAlchemy and psycopg2
+// scripts of scripts/integration/python and the pgjdbc programs of scripts/integration/jdbc run when python3 with the
+// modules, and java with the jar of PGJDBC_JAR, are installed. clickhouse-go isn't run, it needs the Native format.
+//
+//	go test -tags integration -run Integration ./pkg/duckserver
+package duckserver_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"duckserver/pkg/duckserver"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+const integrationDir = "../../scripts/integration"
+
+var (
+	integrationOnce   sync.Once
+	integrationErr    error
+	integrationPgAddr string
+	integrationChAddr string
+)
+
+// freeAddr returns a local address with a free port
+func freeAddr() (string, error) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer lis.Close()
+	return lis.Addr().String(), nil
+}
+
+// startIntegrationServer starts the server shared by the integration tests on a temporary database, like
+// scripts/integration/run.sh without authentication and with the grafana catalog
+func startIntegrationServer(t *testing.T) (string, string) {
+	t.Helper()
+	integrationOnce.Do(func() {
+		dir, err := os.MkdirTemp("", "duckserver-integration-")
+		if err != nil {
+			integrationErr = err
+			return
+		}
+		if integrationPgAddr, err = freeAddr(); err != nil {
+			integrationErr = err
+			return
+		}
+		if integrationChAddr, err = freeAddr(); err != nil {
+			integrationErr = err
+			return
+		}
+		server := duckserver.NewServer(duckserver.Options{
+			DbPath:    filepath.Join(dir, "test.db"),
+			Listeners: []duckserver.ListenerOptions{{Addr: integrationPgAddr}},
+			ClickhouseOptions: duckserver.ClickhouseOptions{
+				Enabled:   true,
+				Listeners: []duckserver.ListenerOptions{{Addr: integrationChAddr}},
+			},
+			UseHack:       true,
+			GrafanaCompat: true,
+			ScratchDir:    dir,
+		})
+		integrationErr = server.Start()
+	})
+	if integrationErr != nil {
+		t.Fatalf("start server: %v", integrationErr)
+	}
+	return integrationPgAddr, integrationChAddr
+}
+
+func connectPgx(t *testing.T, addr, database string) *pgx.Conn {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := pgx.Connect(ctx, fmt.Sprintf("postgres://duckserver@%s/%s?sslmode=disable", addr, database))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close(context.Background()) })
+	return conn
+}
+
+var copyFromStdinRegexp = regexp.MustCompile(`(?is)^\s*COPY\s.*\sFROM\s+STDIN\b`)
+
+// runPsqlScript runs the statements of a psql script one by one like psql -X -q -A -t -v ON_ERROR_STOP=1: the rows
+// of the results are printed with their fields separated by |, the rows of COPY FROM STDIN follow it up to \. and
+// \c database connects to another database
+func runPsqlScript(ctx context.Context, connect func(database string) *pgconn.PgConn, script []byte) (string, error) {
+	var out bytes.Buffer
+	var stmt strings.Builder
+	conn := connect("main")
+	scanner := bufio.NewScanner(bytes.NewReader(script))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if database, ok := strings.CutPrefix(line, `\c `); ok && stmt.Len() == 0 {
+			conn = connect(strings.TrimSpace(database))
+			continue
+		}
+		stmt.WriteString(line + "\n")
+		if !strings.HasSuffix(strings.TrimSpace(line), ";") {
+			continue
+		}
+		query := stmt.String()
+		stmt.Reset()
+		if copyFromStdinRegexp.MatchString(query) {
+			var data strings.Builder
+			for scanner.Scan() && scanner.Text() != `\.` {
+				data.WriteString(scanner.Text() + "\n")
+			}
+			if _, err := conn.CopyFrom(ctx, strings.NewReader(data.String()), query); err != nil {
+				return out.String(), err
+			}
+			continue
+		}
+		results, err := conn.Exec(ctx, query).ReadAll()
+		if err != nil {
+			return out.String(), err
+		}
+		for _, result := range results {
+			if result.Err != nil {
+				return out.String(), result.Err
+			}
+			for _, row := range result.Rows {
+				fields := make([]string, len(row))
+				for i, field := range row {
+					fields[i] = string(field)
+				}
+				out.WriteString(strings.Join(fields, "|") + "\n")
+			}
+		}
+	}
+	return out.String(), scanner.Err()
+}
+
+func TestIntegrationPsqlScripts(t *testing.T) {
+	pgAddr, _ := startIntegrationServer(t)
+	scripts, err := filepath.Glob(filepath.Join(integrationDir, "psql", "*.sql"))
+	if err != nil || len(scripts) == 0 {
+		t.Fatalf("no psql scripts: %v", err)
+	}
+	for _, script := range scripts {
+		name := strings.TrimSuffix(filepath.Base(script), ".sql")
+		t.Run(name, func(t *testing.T) {
+			sql, err := os.ReadFile(script)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected, err := os.ReadFile(strings.TrimSuffix(script, ".sql") + ".out")
+			if err != nil {
+				t.Fatal(err)
+			}
+			connect := func(database string) *pgconn.PgConn { return connectPgx(t, pgAddr, database).PgConn() }
+			actual, err := runPsqlScript(context.Background(), connect, sql)
+			if err != nil {
+				t.Fatalf("%v, output so far:\n%s", err, actual)
+			}
+			if actual != string(expected) {
+				t.Errorf("output differs, expected:\n%s\nactual:\n%s", expected, actual)
+			}
+		})
+	}
+}
+
+// TestIntegrationClickhouseCases runs the cases of scripts/integration/clickhouse: the first line is the request
+// "METHOD query-string", the body follows a line "--- body" and the expected response follows a line "--- expect"
+func TestIntegrationClickhouseCases(t *testing.T) {
+	_, chAddr := startIntegrationServer(t)
+	cases, err := filepath.Glob(filepath.Join(integrationDir, "clickhouse", "*.case"))
+	if err != nil || len(cases) == 0 {
+		t.Fatalf("no clickhouse cases: %v", err)
+	}
+	for _, file := range cases {
+		name := strings.TrimSuffix(filepath.Base(file), ".case")
+		content, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ok := t.Run(name, func(t *testing.T) {
+			request, rest, _ := strings.Cut(string(content), "\n")
+			method, query, _ := strings.Cut(request, " ")
+			_, rest, _ = strings.Cut(rest, "--- body\n")
+			body, expected, found := strings.Cut(rest, "--- expect\n")
+			if !found {
+				body, expected, _ = strings.Cut(rest, "--- expect")
+			}
+			req, err := http.NewRequest(method, "http://"+chAddr+"/?"+query, strings.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			actual, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(actual) != expected {
+				t.Errorf("response differs, expected:\n%q\nactual:\n%q", expected, actual)
+			}
+		})
+		// the cases of a prefix build on each other
+		if !ok {
+			break
+		}
+	}
+}
+
+// TestIntegrationWireTraces replays the client messages of scripts/integration/wire and compares the responses byte
+// for byte
+func TestIntegrationWireTraces(t *testing.T) {
+	pgAddr, _ := startIntegrationServer(t)
+	traces, err := filepath.Glob(filepath.Join(integrationDir, "wire", "*.trace"))
+	if err != nil || len(traces) == 0 {
+		t.Fatalf("no wire traces: %v", err)
+	}
+	args := append([]string{"run", filepath.Join(integrationDir, "wire", "replay.go"), "-addr", pgAddr}, traces...)
+	if out, err := exec.Command("go", args...).CombinedOutput(); err != nil {
+		t.Fatalf("%v:\n%s", err, out)
+	}
+}
+
+// TestIntegrationPgx runs the extended protocol of pgx: typed and binary parameters and results, a pipelined batch,
+// COPY FROM STDIN, an error in a transaction and the savepoints
+func TestIntegrationPgx(t *testing.T) {
+	pgAddr, _ := startIntegrationServer(t)
+	ctx := context.Background()
+	conn := connectPgx(t, pgAddr, "main")
+	if _, err := conn.Exec(ctx, "create or replace table it_pgx (id int primary key, name varchar, score double, ts timestamp, tags varchar[])"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _, _ = conn.Exec(context.Background(), "drop table if exists it_pgx") })
+
+	// the timestamp is a literal and read in text format, the binary timestamps aren't supported
+	ts := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	if _, err := conn.Exec(ctx, "insert into it_pgx values ($1, $2, $3, timestamp '2024-01-02 03:04:05', $4)", 1, "a", 1.5, []string{"x", "y"}); err != nil {
+		t.Fatal(err)
+	}
+	var (
+		name  string
+		score float64
+		got   time.Time
+		tags  string
+	)
+	if err := conn.QueryRow(ctx, "select name, score, ts, tags from it_pgx where id = $1",
+		pgx.QueryResultFormats{pgx.TextFormatCode}, 1).Scan(&name, &score, &got, &tags); err != nil {
+		t.Fatal(err)
+	}
+	if name != "a" || score != 1.5 || !got.Equal(ts) || tags != "{x,y}" {
+		t.Errorf("row = %s, %v, %v, %v", name, score, got, tags)
+	}
+
+	// the arrays are inlined in the query, the placeholders in its strings are kept
+	t.Run("array parameter", func(t *testing.T) {
+		var text string
+		var count int64
+		if err := conn.QueryRow(ctx, "select '$1 -- $2', count(*) from it_pgx where name = any($1::varchar[]) and name <> $2",
+			[]string{"a", "b"}, "$1").Scan(&text, &count); err != nil {
+			t.Fatal(err)
+		}
+		if text != "$1 -- $2" || count != 1 {
+			t.Errorf("row = %s, %d, want $1 -- $2, 1", text, count)
+		}
+	})
+
+	t.Run("batch", func(t *testing.T) {
+		batch := &pgx.Batch{}
+		for i := 2; i <= 4; i++ {
+			batch.Queue("insert into it_pgx (id, name) values ($1, $2)", i, fmt.Sprintf("n%d", i))
+		}
+		batch.Queue("select count(*) from it_pgx")
+		results := conn.SendBatch(ctx, batch)
+		for i := 0; i < 3; i++ {
+			if _, err := results.Exec(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var count int64
+		if err := results.QueryRow().Scan(&count); err != nil {
+			t.Fatal(err)
+		}
+		if err := results.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if count != 4 {
+			t.Errorf("count = %d, want 4", count)
+		}
+	})
+
+	// COPY FROM STDIN takes csv rows of all the columns, not the binary rows of pgx.CopyFrom
+	t.Run("copy", func(t *testing.T) {
+		if _, err := conn.Exec(ctx, "create or replace table it_pgx_copy (id int, name varchar)"); err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Exec(ctx, "drop table it_pgx_copy")
+		tag, err := conn.PgConn().CopyFrom(ctx, strings.NewReader("10,c10\n11,c11\n"), "copy it_pgx_copy from stdin with csv")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tag.RowsAffected() != 2 {
+			t.Errorf("copied %d rows, want 2", tag.RowsAffected())
+		}
+	})
+
+	t.Run("error in transaction", func(t *testing.T) {
+		tx, err := conn.Begin(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tx.Rollback(ctx)
+		if _, err = tx.Exec(ctx, "insert into it_pgx (id, name) values (1, 'duplicate')"); err == nil {
+			t.Fatal("duplicate key inserted")
+		}
+		var pgErr *pgconn.PgError
+		if !errors.As(err, &pgErr) {
+			t.Fatalf("error %v isn't a postgresql error", err)
+		}
+		if _, err = tx.Exec(ctx, "select 1"); err == nil {
+			t.Error("statement ran in a failed transaction")
+		}
+	})
+
+	t.Run("savepoints", func(t *testing.T) {
+		tx, err := conn.Begin(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tx.Rollback(ctx)
+		if _, err = tx.Exec(ctx, "insert into it_pgx (id, name) values (20, 'kept')"); err != nil {
+			t.Fatal(err)
+		}
+		nested, err := tx.Begin(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = nested.Exec(ctx, "insert into it_pgx (id, name) values (21, 'rolled back')"); err != nil {
+			t.Fatal(err)
+		}
+		if err = nested.Rollback(ctx); err != nil {
+			t.Fatal(err)
+		}
+		var ids []int32
+		rows, err := tx.Query(ctx, "select id from it_pgx where id >= 20 order by id")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ids, err = pgx.CollectRows(rows, pgx.RowTo[int32]); err != nil {
+			t.Fatal(err)
+		}
+		if len(ids) != 1 || ids[0] != 20 {
+			t.Errorf("ids after rollback to savepoint = %v, want [20]", ids)
+		}
+
+		// an update before the savepoint can't be run again with the same result
+		if _, err = tx.Exec(ctx, "update it_pgx set score = 2 where id = 20"); err != nil {
+			t.Fatal(err)
+		}
+		if nested, err = tx.Begin(ctx); err != nil {
+			t.Fatal(err)
+		}
+		err = nested.Rollback(ctx)
+		var pgErr *pgconn.PgError
+		if !errors.As(err, &pgErr) || pgErr.Code != "0A000" {
+			t.Errorf("rollback to savepoint after an update = %v, want SQLSTATE 0A000", err)
+		}
+	})
+}
+
+// runClientScripts runs the scripts matching pattern with the command of args followed by the script and the
+// postgresql port, a script passes when it exits 0
+func runClientScripts(t *testing.T, pattern string, args ...string) {
+	pgAddr, _ := startIntegrationServer(t)
+	_, port, _ := net.SplitHostPort(pgAddr)
+	scripts, err := filepath.Glob(filepath.Join(integrationDir, pattern))
+	if err != nil || len(scripts) == 0 {
+		t.Fatalf("no scripts %s: %v", pattern, err)
+	}
+	for _, script := range scripts {
+		t.Run(filepath.Base(script), func(t *testing.T) {
+			cmd := exec.Command(args[0], append(args[1:], script, port)...)
+			if out, err := cmd.CombinedOutput(); err != nil {
+				t.Fatalf("%v:\n%s", err, out)
+			}
+		})
+	}
+}
+
+func TestIntegrationPython(t *testing.T) {
+	if err := exec.Command("python3", "-c", "import sqlalchemy, psycopg2").Run(); err != nil {
+		t.Skip("python3 with sqlalchemy and psycopg2 isn't installed")
+	}
+	runClientScripts(t, "python/*.py", "python3")
+}
+
+func TestIntegrationJDBC(t *testing.T) {
+	jar := os.Getenv("PGJDBC_JAR")
+	if _, err := exec.LookPath("java"); err != nil || jar == "" {
+		t.Skip("java or the pgjdbc jar of PGJDBC_JAR isn't installed")
+	}
+	runClientScripts(t, "jdbc/*.java", "java", "-cp", jar)
+}
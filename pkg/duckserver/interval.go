@@ -0,0 +1,64 @@
+package duckserver
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/marcboeker/go-duckdb"
+	"strings"
+)
+
+const microsPerSecond = 1_000_000
+
+// formatInterval formats an interval in the postgres IntervalStyle, e.g. 1 year 2 mons 3 days 04:05:06.5
+func formatInterval(v duckdb.Interval) string {
+	var parts []string
+	negative := false
+	addPart := func(n int64, unit string) {
+		if n == 0 {
+			return
+		}
+		if n != 1 {
+			unit += "s"
+		}
+		parts = append(parts, fmt.Sprintf("%d %s", n, unit))
+		negative = negative || n < 0
+	}
+	addPart(int64(v.Months/12), "year")
+	addPart(int64(v.Months%12), "mon")
+	addPart(int64(v.Days), "day")
+	if v.Micros == 0 && len(parts) > 0 {
+		return strings.Join(parts, " ")
+	}
+	micros := v.Micros
+	sign := ""
+	if micros < 0 {
+		sign, micros = "-", -micros
+	} else if negative {
+		sign = "+"
+	}
+	seconds := micros / microsPerSecond
+	clock := fmt.Sprintf("%s%02d:%02d:%02d", sign, seconds/3600, seconds/60%60, seconds%60)
+	if frac := micros % microsPerSecond; frac != 0 {
+		clock += strings.TrimRight(fmt.Sprintf(".%06d", frac), "0")
+	}
+	return strings.Join(append(parts, clock), " ")
+}
+
+// intervalBinary encodes an interval in the postgresql binary format, microseconds, days and months
+func intervalBinary(v duckdb.Interval) []byte {
+	b := binary.BigEndian.AppendUint64(nil, uint64(v.Micros))
+	b = binary.BigEndian.AppendUint32(b, uint32(v.Days))
+	return binary.BigEndian.AppendUint32(b, uint32(v.Months))
+}
+
+// decodeIntervalBinary decodes an interval parameter sent in the postgresql binary format
+func decodeIntervalBinary(b []byte) (duckdb.Interval, error) {
+	if len(b) != 16 {
+		return duckdb.Interval{}, fmt.Errorf("invalid binary interval with %d bytes", len(b))
+	}
+	return duckdb.Interval{
+		Micros: int64(binary.BigEndian.Uint64(b)),
+		Days:   int32(binary.BigEndian.Uint32(b[8:])),
+		Months: int32(binary.BigEndian.Uint32(b[12:])),
+	}, nil
+}
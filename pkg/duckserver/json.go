@@ -0,0 +1,57 @@
+package duckserver
+
+import (
+	"regexp"
+	"strings"
+)
+
+// typeAliasOids are the postgresql types of DuckDB type aliases reported instead of the physical type
+var typeAliasOids = map[string]int32{
+	"JSON": 114,
+}
+
+// jsonPathOperatorRegexp matches the postgresql path operators #> and #>> with a literal text array path
+var jsonPathOperatorRegexp = regexp.MustCompile(`#>(>?)\s*'\{([^}']*)\}'`)
+
+// jsonbCastRegexp matches casts to jsonb, DuckDB only has json
+var jsonbCastRegexp = regexp.MustCompile(`(?i)(::\s*|\bAS\s+)jsonb\b`)
+
+// rewriteJsonOperators rewrites the postgresql json operators used by ORMs to their DuckDB form,
+// -> and ->> are the same in DuckDB, x #>> '{a,0}' becomes x ->> '$."a"[0]'
+func rewriteJsonOperators(query string) string {
+	if !strings.Contains(query, "#>") && !strings.Contains(strings.ToLower(query), "jsonb") {
+		return query
+	}
+	query = jsonPathOperatorRegexp.ReplaceAllStringFunc(query, func(s string) string {
+		m := jsonPathOperatorRegexp.FindStringSubmatch(s)
+		return "->" + m[1] + " '" + pgPathToJsonPath(m[2]) + "'"
+	})
+	return jsonbCastRegexp.ReplaceAllString(query, "${1}json")
+}
+
+// pgPathToJsonPath converts the elements of a postgresql path to a JSONPath, numbers index arrays
+func pgPathToJsonPath(path string) string {
+	var b strings.Builder
+	b.WriteString("$")
+	for _, elem := range strings.Split(path, ",") {
+		elem = strings.Trim(strings.TrimSpace(elem), `"`)
+		if elem == "" {
+			continue
+		}
+		if isArrayIndex(elem) {
+			b.WriteString("[" + elem + "]")
+		} else {
+			b.WriteString(`."` + strings.ReplaceAll(elem, `"`, `\"`) + `"`)
+		}
+	}
+	return b.String()
+}
+
+func isArrayIndex(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
@@ -0,0 +1,329 @@
+package duckserver
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/goccy/go-json"
+	"github.com/sirupsen/logrus"
+	"math/big"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	jwksRefreshInterval    = time.Hour
+	jwksMinRefreshInterval = time.Minute
+	jwtLeeway              = time.Minute
+)
+
+// JWTOptions configures bearer token authentication of the http endpoints
+type JWTOptions struct {
+	// JWKSURL is the url of the identity provider's JSON web key set
+	JWKSURL  string
+	Issuer   string
+	Audience string
+	// UserClaim is the claim mapped to the server user, default sub
+	UserClaim string
+	// RolesClaim and Roles require the token to carry one of Roles in the RolesClaim claim
+	RolesClaim string
+	Roles      []string
+}
+
+// ParseJWTOptions parses a spec of the form
+// https://idp/.well-known/jwks.json?issuer=..&audience=..&user_claim=..&roles_claim=..&roles=a,b
+func ParseJWTOptions(spec string) (*JWTOptions, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid jwks url %s", spec)
+	}
+	query := u.Query()
+	options := &JWTOptions{
+		Issuer:     query.Get("issuer"),
+		Audience:   query.Get("audience"),
+		UserClaim:  query.Get("user_claim"),
+		RolesClaim: query.Get("roles_claim"),
+	}
+	if roles := query.Get("roles"); roles != "" {
+		options.Roles = strings.Split(roles, ",")
+	}
+	if options.UserClaim == "" {
+		options.UserClaim = "sub"
+	}
+	if options.RolesClaim == "" {
+		options.RolesClaim = "roles"
+	}
+	for _, k := range []string{"issuer", "audience", "user_claim", "roles_claim", "roles"} {
+		query.Del(k)
+	}
+	u.RawQuery = query.Encode()
+	options.JWKSURL = u.String()
+	return options, nil
+}
+
+type jwtVerifier struct {
+	options   JWTOptions
+	client    *http.Client
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+	// fetching is closed when the fetch in flight finishes, nil when none is running
+	fetching chan struct{}
+}
+
+func newJWTVerifier(options JWTOptions) *jwtVerifier {
+	return &jwtVerifier{options: options, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	decode := base64.RawURLEncoding.DecodeString
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+}
+
+func (v *jwtVerifier) fetchKeys() (map[string]crypto.PublicKey, error) {
+	resp, err := v.client.Get(v.options.JWKSURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch jwks: %s", resp.Status)
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		key, err := k.publicKey()
+		if err != nil {
+			logrus.Warnf("skip jwk %s: %v", k.Kid, err)
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	return keys, nil
+}
+
+// key returns the key of kid, the key set is refreshed periodically and when a new kid shows up,
+// the fetch runs outside the lock and concurrent callers wait for the one in flight
+func (v *jwtVerifier) key(kid string) (crypto.PublicKey, error) {
+	v.mu.Lock()
+	key, ok := v.keys[kid]
+	stale := time.Since(v.fetchedAt) > jwksRefreshInterval
+	if (!ok && time.Since(v.fetchedAt) > jwksMinRefreshInterval) || stale {
+		fetching := v.fetching
+		if fetching == nil {
+			fetching = make(chan struct{})
+			v.fetching = fetching
+			v.fetchedAt = time.Now()
+			v.mu.Unlock()
+			keys, err := v.fetchKeys()
+			if err != nil {
+				logrus.Errorf("fetch jwks from %s failed: %v", v.options.JWKSURL, err)
+			}
+			v.mu.Lock()
+			if err == nil {
+				v.keys = keys
+			}
+			v.fetching = nil
+			close(fetching)
+		} else {
+			v.mu.Unlock()
+			<-fetching
+			v.mu.Lock()
+		}
+		key, ok = v.keys[kid]
+	}
+	v.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	return key, nil
+}
+
+func verifyJWTSignature(alg string, key crypto.PublicKey, signed, sig []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "PS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "PS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512", "PS512", "ES512":
+		hash = crypto.SHA512
+	case "EdDSA":
+		k, ok := key.(ed25519.PublicKey)
+		if !ok || !ed25519.Verify(k, signed, sig) {
+			return errors.New("invalid token signature")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported token algorithm %s", alg)
+	}
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if strings.HasPrefix(alg, "RS") && rsa.VerifyPKCS1v15(k, hash, digest, sig) == nil {
+			return nil
+		}
+		if strings.HasPrefix(alg, "PS") && rsa.VerifyPSS(k, hash, digest, sig, nil) == nil {
+			return nil
+		}
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if strings.HasPrefix(alg, "ES") && len(sig) == 2*size {
+			r := new(big.Int).SetBytes(sig[:size])
+			s := new(big.Int).SetBytes(sig[size:])
+			if ecdsa.Verify(k, digest, r, s) {
+				return nil
+			}
+		}
+	}
+	return errors.New("invalid token signature")
+}
+
+// Verify checks the signature and claims of a token and returns the mapped user
+func (v *jwtVerifier) Verify(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	headerData, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", errors.New("malformed token")
+	}
+	if err = json.Unmarshal(headerData, &header); err != nil {
+		return "", errors.New("malformed token")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", errors.New("malformed token")
+	}
+	key, err := v.key(header.Kid)
+	if err != nil {
+		return "", err
+	}
+	if err = verifyJWTSignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return "", err
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", errors.New("malformed token")
+	}
+	var claims map[string]any
+	if err = json.Unmarshal(payload, &claims); err != nil {
+		return "", errors.New("malformed token")
+	}
+	now := time.Now()
+	if exp, ok := claims["exp"].(float64); !ok || now.After(time.Unix(int64(exp), 0).Add(jwtLeeway)) {
+		return "", errors.New("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return "", errors.New("token not valid yet")
+	}
+	if v.options.Issuer != "" && claims["iss"] != v.options.Issuer {
+		return "", errors.New("invalid token issuer")
+	}
+	if v.options.Audience != "" && !slices.Contains(claimStrings(claims["aud"]), v.options.Audience) {
+		return "", errors.New("invalid token audience")
+	}
+	if len(v.options.Roles) > 0 && !slices.ContainsFunc(claimStrings(claims[v.options.RolesClaim]), func(role string) bool {
+		return slices.Contains(v.options.Roles, role)
+	}) {
+		return "", errors.New("token has no allowed role")
+	}
+	user, _ := claims[v.options.UserClaim].(string)
+	if user == "" {
+		return "", fmt.Errorf("token has no %s claim", v.options.UserClaim)
+	}
+	return user, nil
+}
+
+// claimStrings returns a claim which is either a string or an array of strings
+func claimStrings(claim any) []string {
+	switch c := claim.(type) {
+	case string:
+		return []string{c}
+	case []any:
+		var s []string
+		for _, item := range c {
+			if str, ok := item.(string); ok {
+				s = append(s, str)
+			}
+		}
+		return s
+	}
+	return nil
+}
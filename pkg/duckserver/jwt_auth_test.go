@@ -0,0 +1,75 @@
+package duckserver
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestJWKSFetchOutsideLock(t *testing.T) {
+	public, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		fetches atomic.Int32
+		release = make(chan struct{})
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fetches.Add(1) > 1 {
+			<-release
+		}
+		fmt.Fprintf(w, `{"keys":[{"kty":"OKP","crv":"Ed25519","kid":"a","x":%q}]}`,
+			base64.RawURLEncoding.EncodeToString(public))
+	}))
+	defer server.Close()
+	defer close(release)
+
+	v := newJWTVerifier(JWTOptions{JWKSURL: server.URL})
+	if _, err = v.key("a"); err != nil {
+		t.Fatal(err)
+	}
+	// an unknown kid refreshes the key set, the refresh hangs until release is closed
+	v.mu.Lock()
+	v.fetchedAt = time.Now().Add(-2 * jwksMinRefreshInterval)
+	v.mu.Unlock()
+	unknown := make(chan error, 2)
+	for range 2 {
+		go func() {
+			_, err := v.key("b")
+			unknown <- err
+		}()
+	}
+	for fetches.Load() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := v.key("a")
+		done <- err
+	}()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("a cached key waited for the jwks fetch")
+	}
+
+	release <- struct{}{}
+	for range 2 {
+		if err = <-unknown; err == nil {
+			t.Error("unknown key id found")
+		}
+	}
+	if n := fetches.Load(); n != 2 {
+		t.Errorf("fetched the jwks %d times, want 2", n)
+	}
+}
@@ -0,0 +1,210 @@
+package duckserver
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/xdg-go/scram"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const ldapTimeout = 10 * time.Second
+
+// ldapAuthProvider verifies passwords with an LDAP simple bind,
+// bind_dn is a template where %s is replaced with the escaped username
+type ldapAuthProvider struct {
+	addr   string
+	useTLS bool
+	bindDN string
+}
+
+func newLdapAuthProvider(spec string) (*ldapAuthProvider, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	p := &ldapAuthProvider{addr: u.Host, useTLS: u.Scheme == "ldaps"}
+	// the %s placeholder is not valid url escaping, so keep values which fail to unescape as is
+	for _, kv := range strings.Split(u.RawQuery, "&") {
+		k, v, _ := strings.Cut(kv, "=")
+		if k == "bind_dn" {
+			if unescaped, err := url.QueryUnescape(v); err == nil {
+				v = unescaped
+			}
+			p.bindDN = v
+		}
+	}
+	if !strings.Contains(p.bindDN, "%s") {
+		return nil, fmt.Errorf("ldap auth provider requires bind_dn with %%s, got %q", p.bindDN)
+	}
+	if u.Port() == "" {
+		if p.useTLS {
+			p.addr = net.JoinHostPort(u.Hostname(), "636")
+		} else {
+			p.addr = net.JoinHostPort(u.Hostname(), "389")
+		}
+	}
+	return p, nil
+}
+
+func (p *ldapAuthProvider) LookupCredentials(user string) (scram.StoredCredentials, error) {
+	return scram.StoredCredentials{}, ErrNoStoredCredentials
+}
+
+func (p *ldapAuthProvider) VerifyPassword(user, password string) error {
+	// an empty password is an unauthenticated bind, which most servers accept
+	if user == "" || password == "" {
+		return errInvalidPassword
+	}
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{Timeout: ldapTimeout}
+	if p.useTLS {
+		host, _, _ := net.SplitHostPort(p.addr)
+		conn, err = tls.DialWithDialer(dialer, "tcp", p.addr, &tls.Config{ServerName: host})
+	} else {
+		conn, err = dialer.Dial("tcp", p.addr)
+	}
+	if err != nil {
+		logrus.Errorf("ldap connect to %s failed: %v", p.addr, err)
+		return err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(ldapTimeout))
+	dn := fmt.Sprintf(p.bindDN, escapeLdapDN(user))
+	if _, err = conn.Write(ldapBindRequest(1, dn, password)); err != nil {
+		return err
+	}
+	code, diag, err := readLdapBindResponse(bufio.NewReader(conn))
+	if err != nil {
+		logrus.Errorf("ldap bind response error: %v", err)
+		return err
+	}
+	if code != 0 {
+		logrus.Debugf("ldap bind for %s failed with code %d: %s", dn, code, diag)
+		return errInvalidPassword
+	}
+	return nil
+}
+
+// escapeLdapDN escapes an attribute value for a distinguished name (RFC 4514)
+func escapeLdapDN(s string) string {
+	var b strings.Builder
+	for i, r := range s {
+		switch {
+		case strings.ContainsRune(`,+"\<>;=`, r),
+			i == 0 && (r == ' ' || r == '#'),
+			i == len(s)-1 && r == ' ':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == 0:
+			b.WriteString(`\00`)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+func berLength(n int) []byte {
+	if n < 0x80 {
+		return []byte{byte(n)}
+	}
+	var l []byte
+	for ; n > 0; n >>= 8 {
+		l = append([]byte{byte(n)}, l...)
+	}
+	return append([]byte{0x80 | byte(len(l))}, l...)
+}
+
+func berTLV(tag byte, value []byte) []byte {
+	return append(append([]byte{tag}, berLength(len(value))...), value...)
+}
+
+// ldapBindRequest encodes LDAPMessage{messageID, BindRequest{version 3, name, simple password}}
+func ldapBindRequest(id byte, dn, password string) []byte {
+	bind := berTLV(0x02, []byte{3})
+	bind = append(bind, berTLV(0x04, []byte(dn))...)
+	bind = append(bind, berTLV(0x80, []byte(password))...)
+	msg := berTLV(0x02, []byte{id})
+	msg = append(msg, berTLV(0x60, bind)...)
+	return berTLV(0x30, msg)
+}
+
+func readBer(rd *bufio.Reader) (byte, []byte, error) {
+	tag, err := rd.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	l, err := rd.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	n := int(l)
+	if l&0x80 != 0 {
+		if l&0x7f > 4 {
+			return 0, nil, errors.New("ldap: invalid ber length")
+		}
+		n = 0
+		for i := 0; i < int(l&0x7f); i++ {
+			b, err := rd.ReadByte()
+			if err != nil {
+				return 0, nil, err
+			}
+			n = n<<8 | int(b)
+		}
+	}
+	if n > 1<<20 {
+		return 0, nil, errors.New("ldap: message too large")
+	}
+	value := make([]byte, n)
+	if _, err = io.ReadFull(rd, value); err != nil {
+		return 0, nil, err
+	}
+	return tag, value, nil
+}
+
+// readLdapBindResponse reads a BindResponse and returns the result code and diagnostic message
+func readLdapBindResponse(rd *bufio.Reader) (int, string, error) {
+	tag, msg, err := readBer(rd)
+	if err != nil {
+		return 0, "", err
+	}
+	if tag != 0x30 {
+		return 0, "", fmt.Errorf("ldap: unexpected tag %x", tag)
+	}
+	msgRd := bufio.NewReader(strings.NewReader(string(msg)))
+	if _, _, err = readBer(msgRd); err != nil { // messageID
+		return 0, "", err
+	}
+	tag, op, err := readBer(msgRd)
+	if err != nil {
+		return 0, "", err
+	}
+	if tag != 0x61 {
+		return 0, "", fmt.Errorf("ldap: unexpected protocol op %x", tag)
+	}
+	opRd := bufio.NewReader(strings.NewReader(string(op)))
+	tag, code, err := readBer(opRd)
+	if err != nil {
+		return 0, "", err
+	}
+	if tag != 0x0a || len(code) == 0 {
+		return 0, "", errors.New("ldap: invalid result code")
+	}
+	result := 0
+	for _, b := range code {
+		result = result<<8 | int(b)
+	}
+	var diag []byte
+	if _, _, err = readBer(opRd); err == nil { // matchedDN
+		_, diag, _ = readBer(opRd)
+	}
+	return result, string(diag), nil
+}
@@ -0,0 +1,216 @@
+package duckserver
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// ListenerOptions configures one listen address, each listener has its own auth and tls settings
+type ListenerOptions struct {
+	// Addr is a tcp address, or systemd:NAME for a socket passed by systemd socket activation
+	Addr    string
+	Auth    bool
+	TLSCert string
+	TLSKey  string
+	// ProxyProtocol expects a HAProxy PROXY protocol header on each connection, from the addresses of ProxyTrusted
+	// only, the connections of other addresses are closed
+	ProxyProtocol bool
+	ProxyTrusted  []*net.IPNet
+	// ServerVersion overrides the postgresql server_version reported on this listener
+	ServerVersion string
+	// FoldIdentifiers folds unquoted identifiers to lower case like postgresql on this listener, DuckDB preserves
+	// their case
+	FoldIdentifiers bool
+	// Statements are the statement classes allowed on this listener, e.g. select, set and transaction for a read-only
+	// dashboard endpoint, empty allows all
+	Statements []string
+}
+
+const systemdAddrPrefix = "systemd:"
+
+// parseListenerOptions parses a listen spec like "[::]:5432?auth=false&tls_cert=server.crt&tls_key=server.key&proxy_protocol=true",
+// auth defaults to defaultAuth
+func parseListenerOptions(spec string, defaultAuth bool) (ListenerOptions, error) {
+	addr, query, _ := strings.Cut(spec, "?")
+	options := ListenerOptions{Addr: addr, Auth: defaultAuth}
+	params, err := url.ParseQuery(query)
+	if err != nil {
+		return options, fmt.Errorf("invalid listener %s: %w", spec, err)
+	}
+	readOnly := false
+	for key := range params {
+		value := params.Get(key)
+		switch key {
+		case "auth":
+			if options.Auth, err = strconv.ParseBool(value); err != nil {
+				return options, fmt.Errorf("invalid listener %s: invalid auth %s", spec, value)
+			}
+		case "tls_cert":
+			options.TLSCert = value
+		case "tls_key":
+			options.TLSKey = value
+		case "server_version":
+			options.ServerVersion = value
+		case "proxy_protocol":
+			if options.ProxyProtocol, err = strconv.ParseBool(value); err != nil {
+				return options, fmt.Errorf("invalid listener %s: invalid proxy_protocol %s", spec, value)
+			}
+		case "proxy_trusted":
+			if options.ProxyTrusted, err = parseTrustedProxies(value); err != nil {
+				return options, fmt.Errorf("invalid listener %s: %w", spec, err)
+			}
+		case "fold_identifiers":
+			if options.FoldIdentifiers, err = strconv.ParseBool(value); err != nil {
+				return options, fmt.Errorf("invalid listener %s: invalid fold_identifiers %s", spec, value)
+			}
+		case "statements":
+			if options.Statements, err = parseStatementClasses(value); err != nil {
+				return options, fmt.Errorf("invalid listener %s: %w", spec, err)
+			}
+		case "read_only":
+			if readOnly, err = strconv.ParseBool(value); err != nil {
+				return options, fmt.Errorf("invalid listener %s: invalid read_only %s", spec, value)
+			}
+		default:
+			return options, fmt.Errorf("invalid listener %s: unknown option %s", spec, key)
+		}
+	}
+	if readOnly {
+		if len(options.Statements) > 0 {
+			return options, fmt.Errorf("invalid listener %s: read_only and statements can't be set together", spec)
+		}
+		options.Statements = readOnlyStatementClasses
+	}
+	if options.ProxyProtocol && len(options.ProxyTrusted) == 0 {
+		return options, fmt.Errorf("invalid listener %s: proxy_protocol needs the addresses of the proxies in proxy_trusted", spec)
+	}
+	if (options.TLSCert == "") != (options.TLSKey == "") {
+		return options, fmt.Errorf("invalid listener %s: tls_cert and tls_key must be set together", spec)
+	}
+	return options, nil
+}
+
+func (l ListenerOptions) TLSConfig() (*tls.Config, error) {
+	if l.TLSCert == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(l.TLSCert, l.TLSKey)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+}
+
+func (l ListenerOptions) Listen() (net.Listener, error) {
+	var lis net.Listener
+	var err error
+	if name, ok := strings.CutPrefix(l.Addr, systemdAddrPrefix); ok {
+		lis, err = systemdListener(name)
+	} else {
+		lis, err = net.Listen("tcp", l.Addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if l.ProxyProtocol {
+		return newProxyListener(lis, l.ProxyTrusted), nil
+	}
+	return lis, nil
+}
+
+func (l ListenerOptions) String() string {
+	s := l.Addr
+	if !l.Auth {
+		s += " (no auth)"
+	}
+	if l.TLSCert != "" {
+		s += " (tls)"
+	}
+	if l.ProxyProtocol {
+		s += " (proxy protocol)"
+	}
+	if len(l.Statements) > 0 {
+		s += " (" + strings.Join(l.Statements, ", ") + " statements)"
+	}
+	return s
+}
+
+// ListenFlag is a repeatable command line flag of listener specs, the default is replaced by the first value given
+type ListenFlag struct {
+	values []string
+	set    bool
+}
+
+func NewListenFlag(defaults ...string) *ListenFlag {
+	return &ListenFlag{values: defaults}
+}
+
+func (f *ListenFlag) String() string {
+	return strings.Join(f.values, " ")
+}
+
+func (f *ListenFlag) Set(value string) error {
+	if !f.set {
+		f.values = nil
+		f.set = true
+	}
+	f.values = append(f.values, value)
+	return nil
+}
+
+func (f *ListenFlag) Listeners(defaultAuth bool) ([]ListenerOptions, error) {
+	listeners := make([]ListenerOptions, 0, len(f.values))
+	for _, spec := range f.values {
+		l, err := parseListenerOptions(spec, defaultAuth)
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// parseTrustedProxies parses the comma separated addresses of the proxies, ips like 10.0.0.5 or networks like
+// 10.0.0.0/24
+func parseTrustedProxies(value string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, addr := range strings.Split(value, ",") {
+		if addr = strings.TrimSpace(addr); addr == "" {
+			continue
+		}
+		if !strings.Contains(addr, "/") {
+			ip := net.ParseIP(addr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid proxy_trusted address %s", addr)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy_trusted network %s", addr)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func isLocalAddr(addr net.Addr) bool {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,41 @@
+package duckserver
+
+import (
+	"net"
+	"testing"
+)
+
+func TestProxyTrusted(t *testing.T) {
+	options, err := parseListenerOptions("[::]:5432?proxy_protocol=true&proxy_trusted=10.0.0.5,10.0.1.0/24,fd00::1", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &proxyListener{trusted: options.ProxyTrusted}
+	tests := []struct {
+		ip      string
+		trusted bool
+	}{
+		{"10.0.0.5", true},
+		{"10.0.0.6", false},
+		{"10.0.1.200", true},
+		{"127.0.0.1", false},
+		{"fd00::1", true},
+		{"fd00::2", false},
+		{"::ffff:10.0.0.5", true},
+	}
+	for _, test := range tests {
+		if trusted := l.isTrusted(&net.TCPAddr{IP: net.ParseIP(test.ip), Port: 1234}); trusted != test.trusted {
+			t.Errorf("isTrusted(%s) = %v, want %v", test.ip, trusted, test.trusted)
+		}
+	}
+	for _, spec := range []string{
+		"[::]:5432?proxy_protocol=true",
+		"[::]:5432?proxy_protocol=true&proxy_trusted=",
+		"[::]:5432?proxy_protocol=true&proxy_trusted=proxy.local",
+		"[::]:5432?proxy_protocol=true&proxy_trusted=10.0.0.0/33",
+	} {
+		if _, err = parseListenerOptions(spec, true); err == nil {
+			t.Errorf("parseListenerOptions(%q) accepted", spec)
+		}
+	}
+}
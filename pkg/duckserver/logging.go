@@ -0,0 +1,145 @@
+package duckserver
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// LogOptions configures the format and destinations of the server log
+type LogOptions struct {
+	// Format is text or json
+	Format string
+	// File is the log file, stderr if empty
+	File string
+	// MaxSize and MaxAge rotate the log files when they grow over MaxSize bytes or get older than MaxAge, 0 disables
+	MaxSize int64
+	MaxAge  time.Duration
+	// MaxBackups is the number of rotated files kept, 0 keeps all of them
+	MaxBackups int
+	// ErrorFile receives the error logs besides the log file, with the same rotation
+	ErrorFile string
+}
+
+// ConfigureLogging sets the format and outputs of the standard logrus logger
+func ConfigureLogging(options LogOptions) error {
+	switch options.Format {
+	case "", "text":
+		logrus.SetFormatter(&logrus.TextFormatter{})
+	case "json":
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	default:
+		return fmt.Errorf("unknown log format %s", options.Format)
+	}
+	if options.File != "" {
+		file, err := newRotatingFile(options.File, options.MaxSize, options.MaxAge, options.MaxBackups)
+		if err != nil {
+			return err
+		}
+		logrus.SetOutput(file)
+	}
+	if options.ErrorFile != "" {
+		file, err := newRotatingFile(options.ErrorFile, options.MaxSize, options.MaxAge, options.MaxBackups)
+		if err != nil {
+			return err
+		}
+		logrus.AddHook(&errorLogHook{writer: file})
+	}
+	return nil
+}
+
+// errorLogHook copies error logs to a separate writer
+type errorLogHook struct {
+	writer io.Writer
+}
+
+func (h *errorLogHook) Levels() []logrus.Level {
+	return []logrus.Level{logrus.PanicLevel, logrus.FatalLevel, logrus.ErrorLevel}
+}
+
+func (h *errorLogHook) Fire(entry *logrus.Entry) error {
+	b, err := entry.Logger.Formatter.Format(entry)
+	if err != nil {
+		return err
+	}
+	_, err = h.writer.Write(b)
+	return err
+}
+
+// rotatingFile is a log file renamed to path.TIMESTAMP when it grows over maxSize or gets older than maxAge
+type rotatingFile struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+	file       *os.File
+	size       int64
+	opened     time.Time
+}
+
+func newRotatingFile(path string, maxSize int64, maxAge time.Duration, maxBackups int) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, maxSize: maxSize, maxAge: maxAge, maxBackups: maxBackups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	f.opened = time.Now()
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.size > 0 && ((f.maxSize > 0 && f.size+int64(len(p)) > f.maxSize) || (f.maxAge > 0 && time.Since(f.opened) >= f.maxAge)) {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *rotatingFile) rotate() error {
+	_ = f.file.Close()
+	if err := os.Rename(f.path, f.path+"."+time.Now().Format("20060102T150405.000")); err != nil {
+		return err
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+	if f.maxBackups <= 0 {
+		return nil
+	}
+	backups, err := filepath.Glob(f.path + ".*")
+	if err != nil {
+		return err
+	}
+	// the timestamp suffix sorts in time order
+	sort.Strings(backups)
+	for len(backups) > f.maxBackups {
+		_ = os.Remove(backups[0])
+		backups = backups[1:]
+	}
+	return nil
+}
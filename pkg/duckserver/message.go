@@ -1,12 +1,14 @@
-package main
+package duckserver
 
 import (
 	"bytes"
 	"database/sql/driver"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"strconv"
+	"strings"
 )
 
 // MessageType https://www.postgresql.org/docs/16/protocol-message-formats.html
@@ -69,6 +71,13 @@ type IMessage interface {
 }
 
 const StartupMessageVersion = 196608
+const StartupMessageMajorVersion = 3
+
+// SupportedProtocolMinorVersion is the newest minor version of protocol 3 supported
+const SupportedProtocolMinorVersion = 0
+
+// ProtocolOptionPrefix is the prefix of protocol extension options in the startup message
+const ProtocolOptionPrefix = "_pq_."
 const CancelRequestCode = 80877102
 const SSLRequestCode = 80877103
 
@@ -80,6 +89,17 @@ type StartUpMessage struct {
 	Data       []byte
 	Version    int32
 	Parameters map[string]string
+	// ProtocolOptions are the _pq_.* options requested by client, none of them is supported now
+	ProtocolOptions []string
+}
+
+func (m *StartUpMessage) MinorVersion() int32 {
+	return m.Version & 0xffff
+}
+
+// NeedNegotiate reports whether the client asked for a newer minor version or protocol options
+func (m *StartUpMessage) NeedNegotiate() bool {
+	return m.MinorVersion() > SupportedProtocolMinorVersion || len(m.ProtocolOptions) > 0
 }
 
 func (m *StartUpMessage) FirstMessageType() int {
@@ -91,8 +111,11 @@ func (m *StartUpMessage) Read() ([]byte, error) {
 }
 
 func (m *StartUpMessage) Parse() error {
+	if len(m.Data) < 4 {
+		return errMalformedMessage
+	}
 	m.Version = int32(binary.BigEndian.Uint32(m.Data))
-	if m.Version == StartupMessageVersion {
+	if m.Version>>16 == StartupMessageMajorVersion {
 		m.Parameters = make(map[string]string)
 		currentKey := ""
 		lastIndex := 0
@@ -104,7 +127,11 @@ func (m *StartUpMessage) Parse() error {
 				if currentKey == "" {
 					currentKey = string(m.Data[4+lastIndex : 4+i])
 				} else {
-					m.Parameters[currentKey] = string(m.Data[4+lastIndex : 4+i])
+					if strings.HasPrefix(currentKey, ProtocolOptionPrefix) {
+						m.ProtocolOptions = append(m.ProtocolOptions, currentKey)
+					} else {
+						m.Parameters[currentKey] = string(m.Data[4+lastIndex : 4+i])
+					}
 					currentKey = ""
 				}
 				lastIndex = i + 1
@@ -148,16 +175,52 @@ type Message struct {
 	buf    []byte
 	Length int32
 	Typ    MessageType
+	// consumed is the size of the payload read by ReadPart
+	consumed int
+}
+
+// MessageTooLargeError rejects a message larger than the max message size of the wire
+type MessageTooLargeError struct {
+	Typ    MessageType
+	Length int32
+	Max    int
+}
+
+func (e *MessageTooLargeError) Error() string {
+	return fmt.Sprintf("message %q of %d bytes exceeds the max message size of %d bytes", rune(e.Typ), e.Length-4, e.Max)
+}
+
+// TooLarge returns the error of a message larger than the max message size, nil if it can be read
+func (m *Message) TooLarge() error {
+	if m.wire == nil || m.buf != nil || int(m.Length-4) <= m.wire.maxMessageSize {
+		return nil
+	}
+	return &MessageTooLargeError{Typ: m.Typ, Length: m.Length, Max: m.wire.maxMessageSize}
 }
 
 func (m *Message) Skip() error {
 	if m.wire == nil || m.buf != nil {
 		return nil
 	}
-	_, err := io.CopyN(io.Discard, m.wire, int64(m.Length-4))
+	_, err := io.CopyN(io.Discard, m.wire, int64(int(m.Length-4)-m.consumed))
 	return err
 }
 
+// ReadPart reads the next part of the payload into p, so the payload of a message of any size is streamed,
+// io.EOF at its end
+func (m *Message) ReadPart(p []byte) (int, error) {
+	remaining := int(m.Length-4) - m.consumed
+	if m.wire == nil || m.buf != nil || remaining == 0 {
+		return 0, io.EOF
+	}
+	if len(p) > remaining {
+		p = p[:remaining]
+	}
+	n, err := m.wire.rd.Read(p)
+	m.consumed += n
+	return n, err
+}
+
 func (m *Message) Read() ([]byte, error) {
 	if m.buf != nil {
 		return m.buf, nil
@@ -165,6 +228,9 @@ func (m *Message) Read() ([]byte, error) {
 	if m.wire == nil {
 		return m.buf, nil
 	}
+	if err := m.TooLarge(); err != nil {
+		return nil, err
+	}
 	var buf []byte
 	if m.wire != nil && m.Length <= WireBufferSize+4 {
 		buf = m.wire.buf[:m.Length-4]
@@ -291,12 +357,15 @@ func ParseSaslMessage(message *Message) (*SaslMessage, error) {
 			return nil, err
 		}
 	}
+	if len(message.buf) < 4 {
+		return nil, fmt.Errorf("invalid SASL message")
+	}
 	magic := binary.BigEndian.Uint32(message.buf)
 	if magic != 10 {
 		return nil, fmt.Errorf("invalid SASL message")
 
 	}
-	buf := message.buf[4 : len(message.buf)-1]
+	buf := bytes.TrimSuffix(message.buf[4:], []byte{0})
 	mech := make([]string, 0)
 	for _, m := range bytes.Split(buf, []byte{0}) {
 		mech = append(mech, string(m))
@@ -320,6 +389,9 @@ func ParseSaslContinueMessage(message *Message) (*SaslContinueMessage, error) {
 			return nil, err
 		}
 	}
+	if len(message.buf) < 4 {
+		return nil, fmt.Errorf("invalid SASL message")
+	}
 	magic := binary.BigEndian.Uint32(message.buf)
 	if magic != 11 {
 		return nil, fmt.Errorf("invalid SASL message")
@@ -343,6 +415,9 @@ func ParseSaslFinalMessage(message *Message) (*SaslFinalMessage, error) {
 			return nil, err
 		}
 	}
+	if len(message.buf) < 4 {
+		return nil, fmt.Errorf("invalid SASL message")
+	}
 	magic := binary.BigEndian.Uint32(message.buf)
 	if magic != 12 {
 		return nil, fmt.Errorf("invalid SASL message")
@@ -350,6 +425,63 @@ func ParseSaslFinalMessage(message *Message) (*SaslFinalMessage, error) {
 	return &SaslFinalMessage{Message: message, Data: message.buf[4:]}, nil
 }
 
+var errMalformedMessage = errors.New("malformed message")
+
+// messageReader reads the fields of a frontend message with bounds checks, after the first error every read
+// returns the zero value and err is kept
+type messageReader struct {
+	d   []byte
+	err error
+}
+
+func (r *messageReader) CString() string {
+	if r.err != nil {
+		return ""
+	}
+	i := bytes.IndexByte(r.d, 0)
+	if i < 0 {
+		r.err = errMalformedMessage
+		return ""
+	}
+	s := string(r.d[:i])
+	r.d = r.d[i+1:]
+	return s
+}
+
+func (r *messageReader) Int16() int16 {
+	if r.err != nil || len(r.d) < 2 {
+		r.err = errMalformedMessage
+		return 0
+	}
+	v := int16(binary.BigEndian.Uint16(r.d))
+	r.d = r.d[2:]
+	return v
+}
+
+func (r *messageReader) Int32() int32 {
+	if r.err != nil || len(r.d) < 4 {
+		r.err = errMalformedMessage
+		return 0
+	}
+	v := int32(binary.BigEndian.Uint32(r.d))
+	r.d = r.d[4:]
+	return v
+}
+
+// Bytes reads n bytes, n = -1 is a NULL value and returns nil
+func (r *messageReader) Bytes(n int) []byte {
+	if r.err != nil || n == -1 {
+		return nil
+	}
+	if n < -1 || n > len(r.d) {
+		r.err = errMalformedMessage
+		return nil
+	}
+	b := r.d[:n:n]
+	r.d = r.d[n:]
+	return b
+}
+
 func cstr(s string) []byte {
 	return append([]byte(s), 0)
 }
@@ -405,16 +537,16 @@ func ParseParseMessage(message *Message) (ParseMessage, error) {
 	if err != nil {
 		return ParseMessage{}, err
 	}
-	name := goString(d)
-	d = d[len(name)+1:]
-	query := goString(d)
-	d = d[len(query)+1:]
-	oidCount := int(binary.BigEndian.Uint16(d))
-	d = d[2:]
+	r := messageReader{d: d}
+	name := r.CString()
+	query := r.CString()
+	oidCount := int(r.Int16())
 	oids := make([]int32, 0)
-	for i := 0; i < oidCount; i++ {
-		oids = append(oids, int32(binary.BigEndian.Uint32(d)))
-		d = d[4:]
+	for i := 0; i < oidCount && r.err == nil; i++ {
+		oids = append(oids, r.Int32())
+	}
+	if r.err != nil {
+		return ParseMessage{}, fmt.Errorf("invalid parse message: %w", r.err)
 	}
 	return ParseMessage{Message: message, Name: name, Query: query, ParameterOIDs: oids}, nil
 }
@@ -425,6 +557,10 @@ type BindMessage struct {
 	Statement       string
 	ParameterOIDs   []int32
 	ParameterValues []driver.Value
+	// ParameterFormats are the parameter format codes, parameters in binary format are kept as []byte
+	ParameterFormats []int16
+	// ResultFormats are the result column format codes
+	ResultFormats []int16
 }
 
 func tryParseValue(s string) driver.Value {
@@ -442,31 +578,35 @@ func ParseBindMessage(message *Message) (BindMessage, error) {
 	if err != nil {
 		return BindMessage{}, err
 	}
-	portalName := goString(d)
-	d = d[len(portalName)+1:]
-	statement := goString(d)
-	d = d[len(statement)+1:]
-	formatCount := int(binary.BigEndian.Uint16(d))
-	d = d[2:]
+	r := messageReader{d: d}
+	portalName := r.CString()
+	statement := r.CString()
+	formatCount := int(r.Int16())
 	format := make([]int16, 0)
-	for i := 0; i < formatCount; i++ {
-		format = append(format, int16(binary.BigEndian.Uint16(d)))
-		d = d[2:]
+	for i := 0; i < formatCount && r.err == nil; i++ {
+		format = append(format, r.Int16())
 	}
-	valueCount := int(binary.BigEndian.Uint16(d))
-	d = d[2:]
+	valueCount := int(r.Int16())
 	values := make([]driver.Value, 0)
-	for i := 0; i < valueCount; i++ {
-		l := int32(binary.BigEndian.Uint32(d))
-		d = d[4:]
-		if l == -1 {
+	for i := 0; i < valueCount && r.err == nil; i++ {
+		if value := r.Bytes(int(r.Int32())); value == nil {
 			values = append(values, nil)
+		} else if formatCode(format, i) == formatBinary {
+			values = append(values, value)
 		} else {
-			values = append(values, tryParseValue(string(d[:l])))
-			d = d[l:]
+			values = append(values, tryParseValue(string(value)))
 		}
 	}
-	return BindMessage{Message: message, PortalName: portalName, Statement: statement, ParameterValues: values}, nil
+	resultFormatCount := int(r.Int16())
+	resultFormats := make([]int16, 0)
+	for i := 0; i < resultFormatCount && r.err == nil; i++ {
+		resultFormats = append(resultFormats, r.Int16())
+	}
+	if r.err != nil {
+		return BindMessage{}, fmt.Errorf("invalid bind message: %w", r.err)
+	}
+	return BindMessage{Message: message, PortalName: portalName, Statement: statement, ParameterValues: values,
+		ParameterFormats: format, ResultFormats: resultFormats}, nil
 }
 
 type ExecuteMessage struct {
@@ -480,9 +620,12 @@ func ParseExecuteMessage(message *Message) (ExecuteMessage, error) {
 	if err != nil {
 		return ExecuteMessage{}, err
 	}
-	portalName := goString(d)
-	d = d[len(portalName)+1:]
-	maxRows := int32(binary.BigEndian.Uint32(d))
+	r := messageReader{d: d}
+	portalName := r.CString()
+	maxRows := r.Int32()
+	if r.err != nil {
+		return ExecuteMessage{}, fmt.Errorf("invalid execute message: %w", r.err)
+	}
 	return ExecuteMessage{Message: message, PortalName: portalName, MaxRows: maxRows}, nil
 
 }
@@ -498,9 +641,40 @@ func ParseDescribeMessage(message *Message) (DescribeMessage, error) {
 	if err != nil {
 		return DescribeMessage{}, err
 	}
+	if len(d) < 2 {
+		return DescribeMessage{}, fmt.Errorf("invalid describe message")
+	}
 	return DescribeMessage{Message: message, Type: d[0], Name: goString(d[1:])}, nil
 }
 
+// NewNegotiateProtocolVersionMessage tells client the newest supported minor version and the unrecognized protocol options
+func NewNegotiateProtocolVersionMessage(minorVersion int32, unrecognized []string) *Message {
+	buf := make([]byte, 0)
+	buf = append(buf, cint32(StartupMessageMajorVersion<<16|minorVersion)...)
+	buf = append(buf, cint32(len(unrecognized))...)
+	for _, option := range unrecognized {
+		buf = append(buf, cstr(option)...)
+	}
+	return NewMessage(NegotiateProtocolVersion, buf)
+}
+
+type CloseMessage struct {
+	*Message
+	Type byte
+	Name string
+}
+
+func ParseCloseMessage(message *Message) (CloseMessage, error) {
+	d, err := message.Read()
+	if err != nil {
+		return CloseMessage{}, err
+	}
+	if len(d) < 2 {
+		return CloseMessage{}, fmt.Errorf("invalid close message")
+	}
+	return CloseMessage{Message: message, Type: d[0], Name: goString(d[1:])}, nil
+}
+
 type AuthenticationSASLMessage struct {
 	*Message
 	Mechanisms []string
@@ -536,11 +710,12 @@ func ParseSASLInitialResponseMessage(message *Message) (*SASLInitialResponseMess
 	if message.Typ != SASLInitialResponse {
 		return nil, fmt.Errorf("invalid SASL initial response message")
 	}
-	buf := message.buf
-	mech := goString(buf)
-	buf = buf[len(mech)+1:]
-	l := int32(binary.BigEndian.Uint32(buf))
-	d := buf[4 : l+4]
+	r := messageReader{d: message.buf}
+	mech := r.CString()
+	d := r.Bytes(int(r.Int32()))
+	if r.err != nil {
+		return nil, fmt.Errorf("invalid SASL initial response message: %w", r.err)
+	}
 	return &SASLInitialResponseMessage{Message: message, Mechanism: mech, Initial: d}, nil
 }
 
@@ -566,3 +741,21 @@ func ParseSASLResponseMessage(message *Message) (*SASLResponseMessage, error) {
 	buf := message.buf
 	return &SASLResponseMessage{Message: message, Data: buf}, nil
 }
+
+type PasswordResponseMessage struct {
+	*Message
+	Password string
+}
+
+func ParsePasswordMessage(message *Message) (*PasswordResponseMessage, error) {
+	if message.buf == nil {
+		_, err := message.Read()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if message.Typ != PasswordMessage {
+		return nil, fmt.Errorf("invalid password message")
+	}
+	return &PasswordResponseMessage{Message: message, Password: strings.TrimRight(string(message.buf), "\x00")}, nil
+}
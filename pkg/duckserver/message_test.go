@@ -0,0 +1,168 @@
+package duckserver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// The fuzz targets feed malformed frontend messages to the protocol parsers, which return an error instead of
+// panicking. Run one with go test -run '^$' -fuzz FuzzParseBindMessage ./pkg/duckserver
+
+// fuzzConn is a connection reading the fuzz input, its writes are discarded
+type fuzzConn struct {
+	net.Conn
+	rd *bytes.Reader
+}
+
+func (c *fuzzConn) Read(p []byte) (int, error)       { return c.rd.Read(p) }
+func (c *fuzzConn) Write(p []byte) (int, error)      { return len(p), nil }
+func (c *fuzzConn) Close() error                     { return nil }
+func (c *fuzzConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *fuzzConn) SetWriteDeadline(time.Time) error { return nil }
+func (c *fuzzConn) SetDeadline(time.Time) error      { return nil }
+
+// payload builds a message payload of cstrings, int16 and int32 values and raw bytes
+func payload(parts ...any) []byte {
+	var b []byte
+	for _, part := range parts {
+		switch v := part.(type) {
+		case string:
+			b = append(append(b, v...), 0)
+		case int16:
+			b = binary.BigEndian.AppendUint16(b, uint16(v))
+		case int32:
+			b = binary.BigEndian.AppendUint32(b, uint32(v))
+		case []byte:
+			b = append(b, v...)
+		}
+	}
+	return b
+}
+
+func FuzzParseParseMessage(f *testing.F) {
+	f.Add(payload("s1", "select $1", int16(1), int32(23)))
+	f.Add(payload("", "select 1", int16(0)))
+	f.Add(payload("s1", "select $1", int16(3), int32(23)))
+	f.Add(payload("s1", "select $1", int16(-1)))
+	f.Add([]byte("s1"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg, err := ParseParseMessage(NewMessage(Parse, data))
+		if err == nil && len(msg.ParameterOIDs)*4 > len(data) {
+			t.Errorf("%d parameter oids of a message of %d bytes", len(msg.ParameterOIDs), len(data))
+		}
+	})
+}
+
+func FuzzParseBindMessage(f *testing.F) {
+	f.Add(payload("", "s1", int16(1), int16(0), int16(1), int32(1), []byte("1"), int16(1), int16(1)))
+	f.Add(payload("p", "s1", int16(0), int16(2), int32(-1), int32(4), []byte{0, 0, 0, 1}, int16(0)))
+	f.Add(payload("", "s1", int16(0), int16(1), int32(100), []byte("x")))
+	f.Add(payload("", "s1", int16(0), int16(1), int32(-5)))
+	f.Add(payload("", "s1", int16(-1)))
+	f.Add([]byte{})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg, err := ParseBindMessage(NewMessage(Bind, data))
+		if err == nil && len(msg.ParameterValues)*4 > len(data) {
+			t.Errorf("%d parameters of a message of %d bytes", len(msg.ParameterValues), len(data))
+		}
+	})
+}
+
+func FuzzParseExecuteMessage(f *testing.F) {
+	f.Add(payload("", int32(0)))
+	f.Add(payload("portal", int32(100)))
+	f.Add(payload("portal"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		_, _ = ParseExecuteMessage(NewMessage(Execute, data))
+	})
+}
+
+func FuzzParseDescribeCloseMessage(f *testing.F) {
+	f.Add(payload([]byte("S"), "s1"))
+	f.Add(payload([]byte("P"), ""))
+	f.Add([]byte("S"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		_, _ = ParseDescribeMessage(NewMessage(Describe, data))
+		_, _ = ParseCloseMessage(NewMessage(Close, data))
+	})
+}
+
+func FuzzParseSASLInitialResponseMessage(f *testing.F) {
+	f.Add(payload(scramSha256, int32(8), []byte("n,,n=,r=")))
+	f.Add(payload(scramSha256, int32(-1)))
+	f.Add(payload(scramSha256, int32(1000), []byte("n,,")))
+	f.Add([]byte(scramSha256))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		_, _ = ParseSASLInitialResponseMessage(NewMessage(SASLInitialResponse, data))
+		_, _ = ParseSASLResponseMessage(NewMessage(SASLResponse, data))
+		_, _ = ParsePasswordMessage(NewMessage(PasswordMessage, data))
+	})
+}
+
+func FuzzStartUpMessageParse(f *testing.F) {
+	f.Add(payload(int32(StartupMessageVersion), "user", "postgres", "database", "main", ""))
+	f.Add(payload(int32(StartupMessageVersion), "user"))
+	f.Add(payload(int32(StartupMessageVersion), "_pq_.option", "x", ""))
+	f.Add(payload(int32(StartupMessageVersion)))
+	f.Add([]byte{0, 3})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		m := StartUpMessage{Data: data}
+		_ = m.Parse()
+	})
+}
+
+// FuzzWire reads a startup message and the messages following it from a connection sending data
+func FuzzWire(f *testing.F) {
+	startup := payload(int32(StartupMessageVersion), "user", "postgres", "")
+	startup = append(binary.BigEndian.AppendUint32(nil, uint32(len(startup)+4)), startup...)
+	query := payload([]byte("Q"), int32(13), "select 1")
+	f.Add(append(append([]byte{}, startup...), query...))
+	f.Add(payload(int32(8), int32(SSLRequestCode), []byte(startup)))
+	f.Add(payload(int32(16), int32(CancelRequestCode), int32(1), int32(2)))
+	f.Add(payload(int32(12), int32(CancelRequestCode), int32(1)))
+	f.Add(append(append([]byte{}, startup...), payload([]byte("Q"), int32(1<<30))...))
+	f.Add(append(append([]byte{}, startup...), payload([]byte("Q"), int32(2))...))
+	f.Add(payload(int32(-1)))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		w := newWire(&fuzzConn{rd: bytes.NewReader(data)}, nil, 0, 1<<16)
+		if _, err := w.ReadStartUpMessage(); err != nil {
+			return
+		}
+		for i := 0; i < 16; i++ {
+			msg, err := w.ReadMessage()
+			if err != nil {
+				return
+			}
+			if _, err = msg.Read(); err != nil {
+				return
+			}
+		}
+	})
+}
+
+func FuzzDecodeBinaryParam(f *testing.F) {
+	f.Add(int32(23), []byte{0, 0, 0, 1})
+	f.Add(int32(1700), []byte{0, 1, 0, 0, 0, 0, 0, 0, 0, 1})
+	f.Add(int32(1007), payload(int32(1), int32(0), int32(23), int32(2), int32(1), int32(4), int32(1), int32(-1)))
+	f.Add(int32(1007), payload(int32(1), int32(0), int32(23), int32(-2), int32(1)))
+	f.Add(int32(1007), payload(int32(1), int32(0), int32(23), int32(1<<30), int32(1)))
+	f.Add(int32(1009), payload(int32(1), int32(0), int32(25), int32(1), int32(1), int32(100), []byte("a")))
+	f.Add(int32(1186), []byte{0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 2, 0, 0, 0, 3})
+	f.Fuzz(func(t *testing.T, oid int32, data []byte) {
+		_, _ = decodeBinaryParam(oid, data)
+	})
+}
+
+func FuzzParsePgArray(f *testing.F) {
+	f.Add(`{1,2,3}`)
+	f.Add(`{"a,b",NULL,"c\"d"}`)
+	f.Add(`{{1,2},{3,4}}`)
+	f.Add(`{`)
+	f.Add(`{"a`)
+	f.Fuzz(func(t *testing.T, s string) {
+		_, _ = parsePgArray(s)
+	})
+}
@@ -0,0 +1,52 @@
+package duckserver
+
+import (
+	"encoding/binary"
+)
+
+// maxRetainedMessageBuffer limits the message buffer kept by a Wire between messages
+const maxRetainedMessageBuffer = 1 << 20
+
+// MessageWriter builds a backend message in a buffer reused for every message of a Wire,
+// so building a message doesn't allocate per field
+type MessageWriter struct {
+	buf []byte
+}
+
+// StartMessage resets the message buffer of the wire and writes the message type and a length placeholder
+func (w *Wire) StartMessage(typ MessageType) *MessageWriter {
+	w.msg.buf = append(w.msg.buf[:0], byte(typ), 0, 0, 0, 0)
+	return &w.msg
+}
+
+// SendMessage fills in the length of the message started by StartMessage and writes it
+func (w *Wire) SendMessage(m *MessageWriter) error {
+	binary.BigEndian.PutUint32(m.buf[1:5], uint32(len(m.buf)-1))
+	_, err := w.Write(m.buf)
+	if cap(m.buf) > maxRetainedMessageBuffer {
+		m.buf = nil
+	}
+	return err
+}
+
+func (m *MessageWriter) WriteUint8(b byte) {
+	m.buf = append(m.buf, b)
+}
+
+func (m *MessageWriter) WriteInt16(i int16) {
+	m.buf = binary.BigEndian.AppendUint16(m.buf, uint16(i))
+}
+
+func (m *MessageWriter) WriteInt32(i int32) {
+	m.buf = binary.BigEndian.AppendUint32(m.buf, uint32(i))
+}
+
+func (m *MessageWriter) WriteBytes(b []byte) {
+	m.buf = append(m.buf, b...)
+}
+
+// WriteCString writes s terminated by a zero byte
+func (m *MessageWriter) WriteCString(s string) {
+	m.buf = append(m.buf, s...)
+	m.buf = append(m.buf, 0)
+}
@@ -0,0 +1,114 @@
+package duckserver
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// The benchmarks measure the messages of query results written to a connection discarding them. Compare the
+// MessageWriter with the per-field allocations of BenchmarkDataRowNewMessage:
+//
+//	go test -run '^$' -bench 'DataRow|RowDescription|Flush' -benchmem ./pkg/duckserver
+
+// benchRow is a row of the usual column types
+var benchRow = []driver.Value{
+	int32(42), int64(1234567890), 3.25, "a short string value", true, nil,
+	time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC), big.NewInt(123456789),
+}
+
+var benchColumns = []string{"id", "big", "score", "name", "flag", "empty", "ts", "huge"}
+
+func newBenchConn() *PgConn {
+	return &PgConn{wire: newWire(&fuzzConn{rd: bytes.NewReader(nil)}, nil, 0, 0)}
+}
+
+func BenchmarkDataRow(b *testing.B) {
+	c := newBenchConn()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := c.SendRowData(benchRow); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDataRowBinary(b *testing.B) {
+	c := newBenchConn()
+	c.resultFormats = []int16{formatBinary}
+	row := benchRow[:6]
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := c.SendRowData(row); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkDataRowNewMessage builds the data rows with a slice per field like before the MessageWriter
+func BenchmarkDataRowNewMessage(b *testing.B) {
+	c := newBenchConn()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		data := make([]byte, 0)
+		data = append(data, cint16(len(benchRow))...)
+		for _, v := range benchRow {
+			pgVal, err := toPgValue(v)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if v == nil || pgVal.val == nil {
+				data = append(data, cint32(-1)...)
+				continue
+			}
+			data = append(data, cint32(len(pgVal.val))...)
+			data = append(data, pgVal.val...)
+		}
+		if err := c.wire.WriteMessage(NewMessage(DataRow, data)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRowDescription(b *testing.B) {
+	c := newBenchConn()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := c.SendRowDescription(benchColumns, benchRow, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRowDescriptionTypes(b *testing.B) {
+	c := newBenchConn()
+	columns := [][2]string{{"id", "INTEGER"}, {"big", "BIGINT"}, {"score", "DOUBLE"}, {"name", "VARCHAR"},
+		{"flag", "BOOLEAN"}, {"amount", "DECIMAL(18,2)"}, {"ts", "TIMESTAMP"}, {"huge", "HUGEINT"}}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := c.SendRowDescriptionWithColumnNameAndTypes(columns); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkFlush writes the data rows of results of 100 rows and flushes the buffered output after each result
+func BenchmarkFlush(b *testing.B) {
+	c := newBenchConn()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < 100; j++ {
+			if err := c.SendRowData(benchRow); err != nil {
+				b.Fatal(err)
+			}
+		}
+		if err := c.SendCommandComplete("SELECT 100"); err != nil {
+			b.Fatal(err)
+		}
+		if err := c.wire.Flush(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package duckserver
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// metricsRegistry keeps counters and gauges exposed in prometheus text format on /metrics
+type metricsRegistry struct {
+	mu     sync.Mutex
+	values map[string]float64
+	types  map[string]string
+}
+
+var metrics = &metricsRegistry{values: map[string]float64{}, types: map[string]string{}}
+
+func metricKey(name string, labels ...string) string {
+	if len(labels) == 0 {
+		return name
+	}
+	key := name + "{"
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			key += ","
+		}
+		key += labels[i] + "=" + strconv.Quote(labels[i+1])
+	}
+	return key + "}"
+}
+
+// Add increases a counter, labels are given as key value pairs
+func (m *metricsRegistry) Add(name string, value float64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.types[name] = "counter"
+	m.values[metricKey(name, labels...)] += value
+}
+
+// Set sets a gauge, labels are given as key value pairs
+func (m *metricsRegistry) Set(name string, value float64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.types[name] = "gauge"
+	m.values[metricKey(name, labels...)] = value
+}
+
+func (m *metricsRegistry) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	names := make([]string, 0, len(m.types))
+	for name := range m.types {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	keys := make([]string, 0, len(m.values))
+	for key := range m.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var total int64
+	for _, name := range names {
+		n, err := fmt.Fprintf(w, "# TYPE %s %s\n", name, m.types[name])
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+		for _, key := range keys {
+			if key != name && (len(key) <= len(name) || key[:len(name)+1] != name+"{") {
+				continue
+			}
+			n, err = fmt.Fprintf(w, "%s %s\n", key, strconv.FormatFloat(m.values[key], 'g', -1, 64))
+			total += int64(n)
+			if err != nil {
+				return total, err
+			}
+		}
+	}
+	return total, nil
+}
+
+func (m *metricsRegistry) ServeHTTP(wr http.ResponseWriter, _ *http.Request) {
+	wr.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	_, _ = m.WriteTo(wr)
+}
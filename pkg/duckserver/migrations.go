@@ -0,0 +1,161 @@
+package duckserver
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/sirupsen/logrus"
+)
+
+type migration struct {
+	version    int
+	name       string
+	statements []string
+}
+
+// migrations evolve the duckserver internal schema, append new migrations with a higher version and never edit
+// an existing one, so a database created by an older release is upgraded in order on startup
+var migrations = []migration{
+	{1, "create users", []string{
+		`create table if not exists duckserver.users (username text primary key, password text);`,
+	}},
+	{2, "create insert transfers", []string{
+		`create table if not exists duckserver.insert_transfers (transfer_id text, part bigint, table_name text, rows bigint, finished_at timestamp, primary key (transfer_id, part));`,
+	}},
+	{3, "create dedup keys", []string{
+		`create table if not exists duckserver.dedup_keys (schema_name text, table_name text, key_columns text, primary key (schema_name, table_name));`,
+	}},
+	{4, "create usage and quotas", []string{
+		`create table if not exists duckserver.usage (username text, period_start timestamp, queries bigint, execution_ms bigint, primary key (username, period_start));`,
+		`create table if not exists duckserver.quotas (username text primary key, queries_per_hour bigint, execution_seconds_per_day bigint);`,
+	}},
+	{5, "create profiles", []string{
+		`create table if not exists duckserver.profiles (id text primary key, username text, protocol text, query text, started_at timestamp, timing_ms double, profile text);`,
+	}},
+	{6, "create clickhouse tables", []string{
+		`create table if not exists duckserver.ch_tables (schema_name text, table_name text, engine text, sorting_key text, partition_key text, primary_key text, create_table_query text, primary key (schema_name, table_name));`,
+	}},
+	{7, "list views in clickhouse system tables", []string{
+		`create schema if not exists system;`,
+		`create or replace view ` + systemDatabasesView,
+		`create or replace view ` + systemTablesView,
+	}},
+	{8, "create postgresql catalog overrides", []string{
+		`create or replace view duckserver.pg_constraint as
+select * replace (list_transform(conkey, k -> k + 1) as conkey, list_transform(confkey, k -> k + 1) as confkey)
+from pg_catalog.pg_constraint
+where contype <> 'x';`,
+		`create or replace view duckserver.pg_index as
+select x.* replace (coalesce(len(k.indkey), 0)::smallint as indnatts,
+                    coalesce(len(k.indkey), 0)::smallint as indnkeyatts,
+                    coalesce(k.indkey, []) as indkey,
+                    list_transform(coalesce(k.indkey, []), a -> 0) as indoption)
+from pg_catalog.pg_index x
+         left join (select e.index_oid, list(coalesce(c.column_index, 0)::smallint order by e.ord) as indkey
+                    from (select index_oid, table_oid, unnest(elements) as name, generate_subscripts(elements, 1) as ord
+                          from (select index_oid, table_oid, string_split(regexp_extract(sql, '\((.*)\)', 1), ', ') as elements
+                                from duckdb_indexes())) e
+                             left join duckdb_columns() c on c.table_oid = e.table_oid and c.column_name = trim(e.name, '"')
+                    group by e.index_oid) k on k.index_oid = x.indexrelid;`,
+		`create or replace macro duckserver.pg_get_indexdef(index_id, column_no, pretty) as
+(select string_split(regexp_extract(sql, '\((.*)\)', 1), ', ')[column_no] from duckdb_indexes() where index_oid = index_id);`,
+		`create or replace macro duckserver.pg_table_is_visible(table_id) as
+(select bool_or(n.nspname = any (current_schemas(true)))
+ from pg_catalog.pg_class c
+          join pg_catalog.pg_namespace n on n.oid = c.relnamespace
+ where c.oid = table_id);`,
+		`create or replace macro duckserver.format_type(type_oid, typemod) as
+case pg_catalog.format_type(type_oid, typemod)
+    when 'int2' then 'smallint'
+    when 'int4' then 'integer'
+    when 'int8' then 'bigint'
+    when 'hugeint' then 'numeric(38,0)'
+    when 'float4' then 'real'
+    when 'float8' then 'double precision'
+    when 'bool' then 'boolean'
+    when 'varchar' then 'character varying'
+    when 'time' then 'time without time zone'
+    when 'timestamp' then 'timestamp without time zone'
+    when 'timestamptz' then 'timestamp with time zone'
+    else pg_catalog.format_type(type_oid, typemod) end;`,
+	}},
+	{9, "track usage per application", []string{
+		`create table if not exists duckserver.application_usage (application text, username text, period_start timestamp, queries bigint, execution_ms bigint, primary key (application, username, period_start));`,
+		`alter table duckserver.profiles add column if not exists application text;`,
+	}},
+	{10, "create row policies", []string{
+		`create table if not exists duckserver.row_policies (username text, schema_name text default 'main', table_name text, predicate text, primary key (username, schema_name, table_name));`,
+	}},
+	{11, "create roles and statement rules", []string{
+		`create table if not exists duckserver.user_roles (username text, role text, primary key (username, role));`,
+		`create table if not exists duckserver.statement_rules (role text, statement_class text, action text check (lower(action) in ('allow', 'deny')), primary key (role, statement_class));`,
+	}},
+	{12, "create ttl policies", []string{
+		`create table if not exists duckserver.ttl_policies (schema_name text default 'main', table_name text, time_column text, retention interval, primary key (schema_name, table_name));`,
+	}},
+	{13, "create partitioned tables", []string{
+		`create table if not exists duckserver.partitioned_tables (schema_name text default 'main', table_name text, time_column text, granularity text, primary key (schema_name, table_name));`,
+	}},
+	{14, "create triggers", []string{
+		`create table if not exists duckserver.triggers (schema_name text default 'main', table_name text, name text, statement text, enabled boolean default true, primary key (schema_name, table_name, name));`,
+	}},
+	{15, "create query_log", []string{
+		`create table if not exists duckserver.query_log (type text, event_time timestamp, query_start_time timestamp, query_duration_ms bigint, read_rows bigint, read_bytes bigint, query text, exception text, username text, application text, protocol text);`,
+		`create schema if not exists system;`,
+		`create or replace view system.query_log as
+select type, event_time::date as event_date, event_time, query_start_time, query_duration_ms, read_rows, read_bytes,
+       query, exception, username as "user", application as client_name,
+       (case protocol when 'clickhouse' then 2 else 5 end)::utinyint as interface
+from duckserver.query_log;`,
+	}},
+	{16, "create named queries", []string{
+		`create table if not exists duckserver.named_queries (name text primary key, query text, owner text, created_at timestamp default current_timestamp);`,
+	}},
+	{17, "create user priorities", []string{
+		`create table if not exists duckserver.user_priorities (username text primary key, priority text check (lower(priority) in ('low', 'normal', 'high', 'batch', 'interactive')));`,
+	}},
+	{18, "create ingest spool offsets", []string{
+		`create table if not exists duckserver.ingest_spool (segment bigint primary key, applied_bytes bigint);`,
+	}},
+}
+
+// runMigrations applies the migrations not recorded in duckserver.schema_migrations, each in its own transaction
+func runMigrations(ctx context.Context, db *sql.DB) error {
+	if _, err := db.ExecContext(ctx, "create schema if not exists duckserver;"); err != nil {
+		return err
+	}
+	if _, err := db.ExecContext(ctx, "create table if not exists duckserver.schema_migrations (version integer primary key, name text, applied_at timestamp);"); err != nil {
+		return err
+	}
+	var current int
+	if err := db.QueryRowContext(ctx, "select coalesce(max(version), 0) from duckserver.schema_migrations").Scan(&current); err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		if err := applyMigration(ctx, db, m); err != nil {
+			return fmt.Errorf("migration %d %s: %w", m.version, m.name, err)
+		}
+		logrus.Infof("applied migration %d %s", m.version, m.name)
+	}
+	return nil
+}
+
+func applyMigration(ctx context.Context, db *sql.DB, m migration) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, stmt := range m.statements {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, "insert into duckserver.schema_migrations (version, name, applied_at) values ($1, $2, now())", m.version, m.name); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,296 @@
+package duckserver
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/goccy/go-json"
+	"github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// namedQueryPath is the path of the api registering the named queries of the clickhouse http endpoint
+const namedQueryPath = "/api/v1/named_queries"
+
+// namedQuerySetting runs the named query of its value instead of a query, with the param_ settings as parameters
+const namedQuerySetting = "named_query"
+
+// namedQueriesTTL is the interval between reloads of duckserver.named_queries, the api updates them immediately
+const namedQueriesTTL = 10 * time.Second
+
+// queryParameterRegexp matches the parameters of a named query, {name:Type} like the query parameters of clickhouse
+var queryParameterRegexp = regexp.MustCompile(`\{\s*([A-Za-z_]\w*)\s*:\s*([^{}]+?)\s*\}`)
+
+var namedQueryNameRegexp = regexp.MustCompile(`^[A-Za-z_][\w.-]*$`)
+
+type namedQueryParameter struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// namedQuery is a select registered under a name, dashboards run it with the values of its parameters, which are
+// bound as literals of their type so they can't change the statement
+type namedQuery struct {
+	Name       string                `json:"name"`
+	Query      string                `json:"query"`
+	Owner      string                `json:"owner"`
+	Parameters []namedQueryParameter `json:"parameters"`
+}
+
+// parseNamedQuery checks the statement of a named query and reads its parameters
+func parseNamedQuery(name, query, owner string) (*namedQuery, error) {
+	if !namedQueryNameRegexp.MatchString(name) {
+		return nil, fmt.Errorf("invalid named query name %q", name)
+	}
+	query = strings.TrimSpace(query)
+	if len(splitStatements(query)) != 1 || classifyStatement(query) != "select" {
+		return nil, fmt.Errorf("a named query is a single select statement")
+	}
+	q := &namedQuery{Name: name, Query: query, Owner: owner, Parameters: []namedQueryParameter{}}
+	seen := make(map[string]string)
+	for _, m := range queryParameterRegexp.FindAllStringSubmatch(query, -1) {
+		if typ, ok := seen[m[1]]; ok {
+			if typ != m[2] {
+				return nil, fmt.Errorf("parameter %s has types %s and %s", m[1], typ, m[2])
+			}
+			continue
+		}
+		seen[m[1]] = m[2]
+		q.Parameters = append(q.Parameters, namedQueryParameter{Name: m[1], Type: m[2]})
+	}
+	return q, nil
+}
+
+// Bind returns the statement with the values of the param_ settings, a value is cast to the type of its parameter
+// and an Identifier parameter is quoted as an identifier
+func (q *namedQuery) Bind(settings url.Values) (string, error) {
+	var err error
+	query := queryParameterRegexp.ReplaceAllStringFunc(q.Query, func(s string) string {
+		m := queryParameterRegexp.FindStringSubmatch(s)
+		value, ok := settings["param_"+m[1]]
+		if !ok {
+			if err == nil {
+				err = fmt.Errorf("Substitution `%s` is not set", m[1])
+			}
+			return s
+		}
+		typ := strings.TrimSpace(m[2])
+		switch {
+		case typ == "Identifier":
+			return quoteIdent(value[0])
+		case value[0] == `\N` && strings.HasPrefix(typ, "Nullable("):
+			return fmt.Sprintf("CAST(NULL AS %s)", translateChType(typ))
+		}
+		return fmt.Sprintf("CAST(%s AS %s)", quoteLiteral(value[0]), translateChType(typ))
+	})
+	return query, err
+}
+
+// namedQueries holds the queries of duckserver.named_queries
+type namedQueries struct {
+	db       *sql.DB
+	mu       sync.RWMutex
+	queries  map[string]*namedQuery
+	loadedAt time.Time
+}
+
+func newNamedQueries(db *sql.DB) *namedQueries {
+	return &namedQueries{db: db}
+}
+
+// Load reads duckserver.named_queries
+func (n *namedQueries) Load() error {
+	rows, err := n.db.Query("select name, query, owner from duckserver.named_queries")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	queries := make(map[string]*namedQuery)
+	for rows.Next() {
+		var name, query, owner string
+		if err = rows.Scan(&name, &query, &owner); err != nil {
+			return err
+		}
+		q, err := parseNamedQuery(name, query, owner)
+		if err != nil {
+			logrus.Warnf("named query %s: %v", name, err)
+			continue
+		}
+		queries[name] = q
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	n.mu.Lock()
+	n.queries, n.loadedAt = queries, time.Now()
+	n.mu.Unlock()
+	return nil
+}
+
+func (n *namedQueries) reload() {
+	n.mu.RLock()
+	stale := time.Since(n.loadedAt) > namedQueriesTTL
+	n.mu.RUnlock()
+	if !stale {
+		return
+	}
+	if err := n.Load(); err != nil {
+		logrus.Warnf("load named queries error: %v", err)
+	}
+}
+
+// Get returns a named query, nil if there is none
+func (n *namedQueries) Get(name string) *namedQuery {
+	n.reload()
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.queries[name]
+}
+
+// List returns the named queries sorted by name
+func (n *namedQueries) List() ([]*namedQuery, error) {
+	if err := n.Load(); err != nil {
+		return nil, err
+	}
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	list := make([]*namedQuery, 0, len(n.queries))
+	for _, q := range n.queries {
+		list = append(list, q)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+// errNamedQueryOwner is returned when a user replaces or drops a named query of another user
+var errNamedQueryOwner = errors.New("named query is owned by another user")
+
+// Put registers a named query, replacing a query of the same owner
+func (n *namedQueries) Put(ctx context.Context, q *namedQuery) error {
+	if existing := n.Get(q.Name); existing != nil && existing.Owner != q.Owner {
+		return errNamedQueryOwner
+	}
+	_, err := n.db.ExecContext(ctx, "insert or replace into duckserver.named_queries (name, query, owner) values ($1, $2, $3)", q.Name, q.Query, q.Owner)
+	if err != nil {
+		return err
+	}
+	n.mu.Lock()
+	if n.queries == nil {
+		n.queries = make(map[string]*namedQuery)
+	}
+	n.queries[q.Name] = q
+	n.mu.Unlock()
+	return nil
+}
+
+// Drop removes a named query of user, it reports false if there is none
+func (n *namedQueries) Drop(ctx context.Context, name, user string) (bool, error) {
+	existing := n.Get(name)
+	if existing == nil {
+		return false, nil
+	}
+	if existing.Owner != user {
+		return false, errNamedQueryOwner
+	}
+	if _, err := n.db.ExecContext(ctx, "delete from duckserver.named_queries where name = $1", name); err != nil {
+		return false, err
+	}
+	n.mu.Lock()
+	delete(n.queries, name)
+	n.mu.Unlock()
+	return true, nil
+}
+
+type namedQueryRequest struct {
+	Name  string `json:"name"`
+	Query string `json:"query"`
+}
+
+// serveNamedQueries serves the named queries api: GET lists the queries, or the query of ?name=, POST registers
+// the query of a json body {"name": ..., "query": ...}, or of ?name= with the query as body, and DELETE drops ?name=
+func (c *ChServer) serveNamedQueries(ctx context.Context, wr http.ResponseWriter, r *http.Request) {
+	user := UserFromContext(ctx)
+	queries := c.pgServer.namedQueries
+	name := r.URL.Query().Get("name")
+	// registering a query is like creating a view
+	if r.Method != http.MethodGet && len(c.statements) > 0 && !slices.Contains(c.statements, "ddl") {
+		writeApiError(wr, 403, errors.New("named queries can't be changed on this listener"))
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		if name != "" {
+			q := queries.Get(name)
+			if q == nil {
+				writeApiError(wr, 404, fmt.Errorf("named query %s not found", name))
+				return
+			}
+			wr.Header().Set("Content-Type", "application/json; charset=UTF-8")
+			_ = json.NewEncoder(wr).Encode(q)
+			return
+		}
+		list, err := queries.List()
+		if err != nil {
+			writeApiError(wr, 500, err)
+			return
+		}
+		wr.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		_ = json.NewEncoder(wr).Encode(list)
+	case http.MethodPost, http.MethodPut:
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeApiError(wr, 400, err)
+			return
+		}
+		req := namedQueryRequest{Name: name, Query: string(body)}
+		if name == "" {
+			if err = json.Unmarshal(body, &req); err != nil {
+				writeApiError(wr, 400, fmt.Errorf("invalid request: %w", err))
+				return
+			}
+		}
+		q, err := parseNamedQuery(req.Name, req.Query, user)
+		if err != nil {
+			writeApiError(wr, 400, err)
+			return
+		}
+		if err = c.pgServer.checkQuery(ctx, ProtocolClickhouse, q.Query); err != nil {
+			writeApiError(wr, 403, err)
+			return
+		}
+		if err = queries.Put(ctx, q); errors.Is(err, errNamedQueryOwner) {
+			writeApiError(wr, 403, err)
+			return
+		} else if err != nil {
+			writeApiError(wr, 500, err)
+			return
+		}
+		wr.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		_ = json.NewEncoder(wr).Encode(q)
+	case http.MethodDelete:
+		found, err := queries.Drop(ctx, name, user)
+		if errors.Is(err, errNamedQueryOwner) {
+			writeApiError(wr, 403, err)
+			return
+		} else if err != nil {
+			writeApiError(wr, 500, err)
+			return
+		}
+		if !found {
+			writeApiError(wr, 404, fmt.Errorf("named query %s not found", name))
+			return
+		}
+		wr.WriteHeader(http.StatusNoContent)
+	default:
+		writeApiError(wr, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
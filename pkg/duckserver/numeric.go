@@ -0,0 +1,100 @@
+package duckserver
+
+import (
+	"encoding/binary"
+	"github.com/marcboeker/go-duckdb"
+	"math/big"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// numeric sign values of the postgresql binary format
+const (
+	numericPositive = 0x0000
+	numericNegative = 0x4000
+)
+
+var decimalTypeRegexp = regexp.MustCompile(`^DECIMAL\((\d+),\s*(\d+)\)$`)
+
+// parseDecimalType returns the precision and scale of a DECIMAL(p,s) column type
+func parseDecimalType(typ string) (int, int, bool) {
+	m := decimalTypeRegexp.FindStringSubmatch(typ)
+	if m == nil {
+		return 0, 0, false
+	}
+	precision, _ := strconv.Atoi(m[1])
+	scale, _ := strconv.Atoi(m[2])
+	return precision, scale, true
+}
+
+// numericTypmod is the atttypmod of numeric(precision, scale) reported in RowDescription
+func numericTypmod(precision, scale int) int32 {
+	return int32(precision<<16|scale) + 4
+}
+
+// typeModifier returns the RowDescription type modifier of a DuckDB column type, 0 when it has none
+func typeModifier(typ string) int32 {
+	if precision, scale, ok := parseDecimalType(typ); ok {
+		return numericTypmod(precision, scale)
+	}
+	return 0
+}
+
+// valueTypeModifier returns the RowDescription type modifier of a column by its first value
+func valueTypeModifier(v any) int32 {
+	if d, ok := v.(duckdb.Decimal); ok {
+		return numericTypmod(int(d.Width), int(d.Scale))
+	}
+	return 0
+}
+
+// numericBinary encodes an unscaled value with scale in the postgresql binary numeric format: the number of
+// base 10000 digits, the weight of the first digit, the sign, the display scale and the digits
+func numericBinary(unscaled *big.Int, scale int) []byte {
+	sign := numericPositive
+	if unscaled.Sign() < 0 {
+		sign = numericNegative
+	}
+	str := new(big.Int).Abs(unscaled).String()
+	if len(str) <= scale {
+		str = strings.Repeat("0", scale-len(str)+1) + str
+	}
+	intPart, fracPart := str[:len(str)-scale], str[len(str)-scale:]
+	// align both parts to groups of 4 decimal digits around the decimal point
+	if n := len(intPart) % 4; n != 0 {
+		intPart = strings.Repeat("0", 4-n) + intPart
+	}
+	if n := len(fracPart) % 4; n != 0 {
+		fracPart += strings.Repeat("0", 4-n)
+	}
+	digits := make([]int16, 0, (len(intPart)+len(fracPart))/4)
+	for i := 0; i < len(intPart); i += 4 {
+		d, _ := strconv.Atoi(intPart[i : i+4])
+		digits = append(digits, int16(d))
+	}
+	for i := 0; i < len(fracPart); i += 4 {
+		d, _ := strconv.Atoi(fracPart[i : i+4])
+		digits = append(digits, int16(d))
+	}
+	weight := len(intPart)/4 - 1
+	for len(digits) > 0 && digits[0] == 0 {
+		digits = digits[1:]
+		weight--
+	}
+	for len(digits) > 0 && digits[len(digits)-1] == 0 {
+		digits = digits[:len(digits)-1]
+	}
+	if len(digits) == 0 {
+		weight, sign = 0, numericPositive
+	}
+	b := make([]byte, 0, 8+2*len(digits))
+	b = binary.BigEndian.AppendUint16(b, uint16(len(digits)))
+	b = binary.BigEndian.AppendUint16(b, uint16(int16(weight)))
+	b = binary.BigEndian.AppendUint16(b, uint16(sign))
+	b = binary.BigEndian.AppendUint16(b, uint16(scale))
+	for _, d := range digits {
+		b = binary.BigEndian.AppendUint16(b, uint16(d))
+	}
+	return b
+}
@@ -0,0 +1,671 @@
+package duckserver
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// partitionTableName matches a table name which may be qualified by its schema
+const partitionTableName = `(?:(` + chIdentPattern + `)\s*\.\s*)?(` + chIdentPattern + `)`
+
+// partitionedCreateRegexp matches CREATE TABLE t (columns) PARTITION BY [RANGE] key, the table is partitioned when
+// the key is a time partition key
+var partitionedCreateRegexp = regexp.MustCompile(`(?is)^\s*CREATE\s+TABLE\s+(IF\s+NOT\s+EXISTS\s+)?` + partitionTableName + `\s*\((.*)\)\s*PARTITION\s+BY\s+(?:RANGE\s*)?(.+?)[\s;]*$`)
+
+// partitionKeyRegexp matches date_trunc('month', ts) and the clickhouse partition keys like toYYYYMM(ts)
+var partitionKeyRegexp = regexp.MustCompile(`(?is)^\(?\s*(?:date_trunc\(\s*'(\w+)'\s*,\s*(` + chIdentPattern + `)\s*\)|(\w+)\(\s*(` + chIdentPattern + `)\s*\))\s*\)?$`)
+
+var dropPartitionRegexp = regexp.MustCompile(`(?is)^\s*ALTER\s+TABLE\s+` + partitionTableName + `\s+DROP\s+PARTITION\s+(?:ID\s+)?('(?:[^']|'')*'|\d+)[\s;]*$`)
+
+var partitionedDropRegexp = regexp.MustCompile(`(?is)^\s*DROP\s+(?:TABLE|VIEW)\s+(?:IF\s+EXISTS\s+)?` + partitionTableName + `[\s;]*$`)
+
+// partitionedInsertRegexp matches INSERT INTO t [(columns)] with a SELECT or VALUES source
+var partitionedInsertRegexp = regexp.MustCompile(`(?is)^\s*INSERT\s+INTO\s+` + partitionTableName + `\s*(?:\(([^()]*)\)\s*)?((?:SELECT|VALUES|WITH|FROM)\b.*?|\(.*?)[\s;]*$`)
+
+// partitionLayouts are the granularities of partitioned tables with the layout of the suffix of their partitions
+var partitionLayouts = map[string]string{"day": "2006_01_02", "month": "2006_01", "year": "2006"}
+
+// chPartitionFunctions are the granularities of the clickhouse functions of time partition keys
+var chPartitionFunctions = map[string]string{
+	"toyyyymmdd": "day", "todate": "day", "tostartofday": "day",
+	"toyyyymm": "month", "tostartofmonth": "month",
+	"toyear": "year", "tostartofyear": "year",
+}
+
+// partitionedTable is a table emulated by a view over a table per day, month or year of its time column, named after
+// the table with the partition suffix, e.g. events_2024_01. The rows without time are kept in the template table
+// events_template, which has the structure the partitions are created with.
+type partitionedTable struct {
+	schema      string
+	table       string
+	timeColumn  string
+	granularity string
+}
+
+func (p *partitionedTable) template() string {
+	return p.table + "_template"
+}
+
+func (p *partitionedTable) partition(start time.Time) string {
+	return p.table + "_" + start.Format(partitionLayouts[p.granularity])
+}
+
+func (p *partitionedTable) qualified(table string) string {
+	return quoteIdent(p.schema) + "." + quoteIdent(table)
+}
+
+// next returns the start of the partition after the partition starting at start
+func (p *partitionedTable) next(start time.Time) time.Time {
+	switch p.granularity {
+	case "day":
+		return start.AddDate(0, 0, 1)
+	case "month":
+		return start.AddDate(0, 1, 0)
+	}
+	return start.AddDate(1, 0, 0)
+}
+
+// parsePartition returns the start of the partition named name, ok is false for other tables
+func (p *partitionedTable) parsePartition(name string) (time.Time, bool) {
+	suffix, ok := strings.CutPrefix(name, p.table+"_")
+	if !ok {
+		return time.Time{}, false
+	}
+	start, err := time.Parse(partitionLayouts[p.granularity], suffix)
+	return start, err == nil
+}
+
+// parsePartitionID returns the start of the partition of DROP PARTITION id, the id has the digits of the start in
+// the order of the suffix, e.g. 202401, '2024-01' or '2024-01-01' of a monthly partition
+func (p *partitionedTable) parsePartitionID(id string) (time.Time, error) {
+	if unquoted, ok := unquoteLiteral(id); ok {
+		id = unquoted
+	}
+	digits := strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, id)
+	layout := strings.ReplaceAll(partitionLayouts[p.granularity], "_", "")
+	if len(digits) >= len(layout) {
+		if start, err := time.Parse(layout, digits[:len(layout)]); err == nil {
+			return start, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid partition %s of %s, expected a %s like %s", id, p.table, p.granularity, time.Now().Format(layout))
+}
+
+// parsePartitionKey returns the time column and the granularity of a time partition key, ok is false for other keys
+func parsePartitionKey(key string) (column, granularity string, ok bool) {
+	m := partitionKeyRegexp.FindStringSubmatch(strings.TrimSpace(key))
+	if m == nil {
+		return "", "", false
+	}
+	if m[2] != "" {
+		granularity = strings.ToLower(m[1])
+		_, ok = partitionLayouts[granularity]
+		return chUnquote(m[2]), granularity, ok
+	}
+	granularity, ok = chPartitionFunctions[strings.ToLower(m[3])]
+	return chUnquote(m[4]), granularity, ok
+}
+
+// partitionSchema returns the schema of a table name qualified by qualifier, the default schema when it's empty
+func partitionSchema(qualifier, schema string) string {
+	if qualifier != "" {
+		schema = chUnquote(qualifier)
+	}
+	if schema == "default" || schema == "public" {
+		return "main"
+	}
+	return schema
+}
+
+// partitionedTables caches duckserver.partitioned_tables as it's looked up by every insert, ddlMu serializes the
+// transactions creating and dropping partitions
+type partitionedTables struct {
+	mu     sync.RWMutex
+	tables map[string]*partitionedTable
+	ddlMu  sync.Mutex
+}
+
+func partitionedTableKey(schema, table string) string {
+	return strings.ToLower(schema) + "." + strings.ToLower(table)
+}
+
+func loadPartitionedTables(ctx context.Context, db *sql.DB) (*partitionedTables, error) {
+	rows, err := db.QueryContext(ctx, "select coalesce(schema_name, 'main'), table_name, time_column, granularity from duckserver.partitioned_tables")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	t := &partitionedTables{tables: make(map[string]*partitionedTable)}
+	for rows.Next() {
+		p := &partitionedTable{}
+		if err = rows.Scan(&p.schema, &p.table, &p.timeColumn, &p.granularity); err != nil {
+			return nil, err
+		}
+		if _, ok := partitionLayouts[p.granularity]; !ok {
+			logrus.Warnf("skip partitioned table %s.%s, invalid granularity %s", p.schema, p.table, p.granularity)
+			continue
+		}
+		t.tables[partitionedTableKey(p.schema, p.table)] = p
+	}
+	return t, rows.Err()
+}
+
+// Get returns the partitioned table schema.table, nil if it isn't partitioned
+func (t *partitionedTables) Get(schema, table string) *partitionedTable {
+	if t == nil {
+		return nil
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.tables[partitionedTableKey(schema, table)]
+}
+
+func (t *partitionedTables) Empty() bool {
+	if t == nil {
+		return true
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return len(t.tables) == 0
+}
+
+func (t *partitionedTables) put(p *partitionedTable) {
+	t.mu.Lock()
+	t.tables[partitionedTableKey(p.schema, p.table)] = p
+	t.mu.Unlock()
+}
+
+func (t *partitionedTables) remove(p *partitionedTable) {
+	t.mu.Lock()
+	delete(t.tables, partitionedTableKey(p.schema, p.table))
+	t.mu.Unlock()
+}
+
+// isPartitionCommand reports whether runPartitionCommand runs the query
+func (s *PgServer) isPartitionCommand(schema, query string) bool {
+	if m := partitionedCreateRegexp.FindStringSubmatch(query); m != nil {
+		_, _, ok := parsePartitionKey(m[5])
+		return ok
+	}
+	if dropPartitionRegexp.MatchString(query) {
+		return true
+	}
+	if s.partitions.Empty() {
+		return false
+	}
+	for _, re := range []*regexp.Regexp{partitionedDropRegexp, partitionedInsertRegexp} {
+		if m := re.FindStringSubmatch(query); m != nil {
+			return s.partitions.Get(partitionSchema(m[1], schema), chUnquote(m[2])) != nil
+		}
+	}
+	return false
+}
+
+// runPartitionCommand runs the statements on partitioned tables: CREATE TABLE with a time partition key, ALTER TABLE
+// DROP PARTITION, DROP TABLE and INSERT, ok is false for other statements. Inserts run on conn, which is in a
+// transaction when inTx, nil connects a new one. Unqualified names are in schema.
+func (s *PgServer) runPartitionCommand(ctx context.Context, conn driver.Conn, inTx bool, schema, query string) (tag string, rows int64, ok bool, err error) {
+	if m := partitionedCreateRegexp.FindStringSubmatch(query); m != nil {
+		column, granularity, isKey := parsePartitionKey(m[5])
+		if !isKey {
+			return "", 0, false, nil
+		}
+		return "CREATE TABLE", 0, true, s.createPartitionedTable(ctx, partitionSchema(m[2], schema), chUnquote(m[3]), m[1] != "", m[4], column, granularity)
+	}
+	if m := dropPartitionRegexp.FindStringSubmatch(query); m != nil {
+		p := s.partitions.Get(partitionSchema(m[1], schema), chUnquote(m[2]))
+		if p == nil {
+			return "ALTER TABLE", 0, true, fmt.Errorf("table %s isn't partitioned", chUnquote(m[2]))
+		}
+		return "ALTER TABLE", 0, true, s.dropPartition(ctx, p, m[3])
+	}
+	if s.partitions.Empty() {
+		return "", 0, false, nil
+	}
+	if m := partitionedDropRegexp.FindStringSubmatch(query); m != nil {
+		if p := s.partitions.Get(partitionSchema(m[1], schema), chUnquote(m[2])); p != nil {
+			return "DROP TABLE", 0, true, s.dropPartitionedTable(ctx, p)
+		}
+		return "", 0, false, nil
+	}
+	if m := partitionedInsertRegexp.FindStringSubmatch(query); m != nil {
+		p := s.partitions.Get(partitionSchema(m[1], schema), chUnquote(m[2]))
+		if p == nil {
+			return "", 0, false, nil
+		}
+		var columns []string
+		if strings.TrimSpace(m[3]) != "" {
+			for _, col := range splitTopLevel(m[3]) {
+				columns = append(columns, chUnquote(col))
+			}
+		}
+		rows, err = s.insertPartitioned(ctx, conn, inTx, p, columns, m[4])
+		return "INSERT", rows, true, err
+	}
+	return "", 0, false, nil
+}
+
+// createPartitionedTable creates the template table with the column definitions and the view of a partitioned table
+// without partitions, the time column must be a DATE or a TIMESTAMP
+func (s *PgServer) createPartitionedTable(ctx context.Context, schema, table string, ifNotExists bool, columns, timeColumn, granularity string) error {
+	if s.partitions.Get(schema, table) != nil {
+		if ifNotExists {
+			return nil
+		}
+		return fmt.Errorf("table %s.%s already exists", schema, table)
+	}
+	p := &partitionedTable{schema: schema, table: table, timeColumn: timeColumn, granularity: granularity}
+	err := s.withPartitionTx(ctx, func(conn driver.Conn) error {
+		if _, err := execDriver(ctx, conn, fmt.Sprintf("CREATE TABLE %s (%s)", p.qualified(p.template()), columns)); err != nil {
+			return err
+		}
+		names, types, err := queryTableColumnTypes(ctx, conn, schema, p.template())
+		if err != nil {
+			return err
+		}
+		found := false
+		for i, name := range names {
+			if strings.EqualFold(name, timeColumn) {
+				if types[i] != "DATE" && !strings.HasPrefix(types[i], "TIMESTAMP") {
+					return fmt.Errorf("partition column %s must be a DATE or a TIMESTAMP, not %s", timeColumn, types[i])
+				}
+				p.timeColumn, found = name, true
+			}
+		}
+		if !found {
+			return fmt.Errorf("partition column %s not found in %s", timeColumn, table)
+		}
+		if _, err = execDriver(ctx, conn, "insert into duckserver.partitioned_tables (schema_name, table_name, time_column, granularity) values ($1, $2, $3, $4)",
+			schema, table, p.timeColumn, granularity); err != nil {
+			return err
+		}
+		return createPartitionView(ctx, conn, p, nil)
+	})
+	if err != nil {
+		return err
+	}
+	s.partitions.put(p)
+	logrus.Infof("created table %s.%s partitioned by %s of %s", schema, table, granularity, p.timeColumn)
+	return nil
+}
+
+// dropPartition drops the partition of id, there is nothing to drop if the partition wasn't created
+func (s *PgServer) dropPartition(ctx context.Context, p *partitionedTable, id string) error {
+	start, err := p.parsePartitionID(id)
+	if err != nil {
+		return err
+	}
+	return s.withPartitionTx(ctx, func(conn driver.Conn) error {
+		starts, err := listPartitions(ctx, conn, p)
+		if err != nil {
+			return err
+		}
+		i := sort.Search(len(starts), func(i int) bool { return !starts[i].Before(start) })
+		if i == len(starts) || !starts[i].Equal(start) {
+			return nil
+		}
+		// the view is replaced first so the partition isn't referenced anymore
+		if err = createPartitionView(ctx, conn, p, append(starts[:i:i], starts[i+1:]...)); err != nil {
+			return err
+		}
+		_, err = execDriver(ctx, conn, "DROP TABLE "+p.qualified(p.partition(start)))
+		return err
+	})
+}
+
+// dropPartitionedTable drops the view, the partitions and the template of a partitioned table with its metadata
+func (s *PgServer) dropPartitionedTable(ctx context.Context, p *partitionedTable) error {
+	err := s.withPartitionTx(ctx, func(conn driver.Conn) error {
+		starts, err := listPartitions(ctx, conn, p)
+		if err != nil {
+			return err
+		}
+		statements := []string{"DROP VIEW " + p.qualified(p.table)}
+		for _, start := range starts {
+			statements = append(statements, "DROP TABLE "+p.qualified(p.partition(start)))
+		}
+		statements = append(statements, "DROP TABLE "+p.qualified(p.template()))
+		for _, stmt := range statements {
+			if _, err = execDriver(ctx, conn, stmt); err != nil {
+				return err
+			}
+		}
+		for _, table := range []string{"duckserver.partitioned_tables", "duckserver.ch_tables", "duckserver.dedup_keys", "duckserver.ttl_policies"} {
+			if _, err = execDriver(ctx, conn, "delete from "+table+" where schema_name = $1 and table_name = $2", p.schema, p.table); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.partitions.remove(p)
+	return nil
+}
+
+// insertPartitioned inserts the rows of a SELECT or VALUES source into a partitioned table, the rows are staged and
+// routed to their partitions in a transaction
+func (s *PgServer) insertPartitioned(ctx context.Context, conn driver.Conn, inTx bool, p *partitionedTable, columns []string, source string) (int64, error) {
+	if conn == nil {
+		c, err := s.Connector.Connect(ctx)
+		if err != nil {
+			return 0, err
+		}
+		defer c.Close()
+		conn = c
+	}
+	var err error
+	if len(columns) == 0 {
+		if columns, _, err = queryTableColumnTypes(ctx, conn, p.schema, p.template()); err != nil {
+			return 0, err
+		}
+	}
+	staging, err := createPartitionStaging(ctx, conn, p, columns)
+	if err != nil {
+		return 0, err
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			_, _ = execDriver(context.Background(), conn, "DROP TABLE IF EXISTS duckserver."+quoteIdent(staging))
+		}
+	}()
+	result, err := execDriver(ctx, conn, fmt.Sprintf("INSERT INTO duckserver.%s (%s) %s", quoteIdent(staging), quoteIdents(columns), source))
+	if err != nil {
+		return 0, err
+	}
+	rows, _ := result.RowsAffected()
+	starts, err := s.preparePartitions(ctx, conn, inTx, p, staging)
+	if err != nil {
+		return 0, err
+	}
+	if !inTx {
+		if _, err = execDriver(ctx, conn, "BEGIN TRANSACTION"); err != nil {
+			return 0, err
+		}
+		defer func() {
+			if !committed {
+				_, _ = execDriver(context.Background(), conn, "ROLLBACK")
+			}
+		}()
+	}
+	if err = routePartitions(ctx, conn, p, staging, columns, starts); err != nil {
+		return 0, err
+	}
+	if _, err = execDriver(ctx, conn, "DROP TABLE duckserver."+quoteIdent(staging)); err != nil {
+		return 0, err
+	}
+	if !inTx {
+		if _, err = execDriver(ctx, conn, "COMMIT"); err != nil {
+			return 0, err
+		}
+	}
+	committed = true
+	return rows, nil
+}
+
+// createPartitionStaging creates an empty staging table in duckserver schema with the inserted columns of a
+// partitioned table, the time column must be inserted to route the rows
+func createPartitionStaging(ctx context.Context, conn driver.Conn, p *partitionedTable, columns []string) (string, error) {
+	found := false
+	for _, col := range columns {
+		found = found || strings.EqualFold(col, p.timeColumn)
+	}
+	if !found {
+		return "", fmt.Errorf("partition column %s of %s must be inserted", p.timeColumn, p.table)
+	}
+	return createStagingTable(ctx, conn.(driver.ExecerContext), "partition_staging_", p.schema, p.template(), columns)
+}
+
+// preparePartitions returns the starts of the partitions of the staged rows and creates the missing partitions. They
+// are created in a transaction of their own unless conn is in a transaction, as a transaction doesn't see the tables
+// created after it began.
+func (s *PgServer) preparePartitions(ctx context.Context, conn driver.Conn, inTx bool, p *partitionedTable, staging string) ([]time.Time, error) {
+	col := fmt.Sprintf("cast(%s as timestamp)", quoteIdent(p.timeColumn))
+	values, err := queryDriverStrings(ctx, conn, fmt.Sprintf("select distinct strftime(date_trunc('%s', %s), '%%Y-%%m-%%d') from duckserver.%s where %s is not null",
+		p.granularity, col, quoteIdent(staging), col))
+	if err != nil {
+		return nil, err
+	}
+	starts := make([]time.Time, 0, len(values))
+	for _, v := range values {
+		start, err := time.Parse(time.DateOnly, v)
+		if err != nil {
+			return nil, err
+		}
+		starts = append(starts, start)
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i].Before(starts[j]) })
+	existing, err := listPartitions(ctx, conn, p)
+	if err != nil {
+		return nil, err
+	}
+	if len(missingPartitions(existing, starts)) == 0 {
+		return starts, nil
+	}
+	if inTx {
+		return starts, createPartitions(ctx, conn, p, starts)
+	}
+	return starts, s.withPartitionTx(ctx, func(conn driver.Conn) error {
+		return createPartitions(ctx, conn, p, starts)
+	})
+}
+
+// routePartitions copies the staged rows to the partitions starting at starts and the rows without time to the
+// template
+func routePartitions(ctx context.Context, conn driver.Conn, p *partitionedTable, staging string, columns []string, starts []time.Time) error {
+	cols := quoteIdents(columns)
+	source := "duckserver." + quoteIdent(staging)
+	col := fmt.Sprintf("cast(%s as timestamp)", quoteIdent(p.timeColumn))
+	for _, start := range starts {
+		if _, err := execDriver(ctx, conn, fmt.Sprintf("insert into %s (%s) select %s from %s where %s >= cast($1 as timestamp) and %s < cast($2 as timestamp)",
+			p.qualified(p.partition(start)), cols, cols, source, col, col), start.Format(time.DateTime), p.next(start).Format(time.DateTime)); err != nil {
+			return err
+		}
+	}
+	_, err := execDriver(ctx, conn, fmt.Sprintf("insert into %s (%s) select %s from %s where %s is null",
+		p.qualified(p.template()), cols, cols, source, quoteIdent(p.timeColumn)))
+	return err
+}
+
+// createPartitions creates the missing partitions of starts with the structure of the template and replaces the view
+func createPartitions(ctx context.Context, conn driver.Conn, p *partitionedTable, starts []time.Time) error {
+	existing, err := listPartitions(ctx, conn, p)
+	if err != nil {
+		return err
+	}
+	missing := missingPartitions(existing, starts)
+	if len(missing) == 0 {
+		return nil
+	}
+	ddl, err := queryDriverStrings(ctx, conn, "select sql from duckdb_tables() where database_name = current_database() and schema_name = $1 and table_name = $2",
+		p.schema, p.template())
+	if err != nil {
+		return err
+	}
+	if len(ddl) == 0 {
+		return fmt.Errorf("template table %s of %s not found", p.template(), p.table)
+	}
+	// the columns of the template follow its name, the partitions keep their defaults and constraints
+	var columns string
+	for _, t := range chTokenize(ddl[0]) {
+		if strings.HasPrefix(t.text, "(") {
+			columns = strings.TrimRight(ddl[0][t.start:], "; \t\r\n")
+			break
+		}
+	}
+	for _, start := range missing {
+		if _, err = execDriver(ctx, conn, "CREATE TABLE IF NOT EXISTS "+p.qualified(p.partition(start))+columns); err != nil {
+			return err
+		}
+		logrus.Infof("created partition %s of %s.%s", p.partition(start), p.schema, p.table)
+	}
+	metrics.Add("duckserver_partitions_created_total", float64(len(missing)))
+	starts = append(existing, missing...)
+	sort.Slice(starts, func(i, j int) bool { return starts[i].Before(starts[j]) })
+	return createPartitionView(ctx, conn, p, starts)
+}
+
+// missingPartitions returns the starts which aren't in existing, both sorted
+func missingPartitions(existing, starts []time.Time) []time.Time {
+	var missing []time.Time
+	for _, start := range starts {
+		i := sort.Search(len(existing), func(i int) bool { return !existing[i].Before(start) })
+		if i == len(existing) || !existing[i].Equal(start) {
+			missing = append(missing, start)
+		}
+	}
+	return missing
+}
+
+// listPartitions returns the sorted starts of the partitions of p
+func listPartitions(ctx context.Context, conn driver.Conn, p *partitionedTable) ([]time.Time, error) {
+	names, err := queryDriverStrings(ctx, conn, "select table_name from duckdb_tables() where database_name = current_database() and schema_name = $1 and starts_with(table_name, $2)",
+		p.schema, p.table+"_")
+	if err != nil {
+		return nil, err
+	}
+	var starts []time.Time
+	for _, name := range names {
+		if start, ok := p.parsePartition(name); ok {
+			starts = append(starts, start)
+		}
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i].Before(starts[j]) })
+	return starts, nil
+}
+
+// createPartitionView replaces the view of p with the union of the template and the partitions starting at starts,
+// each partition is filtered by its time range so DuckDB prunes the partitions out of the range of a query
+func createPartitionView(ctx context.Context, conn driver.Conn, p *partitionedTable, starts []time.Time) error {
+	var sb strings.Builder
+	_, _ = fmt.Fprintf(&sb, "CREATE OR REPLACE VIEW %s AS SELECT * FROM %s", p.qualified(p.table), p.qualified(p.template()))
+	col := quoteIdent(p.timeColumn)
+	for _, start := range starts {
+		_, _ = fmt.Fprintf(&sb, " UNION ALL SELECT * FROM %s WHERE %s >= TIMESTAMP '%s' AND %s < TIMESTAMP '%s'",
+			p.qualified(p.partition(start)), col, start.Format(time.DateTime), col, p.next(start).Format(time.DateTime))
+	}
+	_, err := execDriver(ctx, conn, sb.String())
+	return err
+}
+
+// expirePartitions drops the partitions of p ending before cutoff and deletes the rows before cutoff of the partition
+// containing it, it returns the number of deleted rows
+func (s *PgServer) expirePartitions(ctx context.Context, p *partitionedTable, cutoff time.Time) (int64, error) {
+	var deleted int64
+	err := s.withPartitionTx(ctx, func(conn driver.Conn) error {
+		deleted = 0
+		starts, err := listPartitions(ctx, conn, p)
+		if err != nil {
+			return err
+		}
+		i := sort.Search(len(starts), func(i int) bool { return p.next(starts[i]).After(cutoff) })
+		if i > 0 {
+			if err = createPartitionView(ctx, conn, p, starts[i:]); err != nil {
+				return err
+			}
+		}
+		for _, start := range starts[:i] {
+			counts, err := queryDriverStrings(ctx, conn, "select cast(count(*) as varchar) from "+p.qualified(p.partition(start)))
+			if err != nil {
+				return err
+			}
+			if _, err = execDriver(ctx, conn, "DROP TABLE "+p.qualified(p.partition(start))); err != nil {
+				return err
+			}
+			var n int64
+			_, _ = fmt.Sscan(counts[0], &n)
+			deleted += n
+			logrus.Infof("ttl dropped partition %s of %s.%s", p.partition(start), p.schema, p.table)
+		}
+		if i < len(starts) && starts[i].Before(cutoff) {
+			result, err := execDriver(ctx, conn, fmt.Sprintf("DELETE FROM %s WHERE %s < CAST($1 AS TIMESTAMP)", p.qualified(p.partition(starts[i])), quoteIdent(p.timeColumn)),
+				cutoff.Format("2006-01-02 15:04:05.999999"))
+			if err != nil {
+				return err
+			}
+			n, _ := result.RowsAffected()
+			deleted += n
+		}
+		return nil
+	})
+	return deleted, err
+}
+
+// withPartitionTx runs fn in a transaction of a new connection, the transactions creating or dropping partitions are
+// serialized so concurrent inserts don't conflict creating the same partition
+func (s *PgServer) withPartitionTx(ctx context.Context, fn func(conn driver.Conn) error) error {
+	s.partitions.ddlMu.Lock()
+	defer s.partitions.ddlMu.Unlock()
+	conn, err := s.Connector.Connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err = execDriver(ctx, conn, "BEGIN TRANSACTION"); err != nil {
+		return err
+	}
+	if err = fn(conn); err != nil {
+		_, _ = execDriver(context.Background(), conn, "ROLLBACK")
+		return err
+	}
+	_, err = execDriver(ctx, conn, "COMMIT")
+	return err
+}
+
+// execDriver runs a statement with its arguments on a driver connection
+func execDriver(ctx context.Context, conn driver.Conn, query string, args ...driver.Value) (driver.Result, error) {
+	return conn.(driver.ExecerContext).ExecContext(ctx, query, namedValues(args))
+}
+
+// queryDriverStrings returns the first column of the rows of a query on a driver connection, which must be a string
+func queryDriverStrings(ctx context.Context, conn driver.Conn, query string, args ...driver.Value) ([]string, error) {
+	rows, err := conn.(driver.QueryerContext).QueryContext(ctx, query, namedValues(args))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []string
+	values := make([]driver.Value, len(rows.Columns()))
+	for {
+		if err = rows.Next(values); err == io.EOF {
+			return result, nil
+		} else if err != nil {
+			return nil, err
+		}
+		s, _ := values[0].(string)
+		result = append(result, s)
+	}
+}
+
+// partitionCommand runs the statements on partitioned tables on a postgresql connection, it reports false for other
+// statements
+func (c *PgConn) partitionCommand(query string) (bool, error) {
+	tag, rows, ok, err := c.server.runPartitionCommand(context.Background(), c.conn, c.txStatus != TransactionStatusIdle, "main", query)
+	if !ok {
+		return false, nil
+	}
+	if err != nil {
+		return true, c.SendErrorResponse(err.Error())
+	}
+	c.server.notifySchemaChange(query)
+	if tag == "INSERT" {
+		tag = fmt.Sprintf("INSERT 0 %d", rows)
+	}
+	return true, c.SendCommandComplete(tag)
+}
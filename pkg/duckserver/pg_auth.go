@@ -0,0 +1,113 @@
+package duckserver
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+)
+
+// SqlStateInvalidPassword is the SQLSTATE of a failed password authentication
+const SqlStateInvalidPassword = "28P01"
+
+// authFailed tells the client the authentication of user failed with a FATAL error, the error returned closes the
+// connection instead of starting the session
+func (c *PgConn) authFailed(user string, err error) error {
+	logrus.Infof("password authentication failed for user %s: %v", user, err)
+	if sendErr := c.sendFatal(SqlStateInvalidPassword, fmt.Sprintf("password authentication failed for user %s", user)); sendErr != nil {
+		logrus.Tracef("send authentication error: %v", sendErr)
+	}
+	return fmt.Errorf("password authentication failed for user %s: %w", user, err)
+}
+
+func (c *PgConn) Auth(user string) error {
+	if c.listener.options.Auth == false {
+		return c.NoAuth()
+	}
+	// the address of a proxied connection is the one claimed by the proxy, local clients of the proxy aren't trusted
+	if !c.listener.options.ProxyProtocol && isLocalAddr(c.wire.conn.RemoteAddr()) {
+		return c.NoAuth()
+	}
+	if _, err := c.server.authProvider.LookupCredentials(user); errors.Is(err, ErrNoStoredCredentials) {
+		return c.CleartextPasswordAuth(user)
+	}
+	return c.ScramSha256Auth(user)
+}
+
+// CleartextPasswordAuth is used for providers which can only verify plain passwords, e.g. ldap
+func (c *PgConn) CleartextPasswordAuth(user string) error {
+	if err := c.wire.WriteMessage(NewMessage('R', cint32(3))); err != nil {
+		return err
+	}
+	msg, err := c.wire.ReadMessage()
+	if err != nil {
+		return err
+	}
+	passwordMsg, err := ParsePasswordMessage(msg)
+	if err != nil {
+		return err
+	}
+	if err = c.server.authProvider.VerifyPassword(user, passwordMsg.Password); err != nil {
+		return c.authFailed(user, err)
+	}
+	return c.wire.WriteAuthOK()
+}
+
+func (c *PgConn) NoAuth() error {
+	return c.wire.WriteAuthOK()
+}
+
+// ScramSha256Auth authenticates with SCRAM-SHA-256, over TLS SCRAM-SHA-256-PLUS with channel binding is offered too
+func (c *PgConn) ScramSha256Auth(user string) error {
+	mechanisms := []string{scramSha256}
+	if c.wire.channelBinding != nil {
+		mechanisms = []string{scramSha256Plus, scramSha256}
+	}
+	if err := c.wire.WriteMessage(NewAuthenticationSASLMessage(mechanisms)); err != nil {
+		return err
+	}
+	msg, err := c.wire.ReadMessage()
+	if err != nil {
+		return err
+	}
+	saslInitialMsg, err := ParseSASLInitialResponseMessage(msg)
+	if err != nil {
+		return c.authFailed(user, err)
+	}
+	credentials, err := c.server.authProvider.LookupCredentials(user)
+	if err != nil {
+		return c.authFailed(user, err)
+	}
+	conversation, err := newScramConversation(saslInitialMsg.Mechanism, credentials, c.wire.channelBinding)
+	if err != nil {
+		return c.authFailed(user, err)
+	}
+	resp, err := conversation.First(string(saslInitialMsg.Initial))
+	if err != nil {
+		return c.authFailed(user, err)
+	}
+	if err = c.wire.WriteMessage(NewMessage('R', append(cint32(11), []byte(resp)...))); err != nil {
+		return err
+	}
+	if msg, err = c.wire.ReadMessage(); err != nil {
+		return err
+	}
+	saslFinalMsg, err := ParseSASLResponseMessage(msg)
+	if err != nil {
+		return c.authFailed(user, err)
+	}
+	if resp, err = conversation.Final(string(saslFinalMsg.Data)); err != nil {
+		return c.authFailed(user, err)
+	}
+	if err = c.wire.WriteMessage(NewMessage('R', append(cint32(12), []byte(resp)...))); err != nil {
+		return err
+	}
+	return c.wire.WriteAuthOK()
+}
+
+func computeHMAC(key, msg []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(msg)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,163 @@
+package duckserver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/xdg-go/scram"
+	"io"
+	"net"
+	"time"
+)
+
+// pgClient is a minimal postgresql protocol client with simple queries and COPY FROM STDIN, used by the bench command
+type pgClient struct {
+	conn net.Conn
+	wire *Wire
+}
+
+func dialPg(addr, user, password string) (*pgClient, error) {
+	conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	c := &pgClient{conn: conn, wire: newWire(conn, nil, 0, maxMessageLength)}
+	if err = c.startup(user, password); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *pgClient) Close() error {
+	_ = c.wire.WriteMessage(NewMessage(Terminate, nil))
+	_ = c.wire.Flush()
+	return c.conn.Close()
+}
+
+func (c *pgClient) startup(user, password string) error {
+	body := cint32(StartupMessageVersion)
+	body = append(body, cstr("user")...)
+	body = append(body, cstr(user)...)
+	body = append(body, 0)
+	if _, err := c.wire.Write(append(cint32(len(body)+4), body...)); err != nil {
+		return err
+	}
+	var conversation *scram.ClientConversation
+	for {
+		msg, err := c.wire.ReadMessage()
+		if err != nil {
+			return err
+		}
+		d, err := msg.Read()
+		if err != nil {
+			return err
+		}
+		switch msg.Typ {
+		case ErrorResponse:
+			return errorResponseError(d)
+		case ReadyForQuery:
+			return nil
+		case Authentication:
+			if len(d) < 4 {
+				return errors.New("invalid authentication message")
+			}
+			switch binary.BigEndian.Uint32(d) {
+			case 0:
+			case 3:
+				if err = c.wire.WriteMessage(NewMessage(PasswordMessage, cstr(password))); err != nil {
+					return err
+				}
+			case 10:
+				client, err := scram.SHA256.NewClient(user, password, "")
+				if err != nil {
+					return err
+				}
+				conversation = client.NewConversation()
+				first, err := conversation.Step("")
+				if err != nil {
+					return err
+				}
+				payload := append(cstr(scramSha256), cint32(len(first))...)
+				if err = c.wire.WriteMessage(NewMessage(SASLInitialResponse, append(payload, first...))); err != nil {
+					return err
+				}
+			case 11, 12:
+				if conversation == nil {
+					return errors.New("unexpected SASL message")
+				}
+				resp, err := conversation.Step(string(d[4:]))
+				if err != nil {
+					return err
+				}
+				if binary.BigEndian.Uint32(d) == 11 {
+					if err = c.wire.WriteMessage(NewMessage(SASLResponse, []byte(resp))); err != nil {
+						return err
+					}
+				}
+			default:
+				return fmt.Errorf("unsupported authentication type %d", binary.BigEndian.Uint32(d))
+			}
+		}
+	}
+}
+
+// Query runs a simple query and discards the result
+func (c *pgClient) Query(query string) error {
+	if err := c.wire.WriteMessage(NewMessage(Query, cstr(query))); err != nil {
+		return err
+	}
+	return c.readResult(nil)
+}
+
+// CopyIn runs COPY ... FROM STDIN with data
+func (c *pgClient) CopyIn(query string, data []byte) error {
+	if err := c.wire.WriteMessage(NewMessage(Query, cstr(query))); err != nil {
+		return err
+	}
+	return c.readResult(data)
+}
+
+// readResult reads the responses until ReadyForQuery, copyData is sent when the server asks for COPY data
+func (c *pgClient) readResult(copyData []byte) error {
+	var queryErr error
+	for {
+		msg, err := c.wire.ReadMessage()
+		if err != nil {
+			return err
+		}
+		switch msg.Typ {
+		case ErrorResponse:
+			d, err := msg.Read()
+			if err != nil {
+				return err
+			}
+			queryErr = errorResponseError(d)
+		case CopyInResponse:
+			if copyData != nil {
+				if err = c.wire.WriteMessage(NewMessage(CopyData, copyData)); err != nil {
+					return err
+				}
+			}
+			if err = c.wire.WriteMessage(NewMessage(CopyDone, nil)); err != nil {
+				return err
+			}
+		case ReadyForQuery:
+			return queryErr
+		}
+	}
+}
+
+// errorResponseError returns the message field of an ErrorResponse as error
+func errorResponseError(d []byte) error {
+	for len(d) > 1 {
+		field := d[0]
+		value, rest, _ := bytes.Cut(d[1:], []byte{0})
+		if field == 'M' {
+			return errors.New(string(value))
+		}
+		d = rest
+	}
+	return io.ErrUnexpectedEOF
+}
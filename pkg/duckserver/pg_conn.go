@@ -0,0 +1,1442 @@
+package duckserver
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"github.com/marcboeker/go-duckdb"
+	"github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"regexp"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var parameterStatus = map[string]string{
+	"client_encoding":             "UTF8",
+	"standard_conforming_strings": "on",
+}
+
+type portal struct {
+	stmt   *stmtDesc
+	values []driver.Value
+	// resultFormats are the result column format codes of the Bind message
+	resultFormats []int16
+}
+
+type stmtDesc struct {
+	query    string
+	stmt     driver.Stmt
+	columns  [][2]string
+	numInput int
+	set      *setCommand
+	// cursor and savepoint are the commands the server runs instead of DuckDB
+	cursor    *cursorCommand
+	savepoint *savepointCommand
+	// paramOids are the parameter types of the Parse message, or inferred by DuckDB where the client left them 0
+	paramOids []int32
+	// clientParamOids are the parameter types of the Parse message, kept to prepare the statement again
+	clientParamOids []int32
+	// schemaVersion is the server schema version the statement was prepared at
+	schemaVersion uint64
+}
+
+type PgConn struct {
+	wire     *Wire
+	server   *PgServer
+	listener *pgListener
+	conn     driver.Conn
+	db       *sql.DB
+	stmts    map[string]*stmtDesc
+	portal   map[string]portal
+	cancel   context.CancelFunc
+	keyData  [8]byte
+	inError  bool
+	user     string
+	// database is the database of the startup message, the main database if it doesn't exist
+	database string
+	// catalogAlias is the database of the startup message when it doesn't exist, names qualified with it refer
+	// to the database
+	catalogAlias string
+	// profiling is set with SET duckserver_profiling
+	profiling bool
+	// queryStats is set with SET duckserver_query_stats
+	queryStats bool
+	// copyProgressInterval and copyCommitRows are set with SET duckserver_copy_progress and duckserver_copy_commit_rows
+	copyProgressInterval time.Duration
+	copyCommitRows       int
+	// idleInTransactionTimeout and transactionTimeout are set with SET idle_in_transaction_session_timeout and
+	// transaction_timeout, txStart is the time the transaction began and readDeadline the deadline of the connection
+	idleInTransactionTimeout time.Duration
+	transactionTimeout       time.Duration
+	txStart                  time.Time
+	readDeadline             time.Time
+	// resultFormats are the result format codes of the portal being described or executed, nil for text
+	resultFormats []int16
+	// location is the time zone set by the session, nil until it sets one, and tzColumns the TIMESTAMPTZ columns
+	// of the result being sent rendered in it
+	location  *time.Location
+	tzColumns []bool
+	// lastError is the message of the last error sent and stats the rows and bytes read by the last profiled
+	// statement, for the query log. queryLogged is set when the statement of a simple query was logged
+	lastError   string
+	stats       queryStats
+	queryLogged bool
+	// txStatus is the transaction status reported in ReadyForQuery
+	txStatus      byte
+	params        map[string]string
+	defaultParams map[string]string
+	// cursors are the declared cursors
+	cursors map[string]*pgCursor
+	// txLog are the statements of the transaction since BEGIN, incomplete when it got too long or had a COPY, and
+	// savepoints the savepoints set in the transaction
+	txLog           []loggedStatement
+	txLogIncomplete bool
+	savepoints      []savepoint
+	// application is the application_name of the connection and started the time it connected, both are read by
+	// the session list
+	application atomic.Value
+	started     time.Time
+}
+
+func newPgConn(conn net.Conn, server *PgServer, listener *pgListener) *PgConn {
+	dbConn, err := server.Connector.Connect(context.Background())
+	if err != nil {
+		logrus.Fatalf("connect error: %v", err)
+	}
+	keyData := [8]byte{}
+	_, _ = rand.Read(keyData[:])
+	return &PgConn{
+		wire:     newWire(conn, listener.tlsConfig, server.writeBufferSize, server.maxMessageSize),
+		server:   server,
+		listener: listener,
+		conn:     dbConn,
+		keyData:  keyData,
+		db:       server.conn,
+		txStatus: TransactionStatusIdle,
+		started:  time.Now(),
+	}
+}
+
+var copyInRegexp = regexp.MustCompile(`(?i)COPY\s+.*\s+FROM\s+STDIN`)
+
+func detectCopyInSQl(sql string) bool {
+	return copyInRegexp.MatchString(sql)
+}
+
+func (c *PgConn) Close() {
+	for _, stmt := range c.stmts {
+		if stmt.stmt != nil {
+			_ = stmt.stmt.Close()
+		}
+	}
+	c.closeCursors(true)
+	_ = c.wire.Flush()
+	_ = c.wire.conn.Close()
+	_ = c.conn.Close()
+	c.server.Close(c.keyData)
+}
+
+func (c *PgConn) Run() {
+	c.stmts = make(map[string]*stmtDesc)
+	c.portal = make(map[string]portal)
+	c.cursors = make(map[string]*pgCursor)
+	go func() {
+		// a bug handling one connection must not take the server down
+		defer func() {
+			if r := recover(); r != nil {
+				logrus.Errorf("connection panic: %v\n%s", r, debug.Stack())
+			}
+		}()
+		defer c.Close()
+		first, err := c.wire.ReadStartUpMessage()
+		if err != nil {
+			return
+		}
+		if m, ok := first.(*CancelRequestMessage); ok {
+			c.server.CancelRequest(m.Key)
+			return
+		}
+		startup, ok := first.(*StartUpMessage)
+		if !ok {
+			panic("invalid message type")
+		}
+		logrus.Debugf("receive startup: %v", startup)
+		if startup.NeedNegotiate() {
+			negotiate := NewNegotiateProtocolVersionMessage(SupportedProtocolMinorVersion, startup.ProtocolOptions)
+			if err = c.wire.WriteMessage(negotiate); err != nil {
+				logrus.Debugf("send negotiate protocol version error: %v", err)
+				return
+			}
+		}
+		if err = c.Auth(startup.Parameters["user"]); err != nil {
+			logrus.Debugf("auth error: %v", err)
+			return
+		}
+		c.user = startup.Parameters["user"]
+		if err = c.SendBackendKeyData(); err != nil {
+			logrus.Debugf("send backend key data error: %v", err)
+			return
+		}
+		if err = c.useDatabase(startup.Parameters["database"]); err != nil {
+			logrus.Warnf("use database error: %v", err)
+		}
+		if err = c.foldIdentifiers(); err != nil {
+			logrus.Warnf("fold identifiers error: %v", err)
+		}
+		c.server.backends.Store(c.keyData, c)
+		c.initParameters(startup.Parameters)
+		c.initTransactionTimeouts(startup.Parameters)
+		c.setApplication(c.params["application_name"])
+		if err = c.createVersionFunction(); err != nil {
+			logrus.Warnf("create version function error: %v", err)
+		}
+		if err = c.sendAllParameterStatus(); err != nil {
+			logrus.Debugf("send parameter status error: %v", err)
+			return
+		}
+		needReadyMessage := true
+		for {
+			if needReadyMessage {
+				m := &ReadyForQueryMessage{Status: c.txStatus}
+				if err = c.wire.WriteMessage(m); err != nil {
+					logrus.Tracef("write ready for query error: %v", err)
+					return
+				}
+			}
+			if err = c.setReadDeadline(needReadyMessage); err != nil {
+				logrus.Tracef("set read deadline error: %v", err)
+				return
+			}
+			msg, err := c.wire.ReadMessage()
+			if err != nil {
+				if !c.terminateTransaction(err) {
+					logrus.Tracef("read message error: %v", err)
+				}
+				return
+			}
+			// the idle in transaction timeout ends with the message, the statement still runs within the transaction
+			// timeout
+			if err = c.setReadDeadline(false); err != nil {
+				logrus.Tracef("set read deadline error: %v", err)
+				return
+			}
+			// a message over the max size is skipped without reading it, the client gets an error and recovers at
+			// Sync like after an error of the extended protocol
+			if err := msg.TooLarge(); err != nil && msg.Typ != CopyData {
+				needReadyMessage = msg.Typ == Query || msg.Typ == FunctionCall
+				if c.inError && !needReadyMessage {
+					continue
+				}
+				if err := c.SendErrorResponseWithCode(SqlStateProgramLimitExceeded, err.Error()); err != nil {
+					return
+				}
+				if needReadyMessage {
+					c.inError = false
+				}
+				continue
+			}
+			switch msg.Typ {
+			case Query:
+				if queryMsg, err := ParseQueryMessage(msg); err != nil {
+					logrus.Tracef("parse query message error: %v", err)
+					return
+				} else {
+					if err := c.SimpleQuery(queryMsg.Query); err != nil {
+						logrus.Tracef("simple query error: %v", err)
+						return
+					}
+				}
+				needReadyMessage = true
+				c.inError = false
+			case Terminate:
+				return
+			case Sync:
+				needReadyMessage = true
+				c.inError = false
+			case Parse:
+				needReadyMessage = false
+				if c.inError {
+					continue
+				}
+				if parseMsg, err := ParseParseMessage(msg); err != nil {
+					logrus.Tracef("parse parse message error: %v", err)
+					return
+				} else {
+					if err := c.Prepare(parseMsg.Name, parseMsg.Query, parseMsg.ParameterOIDs); err != nil {
+						return
+					}
+				}
+			case Describe:
+				if c.inError {
+					continue
+				}
+				needReadyMessage = false
+				if describeMsg, err := ParseDescribeMessage(msg); err != nil {
+					return
+				} else {
+					if err := c.DescribePrepared(describeMsg.Type, describeMsg.Name); err != nil {
+						return
+					}
+				}
+			case Bind:
+				if c.inError {
+					continue
+				}
+				needReadyMessage = false
+				if bindMsg, err := ParseBindMessage(msg); err != nil {
+					logrus.Tracef("parse bind message error: %v", err)
+					return
+				} else {
+					if err := c.Bind(bindMsg.Statement, bindMsg.PortalName, bindMsg.ParameterValues, bindMsg.ParameterFormats, bindMsg.ResultFormats); err != nil {
+						return
+					}
+				}
+			case Execute:
+				if c.inError {
+					continue
+				}
+				needReadyMessage = false
+				if executeMsg, err := ParseExecuteMessage(msg); err != nil {
+					logrus.Tracef("parse execute message error: %v", err)
+					return
+				} else {
+					if err := c.Execute(executeMsg.PortalName, executeMsg.MaxRows); err != nil {
+						return
+					}
+				}
+			case Flush:
+				needReadyMessage = false
+				if err := c.wire.Flush(); err != nil {
+					logrus.Tracef("flush error: %v", err)
+					return
+				}
+			case Close:
+				if c.inError {
+					continue
+				}
+				needReadyMessage = false
+				if closeMsg, err := ParseCloseMessage(msg); err != nil {
+					logrus.Tracef("parse close message error: %v", err)
+					return
+				} else {
+					if err := c.CloseStmtOrPortal(closeMsg.Type, closeMsg.Name); err != nil {
+						return
+					}
+				}
+			case FunctionCall:
+				// answered like a simple query, the client waits for ReadyForQuery instead of sending Sync
+				if err := c.SendErrorResponseWithCode(SqlStateFeatureNotSupported, "function call is not supported"); err != nil {
+					return
+				}
+				needReadyMessage = true
+				c.inError = false
+			case CopyData, CopyDone, CopyFail:
+				// ignored outside of COPY like postgresql
+				needReadyMessage = false
+			default:
+				needReadyMessage = false
+				if c.inError {
+					continue
+				}
+				logrus.Infof("unsupported message type: %c", msg.Typ)
+				if err := c.SendErrorResponseWithCode(SqlStateFeatureNotSupported, fmt.Sprintf("unsupported frontend message type %q", rune(msg.Typ))); err != nil {
+					return
+				}
+			}
+		}
+	}()
+}
+
+const maxInputArgsUsePrepared = 20
+
+func (c *PgConn) RunStmt(ctx context.Context, stmt driver.Stmt, values []driver.Value, sendRowDesc bool, query string) error {
+	if err := c.server.usage.Check(c.user); err != nil {
+		return c.SendErrorResponse(err.Error())
+	}
+	hints, err := parseQueryHints(query)
+	if err != nil {
+		return c.sendQueryError(err)
+	}
+	ctx, done, err := c.server.applyQueryHints(ctx, c.user, hints)
+	if err != nil {
+		return c.sendQueryError(err)
+	}
+	defer done()
+	if deadline := c.transactionDeadline(); !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+	start := time.Now()
+	run := func() error {
+		return c.runStmt(ctx, stmt, values, sendRowDesc, query)
+	}
+	if c.server.resultSpool {
+		runStmt := run
+		run = func() error {
+			return c.spoolResponse(runStmt)
+		}
+	}
+	c.stats = queryStats{}
+	if c.profiling || c.queryStats || c.server.queryStats {
+		err = c.runProfiled(query, run)
+	} else {
+		err = run()
+	}
+	c.server.usage.Record(c.user, c.applicationName(), time.Since(start))
+	if c.inError {
+		c.logQuery(queryLogExceptionWhileProcessing, query, start, c.stats)
+	} else {
+		c.logQuery(queryLogFinish, query, start, c.stats)
+	}
+	c.updateTransactionStatus(query, c.inError)
+	c.logStatement(query, values)
+	return err
+}
+
+// namedValues numbers the parameter values of a statement from 1
+func namedValues(values []driver.Value) []driver.NamedValue {
+	var nv []driver.NamedValue
+	if len(values) > 0 {
+		nv = make([]driver.NamedValue, len(values))
+		for i, v := range values {
+			nv[i] = driver.NamedValue{Name: "", Ordinal: i + 1, Value: v}
+		}
+	}
+	return nv
+}
+
+func (c *PgConn) runStmt(ctx context.Context, stmt driver.Stmt, values []driver.Value, sendRowDesc bool, query string) error {
+	if stmt == nil {
+		return c.wire.WriteMessage(NewMessage(EmptyQueryResponse, []byte{}))
+	}
+
+	rows, err := stmt.(driver.StmtQueryContext).QueryContext(ctx, namedValues(values))
+	if err != nil {
+		return c.sendQueryError(queryError(ctx, err))
+	}
+	defer rows.Close()
+	c.tzColumns = c.timestampTZColumns(rows)
+	columnNames := rows.Columns()
+	if isExplainResult(columnNames, query) {
+		return c.sendExplain(rows, sendRowDesc)
+	}
+	if !sendRowDesc && isUtilityResult(columnNames, query) {
+		return c.sendUtilityComplete(rows, query)
+	}
+	rowValues := make([]driver.Value, len(columnNames))
+	rowCount := 0
+	if sendRowDesc {
+		if err := rows.Next(rowValues); err != nil {
+			if err == io.EOF {
+				if isUtilityResult(columnNames, query) {
+					return c.SendCommandComplete(commandTag(query))
+				}
+				types, err := c.inferStmtOutputNamesAndTypes(ctx, query)
+				if err != nil {
+					return c.SendErrorResponse(err.Error())
+				}
+				if err := c.SendRowDescriptionWithColumnNameAndTypes(types); err != nil {
+					return c.SendErrorResponse(err.Error())
+				}
+				return c.SendCommandComplete(c.selectTag(0))
+			}
+			return c.SendErrorResponse(err.Error())
+		}
+		if err := c.SendRowDescription(columnNames, rowValues, rowsTypeAliases(rows)); err != nil {
+			return c.SendErrorResponse(err.Error())
+		}
+		if err := c.SendRowData(rowValues); err != nil {
+			return c.SendErrorResponse(err.Error())
+		}
+		rowCount++
+	}
+	for {
+		if err := rows.Next(rowValues); err != nil {
+			if err == io.EOF {
+				break
+			} else {
+				return c.SendErrorResponse(err.Error())
+			}
+		} else {
+			rowCount++
+			if err := c.SendRowData(rowValues); err != nil {
+				return c.SendErrorResponse(err.Error())
+			}
+		}
+	}
+	return c.SendCommandComplete(c.selectTag(rowCount))
+}
+
+var selectLikeQueryRegexp = regexp.MustCompile(`(?i)^\s*(SELECT|WITH|VALUES|FROM|TABLE|SHOW|DESCRIBE|PRAGMA|EXPLAIN)\b`)
+var returningRegexp = regexp.MustCompile(`(?i)\bRETURNING\b`)
+
+// isUtilityResult reports whether an empty result comes from a utility statement,
+// DuckDB returns a single Success column for BEGIN/COMMIT and a single Count column for DDL
+func isUtilityResult(columnNames []string, query string) bool {
+	if len(columnNames) == 0 {
+		return true
+	}
+	if len(columnNames) != 1 || (columnNames[0] != "Success" && columnNames[0] != "Count") {
+		return false
+	}
+	return !selectLikeQueryRegexp.MatchString(query)
+}
+
+// returnsRows reports whether a statement returns rows, a query or a statement with RETURNING
+func returnsRows(query string) bool {
+	return selectLikeQueryRegexp.MatchString(query) || returningRegexp.MatchString(query)
+}
+
+// sendUtilityComplete completes a statement without result rows of the extended protocol, the affected rows of
+// the Count column of DuckDB are reported in the tag like postgresql
+func (c *PgConn) sendUtilityComplete(rows driver.Rows, query string) error {
+	tag := commandTag(query)
+	columnNames := rows.Columns()
+	values := make([]driver.Value, len(columnNames))
+	if len(columnNames) == 1 && columnNames[0] == "Count" && rows.Next(values) == nil {
+		switch tag {
+		case "INSERT":
+			tag = fmt.Sprintf("INSERT 0 %v", values[0])
+		case "UPDATE", "DELETE", "MERGE", "COPY":
+			tag = fmt.Sprintf("%s %v", tag, values[0])
+		}
+	}
+	return c.SendCommandComplete(tag)
+}
+
+// commandTag returns the CommandComplete tag of a statement returning no rows
+func commandTag(query string) string {
+	fields := strings.Fields(query)
+	if len(fields) == 0 {
+		return ""
+	}
+	return strings.ToUpper(strings.TrimSuffix(fields[0], ";"))
+}
+
+// selectTag returns the CommandComplete tag of a query returning rowCount rows
+func (c *PgConn) selectTag(rowCount int) string {
+	if c.server.poolerCompat {
+		return fmt.Sprintf("SELECT %d", rowCount)
+	}
+	return fmt.Sprintf("(%d row)", rowCount)
+}
+
+var onConflictConstraintRegexp = regexp.MustCompile(`(?i)\bON\s+CONFLICT\s+ON\s+CONSTRAINT\s+("[^"]*"|\w+)`)
+
+// rewriteOnConflict rewrites postgresql upsert syntax not supported by DuckDB,
+// DuckDB can't name the constraint, so the conflict target falls back to the primary key
+func rewriteOnConflict(query string) string {
+	return onConflictConstraintRegexp.ReplaceAllString(query, "ON CONFLICT")
+}
+
+// pgQueryRewriters rewrite postgresql syntax of a query to DuckDB before it's prepared, in order
+var pgQueryRewriters = []func(string) string{
+	rewriteOnConflict,
+	rewriteJsonOperators,
+	rewriteDbtRelationships,
+	rewritePgCatalogVersion,
+	rewriteIdentityOptions,
+	rewriteHstoreOids,
+}
+
+func rewritePgQuery(query string) string {
+	for _, rewrite := range pgQueryRewriters {
+		query = rewrite(query)
+	}
+	return query
+}
+
+// rewriteQuery rewrites a query with the rewrites depending on the connection, then with pgQueryRewriters
+func (c *PgConn) rewriteQuery(query string) string {
+	query = c.rewriteGrafanaTimeGroup(c.rewriteGrafanaSchemas(c.rewriteShowParameter(query)))
+	return rewritePgQuery(c.rewriteCatalogOverrides(c.rewriteViewRename(c.rewriteCatalogAlias(c.rewriteCurrentSetting(query)))))
+}
+
+var createUserRegexp = regexp.MustCompile(`(?i)^\s*create\s+user\s+(\w+)\s+with\s+password\s+'(.*)'\s*;?\s*$`)
+var testDiscardAllRegexp = regexp.MustCompile(`(?i)^\s*discard\s+all\s*;?\s*$`)
+
+func (c *PgConn) SimpleQuery(query string) error {
+	start := time.Now()
+	c.queryLogged = false
+	defer func() {
+		if !c.queryLogged {
+			if c.inError {
+				c.logQuery(queryLogExceptionBeforeStart, query, start, queryStats{})
+			} else {
+				c.logQuery(queryLogFinish, query, start, queryStats{})
+			}
+		}
+		c.inError = false
+	}()
+	logrus.Debugf("simple query: %s", query)
+	if err := c.server.checkQuery(c.hookContext(), ProtocolPostgres, query); err != nil {
+		return c.sendQueryError(err)
+	}
+	if c.server.enableAuth {
+		if createUserRegexp.MatchString(query) {
+			m := createUserRegexp.FindStringSubmatch(query)
+			if len(m) == 3 {
+				user := m[1]
+				password := m[2]
+				if err := c.server.CreateUser(user, password); err != nil {
+					return c.SendErrorResponse(err.Error())
+				}
+				return c.SendCommandComplete("CREATE USER")
+			}
+		}
+	}
+	if handled, err := c.databaseCommand(query); handled {
+		return err
+	}
+	if strings.TrimSpace(query) == "" {
+		//send empty query response
+		return c.wire.WriteMessage(NewMessage(EmptyQueryResponse, []byte{}))
+	}
+	if testDiscardAllRegexp.MatchString(query) {
+		return c.DiscardAll()
+	}
+	if set := parseSetCommand(query); set != nil {
+		return c.ApplySet(set)
+	}
+	if systemCheckpointRegexp.MatchString(query) {
+		if err := c.server.checkpointer.Checkpoint(context.Background()); err != nil {
+			return c.SendErrorResponse(err.Error())
+		}
+		return c.SendCommandComplete("CHECKPOINT")
+	}
+	if err := c.server.diskGuard.CheckQuery(query); err != nil {
+		return c.SendErrorResponse(err.Error())
+	}
+	if err := c.server.replica.CheckQuery(query); err != nil {
+		return c.SendErrorResponseWithCode(SqlStateReadOnlySqlTransaction, err.Error())
+	}
+	if handled, err := c.exportCommand(query); handled {
+		return err
+	}
+	query, err := c.server.rowPolicies.Rewrite(c.user, query)
+	if err != nil {
+		return c.SendErrorResponseWithCode(SqlStateInsufficientPrivilege, err.Error())
+	}
+	if handled, err := c.partitionCommand(query); handled {
+		return err
+	}
+	if detectCopyInSQl(query) {
+		return c.CopyIn(query)
+	}
+	query = c.rewriteQuery(query)
+	if savepoint := parseSavepointCommand(query); savepoint != nil {
+		return c.runSavepointCommand(savepoint)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancel = cancel
+	defer func() {
+		cancel()
+		c.cancel = nil
+	}()
+	if cursor := parseCursorCommand(query); cursor != nil {
+		return c.runCursorCommand(ctx, cursor, true)
+	}
+	query, cleanup, err := c.server.fetchRemoteTables(ctx, query)
+	if err != nil {
+		return c.SendErrorResponse(err.Error())
+	}
+	defer cleanup()
+	stmt, err := c.conn.Prepare(query)
+	if err != nil {
+		if strings.Contains(err.Error(), "No statement to prepare") {
+			return c.wire.WriteMessage(NewMessage(EmptyQueryResponse, []byte{}))
+		}
+		return c.SendErrorResponse(err.Error())
+	}
+	defer func() {
+		stmt.Close()
+	}()
+	defer c.server.notifySchemaChange(query)
+	return c.RunStmt(ctx, stmt, nil, true, query)
+}
+
+func (c *PgConn) SendParameterDescription(oids []int32) error {
+	m := c.wire.StartMessage(ParameterDescription)
+	m.WriteInt16(int16(len(oids)))
+	for _, oid := range oids {
+		m.WriteInt32(oid)
+	}
+	return c.wire.SendMessage(m)
+}
+
+func (c *PgConn) SendRowDescriptionWithColumnNameAndTypes(columns [][2]string) error {
+	m := c.wire.StartMessage(RowDescription)
+	m.WriteInt16(int16(len(columns)))
+	for i, column := range columns {
+		m.WriteCString(column[0])
+		m.WriteInt32(0)                                     // table oid
+		m.WriteInt16(0)                                     // column attribute number
+		m.WriteInt32(pgOidFromType(duck2pgType(column[1]))) // oid
+		m.WriteInt16(0)                                     // type size
+		m.WriteInt32(typeModifier(column[1]))               // type modifier
+		m.WriteInt16(formatCode(c.resultFormats, i))        // format code
+	}
+	return c.wire.SendMessage(m)
+}
+
+// SendRowDescription describes the columns by the types of the first row, aliases are the DuckDB type aliases
+// of the columns reported by their own type, e.g. JSON
+func (c *PgConn) SendRowDescription(columnNames []string, firstRowValues []driver.Value, aliases []string) error {
+	m := c.wire.StartMessage(RowDescription)
+	m.WriteInt16(int16(len(columnNames)))
+	if firstRowValues == nil {
+		for _, name := range columnNames {
+			m.WriteCString(name)
+			m.WriteInt32(0)
+			m.WriteInt16(0)
+			m.WriteInt32(25) //oid for text
+			m.WriteInt16(0)  // type size
+			m.WriteInt32(0)  // type modifier
+			m.WriteInt16(0)  // format code
+		}
+	} else {
+		for i, name := range columnNames {
+			v := firstRowValues[i]
+			pgVal, err := toPgValue(v)
+			if err != nil {
+				panic(err)
+			}
+			oid := pgVal.typ.Oid
+			if i < len(aliases) && typeAliasOids[aliases[i]] != 0 {
+				oid = typeAliasOids[aliases[i]]
+			}
+			m.WriteCString(name)
+			m.WriteInt32(0)
+			m.WriteInt16(0)
+			m.WriteInt32(oid)                  // oid
+			m.WriteInt16(pgVal.typ.Typlen)     // type size
+			m.WriteInt32(valueTypeModifier(v)) // type modifier
+			m.WriteInt16(0)                    // format code
+		}
+	}
+	return c.wire.SendMessage(m)
+}
+
+const (
+	// SqlStateFeatureNotSupported is the SQLSTATE of errors for unsupported features
+	SqlStateFeatureNotSupported = "0A000"
+	// SqlStateProgramLimitExceeded is the SQLSTATE of messages over the max message size
+	SqlStateProgramLimitExceeded = "54000"
+	// SqlStateProtocolViolation is the SQLSTATE of a bind without the parameters of the statement
+	SqlStateProtocolViolation = "08P01"
+	// SqlStateUndefinedParameter is the SQLSTATE of a placeholder like $0 which isn't a parameter
+	SqlStateUndefinedParameter = "42P02"
+)
+
+func (c *PgConn) SendErrorResponse(errStr string) error {
+	return c.SendErrorResponseWithCode("SQL-0000", errStr)
+}
+
+// sendQueryError sends an error rejecting a query, with the SQLSTATE of a databaseError
+func (c *PgConn) sendQueryError(err error) error {
+	var dbErr *databaseError
+	if errors.As(err, &dbErr) {
+		return c.SendErrorResponseWithCode(dbErr.code, dbErr.msg)
+	}
+	return c.SendErrorResponse(err.Error())
+}
+
+// SendErrorResponseWithCode sends an error with SQLSTATE code, the extended query messages until Sync are skipped
+func (c *PgConn) SendErrorResponseWithCode(code string, errStr string) error {
+	logrus.Errorf("send error response: %s", errStr)
+	c.inError = true
+	c.lastError = errStr
+	if c.txStatus == TransactionStatusInTransaction {
+		c.txStatus = TransactionStatusFailed
+	}
+	m := c.wire.StartMessage(ErrorResponse)
+	m.WriteUint8('S')
+	m.WriteCString("ERROR")
+	m.WriteUint8('C')
+	m.WriteCString(code)
+	m.WriteUint8('M')
+	m.WriteCString(errStr)
+	m.WriteUint8(0)
+	return c.wire.SendMessage(m)
+}
+
+// sendFatal sends a FATAL error with SQLSTATE code, the connection is closed after it
+func (c *PgConn) sendFatal(code string, errStr string) error {
+	m := c.wire.StartMessage(ErrorResponse)
+	m.WriteUint8('S')
+	m.WriteCString("FATAL")
+	m.WriteUint8('C')
+	m.WriteCString(code)
+	m.WriteUint8('M')
+	m.WriteCString(errStr)
+	m.WriteUint8(0)
+	return c.wire.SendMessage(m)
+}
+
+func (c *PgConn) SendNotice(notice string) error {
+	m := c.wire.StartMessage(NoticeResponse)
+	m.WriteUint8('S')
+	m.WriteCString("NOTICE")
+	m.WriteUint8('C')
+	m.WriteCString("00000")
+	m.WriteUint8('M')
+	m.WriteCString(notice)
+	m.WriteUint8(0)
+	return c.wire.SendMessage(m)
+}
+
+func (c *PgConn) SendRowData(values []driver.Value) error {
+	if hasLargeBytea(values) {
+		return c.streamRowData(values)
+	}
+	m := c.wire.StartMessage(DataRow)
+	m.WriteInt16(int16(len(values)))
+	for i, v := range values {
+		b, err := c.encodeValue(v, i)
+		if err != nil {
+			return err
+		}
+		if b == nil {
+			m.WriteInt32(-1)
+			continue
+		}
+		m.WriteInt32(int32(len(b)))
+		m.WriteBytes(b)
+	}
+	return c.wire.SendMessage(m)
+}
+
+func (c *PgConn) SendBackendKeyData() error {
+	return c.wire.WriteMessage(NewMessage(BackendKeyData, c.keyData[:]))
+}
+
+func (c *PgConn) SendCommandComplete(tag string) error {
+	m := c.wire.StartMessage(CommandComplete)
+	m.WriteCString(tag)
+	return c.wire.SendMessage(m)
+}
+
+func (c *PgConn) SendParameterStatus(key, value string) error {
+	m := c.wire.StartMessage(ParameterStatus)
+	m.WriteCString(key)
+	m.WriteCString(value)
+	return c.wire.SendMessage(m)
+}
+
+func (c *PgConn) Prepare(name, sql string, paramOids []int32) error {
+	defer c.logPrepareError(sql, time.Now())
+	if err := c.server.checkQuery(c.hookContext(), ProtocolPostgres, sql); err != nil {
+		return c.sendQueryError(err)
+	}
+	if sql == "" {
+		c.stmts[name] = &stmtDesc{query: sql}
+		msg := NewMessage(ParseComplete, []byte{})
+		return c.wire.WriteMessage(msg)
+	}
+	sql = castArrayParams(c.rewriteQuery(sql), paramOids)
+	sql, err := c.server.rowPolicies.Rewrite(c.user, sql)
+	if err != nil {
+		return c.SendErrorResponseWithCode(SqlStateInsufficientPrivilege, err.Error())
+	}
+	logrus.Debugf("prepare %s: %s", name, sql)
+	if name != "" {
+		if _, ok := c.stmts[name]; ok {
+			return c.SendErrorResponse(fmt.Sprintf("prepared statement %s already exists", name))
+		}
+	}
+	if set := parseSetCommand(sql); set != nil {
+		c.stmts[name] = &stmtDesc{query: sql, set: set}
+		return c.wire.WriteMessage(NewMessage(ParseComplete, []byte{}))
+	}
+	if cursor := parseCursorCommand(sql); cursor != nil {
+		c.stmts[name] = &stmtDesc{query: sql, cursor: cursor}
+		return c.wire.WriteMessage(NewMessage(ParseComplete, []byte{}))
+	}
+	if savepoint := parseSavepointCommand(sql); savepoint != nil {
+		c.stmts[name] = &stmtDesc{query: sql, savepoint: savepoint}
+		return c.wire.WriteMessage(NewMessage(ParseComplete, []byte{}))
+	}
+	if remoteRegexp.MatchString(sql) {
+		return c.SendErrorResponseWithCode(SqlStateFeatureNotSupported, "remote() is only supported in simple queries")
+	}
+	if remoteURLScanRegexp.MatchString(sql) {
+		return c.SendErrorResponseWithCode(SqlStateFeatureNotSupported, "remote urls are only supported in simple queries")
+	}
+	if exportDatabaseRegexp.MatchString(sql) {
+		return c.SendErrorResponseWithCode(SqlStateFeatureNotSupported, "EXPORT DATABASE and IMPORT DATABASE are only supported in simple queries")
+	}
+	if c.server.isPartitionCommand("main", sql) {
+		return c.SendErrorResponseWithCode(SqlStateFeatureNotSupported, "statements on partitioned tables are only supported in simple queries")
+	}
+	desc := &stmtDesc{query: sql, clientParamOids: paramOids}
+	if err := c.prepareStmt(desc); err != nil {
+		return c.SendErrorResponse(err.Error())
+	}
+	c.stmts[name] = desc
+	msg := NewMessage(ParseComplete, []byte{})
+	return c.wire.WriteMessage(msg)
+}
+
+// prepareStmt prepares the query of a statement at the current schema version
+func (c *PgConn) prepareStmt(desc *stmtDesc) error {
+	schemaVersion := c.server.schemaVersion.Load()
+	stmt, err := c.conn.Prepare(desc.query)
+	if err != nil {
+		return err
+	}
+	inferredOids := stmtParamOids(stmt)
+	for i, oid := range desc.clientParamOids {
+		if i < len(inferredOids) && oid != 0 {
+			inferredOids[i] = oid
+		}
+	}
+	if desc.stmt != nil {
+		_ = desc.stmt.Close()
+	}
+	desc.stmt = stmt
+	desc.numInput = stmt.NumInput()
+	desc.paramOids = inferredOids
+	desc.columns = nil
+	desc.schemaVersion = schemaVersion
+	return nil
+}
+
+// revalidateStmt prepares a statement again when the schema changed since it was prepared
+func (c *PgConn) revalidateStmt(desc *stmtDesc) error {
+	if desc.stmt == nil || desc.schemaVersion == c.server.schemaVersion.Load() {
+		return nil
+	}
+	logrus.Debugf("schema changed, prepare again: %s", desc.query)
+	return c.prepareStmt(desc)
+}
+
+func (c *PgConn) DescribePrepared(typ byte, name string) error {
+	var stmt *stmtDesc
+	if typ == 'S' {
+		stmt = c.stmts[name]
+	} else if typ == 'P' {
+		stmt = c.portal[name].stmt
+		c.resultFormats = c.portal[name].resultFormats
+		defer func() {
+			c.resultFormats = nil
+		}()
+	} else {
+		return c.SendErrorResponse(fmt.Sprintf("unsupported describe type: %c", typ))
+	}
+	if stmt == nil {
+		return c.SendErrorResponse(fmt.Sprintf("prepared statement %s not found", name))
+	}
+	if err := c.revalidateStmt(stmt); err != nil {
+		return c.SendErrorResponse(err.Error())
+	}
+	// only a statement is described with its parameters, a portal already has them bound
+	if typ == 'S' {
+		if err := c.SendParameterDescription(stmt.paramOids); err != nil {
+			return err
+		}
+	}
+	if stmt.cursor != nil && stmt.cursor.verb == "FETCH" {
+		columns, err := c.describeCursor(context.Background(), stmt.cursor.name)
+		if err != nil {
+			return c.SendErrorResponse(err.Error())
+		}
+		return c.SendRowDescriptionWithColumnNameAndTypes(columns)
+	}
+	if stmt.stmt == nil {
+		return c.wire.WriteMessage(NewMessage(NoData, []byte{}))
+	}
+	if stmt.columns == nil && explainRegexp.MatchString(stmt.query) {
+		stmt.columns = explainColumns
+	}
+	if stmt.columns == nil {
+		// statements without results like INSERT and BEGIN are described as NoData, DuckDB can't describe them
+		out, err := c.inferStmtOutputNamesAndTypes(context.Background(), stmt.query)
+		if err != nil || !returnsRows(stmt.query) {
+			out = make([][2]string, 0)
+		}
+		stmt.columns = out
+	}
+	if len(stmt.columns) == 0 {
+		return c.wire.WriteMessage(NewMessage(NoData, []byte{}))
+	}
+	return c.SendRowDescriptionWithColumnNameAndTypes(stmt.columns)
+}
+
+func (c *PgConn) Bind(name, portalName string, args []driver.Value, paramFormats, resultFormats []int16) error {
+	stmt, ok := c.stmts[name]
+	if !ok {
+		return c.SendErrorResponse(fmt.Sprintf("prepared statement %s not found", name))
+	}
+	if err := c.revalidateStmt(stmt); err != nil {
+		return c.SendErrorResponse(err.Error())
+	}
+	for i, arg := range args {
+		var oid int32
+		if i < len(stmt.paramOids) {
+			oid = stmt.paramOids[i]
+		}
+		var err error
+		if b, ok := arg.([]byte); ok && formatCode(paramFormats, i) == formatBinary {
+			args[i], err = decodeBinaryParam(oid, b)
+		} else if s, ok := arg.(string); ok && oid == 17 {
+			args[i], err = decodeBytea(s)
+		} else if s, ok := arg.(string); ok && isArrayOid(oid) {
+			args[i], err = decodeTextArrayParam(oid, s)
+		}
+		if err != nil {
+			return c.SendErrorResponse(err.Error())
+		}
+	}
+	p := portal{stmt: stmt, values: args, resultFormats: resultFormats}
+	c.portal[portalName] = p
+	msg := NewMessage(BindComplete, nil)
+	return c.wire.WriteMessage(msg)
+}
+
+func (c *PgConn) Execute(portalName string, maxRows int32) error {
+	p, ok := c.portal[portalName]
+	if !ok {
+		return c.SendErrorResponse(fmt.Sprintf("portal %s not found", portalName))
+	}
+	if err := c.server.diskGuard.CheckQuery(p.stmt.query); err != nil {
+		return c.SendErrorResponse(err.Error())
+	}
+	if err := c.server.replica.CheckQuery(p.stmt.query); err != nil {
+		return c.SendErrorResponseWithCode(SqlStateReadOnlySqlTransaction, err.Error())
+	}
+	if p.stmt.set != nil {
+		return c.ApplySet(p.stmt.set)
+	}
+	if p.stmt.savepoint != nil {
+		return c.runSavepointCommand(p.stmt.savepoint)
+	}
+	c.resultFormats = p.resultFormats
+	defer func() {
+		c.resultFormats = nil
+	}()
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancel = cancel
+	defer func() {
+		cancel()
+		c.cancel = nil
+	}()
+	if p.stmt.cursor != nil {
+		return c.runCursorCommand(ctx, p.stmt.cursor, false)
+	}
+	// work around for bad performance of using prepared statement with many input args, use simple query instead
+	// todo reduce cgo call in duckdb driver
+	if p.stmt.numInput > maxInputArgsUsePrepared || hasArrayValue(p.values) {
+		query, err := bindValues(p.stmt.query, p.values)
+		if err != nil {
+			return c.sendQueryError(err)
+		}
+		stmt, err := c.conn.Prepare(query)
+		if err != nil {
+			return c.SendErrorResponse(err.Error())
+		}
+		defer stmt.Close()
+		defer c.server.notifySchemaChange(p.stmt.query)
+		return c.RunStmt(ctx, stmt, nil, false, query)
+	}
+	defer c.server.notifySchemaChange(p.stmt.query)
+	return c.RunStmt(ctx, p.stmt.stmt, p.values, false, p.stmt.query)
+}
+
+func (c *PgConn) CloseStmtOrPortal(typ byte, name string) error {
+	switch typ {
+	case 'S':
+		if stmt, ok := c.stmts[name]; ok {
+			if stmt.stmt != nil {
+				_ = stmt.stmt.Close()
+			}
+			delete(c.stmts, name)
+		}
+	case 'P':
+		delete(c.portal, name)
+	default:
+		return c.SendErrorResponse(fmt.Sprintf("unsupported close type: %c", typ))
+	}
+	return c.wire.WriteMessage(NewMessage(CloseComplete, []byte{}))
+}
+
+func (c *PgConn) DiscardAll() error {
+	c.portal = make(map[string]portal)
+	for _, stmt := range c.stmts {
+		if stmt.stmt != nil {
+			_ = stmt.stmt.Close()
+		}
+	}
+	c.stmts = make(map[string]*stmtDesc)
+	c.closeCursors(true)
+	c.profiling = false
+	c.queryStats = false
+	c.setApplication(c.defaultParams["application_name"])
+	if err := c.resetSearchPath(); err != nil {
+		return c.SendErrorResponse(err.Error())
+	}
+	for key, value := range c.defaultParams {
+		if c.params[key] != value {
+			c.params[key] = value
+			if err := c.SendParameterStatus(key, value); err != nil {
+				return err
+			}
+		}
+	}
+	return c.SendCommandComplete("DISCARD ALL")
+}
+
+var extractCopyInRegexp = regexp.MustCompile(`(?i)COPY\s+(.*)\s+FROM\s+STDIN`)
+
+func (c *PgConn) CopyIn(sql string) error {
+	// the copied rows aren't kept in the transaction log, the savepoints set after can't be rolled back to
+	if c.txStatus == TransactionStatusInTransaction {
+		c.txLogIncomplete = true
+	}
+	tableNames := strings.Split(extractCopyInRegexp.FindStringSubmatch(sql)[1], ".")
+	var tableName, schemaName string
+	if len(tableNames) == 1 {
+		tableName = tableNames[0]
+		schemaName = "main"
+	} else {
+		tableName = tableNames[1]
+		schemaName = tableNames[0]
+	}
+	if err := c.server.rowPolicies.CheckWrite(c.user, schemaName, tableName); err != nil {
+		return c.SendErrorResponseWithCode(SqlStateInsufficientPrivilege, err.Error())
+	}
+	columnTypes, err := c.QueryTableColumns(schemaName, tableName)
+	if err != nil {
+		return c.SendErrorResponse(err.Error())
+	}
+	validator, err := newRowValidator(context.Background(), c.conn, schemaName, tableName, nil)
+	if err != nil {
+		return c.SendErrorResponse(err.Error())
+	}
+	convertors := make([]converter, len(columnTypes))
+	for i, columnType := range columnTypes {
+		convertor := getDuckDBConverter(columnType)
+		if convertor == nil {
+			return c.SendErrorResponse(fmt.Sprintf("unsupported column type: %s", columnType))
+		}
+		convertors[i] = convertor
+	}
+	triggers, err := queryInsertTriggers(context.Background(), c.conn, schemaName, tableName)
+	if err != nil {
+		return c.SendErrorResponse(err.Error())
+	}
+	buf := make([]byte, 0)
+	buf = append(buf, 0)
+	buf = append(buf, cint16(len(columnTypes))...)
+	buf = append(buf, make([]byte, len(columnTypes)*2)...)
+	if err := c.wire.WriteMessage(NewMessage(CopyInResponse, buf)); err != nil {
+		return err
+	}
+	reader := &copyReader{wire: c.wire}
+	cr := csv.NewReader(reader)
+	// the number of fields is checked by the validator, with the row number
+	cr.FieldsPerRecord = -1
+	v := make([]driver.Value, len(columnTypes))
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancel = cancel
+	defer func() {
+		cancel()
+		c.cancel = nil
+	}()
+	var canceled bool
+	go func() {
+		<-ctx.Done()
+		canceled = true
+	}()
+	progress := c.newCopyProgress(reader)
+	// with duckserver_copy_commit_rows the rows are appended and committed in batches, unless in a transaction
+	inTx := c.txStatus != TransactionStatusIdle
+	batchRows := c.copyCommitRows
+	if inTx {
+		batchRows = 0
+	}
+	rowCount, committedRows := 0, 0
+	batchFull := false
+	copyRows := func(appender rowAppender) error {
+		for {
+			if canceled {
+				return errCopyCanceled
+			}
+			row, err := cr.Read()
+			if err == io.EOF {
+				return appender.Flush()
+			}
+			if err != nil {
+				return err
+			}
+			validator.Next()
+			if err = validator.FieldCount(len(row)); err != nil {
+				return validator.RowError(err)
+			}
+			for i, val := range row {
+				// an empty field is NULL like postgresql, except in text columns where it can't be told from ""
+				if val == "" && columnTypes[i] != "VARCHAR" {
+					v[i] = nil
+					continue
+				}
+				v[i], err = convertors[i](val)
+				if err != nil {
+					return validator.RowError(validator.ValueError(i, err))
+				}
+			}
+			if err = validator.Check(v); err != nil {
+				return validator.RowError(err)
+			}
+			if err := appender.AppendRow(v...); err != nil {
+				return err
+			}
+			rowCount++
+			if err = progress.Row(rowCount, committedRows); err != nil {
+				return err
+			}
+			if batchRows > 0 && rowCount-committedRows >= batchRows {
+				batchFull = true
+				return appender.Flush()
+			}
+		}
+	}
+	for {
+		batchFull = false
+		// with triggers the rows are appended to a staging table the triggers read
+		if len(triggers) > 0 {
+			err = appendWithTriggers(ctx, c.conn, inTx, schemaName, tableName, triggers, copyRows)
+		} else {
+			err = inTransaction(ctx, c.conn.(driver.ExecerContext), inTx, func() error {
+				return appendRowsWith(ctx, c.conn, schemaName, tableName, copyRows)
+			})
+		}
+		if err != nil || !batchFull {
+			break
+		}
+		committedRows = rowCount
+	}
+	if err != nil && committedRows > 0 {
+		if noticeErr := c.SendNotice(fmt.Sprintf("COPY committed %d rows before the error, resume after row %d", committedRows, committedRows)); noticeErr != nil {
+			return noticeErr
+		}
+	}
+	if errors.Is(err, errCopyCanceled) {
+		return c.SendCopyFail()
+	}
+	if err != nil {
+		return c.sendQueryError(err)
+	}
+	return c.SendCommandComplete(fmt.Sprintf("COPY %d", rowCount))
+}
+
+// errCopyCanceled stops a COPY FROM STDIN canceled by the client
+var errCopyCanceled = errors.New("copy canceled")
+
+func (c *PgConn) QueryTableColumns(schema, table string) ([]string, error) {
+	stmt, err := c.conn.Prepare(`select data_type from information_schema.columns where table_schema=? and table_name=?`)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query([]driver.Value{schema, table})
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columnTypes := make([]string, 0)
+	columns := make([]driver.Value, 1)
+	for {
+		if err := rows.Next(columns); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+		columnTypes = append(columnTypes, columns[0].(string))
+	}
+	return columnTypes, nil
+}
+
+func (c *PgConn) SendCopyFail() error {
+	return c.wire.WriteMessage(NewMessage(CopyFail, nil))
+}
+
+var placeholderRegexp = regexp.MustCompile(`\$\d+`)
+
+func (c *PgConn) inferStmtOutputNamesAndTypes(ctx context.Context, query string) ([][2]string, error) {
+	probeQuery := fmt.Sprintf("describe %s", placeholderRegexp.ReplaceAllString(query, "null"))
+	rows, err := c.db.QueryContext(ctx, probeQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columnNameTypes := make([][2]string, 0)
+	var columnName, columnType, n1, n2, n3, n4 sql.Null[string]
+	for rows.Next() {
+		if err := rows.Scan(&columnName, &columnType, &n1, &n2, &n3, &n4); err != nil {
+			return nil, err
+		}
+		columnNameTypes = append(columnNameTypes, [2]string{columnName.V, columnType.V})
+	}
+	return columnNameTypes, nil
+}
+
+// copyReader reads the COPY data of the client, the CopyData messages are streamed so their size isn't limited
+type copyReader struct {
+	wire *Wire
+	msg  *Message
+	// bytes are the bytes of COPY data received
+	bytes int64
+}
+
+func (r *copyReader) Read(p []byte) (n int, err error) {
+	for {
+		if r.msg != nil {
+			n, err := r.msg.ReadPart(p)
+			r.bytes += int64(n)
+			if err != io.EOF {
+				return n, err
+			}
+			r.msg = nil
+		}
+		msg, err := r.wire.ReadMessage()
+		if err != nil {
+			return 0, err
+		}
+		switch msg.Typ {
+		case CopyData:
+			r.msg = msg
+		case CopyDone:
+			return 0, io.EOF
+		case CopyFail:
+			return 0, fmt.Errorf("copy fail")
+		default:
+			return 0, fmt.Errorf("unexpected message type: %v", msg.Typ)
+		}
+	}
+}
+
+// bindValues inlines the parameters of a query as literals. The placeholders in quoted strings, quoted identifiers,
+// dollar quoted strings and comments are kept, a placeholder which isn't a parameter is an error
+func bindValues(sql string, args []driver.Value) (string, error) {
+	sb := strings.Builder{}
+	for i := 0; i < len(sql); {
+		// the end of a quoted span or comment starting at i
+		end := -1
+		switch {
+		case sql[i] == '\'' || sql[i] == '"':
+			// a backslash escapes the next character of an E'' string
+			escapes := sql[i] == '\'' && i > 0 && (sql[i-1] == 'e' || sql[i-1] == 'E') && (i == 1 || !isChIdentByte(sql[i-2]))
+			end = i + 1
+			for end < len(sql) {
+				if escapes && sql[end] == '\\' {
+					end += 2
+					continue
+				}
+				if sql[end] == sql[i] {
+					// a doubled quote is escaped
+					if end+1 < len(sql) && sql[end+1] == sql[i] {
+						end += 2
+						continue
+					}
+					break
+				}
+				end++
+			}
+			end++
+		case strings.HasPrefix(sql[i:], "--"):
+			end = len(sql)
+			if nl := strings.IndexByte(sql[i:], '\n'); nl >= 0 {
+				end = i + nl + 1
+			}
+		case strings.HasPrefix(sql[i:], "/*"):
+			end = len(sql)
+			if close := strings.Index(sql[i+2:], "*/"); close >= 0 {
+				end = i + 2 + close + 2
+			}
+		case sql[i] == '$' && i+1 < len(sql) && sql[i+1] >= '0' && sql[i+1] <= '9':
+			j := i + 1
+			for j < len(sql) && sql[j] >= '0' && sql[j] <= '9' {
+				j++
+			}
+			valueIdx, err := strconv.Atoi(sql[i+1 : j])
+			if err != nil || valueIdx < 1 {
+				return "", &databaseError{SqlStateUndefinedParameter, fmt.Sprintf("there is no parameter %s", sql[i:j])}
+			}
+			if valueIdx > len(args) {
+				return "", &databaseError{SqlStateProtocolViolation, fmt.Sprintf("bind message supplies %d parameters, but the statement requires %s", len(args), sql[i:j])}
+			}
+			if err = writeLiteral(&sb, args[valueIdx-1]); err != nil {
+				return "", err
+			}
+			i = j
+			continue
+		case sql[i] == '$':
+			// $tag$ ... $tag$, the tag of a dollar quote doesn't start with a digit
+			if tag := dollarQuoteRegexp.FindString(sql[i:]); tag != "" && (i == 0 || !isChIdentByte(sql[i-1])) {
+				end = len(sql)
+				if close := strings.Index(sql[i+len(tag):], tag); close >= 0 {
+					end = i + len(tag) + close + len(tag)
+				}
+			}
+		}
+		if end < 0 {
+			sb.WriteByte(sql[i])
+			i++
+			continue
+		}
+		end = min(end, len(sql))
+		sb.WriteString(sql[i:end])
+		i = end
+	}
+	return sb.String(), nil
+}
+
+var dollarQuoteRegexp = regexp.MustCompile(`^\$(?:[A-Za-z_][A-Za-z0-9_]*)?\$`)
+
+// writeLiteral writes a bound value as a SQL literal, arrays as DuckDB list literals
+func writeLiteral(sb *strings.Builder, v driver.Value) error {
+	switch vv := v.(type) {
+	case nil:
+		sb.WriteString("null")
+	case string:
+		sb.WriteString("'" + strings.ReplaceAll(vv, "'", "''") + "'")
+	case int64:
+		sb.WriteString(strconv.FormatInt(vv, 10))
+	case float64:
+		sb.WriteString(strconv.FormatFloat(vv, 'f', -1, 64))
+	case bool:
+		sb.WriteString(strconv.FormatBool(vv))
+	case []byte:
+		sb.WriteByte('\'')
+		for _, b := range vv {
+			_, _ = fmt.Fprintf(sb, "\\x%02X", b)
+		}
+		sb.WriteString("'::BLOB")
+	case duckdb.Interval:
+		_, _ = fmt.Fprintf(sb, "INTERVAL '%d months %d days %d microseconds'", vv.Months, vv.Days, vv.Micros)
+	case []any:
+		sb.WriteByte('[')
+		for i, e := range vv {
+			if i > 0 {
+				sb.WriteString(", ")
+			}
+			if err := writeLiteral(sb, e); err != nil {
+				return err
+			}
+		}
+		sb.WriteByte(']')
+	default:
+		return fmt.Errorf("unsupported bind type: %T", vv)
+	}
+	return nil
+}
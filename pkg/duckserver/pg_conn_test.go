@@ -0,0 +1,44 @@
+package duckserver
+
+import (
+	"database/sql/driver"
+	"errors"
+	"testing"
+)
+
+func TestBindValues(t *testing.T) {
+	args := []driver.Value{"it's", int64(2), nil, []any{int64(1), "x"}}
+	tests := []struct {
+		sql    string
+		bound  string
+		sqlErr string
+	}{
+		{"select $1, $2, $3, $4", "select 'it''s', 2, null, [1, 'x']", ""},
+		{"select * from t where a = any($4) and b = $2", "select * from t where a = any([1, 'x']) and b = 2", ""},
+		{"select $1 || '$1'", "select 'it''s' || '$1'", ""},
+		{"select 'it''s $1', $2", "select 'it''s $1', 2", ""},
+		{"select E'\\'$1', $2", "select E'\\'$1', 2", ""},
+		{`select "$1", $2 from t`, `select "$1", 2 from t`, ""},
+		{`select "a""$1", $2`, `select "a""$1", 2`, ""},
+		{"select $$ $1 $$, $2", "select $$ $1 $$, 2", ""},
+		{"select $q$ '$1 $q$, $2", "select $q$ '$1 $q$, 2", ""},
+		{"select $2 -- $1\n, $2", "select 2 -- $1\n, 2", ""},
+		{"select /* $1 */ $2", "select /* $1 */ 2", ""},
+		{"select '$1", "select '$1", ""},
+		{"select '$' || $2", "select '$' || 2", ""},
+		{"select $0", "", SqlStateUndefinedParameter},
+		{"select $00", "", SqlStateUndefinedParameter},
+		{"select $5", "", SqlStateProtocolViolation},
+		{"select $99999999999999999999", "", SqlStateUndefinedParameter},
+	}
+	for _, test := range tests {
+		bound, err := bindValues(test.sql, args)
+		var dbErr *databaseError
+		switch {
+		case test.sqlErr != "" && (!errors.As(err, &dbErr) || dbErr.code != test.sqlErr):
+			t.Errorf("bindValues(%q) error = %v, want SQLSTATE %s", test.sql, err, test.sqlErr)
+		case test.sqlErr == "" && (err != nil || bound != test.bound):
+			t.Errorf("bindValues(%q) = %q, %v, want %q", test.sql, bound, err, test.bound)
+		}
+	}
+}
@@ -0,0 +1,370 @@
+package duckserver
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultServerVersion is the server_version reported unless configured, drivers parse it as a postgresql version
+const defaultServerVersion = "16.0"
+
+// compatParameterStatus are the extra parameters reported on startup in pooler compatible mode,
+// pgbouncer and odyssey track them to restore the session when a server connection is reused
+var compatParameterStatus = map[string]string{
+	"server_encoding":   "UTF8",
+	"DateStyle":         "ISO, MDY",
+	"IntervalStyle":     "postgres",
+	"TimeZone":          "UTC",
+	"integer_datetimes": "on",
+	"is_superuser":      "on",
+	"application_name":  "",
+}
+
+// localParameters are only tracked by the server, DuckDB doesn't know them
+var localParameters = map[string]bool{
+	"application_name":              true,
+	"client_encoding":               true,
+	"datestyle":                     true,
+	"intervalstyle":                 true,
+	"extra_float_digits":            true,
+	"standard_conforming_strings":   true,
+	"integer_datetimes":             true,
+	"is_superuser":                  true,
+	"session_authorization":         true,
+	"server_version":                true,
+	"duckdb_version":                true,
+	"server_encoding":               true,
+	profilingSetting:                true,
+	queryStatsSetting:               true,
+	copyProgressSetting:             true,
+	copyCommitRowsSetting:           true,
+	idleInTransactionTimeoutSetting: true,
+	transactionTimeoutSetting:       true,
+}
+
+// reportedParameters are the GUC_REPORT parameters, a ParameterStatus is sent when they change
+var reportedParameters = map[string]string{
+	"application_name":            "application_name",
+	"client_encoding":             "client_encoding",
+	"datestyle":                   "DateStyle",
+	"intervalstyle":               "IntervalStyle",
+	"timezone":                    "TimeZone",
+	"standard_conforming_strings": "standard_conforming_strings",
+	"session_authorization":       "session_authorization",
+	"search_path":                 "search_path",
+}
+
+var showParameterRegexp = regexp.MustCompile(`(?i)^\s*SHOW\s+(\w+)\s*;?\s*$`)
+var showIsolationLevelRegexp = regexp.MustCompile(`(?i)^\s*SHOW\s+TRANSACTION\s+ISOLATION\s+LEVEL\s*;?\s*$`)
+var showTimeZoneRegexp = regexp.MustCompile(`(?i)^\s*SHOW\s+TIME\s+ZONE\s*;?\s*$`)
+
+// showParameters are the values SHOW returns for the parameters the connection doesn't track, drivers read some of
+// them when they connect
+var showParameters = map[string]string{
+	"application_name":              "",
+	"DateStyle":                     "ISO, MDY",
+	"IntervalStyle":                 "postgres",
+	"TimeZone":                      "UTC",
+	"server_encoding":               "UTF8",
+	"integer_datetimes":             "on",
+	"is_superuser":                  "on",
+	"max_identifier_length":         "63",
+	"lc_collate":                    "C",
+	"lc_ctype":                      "C",
+	"transaction_read_only":         "off",
+	"default_transaction_read_only": "off",
+}
+var currentSettingRegexp = regexp.MustCompile(`(?i)\bcurrent_setting\(\s*'(\w+)'\s*\)`)
+var setParameterRegexp = regexp.MustCompile(`(?is)^\s*SET\s+(?:SESSION\s+)?(\w+)\s*(?:=|\s+TO\s+)\s*(.*?)\s*;?\s*$`)
+var resetParameterRegexp = regexp.MustCompile(`(?i)^\s*RESET\s+(\w+)\s*;?\s*$`)
+
+type setCommand struct {
+	name  string
+	value string
+	reset bool
+}
+
+// parseSetCommand parses SET and RESET of the parameters tracked by server
+func parseSetCommand(query string) *setCommand {
+	if cmd := parseSetTimeZone(query); cmd != nil {
+		return cmd
+	}
+	if m := setParameterRegexp.FindStringSubmatch(query); len(m) == 3 {
+		name := strings.ToLower(m[1])
+		if !localParameters[name] && reportedParameters[name] == "" {
+			return nil
+		}
+		value := m[2]
+		if len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'' {
+			value = strings.ReplaceAll(value[1:len(value)-1], "''", "'")
+		}
+		return &setCommand{name: name, value: value}
+	}
+	if m := resetParameterRegexp.FindStringSubmatch(query); len(m) == 2 {
+		name := strings.ToLower(m[1])
+		if name == "all" || localParameters[name] || reportedParameters[name] != "" {
+			return &setCommand{name: name, reset: true}
+		}
+	}
+	return nil
+}
+
+func (c *PgConn) initParameters(startup map[string]string) {
+	c.params = make(map[string]string)
+	c.defaultParams = make(map[string]string)
+	for key, value := range parameterStatus {
+		c.defaultParams[key] = value
+	}
+	c.defaultParams["server_version"] = c.serverVersion()
+	c.defaultParams["duckdb_version"] = c.server.duckdbVersion
+	c.defaultParams["search_path"] = defaultSearchPath
+	if c.server.poolerCompat || c.server.grafanaCompat {
+		for key, value := range compatParameterStatus {
+			c.defaultParams[key] = value
+		}
+		c.defaultParams["session_authorization"] = startup["user"]
+	}
+	// the application_name of the startup message is the default of the session like postgresql, RESET returns to it
+	if appName, ok := startup["application_name"]; ok {
+		c.defaultParams["application_name"] = appName
+	}
+	for key, value := range c.defaultParams {
+		c.params[key] = value
+	}
+}
+
+// parameter returns a parameter of the connection by its case insensitive name, server_version_num is derived
+// from server_version like postgresql and the transaction isolation is the snapshot isolation of DuckDB
+func (c *PgConn) parameter(name string) (string, bool) {
+	if strings.EqualFold(name, "transaction_isolation") || strings.EqualFold(name, "default_transaction_isolation") {
+		return "repeatable read", true
+	}
+	if value, ok := c.transactionTimeoutParameter(name); ok {
+		return value, true
+	}
+	if strings.EqualFold(name, "server_version_num") {
+		var major, minor, patch int
+		_, _ = fmt.Sscanf(c.params["server_version"], "%d.%d.%d", &major, &minor, &patch)
+		if major >= 10 {
+			return strconv.Itoa(major*10000 + minor), true
+		}
+		return strconv.Itoa(major*10000 + minor*100 + patch), true
+	}
+	for key, value := range c.params {
+		if strings.EqualFold(key, name) {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// rewriteShowParameter answers SHOW of the parameters tracked by the connection, like search_path and TimeZone,
+// DuckDB takes them as tables
+func (c *PgConn) rewriteShowParameter(query string) string {
+	if showIsolationLevelRegexp.MatchString(query) {
+		query = "SHOW transaction_isolation"
+	} else if showTimeZoneRegexp.MatchString(query) {
+		query = "SHOW TimeZone"
+	}
+	m := showParameterRegexp.FindStringSubmatch(query)
+	if m == nil {
+		return query
+	}
+	name, value, ok := c.showParameter(m[1])
+	if !ok {
+		return query
+	}
+	return "select " + quoteLiteral(value) + " as " + quoteIdent(name)
+}
+
+// showParameter returns the name and value of a parameter shown by SHOW, the column is named like postgresql names
+// the parameter, a reader is read only. Other names are left to DuckDB, SHOW of a table describes it
+func (c *PgConn) showParameter(name string) (string, string, bool) {
+	canonical := strings.ToLower(name)
+	for key := range showParameters {
+		if strings.EqualFold(key, name) {
+			canonical = key
+		}
+	}
+	for key := range c.params {
+		if strings.EqualFold(key, name) {
+			canonical = key
+		}
+	}
+	if value, ok := c.parameter(name); ok {
+		return canonical, value, true
+	}
+	value, ok := showParameters[canonical]
+	if ok && c.server.replica != nil && strings.HasSuffix(canonical, "transaction_read_only") {
+		value = "on"
+	}
+	return canonical, value, ok
+}
+
+// rewriteCurrentSetting replaces current_setting() of the parameters tracked by the connection with their values,
+// the settings of DuckDB are left to DuckDB
+func (c *PgConn) rewriteCurrentSetting(query string) string {
+	if !strings.Contains(strings.ToLower(query), "current_setting") {
+		return query
+	}
+	return currentSettingRegexp.ReplaceAllStringFunc(query, func(s string) string {
+		if value, ok := c.parameter(currentSettingRegexp.FindStringSubmatch(s)[1]); ok {
+			return quoteLiteral(value)
+		}
+		return s
+	})
+}
+
+// serverVersion is the server_version of the listener, or of the server if the listener doesn't set it
+func (c *PgConn) serverVersion() string {
+	if c.listener.options.ServerVersion != "" {
+		return c.listener.options.ServerVersion
+	}
+	return c.server.serverVersion
+}
+
+// createVersionFunction shadows DuckDB version() for the connection with a temporary macro returning a postgresql
+// style version, the DuckDB version stays in the duckdb_version parameter
+func (c *PgConn) createVersionFunction() error {
+	version := fmt.Sprintf("PostgreSQL %s (DuckDB %s)", c.serverVersion(), c.server.duckdbVersion)
+	stmt := "CREATE OR REPLACE TEMP MACRO version() AS '" + strings.ReplaceAll(version, "'", "''") + "'"
+	_, err := c.conn.(driver.ExecerContext).ExecContext(context.Background(), stmt, nil)
+	return err
+}
+
+func (c *PgConn) sendAllParameterStatus() error {
+	for key, value := range c.params {
+		if err := c.SendParameterStatus(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// foldIdentifiers turns off preserve_identifier_case for the connection when the listener folds identifiers,
+// DuckDB then folds unquoted identifiers to lower case like postgresql while quoted ones keep their case
+func (c *PgConn) foldIdentifiers() error {
+	if !c.listener.options.FoldIdentifiers {
+		return nil
+	}
+	_, err := c.conn.(driver.ExecerContext).ExecContext(context.Background(), "SET preserve_identifier_case = false", nil)
+	return err
+}
+
+// ApplySet runs the SET or RESET command and reports the changed parameters with ParameterStatus
+func (c *PgConn) ApplySet(cmd *setCommand) error {
+	if cmd.name == profilingSetting || cmd.name == "all" {
+		c.profiling = !cmd.reset && isTrueSetting(cmd.value)
+	}
+	if cmd.name == queryStatsSetting || cmd.name == "all" {
+		c.queryStats = !cmd.reset && isTrueSetting(cmd.value)
+	}
+	if err := c.setCopyOptions(cmd); err != nil {
+		return c.sendQueryError(err)
+	}
+	if err := c.setTransactionTimeouts(cmd); err != nil {
+		return c.sendQueryError(err)
+	}
+	if cmd.name == "application_name" || cmd.name == "all" {
+		if cmd.reset {
+			c.setApplication(c.defaultParams["application_name"])
+		} else if cmd.name == "application_name" {
+			c.setApplication(cmd.value)
+		}
+	}
+	if cmd.reset && cmd.name == "all" {
+		if err := c.resetSearchPath(); err != nil {
+			return c.SendErrorResponse(err.Error())
+		}
+		if c.location != nil {
+			value, err := c.setTimeZone(&setCommand{name: "timezone", reset: true})
+			if err != nil {
+				return c.sendQueryError(err)
+			}
+			c.params["TimeZone"] = value
+			if err := c.SendParameterStatus("TimeZone", value); err != nil {
+				return err
+			}
+		}
+		for key, value := range c.defaultParams {
+			if c.params[key] != value {
+				c.params[key] = value
+				if err := c.SendParameterStatus(key, value); err != nil {
+					return err
+				}
+			}
+		}
+		return c.SendCommandComplete("RESET")
+	}
+	tag := "SET"
+	if cmd.reset {
+		tag = "RESET"
+	}
+	if cmd.name == "search_path" {
+		if cmd.reset || strings.EqualFold(cmd.value, "default") {
+			cmd.value = defaultSearchPath
+		}
+		if err := c.setSearchPath(cmd.value); err != nil {
+			return c.SendErrorResponse(err.Error())
+		}
+	} else if cmd.name == "timezone" {
+		value, err := c.setTimeZone(cmd)
+		if err != nil {
+			return c.sendQueryError(err)
+		}
+		cmd = &setCommand{name: cmd.name, value: value}
+	} else if !localParameters[cmd.name] {
+		stmt := "SET " + cmd.name + " = '" + strings.ReplaceAll(cmd.value, "'", "''") + "'"
+		if cmd.reset {
+			stmt = "RESET " + cmd.name
+		}
+		if _, err := c.conn.(driver.ExecerContext).ExecContext(context.Background(), stmt, nil); err != nil {
+			return c.SendErrorResponse(err.Error())
+		}
+	}
+	reportName := reportedParameters[cmd.name]
+	if reportName == "" {
+		return c.SendCommandComplete(tag)
+	}
+	value := cmd.value
+	if cmd.reset {
+		var ok bool
+		if value, ok = c.defaultParams[reportName]; !ok {
+			return c.SendCommandComplete(tag)
+		}
+	}
+	if c.params[reportName] != value {
+		c.params[reportName] = value
+		if err := c.SendParameterStatus(reportName, value); err != nil {
+			return err
+		}
+	}
+	return c.SendCommandComplete(tag)
+}
+
+var beginTransactionRegexp = regexp.MustCompile(`(?i)^\s*(BEGIN|START\s+TRANSACTION)\b`)
+var endTransactionRegexp = regexp.MustCompile(`(?i)^\s*(COMMIT|END|ABORT|ROLLBACK)\b(\s*(WORK|TRANSACTION))?\s*;?\s*$`)
+
+// updateTransactionStatus tracks the transaction status reported in ReadyForQuery
+func (c *PgConn) updateTransactionStatus(query string, failed bool) {
+	switch {
+	case endTransactionRegexp.MatchString(query):
+		c.txStatus = TransactionStatusIdle
+		c.txStart = time.Time{}
+		c.resetTransactionLog()
+		c.closeCursors(false)
+	case failed:
+		if c.txStatus != TransactionStatusIdle {
+			c.txStatus = TransactionStatusFailed
+		}
+	case beginTransactionRegexp.MatchString(query):
+		c.txStatus = TransactionStatusInTransaction
+		c.txStart = time.Now()
+		c.resetTransactionLog()
+	}
+}
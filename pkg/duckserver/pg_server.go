@@ -0,0 +1,665 @@
+package duckserver
+
+import (
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"github.com/marcboeker/go-duckdb"
+	"github.com/sirupsen/logrus"
+	"github.com/supercaracal/scram-sha-256/pkg/pgpasswd"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type ClickhouseOptions struct {
+	Enabled                  bool
+	Listeners                []ListenerOptions
+	AsyncInsertMaxRows       int
+	AsyncInsertFlushInterval time.Duration
+	// CoalesceInsertBytes buffers the inserts with a body of at most this many bytes like async_insert=1, each
+	// acknowledged after the flush of its batch, 0 disables it
+	CoalesceInsertBytes int64
+	// JWT enables bearer token authentication besides user and password, nil disables it
+	JWT *JWTOptions
+	// ServerVersion is the clickhouse version returned by version(), for clients checking the server version
+	ServerVersion string
+	// DisplayName is sent in the X-ClickHouse-Server-Display-Name header, default the hostname
+	DisplayName string
+	// CORS lets browsers of other origins query the endpoint, nil disables it
+	CORS *CORSOptions
+	// ReadHeaderTimeout and IdleTimeout limit the time to read request headers and to keep an idle connection,
+	// default 10s and 2m
+	ReadHeaderTimeout time.Duration
+	IdleTimeout       time.Duration
+	// MaxConnections limits the open connections of each listener, 0 is unlimited
+	MaxConnections int
+	// MaxConcurrentStreams limits the concurrent requests of a HTTP/2 connection, default 250
+	MaxConcurrentStreams int
+	// CursorTTL closes the cursors of the pagination api unused for this long, default 10m
+	CursorTTL time.Duration
+	// AppenderIdleTimeout closes the pooled connections and appenders of inserts unused for this long, default 30s,
+	// negative disables the pool
+	AppenderIdleTimeout time.Duration
+	// ResultCacheMaxBytes is the size of the cache of the selects with result_cache_ttl, 0 disables it
+	ResultCacheMaxBytes int64
+	// ResultCacheStale is how long a result is served after its ttl while it is refreshed, unless the query sets
+	// result_cache_stale, default 5m
+	ResultCacheStale time.Duration
+	// Partitions emulates the time partition keys of tables, e.g. PARTITION BY toYYYYMM(ts), with partitioned
+	// tables, the partition key is only recorded otherwise
+	Partitions bool
+	// FormatSchemaPath is the directory of the .proto files named by the format_schema setting of the Protobuf
+	// input formats, empty disables them
+	FormatSchemaPath string
+	// IngestSpoolDir spools the async inserts with wait_for_async_insert=0 to this directory, they are acknowledged
+	// once synced to disk and applied in the background, empty keeps them in memory until their flush
+	IngestSpoolDir string
+}
+
+type Options struct {
+	DbPath            string
+	Listeners         []ListenerOptions
+	ClickhouseOptions ClickhouseOptions
+	UseHack           bool
+	Auth              bool
+	// PoolerCompat reports the session parameters tracked by pgbouncer/odyssey and uses postgresql command tags
+	PoolerCompat bool
+	// GrafanaCompat creates the catalog views and functions queried by the grafana postgresql datasource and reports
+	// the session parameters of pooler compatible mode
+	GrafanaCompat bool
+	// ResultSpool spools the result of a statement before sending it, so slow clients don't pin DuckDB results
+	ResultSpool bool
+	// ResultSpoolMemory is the size of a spooled result kept in memory before spilling to a temporary file
+	ResultSpoolMemory int
+	// ServerVersion is the postgresql server_version reported to clients, default 16.0, listeners may override it
+	ServerVersion string
+	// WriteBufferSize is the output buffer size of a postgresql connection, default 64KB
+	WriteBufferSize int
+	// MaxMessageSize is the max size of a message of a postgresql client, default 64MB, COPY data isn't limited
+	MaxMessageSize int
+	// TCPDelay enables Nagle's algorithm on postgresql connections, by default TCP_NODELAY is set as the output
+	// buffer already batches the messages of a response
+	TCPDelay bool
+	// SocketSendBuffer is the socket send buffer size of a postgresql connection, 0 keeps the system default
+	SocketSendBuffer int
+	// CheckpointWalSize triggers a background checkpoint when the WAL grows over this size, 0 disables it
+	CheckpointWalSize int64
+	// CheckpointInterval triggers a background checkpoint periodically, 0 disables it
+	CheckpointInterval time.Duration
+	// DiskSoftLimit warns when free space of the database volume is below this many bytes, 0 disables it
+	DiskSoftLimit uint64
+	// DiskHardLimit rejects writes when free space of the database volume is below this many bytes, 0 disables it
+	DiskHardLimit uint64
+	// SnapshotDir restores an in-memory database from this directory on start and exports it there on stop
+	SnapshotDir string
+	// SnapshotInterval also exports the in-memory database periodically, 0 only exports on stop
+	SnapshotInterval time.Duration
+	// ReplicationPublishDir makes the server a writer publishing a copy of its database to this directory, shared
+	// with the readers
+	ReplicationPublishDir string
+	// ReplicationPublishInterval is the interval between the published copies
+	ReplicationPublishInterval time.Duration
+	// ReplicaOf makes the server a read-only reader of the copies published to this directory, the database must
+	// be in-memory
+	ReplicaOf string
+	// ReplicaPollInterval is the interval between the checks for a newer copy
+	ReplicaPollInterval time.Duration
+	// AutoUpgrade migrates a database file written by another DuckDB version on start, it's exported with DuckDBCli
+	// and imported into a new file
+	AutoUpgrade bool
+	// DuckDBCli is the DuckDB cli of the version that wrote the database file, used by AutoUpgrade
+	DuckDBCli string
+	// Superusers may run EXPORT DATABASE and IMPORT DATABASE, which read and write files of the server host
+	Superusers []string
+	// PprofListen is the address of the admin http listener serving the go profiler under /debug/pprof/, /metrics
+	// and /replication/status without authentication, empty to disable
+	PprofListen string
+	// QueryStats profiles every query to account the rows and bytes it reads in the metrics
+	QueryStats bool
+	// QueryLog logs the queries of both frontends to duckserver.query_log, shown by system.query_log
+	QueryLog bool
+	// TTLInterval is the interval between deletions of the rows expired by duckserver.ttl_policies, 0 disables them
+	TTLInterval time.Duration
+	// DataDir holds the databases of CREATE DATABASE, one DuckDB file each, empty disables CREATE DATABASE
+	DataDir string
+	// MaxRunningQueries is the number of queries running at once, the others wait and start by priority, 0 is
+	// unlimited
+	MaxRunningQueries int
+	// LowPriorityQueries is the number of low priority queries running at once, default 2
+	LowPriorityQueries int
+	// IdleInTransactionTimeout terminates the sessions idle in a transaction for longer and TransactionTimeout the
+	// sessions whose transaction is open for longer, rolling back the transaction, 0 disables them. Sessions change
+	// them with SET idle_in_transaction_session_timeout and transaction_timeout
+	IdleInTransactionTimeout time.Duration
+	TransactionTimeout       time.Duration
+	// TempDirectory is the directory DuckDB spills the operators larger than memory to and MaxTempDirectorySize
+	// limits its size, like 100GB, empty keeps the defaults of DuckDB, the database path with .tmp and 90% of the
+	// free space
+	TempDirectory        string
+	MaxTempDirectorySize string
+	// ScratchDir holds the scratch files of the server, the spooled results, cursors, exports, the result cache and
+	// the downloads of remote urls, empty is the temporary directory of the system
+	ScratchDir string
+	// RemotePeers is the addresses remote() may fetch tables from, like node1:8123, * allows all addresses. Empty
+	// disables remote()
+	RemotePeers []string
+	// RemoteMaxBytes is the largest table remote() fetches from a shard, 0 is 1GiB
+	RemoteMaxBytes int64
+	// RemoteURLAllowlist is the url prefixes the queries may read files from, * allows all urls. Empty keeps the
+	// http and s3 file systems of DuckDB
+	RemoteURLAllowlist []string
+	// RemoteURLMaxBytes is the largest file a query reads from a remote url, 0 is 1GiB
+	RemoteURLMaxBytes int64
+	// AuthProvider verifies users of both frontends, nil uses the duckserver.users table
+	AuthProvider AuthProvider
+	Hooks        Hooks
+}
+
+type PgServer struct {
+	Connector    *duckdb.Connector
+	conn         *sql.DB
+	backends     sync.Map
+	enableAuth   bool
+	checkpointer *checkpointer
+	ttl          *ttlJob
+	partitions   *partitionedTables
+	diskGuard    *diskGuard
+	snapshotter  *snapshotter
+	publisher    *replicationPublisher
+	replica      *replica
+	dataDir      string
+	mainDatabase string
+	databaseMu   sync.Mutex
+	// schemaVersion is bumped by DDL statements of any session
+	schemaVersion     atomic.Uint64
+	poolerCompat      bool
+	grafanaCompat     bool
+	resultSpool       bool
+	resultSpoolMemory int
+	writeBufferSize   int
+	maxMessageSize    int
+	tcpDelay          bool
+	socketSendBuffer  int
+	queryStats        bool
+	superusers        []string
+	tableWidths       tableWidths
+	serverVersion     string
+	duckdbVersion     string
+	authProvider      AuthProvider
+	usage             *usageTracker
+	queryLog          *queryLog
+	rowPolicies       *rowPolicies
+	statementRules    *statementRules
+	namedQueries      *namedQueries
+	remoteURLs        *remoteURLPolicy
+	remotePeers       *remotePeers
+	resultCache       *resultCache
+	spool             *ingestSpool
+	// scratchDir is the directory of the scratch files of the server
+	scratchDir string
+	scheduler  *queryScheduler
+	// idleInTransactionTimeout and transactionTimeout are the defaults of the sessions
+	idleInTransactionTimeout time.Duration
+	transactionTimeout       time.Duration
+	hooks                    Hooks
+	listeners                []net.Listener
+	httpServers              []*http.Server
+	// duckdbTimeZone is set when DuckDB has the TimeZone setting of ICU, SET TIME ZONE is passed on to it
+	duckdbTimeZone bool
+	// cursors are the results paginated by the clickhouse http api and appenders the pool of the inserts
+	cursors   *queryCursors
+	appenders *appenderPool
+	errCh     chan error
+	done      chan struct{}
+	stopOnce  sync.Once
+}
+
+// systemDatabasesView and systemTablesView are the clickhouse system tables listing databases and tables, views are
+// listed with the View engine like clickhouse for dbt-clickhouse
+const systemDatabasesView = `system.databases as
+select schema_name as name,
+       'Atomic'    as engine
+from information_schema.schemata
+where catalog_name not in ('system', 'temp');`
+const systemTablesView = `system.tables as
+select table_name    as name,
+       table_schema  as database,
+       'uuid'        as uuid,
+       case when table_type = 'VIEW' then 'View' else 'duckdb' end as engine,
+       0             as is_temporary,
+       table_comment as comment
+from information_schema.tables
+where table_type = 'BASE TABLE'
+   or table_type = 'VIEW' and table_schema not in ('system', 'information_schema', 'pg_catalog') and table_name not in ('pg_type', 'pg_matviews');`
+
+func duckdbInit(execer driver.ExecerContext) error {
+	var statements = []string{
+		`create view if not exists pg_type as select type_oid as oid,case when logical_type like '%TIMESTAMP_%' then 'TIMESTAMP' when logical_type = 'DECIMAL' then 'NUMERIC' when logical_type='BOOLEAN' then 'bool' when logical_type = 'ENUM' then type_name else logical_type end as typname from duckdb_types where oid is not null;`,
+		`create view if not exists pg_matviews as select '' as  matviewname , '' as schemaname limit 0;`,
+		`create view if not exists information_schema.constraint_column_usage as select '' constraint_name limit 0;`,
+		`create function if not exists array_positions(a,b) as 0;`,
+		`create function if not exists timezone() as 'utc';`,
+		`create function if not exists currentDatabase() as current_schema();`,
+		`create schema if not exists system;`,
+		`create view if not exists ` + systemDatabasesView,
+		`create view if not exists ` + systemTablesView,
+		`create view if not exists system.columns as
+select table_schema   as database,
+       table_name     as table,
+       column_name    as name,
+       data_type      as type,
+       column_comment as comment,
+       data_type         default_kind,
+       column_default as default_expression
+from information_schema.columns;`,
+		`create view if not exists system.functions as
+select proname as name, prokind = 'a' as is_aggregate
+from pg_proc;`,
+	}
+	for _, stmt := range statements {
+		if _, err := execer.ExecContext(context.Background(), stmt, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Start opens the server and blocks until it stops
+func (s *PgServer) Start(options Options) error {
+	if err := s.Open(options); err != nil {
+		return err
+	}
+	return s.Wait()
+}
+
+// Open opens the database and starts the listeners, it returns once the server accepts connections
+func (s *PgServer) Open(options Options) error {
+	memory := isMemoryDB(options.DbPath)
+	if options.SnapshotDir != "" && !memory {
+		return fmt.Errorf("snapshot_dir requires an in-memory database, db_path is %s", options.DbPath)
+	}
+	if options.ReplicaOf != "" && !memory {
+		return fmt.Errorf("replica_of requires an in-memory database, db_path is %s", options.DbPath)
+	}
+	if options.ReplicaOf != "" && (options.ReplicationPublishDir != "" || options.SnapshotDir != "") {
+		return fmt.Errorf("replica_of can't be used with replication_publish_dir or snapshot_dir")
+	}
+	if !memory {
+		if err := checkStorageVersion(options.DbPath, options.AutoUpgrade, options.DuckDBCli); err != nil {
+			return err
+		}
+	}
+	dsn := options.DbPath
+	if memory {
+		// go-duckdb opens an in-memory database for an empty path
+		dsn = ""
+	}
+	// the hack objects are created after the restore, so IMPORT DATABASE doesn't find them already existing
+	var restoring atomic.Bool
+	restoring.Store(options.SnapshotDir != "")
+	duckConnector, err := duckdb.NewConnector(dsn, func(execer driver.ExecerContext) error {
+		if !options.UseHack || restoring.Load() {
+			return nil
+		}
+		return duckdbInit(execer)
+	})
+	if err != nil {
+		return err
+	}
+	if memory {
+		logrus.Infof("Open in-memory DuckDB database")
+	} else {
+		logrus.Infof("Open DuckDB database at %s", options.DbPath)
+	}
+	s.Connector = duckConnector
+	if options.SnapshotDir != "" {
+		conn, err := duckConnector.Connect(context.Background())
+		if err != nil {
+			return err
+		}
+		err = restoreSnapshot(conn, options.SnapshotDir)
+		_ = conn.Close()
+		if err != nil {
+			return err
+		}
+		restoring.Store(false)
+	}
+	s.conn = sql.OpenDB(s.Connector)
+
+	if err = runMigrations(context.Background(), s.conn); err != nil {
+		return err
+	}
+	if s.partitions, err = loadPartitionedTables(context.Background(), s.conn); err != nil {
+		return err
+	}
+	if options.GrafanaCompat {
+		if err = grafanaInit(context.Background(), s.conn); err != nil {
+			return err
+		}
+	}
+	s.dataDir = options.DataDir
+	if err = s.attachDatabases(); err != nil {
+		return err
+	}
+	s.hooks = options.Hooks
+	if s.hooks.OnOpen != nil {
+		if err = s.hooks.OnOpen(s.conn); err != nil {
+			return err
+		}
+	}
+	s.errCh = make(chan error, len(options.Listeners)+len(options.ClickhouseOptions.Listeners))
+	s.done = make(chan struct{})
+	if options.Auth {
+		s.enableAuth = true
+	}
+	s.poolerCompat = options.PoolerCompat
+	s.grafanaCompat = options.GrafanaCompat
+	s.resultSpool = options.ResultSpool
+	s.resultSpoolMemory = options.ResultSpoolMemory
+	s.writeBufferSize = options.WriteBufferSize
+	s.maxMessageSize = options.MaxMessageSize
+	s.tcpDelay = options.TCPDelay
+	s.socketSendBuffer = options.SocketSendBuffer
+	s.queryStats = options.QueryStats
+	s.idleInTransactionTimeout = options.IdleInTransactionTimeout
+	s.transactionTimeout = options.TransactionTimeout
+	s.superusers = options.Superusers
+	s.serverVersion = options.ServerVersion
+	if s.serverVersion == "" {
+		s.serverVersion = defaultServerVersion
+	}
+	if err = s.conn.QueryRow("select library_version from pragma_version()").Scan(&s.duckdbVersion); err != nil {
+		return err
+	}
+	if err = s.conn.QueryRow("select count(*) > 0 from duckdb_settings() where name = 'TimeZone'").Scan(&s.duckdbTimeZone); err != nil {
+		return err
+	}
+	s.authProvider = options.AuthProvider
+	if s.authProvider == nil {
+		s.authProvider = &tableAuthProvider{db: s.conn}
+	}
+	if s.scratchDir, err = openScratchDir(options.ScratchDir); err != nil {
+		return err
+	}
+	if err = setTempDirectory(s.conn, options.TempDirectory, options.MaxTempDirectorySize); err != nil {
+		return err
+	}
+	go newStorageUsage(s.conn, s.scratchDir).Run(s.done)
+	if memory {
+		// an in-memory database has no WAL, CHECKPOINT is still accepted
+		s.checkpointer = newCheckpointer(s, options.DbPath, 0, 0)
+		s.diskGuard = newDiskGuard(filepath.Join(options.SnapshotDir, memoryDbPath), options.DiskSoftLimit, options.DiskHardLimit)
+	} else {
+		s.checkpointer = newCheckpointer(s, options.DbPath, options.CheckpointWalSize, options.CheckpointInterval)
+		s.diskGuard = newDiskGuard(options.DbPath, options.DiskSoftLimit, options.DiskHardLimit)
+	}
+	go s.checkpointer.Run()
+	if options.ReplicaOf == "" {
+		// a reader is read-only, it gets the rows expired by the writer with the next copy
+		s.ttl = newTTLJob(s, options.TTLInterval)
+		go s.ttl.Run()
+	}
+	if options.SnapshotDir != "" {
+		s.snapshotter = newSnapshotter(s, options.SnapshotDir, options.SnapshotInterval)
+		go s.snapshotter.Run()
+	}
+	if options.ReplicationPublishDir != "" {
+		if s.publisher, err = newReplicationPublisher(s, options.ReplicationPublishDir, options.ReplicationPublishInterval); err != nil {
+			return err
+		}
+		go s.publisher.Run()
+	}
+	if options.ReplicaOf != "" {
+		s.replica = newReplica(s, options.ReplicaOf, options.ReplicaPollInterval)
+		if err = s.replica.Pull(context.Background()); err != nil {
+			logrus.Warnf("pull snapshot error: %v", err)
+		}
+		go s.replica.Run()
+	}
+	go s.diskGuard.Run(s.done)
+	if s.usage, err = newUsageTracker(s.conn); err != nil {
+		return err
+	}
+	go s.usage.Run(s.done)
+	if options.QueryLog {
+		s.queryLog = newQueryLog(s.conn)
+		go s.queryLog.Run(s.done)
+	}
+	if s.rowPolicies, err = newRowPolicies(s.conn); err != nil {
+		return err
+	}
+	if s.statementRules, err = newStatementRules(s.conn); err != nil {
+		return err
+	}
+	s.namedQueries = newNamedQueries(s.conn)
+	s.scheduler = newQueryScheduler(s.conn, options.MaxRunningQueries, options.LowPriorityQueries)
+	if s.remotePeers, err = newRemotePeers(options.RemotePeers, options.RemoteMaxBytes); err != nil {
+		return err
+	}
+	if s.remoteURLs, err = newRemoteURLPolicy(options.RemoteURLAllowlist, options.RemoteURLMaxBytes, s.scratchDir); err != nil {
+		return err
+	}
+	// with an allowlist the allowed urls are downloaded by the server, DuckDB can't reach urls computed by queries.
+	// The file systems can't be enabled again
+	if s.remoteURLs != nil {
+		if _, err = s.conn.Exec("SET disabled_filesystems = 'HTTPFileSystem,S3FileSystem'"); err != nil {
+			return err
+		}
+	}
+	if options.ClickhouseOptions.Enabled {
+		if err = s.StartClickhouseHttp(options.ClickhouseOptions); err != nil {
+			_ = s.Stop()
+			return err
+		}
+	}
+	if options.PprofListen != "" {
+		if err = s.startAdminHttp(options.PprofListen); err != nil {
+			_ = s.Stop()
+			return err
+		}
+	}
+	for _, l := range options.Listeners {
+		tlsConfig, err := l.TLSConfig()
+		if err != nil {
+			_ = s.Stop()
+			return err
+		}
+		lis, err := l.Listen()
+		if err != nil {
+			_ = s.Stop()
+			return err
+		}
+		s.listeners = append(s.listeners, lis)
+		logrus.Infof("Listening postgresql wire protocol on %s", l)
+		go s.serve(lis, &pgListener{options: l, tlsConfig: tlsConfig})
+	}
+	return nil
+}
+
+// Wait blocks until a listener fails or the server is stopped
+func (s *PgServer) Wait() error {
+	select {
+	case err := <-s.errCh:
+		return err
+	case <-s.done:
+		return nil
+	}
+}
+
+// Stop closes the listeners, the client connections and the database
+func (s *PgServer) Stop() error {
+	var err error
+	s.stopOnce.Do(func() {
+		close(s.done)
+		for _, lis := range s.listeners {
+			_ = lis.Close()
+		}
+		for _, srv := range s.httpServers {
+			_ = srv.Close()
+		}
+		s.cursors.Close()
+		s.spool.Close()
+		s.appenders.Close()
+		s.resultCache.Close()
+		s.backends.Range(func(key, value any) bool {
+			_ = value.(*PgConn).wire.conn.Close()
+			return true
+		})
+		if s.usage != nil {
+			if flushErr := s.usage.Flush(context.Background()); flushErr != nil {
+				logrus.Warnf("flush usage error: %v", flushErr)
+			}
+		}
+		if flushErr := s.queryLog.Flush(context.Background()); flushErr != nil {
+			logrus.Warnf("flush query log error: %v", flushErr)
+		}
+		if s.snapshotter != nil {
+			if snapshotErr := s.snapshotter.Snapshot(context.Background()); snapshotErr != nil {
+				logrus.Errorf("snapshot on stop error: %v", snapshotErr)
+			}
+		}
+		if s.conn != nil {
+			err = s.conn.Close()
+		}
+		if s.Connector != nil {
+			if closeErr := s.Connector.Close(); err == nil {
+				err = closeErr
+			}
+		}
+	})
+	return err
+}
+
+type pgListener struct {
+	options   ListenerOptions
+	tlsConfig *tls.Config
+}
+
+func (s *PgServer) serve(lis net.Listener, listener *pgListener) {
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				s.errCh <- err
+				return
+			}
+			continue
+		}
+		s.tuneSocket(conn)
+		pgConn := newPgConn(conn, s, listener)
+		pgConn.Run()
+	}
+}
+
+func (s *PgServer) CreateUser(user, password string) error {
+	if _, ok := s.authProvider.(*tableAuthProvider); !ok {
+		return errors.New("create user is only supported by the table auth provider")
+	}
+	pass, err := pgpasswd.Encrypt([]byte(password))
+	if err != nil {
+		return err
+	}
+	_, err = s.conn.ExecContext(context.Background(), "insert into duckserver.users (username, password) values ($1, $2)", user, pass)
+	return err
+}
+
+func (s *PgServer) StartClickhouseHttp(options ClickhouseOptions) error {
+	conn := sql.OpenDB(s.Connector)
+	s.cursors = newQueryCursors(options.CursorTTL)
+	s.appenders = newAppenderPool(s.Connector, &s.schemaVersion, options.AppenderIdleTimeout)
+	resultCache, err := newResultCache(s.scratchDir, options.ResultCacheMaxBytes, options.ResultCacheStale, &s.schemaVersion)
+	if err != nil {
+		return err
+	}
+	s.resultCache = resultCache
+	asyncInserts := newAsyncInserter(s.appenders, options.AsyncInsertMaxRows, options.AsyncInsertFlushInterval)
+	if options.IngestSpoolDir != "" {
+		// the writer reads the spooled inserts like a clickhouse listener
+		spoolServer := &ChServer{
+			conn:             conn,
+			connector:        s.Connector,
+			pgServer:         s,
+			asyncInserts:     asyncInserts,
+			partitions:       options.Partitions,
+			formatSchemaPath: options.FormatSchemaPath,
+		}
+		if s.spool, err = newIngestSpool(options.IngestSpoolDir, spoolServer); err != nil {
+			return err
+		}
+		go s.spool.Run()
+	}
+	var jwt *jwtVerifier
+	if options.JWT != nil {
+		jwt = newJWTVerifier(*options.JWT)
+	}
+	serverVersion := options.ServerVersion
+	if serverVersion == "" {
+		serverVersion = defaultClickhouseVersion
+	}
+	displayName := options.DisplayName
+	if displayName == "" {
+		displayName, _ = os.Hostname()
+	}
+	var cors *corsPolicy
+	if options.CORS != nil {
+		cors = newCorsPolicy(*options.CORS)
+	}
+	for _, l := range options.Listeners {
+		chServer := &ChServer{
+			conn:                conn,
+			connector:           s.Connector,
+			pgServer:            s,
+			asyncInserts:        asyncInserts,
+			enableAuth:          l.Auth,
+			jwt:                 jwt,
+			serverVersion:       serverVersion,
+			displayName:         displayName,
+			cors:                cors,
+			partitions:          options.Partitions,
+			coalesceInsertBytes: options.CoalesceInsertBytes,
+			formatSchemaPath:    options.FormatSchemaPath,
+			spool:               s.spool,
+			statements:          l.Statements,
+		}
+		lis, err := l.Listen()
+		if err != nil {
+			return err
+		}
+		lis = newLimitListener(lis, options.MaxConnections)
+		srv := newChHttpServer(chServer, options)
+		s.httpServers = append(s.httpServers, srv)
+		logrus.Infof("Listening clickhouse http protocol on %s", l)
+		go func(l ListenerOptions) {
+			var err error
+			if l.TLSCert != "" {
+				err = srv.ServeTLS(lis, l.TLSCert, l.TLSKey)
+			} else {
+				err = srv.Serve(lis)
+			}
+			if !errors.Is(err, http.ErrServerClosed) {
+				s.errCh <- err
+			}
+		}(l)
+	}
+	return nil
+}
+
+func (s *PgServer) Close(key [8]byte) {
+	s.backends.Delete(key)
+}
+
+func (s *PgServer) CancelRequest(key [8]byte) {
+	if backend, ok := s.backends.Load(key); ok {
+		if backend.(*PgConn).cancel != nil {
+			backend.(*PgConn).cancel()
+		}
+	}
+}
@@ -1,4 +1,4 @@
-package main
+package duckserver
 
 import (
 	"fmt"
@@ -21,7 +21,8 @@ var pgTypes = []pgType{
 	{17, "bytea", 0},
 	{18, "char", 0},
 	{20, "int8", 0},
-	{21, "int4", 0},
+	{21, "int2", 0},
+	{23, "int4", 0},
 	{700, "float4", 0},
 	{701, "float8", 0},
 	{25, "text", 0},
@@ -29,6 +30,7 @@ var pgTypes = []pgType{
 	{1114, "timestamp", 0},
 	{1184, "timestamptz", 0},
 	{114, "json", 0},
+	{1186, "interval", 0},
 }
 
 var oidTypeMap = map[int32]pgType{}
@@ -75,15 +77,32 @@ func toPgValue(v any) (pgValue, error) {
 	case int32:
 		s := strconv.FormatInt(int64(v), 10)
 		b := []byte(s)
-		return pgValue{pgTypeFromOid(21), b}, nil
+		return pgValue{pgTypeFromOid(23), b}, nil
 	case int64:
 		s := strconv.FormatInt(v, 10)
 		b := []byte(s)
 		return pgValue{pgTypeFromOid(20), b}, nil
+	case uint8:
+		s := strconv.FormatUint(uint64(v), 10)
+		b := []byte(s)
+		return pgValue{pgTypeFromOid(21), b}, nil
+	case uint16:
+		s := strconv.FormatUint(uint64(v), 10)
+		b := []byte(s)
+		return pgValue{pgTypeFromOid(23), b}, nil
+	case uint32:
+		s := strconv.FormatUint(uint64(v), 10)
+		b := []byte(s)
+		return pgValue{pgTypeFromOid(20), b}, nil
+	case uint64:
+		// UBIGINT overflows int8, it is sent as numeric like HUGEINT
+		s := strconv.FormatUint(v, 10)
+		b := []byte(s)
+		return pgValue{pgTypeFromOid(1700), b}, nil
 	case float32:
 		s := strconv.FormatFloat(float64(v), 'f', -1, 32)
 		b := []byte(s)
-		return pgValue{pgTypeFromOid(701), b}, nil
+		return pgValue{pgTypeFromOid(700), b}, nil
 	case float64:
 		s := strconv.FormatFloat(v, 'f', -1, 64)
 		b := []byte(s)
@@ -91,13 +110,16 @@ func toPgValue(v any) (pgValue, error) {
 	case string:
 		b := []byte(v)
 		return pgValue{pgTypeFromOid(25), b}, nil
+	case []byte:
+		return pgValue{pgTypeFromOid(17), encodeBytea(v)}, nil
 	case nil:
 		return pgValue{pgTypeFromOid(25), nil}, nil
 	case duckdb.Decimal:
-		f := v.Float64()
-		s := strconv.FormatFloat(f, 'f', -1, 64)
-		b := []byte(s)
+		b := []byte(duckDecimalToString(v))
 		return pgValue{pgTypeFromOid(1700), b}, nil
+	case duckdb.Interval:
+		b := []byte(formatInterval(v))
+		return pgValue{pgTypeFromOid(1186), b}, nil
 	case time.Time:
 		s := v.Format("2006-01-02 15:04:05.999999")
 		b := []byte(s)
@@ -109,6 +131,10 @@ func toPgValue(v any) (pgValue, error) {
 	case []any:
 		var res []string
 		for _, e := range v {
+			if e == nil {
+				res = append(res, "NULL")
+				continue
+			}
 			pv, err := toPgValue(e)
 			if err != nil {
 				return pgValue{}, err
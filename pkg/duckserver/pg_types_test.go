@@ -0,0 +1,100 @@
+package duckserver
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/marcboeker/go-duckdb"
+	"math"
+	"math/big"
+	"testing"
+)
+
+// decodeNumericBinary decodes the postgresql binary numeric format to its text
+func decodeNumericBinary(b []byte) (string, error) {
+	if len(b) < 8 {
+		return "", fmt.Errorf("numeric of %d bytes", len(b))
+	}
+	ndigits := int(binary.BigEndian.Uint16(b))
+	weight := int(int16(binary.BigEndian.Uint16(b[2:])))
+	sign := binary.BigEndian.Uint16(b[4:])
+	scale := int(binary.BigEndian.Uint16(b[6:]))
+	if len(b) != 8+2*ndigits {
+		return "", fmt.Errorf("numeric of %d digits in %d bytes", ndigits, len(b))
+	}
+	n := new(big.Int)
+	for i := 0; i < ndigits; i++ {
+		n.Mul(n, big.NewInt(10000))
+		n.Add(n, big.NewInt(int64(binary.BigEndian.Uint16(b[8+2*i:]))))
+	}
+	if sign == numericNegative {
+		n.Neg(n)
+	}
+	// the digits are base 10000 from weight down to weight-ndigits+1
+	r := new(big.Rat).SetInt(n)
+	if exp := weight - ndigits + 1; exp > 0 {
+		r.Mul(r, new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10000), big.NewInt(int64(exp)), nil)))
+	} else if exp < 0 {
+		r.Quo(r, new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10000), big.NewInt(int64(-exp)), nil)))
+	}
+	return r.FloatString(scale), nil
+}
+
+func bigInt(s string) *big.Int {
+	n, _ := new(big.Int).SetString(s, 10)
+	return n
+}
+
+// TestIntegerBoundaries encodes HUGEINT and the unsigned integers at their boundaries in text and binary format, and
+// decodes the binary numerics back. go-duckdb can't scan UHUGEINT, its max is encoded as the *big.Int of a HUGEINT
+func TestIntegerBoundaries(t *testing.T) {
+	tests := []struct {
+		value any
+		oid   int32
+		text  string
+	}{
+		{bigInt("170141183460469231731687303715884105727"), 1700, "170141183460469231731687303715884105727"},
+		{bigInt("-170141183460469231731687303715884105728"), 1700, "-170141183460469231731687303715884105728"},
+		{bigInt("340282366920938463463374607431768211455"), 1700, "340282366920938463463374607431768211455"},
+		{bigInt("0"), 1700, "0"},
+		{bigInt("-1"), 1700, "-1"},
+		{bigInt("10000"), 1700, "10000"},
+		{uint64(math.MaxUint64), 1700, "18446744073709551615"},
+		{uint64(0), 1700, "0"},
+		{uint32(math.MaxUint32), 20, "4294967295"},
+		{uint16(math.MaxUint16), 23, "65535"},
+		{uint8(math.MaxUint8), 21, "255"},
+		{int64(-1), 20, "-1"},
+		{int64(math.MinInt64), 20, "-9223372036854775808"},
+		{duckdb.Decimal{Width: 38, Scale: 2, Value: bigInt("-12345")}, 1700, "-123.45"},
+		{duckdb.Decimal{Width: 38, Scale: 6, Value: bigInt("1")}, 1700, "0.000001"},
+	}
+	for _, test := range tests {
+		pv, err := toPgValue(test.value)
+		if err != nil {
+			t.Errorf("toPgValue(%v): %v", test.value, err)
+			continue
+		}
+		if pv.typ.Oid != test.oid || string(pv.val) != test.text {
+			t.Errorf("toPgValue(%v) = %d %s, want %d %s", test.value, pv.typ.Oid, pv.val, test.oid, test.text)
+		}
+		b, err := binaryValue(test.value)
+		if err != nil {
+			t.Errorf("binaryValue(%v): %v", test.value, err)
+			continue
+		}
+		var decoded string
+		switch test.oid {
+		case 1700:
+			decoded, err = decodeNumericBinary(b)
+		case 20:
+			decoded = fmt.Sprint(int64(binary.BigEndian.Uint64(b)))
+		case 23:
+			decoded = fmt.Sprint(int32(binary.BigEndian.Uint32(b)))
+		case 21:
+			decoded = fmt.Sprint(int16(binary.BigEndian.Uint16(b)))
+		}
+		if err != nil || decoded != test.text {
+			t.Errorf("binaryValue(%v) decodes to %s, %v, want %s", test.value, decoded, err, test.text)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package duckserver
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"fmt"
+	"github.com/goccy/go-json"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// profilingSetting enables profiling, as a postgresql SET parameter or a clickhouse setting
+const profilingSetting = "duckserver_profiling"
+
+type profilingContextKey struct{}
+
+func withProfiling(ctx context.Context) context.Context {
+	return context.WithValue(ctx, profilingContextKey{}, true)
+}
+
+func profilingFromContext(ctx context.Context) bool {
+	enabled, _ := ctx.Value(profilingContextKey{}).(bool)
+	return enabled
+}
+
+// isTrueSetting parses the boolean spellings of postgresql and clickhouse settings
+func isTrueSetting(value string) bool {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "1", "on", "true", "yes":
+		return true
+	}
+	return false
+}
+
+// queryProfile runs DuckDB's json profiler for a query on one connection, the profiler writes the output to a
+// temporary file after the query finishes
+type queryProfile struct {
+	id    string
+	path  string
+	start time.Time
+	exec  func(ctx context.Context, stmt string) error
+}
+
+func startProfile(ctx context.Context, dir string, exec func(ctx context.Context, stmt string) error) (*queryProfile, error) {
+	f, err := os.CreateTemp(dir, "duckserver-profile-*.json")
+	if err != nil {
+		return nil, err
+	}
+	_ = f.Close()
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+	p := &queryProfile{id: hex.EncodeToString(id), path: f.Name(), start: time.Now(), exec: exec}
+	for _, stmt := range []string{"PRAGMA enable_profiling='json'", "PRAGMA profiling_output='" + strings.ReplaceAll(p.path, "'", "''") + "'"} {
+		if err = exec(ctx, stmt); err != nil {
+			_ = os.Remove(p.path)
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// profileResult is the output of the profiler for a query
+type profileResult struct {
+	profile []byte
+	timing  time.Duration
+	stats   queryStats
+}
+
+// Stop disables the profiler and reads the profile of the query
+func (p *queryProfile) Stop(s *PgServer) (*profileResult, error) {
+	defer os.Remove(p.path)
+	if err := p.exec(context.Background(), "PRAGMA disable_profiling"); err != nil {
+		return nil, err
+	}
+	profile, err := os.ReadFile(p.path)
+	if err != nil {
+		return nil, err
+	}
+	var root profileNode
+	if len(profile) > 0 {
+		if err = json.Unmarshal(profile, &root); err != nil {
+			logrus.Debugf("parse profile error: %v", err)
+		}
+	}
+	return &profileResult{profile: profile, timing: time.Duration(root.Timing * float64(time.Second)), stats: s.scanStats(&root)}, nil
+}
+
+// Store stores the profile in duckserver.profiles
+func (p *queryProfile) Store(db *sql.DB, result *profileResult, user, application, protocol, query string) error {
+	_, err := db.ExecContext(context.Background(), "insert into duckserver.profiles (id, username, application, protocol, query, started_at, timing_ms, profile) values ($1, $2, $3, $4, $5, $6, $7, $8)",
+		p.id, user, application, protocol, query, p.start, float64(result.timing.Microseconds())/1000, string(result.profile))
+	return err
+}
+
+// sqlQueryer is implemented by both *sql.DB and *sql.Conn
+type sqlQueryer interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// profiledQuery is the connection of a clickhouse query, Finish stops the profiler once the query ran and Done
+// also returns the connection once the result is read
+type profiledQuery struct {
+	finishOnce sync.Once
+	finish     func()
+	release    func()
+}
+
+// Finish stops the profiler, it may be called before Done to report the rows read before sending the result
+func (q *profiledQuery) Finish() {
+	q.finishOnce.Do(q.finish)
+}
+
+func (q *profiledQuery) Done() {
+	q.Finish()
+	q.release()
+}
+
+// profiledConn returns the connection to run a clickhouse query on. When profiling is requested the query runs on
+// a dedicated connection with the profiler enabled, the profile id is returned in the X-DuckServer-Profile-Id
+// header. With query stats the profiler also runs, the rows and bytes read are added to progress.
+func (c *ChServer) profiledConn(ctx context.Context, query string, wr http.ResponseWriter, progress *chProgress) (sqlQueryer, *profiledQuery, error) {
+	profiling := profilingFromContext(ctx)
+	if !profiling && !c.pgServer.queryStats && !queryStatsFromContext(ctx) {
+		conn, release, err := c.requestQueryer(ctx)
+		return conn, &profiledQuery{finish: func() {}, release: release}, err
+	}
+	conn, release, err := c.databaseConn(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	exec := func(ctx context.Context, stmt string) error {
+		_, err := conn.ExecContext(ctx, stmt)
+		return err
+	}
+	profile, err := startProfile(ctx, c.pgServer.scratchDir, exec)
+	if err != nil {
+		logrus.Warnf("start profiling error: %v", err)
+		return conn, &profiledQuery{finish: func() {}, release: release}, nil
+	}
+	if profiling {
+		wr.Header().Set("X-DuckServer-Profile-Id", profile.id)
+	}
+	finish := func() {
+		result, err := profile.Stop(c.pgServer)
+		if err != nil {
+			logrus.Warnf("stop profiling error: %v", err)
+			return
+		}
+		recordQueryStats(ApplicationFromContext(ctx), result.stats)
+		progress.readRows.Add(result.stats.readRows)
+		progress.readBytes.Add(result.stats.readBytes)
+		if !profiling {
+			return
+		}
+		if err = profile.Store(c.pgServer.conn, result, UserFromContext(ctx), ApplicationFromContext(ctx), ProtocolClickhouse, query); err != nil {
+			logrus.Warnf("store profile error: %v", err)
+		}
+	}
+	return conn, &profiledQuery{finish: finish, release: release}, nil
+}
+
+// runProfiled runs a postgresql statement with the profiler enabled, the profile is stored when profiling is set
+// and the timing and the rows and bytes read are reported with a notice when profiling or query stats are set
+func (c *PgConn) runProfiled(query string, run func() error) error {
+	exec := func(ctx context.Context, stmt string) error {
+		_, err := c.conn.(driver.ExecerContext).ExecContext(ctx, stmt, nil)
+		return err
+	}
+	profile, err := startProfile(context.Background(), c.server.scratchDir, exec)
+	if err != nil {
+		return c.SendErrorResponse(err.Error())
+	}
+	runErr := run()
+	result, err := profile.Stop(c.server)
+	if err != nil {
+		logrus.Warnf("stop profiling error: %v", err)
+		return runErr
+	}
+	recordQueryStats(c.applicationName(), result.stats)
+	c.stats = result.stats
+	if c.profiling {
+		if err = profile.Store(c.server.conn, result, c.user, c.applicationName(), ProtocolPostgres, query); err != nil {
+			logrus.Warnf("store profile error: %v", err)
+			return runErr
+		}
+	}
+	if runErr != nil {
+		return runErr
+	}
+	stats := fmt.Sprintf("%d rows, %d bytes read", result.stats.readRows, result.stats.readBytes)
+	if c.profiling {
+		return c.SendNotice(fmt.Sprintf("profile %s: %.3f ms, %s", profile.id, float64(result.timing.Microseconds())/1000, stats))
+	}
+	if c.queryStats {
+		return c.SendNotice(stats)
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+package duckserver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const proxyHeaderTimeout = 5 * time.Second
+
+var proxyV2Signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+// proxyListener reads the HAProxy PROXY protocol v1/v2 header of accepted connections,
+// RemoteAddr of the returned connections is the real client address. Only the trusted proxies may send the header,
+// the connections of other addresses are closed
+type proxyListener struct {
+	net.Listener
+	trusted []*net.IPNet
+	conns   chan net.Conn
+	errCh   chan error
+}
+
+func newProxyListener(lis net.Listener, trusted []*net.IPNet) *proxyListener {
+	l := &proxyListener{Listener: lis, trusted: trusted, conns: make(chan net.Conn), errCh: make(chan error, 1)}
+	go l.acceptLoop()
+	return l
+}
+
+func (l *proxyListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				l.errCh <- err
+				return
+			}
+			continue
+		}
+		if !l.isTrusted(conn.RemoteAddr()) {
+			logrus.Warnf("proxy protocol connection from untrusted address %s closed", conn.RemoteAddr())
+			_ = conn.Close()
+			continue
+		}
+		// read the header in its own goroutine so a slow client doesn't block accepting others
+		go func() {
+			pc, err := readProxyHeader(conn)
+			if err != nil {
+				logrus.Debugf("proxy protocol error from %s: %v", conn.RemoteAddr(), err)
+				_ = conn.Close()
+				return
+			}
+			l.conns <- pc
+		}()
+	}
+}
+
+// isTrusted reports whether addr is a trusted proxy
+func (l *proxyListener) isTrusted(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, network := range l.trusted {
+		if network.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case err := <-l.errCh:
+		l.errCh <- err
+		return nil, err
+	}
+}
+
+type proxyConn struct {
+	net.Conn
+	rd         *bufio.Reader
+	remoteAddr net.Addr
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	return c.rd.Read(p)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func readProxyHeader(conn net.Conn) (net.Conn, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout)); err != nil {
+		return nil, err
+	}
+	rd := bufio.NewReader(conn)
+	pc := &proxyConn{Conn: conn, rd: rd}
+	sig, err := rd.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(sig, proxyV2Signature) {
+		pc.remoteAddr, err = readProxyV2Header(rd)
+	} else {
+		pc.remoteAddr, err = readProxyV1Header(rd)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return pc, conn.SetReadDeadline(time.Time{})
+}
+
+func readProxyV1Header(rd *bufio.Reader) (net.Addr, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(strings.TrimSuffix(line, "\r\n"))
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, fmt.Errorf("invalid proxy protocol v1 header")
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("invalid proxy protocol v1 header")
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("invalid proxy protocol v1 address")
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+func readProxyV2Header(rd *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(rd, header); err != nil {
+		return nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("invalid proxy protocol v2 version")
+	}
+	command := header[12] & 0x0F
+	family := header[13] >> 4
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(rd, payload); err != nil {
+		return nil, err
+	}
+	// LOCAL command is used by the proxy for health checks, keep the real address
+	if command == 0 {
+		return nil, nil
+	}
+	switch family {
+	case 1: // AF_INET
+		if len(payload) < 12 {
+			return nil, fmt.Errorf("invalid proxy protocol v2 address")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 2: // AF_INET6
+		if len(payload) < 36 {
+			return nil, fmt.Errorf("invalid proxy protocol v2 address")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,312 @@
+package duckserver
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/goccy/go-json"
+	"github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// queryCursorPath is the path of the pagination api of the clickhouse http endpoint
+const queryCursorPath = "/api/v1/query"
+
+const (
+	defaultCursorPageSize = 1000
+	maxCursorPageSize     = 100000
+	defaultCursorTTL      = 10 * time.Minute
+)
+
+// queryCursor is the result of a query materialized to a parquet file, pages are read from the file
+type queryCursor struct {
+	id       string
+	user     string
+	path     string
+	rowCount int64
+	mu       sync.Mutex
+	offset   int64
+	lastUsed time.Time
+}
+
+// queryCursors holds the cursors of the pagination api, cursors unused for ttl are closed
+type queryCursors struct {
+	ttl     time.Duration
+	mu      sync.Mutex
+	cursors map[string]*queryCursor
+	done    chan struct{}
+	once    sync.Once
+}
+
+func newQueryCursors(ttl time.Duration) *queryCursors {
+	if ttl <= 0 {
+		ttl = defaultCursorTTL
+	}
+	q := &queryCursors{ttl: ttl, cursors: make(map[string]*queryCursor), done: make(chan struct{})}
+	go q.expireLoop()
+	return q
+}
+
+func (q *queryCursors) expireLoop() {
+	ticker := time.NewTicker(q.ttl / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-q.done:
+			return
+		case <-ticker.C:
+			q.mu.Lock()
+			for id, cur := range q.cursors {
+				cur.mu.Lock()
+				expired := time.Since(cur.lastUsed) > q.ttl
+				cur.mu.Unlock()
+				if expired {
+					delete(q.cursors, id)
+					_ = os.Remove(cur.path)
+					logrus.Debugf("query cursor %s of %s expired", id, cur.user)
+				}
+			}
+			q.mu.Unlock()
+		}
+	}
+}
+
+func (q *queryCursors) Add(cur *queryCursor) {
+	q.mu.Lock()
+	q.cursors[cur.id] = cur
+	q.mu.Unlock()
+}
+
+// Get returns a cursor of user
+func (q *queryCursors) Get(id, user string) *queryCursor {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if cur := q.cursors[id]; cur != nil && cur.user == user {
+		return cur
+	}
+	return nil
+}
+
+// Remove closes a cursor of user, it reports false if there is none
+func (q *queryCursors) Remove(id, user string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	cur := q.cursors[id]
+	if cur == nil || cur.user != user {
+		return false
+	}
+	delete(q.cursors, id)
+	_ = os.Remove(cur.path)
+	return true
+}
+
+// Close removes the files of all cursors
+func (q *queryCursors) Close() {
+	if q == nil {
+		return
+	}
+	q.once.Do(func() {
+		close(q.done)
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		for id, cur := range q.cursors {
+			delete(q.cursors, id)
+			_ = os.Remove(cur.path)
+		}
+	})
+}
+
+type queryCursorRequest struct {
+	Query    string `json:"query"`
+	PageSize int    `json:"page_size"`
+}
+
+type queryCursorColumn struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// queryCursorPage is a page of a cursor, HasMore is false once the last row was read
+type queryCursorPage struct {
+	Cursor   string              `json:"cursor"`
+	Columns  []queryCursorColumn `json:"columns"`
+	Rows     [][]any             `json:"rows"`
+	Offset   int64               `json:"offset"`
+	RowCount int64               `json:"row_count"`
+	HasMore  bool                `json:"has_more"`
+}
+
+// serveQueryCursor serves the pagination api: POST runs a query into a new cursor and returns its first page, GET
+// returns the next page of ?cursor= or the page at ?offset=, DELETE closes the cursor
+func (c *ChServer) serveQueryCursor(ctx context.Context, wr http.ResponseWriter, r *http.Request) {
+	user := UserFromContext(ctx)
+	params := r.URL.Query()
+	pageSize := defaultCursorPageSize
+	if s := params.Get("page_size"); s != "" {
+		var err error
+		if pageSize, err = strconv.Atoi(s); err != nil {
+			writeApiError(wr, 400, fmt.Errorf("invalid page_size %s", s))
+			return
+		}
+	}
+	switch r.Method {
+	case http.MethodPost:
+		req := queryCursorRequest{Query: params.Get("query"), PageSize: pageSize}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeApiError(wr, 400, err)
+			return
+		}
+		if len(body) > 0 {
+			if err = json.Unmarshal(body, &req); err != nil {
+				writeApiError(wr, 400, fmt.Errorf("invalid request: %w", err))
+				return
+			}
+		}
+		if req.PageSize <= 0 || req.PageSize > maxCursorPageSize {
+			writeApiError(wr, 400, fmt.Errorf("page_size must be between 1 and %d", maxCursorPageSize))
+			return
+		}
+		cur, code, err := c.openQueryCursor(ctx, wr, req.Query)
+		if err != nil {
+			writeApiError(wr, code, err)
+			return
+		}
+		c.pgServer.cursors.Add(cur)
+		c.writeCursorPage(ctx, wr, cur, -1, req.PageSize)
+	case http.MethodGet:
+		cur := c.pgServer.cursors.Get(params.Get("cursor"), user)
+		if cur == nil {
+			writeApiError(wr, 404, fmt.Errorf("cursor %s not found", params.Get("cursor")))
+			return
+		}
+		offset := int64(-1)
+		if s := params.Get("offset"); s != "" {
+			var err error
+			if offset, err = strconv.ParseInt(s, 10, 64); err != nil || offset < 0 {
+				writeApiError(wr, 400, fmt.Errorf("invalid offset %s", s))
+				return
+			}
+		}
+		c.writeCursorPage(ctx, wr, cur, offset, pageSize)
+	case http.MethodDelete:
+		if !c.pgServer.cursors.Remove(params.Get("cursor"), user) {
+			writeApiError(wr, 404, fmt.Errorf("cursor %s not found", params.Get("cursor")))
+			return
+		}
+		wr.WriteHeader(http.StatusNoContent)
+	default:
+		writeApiError(wr, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+// openQueryCursor runs a select like SelectQuery and writes its result to a parquet file, the error comes with its
+// http status
+func (c *ChServer) openQueryCursor(ctx context.Context, wr http.ResponseWriter, query string) (*queryCursor, int, error) {
+	if err := c.pgServer.checkQuery(ctx, ProtocolClickhouse, query); err != nil {
+		return nil, 403, err
+	}
+	query, code, err := c.rewriteSelectQuery(ctx, query)
+	if err != nil {
+		return nil, code, err
+	}
+	if explainRegexp.MatchString(query) {
+		return nil, 400, fmt.Errorf("EXPLAIN can't be paginated")
+	}
+	query = formatCleanRegexp.ReplaceAllString(query, "$1")
+	query, cleanup, err := c.pgServer.fetchRemoteTables(ctx, query)
+	if err != nil {
+		return nil, 500, err
+	}
+	defer cleanup()
+	f, err := os.CreateTemp(c.pgServer.scratchDir, "duckserver-cursor-*.parquet")
+	if err != nil {
+		return nil, 500, err
+	}
+	_ = f.Close()
+	progress := newChProgress()
+	conn, profiled, err := c.profiledConn(ctx, query, wr, progress)
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return nil, 500, err
+	}
+	_, err = conn.ExecContext(ctx, fmt.Sprintf("COPY (%s) TO %s (FORMAT PARQUET)", query, quoteLiteral(f.Name())))
+	profiled.Done()
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return nil, 500, err
+	}
+	progress.SetSummary(wr)
+	cur := &queryCursor{user: UserFromContext(ctx), path: f.Name(), lastUsed: time.Now()}
+	if err = c.conn.QueryRowContext(ctx, fmt.Sprintf("select count(*) from read_parquet(%s)", quoteLiteral(cur.path))).Scan(&cur.rowCount); err != nil {
+		_ = os.Remove(f.Name())
+		return nil, 500, err
+	}
+	id := make([]byte, 16)
+	_, _ = rand.Read(id)
+	cur.id = hex.EncodeToString(id)
+	return cur, 200, nil
+}
+
+// writeCursorPage writes the page of a cursor at offset, -1 continues after the last page
+func (c *ChServer) writeCursorPage(ctx context.Context, wr http.ResponseWriter, cur *queryCursor, offset int64, pageSize int) {
+	if pageSize <= 0 || pageSize > maxCursorPageSize {
+		writeApiError(wr, 400, fmt.Errorf("page_size must be between 1 and %d", maxCursorPageSize))
+		return
+	}
+	cur.mu.Lock()
+	defer cur.mu.Unlock()
+	cur.lastUsed = time.Now()
+	if offset < 0 {
+		offset = cur.offset
+	}
+	rows, err := c.conn.QueryContext(ctx, fmt.Sprintf("select * from read_parquet(%s) limit %d offset %d", quoteLiteral(cur.path), pageSize, offset))
+	if err != nil {
+		writeApiError(wr, 500, err)
+		return
+	}
+	defer rows.Close()
+	columnTypes, err := rows.ColumnTypes()
+	if err != nil {
+		writeApiError(wr, 500, err)
+		return
+	}
+	page := queryCursorPage{Columns: make([]queryCursorColumn, len(columnTypes)), Rows: [][]any{}, Offset: offset, RowCount: cur.rowCount}
+	for i, col := range columnTypes {
+		page.Columns[i] = queryCursorColumn{Name: col.Name(), Type: col.DatabaseTypeName()}
+	}
+	for rows.Next() {
+		values := make([]any, len(columnTypes))
+		valuePointers := make([]any, len(columnTypes))
+		for i := range values {
+			valuePointers[i] = &values[i]
+		}
+		if err = rows.Scan(valuePointers...); err != nil {
+			writeApiError(wr, 500, err)
+			return
+		}
+		page.Rows = append(page.Rows, values)
+	}
+	if err = rows.Err(); err != nil {
+		writeApiError(wr, 500, err)
+		return
+	}
+	cur.offset = offset + int64(len(page.Rows))
+	page.HasMore = cur.offset < cur.rowCount
+	page.Cursor = cur.id
+	wr.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	_ = json.NewEncoder(wr).Encode(page)
+}
+
+// writeApiError writes the error of a json api request
+func writeApiError(wr http.ResponseWriter, code int, err error) {
+	wr.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	wr.WriteHeader(code)
+	_ = json.NewEncoder(wr).Encode(map[string]string{"error": err.Error()})
+}
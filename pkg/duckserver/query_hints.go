@@ -0,0 +1,126 @@
+package duckserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SqlStateQueryCanceled is the SQLSTATE of a statement stopped by its timeout
+const SqlStateQueryCanceled = "57014"
+
+// queryHintsRegexp matches the hint comments of a query, like select /*+ timeout=5s priority=low */ ...
+var queryHintsRegexp = regexp.MustCompile(`(?s)/\*\+(.*?)\*/`)
+
+// queryHintRegexp matches a hint of a hint comment, name=value, the value may be quoted
+var queryHintRegexp = regexp.MustCompile(`([A-Za-z_]\w*)\s*=\s*('(?:[^']|'')*'|[^\s,]+)`)
+
+// queryHintSettings are the hints named after the settings of the clickhouse endpoint they set
+var queryHintSettings = map[string]string{
+	"cache_ttl":   resultCacheTTLSetting,
+	"cache_stale": resultCacheStaleSetting,
+	"format":      defaultFormatSetting,
+}
+
+// queryHints are the hints of the comments of a query. The timeout and priority apply to both frontends, the other
+// hints are settings of the clickhouse endpoint, like the output format settings, which postgresql ignores
+type queryHints struct {
+	timeout time.Duration
+	// priority is set by a priority hint, it can't raise the priority of the user
+	priority    queryPriority
+	hasPriority bool
+	settings    url.Values
+}
+
+// parseQueryHints reads the hints of a query, an error for invalid timeout and priority hints
+func parseQueryHints(query string) (queryHints, error) {
+	var h queryHints
+	if !strings.Contains(query, "/*+") {
+		return h, nil
+	}
+	for _, comment := range queryHintsRegexp.FindAllStringSubmatch(query, -1) {
+		for _, m := range queryHintRegexp.FindAllStringSubmatch(comment[1], -1) {
+			name, value := strings.ToLower(m[1]), m[2]
+			if strings.HasPrefix(value, "'") && len(value) > 1 {
+				value = strings.ReplaceAll(value[1:len(value)-1], "''", "'")
+			}
+			switch name {
+			case "timeout":
+				timeout, err := time.ParseDuration(value)
+				if seconds, parseErr := strconv.ParseFloat(value, 64); parseErr == nil {
+					timeout, err = time.Duration(seconds*float64(time.Second)), nil
+				}
+				if err != nil || timeout <= 0 {
+					return h, &databaseError{SqlStateInvalidParameterValue, fmt.Sprintf("invalid timeout hint %q, expected a duration like 5s", value)}
+				}
+				h.timeout = timeout
+			case "priority":
+				priority, ok := parseQueryPriority(value)
+				if !ok {
+					return h, &databaseError{SqlStateInvalidParameterValue, fmt.Sprintf("invalid priority hint %q, expected low, normal or high", value)}
+				}
+				h.priority, h.hasPriority = priority, true
+			default:
+				if setting, ok := queryHintSettings[name]; ok {
+					name = setting
+				}
+				if h.settings == nil {
+					h.settings = make(url.Values)
+				}
+				h.settings.Set(name, value)
+			}
+		}
+	}
+	return h, nil
+}
+
+// Settings returns the settings of a clickhouse request with the settings of the hints, which win like the
+// SETTINGS clause of clickhouse
+func (h queryHints) Settings(settings url.Values) url.Values {
+	if len(h.settings) == 0 {
+		return settings
+	}
+	merged := make(url.Values, len(settings)+len(h.settings))
+	for name, values := range settings {
+		merged[name] = values
+	}
+	for name, values := range h.settings {
+		merged[name] = values
+	}
+	return merged
+}
+
+// applyQueryHints applies the timeout of the hints to the context of a query of user and waits for the scheduler to
+// run it at the priority of the user, or the lower priority of the hints, done releases them
+func (s *PgServer) applyQueryHints(ctx context.Context, user string, h queryHints) (context.Context, func(), error) {
+	cancel := context.CancelFunc(func() {})
+	if h.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, h.timeout)
+	}
+	priority := s.scheduler.UserPriority(user)
+	if h.hasPriority {
+		priority = min(priority, h.priority)
+	}
+	release, err := s.scheduler.Acquire(ctx, priority)
+	if err != nil {
+		cancel()
+		return ctx, nil, err
+	}
+	return ctx, func() {
+		release()
+		cancel()
+	}, nil
+}
+
+// queryError returns the error of a query stopped by its timeout hint as a statement timeout, other errors as is
+func queryError(ctx context.Context, err error) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return &databaseError{SqlStateQueryCanceled, "canceling statement due to statement timeout"}
+	}
+	return err
+}
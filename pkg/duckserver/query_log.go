@@ -0,0 +1,213 @@
+package duckserver
+
+import (
+	"context"
+	"database/sql"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// queryLogFlushInterval is how often the logged queries are written, like flush_interval_milliseconds of clickhouse
+const queryLogFlushInterval = 7500 * time.Millisecond
+
+// maxPendingQueryLog bounds the queries kept in memory when the flushes fail, the oldest are dropped above it
+const maxPendingQueryLog = 100000
+
+// maxQueryLogException bounds the error text of a clickhouse response kept in the log
+const maxQueryLogException = 4096
+
+// the types of a query log entry, named like the type column of the clickhouse query log
+const (
+	queryLogFinish                   = "QueryFinish"
+	queryLogExceptionBeforeStart     = "ExceptionBeforeStart"
+	queryLogExceptionWhileProcessing = "ExceptionWhileProcessing"
+)
+
+type queryLogEntry struct {
+	typ         string
+	start       time.Time
+	duration    time.Duration
+	query       string
+	exception   string
+	user        string
+	application string
+	protocol    string
+	readRows    int64
+	readBytes   int64
+}
+
+// queryLog writes the queries of both frontends to duckserver.query_log in batches, which system.query_log shows
+// with the column names of clickhouse. A nil queryLog logs nothing
+type queryLog struct {
+	db      *sql.DB
+	mu      sync.Mutex
+	pending []queryLogEntry
+}
+
+func newQueryLog(db *sql.DB) *queryLog {
+	return &queryLog{db: db}
+}
+
+// Record adds a query to the next flush
+func (l *queryLog) Record(entry queryLogEntry) {
+	if l == nil || entry.query == "" {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.pending) >= maxPendingQueryLog {
+		l.pending = l.pending[1:]
+	}
+	l.pending = append(l.pending, entry)
+}
+
+func (l *queryLog) Run(done chan struct{}) {
+	ticker := time.NewTicker(queryLogFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		if err := l.Flush(context.Background()); err != nil {
+			logrus.Warnf("flush query log error: %v", err)
+		}
+	}
+}
+
+// Flush writes the pending queries in a transaction, they are kept for the next flush when it fails
+func (l *queryLog) Flush(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	pending := l.pending
+	l.pending = nil
+	l.mu.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+	if err := l.insert(ctx, pending); err != nil {
+		l.mu.Lock()
+		l.pending = append(pending, l.pending...)
+		if len(l.pending) > maxPendingQueryLog {
+			l.pending = l.pending[len(l.pending)-maxPendingQueryLog:]
+		}
+		l.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (l *queryLog) insert(ctx context.Context, entries []queryLogEntry) error {
+	tx, err := l.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.PrepareContext(ctx, `insert into duckserver.query_log (type, event_time, query_start_time, query_duration_ms, read_rows, read_bytes, query, exception, username, application, protocol)
+values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, e := range entries {
+		_, err = stmt.ExecContext(ctx, e.typ, e.start.Add(e.duration).UTC(), e.start.UTC(), e.duration.Milliseconds(),
+			e.readRows, e.readBytes, e.query, e.exception, e.user, e.application, e.protocol)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// logQuery logs a statement of the session, the exception is the error sent for it if any
+func (c *PgConn) logQuery(typ string, query string, start time.Time, stats queryStats) {
+	exception := ""
+	if typ != queryLogFinish {
+		exception = c.lastError
+	}
+	c.server.queryLog.Record(queryLogEntry{
+		typ:         typ,
+		start:       start,
+		duration:    time.Since(start),
+		query:       query,
+		exception:   exception,
+		user:        c.user,
+		application: c.applicationName(),
+		protocol:    ProtocolPostgres,
+		readRows:    stats.readRows,
+		readBytes:   stats.readBytes,
+	})
+	c.queryLogged = true
+}
+
+// logPrepareError logs a statement failing to parse in the extended protocol
+func (c *PgConn) logPrepareError(query string, start time.Time) {
+	if c.inError {
+		c.logQuery(queryLogExceptionBeforeStart, query, start, queryStats{})
+	}
+}
+
+// chQueryLogWriter records the outcome of a clickhouse request for the query log, the error text of a failed
+// response and the counters of its summary
+type chQueryLogWriter struct {
+	http.ResponseWriter
+	status    int
+	exception []byte
+	streamErr bool
+	readRows  int64
+	readBytes int64
+}
+
+func (w *chQueryLogWriter) WriteHeader(code int) {
+	if code >= http.StatusOK && w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *chQueryLogWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if w.status >= http.StatusBadRequest && len(w.exception) < maxQueryLogException {
+		w.exception = append(w.exception, p[:min(len(p), maxQueryLogException-len(w.exception))]...)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *chQueryLogWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// entry returns the log entry of the request, the type follows the status and errors sent after the header
+func (w *chQueryLogWriter) entry() queryLogEntry {
+	e := queryLogEntry{typ: queryLogFinish, readRows: w.readRows, readBytes: w.readBytes}
+	if w.streamErr {
+		e.typ = queryLogExceptionWhileProcessing
+	} else if w.status >= http.StatusBadRequest {
+		e.typ = queryLogExceptionBeforeStart
+	}
+	if e.typ != queryLogFinish {
+		e.exception = string(w.exception)
+	}
+	return e
+}
+
+// queryLogWriterOf finds the query log writer wrapped by wr, nil when the request isn't logged
+func queryLogWriterOf(wr http.ResponseWriter) *chQueryLogWriter {
+	for {
+		switch w := wr.(type) {
+		case *chQueryLogWriter:
+			return w
+		case interface{ Unwrap() http.ResponseWriter }:
+			wr = w.Unwrap()
+		default:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package duckserver
+
+import (
+	"context"
+	"database/sql"
+	"github.com/sirupsen/logrus"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultLowPriorityQueries = 2
+
+// userPrioritiesTTL is the interval between reloads of duckserver.user_priorities
+const userPrioritiesTTL = 10 * time.Second
+
+// queryPriority is the scheduling class of a query, batch queries are low and dashboards high
+type queryPriority int
+
+const (
+	priorityLow queryPriority = iota
+	priorityNormal
+	priorityHigh
+)
+
+var queryPriorityNames = []string{"low", "normal", "high"}
+
+func (p queryPriority) String() string {
+	return queryPriorityNames[p]
+}
+
+// parseQueryPriority reads a priority, batch and interactive are low and high
+func parseQueryPriority(s string) (queryPriority, bool) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "low", "batch":
+		return priorityLow, true
+	case "normal":
+		return priorityNormal, true
+	case "high", "interactive":
+		return priorityHigh, true
+	}
+	return priorityNormal, false
+}
+
+type schedulerWaiter struct {
+	priority queryPriority
+	ready    chan struct{}
+	admitted bool
+}
+
+// queryScheduler admits the queries by priority. At most maxRunning queries run at once, 0 is unlimited, and at
+// most maxLow of them are low priority, so an export or a backfill doesn't take the cpus of the dashboards. Waiting
+// queries start by priority, then in order of arrival. The priority of a user is its row of
+// duckserver.user_priorities, or the row of user *, and normal without row
+type queryScheduler struct {
+	db         *sql.DB
+	maxRunning int
+	maxLow     int
+	mu         sync.Mutex
+	running    int
+	lowRunning int
+	waiting    [3][]*schedulerWaiter
+	users      map[string]queryPriority
+	loadedAt   time.Time
+}
+
+func newQueryScheduler(db *sql.DB, maxRunning, maxLow int) *queryScheduler {
+	if maxLow <= 0 {
+		maxLow = defaultLowPriorityQueries
+	}
+	return &queryScheduler{db: db, maxRunning: max(maxRunning, 0), maxLow: maxLow}
+}
+
+// Load reads duckserver.user_priorities
+func (s *queryScheduler) Load() error {
+	rows, err := s.db.Query("select username, priority from duckserver.user_priorities")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	users := make(map[string]queryPriority)
+	for rows.Next() {
+		var user, name string
+		if err = rows.Scan(&user, &name); err != nil {
+			return err
+		}
+		priority, ok := parseQueryPriority(name)
+		if !ok {
+			logrus.Warnf("invalid priority %q of user %s", name, user)
+			continue
+		}
+		users[user] = priority
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.users, s.loadedAt = users, time.Now()
+	s.mu.Unlock()
+	return nil
+}
+
+// UserPriority returns the priority of the queries of a user
+func (s *queryScheduler) UserPriority(user string) queryPriority {
+	if s == nil {
+		return priorityNormal
+	}
+	s.mu.Lock()
+	stale := time.Since(s.loadedAt) > userPrioritiesTTL
+	s.mu.Unlock()
+	if stale {
+		if err := s.Load(); err != nil {
+			logrus.Warnf("load user priorities error: %v", err)
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if priority, ok := s.users[user]; ok {
+		return priority
+	}
+	if priority, ok := s.users[defaultQuotaUser]; ok {
+		return priority
+	}
+	return priorityNormal
+}
+
+// canRun reports whether a query of priority may start now, mu is held
+func (s *queryScheduler) canRun(priority queryPriority) bool {
+	if s.maxRunning > 0 && s.running >= s.maxRunning {
+		return false
+	}
+	return priority != priorityLow || s.lowRunning < s.maxLow
+}
+
+// admit starts a query, mu is held
+func (s *queryScheduler) admit(priority queryPriority) {
+	s.running++
+	if priority == priorityLow {
+		s.lowRunning++
+	}
+	metrics.Set("duckserver_running_queries", float64(s.running))
+}
+
+// dispatch starts the waiting queries which may run, the higher priorities first, mu is held
+func (s *queryScheduler) dispatch() {
+	for p := priorityHigh; p >= priorityLow; p-- {
+		for len(s.waiting[p]) > 0 && s.canRun(p) {
+			w := s.waiting[p][0]
+			s.waiting[p] = s.waiting[p][1:]
+			s.admit(p)
+			w.admitted = true
+			close(w.ready)
+		}
+		metrics.Set("duckserver_waiting_queries", float64(len(s.waiting[p])), "priority", p.String())
+	}
+}
+
+// Acquire waits until a query of priority may run, release ends it
+func (s *queryScheduler) Acquire(ctx context.Context, priority queryPriority) (func(), error) {
+	if s == nil {
+		return func() {}, nil
+	}
+	release := func() {
+		s.mu.Lock()
+		s.running--
+		if priority == priorityLow {
+			s.lowRunning--
+		}
+		metrics.Set("duckserver_running_queries", float64(s.running))
+		s.dispatch()
+		s.mu.Unlock()
+	}
+	s.mu.Lock()
+	// a query doesn't overtake the waiting queries of its priority or a higher one
+	waiting := false
+	for p := priority; p <= priorityHigh; p++ {
+		waiting = waiting || len(s.waiting[p]) > 0
+	}
+	if !waiting && s.canRun(priority) {
+		s.admit(priority)
+		s.mu.Unlock()
+		return release, nil
+	}
+	w := &schedulerWaiter{priority: priority, ready: make(chan struct{})}
+	s.waiting[priority] = append(s.waiting[priority], w)
+	metrics.Set("duckserver_waiting_queries", float64(len(s.waiting[priority])), "priority", priority.String())
+	metrics.Add("duckserver_scheduler_waits_total", 1, "priority", priority.String())
+	s.mu.Unlock()
+	select {
+	case <-w.ready:
+		return release, nil
+	case <-ctx.Done():
+	}
+	s.mu.Lock()
+	if w.admitted {
+		s.mu.Unlock()
+		release()
+		return nil, queryError(ctx, ctx.Err())
+	}
+	for i, other := range s.waiting[priority] {
+		if other == w {
+			s.waiting[priority] = append(s.waiting[priority][:i], s.waiting[priority][i+1:]...)
+			break
+		}
+	}
+	// the queries of lower priorities may have waited behind this one
+	s.dispatch()
+	s.mu.Unlock()
+	return nil, queryError(ctx, ctx.Err())
+}
@@ -0,0 +1,181 @@
+package duckserver
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// queryStatsSetting reports the rows and bytes read by each query, as a postgresql SET parameter or a clickhouse
+// setting, --query_stats collects them for the metrics of every query
+const queryStatsSetting = "duckserver_query_stats"
+
+// stringWidth is the in-memory width of a string value of DuckDB, also used for the types without a fixed width
+const stringWidth = 16
+
+// typeWidths are the in-memory widths of the fixed width types
+var typeWidths = map[string]int64{
+	"BOOLEAN":                  1,
+	"TINYINT":                  1,
+	"UTINYINT":                 1,
+	"SMALLINT":                 2,
+	"USMALLINT":                2,
+	"INTEGER":                  4,
+	"UINTEGER":                 4,
+	"FLOAT":                    4,
+	"DATE":                     4,
+	"BIGINT":                   8,
+	"UBIGINT":                  8,
+	"DOUBLE":                   8,
+	"TIME":                     8,
+	"TIMESTAMP":                8,
+	"TIMESTAMP_S":              8,
+	"TIMESTAMP_MS":             8,
+	"TIMESTAMP_NS":             8,
+	"TIMESTAMP WITH TIME ZONE": 8,
+	"HUGEINT":                  16,
+	"UHUGEINT":                 16,
+	"UUID":                     16,
+	"INTERVAL":                 16,
+}
+
+type queryStatsContextKey struct{}
+
+func withQueryStats(ctx context.Context) context.Context {
+	return context.WithValue(ctx, queryStatsContextKey{}, true)
+}
+
+func queryStatsFromContext(ctx context.Context) bool {
+	enabled, _ := ctx.Value(queryStatsContextKey{}).(bool)
+	return enabled
+}
+
+// queryStats are the rows and bytes read by the scans of a query. The bytes are the in-memory width of the columns
+// read, strings count stringWidth bytes, so they compare the cost of queries rather than measure the disk reads.
+type queryStats struct {
+	readRows  int64
+	readBytes int64
+}
+
+// profileNode is an operator of the json profile of DuckDB
+type profileNode struct {
+	Name        string        `json:"name"`
+	Timing      float64       `json:"timing"`
+	Cardinality int64         `json:"cardinality"`
+	ExtraInfo   string        `json:"extra_info"`
+	Children    []profileNode `json:"children"`
+}
+
+// tableWidths caches the column widths of the tables scanned, it's dropped when the schema changes
+type tableWidths struct {
+	mu            sync.Mutex
+	schemaVersion uint64
+	tables        map[string]map[string]int64
+}
+
+func recordQueryStats(application string, stats queryStats) {
+	metrics.Add("duckserver_read_rows_total", float64(stats.readRows), "application", application)
+	metrics.Add("duckserver_read_bytes_total", float64(stats.readBytes), "application", application)
+}
+
+// scanStats sums the rows produced by the scans of a profile, the bytes are the rows times the width of the
+// projected columns
+func (s *PgServer) scanStats(node *profileNode) queryStats {
+	var stats queryStats
+	if strings.Contains(node.Name, "SCAN") {
+		stats.readRows = node.Cardinality
+		stats.readBytes = node.Cardinality * s.scanWidth(node.ExtraInfo)
+	}
+	for i := range node.Children {
+		child := s.scanStats(&node.Children[i])
+		stats.readRows += child.readRows
+		stats.readBytes += child.readBytes
+	}
+	return stats
+}
+
+// scanWidth returns the width of a row of a scan from its extra info, the table name, the projected columns and the
+// filters pushed down into the scan separated by [INFOSEPARATOR]. The columns only read by the filters count too.
+func (s *PgServer) scanWidth(extraInfo string) int64 {
+	sections := strings.Split(extraInfo, "[INFOSEPARATOR]")
+	if len(sections) < 2 {
+		return 0
+	}
+	widths := s.columnWidths(strings.TrimSpace(sections[0]))
+	read := map[string]bool{}
+	var width int64
+	for _, column := range strings.Split(strings.TrimSpace(sections[1]), "\n") {
+		if column = strings.TrimSpace(column); column == "" || read[column] {
+			continue
+		}
+		read[column] = true
+		if w, ok := widths[column]; ok {
+			width += w
+		} else {
+			width += stringWidth
+		}
+	}
+	for _, section := range sections[2:] {
+		filters, ok := strings.CutPrefix(strings.TrimSpace(section), "Filters:")
+		if !ok {
+			continue
+		}
+		for _, word := range strings.FieldsFunc(filters, func(r rune) bool {
+			return r != '_' && !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		}) {
+			if w, ok := widths[word]; ok && !read[word] {
+				read[word] = true
+				width += w
+			}
+		}
+	}
+	return width
+}
+
+// columnWidths returns the widths of the columns of a table of the main database by its name
+func (s *PgServer) columnWidths(table string) map[string]int64 {
+	s.tableWidths.mu.Lock()
+	defer s.tableWidths.mu.Unlock()
+	if version := s.schemaVersion.Load(); s.tableWidths.tables == nil || s.tableWidths.schemaVersion != version {
+		s.tableWidths.tables = map[string]map[string]int64{}
+		s.tableWidths.schemaVersion = version
+	}
+	if widths, ok := s.tableWidths.tables[table]; ok {
+		return widths
+	}
+	widths := map[string]int64{}
+	rows, err := s.conn.Query("select column_name, data_type from duckdb_columns() where table_name = $1 and database_name = $2", table, s.mainDatabase)
+	if err == nil {
+		for rows.Next() {
+			var column, dataType string
+			if rows.Scan(&column, &dataType) != nil {
+				break
+			}
+			if _, ok := widths[column]; !ok {
+				widths[column] = typeWidth(dataType)
+			}
+		}
+		_ = rows.Close()
+	}
+	s.tableWidths.tables[table] = widths
+	return widths
+}
+
+func typeWidth(dataType string) int64 {
+	if p, _, ok := parseDecimalType(dataType); ok {
+		switch {
+		case p <= 4:
+			return 2
+		case p <= 9:
+			return 4
+		case p <= 18:
+			return 8
+		}
+		return 16
+	}
+	if w, ok := typeWidths[dataType]; ok {
+		return w
+	}
+	return stringWidth
+}
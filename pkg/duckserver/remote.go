@@ -0,0 +1,296 @@
+package duckserver
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// remoteRegexp matches the remote table function of clickhouse, remote('host:port', db.table) or
+// remote('host:port', 'db', 'table') with an optional user and password. Several comma separated addresses are
+// shards, their rows are concatenated.
+var remoteRegexp = regexp.MustCompile(`(?i)\bremote\(\s*('[^()]*?)\)`)
+
+// defaultRemotePort is the clickhouse http port used when the address of remote() has none
+const defaultRemotePort = "8123"
+
+// defaultRemoteMaxBytes is the largest table fetched from a shard of remote()
+const defaultRemoteMaxBytes = 1 << 30
+
+// remotePeers are the servers remote() may fetch tables from, http(s) addresses compared by scheme, host and port.
+// Without peers remote() is disabled, so a query can't make the server send requests to other addresses
+type remotePeers struct {
+	all      bool
+	peers    []*url.URL
+	maxBytes int64
+	client   *http.Client
+}
+
+// newRemotePeers returns the peers of an allowlist of addresses like node1:8123 or https://node2:8443, * allows
+// all addresses
+func newRemotePeers(allowlist []string, maxBytes int64) (*remotePeers, error) {
+	if maxBytes <= 0 {
+		maxBytes = defaultRemoteMaxBytes
+	}
+	// redirects aren't followed, they could lead to addresses which aren't peers
+	p := &remotePeers{maxBytes: maxBytes, client: &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}}
+	for _, addr := range allowlist {
+		if addr = strings.TrimSpace(addr); addr == "" {
+			continue
+		}
+		if addr == "*" {
+			p.all = true
+			continue
+		}
+		u, err := remoteAddressURL(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid remote peer %q, expected host:port or http(s)://host:port", addr)
+		}
+		p.peers = append(p.peers, u)
+	}
+	return p, nil
+}
+
+// remoteAddressURL returns the url of an address of remote(), a host without port has the clickhouse http port
+func remoteAddressURL(addr string) (*url.URL, error) {
+	if !strings.Contains(addr, "://") {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(addr, defaultRemotePort)
+		}
+		addr = "http://" + addr
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" || u.User != nil {
+		return nil, fmt.Errorf("invalid remote address %s", addr)
+	}
+	if u.Port() == "" {
+		port := "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+		u.Host = net.JoinHostPort(u.Hostname(), port)
+	}
+	return u, nil
+}
+
+// Allowed reports whether the url of an address of remote() is a peer
+func (p *remotePeers) Allowed(u *url.URL) bool {
+	if p == nil {
+		return false
+	}
+	if p.all {
+		return true
+	}
+	for _, peer := range p.peers {
+		if u.Scheme == peer.Scheme && strings.EqualFold(u.Host, peer.Host) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteTable is a remote() call of a query
+type remoteTable struct {
+	addresses []*url.URL
+	table     string
+	user      string
+	password  string
+	peers     *remotePeers
+	urls      *remoteURLPolicy
+	// dir is the scratch directory of the fetched files
+	dir string
+}
+
+func unquoteLiteral(s string) (string, bool) {
+	if len(s) < 2 || s[0] != '\'' || s[len(s)-1] != '\'' {
+		return "", false
+	}
+	return strings.ReplaceAll(s[1:len(s)-1], "''", "'"), true
+}
+
+func parseRemoteTable(args string) (*remoteTable, error) {
+	parts := splitTopLevel(args)
+	addresses, ok := unquoteLiteral(parts[0])
+	if !ok || len(parts) < 2 {
+		return nil, fmt.Errorf("remote() expects an address and a table")
+	}
+	t := &remoteTable{}
+	for _, addr := range strings.Split(addresses, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			u, err := remoteAddressURL(addr)
+			if err != nil {
+				return nil, fmt.Errorf("remote() expects addresses like host:port or http(s)://host:port, got %s", addr)
+			}
+			t.addresses = append(t.addresses, u)
+		}
+	}
+	rest := parts[2:]
+	if db, ok := unquoteLiteral(parts[1]); ok {
+		if len(parts) < 3 {
+			return nil, fmt.Errorf("remote() expects a table after the database %s", db)
+		}
+		table, ok := unquoteLiteral(parts[2])
+		if !ok {
+			return nil, fmt.Errorf("remote() expects the table as a string after the database %s", db)
+		}
+		t.table = quoteIdent(db) + "." + quoteIdent(table)
+		rest = parts[3:]
+	} else {
+		t.table = parts[1]
+	}
+	if len(rest) > 2 {
+		return nil, fmt.Errorf("remote() has too many arguments")
+	}
+	credentials := []*string{&t.user, &t.password}
+	for i, arg := range rest {
+		if *credentials[i], ok = unquoteLiteral(arg); !ok {
+			return nil, fmt.Errorf("remote() expects the user and password as strings")
+		}
+	}
+	return t, nil
+}
+
+// fetchRemoteTables fetches the tables of the remote() calls of a query from the other servers over clickhouse http
+// in FORMAT Parquet, and the files of the remote urls, and reads them from temporary files, cleanup removes the files
+// once the query is done
+func (s *PgServer) fetchRemoteTables(ctx context.Context, query string) (string, func(), error) {
+	query, files, err := s.remoteURLs.fetchAll(ctx, query)
+	cleanup := func() {
+		for _, file := range files {
+			_ = os.Remove(file)
+		}
+	}
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	matches := remoteRegexp.FindAllStringSubmatchIndex(query, -1)
+	if len(matches) == 0 {
+		return query, cleanup, nil
+	}
+	var b strings.Builder
+	last := 0
+	for _, m := range matches {
+		t, err := parseRemoteTable(query[m[2]:m[3]])
+		if err != nil {
+			cleanup()
+			return "", nil, err
+		}
+		for _, u := range t.addresses {
+			if !s.remotePeers.Allowed(u) {
+				cleanup()
+				return "", nil, &databaseError{SqlStateInsufficientPrivilege, fmt.Sprintf("remote address %s is not in the remote peers", u.Host)}
+			}
+			// the remote url allowlist applies to the peers too
+			if s.remoteURLs != nil && !s.remoteURLs.Allowed(u) {
+				cleanup()
+				return "", nil, &databaseError{SqlStateInsufficientPrivilege, fmt.Sprintf("remote address %s is not in the remote url allowlist", u.Host)}
+			}
+		}
+		t.peers, t.urls, t.dir = s.remotePeers, s.remoteURLs, s.scratchDir
+		shards, err := t.fetch(ctx)
+		files = append(files, shards...)
+		if err != nil {
+			cleanup()
+			return "", nil, err
+		}
+		quoted := make([]string, len(shards))
+		for i, file := range shards {
+			quoted[i] = quoteLiteral(file)
+		}
+		b.WriteString(query[last:m[0]])
+		b.WriteString(fmt.Sprintf("read_parquet([%s], union_by_name = true)", strings.Join(quoted, ", ")))
+		last = m[1]
+	}
+	b.WriteString(query[last:])
+	return b.String(), cleanup, nil
+}
+
+// fetch fetches the table from all addresses in parallel, the files fetched are returned on error too
+func (t *remoteTable) fetch(ctx context.Context) ([]string, error) {
+	files := make([]string, len(t.addresses))
+	errs := make([]error, len(t.addresses))
+	var wg sync.WaitGroup
+	for i, addr := range t.addresses {
+		wg.Add(1)
+		go func(i int, addr *url.URL) {
+			defer wg.Done()
+			files[i], errs[i] = t.fetchShard(ctx, addr)
+		}(i, addr)
+	}
+	wg.Wait()
+	var fetched []string
+	for _, file := range files {
+		if file != "" {
+			fetched = append(fetched, file)
+		}
+	}
+	for _, err := range errs {
+		if err != nil {
+			return fetched, err
+		}
+	}
+	return fetched, nil
+}
+
+// fetchShard fetches the table from a peer, at most maxBytes of the peers and of the remote url allowlist. The body
+// of an error response isn't returned, it could be any content of the address
+func (t *remoteTable) fetchShard(ctx context.Context, addr *url.URL) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(addr.String(), "/")+"/",
+		strings.NewReader(fmt.Sprintf("SELECT * FROM %s FORMAT Parquet", t.table)))
+	if err != nil {
+		return "", err
+	}
+	if t.user != "" {
+		req.SetBasicAuth(t.user, t.password)
+	}
+	resp, err := t.peers.client.Do(req)
+	if err != nil {
+		metrics.Add("duckserver_remote_errors_total", 1)
+		return "", fmt.Errorf("remote %s: %w", addr.Host, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		metrics.Add("duckserver_remote_errors_total", 1)
+		return "", fmt.Errorf("remote %s: %s", addr.Host, resp.Status)
+	}
+	maxBytes := t.peers.maxBytes
+	if t.urls != nil && t.urls.maxBytes < maxBytes {
+		maxBytes = t.urls.maxBytes
+	}
+	if resp.ContentLength > maxBytes {
+		metrics.Add("duckserver_remote_errors_total", 1)
+		return "", fmt.Errorf("remote %s has %d bytes, more than the limit of %d", addr.Host, resp.ContentLength, maxBytes)
+	}
+	f, err := os.CreateTemp(t.dir, "duckserver-remote-*.parquet")
+	if err != nil {
+		return "", err
+	}
+	n, err := io.Copy(f, io.LimitReader(resp.Body, maxBytes+1))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && n > maxBytes {
+		err = fmt.Errorf("more than the limit of %d bytes", maxBytes)
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		metrics.Add("duckserver_remote_errors_total", 1)
+		return "", fmt.Errorf("remote %s: %w", addr.Host, err)
+	}
+	metrics.Add("duckserver_remote_fetches_total", 1)
+	metrics.Add("duckserver_remote_fetched_bytes_total", float64(n))
+	return f.Name(), nil
+}
@@ -0,0 +1,208 @@
+package duckserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// defaultRemoteURLMaxBytes is the largest file a query reads from a remote url
+const defaultRemoteURLMaxBytes = 1 << 30
+
+// remoteURLScanRegexp matches the files of a query read from http(s) urls, a url or a list of urls quoted as a string
+// or an identifier after FROM or JOIN or as the files of the read functions like read_parquet and read_csv
+var remoteURLScanRegexp = regexp.MustCompile(`(?i)(?:\bfrom|\bjoin|\b(?:read_\w+|parquet_\w+|sniff_csv)\s*\()\s*(\[\s*(?:'(?:[^']|'')*'\s*,?\s*)+\]|'https?://(?:[^']|'')*'|"https?://(?:[^"]|"")*")`)
+
+// remoteURLRegexp matches a quoted http(s) url in the files of a scan
+var remoteURLRegexp = regexp.MustCompile(`(?i)'https?://(?:[^']|'')*'|"https?://(?:[^"]|"")*"`)
+
+// remoteURLExtRegexp matches the extensions of the urls kept by their temporary files, like .csv.gz
+var remoteURLExtRegexp = regexp.MustCompile(`^(?:\.[A-Za-z0-9]+)+$`)
+
+// remoteURLPolicy allows the queries to read files from the http(s) urls of an allowlist. The server downloads them
+// to temporary files, at most maxBytes each, and the http file systems of DuckDB are disabled so a url computed by a
+// query can't reach other addresses
+type remoteURLPolicy struct {
+	all      bool
+	allow    []*url.URL
+	maxBytes int64
+	client   *http.Client
+	// dir is the scratch directory of the downloaded files
+	dir string
+}
+
+// newRemoteURLPolicy returns the policy of an allowlist of url prefixes like https://data.example.com/public/, *
+// allows all urls. Without allowlist it returns nil, DuckDB reads the urls itself
+func newRemoteURLPolicy(allowlist []string, maxBytes int64, dir string) (*remoteURLPolicy, error) {
+	if maxBytes <= 0 {
+		maxBytes = defaultRemoteURLMaxBytes
+	}
+	p := &remoteURLPolicy{maxBytes: maxBytes, dir: dir}
+	for _, prefix := range allowlist {
+		if prefix = strings.TrimSpace(prefix); prefix == "" {
+			continue
+		}
+		if prefix == "*" {
+			p.all = true
+			continue
+		}
+		u, err := url.Parse(prefix)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid remote url prefix %q, expected http(s)://host/path", prefix)
+		}
+		p.allow = append(p.allow, u)
+	}
+	if !p.all && len(p.allow) == 0 {
+		return nil, nil
+	}
+	p.client = &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		if !p.Allowed(req.URL) {
+			return fmt.Errorf("redirect to %s is not in the remote url allowlist", req.URL.Redacted())
+		}
+		return nil
+	}}
+	return p, nil
+}
+
+// Allowed reports whether a url is in the allowlist, the scheme and host have to be the same and the cleaned path
+// has to be the path of a prefix or below it
+func (p *remoteURLPolicy) Allowed(u *url.URL) bool {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return false
+	}
+	if p.all {
+		return true
+	}
+	for _, prefix := range p.allow {
+		if u.Scheme == prefix.Scheme && strings.EqualFold(u.Host, prefix.Host) && isSubPath(u.Path, prefix.Path) {
+			return true
+		}
+	}
+	return false
+}
+
+// isSubPath reports whether the url path p is dir or below it once the dot segments are resolved, /public/../secret
+// and /public_x aren't below /public
+func isSubPath(p, dir string) bool {
+	p, dir = path.Clean("/"+p), path.Clean("/"+dir)
+	return dir == "/" || p == dir || strings.HasPrefix(p, dir+"/")
+}
+
+// remoteURLs returns the urls read by a query
+func remoteURLs(query string) []string {
+	var urls []string
+	for _, scan := range remoteURLScanRegexp.FindAllStringSubmatch(query, -1) {
+		for _, quoted := range remoteURLRegexp.FindAllString(scan[1], -1) {
+			q := quoted[:1]
+			urls = append(urls, strings.ReplaceAll(quoted[1:len(quoted)-1], q+q, q))
+		}
+	}
+	return urls
+}
+
+// Check returns an error if a query reads a url which isn't in the allowlist
+func (p *remoteURLPolicy) Check(query string) error {
+	if p == nil {
+		return nil
+	}
+	for _, raw := range remoteURLs(query) {
+		u, err := url.Parse(raw)
+		if err != nil || !p.Allowed(u) {
+			return &databaseError{SqlStateInsufficientPrivilege, fmt.Sprintf("remote url %s is not in the remote url allowlist", raw)}
+		}
+	}
+	return nil
+}
+
+// fetchAll downloads the urls read by a query and replaces them with the temporary files, cleanup removes the files
+// once the query is done
+func (p *remoteURLPolicy) fetchAll(ctx context.Context, query string) (string, []string, error) {
+	if p == nil || !remoteURLScanRegexp.MatchString(query) {
+		return query, nil, nil
+	}
+	if err := p.Check(query); err != nil {
+		return "", nil, err
+	}
+	var files []string
+	fetched := make(map[string]string)
+	var fetchErr error
+	query = remoteURLScanRegexp.ReplaceAllStringFunc(query, func(scan string) string {
+		return remoteURLRegexp.ReplaceAllStringFunc(scan, func(quoted string) string {
+			q := quoted[:1]
+			raw := strings.ReplaceAll(quoted[1:len(quoted)-1], q+q, q)
+			file, ok := fetched[raw]
+			if !ok && fetchErr == nil {
+				if file, fetchErr = p.fetch(ctx, raw); fetchErr == nil {
+					fetched[raw] = file
+					files = append(files, file)
+				}
+			}
+			if q == `"` {
+				return quoteIdent(file)
+			}
+			return quoteLiteral(file)
+		})
+	})
+	if fetchErr != nil {
+		return "", files, fetchErr
+	}
+	return query, files, nil
+}
+
+// fetch downloads a url to a temporary file with the extension of the url, so DuckDB detects its format
+func (p *remoteURLPolicy) fetch(ctx context.Context, raw string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, raw, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		metrics.Add("duckserver_remote_url_errors_total", 1)
+		return "", fmt.Errorf("remote url %s: %w", req.URL.Redacted(), err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		metrics.Add("duckserver_remote_url_errors_total", 1)
+		return "", fmt.Errorf("remote url %s: %s", req.URL.Redacted(), resp.Status)
+	}
+	if resp.ContentLength > p.maxBytes {
+		metrics.Add("duckserver_remote_url_errors_total", 1)
+		return "", fmt.Errorf("remote url %s has %d bytes, more than the limit of %d", req.URL.Redacted(), resp.ContentLength, p.maxBytes)
+	}
+	ext := ""
+	if base := path.Base(req.URL.Path); strings.Contains(base, ".") {
+		ext = base[strings.Index(base, "."):]
+	}
+	if !remoteURLExtRegexp.MatchString(ext) {
+		ext = ""
+	}
+	f, err := os.CreateTemp(p.dir, "duckserver-url-*"+ext)
+	if err != nil {
+		return "", err
+	}
+	n, err := io.Copy(f, io.LimitReader(resp.Body, p.maxBytes+1))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && n > p.maxBytes {
+		err = fmt.Errorf("more than the limit of %d bytes", p.maxBytes)
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		metrics.Add("duckserver_remote_url_errors_total", 1)
+		return "", fmt.Errorf("remote url %s: %w", req.URL.Redacted(), err)
+	}
+	metrics.Add("duckserver_remote_url_fetches_total", 1)
+	metrics.Add("duckserver_remote_url_fetched_bytes_total", float64(n))
+	return f.Name(), nil
+}
@@ -0,0 +1,88 @@
+package duckserver
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestRemoteURLs(t *testing.T) {
+	tests := []struct {
+		query string
+		urls  []string
+	}{
+		{"select 1", nil},
+		{"select * from 'https://a.example.com/x.parquet'", []string{"https://a.example.com/x.parquet"}},
+		{`SELECT * FROM "http://a.example.com/x.csv"`, []string{"http://a.example.com/x.csv"}},
+		{"select * from t join 'https://a.example.com/y.csv' using (id)", []string{"https://a.example.com/y.csv"}},
+		{"select * from read_parquet('https://a.example.com/it''s.parquet')", []string{"https://a.example.com/it's.parquet"}},
+		{"select * from read_csv(['https://a.example.com/a.csv', 'https://b.example.com/b.csv'])",
+			[]string{"https://a.example.com/a.csv", "https://b.example.com/b.csv"}},
+		{"select * from read_csv_auto ( 'HTTPS://a.example.com/a.csv')", []string{"HTTPS://a.example.com/a.csv"}},
+		{"select * from parquet_schema('http://a.example.com/a.parquet')", []string{"http://a.example.com/a.parquet"}},
+		{"select 'https://a.example.com/a.csv'", nil},
+	}
+	for _, test := range tests {
+		if urls := remoteURLs(test.query); !reflect.DeepEqual(urls, test.urls) {
+			t.Errorf("remoteURLs(%q) = %q, want %q", test.query, urls, test.urls)
+		}
+	}
+}
+
+func TestRemoteURLPolicy(t *testing.T) {
+	p, err := newRemoteURLPolicy([]string{"https://data.example.com/public/", "http://node1:8123"}, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		url     string
+		allowed bool
+	}{
+		{"https://data.example.com/public/a.parquet", true},
+		{"https://DATA.example.com/public/x/y.csv", true},
+		{"https://data.example.com/public", true},
+		{"https://data.example.com/public_x/a.csv", false},
+		{"https://data.example.com/public/../secret/a.csv", false},
+		{"https://data.example.com/public/%2e%2e/secret/a.csv", false},
+		{"http://data.example.com/public/a.csv", false},
+		{"https://data.example.com.evil/public/a.csv", false},
+		{"https://data.example.com:8443/public/a.csv", false},
+		{"http://node1:8123/", true},
+		{"http://169.254.169.254/latest/meta-data", false},
+		{"file:///etc/passwd", false},
+	}
+	for _, test := range tests {
+		u, err := url.Parse(test.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if allowed := p.Allowed(u); allowed != test.allowed {
+			t.Errorf("Allowed(%q) = %v, want %v", test.url, allowed, test.allowed)
+		}
+	}
+	if err = p.Check("select * from read_csv(['https://data.example.com/public/a.csv', 'http://169.254.169.254/x'])"); err == nil {
+		t.Error("Check allowed a url outside of the allowlist")
+	}
+	if err = p.Check("select * from 'https://data.example.com/public/a.csv'"); err != nil {
+		t.Error(err)
+	}
+	if p, err = newRemoteURLPolicy(nil, 0, ""); err != nil || p != nil {
+		t.Errorf("newRemoteURLPolicy without allowlist = %v, %v", p, err)
+	}
+}
+
+func TestRemotePeersRemoteURLPolicy(t *testing.T) {
+	p, err := newRemoteURLPolicy([]string{"http://node1:8123/"}, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for addr, allowed := range map[string]bool{"node1": true, "node1:8123": true, "node2:8123": false, "169.254.169.254:80": false} {
+		u, err := remoteAddressURL(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Allowed(u) != allowed {
+			t.Errorf("remote address %s allowed = %v, want %v", addr, !allowed, allowed)
+		}
+	}
+}
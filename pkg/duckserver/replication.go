@@ -0,0 +1,416 @@
+package duckserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SqlStateReadOnlySqlTransaction is the SQLSTATE of a write on a reader
+const SqlStateReadOnlySqlTransaction = "25006"
+
+// replicationManifestFile is the file of the publish directory naming the latest published snapshot, it's replaced
+// atomically after the snapshot file is complete
+const replicationManifestFile = "manifest.json"
+
+// replicationKeepSnapshots is the number of published snapshot files kept, the readers keep the previous snapshot
+// attached for the queries still running on it
+const replicationKeepSnapshots = 3
+
+// replicatedServerTables are the tables of the duckserver schema copied to the readers, so they accept the same
+// users, quotas, row policies and statement rules as the writer
+var replicatedServerTables = []string{"users", "quotas", "ch_tables", "row_policies", "user_roles", "statement_rules"}
+
+var snapshotFileRegexp = regexp.MustCompile(`^snapshot-(\d+)\.duckdb$`)
+var createViewRegexp = regexp.MustCompile(`(?i)^\s*CREATE\s+VIEW\b`)
+
+type replicationManifest struct {
+	Version     int64     `json:"version"`
+	File        string    `json:"file"`
+	PublishedAt time.Time `json:"published_at"`
+}
+
+// ReplicationStatus is the answer of /replication/status
+type ReplicationStatus struct {
+	// Role is writer, reader or standalone
+	Role        string     `json:"role"`
+	Dir         string     `json:"dir,omitempty"`
+	Version     int64      `json:"version"`
+	PublishedAt *time.Time `json:"published_at,omitempty"`
+	LoadedAt    *time.Time `json:"loaded_at,omitempty"`
+	LagSeconds  float64    `json:"lag_seconds"`
+	Error       string     `json:"error,omitempty"`
+}
+
+func readReplicationManifest(dir string) (*replicationManifest, error) {
+	data, err := os.ReadFile(filepath.Join(dir, replicationManifestFile))
+	if err != nil {
+		return nil, err
+	}
+	m := &replicationManifest{}
+	if err = json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("read %s: %w", replicationManifestFile, err)
+	}
+	return m, nil
+}
+
+// replicationPublisher copies the database of the writer to a DuckDB file of dir every interval, the readers
+// attach the file named by the manifest
+type replicationPublisher struct {
+	server   *PgServer
+	dir      string
+	interval time.Duration
+	mu       sync.Mutex
+	manifest replicationManifest
+	err      error
+}
+
+func newReplicationPublisher(server *PgServer, dir string, interval time.Duration) (*replicationPublisher, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	p := &replicationPublisher{server: server, dir: dir, interval: interval}
+	// the versions continue after a restart, the readers only load newer ones
+	if m, err := readReplicationManifest(dir); err == nil {
+		p.manifest = *m
+	}
+	return p, nil
+}
+
+func (p *replicationPublisher) Run() {
+	if err := p.Publish(context.Background()); err != nil {
+		logrus.Warnf("publish snapshot error: %v", err)
+	}
+	if p.interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.server.done:
+			return
+		case <-ticker.C:
+		}
+		if err := p.Publish(context.Background()); err != nil {
+			logrus.Warnf("publish snapshot error: %v", err)
+		}
+	}
+}
+
+// Publish copies the database to a new snapshot file and points the manifest to it
+func (p *replicationPublisher) Publish(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	err := p.publish(ctx)
+	p.err = err
+	if err != nil {
+		metrics.Add("duckserver_replication_publish_errors_total", 1)
+	}
+	return err
+}
+
+func (p *replicationPublisher) publish(ctx context.Context) error {
+	start := time.Now()
+	m := replicationManifest{Version: p.manifest.Version + 1}
+	m.File = fmt.Sprintf("snapshot-%d.duckdb", m.Version)
+	path := filepath.Join(p.dir, m.File)
+	for _, f := range []string{path, path + ".wal"} {
+		if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if _, err := p.server.conn.ExecContext(ctx, fmt.Sprintf("ATTACH %s AS duckserver_publish", quoteLiteral(path))); err != nil {
+		return err
+	}
+	_, err := p.server.conn.ExecContext(ctx, fmt.Sprintf("COPY FROM DATABASE %s TO duckserver_publish", quoteIdent(p.server.mainDatabase)))
+	if _, detachErr := p.server.conn.ExecContext(ctx, "DETACH duckserver_publish"); err == nil {
+		err = detachErr
+	}
+	if err != nil {
+		_ = os.Remove(path)
+		return err
+	}
+	m.PublishedAt = time.Now().UTC()
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(p.dir, replicationManifestFile+".tmp")
+	if err = os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, filepath.Join(p.dir, replicationManifestFile)); err != nil {
+		return err
+	}
+	p.manifest = m
+	p.removeOldSnapshots()
+	duration := time.Since(start)
+	metrics.Add("duckserver_replication_publishes_total", 1)
+	metrics.Set("duckserver_replication_version", float64(m.Version))
+	metrics.Set("duckserver_replication_last_publish_duration_seconds", duration.Seconds())
+	logrus.Debugf("published snapshot %d to %s in %s", m.Version, p.dir, duration)
+	return nil
+}
+
+// removeOldSnapshots removes the snapshot files older than the last replicationKeepSnapshots, a reader still
+// reading a removed file keeps it open
+func (p *replicationPublisher) removeOldSnapshots() {
+	entries, err := os.ReadDir(p.dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		match := snapshotFileRegexp.FindStringSubmatch(entry.Name())
+		if match == nil {
+			continue
+		}
+		version, _ := strconv.ParseInt(match[1], 10, 64)
+		if version <= p.manifest.Version-replicationKeepSnapshots {
+			_ = os.Remove(filepath.Join(p.dir, entry.Name()))
+		}
+	}
+}
+
+func (p *replicationPublisher) Status() ReplicationStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	status := ReplicationStatus{Role: "writer", Dir: p.dir, Version: p.manifest.Version}
+	if p.manifest.Version > 0 {
+		publishedAt := p.manifest.PublishedAt
+		status.PublishedAt = &publishedAt
+		status.LagSeconds = time.Since(publishedAt).Seconds()
+	}
+	if p.err != nil {
+		status.Error = p.err.Error()
+	}
+	return status
+}
+
+// replica is a reader node, it attaches the snapshots published in dir read-only and points views of the main
+// database to their tables, so the clients query them by the usual names
+type replica struct {
+	server   *PgServer
+	dir      string
+	interval time.Duration
+	mu       sync.Mutex
+	manifest replicationManifest
+	loadedAt time.Time
+	err      error
+	// attached are the attached snapshots, the previous one stays attached for the running queries
+	attached []string
+	// objects are the schema qualified views created for the current snapshot
+	objects map[string]bool
+}
+
+func newReplica(server *PgServer, dir string, interval time.Duration) *replica {
+	return &replica{server: server, dir: dir, interval: interval, objects: map[string]bool{}}
+}
+
+func (r *replica) Run() {
+	if r.interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.server.done:
+			return
+		case <-ticker.C:
+		}
+		if err := r.Pull(context.Background()); err != nil {
+			logrus.Warnf("pull snapshot error: %v", err)
+		}
+	}
+}
+
+// Pull loads the snapshot of the manifest when it's newer than the loaded one
+func (r *replica) Pull(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	m, err := readReplicationManifest(r.dir)
+	if err == nil && m.Version > r.manifest.Version {
+		err = r.load(ctx, m)
+	} else if os.IsNotExist(err) {
+		err = fmt.Errorf("no snapshot published in %s yet", r.dir)
+	}
+	r.err = err
+	if err != nil {
+		metrics.Add("duckserver_replication_pull_errors_total", 1)
+	}
+	if r.manifest.Version > 0 {
+		metrics.Set("duckserver_replication_lag_seconds", time.Since(r.manifest.PublishedAt).Seconds())
+	}
+	return err
+}
+
+func (r *replica) load(ctx context.Context, m *replicationManifest) error {
+	start := time.Now()
+	name := fmt.Sprintf("duckserver_replica_%d", m.Version)
+	path := filepath.Join(r.dir, m.File)
+	if _, err := r.server.conn.ExecContext(ctx, fmt.Sprintf("ATTACH %s AS %s (READ_ONLY)", quoteLiteral(path), name)); err != nil {
+		return err
+	}
+	objects, err := r.switchTo(ctx, name)
+	if err != nil {
+		_, _ = r.server.conn.ExecContext(ctx, "DETACH "+name)
+		return err
+	}
+	r.objects = objects
+	r.attached = append(r.attached, name)
+	for len(r.attached) > 2 {
+		if _, err = r.server.conn.ExecContext(ctx, "DETACH "+r.attached[0]); err != nil {
+			logrus.Warnf("detach %s error: %v", r.attached[0], err)
+		}
+		r.attached = r.attached[1:]
+	}
+	// the statements prepared on the previous snapshot are prepared again
+	r.server.schemaVersion.Add(1)
+	r.manifest = *m
+	r.loadedAt = time.Now()
+	duration := time.Since(start)
+	metrics.Add("duckserver_replication_pulls_total", 1)
+	metrics.Set("duckserver_replication_version", float64(m.Version))
+	metrics.Set("duckserver_replication_last_pull_duration_seconds", duration.Seconds())
+	logrus.Infof("loaded snapshot %d from %s in %s", m.Version, r.dir, duration)
+	return nil
+}
+
+// switchTo replaces the views of the main database by views of the tables of the attached snapshot in one
+// transaction, the views of the writer are created again in the main database. The objects of the main database
+// not created by the replica, like the hack views, are left alone.
+func (r *replica) switchTo(ctx context.Context, name string) (map[string]bool, error) {
+	local := map[string]bool{}
+	rows, err := r.server.conn.QueryContext(ctx, `select schema_name, table_name from duckdb_tables() where database_name = $1
+		union all select schema_name, view_name from duckdb_views() where database_name = $1 and not internal and not temporary`, r.server.mainDatabase)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var schema, table string
+		if err = rows.Scan(&schema, &table); err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+		if key := schema + "." + table; !r.objects[key] {
+			local[key] = true
+		}
+	}
+	if err = rows.Close(); err != nil {
+		return nil, err
+	}
+	type snapshotObject struct {
+		schema, name, sql string
+	}
+	var objects []snapshotObject
+	// the views are created after the tables in the order of the writer, as they're bound on creation
+	rows, err = r.server.conn.QueryContext(ctx, `select schema_name, name, sql from (
+		select schema_name, table_name as name, '' as sql, 0 as kind, table_oid as oid from duckdb_tables() where database_name = $1
+		union all select schema_name, view_name, sql, 1, view_oid from duckdb_views() where database_name = $1 and not internal and not temporary
+	) order by kind, oid`, name)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var o snapshotObject
+		if err = rows.Scan(&o.schema, &o.name, &o.sql); err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+		if o.schema != "duckserver" && !local[o.schema+"."+o.name] {
+			objects = append(objects, o)
+		}
+	}
+	if err = rows.Close(); err != nil {
+		return nil, err
+	}
+	tx, err := r.server.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback() }()
+	created := map[string]bool{}
+	for _, o := range objects {
+		if _, err = tx.ExecContext(ctx, "CREATE SCHEMA IF NOT EXISTS "+quoteIdent(o.schema)); err != nil {
+			return nil, err
+		}
+		query := fmt.Sprintf("CREATE OR REPLACE VIEW %s.%s AS SELECT * FROM %s.%s.%s", quoteIdent(o.schema), quoteIdent(o.name), name, quoteIdent(o.schema), quoteIdent(o.name))
+		if o.sql != "" {
+			query = createViewRegexp.ReplaceAllLiteralString(o.sql, "CREATE OR REPLACE VIEW")
+		}
+		if _, err = tx.ExecContext(ctx, query); err != nil {
+			return nil, fmt.Errorf("replicate %s.%s: %w", o.schema, o.name, err)
+		}
+		created[o.schema+"."+o.name] = true
+	}
+	for key := range r.objects {
+		if created[key] {
+			continue
+		}
+		schema, table, _ := strings.Cut(key, ".")
+		if _, err = tx.ExecContext(ctx, fmt.Sprintf("DROP VIEW IF EXISTS %s.%s", quoteIdent(schema), quoteIdent(table))); err != nil {
+			return nil, err
+		}
+	}
+	for _, table := range replicatedServerTables {
+		if _, err = tx.ExecContext(ctx, "DELETE FROM duckserver."+table); err != nil {
+			return nil, err
+		}
+		if _, err = tx.ExecContext(ctx, fmt.Sprintf("INSERT INTO duckserver.%s BY NAME SELECT * FROM %s.duckserver.%s", table, name, table)); err != nil {
+			return nil, fmt.Errorf("replicate duckserver.%s: %w", table, err)
+		}
+	}
+	return created, tx.Commit()
+}
+
+// CheckWrite returns an error on a reader, the tables are views of the read-only snapshot
+func (r *replica) CheckWrite() error {
+	if r == nil {
+		return nil
+	}
+	return &databaseError{SqlStateReadOnlySqlTransaction, fmt.Sprintf("cannot write on a read-only replica of %s", r.dir)}
+}
+
+// CheckQuery returns an error if the query writes on a reader
+func (r *replica) CheckQuery(query string) error {
+	if !isWriteQuery(query) {
+		return nil
+	}
+	return r.CheckWrite()
+}
+
+func (r *replica) Status() ReplicationStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	status := ReplicationStatus{Role: "reader", Dir: r.dir, Version: r.manifest.Version}
+	if r.manifest.Version > 0 {
+		publishedAt, loadedAt := r.manifest.PublishedAt, r.loadedAt
+		status.PublishedAt = &publishedAt
+		status.LoadedAt = &loadedAt
+		status.LagSeconds = time.Since(publishedAt).Seconds()
+	}
+	if r.err != nil {
+		status.Error = r.err.Error()
+	}
+	return status
+}
+
+// ReplicationStatus returns the replication role and state of the server
+func (s *PgServer) ReplicationStatus() ReplicationStatus {
+	if s.publisher != nil {
+		return s.publisher.Status()
+	}
+	if s.replica != nil {
+		return s.replica.Status()
+	}
+	return ReplicationStatus{Role: "standalone"}
+}
@@ -0,0 +1,398 @@
+package duckserver
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// the settings caching the result of a select, for dashboards repeating the same queries. A result younger than
+// result_cache_ttl seconds is served from the cache, an older one for result_cache_stale more seconds while it is
+// refreshed in the background
+const (
+	resultCacheTTLSetting   = "result_cache_ttl"
+	resultCacheStaleSetting = "result_cache_stale"
+)
+
+const defaultResultCacheStale = 5 * time.Minute
+
+// resultCacheStatusHeader tells a client whether the result came from the cache: hit, stale or miss
+const resultCacheStatusHeader = "X-DuckServer-Result-Cache"
+
+// resultCacheIgnoredSettings don't change the result of a query
+var resultCacheIgnoredSettings = map[string]bool{
+	"query":                 true,
+	"query_id":              true,
+	"user":                  true,
+	"password":              true,
+	resultCacheTTLSetting:   true,
+	resultCacheStaleSetting: true,
+	waitForFlushSetting:     true,
+}
+
+// resultCachePolicy is how long a result is fresh, and how long after that it is served while refreshed
+type resultCachePolicy struct {
+	ttl   time.Duration
+	stale time.Duration
+}
+
+// parseResultCachePolicy reads the policy of a query from its settings, set by the cache_ttl and cache_stale hints
+// too, ok is false when the query isn't cached
+func parseResultCachePolicy(settings url.Values, defaultStale time.Duration) (resultCachePolicy, bool, error) {
+	policy := resultCachePolicy{stale: defaultStale}
+	for _, name := range []string{resultCacheTTLSetting, resultCacheStaleSetting} {
+		if !settings.Has(name) {
+			continue
+		}
+		value := settings.Get(name)
+		seconds, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return policy, false, fmt.Errorf("Cannot parse setting %s: %q is not an unsigned integer", name, value)
+		}
+		if name == resultCacheTTLSetting {
+			policy.ttl = time.Duration(seconds) * time.Second
+		} else {
+			policy.stale = time.Duration(seconds) * time.Second
+		}
+	}
+	return policy, policy.ttl > 0, nil
+}
+
+// resultCacheKey identifies the result of a query, the same query of another user may see other rows
+func resultCacheKey(ctx context.Context, query, format string, settings url.Values) string {
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		if !resultCacheIgnoredSettings[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, part := range []string{UserFromContext(ctx), databaseFromContext(ctx), format, query} {
+		b.WriteString(part)
+		b.WriteByte(0)
+	}
+	for _, name := range names {
+		b.WriteString(name)
+		b.WriteByte('=')
+		b.WriteString(strings.Join(settings[name], ","))
+		b.WriteByte(0)
+	}
+	return hex.EncodeToString(getSHA256Sum([]byte(b.String())))
+}
+
+// resultCacheEntry is a cached response, its body is a file of the cache directory mapped into memory and shared by
+// the requests sending it
+type resultCacheEntry struct {
+	key           string
+	file          string
+	data          []byte
+	header        http.Header
+	policy        resultCachePolicy
+	storedAt      time.Time
+	lastUsed      time.Time
+	schemaVersion uint64
+	// refs counts the requests sending the entry, an evicted entry is unmapped once the last is done
+	refs       int
+	evicted    bool
+	refreshing bool
+}
+
+// resultCache holds the responses of the cached selects of the clickhouse endpoint, up to maxBytes, evicting the
+// least recently used. DDL statements invalidate all of them
+type resultCache struct {
+	dir           string
+	maxBytes      int64
+	defaultStale  time.Duration
+	schemaVersion *atomic.Uint64
+	mu            sync.Mutex
+	entries       map[string]*resultCacheEntry
+	size          int64
+}
+
+func newResultCache(dir string, maxBytes int64, defaultStale time.Duration, schemaVersion *atomic.Uint64) (*resultCache, error) {
+	if maxBytes <= 0 {
+		return nil, nil
+	}
+	if defaultStale == 0 {
+		defaultStale = defaultResultCacheStale
+	}
+	dir, err := os.MkdirTemp(dir, "duckserver-result-cache-*")
+	if err != nil {
+		return nil, err
+	}
+	return &resultCache{
+		dir:           dir,
+		maxBytes:      maxBytes,
+		defaultStale:  max(defaultStale, 0),
+		schemaVersion: schemaVersion,
+		entries:       make(map[string]*resultCacheEntry),
+	}, nil
+}
+
+// Serve sends the cached response of key and reports whether there was one. A stale response is sent and refreshed
+// in the background by refresh, a single refresh at a time
+func (c *resultCache) Serve(ctx context.Context, wr http.ResponseWriter, key string, refresh func(context.Context, http.ResponseWriter)) bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	e := c.entries[key]
+	if e == nil {
+		c.mu.Unlock()
+		metrics.Add("duckserver_result_cache_misses_total", 1)
+		return false
+	}
+	age := time.Since(e.storedAt)
+	if age > e.policy.ttl+e.policy.stale || e.schemaVersion != c.schemaVersion.Load() {
+		c.evict(e)
+		c.mu.Unlock()
+		metrics.Add("duckserver_result_cache_misses_total", 1)
+		return false
+	}
+	status, metric := "hit", "duckserver_result_cache_hits_total"
+	if age > e.policy.ttl {
+		status, metric = "stale", "duckserver_result_cache_stale_hits_total"
+		if !e.refreshing {
+			e.refreshing = true
+			go c.refresh(context.WithoutCancel(ctx), e, refresh)
+		}
+	}
+	e.refs++
+	e.lastUsed = time.Now()
+	c.mu.Unlock()
+	defer c.release(e)
+	metrics.Add(metric, 1)
+	for name, values := range e.header {
+		wr.Header()[name] = values
+	}
+	wr.Header().Set(resultCacheStatusHeader, status)
+	wr.WriteHeader(http.StatusOK)
+	_, _ = wr.Write(e.data)
+	return true
+}
+
+// refresh runs the query of a stale entry again and replaces the entry, the stale entry is kept if it fails
+func (c *resultCache) refresh(ctx context.Context, e *resultCacheEntry, refresh func(context.Context, http.ResponseWriter)) {
+	metrics.Add("duckserver_result_cache_refreshes_total", 1)
+	w := c.Writer(&discardResponseWriter{header: make(http.Header)}, e.key, e.policy)
+	refresh(ctx, w)
+	if !w.Done(ctx) {
+		logrus.Debugf("refresh of cached result %s failed", e.key)
+	}
+	c.mu.Lock()
+	e.refreshing = false
+	c.mu.Unlock()
+}
+
+func (c *resultCache) release(e *resultCacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e.refs--
+	if e.evicted && e.refs == 0 {
+		e.unmap()
+	}
+}
+
+// evict removes an entry, mu is held
+func (c *resultCache) evict(e *resultCacheEntry) {
+	if e.evicted {
+		return
+	}
+	e.evicted = true
+	if c.entries[e.key] == e {
+		delete(c.entries, e.key)
+	}
+	c.size -= int64(len(e.data))
+	metrics.Set("duckserver_result_cache_bytes", float64(c.size))
+	if e.refs == 0 {
+		e.unmap()
+	}
+}
+
+func (e *resultCacheEntry) unmap() {
+	if e.data != nil {
+		if err := unmapFile(e.data); err != nil {
+			logrus.Warnf("unmap cached result %s error: %v", e.key, err)
+		}
+		e.data = nil
+	}
+	_ = os.Remove(e.file)
+}
+
+// store adds the response written to file, replacing the entry of its key and evicting the least recently used
+// entries over maxBytes
+func (c *resultCache) store(key, file string, size int64, header http.Header, policy resultCachePolicy, version uint64) error {
+	data, err := mapFile(file, size)
+	if err != nil {
+		_ = os.Remove(file)
+		return err
+	}
+	now := time.Now()
+	e := &resultCacheEntry{key: key, file: file, data: data, header: header, policy: policy, storedAt: now, lastUsed: now, schemaVersion: version}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		// the cache was closed
+		e.unmap()
+		return nil
+	}
+	if old := c.entries[key]; old != nil {
+		c.evict(old)
+	}
+	c.entries[key] = e
+	c.size += size
+	for c.size > c.maxBytes {
+		var oldest *resultCacheEntry
+		for _, candidate := range c.entries {
+			if oldest == nil || candidate.lastUsed.Before(oldest.lastUsed) {
+				oldest = candidate
+			}
+		}
+		c.evict(oldest)
+		metrics.Add("duckserver_result_cache_evictions_total", 1)
+	}
+	metrics.Set("duckserver_result_cache_bytes", float64(c.size))
+	return nil
+}
+
+// Close drops the entries and removes the cache directory
+func (c *resultCache) Close() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	for _, e := range c.entries {
+		c.evict(e)
+	}
+	c.entries = nil
+	c.mu.Unlock()
+	_ = os.RemoveAll(c.dir)
+}
+
+// Writer returns a writer sending the response of a query to wr, which keeps a copy of it for the cache
+func (c *resultCache) Writer(wr http.ResponseWriter, key string, policy resultCachePolicy) *resultCacheWriter {
+	return &resultCacheWriter{ResponseWriter: wr, cache: c, key: key, policy: policy, schemaVersion: c.schemaVersion.Load()}
+}
+
+// resultCacheWriter copies a successful response to a file of the cache directory
+type resultCacheWriter struct {
+	http.ResponseWriter
+	cache         *resultCache
+	key           string
+	policy        resultCachePolicy
+	schemaVersion uint64
+	file          *os.File
+	size          int64
+	status        int
+	failed        bool
+}
+
+func (w *resultCacheWriter) WriteHeader(code int) {
+	if code >= http.StatusOK && w.status == 0 {
+		w.status = code
+		if code == http.StatusOK {
+			w.Header().Set(resultCacheStatusHeader, "miss")
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *resultCacheWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.status == http.StatusOK && !w.failed {
+		w.copy(p)
+	}
+	n, err := w.ResponseWriter.Write(p)
+	if err != nil {
+		w.failed = true
+	}
+	return n, err
+}
+
+func (w *resultCacheWriter) copy(p []byte) {
+	if w.size+int64(len(p)) > w.cache.maxBytes {
+		w.failed = true
+		return
+	}
+	if w.file == nil {
+		f, err := os.CreateTemp(w.cache.dir, "result-*")
+		if err != nil {
+			logrus.Warnf("create cached result error: %v", err)
+			w.failed = true
+			return
+		}
+		w.file = f
+	}
+	if _, err := w.file.Write(p); err != nil {
+		logrus.Warnf("write cached result error: %v", err)
+		w.failed = true
+		return
+	}
+	w.size += int64(len(p))
+}
+
+func (w *resultCacheWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Done adds the response to the cache, unless the query failed or the client went away before the whole response
+// was sent, and reports whether it was added
+func (w *resultCacheWriter) Done(ctx context.Context) bool {
+	failed := w.failed || w.status != http.StatusOK || ctx.Err() != nil ||
+		w.Header().Get(http.TrailerPrefix+chExceptionCodeHeader) != ""
+	if w.file == nil {
+		if failed {
+			return false
+		}
+		f, err := os.CreateTemp(w.cache.dir, "result-*")
+		if err != nil {
+			logrus.Warnf("create cached result error: %v", err)
+			return false
+		}
+		w.file = f
+	}
+	name := w.file.Name()
+	if err := w.file.Close(); err != nil || failed {
+		_ = os.Remove(name)
+		return false
+	}
+	header := make(http.Header)
+	for _, name := range []string{"Content-Type", "X-Clickhouse-Format"} {
+		if value := w.Header().Get(name); value != "" {
+			header.Set(name, value)
+		}
+	}
+	if err := w.cache.store(w.key, name, w.size, header, w.policy, w.schemaVersion); err != nil {
+		logrus.Warnf("store cached result error: %v", err)
+		return false
+	}
+	return true
+}
+
+// discardResponseWriter is the client of the background refreshes
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (w *discardResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *discardResponseWriter) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (w *discardResponseWriter) WriteHeader(int) {}
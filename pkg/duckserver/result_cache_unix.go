@@ -0,0 +1,25 @@
+//go:build !windows
+
+package duckserver
+
+import (
+	"os"
+	"syscall"
+)
+
+// mapFile maps a cached result into memory, read only and shared by the requests sending it
+func mapFile(name string, size int64) ([]byte, error) {
+	if size == 0 {
+		return nil, nil
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func unmapFile(data []byte) error {
+	return syscall.Munmap(data)
+}
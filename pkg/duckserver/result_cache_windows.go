@@ -0,0 +1,18 @@
+//go:build windows
+
+package duckserver
+
+import "os"
+
+// mapFile reads a cached result into memory, the file of an open mapping couldn't be removed on windows
+func mapFile(name string, size int64) ([]byte, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return data[:min(int64(len(data)), size)], nil
+}
+
+func unmapFile([]byte) error {
+	return nil
+}
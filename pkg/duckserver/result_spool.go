@@ -0,0 +1,78 @@
+package duckserver
+
+import (
+	"bytes"
+	"io"
+	"os"
+)
+
+const defaultResultSpoolMemory = 16 << 20
+
+// resultSpool buffers the response of a statement in memory and spills to a temporary file of dir over memLimit,
+// so the DuckDB result is released before a slow client downloads it
+type resultSpool struct {
+	dir      string
+	buf      bytes.Buffer
+	file     *os.File
+	memLimit int
+	spilled  int64
+}
+
+func newResultSpool(dir string, memLimit int) *resultSpool {
+	if memLimit <= 0 {
+		memLimit = defaultResultSpoolMemory
+	}
+	return &resultSpool{dir: dir, memLimit: memLimit}
+}
+
+func (s *resultSpool) Write(p []byte) (int, error) {
+	if s.file == nil && s.buf.Len()+len(p) > s.memLimit {
+		f, err := os.CreateTemp(s.dir, "duckserver-spool-*")
+		if err != nil {
+			return 0, err
+		}
+		s.file = f
+		metrics.Add("duckserver_result_spill_files_total", 1)
+		if _, err = s.buf.WriteTo(f); err != nil {
+			return 0, err
+		}
+	}
+	if s.file != nil {
+		s.spilled += int64(len(p))
+		return s.file.Write(p)
+	}
+	return s.buf.Write(p)
+}
+
+func (s *resultSpool) WriteTo(w io.Writer) (int64, error) {
+	if s.file == nil {
+		return s.buf.WriteTo(w)
+	}
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return io.Copy(w, s.file)
+}
+
+func (s *resultSpool) Close() error {
+	if s.file == nil {
+		return nil
+	}
+	metrics.Add("duckserver_result_spill_bytes_total", float64(s.spilled))
+	_ = s.file.Close()
+	return os.Remove(s.file.Name())
+}
+
+// spoolResponse runs a statement with its response spooled, the spool is sent after the result is closed
+func (c *PgConn) spoolResponse(run func() error) error {
+	spool := newResultSpool(c.server.scratchDir, c.server.resultSpoolMemory)
+	defer spool.Close()
+	writer := c.wire.Writer
+	c.wire.Writer = spool
+	err := run()
+	c.wire.Writer = writer
+	if _, writeErr := spool.WriteTo(writer); writeErr != nil {
+		return writeErr
+	}
+	return err
+}
@@ -0,0 +1,314 @@
+package duckserver
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultRowPolicyUser is the duckserver.row_policies user whose policies apply to the users without their own
+// policy of the table
+const defaultRowPolicyUser = "*"
+
+// rowPoliciesTTL is the interval between reloads of duckserver.row_policies, writes to the table reload it on the
+// next query
+const rowPoliciesTTL = 10 * time.Second
+
+// rowPolicyStopWords end the table reference of a FROM or JOIN, the next word isn't an alias
+var rowPolicyStopWords = map[string]bool{
+	"where": true, "join": true, "on": true, "using": true, "group": true, "order": true, "limit": true,
+	"offset": true, "having": true, "qualify": true, "window": true, "union": true, "except": true,
+	"intersect": true, "inner": true, "left": true, "right": true, "full": true, "outer": true, "cross": true,
+	"natural": true, "positional": true, "asof": true, "semi": true, "anti": true, "lateral": true,
+	"sample": true, "tablesample": true, "using_sample": true, "returning": true, "set": true, "select": true,
+	"pivot": true, "unpivot": true, "fetch": true, "values": true, "format": true, "settings": true,
+}
+
+// rowPolicyPivotWords start the PIVOT and UNPIVOT statements, which read the table following them. The PIVOT of a
+// FROM clause is followed by a parenthesized group instead
+var rowPolicyPivotWords = map[string]bool{"pivot": true, "unpivot": true, "pivot_wider": true, "pivot_longer": true}
+
+type rowPolicyKey struct {
+	user   string
+	schema string
+	table  string
+}
+
+// rowPolicies holds duckserver.row_policies, the predicates restricting the rows of a table a user reads. Queries
+// of the user read the table through a subquery filtering it with the predicate.
+type rowPolicies struct {
+	db       *sql.DB
+	mu       sync.RWMutex
+	policies map[rowPolicyKey]string
+	// users and tables have policies, by lower case table name
+	users  map[string]bool
+	tables map[string]bool
+	// schemas and catalogs are the lower case names a qualified table name is resolved with
+	schemas  map[string]bool
+	catalogs map[string]bool
+	loadedAt time.Time
+	dirty    atomic.Bool
+}
+
+func newRowPolicies(db *sql.DB) (*rowPolicies, error) {
+	p := &rowPolicies{db: db}
+	return p, p.Load()
+}
+
+// Load reads duckserver.row_policies
+func (p *rowPolicies) Load() error {
+	rows, err := p.db.Query("select username, lower(coalesce(schema_name, 'main')), lower(table_name), predicate from duckserver.row_policies")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	policies := make(map[rowPolicyKey]string)
+	users := make(map[string]bool)
+	tables := make(map[string]bool)
+	for rows.Next() {
+		var key rowPolicyKey
+		var predicate string
+		if err = rows.Scan(&key.user, &key.schema, &key.table, &predicate); err != nil {
+			return err
+		}
+		policies[key] = predicate
+		users[key.user] = true
+		tables[key.table] = true
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	schemas := make(map[string]bool)
+	catalogs := make(map[string]bool)
+	rows, err = p.db.Query("select lower(catalog_name), lower(schema_name) from information_schema.schemata")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var catalog, schema string
+		if err = rows.Scan(&catalog, &schema); err != nil {
+			return err
+		}
+		catalogs[catalog] = true
+		schemas[schema] = true
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	p.policies, p.users, p.tables, p.schemas, p.catalogs, p.loadedAt = policies, users, tables, schemas, catalogs, time.Now()
+	p.mu.Unlock()
+	return nil
+}
+
+// resolve returns the schema of a table name of 1 to 3 lower case parts, empty for an unqualified name which the
+// search path may resolve to any schema or for a qualifier naming both a schema and a catalog. The qualifier of a
+// name of 2 parts is a schema or a catalog whose default schema is main, ok is false if it is neither.
+func (p *rowPolicies) resolve(names []string) (schema string, ok bool) {
+	switch len(names) {
+	case 1:
+		return "", true
+	case 2:
+		isSchema, isCatalog := p.schemas[names[0]], p.catalogs[names[0]]
+		switch {
+		case isSchema && isCatalog:
+			return "", true
+		case isSchema:
+			return names[0], true
+		case isCatalog:
+			return "main", true
+		}
+		return "", false
+	case 3:
+		return names[1], true
+	}
+	return "", false
+}
+
+// reload reloads the policies after a write to duckserver.row_policies or once they are older than rowPoliciesTTL
+func (p *rowPolicies) reload() {
+	p.mu.RLock()
+	stale := time.Since(p.loadedAt) > rowPoliciesTTL
+	p.mu.RUnlock()
+	if !stale && !p.dirty.Load() {
+		return
+	}
+	p.dirty.Store(false)
+	if err := p.Load(); err != nil {
+		logrus.Warnf("load row policies error: %v", err)
+	}
+}
+
+// predicate returns the policy of user for a table, an empty schema matches the table in any schema
+func (p *rowPolicies) predicate(user, schema, table string) (string, bool) {
+	if !p.tables[table] {
+		return "", false
+	}
+	for _, u := range []string{user, defaultRowPolicyUser} {
+		if schema != "" {
+			if predicate, ok := p.policies[rowPolicyKey{u, schema, table}]; ok {
+				return predicate, true
+			}
+			continue
+		}
+		var predicates []string
+		for key, predicate := range p.policies {
+			if key.user == u && key.table == table {
+				predicates = append(predicates, "("+predicate+")")
+			}
+		}
+		if len(predicates) > 0 {
+			return strings.Join(predicates, " AND "), true
+		}
+	}
+	return "", false
+}
+
+// Rewrite filters the tables with a policy of user read by query. Writes of a restricted user to those tables or to
+// duckserver.row_policies are rejected.
+func (p *rowPolicies) Rewrite(user, query string) (string, error) {
+	if p == nil {
+		return query, nil
+	}
+	p.reload()
+	// the write runs after the rewrite, the next query reloads the policies and the schemas
+	if isWriteQuery(query) && strings.Contains(strings.ToLower(query), "row_policies") || ddlRegexp.MatchString(query) {
+		p.dirty.Store(true)
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if len(p.policies) == 0 || !p.users[user] && !p.users[defaultRowPolicyUser] {
+		return query, nil
+	}
+	r := &rowPolicyRewriter{policies: p, user: user}
+	query = r.rewrite(query)
+	if r.err != nil {
+		return "", r.err
+	}
+	return query, nil
+}
+
+// CheckWrite returns an error if user has a row policy on the table, schema may be a catalog
+func (p *rowPolicies) CheckWrite(user, schema, table string) error {
+	if p == nil {
+		return nil
+	}
+	p.reload()
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	table = strings.ToLower(table)
+	schema, ok := p.resolve([]string{strings.ToLower(schema), table})
+	if !ok && p.tables[table] {
+		return fmt.Errorf("row policies of user %s can't resolve the table %s", user, table)
+	}
+	if _, ok := p.predicate(user, schema, table); ok {
+		return fmt.Errorf("row policies of user %s don't allow writing to %s", user, table)
+	}
+	return nil
+}
+
+// rowPolicyRewriter rewrites the table references of a query, err rejects a query writing to a table with a policy
+// of the user, reading it without the policy, reading duckserver.row_policies or naming a table with a policy which
+// can't be resolved
+type rowPolicyRewriter struct {
+	policies *rowPolicies
+	user     string
+	err      error
+}
+
+// rewrite replaces the tables following FROM, its commas, JOIN and the PIVOT and UNPIVOT statements with a subquery
+// applying the policy, parenthesized groups such as subqueries and CTEs are rewritten recursively. The tables following DELETE FROM, UPDATE, INTO, COPY,
+// TABLE and SUMMARIZE are written or read as a whole.
+func (r *rowPolicyRewriter) rewrite(s string) string {
+	tokens := chTokenize(s)
+	var b strings.Builder
+	last := 0
+	// fromList is set in the comma separated tables of a FROM
+	fromList := false
+	for i := 0; i < len(tokens); i++ {
+		t := tokens[i]
+		if strings.HasPrefix(t.text, "(") {
+			b.WriteString(s[last:t.start])
+			b.WriteString("(" + r.rewrite(t.text[1:len(t.text)-1]) + ")")
+			last = t.end
+			continue
+		}
+		keyword := strings.ToLower(t.text)
+		read := keyword == "join" || keyword == "from" && (i == 0 || !strings.EqualFold(tokens[i-1].text, "delete")) ||
+			keyword == "," && fromList || rowPolicyPivotWords[keyword]
+		if read {
+			fromList = true
+		} else if rowPolicyStopWords[keyword] {
+			fromList = false
+		}
+		if !read && keyword != "from" && keyword != "update" && keyword != "into" && keyword != "copy" && keyword != "table" && keyword != "summarize" {
+			continue
+		}
+		// the table name is made of identifiers separated by dots
+		j := i + 1
+		var parts []string
+		for j < len(tokens) && isRowPolicyIdent(tokens[j].text) {
+			parts = append(parts, tokens[j].text)
+			if j+1 < len(tokens) && tokens[j+1].text == "." {
+				j += 2
+				continue
+			}
+			j++
+			break
+		}
+		// a parenthesized group after the name of a read is a table function
+		if len(parts) == 0 || rowPolicyStopWords[strings.ToLower(parts[0])] || read && j < len(tokens) && strings.HasPrefix(tokens[j].text, "(") {
+			continue
+		}
+		names := splitQualifiedName(strings.Join(parts, "."))
+		for k := range names {
+			names[k] = strings.ToLower(names[k])
+		}
+		table := names[len(names)-1]
+		schema, resolved := r.policies.resolve(names)
+		if !resolved {
+			if r.policies.tables[table] && r.err == nil {
+				r.err = fmt.Errorf("row policies of user %s can't resolve the table %s", r.user, strings.Join(parts, "."))
+			}
+			continue
+		}
+		if table == "row_policies" && (schema == "duckserver" || schema == "" && len(names) > 1) && r.err == nil {
+			r.err = fmt.Errorf("row policies of user %s don't allow reading or writing duckserver.row_policies", r.user)
+			continue
+		}
+		predicate, ok := r.policies.predicate(r.user, schema, table)
+		if !ok {
+			continue
+		}
+		if !read {
+			if r.err == nil {
+				r.err = fmt.Errorf("row policies of user %s don't allow writing to %s", r.user, strings.Join(parts, "."))
+			}
+			continue
+		}
+		name := s[tokens[i+1].start:tokens[j-1].end]
+		alias := " AS " + parts[len(parts)-1]
+		end := tokens[j-1].end
+		if j+1 < len(tokens) && strings.EqualFold(tokens[j].text, "as") && strings.HasPrefix(tokens[j+1].text, "(") {
+			// AS followed by the column aliases only, the subquery needs the table name
+			end = tokens[j].end
+		} else if j < len(tokens) && (strings.EqualFold(tokens[j].text, "as") || isRowPolicyIdent(tokens[j].text) && !rowPolicyStopWords[strings.ToLower(tokens[j].text)]) {
+			alias = ""
+		}
+		b.WriteString(s[last:tokens[i+1].start])
+		b.WriteString(fmt.Sprintf("(SELECT * FROM %s WHERE %s)%s", name, predicate, alias))
+		last = end
+		i = j - 1
+	}
+	b.WriteString(s[last:])
+	return b.String()
+}
+
+func isRowPolicyIdent(s string) bool {
+	return s != "" && (s[0] == '"' || isChIdentByte(s[0]))
+}
@@ -0,0 +1,102 @@
+package duckserver
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// SQLSTATEs of the rows rejected by COPY FROM STDIN
+const (
+	SqlStateNotNullViolation          = "23502"
+	SqlStateInvalidTextRepresentation = "22P02"
+	SqlStateBadCopyFileFormat         = "22P04"
+)
+
+// rowValidator checks the rows of COPY FROM STDIN and clickhouse inserts before they are appended, a row with a null
+// in a NOT NULL column or a value not matching its column fails with its number instead of failing the whole flush
+type rowValidator struct {
+	table   string
+	columns []string
+	notNull []bool
+	row     int
+	// allowErrors are the bad rows skipped by clickhouse inserts
+	allowErrors *allowErrors
+}
+
+// newRowValidator returns the validator of the rows of columns of a table, nil columns are all the columns in order
+func newRowValidator(ctx context.Context, conn driver.Conn, schema, table string, columns []string) (*rowValidator, error) {
+	rows, err := conn.(driver.QueryerContext).QueryContext(ctx, "select column_name, is_nullable = 'NO' from information_schema.columns where table_schema = $1 and table_name = $2 order by ordinal_position", []driver.NamedValue{
+		{Ordinal: 1, Value: schema},
+		{Ordinal: 2, Value: table},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	v := &rowValidator{table: table}
+	notNull := make(map[string]bool)
+	values := make([]driver.Value, 2)
+	for {
+		if err = rows.Next(values); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		name := values[0].(string)
+		notNull[name] = values[1] == true
+		if columns == nil {
+			v.columns = append(v.columns, name)
+		}
+	}
+	if columns != nil {
+		v.columns = columns
+	}
+	v.notNull = make([]bool, len(v.columns))
+	for i, name := range v.columns {
+		v.notNull[i] = notNull[name]
+	}
+	return v, nil
+}
+
+// Next starts the next row, errors are numbered with it from 1
+func (v *rowValidator) Next() {
+	v.row++
+}
+
+// FieldCount checks the number of fields of a row of COPY
+func (v *rowValidator) FieldCount(n int) error {
+	if n > len(v.columns) {
+		return &databaseError{SqlStateBadCopyFileFormat, "extra data after last expected column"}
+	}
+	if n < len(v.columns) {
+		return &databaseError{SqlStateBadCopyFileFormat, fmt.Sprintf("missing data for column \"%s\"", v.columns[n])}
+	}
+	return nil
+}
+
+// ValueError reports a value of column i of the row not converting to the column type
+func (v *rowValidator) ValueError(i int, err error) error {
+	return &databaseError{SqlStateInvalidTextRepresentation, fmt.Sprintf("%s, column %s", err, v.columns[i])}
+}
+
+// Check checks the values of the row against the NOT NULL constraints
+func (v *rowValidator) Check(values []driver.Value) error {
+	for i, value := range values {
+		if value == nil && i < len(v.notNull) && v.notNull[i] {
+			return &databaseError{SqlStateNotNullViolation, fmt.Sprintf("null value in column \"%s\" of relation \"%s\" violates not-null constraint", v.columns[i], v.table)}
+		}
+	}
+	return nil
+}
+
+// RowError numbers an error of the row, keeping its SQLSTATE
+func (v *rowValidator) RowError(err error) error {
+	var dbErr *databaseError
+	if errors.As(err, &dbErr) {
+		return &databaseError{dbErr.code, fmt.Sprintf("%s, row %d", dbErr.msg, v.row)}
+	}
+	return fmt.Errorf("%w, row %d", err, v.row)
+}
@@ -0,0 +1,293 @@
+package duckserver
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+const (
+	// SqlStateNoActiveTransaction is the SQLSTATE of SAVEPOINT outside a transaction block
+	SqlStateNoActiveTransaction = "25P01"
+	// SqlStateInvalidSavepoint is the SQLSTATE of a savepoint that doesn't exist
+	SqlStateInvalidSavepoint = "3B001"
+)
+
+var savepointRegexp = regexp.MustCompile(`(?is)^\s*SAVEPOINT\s+(` + pgIdentPattern + `)\s*;?\s*$`)
+var releaseSavepointRegexp = regexp.MustCompile(`(?is)^\s*RELEASE\s+(?:SAVEPOINT\s+)?(` + pgIdentPattern + `)\s*;?\s*$`)
+var rollbackToSavepointRegexp = regexp.MustCompile(`(?is)^\s*ROLLBACK\s+(?:(?:WORK|TRANSACTION)\s+)?TO\s+(?:SAVEPOINT\s+)?(` + pgIdentPattern + `)\s*;?\s*$`)
+
+// maxTransactionLog is the number of statements of a transaction kept to roll back to a savepoint, the savepoints
+// of a larger transaction can't be rolled back to
+const maxTransactionLog = 10000
+
+// savepoint is a savepoint of the transaction, logLen is the length of the transaction log when it was set or -1
+// when the log is incomplete
+type savepoint struct {
+	name   string
+	logLen int
+}
+
+// loggedStatement is a statement of the transaction with its parameters. A statement which isn't replayable could
+// give another result when run again, the savepoints after it can't be rolled back to. The tables inserted into are
+// replayable if their defaults are constants
+type loggedStatement struct {
+	query      string
+	values     []driver.Value
+	replayable bool
+	tables     []string
+}
+
+// savepointCommand is a SAVEPOINT, RELEASE or ROLLBACK TO, psqlODBC wraps the statements of a transaction in
+// savepoints to roll back a failed statement only
+type savepointCommand struct {
+	verb string
+	name string
+}
+
+// parseSavepointCommand parses SAVEPOINT, RELEASE and ROLLBACK TO
+func parseSavepointCommand(query string) *savepointCommand {
+	if m := savepointRegexp.FindStringSubmatch(query); m != nil {
+		return &savepointCommand{verb: "SAVEPOINT", name: foldIdent(m[1])}
+	}
+	if m := releaseSavepointRegexp.FindStringSubmatch(query); m != nil {
+		return &savepointCommand{verb: "RELEASE", name: foldIdent(m[1])}
+	}
+	if m := rollbackToSavepointRegexp.FindStringSubmatch(query); m != nil {
+		return &savepointCommand{verb: "ROLLBACK", name: foldIdent(m[1])}
+	}
+	return nil
+}
+
+// runSavepointCommand runs SAVEPOINT, RELEASE and ROLLBACK TO, DuckDB has no subtransactions so a savepoint is
+// the position in the transaction log and ROLLBACK TO restores it by running the transaction again up to there
+func (c *PgConn) runSavepointCommand(cmd *savepointCommand) error {
+	if c.txStatus == TransactionStatusIdle {
+		return c.SendErrorResponseWithCode(SqlStateNoActiveTransaction, fmt.Sprintf("%s can only be used in transaction blocks", cmd.verb))
+	}
+	if c.txStatus == TransactionStatusFailed && cmd.verb != "ROLLBACK" {
+		return c.SendErrorResponse("current transaction is aborted, commands ignored until end of transaction block")
+	}
+	if cmd.verb == "SAVEPOINT" {
+		sp := savepoint{name: cmd.name, logLen: len(c.txLog)}
+		if c.txLogIncomplete {
+			sp.logLen = -1
+		}
+		c.savepoints = append(c.savepoints, sp)
+		return c.SendCommandComplete("SAVEPOINT")
+	}
+	i := len(c.savepoints) - 1
+	for i >= 0 && c.savepoints[i].name != cmd.name {
+		i--
+	}
+	if i < 0 {
+		return c.SendErrorResponseWithCode(SqlStateInvalidSavepoint, fmt.Sprintf("savepoint \"%s\" does not exist", cmd.name))
+	}
+	if cmd.verb == "ROLLBACK" {
+		return c.rollbackToSavepoint(i)
+	}
+	c.savepoints = c.savepoints[:i]
+	return c.SendCommandComplete("RELEASE")
+}
+
+// rollbackToSavepoint rolls back the DuckDB transaction and runs the logged statements before the savepoint in a new
+// one, the savepoint is kept like postgresql. The statements see the data committed since the transaction began, so
+// only statements which don't read data or evaluate volatile functions are run again, with others before the
+// savepoint the rollback is refused and the transaction is kept.
+func (c *PgConn) rollbackToSavepoint(i int) error {
+	sp := c.savepoints[i]
+	if sp.logLen < 0 {
+		return c.SendErrorResponseWithCode(SqlStateFeatureNotSupported, fmt.Sprintf("cannot roll back to savepoint \"%s\", the transaction has more than %d statements or a COPY", sp.name, maxTransactionLog))
+	}
+	ctx := context.Background()
+	for _, stmt := range c.txLog[:sp.logLen] {
+		replayable := stmt.replayable
+		for _, table := range stmt.tables {
+			if !replayable {
+				break
+			}
+			var err error
+			if replayable, err = c.hasConstantDefaults(ctx, table); err != nil {
+				return c.SendErrorResponse(err.Error())
+			}
+		}
+		if !replayable {
+			return c.SendErrorResponseWithCode(SqlStateFeatureNotSupported, fmt.Sprintf("cannot roll back to savepoint \"%s\", a statement before it reads data or evaluates volatile functions and can't be run again with the same result", sp.name))
+		}
+	}
+	execer := c.conn.(driver.ExecerContext)
+	if _, err := execer.ExecContext(ctx, "ROLLBACK", nil); err != nil {
+		return c.SendErrorResponse(err.Error())
+	}
+	c.txStatus = TransactionStatusFailed
+	if _, err := execer.ExecContext(ctx, "BEGIN", nil); err != nil {
+		return c.SendErrorResponse(err.Error())
+	}
+	for _, stmt := range c.txLog[:sp.logLen] {
+		if _, err := execer.ExecContext(ctx, stmt.query, namedValues(stmt.values)); err != nil {
+			return c.SendErrorResponse(fmt.Sprintf("cannot roll back to savepoint \"%s\": %s", sp.name, err))
+		}
+	}
+	c.txStatus = TransactionStatusInTransaction
+	c.txLog = c.txLog[:sp.logLen]
+	c.savepoints = c.savepoints[:i+1]
+	return c.SendCommandComplete("ROLLBACK")
+}
+
+// logStatement keeps a statement run in the transaction for rollbackToSavepoint, queries without side effects
+// aren't kept
+func (c *PgConn) logStatement(query string, values []driver.Value) {
+	if c.txStatus != TransactionStatusInTransaction || c.inError || beginTransactionRegexp.MatchString(query) || selectLikeQueryRegexp.MatchString(query) {
+		return
+	}
+	if len(c.txLog) >= maxTransactionLog {
+		c.txLogIncomplete = true
+		return
+	}
+	stmt := loggedStatement{query: query, values: values, replayable: true}
+	for _, part := range splitStatements(query) {
+		table, ok := replayableStatement(part)
+		stmt.replayable = stmt.replayable && ok
+		if table != "" {
+			stmt.tables = append(stmt.tables, table)
+		}
+	}
+	c.txLog = append(c.txLog, stmt)
+}
+
+// replayableStatement reports whether a statement gives the same result when run again on the data committed by
+// other connections since: DDL which doesn't read data or evaluate expressions on existing rows, settings and
+// INSERT ... VALUES of literals and parameters. The table of an insert is returned, its defaults are evaluated for
+// the omitted columns
+func replayableStatement(stmt string) (string, bool) {
+	tokens := chTokenize(stmt)
+	if len(tokens) == 0 {
+		return "", true
+	}
+	switch classifyStatement(stmt) {
+	case "set", "transaction":
+		return "", true
+	case "ddl":
+		// the query of a view or macro isn't run
+		query := false
+		for i, t := range tokens {
+			word := strings.ToLower(t.text)
+			query = query || word == "view" || word == "macro" || word == "function"
+			// CREATE TABLE ... AS query reads data, ALTER evaluates defaults and conversions on the existing rows
+			if word == "as" && !query && strings.EqualFold(tokens[0].text, "create") && i+1 < len(tokens) {
+				next := strings.ToLower(tokens[i+1].text)
+				if next == "select" || next == "from" || next == "with" || next == "values" || next == "table" || strings.HasPrefix(next, "(") {
+					return "", false
+				}
+			}
+			if strings.EqualFold(tokens[0].text, "alter") && (word == "default" || word == "using" || word == "type") {
+				return "", false
+			}
+		}
+		return "", !strings.EqualFold(tokens[0].text, "optimize")
+	case "insert":
+		return replayableInsert(tokens)
+	}
+	return "", false
+}
+
+// replayableInsert reports whether the tokens are an INSERT INTO table [(columns)] VALUES of literals and parameters
+// without ON CONFLICT, and returns the table
+func replayableInsert(tokens []chToken) (string, bool) {
+	if len(tokens) < 4 || !strings.EqualFold(tokens[0].text, "insert") || !strings.EqualFold(tokens[1].text, "into") {
+		return "", false
+	}
+	i := 2
+	var parts []string
+	for i < len(tokens) && isRowPolicyIdent(tokens[i].text) {
+		parts = append(parts, chUnquote(tokens[i].text))
+		if i+1 < len(tokens) && tokens[i+1].text == "." {
+			i += 2
+			continue
+		}
+		i++
+		break
+	}
+	if len(parts) == 0 {
+		return "", false
+	}
+	if i < len(tokens) && strings.HasPrefix(tokens[i].text, "(") {
+		i++
+	}
+	if i >= len(tokens) || !strings.EqualFold(tokens[i].text, "values") {
+		return "", false
+	}
+	for i++; i < len(tokens); i++ {
+		t := tokens[i].text
+		switch {
+		case t == ",":
+		case strings.HasPrefix(t, "(") && isLiteralList(t[1:len(t)-1]):
+		case strings.EqualFold(t, "returning"):
+			i = len(tokens)
+		default:
+			return "", false
+		}
+	}
+	return parts[len(parts)-1], true
+}
+
+// isLiteralList reports whether s is made of literals, parameters and casts only, without identifiers, function calls
+// or subqueries
+func isLiteralList(s string) bool {
+	tokens := chTokenize(s)
+	for i := 0; i < len(tokens); i++ {
+		t := tokens[i].text
+		switch {
+		case t[0] == '\'' || t[0] >= '0' && t[0] <= '9':
+		case strings.HasPrefix(t, "("):
+			if !isLiteralList(t[1 : len(t)-1]) {
+				return false
+			}
+		case len(t) == 1 && strings.Contains(",+-.$:[]{}", t):
+			if t == ":" && i+2 < len(tokens) && tokens[i+1].text == ":" && isChIdentByte(tokens[i+2].text[0]) {
+				// a cast to a type, with its parameters like DECIMAL(10, 2)
+				i += 2
+				if i+1 < len(tokens) && strings.HasPrefix(tokens[i+1].text, "(") {
+					i++
+				}
+			}
+		default:
+			if word := strings.ToLower(t); word != "null" && word != "true" && word != "false" {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// hasConstantDefaults reports whether the columns of the tables named table have no defaults or constant ones, the
+// others like now() or nextval() give new values when an insert is run again
+func (c *PgConn) hasConstantDefaults(ctx context.Context, table string) (bool, error) {
+	rows, err := c.conn.(driver.QueryerContext).QueryContext(ctx, "select column_default from duckdb_columns() where table_name = $1 and column_default is not null",
+		[]driver.NamedValue{{Ordinal: 1, Value: table}})
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	values := make([]driver.Value, 1)
+	for {
+		if err = rows.Next(values); err == io.EOF {
+			return true, nil
+		} else if err != nil {
+			return false, err
+		}
+		if def, _ := values[0].(string); !constantDefaultRegexp.MatchString(def) {
+			return false, nil
+		}
+	}
+}
+
+// resetTransactionLog forgets the log and the savepoints at the beginning and the end of a transaction
+func (c *PgConn) resetTransactionLog() {
+	c.txLog = nil
+	c.txLogIncomplete = false
+	c.savepoints = nil
+}
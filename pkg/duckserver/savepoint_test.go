@@ -0,0 +1,59 @@
+package duckserver
+
+import "testing"
+
+func TestReplayableStatement(t *testing.T) {
+	tests := []struct {
+		stmt       string
+		table      string
+		replayable bool
+	}{
+		{"insert into t values (1)", "t", true},
+		{"INSERT INTO main.t (a, b) VALUES (1, 'x'), ($1, $2) RETURNING a", "t", true},
+		{`insert into "My T" values (-1.5e3, null, true, '2024-01-01'::timestamp, 1::decimal(10, 2), [1, 2], {'a': 1})`, "My T", true},
+		{"insert into t values ((1 + 2))", "t", true},
+		{"create table t (a int default 1)", "", true},
+		{"create view v as select * from t", "", true},
+		{"create or replace macro m(a) as a + 1", "", true},
+		{"drop table t", "", true},
+		{"alter table t add column c int", "", true},
+		{"set search_path = 'main'", "", true},
+
+		{"insert into t select * from u", "", false},
+		{"insert into t values (now())", "", false},
+		{"insert into t values (nextval('s'))", "", false},
+		{"insert into t values (current_timestamp)", "", false},
+		{"insert into t values ((select max(a) from u))", "", false},
+		{"insert into t values (random())", "", false},
+		{"insert into t default values", "", false},
+		{"insert or replace into t values (1)", "", false},
+		{"insert into t values (1) on conflict do nothing", "", false},
+		{"update t set a = 1 where b = 2", "", false},
+		{"update t set a = 1", "", false},
+		{"delete from t where a = 1", "", false},
+		{"create table t2 as select * from t", "", false},
+		{"create table t2 as (select * from t)", "", false},
+		{"alter table t add column c timestamp default now()", "", false},
+		{"alter table t alter a type bigint using a * 2", "", false},
+		{"copy t from 'f.csv'", "", false},
+		{"with c as (select 1) insert into t select * from c", "", false},
+		{"call my_procedure()", "", false},
+	}
+	for _, test := range tests {
+		table, replayable := replayableStatement(test.stmt)
+		if replayable != test.replayable || replayable && table != test.table {
+			t.Errorf("replayableStatement(%q) = %q, %v, want %q, %v", test.stmt, table, replayable, test.table, test.replayable)
+		}
+	}
+}
+
+func TestConstantDefault(t *testing.T) {
+	for def, constant := range map[string]bool{
+		"42": true, "'abc'": true, "CAST('2024-01-01' AS DATE)": true, "true": true,
+		"nextval('s')": false, "now()": false, "CURRENT_TIMESTAMP": false, "random()": false, "uuid()": false,
+	} {
+		if constantDefaultRegexp.MatchString(def) != constant {
+			t.Errorf("default %s constant = %v, want %v", def, !constant, constant)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package duckserver
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/xdg-go/scram"
+	"strings"
+)
+
+const (
+	scramSha256     = "SCRAM-SHA-256"
+	scramSha256Plus = "SCRAM-SHA-256-PLUS"
+)
+
+// scramServerNonceLen is the number of random bytes the server appends to the client nonce
+const scramServerNonceLen = 18
+
+// tlsServerEndPoint is the tls-server-end-point channel binding data of RFC 5929, the hash of the server certificate.
+// It returns nil if the certificate has no usable signature hash, e.g. ed25519, then SCRAM-SHA-256-PLUS isn't offered
+func tlsServerEndPoint(config *tls.Config) []byte {
+	if config == nil || len(config.Certificates) == 0 || len(config.Certificates[0].Certificate) == 0 {
+		return nil
+	}
+	cert, err := x509.ParseCertificate(config.Certificates[0].Certificate[0])
+	if err != nil {
+		return nil
+	}
+	var hash crypto.Hash
+	switch cert.SignatureAlgorithm {
+	case x509.MD5WithRSA, x509.SHA1WithRSA, x509.ECDSAWithSHA1, x509.DSAWithSHA1,
+		x509.SHA256WithRSA, x509.SHA256WithRSAPSS, x509.ECDSAWithSHA256, x509.DSAWithSHA256:
+		hash = crypto.SHA256
+	case x509.SHA384WithRSA, x509.SHA384WithRSAPSS, x509.ECDSAWithSHA384:
+		hash = crypto.SHA384
+	case x509.SHA512WithRSA, x509.SHA512WithRSAPSS, x509.ECDSAWithSHA512:
+		hash = crypto.SHA512
+	default:
+		return nil
+	}
+	h := hash.New()
+	h.Write(cert.Raw)
+	return h.Sum(nil)
+}
+
+// scramConversation is the server side of SCRAM-SHA-256 and SCRAM-SHA-256-PLUS with tls-server-end-point
+// channel binding, github.com/xdg-go/scram rejects clients requesting channel binding
+type scramConversation struct {
+	credentials scram.StoredCredentials
+	// channelBinding is the channel binding data of the connection, nil if PLUS isn't offered
+	channelBinding  []byte
+	plus            bool
+	gs2Header       string
+	clientFirstBare string
+	serverFirst     string
+	nonce           string
+}
+
+func newScramConversation(mechanism string, credentials scram.StoredCredentials, channelBinding []byte) (*scramConversation, error) {
+	switch mechanism {
+	case scramSha256:
+	case scramSha256Plus:
+		if channelBinding == nil {
+			return nil, errors.New("channel binding is not supported on this connection")
+		}
+	default:
+		return nil, fmt.Errorf("invalid mechanism: %s", mechanism)
+	}
+	return &scramConversation{credentials: credentials, channelBinding: channelBinding, plus: mechanism == scramSha256Plus}, nil
+}
+
+// First handles client-first-message and returns server-first-message
+func (s *scramConversation) First(clientFirst string) (string, error) {
+	fields := strings.SplitN(clientFirst, ",", 3)
+	if len(fields) != 3 {
+		return "", errors.New("malformed SCRAM message")
+	}
+	switch flag := fields[0]; {
+	case flag == "p=tls-server-end-point":
+		if !s.plus {
+			return "", errors.New("channel binding requested with a mechanism without channel binding")
+		}
+	case strings.HasPrefix(flag, "p="):
+		return "", fmt.Errorf("unsupported channel binding type %s", strings.TrimPrefix(flag, "p="))
+	case flag == "y":
+		// the client supports channel binding but thinks the server doesn't, although PLUS was offered
+		if s.channelBinding != nil {
+			return "", errors.New("channel binding is supported by the server")
+		}
+	case flag == "n":
+		if s.plus {
+			return "", errors.New("channel binding is required by the mechanism")
+		}
+	default:
+		return "", fmt.Errorf("invalid gs2 flag %s", flag)
+	}
+	if fields[1] != "" && !strings.HasPrefix(fields[1], "a=") {
+		return "", errors.New("malformed SCRAM message")
+	}
+	s.gs2Header = fields[0] + "," + fields[1] + ","
+	s.clientFirstBare = fields[2]
+	// the username of the message is ignored like postgresql, the user of the startup message is authenticated
+	var clientNonce string
+	for _, attr := range strings.Split(s.clientFirstBare, ",") {
+		if strings.HasPrefix(attr, "r=") {
+			clientNonce = strings.TrimPrefix(attr, "r=")
+		}
+	}
+	if clientNonce == "" {
+		return "", errors.New("malformed SCRAM message: missing nonce")
+	}
+	serverNonce := make([]byte, scramServerNonceLen)
+	if _, err := rand.Read(serverNonce); err != nil {
+		return "", err
+	}
+	s.nonce = clientNonce + base64.StdEncoding.EncodeToString(serverNonce)
+	s.serverFirst = fmt.Sprintf("r=%s,s=%s,i=%d", s.nonce,
+		base64.StdEncoding.EncodeToString([]byte(s.credentials.Salt)), s.credentials.Iters)
+	return s.serverFirst, nil
+}
+
+// Final verifies client-final-message and returns server-final-message
+func (s *scramConversation) Final(clientFinal string) (string, error) {
+	proofIndex := strings.LastIndex(clientFinal, ",p=")
+	if proofIndex < 0 {
+		return "", errors.New("malformed SCRAM message: missing proof")
+	}
+	withoutProof := clientFinal[:proofIndex]
+	proof, err := base64.StdEncoding.DecodeString(clientFinal[proofIndex+len(",p="):])
+	if err != nil {
+		return "", fmt.Errorf("malformed SCRAM proof: %w", err)
+	}
+	var binding, nonce string
+	for _, attr := range strings.Split(withoutProof, ",") {
+		switch {
+		case strings.HasPrefix(attr, "c="):
+			binding = strings.TrimPrefix(attr, "c=")
+		case strings.HasPrefix(attr, "r="):
+			nonce = strings.TrimPrefix(attr, "r=")
+		}
+	}
+	expected := []byte(s.gs2Header)
+	if s.plus {
+		expected = append(expected, s.channelBinding...)
+	}
+	if binding != base64.StdEncoding.EncodeToString(expected) {
+		return "", errors.New("SCRAM channel binding check failed")
+	}
+	if nonce != s.nonce {
+		return "", errors.New("SCRAM nonce does not match")
+	}
+	authMessage := []byte(s.clientFirstBare + "," + s.serverFirst + "," + withoutProof)
+	clientSignature := computeHMAC(s.credentials.StoredKey, authMessage)
+	if len(proof) != len(clientSignature) {
+		return "", errors.New("invalid SCRAM proof")
+	}
+	clientKey := make([]byte, len(proof))
+	subtle.XORBytes(clientKey, proof, clientSignature)
+	storedKey := sha256.Sum256(clientKey)
+	if !hmac.Equal(storedKey[:], s.credentials.StoredKey) {
+		return "", errors.New("invalid SCRAM proof")
+	}
+	return "v=" + base64.StdEncoding.EncodeToString(computeHMAC(s.credentials.ServerKey, authMessage)), nil
+}
@@ -0,0 +1,91 @@
+package duckserver
+
+import (
+	"context"
+	"database/sql/driver"
+	"io"
+	"strings"
+)
+
+// defaultSearchPath is the search_path reported until a client sets it, public is the main schema of DuckDB
+const defaultSearchPath = `"$user", public`
+
+// searchPathSchemas splits a postgresql search_path into schema names, unquoted names are folded to lower case
+func searchPathSchemas(value string) []string {
+	var schemas []string
+	var sb strings.Builder
+	quoted, inQuotes := false, false
+	flush := func() {
+		name := strings.Trim(strings.TrimSpace(sb.String()), "'")
+		if !quoted {
+			name = strings.ToLower(name)
+		}
+		if name != "" {
+			schemas = append(schemas, name)
+		}
+		sb.Reset()
+		quoted = false
+	}
+	for i := 0; i < len(value); i++ {
+		switch ch := value[i]; {
+		case ch == '"' && inQuotes && i+1 < len(value) && value[i+1] == '"':
+			sb.WriteByte('"')
+			i++
+		case ch == '"':
+			inQuotes = !inQuotes
+			quoted = true
+		case ch == ',' && !inQuotes:
+			flush()
+		default:
+			sb.WriteByte(ch)
+		}
+	}
+	flush()
+	return schemas
+}
+
+// setSearchPath sets the DuckDB search_path of the connection from a postgresql search_path, the schemas are
+// qualified with the database of the connection, $user and public resolve like postgresql and missing schemas
+// are skipped as postgresql does
+func (c *PgConn) setSearchPath(value string) error {
+	ctx := context.Background()
+	rows, err := c.conn.(driver.QueryerContext).QueryContext(ctx, "select schema_name from duckdb_schemas() where database_name = $1",
+		[]driver.NamedValue{{Ordinal: 1, Value: c.database}})
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]bool)
+	values := make([]driver.Value, 1)
+	for {
+		if err = rows.Next(values); err == io.EOF {
+			break
+		} else if err != nil {
+			_ = rows.Close()
+			return err
+		}
+		existing[values[0].(string)] = true
+	}
+	_ = rows.Close()
+	var entries []string
+	for _, schema := range searchPathSchemas(value) {
+		switch {
+		case schema == "$user":
+			schema = c.user
+		case schema == "public" && !existing["public"]:
+			schema = "main"
+		}
+		if existing[schema] {
+			entries = append(entries, quoteIdent(c.database)+"."+quoteIdent(schema))
+		}
+	}
+	_, err = c.conn.(driver.ExecerContext).ExecContext(ctx, "SET search_path = "+quoteLiteral(strings.Join(entries, ",")), nil)
+	return err
+}
+
+// resetSearchPath restores the default search_path when the client changed it, for RESET ALL and DISCARD ALL
+func (c *PgConn) resetSearchPath() error {
+	if c.params["search_path"] == c.defaultParams["search_path"] {
+		return nil
+	}
+	return c.setSearchPath(defaultSearchPath)
+}
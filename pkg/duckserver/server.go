@@ -0,0 +1,134 @@
+package duckserver
+
+import (
+	"context"
+	"database/sql"
+	"regexp"
+)
+
+const VERSION = "0.1.0"
+
+const (
+	ProtocolPostgres   = "postgres"
+	ProtocolClickhouse = "clickhouse"
+)
+
+// Hooks let an embedding program customize the server
+type Hooks struct {
+	// OnOpen is called after the database is opened and migrated, before accepting connections
+	OnOpen func(db *sql.DB) error
+	// OnQuery is called with each query received from the postgresql and clickhouse frontends,
+	// returning an error rejects the query
+	OnQuery func(ctx context.Context, protocol string, query string) error
+	// OnSchemaChange is called after a statement that may change the schema, e.g. to invalidate caches of the embedder
+	OnSchemaChange func(query string)
+}
+
+// ddlRegexp matches statements that may change the columns of tables and views
+var ddlRegexp = regexp.MustCompile(`(?i)^\s*(CREATE|ALTER|DROP|ATTACH|DETACH|IMPORT|USE|RENAME|EXCHANGE)\b`)
+
+// notifySchemaChange bumps the schema version after a DDL statement, so all sessions describe and prepare their
+// statements again instead of sending stale RowDescriptions
+func (s *PgServer) notifySchemaChange(query string) {
+	if !ddlRegexp.MatchString(query) {
+		return
+	}
+	s.schemaVersion.Add(1)
+	metrics.Add("duckserver_schema_changes_total", 1)
+	if s.hooks.OnSchemaChange != nil {
+		s.hooks.OnSchemaChange(query)
+	}
+}
+
+type contextKey int
+
+const (
+	userContextKey contextKey = iota
+	applicationContextKey
+	listenerStatementsContextKey
+)
+
+// withUser returns a context carrying the authenticated user of a query
+func withUser(ctx context.Context, user string) context.Context {
+	return context.WithValue(ctx, userContextKey, user)
+}
+
+// UserFromContext returns the user of a query, e.g. in the OnQuery hook
+func UserFromContext(ctx context.Context) string {
+	user, _ := ctx.Value(userContextKey).(string)
+	return user
+}
+
+// withApplication returns a context carrying the application of a query, the application_name of a postgresql
+// connection or the client_name or User-Agent of a clickhouse request
+func withApplication(ctx context.Context, application string) context.Context {
+	return context.WithValue(ctx, applicationContextKey, application)
+}
+
+// ApplicationFromContext returns the application of a query, e.g. in the OnQuery hook
+func ApplicationFromContext(ctx context.Context) string {
+	application, _ := ctx.Value(applicationContextKey).(string)
+	return application
+}
+
+// withListenerStatements returns a context carrying the statement classes the listener of a query allows
+func withListenerStatements(ctx context.Context, statements []string) context.Context {
+	if len(statements) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, listenerStatementsContextKey, statements)
+}
+
+// checkQuery checks a query against the statement classes of its listener, the statement rules of its user and the
+// OnQuery hook
+func (s *PgServer) checkQuery(ctx context.Context, protocol, query string) error {
+	statements, _ := ctx.Value(listenerStatementsContextKey).([]string)
+	if err := s.checkListenerStatements(statements, query); err != nil {
+		return err
+	}
+	if err := s.statementRules.Check(UserFromContext(ctx), query); err != nil {
+		return err
+	}
+	if err := s.remoteURLs.Check(query); err != nil {
+		return err
+	}
+	if s.hooks.OnQuery == nil {
+		return nil
+	}
+	return s.hooks.OnQuery(ctx, protocol, query)
+}
+
+// Server runs the postgresql and clickhouse frontends of a DuckDB database in process
+type Server struct {
+	options Options
+	pg      PgServer
+}
+
+func NewServer(options Options) *Server {
+	return &Server{options: options}
+}
+
+// Start opens the database and starts the listeners, it returns once the server accepts connections
+func (s *Server) Start() error {
+	return s.pg.Open(s.options)
+}
+
+// Wait blocks until a listener fails or the server is stopped
+func (s *Server) Wait() error {
+	return s.pg.Wait()
+}
+
+// Stop closes the listeners, the client connections and the database
+func (s *Server) Stop() error {
+	return s.pg.Stop()
+}
+
+// DB returns the database served, it's only valid after Start
+func (s *Server) DB() *sql.DB {
+	return s.pg.conn
+}
+
+// CreateUser creates a user for authentication of both frontends
+func (s *Server) CreateUser(user, password string) error {
+	return s.pg.CreateUser(user, password)
+}
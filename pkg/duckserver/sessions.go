@@ -0,0 +1,107 @@
+package duckserver
+
+import (
+	"context"
+	"encoding/binary"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// maxApplicationLength truncates the application names reported by clients, they label the metrics
+const maxApplicationLength = 64
+
+func truncateApplication(application string) string {
+	if len(application) > maxApplicationLength {
+		return application[:maxApplicationLength]
+	}
+	return application
+}
+
+// SessionInfo is a client session listed by /sessions
+type SessionInfo struct {
+	Protocol    string    `json:"protocol"`
+	ID          string    `json:"id"`
+	User        string    `json:"user"`
+	Database    string    `json:"database,omitempty"`
+	Application string    `json:"application"`
+	ClientAddr  string    `json:"client_addr,omitempty"`
+	Started     time.Time `json:"started,omitempty"`
+}
+
+// setApplication sets the application of the connection from application_name, read by other goroutines listing
+// the sessions
+func (c *PgConn) setApplication(application string) {
+	c.application.Store(truncateApplication(application))
+}
+
+func (c *PgConn) applicationName() string {
+	application, _ := c.application.Load().(string)
+	return application
+}
+
+// hookContext returns the context of the OnQuery hook for a query of the connection
+func (c *PgConn) hookContext() context.Context {
+	ctx := withApplication(withUser(context.Background(), c.user), c.applicationName())
+	return withListenerStatements(ctx, c.listener.options.Statements)
+}
+
+// sessionPID is the id of a postgresql connection listed by /sessions, the process id of its backend key data. The
+// secret key, which cancels the queries of the connection, is never listed
+func sessionPID(keyData [8]byte) string {
+	return strconv.FormatUint(uint64(binary.BigEndian.Uint32(keyData[:4])), 10)
+}
+
+// Sessions lists the postgresql connections and the clickhouse sessions with their user and application, the
+// sessions of user or all sessions without a user
+func (s *PgServer) Sessions(user string) []SessionInfo {
+	var sessions []SessionInfo
+	s.backends.Range(func(key, value any) bool {
+		c := value.(*PgConn)
+		if user != "" && c.user != user {
+			return true
+		}
+		sessions = append(sessions, SessionInfo{
+			Protocol:    ProtocolPostgres,
+			ID:          sessionPID(key.([8]byte)),
+			User:        c.user,
+			Database:    c.database,
+			Application: c.applicationName(),
+			ClientAddr:  c.wire.conn.RemoteAddr().String(),
+			Started:     c.started,
+		})
+		return true
+	})
+	for _, srv := range s.httpServers {
+		ch, ok := srv.Handler.(*ChServer)
+		if !ok {
+			continue
+		}
+		ch.sessions.Range(func(key, value any) bool {
+			session := value.(*chSession)
+			session.mu.Lock()
+			if user != "" && session.user != user {
+				session.mu.Unlock()
+				return true
+			}
+			info := SessionInfo{
+				Protocol:    ProtocolClickhouse,
+				ID:          key.(string),
+				User:        session.user,
+				Database:    session.database,
+				Application: session.application,
+				Started:     session.started,
+			}
+			expired := time.Now().After(session.expires)
+			session.mu.Unlock()
+			if !expired {
+				sessions = append(sessions, info)
+			}
+			return true
+		})
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Started.Before(sessions[j].Started)
+	})
+	return sessions
+}
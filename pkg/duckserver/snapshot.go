@@ -0,0 +1,105 @@
+package duckserver
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoryDbPath is the db_path of an in-memory database
+const memoryDbPath = ":memory:"
+
+func isMemoryDB(dbPath string) bool {
+	return dbPath == "" || dbPath == memoryDbPath
+}
+
+// snapshotter exports an in-memory database to dir every interval and on stop, the export is written to
+// dir.tmp and renamed over dir, so a crash during a snapshot leaves the previous one in place
+type snapshotter struct {
+	server   *PgServer
+	dir      string
+	interval time.Duration
+	mu       sync.Mutex
+}
+
+func newSnapshotter(server *PgServer, dir string, interval time.Duration) *snapshotter {
+	return &snapshotter{server: server, dir: dir, interval: interval}
+}
+
+func (s *snapshotter) Run() {
+	if s.interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.server.done:
+			return
+		case <-ticker.C:
+		}
+		if err := s.Snapshot(context.Background()); err != nil {
+			logrus.Warnf("snapshot error: %v", err)
+		}
+	}
+}
+
+// Snapshot exports the database to the snapshot directory
+func (s *snapshotter) Snapshot(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	start := time.Now()
+	tmp := s.dir + ".tmp"
+	old := s.dir + ".old"
+	if err := os.RemoveAll(tmp); err != nil {
+		return err
+	}
+	if _, err := s.server.conn.ExecContext(ctx, fmt.Sprintf("EXPORT DATABASE %s (FORMAT PARQUET)", quoteLiteral(tmp))); err != nil {
+		metrics.Add("duckserver_snapshot_errors_total", 1)
+		return err
+	}
+	if err := os.RemoveAll(old); err != nil {
+		return err
+	}
+	if err := os.Rename(s.dir, old); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Rename(tmp, s.dir); err != nil {
+		return err
+	}
+	_ = os.RemoveAll(old)
+	duration := time.Since(start)
+	metrics.Add("duckserver_snapshots_total", 1)
+	metrics.Set("duckserver_last_snapshot_duration_seconds", duration.Seconds())
+	metrics.Set("duckserver_last_snapshot_timestamp_seconds", float64(time.Now().Unix()))
+	logrus.Debugf("snapshot to %s finished in %s", s.dir, duration)
+	return nil
+}
+
+// restoreSnapshot imports the latest snapshot in dir, the previous one is used when a snapshot was interrupted
+// between its renames, a missing snapshot starts an empty database
+func restoreSnapshot(conn driver.Conn, dir string) error {
+	for _, candidate := range []string{dir, dir + ".old"} {
+		if _, err := os.Stat(filepath.Join(candidate, "schema.sql")); err != nil {
+			continue
+		}
+		start := time.Now()
+		if _, err := conn.(driver.ExecerContext).ExecContext(context.Background(), fmt.Sprintf("IMPORT DATABASE %s", quoteLiteral(candidate)), nil); err != nil {
+			return fmt.Errorf("restore snapshot %s: %w", candidate, err)
+		}
+		logrus.Infof("restored snapshot %s in %s", candidate, time.Since(start))
+		return nil
+	}
+	logrus.Infof("no snapshot in %s, starting with an empty database", dir)
+	return nil
+}
+
+func quoteLiteral(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
@@ -0,0 +1,27 @@
+package duckserver
+
+import (
+	"github.com/sirupsen/logrus"
+	"net"
+)
+
+// tuneSocket sets TCP_NODELAY and the send buffer of a postgresql connection. The wire batches the messages of a
+// response in its output buffer and writes them when it's full or the response is complete, so with TCP_NODELAY a
+// write is sent at once instead of waiting for the ack of the previous one
+func (s *PgServer) tuneSocket(conn net.Conn) {
+	if pc, ok := conn.(*proxyConn); ok {
+		conn = pc.Conn
+	}
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	if err := tcpConn.SetNoDelay(!s.tcpDelay); err != nil {
+		logrus.Warnf("set TCP_NODELAY: %v", err)
+	}
+	if s.socketSendBuffer > 0 {
+		if err := tcpConn.SetWriteBuffer(s.socketSendBuffer); err != nil {
+			logrus.Warnf("set socket send buffer: %v", err)
+		}
+	}
+}
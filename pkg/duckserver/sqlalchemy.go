@@ -0,0 +1,43 @@
+package duckserver
+
+import (
+	"regexp"
+)
+
+// pgCatalogVersionRegexp matches pg_catalog.version(), DuckDB doesn't find the version() macro of the connection
+// when it's qualified
+var pgCatalogVersionRegexp = regexp.MustCompile(`(?i)\bpg_catalog\.version\(\s*\)`)
+
+// identityOptionsRegexp matches the identity options subquery of the column reflection of sqlalchemy, DuckDB has
+// no identity columns nor the regclass type and json_build_object it uses
+var identityOptionsRegexp = regexp.MustCompile(`(?is)\(\s*SELECT\s+json_build_object\(\s*'always'.*?\)\s+AS\s+identity_options\b`)
+
+// hstoreOidsRegexp matches the pg_type of the hstore oids query of psycopg2, the pg_type of the hack has no
+// typnamespace and typarray
+var hstoreOidsRegexp = regexp.MustCompile(`(?is)\bFROM\s+pg_type\s+t\s+JOIN\s+pg_namespace\s+ns\b`)
+
+// pgCatalogOverrideRegexp matches the catalog objects of pg_catalog replaced by the duckserver schema, DuckDB
+// numbers the columns of constraints from 0, doesn't list the columns of indexes, sees every table and formats
+// types by their internal names
+var pgCatalogOverrideRegexp = regexp.MustCompile(`(?i)\bpg_catalog\.(pg_constraint|pg_index|pg_get_indexdef|pg_table_is_visible|format_type)\b`)
+
+// rewritePgCatalogVersion answers pg_catalog.version() with the version() of the connection
+func rewritePgCatalogVersion(query string) string {
+	return pgCatalogVersionRegexp.ReplaceAllLiteralString(query, "version()")
+}
+
+// rewriteIdentityOptions answers the identity options of sqlalchemy with NULL, no column is an identity
+func rewriteIdentityOptions(query string) string {
+	return identityOptionsRegexp.ReplaceAllLiteralString(query, "NULL AS identity_options")
+}
+
+// rewriteHstoreOids reads the hstore oids of psycopg2 from the pg_type of pg_catalog
+func rewriteHstoreOids(query string) string {
+	return hstoreOidsRegexp.ReplaceAllLiteralString(query, "FROM pg_catalog.pg_type t JOIN pg_catalog.pg_namespace ns")
+}
+
+// rewriteCatalogOverrides points the objects of pgCatalogOverrideRegexp to the duckserver schema of the main
+// database, which postgresql clients reflecting tables with pg_catalog read
+func (c *PgConn) rewriteCatalogOverrides(query string) string {
+	return pgCatalogOverrideRegexp.ReplaceAllString(query, quoteIdent(c.server.mainDatabase)+".duckserver.$1")
+}
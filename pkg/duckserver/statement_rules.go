@@ -0,0 +1,325 @@
+package duckserver
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultRole is the role of every user in duckserver.statement_rules
+const defaultRole = "*"
+
+// allStatementClasses is the statement_class of the rules of all classes
+const allStatementClasses = "all"
+
+// statementRulesTTL is the interval between reloads of duckserver.statement_rules and duckserver.user_roles, writes
+// to the tables reload them on the next query
+const statementRulesTTL = 10 * time.Second
+
+// statementClasses are the classes of the statements by their first keyword, other statements are "other"
+var statementClasses = map[string]string{
+	"select": "select", "from": "select", "values": "select", "table": "select", "show": "select",
+	"describe": "select", "desc": "select", "summarize": "select", "pivot": "select", "unpivot": "select",
+	"declare": "select", "fetch": "select", "move": "select", "close": "select", "exists": "select",
+	"insert": "insert", "upsert": "insert",
+	"update": "update", "merge": "update",
+	"delete": "delete", "truncate": "delete",
+	"create": "ddl", "alter": "ddl", "drop": "ddl", "comment": "ddl", "rename": "ddl", "exchange": "ddl",
+	"optimize": "ddl",
+	"copy":     "copy", "export": "copy", "import": "copy",
+	"load": "load", "install": "load", "force": "load",
+	"attach": "attach", "detach": "attach",
+	"set": "set", "reset": "set", "use": "set", "discard": "set",
+	"pragma": "pragma", "call": "pragma", "checkpoint": "pragma", "vacuum": "pragma", "analyze": "pragma",
+	"system": "pragma",
+	"begin":  "transaction", "start": "transaction", "commit": "transaction", "end": "transaction",
+	"rollback": "transaction", "abort": "transaction", "savepoint": "transaction", "release": "transaction",
+}
+
+// readOnlyStatementClasses are the statement classes allowed on a read_only listener
+var readOnlyStatementClasses = []string{"select", "set", "transaction"}
+
+// parseStatementClasses parses the comma separated statement classes of a listener
+func parseStatementClasses(value string) ([]string, error) {
+	var classes []string
+	for _, class := range strings.Split(value, ",") {
+		class = strings.ToLower(strings.TrimSpace(class))
+		if class == "" {
+			continue
+		}
+		known := class == "other"
+		for _, c := range statementClasses {
+			known = known || c == class
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown statement class %s", class)
+		}
+		classes = append(classes, class)
+	}
+	if len(classes) == 0 {
+		return nil, fmt.Errorf("no statement class")
+	}
+	return classes, nil
+}
+
+// checkListenerStatements returns an error if a statement of the query has a class the listener doesn't allow,
+// the listener allows all classes without statements. Class set allows the settings of the session, a setting of
+// the whole server also needs class pragma. remote() and remote urls, which make the server send requests to other
+// hosts, need class attach
+func (s *PgServer) checkListenerStatements(allowed []string, query string) error {
+	if len(allowed) == 0 {
+		return nil
+	}
+	if !slices.Contains(allowed, "attach") && (remoteRegexp.MatchString(query) || len(remoteURLs(query)) > 0) {
+		return &databaseError{SqlStateInsufficientPrivilege, "remote tables and urls are not allowed on this listener"}
+	}
+	for _, stmt := range splitStatements(query) {
+		class := classifyStatement(stmt)
+		if !slices.Contains(allowed, class) {
+			return &databaseError{SqlStateInsufficientPrivilege, fmt.Sprintf("%s statements are not allowed on this listener", class)}
+		}
+		if class == "set" && !slices.Contains(allowed, "pragma") {
+			if setting, global := s.globalSetting(stmt); global {
+				return &databaseError{SqlStateInsufficientPrivilege, fmt.Sprintf("global setting %s can't be changed on this listener", setting)}
+			}
+		}
+	}
+	return nil
+}
+
+// globalSetting reports whether a SET or RESET statement changes a setting of the whole server, with GLOBAL or a
+// DuckDB setting of global scope like memory_limit. The parameters of the postgresql sessions aren't DuckDB settings
+func (s *PgServer) globalSetting(stmt string) (string, bool) {
+	tokens := chTokenize(stmt)
+	if len(tokens) < 2 {
+		return "", false
+	}
+	if keyword := strings.ToLower(tokens[0].text); keyword != "set" && keyword != "reset" {
+		return "", false
+	}
+	name := strings.ToLower(tokens[1].text)
+	switch name {
+	case "global":
+		if len(tokens) < 3 {
+			return "", true
+		}
+		return strings.ToLower(strings.Trim(tokens[2].text, `"`)), true
+	case "session", "local":
+		if len(tokens) < 3 {
+			return "", false
+		}
+		name = strings.ToLower(tokens[2].text)
+	}
+	name = strings.Trim(name, `"`)
+	var scope string
+	err := s.conn.QueryRow("select scope from duckdb_settings() where name = $1", name).Scan(&scope)
+	if errors.Is(err, sql.ErrNoRows) {
+		return name, false
+	}
+	return name, err != nil || scope == "GLOBAL"
+}
+
+// classifyStatement returns the class of a statement: select, insert, update, delete, ddl, copy, load, attach, set,
+// pragma, transaction or other. The statement of WITH, EXPLAIN and PREPARE is classified by its main statement.
+func classifyStatement(stmt string) string {
+	tokens := chTokenize(stmt)
+	for i := 0; i < len(tokens); i++ {
+		keyword := strings.ToLower(tokens[i].text)
+		switch {
+		case strings.HasPrefix(keyword, "("):
+			// a parenthesized query or the options of EXPLAIN
+			if i == 0 {
+				return classifyStatement(keyword[1 : len(keyword)-1])
+			}
+			continue
+		case keyword == "with":
+			return classifyWith(stmt, tokens[i+1:])
+		case keyword == "explain" || keyword == "analyze" && i > 0:
+			continue
+		case keyword == "prepare":
+			// PREPARE name [(types)] AS statement
+			for i+1 < len(tokens) && !strings.EqualFold(tokens[i+1].text, "as") {
+				i++
+			}
+			i++
+			continue
+		}
+		if class, ok := statementClasses[keyword]; ok {
+			return class
+		}
+		return "other"
+	}
+	return "other"
+}
+
+// classifyWith classifies the statement after the common table expressions of the tokens after WITH:
+// [RECURSIVE] name [(columns)] [USING KEY (columns)] AS [NOT] [MATERIALIZED] (query), separated by commas. A query of
+// an expression which isn't a select gives its class, a list which doesn't parse is other
+func classifyWith(stmt string, tokens []chToken) string {
+	i := 0
+	if i < len(tokens) && strings.EqualFold(tokens[i].text, "recursive") {
+		i++
+	}
+	for {
+		if i >= len(tokens) || !isChIdentByte(tokens[i].text[0]) && tokens[i].text[0] != '"' && tokens[i].text[0] != '`' {
+			return "other"
+		}
+		i++
+		if i < len(tokens) && strings.HasPrefix(tokens[i].text, "(") {
+			i++
+		}
+		if i+2 < len(tokens) && strings.EqualFold(tokens[i].text, "using") && strings.EqualFold(tokens[i+1].text, "key") &&
+			strings.HasPrefix(tokens[i+2].text, "(") {
+			i += 3
+		}
+		if i >= len(tokens) || !strings.EqualFold(tokens[i].text, "as") {
+			return "other"
+		}
+		i++
+		if i < len(tokens) && strings.EqualFold(tokens[i].text, "not") {
+			i++
+		}
+		if i < len(tokens) && strings.EqualFold(tokens[i].text, "materialized") {
+			i++
+		}
+		if i >= len(tokens) || !strings.HasPrefix(tokens[i].text, "(") || !strings.HasSuffix(tokens[i].text, ")") {
+			return "other"
+		}
+		body := tokens[i].text
+		if class := classifyStatement(body[1 : len(body)-1]); class != "select" {
+			return class
+		}
+		i++
+		if i < len(tokens) && tokens[i].text == "," {
+			i++
+			continue
+		}
+		break
+	}
+	if i >= len(tokens) {
+		return "other"
+	}
+	return classifyStatement(stmt[tokens[i].start:])
+}
+
+// statementRules holds the roles of duckserver.user_roles and the statement classes duckserver.statement_rules
+// allows or denies to a role
+type statementRules struct {
+	db       *sql.DB
+	mu       sync.RWMutex
+	roles    map[string][]string
+	rules    map[string]map[string]bool
+	loadedAt time.Time
+	dirty    atomic.Bool
+}
+
+func newStatementRules(db *sql.DB) (*statementRules, error) {
+	r := &statementRules{db: db}
+	return r, r.Load()
+}
+
+// Load reads duckserver.user_roles and duckserver.statement_rules
+func (r *statementRules) Load() error {
+	roles := make(map[string][]string)
+	rows, err := r.db.Query("select username, role from duckserver.user_roles")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var user, role string
+		if err = rows.Scan(&user, &role); err != nil {
+			return err
+		}
+		roles[user] = append(roles[user], role)
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	rules := make(map[string]map[string]bool)
+	rows, err = r.db.Query("select role, lower(statement_class), lower(action) = 'allow' from duckserver.statement_rules")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var role, class string
+		var allow bool
+		if err = rows.Scan(&role, &class, &allow); err != nil {
+			return err
+		}
+		if rules[role] == nil {
+			rules[role] = make(map[string]bool)
+		}
+		rules[role][class] = allow
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.roles, r.rules, r.loadedAt = roles, rules, time.Now()
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *statementRules) reload() {
+	r.mu.RLock()
+	stale := time.Since(r.loadedAt) > statementRulesTTL
+	r.mu.RUnlock()
+	if !stale && !r.dirty.Load() {
+		return
+	}
+	r.dirty.Store(false)
+	if err := r.Load(); err != nil {
+		logrus.Warnf("load statement rules error: %v", err)
+	}
+}
+
+// allowed reports whether the roles of a user allow the class. The rules of the class come before the rules of
+// class "all", among them an allow of a role wins over a deny of another role, and classes without rules are allowed.
+func (r *statementRules) allowed(roles []string, class string) bool {
+	for _, c := range []string{class, allStatementClasses} {
+		decided, allow := false, false
+		for _, role := range roles {
+			if a, ok := r.rules[role][c]; ok {
+				decided = true
+				allow = allow || a
+			}
+		}
+		if decided {
+			return allow
+		}
+	}
+	return true
+}
+
+// Check returns an error if a statement of the query has a class the roles of user don't allow
+func (r *statementRules) Check(user, query string) error {
+	if r == nil {
+		return nil
+	}
+	r.reload()
+	lower := strings.ToLower(query)
+	// the write runs after the check, the next query reloads the rules
+	if isWriteQuery(query) && (strings.Contains(lower, "statement_rules") || strings.Contains(lower, "user_roles")) {
+		defer r.dirty.Store(true)
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if len(r.rules) == 0 {
+		return nil
+	}
+	roles := append([]string{defaultRole}, r.roles[user]...)
+	for _, stmt := range splitStatements(query) {
+		if class := classifyStatement(stmt); !r.allowed(roles, class) {
+			return &databaseError{SqlStateInsufficientPrivilege, fmt.Sprintf("%s statements are not allowed for user %s", class, user)}
+		}
+	}
+	return nil
+}
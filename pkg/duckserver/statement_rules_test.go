@@ -0,0 +1,145 @@
+package duckserver
+
+import (
+	"database/sql"
+	"testing"
+)
+
+func TestClassifyStatement(t *testing.T) {
+	tests := []struct {
+		stmt  string
+		class string
+	}{
+		{"select 1", "select"},
+		{"  /*+ timeout(10) */ SELECT 1", "select"},
+		{"-- comment\ndelete from t", "delete"},
+		{"/* select */ delete from t", "delete"},
+		{"(select 1) union (select 2)", "select"},
+		{"from t", "select"},
+		{"insert into t values (1)", "insert"},
+		{"update t set a = 1", "update"},
+		{"truncate t", "delete"},
+		{"create table t (a int)", "ddl"},
+		{"copy t to 'f.csv'", "copy"},
+		{"attach 'f.db' as f", "attach"},
+		{"set memory_limit = '1GB'", "set"},
+		{"pragma version", "pragma"},
+		{"begin", "transaction"},
+		{"explain select 1", "select"},
+		{"explain analyze delete from t", "delete"},
+		{"explain (format json) insert into t values (1)", "insert"},
+		{"prepare p as delete from t where a = $1", "delete"},
+		{"prepare p (int) as select $1", "select"},
+		{"frobnicate", "other"},
+		{"", "other"},
+
+		{"with a as (select 1) select * from a", "select"},
+		{"with a as (select 1) delete from t", "delete"},
+		{"with recursive a(n) as (select 1 union all select n + 1 from a) insert into t select n from a", "insert"},
+		{"with a as not materialized (select 1) update t set a = 1", "update"},
+		{"with a as materialized (select 1), b as (select 2) drop table t", "ddl"},
+		{"with a using key (k) as (select 1 as k) copy t to 'f.csv'", "copy"},
+		{`with "select" as (select 1) delete from t`, "delete"},
+		{"with a as (with b as (select 1) select * from b) delete from t", "delete"},
+		{"with a as (delete from t returning *) select * from a", "delete"},
+		{"explain with a as (select 1) delete from t", "delete"},
+		{"with a as (select 1)", "other"},
+		{"with a select 1", "other"},
+		{"with a as select 1 delete from t", "other"},
+	}
+	// CTE names which are statement keywords must not be read as the statement
+	for _, name := range []string{"close", "fetch", "move", "show", "select", "from", "values", "table", "describe",
+		"summarize", "pivot", "exists", "declare", "begin", "set"} {
+		tests = append(tests,
+			struct{ stmt, class string }{"with " + name + " as (select 1) delete from t", "delete"},
+			struct{ stmt, class string }{"WITH " + name + " AS (SELECT 1) INSERT INTO t SELECT * FROM " + name, "insert"},
+			struct{ stmt, class string }{"with " + name + "(x) as (select 1), b as (select 2) update t set a = 1", "update"},
+			struct{ stmt, class string }{"with " + name + " as (select 1) select * from " + name, "select"},
+		)
+	}
+	for _, test := range tests {
+		if class := classifyStatement(test.stmt); class != test.class {
+			t.Errorf("classifyStatement(%q) = %s, want %s", test.stmt, class, test.class)
+		}
+	}
+}
+
+func TestIsWriteQuery(t *testing.T) {
+	tests := []struct {
+		query string
+		write bool
+	}{
+		{"select 1", false},
+		{"select 1; delete from t", true},
+		{"with close as (select 1) delete from t", true},
+		{"with fetch as (select 1) select * from fetch", false},
+		{"/* delete */ select 1", false},
+	}
+	for _, test := range tests {
+		if write := isWriteQuery(test.query); write != test.write {
+			t.Errorf("isWriteQuery(%q) = %v, want %v", test.query, write, test.write)
+		}
+	}
+}
+
+func TestListenerStatementsReadOnly(t *testing.T) {
+	s := &PgServer{}
+	for _, query := range []string{
+		"delete from t",
+		"with close as (select 1) delete from t",
+		"with move as (select 1), show as (select 2) insert into t select 1",
+		"explain analyze with fetch as (select 1) update t set a = 1",
+		"select 1; drop table t",
+		"select * from remote('169.254.169.254:80', 'a', 'b')",
+		"with r as (select * from remote('node1', t)) select * from r",
+		"select * from read_parquet('https://data.example.com/a.parquet')",
+	} {
+		if err := s.checkListenerStatements(readOnlyStatementClasses, query); err == nil {
+			t.Errorf("checkListenerStatements(%q) allowed on a read only listener", query)
+		}
+	}
+	for _, query := range []string{"select 1", "with close as (select 1) select * from close", "begin; select 1; commit"} {
+		if err := s.checkListenerStatements(readOnlyStatementClasses, query); err != nil {
+			t.Errorf("checkListenerStatements(%q): %v", query, err)
+		}
+	}
+	if err := s.checkListenerStatements([]string{"select", "attach"}, "select * from remote('node1', t)"); err != nil {
+		t.Errorf("remote() not allowed with class attach: %v", err)
+	}
+}
+
+func TestGlobalSetting(t *testing.T) {
+	db, err := sql.Open("duckdb", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	s := &PgServer{conn: db}
+	tests := []struct {
+		stmt    string
+		setting string
+		global  bool
+	}{
+		{"set memory_limit = '1GB'", "memory_limit", true},
+		{"SET Threads TO 4", "threads", true},
+		{`set "memory_limit" = '1GB'`, "memory_limit", true},
+		{"set session memory_limit = '1GB'", "memory_limit", true},
+		{"set local threads = 1", "threads", true},
+		{"reset memory_limit", "memory_limit", true},
+		{"set global search_path = 'x'", "search_path", true},
+		{"set global", "", true},
+		{"set search_path = 'x'", "search_path", false},
+		{"set session search_path = 'x'", "search_path", false},
+		{"set application_name = 'psql'", "application_name", false},
+		{"set datestyle to iso", "datestyle", false},
+		{"reset all", "all", false},
+		{"set session", "", false},
+		{"set", "", false},
+		{"select 1", "", false},
+	}
+	for _, test := range tests {
+		if setting, global := s.globalSetting(test.stmt); setting != test.setting || global != test.global {
+			t.Errorf("globalSetting(%q) = %s, %v, want %s, %v", test.stmt, setting, global, test.setting, test.global)
+		}
+	}
+}
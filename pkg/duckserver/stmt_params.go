@@ -0,0 +1,97 @@
+package duckserver
+
+/*
+#include <stdint.h>
+#include <stdlib.h>
+
+// functions of the DuckDB C API, linked by go-duckdb
+int32_t duckdb_param_type(void *prepared_statement, uint64_t param_idx);
+void *duckdb_column_logical_type(void *result, uint64_t col);
+char *duckdb_logical_type_get_alias(void *type);
+void duckdb_destroy_logical_type(void **type);
+void duckdb_free(void *ptr);
+*/
+import "C"
+
+import (
+	"database/sql/driver"
+	"reflect"
+	"unsafe"
+)
+
+// duckdbParamTypeOids maps the duckdb_type of a parameter to the postgresql type oid, unknown types are sent as 0
+// so the client decides
+var duckdbParamTypeOids = map[int32]int32{
+	1:  16,   // BOOLEAN -> bool
+	2:  21,   // TINYINT -> int2
+	3:  21,   // SMALLINT -> int2
+	4:  23,   // INTEGER -> int4
+	5:  20,   // BIGINT -> int8
+	6:  21,   // UTINYINT -> int2
+	7:  23,   // USMALLINT -> int4
+	8:  20,   // UINTEGER -> int8
+	9:  1700, // UBIGINT -> numeric
+	10: 700,  // FLOAT -> float4
+	11: 701,  // DOUBLE -> float8
+	12: 1114, // TIMESTAMP -> timestamp
+	13: 1082, // DATE -> date
+	14: 1083, // TIME -> time
+	15: 1186, // INTERVAL -> interval
+	16: 1700, // HUGEINT -> numeric
+	17: 25,   // VARCHAR -> text
+	18: 17,   // BLOB -> bytea
+	19: 1700, // DECIMAL -> numeric
+	20: 1114, // TIMESTAMP_S -> timestamp
+	21: 1114, // TIMESTAMP_MS -> timestamp
+	22: 1114, // TIMESTAMP_NS -> timestamp
+	24: 1009, // LIST -> text[], the element type isn't exposed by the C API
+	27: 2950, // UUID -> uuid
+	30: 1266, // TIME_TZ -> timetz
+	31: 1184, // TIMESTAMP_TZ -> timestamptz
+	32: 1700, // UHUGEINT -> numeric
+}
+
+// stmtParamOids returns the postgresql type oids of the parameters DuckDB inferred for a prepared statement.
+// go-duckdb doesn't expose the parameter types, so the C handle is read from its statement
+func stmtParamOids(stmt driver.Stmt) []int32 {
+	oids := make([]int32, stmt.NumInput())
+	v := reflect.ValueOf(stmt)
+	if v.Kind() != reflect.Pointer || v.Elem().Kind() != reflect.Struct {
+		return oids
+	}
+	handle := v.Elem().FieldByName("stmt")
+	if !handle.IsValid() || handle.Kind() != reflect.Pointer || handle.IsNil() {
+		return oids
+	}
+	prepared := *(*unsafe.Pointer)(handle.UnsafePointer())
+	for i := range oids {
+		oids[i] = duckdbParamTypeOids[int32(C.duckdb_param_type(prepared, C.uint64_t(i+1)))]
+	}
+	return oids
+}
+
+// rowsTypeAliases returns the type alias of each column of a result, e.g. JSON, empty for columns without alias.
+// go-duckdb reports an aliased column by its physical type, so the C result is read from its rows
+func rowsTypeAliases(rows driver.Rows) []string {
+	aliases := make([]string, len(rows.Columns()))
+	v := reflect.ValueOf(rows)
+	if v.Kind() != reflect.Pointer || v.Elem().Kind() != reflect.Struct {
+		return aliases
+	}
+	res := v.Elem().FieldByName("res")
+	if !res.IsValid() || !res.CanAddr() {
+		return aliases
+	}
+	// the result is copied to C memory, cgo rejects a pointer into the rows struct holding Go pointers
+	result := C.CBytes(unsafe.Slice((*byte)(unsafe.Pointer(res.UnsafeAddr())), res.Type().Size()))
+	defer C.free(result)
+	for i := range aliases {
+		logicalType := C.duckdb_column_logical_type(result, C.uint64_t(i))
+		if alias := C.duckdb_logical_type_get_alias(logicalType); alias != nil {
+			aliases[i] = C.GoString(alias)
+			C.duckdb_free(unsafe.Pointer(alias))
+		}
+		C.duckdb_destroy_logical_type(&logicalType)
+	}
+	return aliases
+}
@@ -0,0 +1,122 @@
+package duckserver
+
+import (
+	"database/sql"
+	"github.com/sirupsen/logrus"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// storageUsageInterval is the interval between the disk usage metrics of the temp and scratch directories
+const storageUsageInterval = 15 * time.Second
+
+// scratchFilePrefix prefixes the scratch files and directories of the server, the scratch directory may be shared
+const scratchFilePrefix = "duckserver-"
+
+// openScratchDir returns the directory of the scratch files of the server, the result spools, cursors, exports,
+// result cache and downloads, created when missing. Empty is the temporary directory of the system
+func openScratchDir(dir string) (string, error) {
+	if dir == "" {
+		return os.TempDir(), nil
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// setTempDirectory points the files DuckDB spills the operators larger than memory to at dir, at most maxSize of them
+// like 100GB, empty keeps the defaults of DuckDB
+func setTempDirectory(db *sql.DB, dir, maxSize string) error {
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+		if _, err := db.Exec("SET temp_directory = " + quoteLiteral(dir)); err != nil {
+			return err
+		}
+	}
+	if maxSize != "" {
+		if _, err := db.Exec("SET max_temp_directory_size = " + quoteLiteral(maxSize)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// storageUsage reports the size and the free space of the DuckDB temp directory and of the scratch directory
+type storageUsage struct {
+	db         *sql.DB
+	scratchDir string
+}
+
+func newStorageUsage(db *sql.DB, scratchDir string) *storageUsage {
+	return &storageUsage{db: db, scratchDir: scratchDir}
+}
+
+func (u *storageUsage) Run(done <-chan struct{}) {
+	for {
+		u.check()
+		select {
+		case <-done:
+			return
+		case <-time.After(storageUsageInterval):
+		}
+	}
+}
+
+func (u *storageUsage) check() {
+	// duckdb_temporary_files() fails on a spill file removed while it is listed, the directory is walked instead
+	var tempDir string
+	if err := u.db.QueryRow("select current_setting('temp_directory')").Scan(&tempDir); err != nil {
+		logrus.Warnf("temp directory usage: %v", err)
+	} else if tempDir != "" {
+		metrics.Set("duckserver_temp_directory_bytes", float64(dirBytes(tempDir, "")))
+		if free, err := diskFreeBytes(existingParent(tempDir)); err == nil {
+			metrics.Set("duckserver_temp_directory_free_bytes", float64(free))
+		}
+	}
+	metrics.Set("duckserver_scratch_bytes", float64(dirBytes(u.scratchDir, scratchFilePrefix)))
+	if free, err := diskFreeBytes(u.scratchDir); err == nil {
+		metrics.Set("duckserver_scratch_free_bytes", float64(free))
+	}
+}
+
+// existingParent returns dir or its closest existing parent, DuckDB creates the temp directory on the first spill
+func existingParent(dir string) string {
+	dir, _ = filepath.Abs(dir)
+	for {
+		if _, err := os.Stat(dir); err == nil || filepath.Dir(dir) == dir {
+			return dir
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// dirBytes is the size of the files in dir and its subdirectories whose name in dir starts with prefix, files removed
+// while it is counted are skipped
+func dirBytes(dir, prefix string) int64 {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0
+	}
+	var size int64
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), prefix) {
+			continue
+		}
+		_ = filepath.WalkDir(filepath.Join(dir, entry.Name()), func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return nil
+			}
+			if info, err := d.Info(); err == nil {
+				size += info.Size()
+			}
+			return nil
+		})
+	}
+	return size
+}
@@ -0,0 +1,196 @@
+package duckserver
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/marcboeker/go-duckdb"
+	"github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// storageHeaderSize is the size of the main header of a DuckDB file, after the 8 byte checksum come the DUCK magic,
+// the storage version, 4 flags and, since v0.10, the version and commit of the DuckDB that created the file
+const storageHeaderSize = 8 + 4 + 8 + 4*8 + 32 + 32
+
+// storageVersions are the DuckDB releases writing each storage version
+var storageVersions = map[uint64]string{
+	64: "v0.9.0 to v1.1",
+	51: "v0.8.0 or v0.8.1",
+	43: "v0.7.0 or v0.7.1",
+	39: "v0.6.0 or v0.6.1",
+	38: "v0.5.0 or v0.5.1",
+	33: "v0.3.3 to v0.4.0",
+	31: "v0.3.2",
+	27: "v0.3.1",
+	25: "v0.3.0",
+	21: "v0.2.9",
+	18: "v0.2.8",
+	17: "v0.2.7",
+	15: "v0.2.6",
+	13: "v0.2.5",
+	11: "v0.2.4",
+	6:  "v0.2.3",
+	4:  "v0.2.2",
+	1:  "v0.2.1 or earlier",
+}
+
+// storageHeader is the storage version of a DuckDB file and the version of the DuckDB that created it
+type storageHeader struct {
+	version        uint64
+	libraryVersion string
+}
+
+// String describes the DuckDB that wrote the file
+func (h storageHeader) String() string {
+	release := h.libraryVersion
+	if release == "" {
+		if release = storageVersions[h.version]; release == "" {
+			release = "an unknown version"
+		}
+	}
+	return fmt.Sprintf("DuckDB %s (storage version %d)", release, h.version)
+}
+
+// readStorageHeader reads the header of a DuckDB file, ok is false if the file doesn't exist or isn't a DuckDB file
+func readStorageHeader(path string) (header storageHeader, ok bool, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return header, false, nil
+		}
+		return header, false, err
+	}
+	defer f.Close()
+	buf := make([]byte, storageHeaderSize)
+	if _, err = io.ReadFull(f, buf); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return header, false, nil
+		}
+		return header, false, err
+	}
+	if string(buf[8:12]) != "DUCK" {
+		return header, false, nil
+	}
+	header.version = binary.LittleEndian.Uint64(buf[12:20])
+	desc := buf[52 : 52+32]
+	header.libraryVersion = string(bytes.TrimRight(desc, "\x00"))
+	return header, true, nil
+}
+
+// linkedStorageHeader returns the header written by the linked DuckDB, read from a new database file
+func linkedStorageHeader() (storageHeader, error) {
+	dir, err := os.MkdirTemp("", "duckserver-storage-*")
+	if err != nil {
+		return storageHeader{}, err
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "probe.db")
+	connector, err := duckdb.NewConnector(path, nil)
+	if err != nil {
+		return storageHeader{}, err
+	}
+	if err = connector.Close(); err != nil {
+		return storageHeader{}, err
+	}
+	header, ok, err := readStorageHeader(path)
+	if err == nil && !ok {
+		err = fmt.Errorf("probe database %s has no DuckDB header", path)
+	}
+	return header, err
+}
+
+// checkStorageVersion checks that the linked DuckDB can read the database file at path before opening it, so a file
+// written by another DuckDB version fails with a message telling how to migrate it, or is upgraded with autoUpgrade
+func checkStorageVersion(path string, autoUpgrade bool, cli string) error {
+	header, ok, err := readStorageHeader(path)
+	if err != nil || !ok {
+		return err
+	}
+	linked, err := linkedStorageHeader()
+	if err != nil {
+		return fmt.Errorf("check storage version: %w", err)
+	}
+	if header.version == linked.version {
+		if header.libraryVersion != "" && header.libraryVersion != linked.libraryVersion {
+			logrus.Infof("database %s was created by DuckDB %s, opening with DuckDB %s", path, header.libraryVersion, linked.libraryVersion)
+		}
+		return nil
+	}
+	if !autoUpgrade {
+		hint := fmt.Sprintf("migrate it with --auto_upgrade and --duckdb_cli set to the cli of %s", header)
+		if header.version > linked.version {
+			hint = "run a duck_server build linking a DuckDB reading it, or " + hint
+		}
+		return fmt.Errorf("database %s was written by %s, this server links %s which can't read it, %s",
+			path, header, linked, hint)
+	}
+	return upgradeDatabase(path, header, cli)
+}
+
+// upgradeDatabase exports the database at path with the DuckDB cli of its version and imports it into a new file,
+// which replaces it once complete. The old file and its WAL are kept with the storage version as suffix.
+func upgradeDatabase(path string, header storageHeader, cli string) error {
+	start := time.Now()
+	dir := path + ".upgrade"
+	tmp := path + ".upgrade.db"
+	for _, p := range []string{dir, tmp, tmp + ".wal"} {
+		if err := os.RemoveAll(p); err != nil {
+			return err
+		}
+	}
+	defer os.RemoveAll(dir)
+	logrus.Infof("upgrading database %s written by %s, exporting with %s", path, header, cli)
+	cmd := exec.Command(cli, path)
+	cmd.Stdin = strings.NewReader(fmt.Sprintf("EXPORT DATABASE %s (FORMAT PARQUET);\n", quoteLiteral(dir)))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("export %s with %s: %w: %s", path, cli, err, strings.TrimSpace(string(out)))
+	}
+	if _, err := os.Stat(filepath.Join(dir, "schema.sql")); err != nil {
+		return fmt.Errorf("export %s with %s: %w", path, cli, err)
+	}
+	if err := importDatabase(tmp, dir); err != nil {
+		_ = os.Remove(tmp)
+		_ = os.Remove(tmp + ".wal")
+		return fmt.Errorf("import the export of %s: %w", path, err)
+	}
+	backup := fmt.Sprintf("%s.v%d", path, header.version)
+	for _, suffix := range []string{"", ".wal"} {
+		if err := os.Rename(path+suffix, backup+suffix); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	logrus.Infof("upgraded database %s in %s, the old file is kept as %s", path, time.Since(start), backup)
+	return nil
+}
+
+// importDatabase imports an EXPORT DATABASE directory into a new database file
+func importDatabase(path, dir string) error {
+	connector, err := duckdb.NewConnector(path, nil)
+	if err != nil {
+		return err
+	}
+	db := sql.OpenDB(connector)
+	// IMPORT DATABASE fails on the empty schema of an empty database
+	schema, err := os.ReadFile(filepath.Join(dir, "schema.sql"))
+	if err == nil && len(bytes.TrimSpace(schema)) > 0 {
+		_, err = db.Exec(fmt.Sprintf("IMPORT DATABASE %s", quoteLiteral(dir)))
+	}
+	if err == nil {
+		_, err = db.Exec("CHECKPOINT")
+	}
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
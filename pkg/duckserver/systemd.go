@@ -0,0 +1,50 @@
+package duckserver
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// listenFdsStart is the first file descriptor passed by systemd socket activation
+const listenFdsStart = 3
+
+var systemdOnce sync.Once
+var systemdFiles []*os.File
+var systemdNames []string
+
+func loadSystemdFiles() {
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	for i := 0; i < count; i++ {
+		name := strconv.Itoa(i)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		systemdFiles = append(systemdFiles, os.NewFile(uintptr(listenFdsStart+i), name))
+		systemdNames = append(systemdNames, name)
+	}
+	_ = os.Unsetenv("LISTEN_PID")
+	_ = os.Unsetenv("LISTEN_FDS")
+	_ = os.Unsetenv("LISTEN_FDNAMES")
+}
+
+// systemdListener returns the socket passed by systemd socket activation, by FileDescriptorName or index
+func systemdListener(name string) (net.Listener, error) {
+	systemdOnce.Do(loadSystemdFiles)
+	for i, f := range systemdFiles {
+		if systemdNames[i] == name || strconv.Itoa(i) == name {
+			return net.FileListener(f)
+		}
+	}
+	return nil, fmt.Errorf("systemd socket %s not found", name)
+}
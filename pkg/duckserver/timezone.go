@@ -0,0 +1,102 @@
+package duckserver
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SqlStateInvalidParameterValue is the SQLSTATE of a SET with an invalid value
+const SqlStateInvalidParameterValue = "22023"
+
+var setTimeZoneRegexp = regexp.MustCompile(`(?is)^\s*SET\s+(?:SESSION\s+)?TIME\s+ZONE\s+(.*?)\s*;?\s*$`)
+
+// parseSetTimeZone parses SET TIME ZONE, LOCAL and DEFAULT reset the time zone like RESET TimeZone
+func parseSetTimeZone(query string) *setCommand {
+	m := setTimeZoneRegexp.FindStringSubmatch(query)
+	if m == nil {
+		return nil
+	}
+	value := m[1]
+	if strings.EqualFold(value, "local") || strings.EqualFold(value, "default") {
+		return &setCommand{name: "timezone", reset: true}
+	}
+	if len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'' {
+		value = strings.ReplaceAll(value[1:len(value)-1], "''", "'")
+	}
+	return &setCommand{name: "timezone", value: value}
+}
+
+// loadTimeZone loads a time zone by its name, or a number of hours east of UTC like postgresql
+func loadTimeZone(name string) (*time.Location, error) {
+	if hours, err := strconv.ParseFloat(name, 64); err == nil {
+		return time.FixedZone(name, int(hours*3600)), nil
+	}
+	if strings.EqualFold(name, "utc") || strings.EqualFold(name, "gmt") {
+		return time.UTC, nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil || name == "" || strings.EqualFold(name, "local") {
+		return nil, &databaseError{SqlStateInvalidParameterValue, fmt.Sprintf("invalid value for parameter \"TimeZone\": \"%s\"", name)}
+	}
+	return loc, nil
+}
+
+// setTimeZone sets the time zone of the session, TIMESTAMPTZ values are rendered in it and DuckDB gets it when
+// it has the TimeZone setting of ICU. It returns the value reported for TimeZone
+func (c *PgConn) setTimeZone(cmd *setCommand) (string, error) {
+	value := cmd.value
+	if cmd.reset || strings.EqualFold(value, "default") {
+		var ok bool
+		if value, ok = c.defaultParams["TimeZone"]; !ok {
+			value = "UTC"
+		}
+	}
+	loc, err := loadTimeZone(value)
+	if err != nil {
+		return "", err
+	}
+	if c.server.duckdbTimeZone {
+		stmt := "SET TimeZone = " + quoteLiteral(loc.String())
+		if _, err := c.conn.(driver.ExecerContext).ExecContext(context.Background(), stmt, nil); err != nil {
+			return "", err
+		}
+	}
+	c.location = loc
+	if cmd.reset {
+		c.location = nil
+	}
+	return value, nil
+}
+
+// timestampTZColumns marks the TIMESTAMPTZ columns of a result when the session set a time zone
+func (c *PgConn) timestampTZColumns(rows driver.Rows) []bool {
+	typed, ok := rows.(driver.RowsColumnTypeDatabaseTypeName)
+	if c.location == nil || !ok {
+		return nil
+	}
+	columns := make([]bool, len(rows.Columns()))
+	for i := range columns {
+		columns[i] = typed.ColumnTypeDatabaseTypeName(i) == "TIMESTAMPTZ"
+	}
+	return columns
+}
+
+// formatTimestampTZ formats a timestamp with its offset like postgresql, e.g. 2024-01-01 07:00:00-05
+func formatTimestampTZ(t time.Time) string {
+	s := t.Format("2006-01-02 15:04:05.999999")
+	_, offset := t.Zone()
+	sign := byte('+')
+	if offset < 0 {
+		sign, offset = '-', -offset
+	}
+	s += fmt.Sprintf("%c%02d", sign, offset/3600)
+	if offset%3600 != 0 {
+		s += fmt.Sprintf(":%02d", offset%3600/60)
+	}
+	return s
+}
@@ -0,0 +1,139 @@
+package duckserver
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io"
+	"strings"
+	"time"
+)
+
+// newRowsName is the name of the inserted rows in the statement of a trigger
+const newRowsName = "new_rows"
+
+// insertTrigger is a statement of duckserver.triggers run after each batch of rows inserted into its table by COPY,
+// INSERT ... FORMAT or an async insert flush, in the transaction of the batch, like a materialized view of
+// clickhouse. new_rows in the statement is the batch, it has the inserted columns.
+type insertTrigger struct {
+	name      string
+	statement string
+}
+
+// queryInsertTriggers returns the enabled triggers of a table in the order of their names
+func queryInsertTriggers(ctx context.Context, conn driver.Conn, schema, table string) ([]insertTrigger, error) {
+	rows, err := conn.(driver.QueryerContext).QueryContext(ctx, "select name, statement from duckserver.triggers where coalesce(schema_name, 'main') = $1 and table_name = $2 and coalesce(enabled, true) order by name", []driver.NamedValue{
+		{Ordinal: 1, Value: schema},
+		{Ordinal: 2, Value: table},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var triggers []insertTrigger
+	values := make([]driver.Value, 2)
+	for {
+		if err = rows.Next(values); err == io.EOF {
+			return triggers, nil
+		} else if err != nil {
+			return nil, err
+		}
+		triggers = append(triggers, insertTrigger{name: values[0].(string), statement: values[1].(string)})
+	}
+}
+
+// runInsertTriggers runs the triggers on the rows of a staging table of duckserver schema, an error of a trigger fails
+// the insert
+func runInsertTriggers(ctx context.Context, execer driver.ExecerContext, triggers []insertTrigger, staging string) error {
+	for _, t := range triggers {
+		start := time.Now()
+		if _, err := execer.ExecContext(ctx, bindNewRows(t.statement, "duckserver."+quoteIdent(staging)), nil); err != nil {
+			metrics.Add("duckserver_trigger_errors_total", 1)
+			return fmt.Errorf("trigger %s: %w", t.name, err)
+		}
+		metrics.Add("duckserver_trigger_runs_total", 1)
+		logrus.Debugf("trigger %s finished in %s", t.name, time.Since(start))
+	}
+	return nil
+}
+
+// bindNewRows replaces new_rows outside of quotes with table, also in subqueries
+func bindNewRows(statement, table string) string {
+	var sb strings.Builder
+	last := 0
+	for _, t := range chTokenize(statement) {
+		var replacement string
+		switch {
+		case strings.EqualFold(t.text, newRowsName):
+			replacement = table
+		case strings.HasPrefix(t.text, "(") && strings.HasSuffix(t.text, ")"):
+			replacement = "(" + bindNewRows(t.text[1:len(t.text)-1], table) + ")"
+		default:
+			continue
+		}
+		sb.WriteString(statement[last:t.start])
+		sb.WriteString(replacement)
+		last = t.end
+	}
+	sb.WriteString(statement[last:])
+	return sb.String()
+}
+
+// appendWithTriggers appends the rows written by fill to a staging table of schema.table, then inserts them into the
+// table and runs the triggers in a transaction, conn is already in a transaction when inTx
+func appendWithTriggers(ctx context.Context, conn driver.Conn, inTx bool, schema, table string, triggers []insertTrigger, fill func(appender rowAppender) error) error {
+	execer := conn.(driver.ExecerContext)
+	return inTransaction(ctx, execer, inTx, func() error {
+		columns, _, err := queryTableColumnTypes(ctx, conn, schema, table)
+		if err != nil {
+			return err
+		}
+		staging, err := createStagingTable(ctx, execer, "insert_staging_", schema, table, columns)
+		if err != nil {
+			return err
+		}
+		if err = appendRowsWith(ctx, conn, "duckserver", staging, fill); err != nil {
+			return err
+		}
+		if _, err = execer.ExecContext(ctx, fmt.Sprintf("insert into %s.%s select * from duckserver.%s",
+			quoteIdent(schema), quoteIdent(table), quoteIdent(staging)), nil); err != nil {
+			return err
+		}
+		if err = runInsertTriggers(ctx, execer, triggers, staging); err != nil {
+			return err
+		}
+		_, err = execer.ExecContext(ctx, "drop table duckserver."+quoteIdent(staging), nil)
+		return err
+	})
+}
+
+// appendRowsWith appends the rows written by fill to schema.table, the rows appended before fill fails are flushed
+// too and rolled back with the transaction of the caller
+func appendRowsWith(ctx context.Context, conn driver.Conn, schema, table string, fill func(appender rowAppender) error) error {
+	appender, err := newRowAppender(ctx, conn, schema, table)
+	if err != nil {
+		return err
+	}
+	err = fill(appender)
+	if closeErr := appender.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// inTransaction runs fn in a transaction rolled back when it fails, conn is already in a transaction when inTx
+func inTransaction(ctx context.Context, execer driver.ExecerContext, inTx bool, fn func() error) error {
+	if inTx {
+		return fn()
+	}
+	if _, err := execer.ExecContext(ctx, "BEGIN TRANSACTION", nil); err != nil {
+		return err
+	}
+	if err := fn(); err != nil {
+		_, _ = execer.ExecContext(context.Background(), "ROLLBACK", nil)
+		return err
+	}
+	_, err := execer.ExecContext(ctx, "COMMIT", nil)
+	return err
+}
@@ -0,0 +1,126 @@
+package duckserver
+
+import (
+	"context"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"regexp"
+	"time"
+)
+
+// chTTLRegexp matches the TTL of a clickhouse table which deletes the rows some time after a column,
+// e.g. ts + INTERVAL 30 DAY or toDateTime(ts) + toIntervalDay(30)
+var chTTLRegexp = regexp.MustCompile(`(?is)^(?:toDateTime\(\s*)?(` + chIdentPattern + `)\s*\)?\s*\+\s*(?:INTERVAL\s+(\d+)\s+(\w+?)S?|toInterval(\w+?)s?\(\s*(\d+)\s*\))(?:\s+DELETE)?$`)
+
+// ttlPolicy is a row of duckserver.ttl_policies, the rows of the table whose time column is before cutoff are expired
+type ttlPolicy struct {
+	schema     string
+	table      string
+	timeColumn string
+	cutoff     time.Time
+}
+
+// ttlJob deletes the expired rows of the tables of duckserver.ttl_policies every interval and checkpoints the
+// database after deleting rows, like the TTL of clickhouse tables
+type ttlJob struct {
+	server   *PgServer
+	interval time.Duration
+}
+
+func newTTLJob(server *PgServer, interval time.Duration) *ttlJob {
+	return &ttlJob{server: server, interval: interval}
+}
+
+func (j *ttlJob) Run() {
+	if j.interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-j.server.done:
+			return
+		case <-ticker.C:
+		}
+		if _, err := j.Expire(context.Background()); err != nil {
+			logrus.Warnf("ttl error: %v", err)
+		}
+	}
+}
+
+// Expire deletes the expired rows of all policies and returns the number of deleted rows
+func (j *ttlJob) Expire(ctx context.Context) (int64, error) {
+	policies, err := j.policies(ctx)
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, p := range policies {
+		start := time.Now()
+		deleted, err := j.expire(ctx, p)
+		if err != nil {
+			// a dropped table or column doesn't stop the other policies
+			metrics.Add("duckserver_ttl_errors_total", 1)
+			logrus.Warnf("ttl of %s.%s error: %v", p.schema, p.table, err)
+			continue
+		}
+		if deleted > 0 {
+			logrus.Infof("ttl deleted %d rows of %s.%s older than %s in %s", deleted, p.schema, p.table, p.cutoff.Format(time.RFC3339), time.Since(start))
+		}
+		total += deleted
+	}
+	metrics.Add("duckserver_ttl_deleted_rows_total", float64(total))
+	if total > 0 {
+		if err = j.server.checkpointer.Checkpoint(ctx); err != nil {
+			return total, fmt.Errorf("checkpoint after ttl: %w", err)
+		}
+	}
+	return total, nil
+}
+
+// expire deletes the expired rows of a policy, the expired partitions of a partitioned table are dropped whole
+func (j *ttlJob) expire(ctx context.Context, p ttlPolicy) (int64, error) {
+	if partitioned := j.server.partitions.Get(p.schema, p.table); partitioned != nil {
+		return j.server.expirePartitions(ctx, partitioned, p.cutoff)
+	}
+	result, err := j.server.conn.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s.%s WHERE %s < CAST($1 AS TIMESTAMP)",
+		quoteIdent(p.schema), quoteIdent(p.table), quoteIdent(p.timeColumn)), p.cutoff.Format("2006-01-02 15:04:05.999999"))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// policies reads duckserver.ttl_policies with the cutoff of each table
+func (j *ttlJob) policies(ctx context.Context) ([]ttlPolicy, error) {
+	rows, err := j.server.conn.QueryContext(ctx, `select coalesce(schema_name, 'main'), table_name, time_column, cast($1 as timestamp) - retention
+from duckserver.ttl_policies where retention is not null`, time.Now().UTC().Format("2006-01-02 15:04:05.999999"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var policies []ttlPolicy
+	for rows.Next() {
+		var p ttlPolicy
+		if err = rows.Scan(&p.schema, &p.table, &p.timeColumn, &p.cutoff); err != nil {
+			return nil, err
+		}
+		policies = append(policies, p)
+	}
+	return policies, rows.Err()
+}
+
+// parseChTTL returns the time column and the retention of a clickhouse table TTL, ok is false for other TTL
+// expressions such as the TTL moving rows to another volume
+func parseChTTL(ttl string) (column, retention string, ok bool) {
+	m := chTTLRegexp.FindStringSubmatch(ttl)
+	if m == nil {
+		return "", "", false
+	}
+	n, unit := m[2], m[3]
+	if n == "" {
+		n, unit = m[5], m[4]
+	}
+	return chUnquote(m[1]), n + " " + unit, true
+}
@@ -0,0 +1,151 @@
+package duckserver
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// SqlStateIdleInTransactionTimeout is the SQLSTATE of a session terminated while idle in a transaction
+	SqlStateIdleInTransactionTimeout = "25P03"
+	// SqlStateTransactionTimeout is the SQLSTATE of a session terminated by the transaction timeout
+	SqlStateTransactionTimeout = "25P04"
+)
+
+// idleInTransactionTimeoutSetting terminates a session idle in a transaction for longer, and transactionTimeoutSetting
+// a session whose transaction is open for longer, like postgresql. 0 disables them
+const (
+	idleInTransactionTimeoutSetting = "idle_in_transaction_session_timeout"
+	transactionTimeoutSetting       = "transaction_timeout"
+)
+
+// parseTimeoutSetting reads a timeout setting like postgresql, a number of milliseconds or a duration like 5s or 1min
+func parseTimeoutSetting(name, value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	timeout, err := time.ParseDuration(strings.Replace(value, "min", "m", 1))
+	if ms, msErr := strconv.ParseInt(value, 10, 64); msErr == nil {
+		timeout, err = time.Duration(ms)*time.Millisecond, nil
+	}
+	if err != nil || timeout < 0 {
+		return 0, &databaseError{SqlStateInvalidParameterValue, fmt.Sprintf("invalid value for parameter \"%s\": \"%s\"", name, value)}
+	}
+	return timeout, nil
+}
+
+// formatTimeoutSetting formats a timeout setting like SHOW of postgresql
+func formatTimeoutSetting(timeout time.Duration) string {
+	switch {
+	case timeout == 0:
+		return "0"
+	case timeout%time.Minute == 0:
+		return fmt.Sprintf("%dmin", timeout/time.Minute)
+	case timeout%time.Second == 0:
+		return fmt.Sprintf("%ds", timeout/time.Second)
+	}
+	return fmt.Sprintf("%dms", timeout/time.Millisecond)
+}
+
+// initTransactionTimeouts sets the timeouts of the session from the server, or from the startup message
+func (c *PgConn) initTransactionTimeouts(startup map[string]string) {
+	c.idleInTransactionTimeout = c.server.idleInTransactionTimeout
+	c.transactionTimeout = c.server.transactionTimeout
+	for _, name := range []string{idleInTransactionTimeoutSetting, transactionTimeoutSetting} {
+		if value, ok := startup[name]; ok {
+			if err := c.setTransactionTimeouts(&setCommand{name: name, value: value}); err != nil {
+				logrus.Warnf("startup parameter %s error: %v", name, err)
+			}
+		}
+	}
+}
+
+// setTransactionTimeouts applies SET and RESET of the transaction timeouts, RESET returns to the timeouts of the server
+func (c *PgConn) setTransactionTimeouts(cmd *setCommand) error {
+	for _, setting := range []struct {
+		name    string
+		timeout *time.Duration
+		server  time.Duration
+	}{
+		{idleInTransactionTimeoutSetting, &c.idleInTransactionTimeout, c.server.idleInTransactionTimeout},
+		{transactionTimeoutSetting, &c.transactionTimeout, c.server.transactionTimeout},
+	} {
+		if cmd.name != setting.name && cmd.name != "all" {
+			continue
+		}
+		if cmd.reset || strings.EqualFold(cmd.value, "default") {
+			*setting.timeout = setting.server
+			continue
+		}
+		timeout, err := parseTimeoutSetting(setting.name, cmd.value)
+		if err != nil {
+			return err
+		}
+		*setting.timeout = timeout
+	}
+	return nil
+}
+
+// transactionTimeoutParameter returns the value of the transaction timeouts shown by SHOW and current_setting
+func (c *PgConn) transactionTimeoutParameter(name string) (string, bool) {
+	switch strings.ToLower(name) {
+	case idleInTransactionTimeoutSetting:
+		return formatTimeoutSetting(c.idleInTransactionTimeout), true
+	case transactionTimeoutSetting:
+		return formatTimeoutSetting(c.transactionTimeout), true
+	}
+	return "", false
+}
+
+// transactionDeadline is the time the transaction of the session times out at, zero outside a transaction or
+// without transaction timeout
+func (c *PgConn) transactionDeadline() time.Time {
+	if c.txStatus == TransactionStatusIdle || c.txStart.IsZero() || c.transactionTimeout <= 0 {
+		return time.Time{}
+	}
+	return c.txStart.Add(c.transactionTimeout)
+}
+
+// setReadDeadline limits the wait for the next message of a session in a transaction to the transaction timeout, and
+// to the idle in transaction timeout when the session is idle after ReadyForQuery
+func (c *PgConn) setReadDeadline(idle bool) error {
+	deadline := c.transactionDeadline()
+	if idle && c.txStatus != TransactionStatusIdle && c.idleInTransactionTimeout > 0 {
+		if idleDeadline := time.Now().Add(c.idleInTransactionTimeout); deadline.IsZero() || idleDeadline.Before(deadline) {
+			deadline = idleDeadline
+		}
+	}
+	if deadline.Equal(c.readDeadline) {
+		return nil
+	}
+	c.readDeadline = deadline
+	return c.wire.conn.SetReadDeadline(deadline)
+}
+
+// terminateTransaction rolls back the transaction of a session which timed out and tells the client why with a FATAL
+// error before the connection is closed, a stuck transaction would keep DuckDB from checkpointing for everyone
+func (c *PgConn) terminateTransaction(err error) bool {
+	if !errors.Is(err, os.ErrDeadlineExceeded) || c.txStatus == TransactionStatusIdle {
+		return false
+	}
+	code, reason, message := SqlStateIdleInTransactionTimeout, "idle_in_transaction", "terminating connection due to idle-in-transaction timeout"
+	if deadline := c.transactionDeadline(); !deadline.IsZero() && !time.Now().Before(deadline) {
+		code, reason, message = SqlStateTransactionTimeout, "transaction", "terminating connection due to transaction timeout"
+	}
+	logrus.Warnf("user %s: %s, the transaction started at %s is rolled back", c.user, message, c.txStart.Format(time.RFC3339))
+	metrics.Add("duckserver_transaction_timeouts_total", 1, "reason", reason)
+	if _, err := c.conn.(driver.ExecerContext).ExecContext(context.Background(), "ROLLBACK", nil); err != nil {
+		logrus.Warnf("rollback timed out transaction error: %v", err)
+	}
+	c.txStatus = TransactionStatusIdle
+	c.resetTransactionLog()
+	if err := c.sendFatal(code, message); err != nil {
+		logrus.Tracef("send transaction timeout error: %v", err)
+	}
+	return true
+}
@@ -0,0 +1,240 @@
+package duckserver
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+const usageFlushInterval = 10 * time.Second
+
+// defaultQuotaUser is the duckserver.quotas row applied to users without their own row
+const defaultQuotaUser = "*"
+
+type quota struct {
+	queriesPerHour         int64
+	executionSecondsPerDay int64
+}
+
+type usageKey struct {
+	user string
+	hour time.Time
+}
+
+// applicationUsageKey is the hourly bucket of duckserver.application_usage
+type applicationUsageKey struct {
+	application string
+	user        string
+	hour        time.Time
+}
+
+type usageCounter struct {
+	queries     int64
+	executionMs int64
+}
+
+// usageTracker accounts queries and execution time per user in hourly buckets of duckserver.usage,
+// and enforces the quotas of duckserver.quotas. Counters of the current day are kept in memory
+// and flushed periodically, the server is the only writer of the database so memory is authoritative
+type usageTracker struct {
+	db      *sql.DB
+	mu      sync.Mutex
+	buckets map[usageKey]*usageCounter
+	pending map[usageKey]*usageCounter
+	quotas  map[string]quota
+	// applicationPending are the counters per application not flushed yet, they are only accounted
+	applicationPending map[applicationUsageKey]*usageCounter
+}
+
+func newUsageTracker(db *sql.DB) (*usageTracker, error) {
+	t := &usageTracker{
+		db:      db,
+		buckets: make(map[usageKey]*usageCounter),
+		pending: make(map[usageKey]*usageCounter),
+		quotas:  make(map[string]quota),
+
+		applicationPending: make(map[applicationUsageKey]*usageCounter),
+	}
+	day := time.Now().UTC().Truncate(24 * time.Hour)
+	rows, err := db.Query("select username, period_start, queries, execution_ms from duckserver.usage where period_start >= $1", day)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key usageKey
+		counter := &usageCounter{}
+		if err = rows.Scan(&key.user, &key.hour, &counter.queries, &counter.executionMs); err != nil {
+			return nil, err
+		}
+		key.hour = key.hour.UTC()
+		t.buckets[key] = counter
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return t, t.loadQuotas()
+}
+
+func (t *usageTracker) loadQuotas() error {
+	rows, err := t.db.Query("select username, coalesce(queries_per_hour, 0), coalesce(execution_seconds_per_day, 0) from duckserver.quotas")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	quotas := make(map[string]quota)
+	for rows.Next() {
+		var user string
+		var q quota
+		if err = rows.Scan(&user, &q.queriesPerHour, &q.executionSecondsPerDay); err != nil {
+			return err
+		}
+		quotas[user] = q
+	}
+	t.mu.Lock()
+	t.quotas = quotas
+	t.mu.Unlock()
+	return rows.Err()
+}
+
+// Check returns an error if user exceeded a quota of the current interval
+func (t *usageTracker) Check(user string) error {
+	now := time.Now().UTC()
+	hour := now.Truncate(time.Hour)
+	day := now.Truncate(24 * time.Hour)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	q, ok := t.quotas[user]
+	if !ok {
+		q = t.quotas[defaultQuotaUser]
+	}
+	if q.queriesPerHour > 0 {
+		var queries int64
+		if counter, ok := t.buckets[usageKey{user, hour}]; ok {
+			queries = counter.queries
+		}
+		if queries >= q.queriesPerHour {
+			return fmt.Errorf("Quota for user `%s` for 1h has been exceeded: queries = %d/%d. Interval will end at %s",
+				user, queries, q.queriesPerHour, hour.Add(time.Hour).Format(time.DateTime))
+		}
+	}
+	if q.executionSecondsPerDay > 0 {
+		var executionMs int64
+		for key, counter := range t.buckets {
+			if key.user == user && !key.hour.Before(day) {
+				executionMs += counter.executionMs
+			}
+		}
+		if executionMs >= q.executionSecondsPerDay*1000 {
+			return fmt.Errorf("Quota for user `%s` for 1d has been exceeded: execution_time = %.3f/%d. Interval will end at %s",
+				user, float64(executionMs)/1000, q.executionSecondsPerDay, day.Add(24*time.Hour).Format(time.DateTime))
+		}
+	}
+	return nil
+}
+
+// Record accounts a query of user from application which took elapsed
+func (t *usageTracker) Record(user, application string, elapsed time.Duration) {
+	key := usageKey{user, time.Now().UTC().Truncate(time.Hour)}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, m := range []map[usageKey]*usageCounter{t.buckets, t.pending} {
+		counter, ok := m[key]
+		if !ok {
+			counter = &usageCounter{}
+			m[key] = counter
+		}
+		counter.queries++
+		counter.executionMs += elapsed.Milliseconds()
+	}
+	applicationKey := applicationUsageKey{application, user, key.hour}
+	counter, ok := t.applicationPending[applicationKey]
+	if !ok {
+		counter = &usageCounter{}
+		t.applicationPending[applicationKey] = counter
+	}
+	counter.queries++
+	counter.executionMs += elapsed.Milliseconds()
+	metrics.Add("duckserver_user_queries_total", 1, "user", user)
+	metrics.Add("duckserver_user_execution_seconds_total", elapsed.Seconds(), "user", user)
+	metrics.Add("duckserver_application_queries_total", 1, "application", application)
+	metrics.Add("duckserver_application_execution_seconds_total", elapsed.Seconds(), "application", application)
+}
+
+func (t *usageTracker) Run(done chan struct{}) {
+	ticker := time.NewTicker(usageFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		if err := t.Flush(context.Background()); err != nil {
+			logrus.Warnf("flush usage error: %v", err)
+		}
+		if err := t.loadQuotas(); err != nil {
+			logrus.Warnf("load quotas error: %v", err)
+		}
+	}
+}
+
+// Flush writes the pending counters into duckserver.usage and duckserver.application_usage and drops buckets
+// before the current day
+func (t *usageTracker) Flush(ctx context.Context) error {
+	t.mu.Lock()
+	pending := t.pending
+	t.pending = make(map[usageKey]*usageCounter)
+	applicationPending := t.applicationPending
+	t.applicationPending = make(map[applicationUsageKey]*usageCounter)
+	day := time.Now().UTC().Truncate(24 * time.Hour)
+	for key := range t.buckets {
+		if key.hour.Before(day) {
+			delete(t.buckets, key)
+		}
+	}
+	t.mu.Unlock()
+	for key, counter := range pending {
+		_, err := t.db.ExecContext(ctx, `insert into duckserver.usage (username, period_start, queries, execution_ms) values ($1, $2, $3, $4)
+on conflict (username, period_start) do update set queries = queries + excluded.queries, execution_ms = execution_ms + excluded.execution_ms`,
+			key.user, key.hour, counter.queries, counter.executionMs)
+		if err != nil {
+			t.restorePending(pending, applicationPending)
+			return err
+		}
+		delete(pending, key)
+	}
+	for key, counter := range applicationPending {
+		_, err := t.db.ExecContext(ctx, `insert into duckserver.application_usage (application, username, period_start, queries, execution_ms) values ($1, $2, $3, $4, $5)
+on conflict (application, username, period_start) do update set queries = queries + excluded.queries, execution_ms = execution_ms + excluded.execution_ms`,
+			key.application, key.user, key.hour, counter.queries, counter.executionMs)
+		if err != nil {
+			t.restorePending(pending, applicationPending)
+			return err
+		}
+		delete(applicationPending, key)
+	}
+	return nil
+}
+
+// restorePending puts counters which failed to flush back to be retried
+func (t *usageTracker) restorePending(pending map[usageKey]*usageCounter, applicationPending map[applicationUsageKey]*usageCounter) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	mergeCounters(t.pending, pending)
+	mergeCounters(t.applicationPending, applicationPending)
+}
+
+func mergeCounters[K comparable](dst, src map[K]*usageCounter) {
+	for key, counter := range src {
+		if current, ok := dst[key]; ok {
+			current.queries += counter.queries
+			current.executionMs += counter.executionMs
+		} else {
+			dst[key] = counter
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package duckserver
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+const WireBufferSize = 4096
+
+// maxStartupMessageLength and maxMessageLength limit the length a client may announce, like postgresql
+const (
+	maxStartupMessageLength = 10000
+	maxMessageLength        = 1<<30 - 1
+)
+
+// defaultWireWriteBufferSize is the default size of the output buffer, responses are flushed when the buffer is full,
+// on a Flush message and once all pipelined input is processed
+const defaultWireWriteBufferSize = 64 * 1024
+
+// defaultMaxMessageSize is the default max size of a message, a hostile client can't make the server allocate more
+const defaultMaxMessageSize = 64 << 20
+
+type Wire struct {
+	conn      net.Conn
+	buf       [WireBufferSize]byte
+	writeBuf  [WireBufferSize]byte
+	lastMsg   *Message
+	rd        *bufio.Reader
+	out       *bufio.Writer
+	outSize   int
+	tlsConfig *tls.Config
+	// channelBinding is the tls-server-end-point channel binding data once TLS is established
+	channelBinding []byte
+	// maxMessageSize is the max size of a message payload read at once
+	maxMessageSize int
+	msg            MessageWriter
+	io.Writer
+}
+
+func newWire(conn net.Conn, tlsConfig *tls.Config, writeBufferSize int, maxMessageSize int) *Wire {
+	if writeBufferSize <= 0 {
+		writeBufferSize = defaultWireWriteBufferSize
+	}
+	if maxMessageSize <= 0 {
+		maxMessageSize = defaultMaxMessageSize
+	}
+	w := &Wire{conn: conn, tlsConfig: tlsConfig, outSize: writeBufferSize, maxMessageSize: maxMessageSize}
+	w.setConn(conn)
+	return w
+}
+
+func (w *Wire) setConn(conn net.Conn) {
+	w.conn = conn
+	w.rd = bufio.NewReaderSize(conn, 1024*1024)
+	w.out = bufio.NewWriterSize(conn, w.outSize)
+	w.Writer = w.out
+}
+
+// Flush sends the buffered output to the client
+func (w *Wire) Flush() error {
+	return w.out.Flush()
+}
+
+// hasBufferedMessage reports whether a complete message is already buffered, so it can be read without waiting
+// for the client. Pipelining clients like pgx send Parse/Bind/Execute/Sync in one batch, their responses are
+// flushed together once the batch is drained
+func (w *Wire) hasBufferedMessage() bool {
+	n := w.rd.Buffered()
+	if n < 5 {
+		return false
+	}
+	header, err := w.rd.Peek(5)
+	if err != nil {
+		return false
+	}
+	return n >= 1+int(binary.BigEndian.Uint32(header[1:]))
+}
+
+func (w *Wire) Read(p []byte) (int, error) {
+	if w.rd == nil {
+		panic("read from nil reader")
+	}
+	return io.ReadFull(w.rd, p)
+}
+
+func (w *Wire) ReadInt32() (int32, error) {
+	_, err := w.Read(w.buf[0:4])
+	b := w.buf
+	_ = b[3] // bounds check hint to compiler; see golang.org/issue/14808
+	return int32(b[3]) | int32(b[2])<<8 | int32(b[1])<<16 | int32(b[0])<<24, err
+}
+
+func (w *Wire) ReadStartUpMessage() (FirstMessage, error) {
+	l, err := w.ReadInt32()
+	if err != nil {
+		return nil, err
+	}
+	if l < 8 || l > maxStartupMessageLength {
+		return nil, fmt.Errorf("invalid startup message length %d", l)
+	}
+	buf := make([]byte, l-4)
+	if _, err = w.Read(buf); err != nil {
+		return nil, err
+	}
+	version := binary.BigEndian.Uint32(buf)
+	if version>>16 == StartupMessageMajorVersion {
+		sm := StartUpMessage{Data: buf}
+		err = sm.Parse()
+		return &sm, err
+	}
+	if version == CancelRequestCode {
+		if len(buf) < 12 {
+			return nil, fmt.Errorf("invalid cancel request length %d", l)
+		}
+		cm := CancelRequestMessage{Version: int32(version)}
+		copy(cm.Key[:], buf[4:12])
+		return &cm, nil
+	}
+	if version == SSLRequestCode {
+		if w.tlsConfig == nil {
+			if _, err := w.Write([]byte{byte('N')}); err != nil {
+				return nil, err
+			}
+			if err := w.Flush(); err != nil {
+				return nil, err
+			}
+			return w.ReadStartUpMessage()
+		}
+		if _, err := w.Write([]byte{byte('S')}); err != nil {
+			return nil, err
+		}
+		if err := w.Flush(); err != nil {
+			return nil, err
+		}
+		tlsConn := tls.Server(w.conn, w.tlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			return nil, err
+		}
+		w.setConn(tlsConn)
+		w.channelBinding = tlsServerEndPoint(w.tlsConfig)
+		return w.ReadStartUpMessage()
+	}
+	return nil, fmt.Errorf("invalid version")
+}
+
+func (w *Wire) WriteAuthOK() error {
+	_, err := w.Write([]byte{'R', 0, 0, 0, 8, 0, 0, 0, 0})
+	return err
+}
+
+func (w *Wire) ReadMessage() (*Message, error) {
+	if w.lastMsg != nil {
+		if err := w.lastMsg.Skip(); err != nil {
+			return nil, err
+		}
+	}
+	if !w.hasBufferedMessage() {
+		if err := w.Flush(); err != nil {
+			return nil, err
+		}
+	}
+	buf := w.buf[0:5]
+	_, err := w.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	t := MessageType(buf[0])
+	_ = buf[4]
+	l := int32(buf[4]) | int32(buf[3])<<8 | int32(buf[2])<<16 | int32(buf[1])<<24
+	if l < 4 || l > maxMessageLength {
+		return nil, fmt.Errorf("invalid message length %d", l)
+	}
+	var m *Message
+	if w.lastMsg != nil {
+		m = w.lastMsg
+		m.Length = l
+		m.Typ = t
+		m.buf = nil
+		m.consumed = 0
+	} else {
+		m = &Message{
+			Length: l,
+			wire:   w,
+			Typ:    t,
+		}
+		w.lastMsg = m
+	}
+	//logrus.Infof("read message: %v", m.String())
+	return m, nil
+}
+
+func (w *Wire) WriteMessage(msg IMessage) error {
+	//logrus.Infof("write message: %v", msg.String())
+	return msg.Write(w)
+}
+
+func (w *Wire) ReadMessageInType(t MessageType) (*Message, error) {
+	m, err := w.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	if m.Typ != t {
+		return nil, fmt.Errorf("message type not match")
+	}
+	return m, nil
+}
+
+func (w *Wire) ReadAuthMessage() (AuthenticationMessage, error) {
+	m, err := w.ReadMessageInType('R')
+	if err != nil {
+		return nil, err
+	}
+	_, err = m.Read()
+	if err != nil {
+		return nil, err
+	}
+	if len(m.buf) < 4 {
+		return nil, fmt.Errorf("invalid authentication message")
+	}
+	t := binary.BigEndian.Uint32(m.buf)
+	switch t {
+	case 3:
+		return &CleartextPasswordMessage{Message: m}, nil
+	case 5:
+		return &MD5PasswordMessage{Message: m, Salt: m.buf[4:]}, nil
+	case 10:
+		return ParseSaslMessage(m)
+	case 11:
+		return ParseSaslContinueMessage(m)
+	}
+	return nil, fmt.Errorf("unsupported auth type %d", t)
+}
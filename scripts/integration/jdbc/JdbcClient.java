@@ -0,0 +1,90 @@
+// Runs the queries of a pgjdbc application: typed parameters, a batch, an error recovered by rollback and savepoints.
+// Usage: java -cp postgresql.jar JdbcClient.java PORT
+import java.math.BigDecimal;
+import java.sql.Connection;
+import java.sql.DriverManager;
+import java.sql.PreparedStatement;
+import java.sql.ResultSet;
+import java.sql.SQLException;
+import java.sql.Savepoint;
+import java.sql.Statement;
+import java.sql.Timestamp;
+import java.sql.Types;
+
+public class JdbcClient {
+    static void check(boolean ok, String what) {
+        if (!ok) {
+            throw new AssertionError(what);
+        }
+    }
+
+    static long count(Connection conn, String where) throws SQLException {
+        try (Statement st = conn.createStatement(); ResultSet rs = st.executeQuery("select count(*) from it_jdbc where " + where)) {
+            rs.next();
+            return rs.getLong(1);
+        }
+    }
+
+    public static void main(String[] args) throws Exception {
+        String url = "jdbc:postgresql://127.0.0.1:" + args[0] + "/duckserver?user=duckserver";
+        try (Connection conn = DriverManager.getConnection(url)) {
+            try (Statement st = conn.createStatement()) {
+                st.execute("create or replace table it_jdbc (id int, name varchar, amount decimal(18, 2), ts timestamp)");
+            }
+
+            try (PreparedStatement ps = conn.prepareStatement("insert into it_jdbc values (?, ?, ?, ?)")) {
+                ps.setInt(1, 1);
+                ps.setString(2, "it's");
+                ps.setBigDecimal(3, new BigDecimal("12.34"));
+                ps.setTimestamp(4, Timestamp.valueOf("2024-01-02 03:04:05"));
+                check(ps.executeUpdate() == 1, "insert count");
+                for (int i = 2; i <= 4; i++) {
+                    ps.setInt(1, i);
+                    ps.setNull(2, Types.VARCHAR);
+                    ps.setNull(3, Types.NUMERIC);
+                    ps.setNull(4, Types.TIMESTAMP);
+                    ps.addBatch();
+                }
+                ps.executeBatch();
+            }
+
+            // the prepared statement is run more times than prepareThreshold, pgjdbc switches to a named statement
+            try (PreparedStatement ps = conn.prepareStatement("select name, amount from it_jdbc where id = ?")) {
+                for (int i = 0; i < 10; i++) {
+                    ps.setInt(1, 1);
+                    try (ResultSet rs = ps.executeQuery()) {
+                        check(rs.next(), "row of id 1");
+                        check("it's".equals(rs.getString(1)), "name " + rs.getString(1));
+                        check(new BigDecimal("12.34").compareTo(rs.getBigDecimal(2)) == 0, "amount " + rs.getBigDecimal(2));
+                    }
+                }
+            }
+            check(count(conn, "name is null") == 3, "null names");
+
+            conn.setAutoCommit(false);
+            try (Statement st = conn.createStatement()) {
+                st.executeQuery("select * from it_jdbc_missing");
+                throw new AssertionError("query of a missing table succeeded");
+            } catch (SQLException e) {
+                conn.rollback();
+            }
+            try (PreparedStatement ps = conn.prepareStatement("insert into it_jdbc (id, name) values (?, ?)")) {
+                ps.setInt(1, 5);
+                ps.setString(2, "kept");
+                ps.executeUpdate();
+                Savepoint sp = conn.setSavepoint("s1");
+                ps.setInt(1, 6);
+                ps.setString(2, "rolled back");
+                ps.executeUpdate();
+                conn.rollback(sp);
+            }
+            conn.commit();
+            check(count(conn, "id = 5") == 1 && count(conn, "id = 6") == 0, "rollback to savepoint");
+            conn.setAutoCommit(true);
+
+            try (Statement st = conn.createStatement()) {
+                st.execute("drop table it_jdbc");
+            }
+        }
+    }
+}
@@ -0,0 +1,4 @@
+CREATE TABLE it_basic (a int, b varchar);
+INSERT INTO it_basic VALUES (1, 'x'), (2, 'y');
+SELECT a, b FROM it_basic ORDER BY a;
+SELECT count(*) FROM it_basic WHERE a > 1;
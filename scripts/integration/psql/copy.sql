@@ -0,0 +1,6 @@
+CREATE TABLE it_copy (a int, b varchar);
+COPY it_copy FROM STDIN WITH CSV;
+1,x
+2,y
+\.
+SELECT a, b FROM it_copy ORDER BY a;
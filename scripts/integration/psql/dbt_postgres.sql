@@ -0,0 +1,24 @@
+\c postgres
+create schema if not exists "postgres"."it_dbt";
+BEGIN;
+create  table "postgres"."it_dbt"."m1__dbt_tmp" as ( select 1 as id, 'a' as name );
+alter table "postgres"."it_dbt"."m1__dbt_tmp" rename to "m1";
+COMMIT;
+BEGIN;
+create view "postgres"."it_dbt"."v1__dbt_tmp" as ( select * from "postgres"."it_dbt"."m1" );
+alter table "postgres"."it_dbt"."v1__dbt_tmp" rename to "v1";
+COMMIT;
+BEGIN;
+create  table "postgres"."it_dbt"."m1__dbt_tmp" as ( select 2 as id, 'b' as name );
+alter table "postgres"."it_dbt"."m1" rename to "m1__dbt_backup";
+alter table "postgres"."it_dbt"."m1__dbt_tmp" rename to "m1";
+COMMIT;
+drop table if exists "postgres"."it_dbt"."m1__dbt_backup" cascade;
+select tablename from pg_tables where schemaname ilike 'it_dbt' union all select viewname from pg_views where schemaname ilike 'it_dbt' order by 1;
+create temporary table "m2__dbt_tmp" as ( select 3 as id, 'c' as name );
+insert into "postgres"."it_dbt"."m1" ("id", "name") ( select "id", "name" from "m2__dbt_tmp" );
+select * from "postgres"."it_dbt"."v1" order by id;
+with relation as ( select pg_rewrite.ev_class as class, pg_rewrite.oid as id from pg_rewrite ), class as ( select oid as id, relname as name, relnamespace as schema, relkind as kind from pg_class ), dependency as ( select distinct pg_depend.objid as id, pg_depend.refobjid as ref from pg_depend ), schema as ( select pg_namespace.oid as id, pg_namespace.nspname as name from pg_namespace ), referenced as ( select relation.id AS id, referenced_class.name , referenced_class.schema , referenced_class.kind from relation join class as referenced_class on relation.class=referenced_class.id ), relationships as ( select referenced.name as referenced_name, referenced.schema as referenced_schema_id, dependent_class.name as dependent_name, dependent_class.schema as dependent_schema_id from referenced join dependency on referenced.id=dependency.id join class as dependent_class on dependency.ref=dependent_class.id ) select referenced_schema.name as referenced_schema, relationships.referenced_name as referenced_name, dependent_schema.name as dependent_schema, relationships.dependent_name as dependent_name from relationships join schema as dependent_schema on relationships.dependent_schema_id=dependent_schema.id join schema as referenced_schema on relationships.referenced_schema_id=referenced_schema.id group by referenced_schema, referenced_name, dependent_schema, dependent_name;
+select count(*) as failures, count(*) != 0 as should_warn from ( select id from "postgres"."it_dbt"."m1" where id is null ) dbt_internal_test;
+drop view if exists "postgres"."it_dbt"."v1" cascade;
+drop schema "postgres"."it_dbt" cascade;
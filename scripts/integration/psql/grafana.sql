@@ -0,0 +1,11 @@
+CREATE TABLE it_grafana (ts timestamptz, host varchar, value double);
+INSERT INTO it_grafana VALUES ('2024-01-01 00:00:10+00', 'a', 1), ('2024-01-01 00:07:00+00', 'b', 2);
+SELECT current_setting('server_version_num')::int/100 as version;
+SELECT extversion FROM pg_extension WHERE extname = 'timescaledb';
+SELECT name FROM pg_timezone_names ORDER BY name;
+SHOW TimeZone;
+select quote_ident(table_name) as "table" from information_schema.tables where quote_ident(table_schema) not in ('information_schema', 'pg_catalog') and quote_ident(table_schema) IN (SELECT CASE WHEN trim(s[i]) = '"$user"' THEN user ELSE trim(s[i]) END FROM generate_series(array_lower(string_to_array(current_setting('search_path'),','),1), array_upper(string_to_array(current_setting('search_path'),','),1)) as i, string_to_array(current_setting('search_path'),',') s) and table_name like 'it_grafana%';
+SELECT quote_ident(column_name) AS "column", data_type AS "type" FROM information_schema.columns WHERE quote_ident(table_name) = 'it_grafana' ORDER BY 1;
+SELECT floor(extract(epoch from ts)/300)*300 AS "time", avg(value) AS "value" FROM it_grafana WHERE ts BETWEEN '2024-01-01T00:00:00Z' AND '2024-01-02T00:00:00Z' GROUP BY 1 ORDER BY 1;
+SELECT time_bucket('300s',ts) AS "time", avg(value) AS "value" FROM it_grafana WHERE ts BETWEEN '2024-01-01T00:00:00Z' AND '2024-01-02T00:00:00Z' GROUP BY 1 ORDER BY 1;
+SELECT ts::timestamptz AS "time", host AS metric, value FROM it_grafana WHERE ts >= to_timestamp(1704067200) AND ts <= to_timestamp(1704153600) ORDER BY 1;
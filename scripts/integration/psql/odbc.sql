@@ -0,0 +1,13 @@
+CREATE TABLE it_odbc (a int, b varchar);
+INSERT INTO it_odbc SELECT i, 'v' || i FROM range(5) r(i);
+BEGIN;
+SAVEPOINT _EXEC_SVP_1;
+DECLARE "SQL_CUR1" CURSOR WITH HOLD FOR SELECT a, b FROM it_odbc ORDER BY a;
+RELEASE _EXEC_SVP_1;
+FETCH 2 IN "SQL_CUR1";
+MOVE 1 IN "SQL_CUR1";
+FETCH ALL IN "SQL_CUR1";
+COMMIT;
+FETCH NEXT FROM "SQL_CUR1";
+CLOSE "SQL_CUR1";
+DROP TABLE it_odbc;
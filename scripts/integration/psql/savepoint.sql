@@ -0,0 +1,14 @@
+CREATE TABLE it_savepoint (a int PRIMARY KEY);
+BEGIN;
+INSERT INTO it_savepoint VALUES (1);
+SAVEPOINT s1;
+INSERT INTO it_savepoint VALUES (2);
+SAVEPOINT s2;
+INSERT INTO it_savepoint VALUES (3);
+ROLLBACK TO SAVEPOINT s2;
+SELECT list(a ORDER BY a) FROM it_savepoint;
+ROLLBACK TO s1;
+RELEASE s1;
+COMMIT;
+SELECT a FROM it_savepoint ORDER BY a;
+DROP TABLE it_savepoint;
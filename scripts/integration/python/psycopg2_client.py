@@ -0,0 +1,67 @@
+# Runs the queries of a psycopg2 application: adapted parameters, executemany, COPY, a named cursor, an error
+# recovered by rollback and savepoints.
+# Usage: python3 psycopg2_client.py PORT
+import datetime
+import decimal
+import io
+import sys
+
+import psycopg2
+
+conn = psycopg2.connect(host="127.0.0.1", port=sys.argv[1], user="duckserver", dbname="duckserver")
+cur = conn.cursor()
+cur.execute("create or replace table it_psycopg2 (id int, name varchar, amount decimal(18, 2), ts timestamp, data blob, tags varchar[])")
+conn.commit()
+
+cur.execute("insert into it_psycopg2 values (%s, %s, %s, %s, %s, %s)",
+            (1, "it's", decimal.Decimal("12.34"), datetime.datetime(2024, 1, 2, 3, 4, 5), psycopg2.Binary(b"\x00\x01"), ["a", "b"]))
+cur.executemany("insert into it_psycopg2 (id, name) values (%(id)s, %(name)s)", [{"id": 2, "name": None}, {"id": 3, "name": "c"}])
+conn.commit()
+
+cur.execute("select name, amount, ts, data, tags from it_psycopg2 where id = %s", (1,))
+name, amount, ts, data, tags = cur.fetchone()
+assert name == "it's", name
+assert amount == decimal.Decimal("12.34"), amount
+# timestamps are described as text
+assert str(ts) == "2024-01-02 03:04:05", ts
+assert bytes(data) == b"\x00\x01", data
+# lists are described as text
+assert tags == "{a,b}", tags
+cur.execute("select id from it_psycopg2 where name is null")
+assert cur.fetchall() == [(2,)]
+
+# COPY FROM STDIN takes csv rows of all the columns
+cur.execute("create or replace table it_psycopg2_copy (id int, name varchar)")
+cur.copy_expert("copy it_psycopg2_copy from stdin with csv", io.StringIO("4,d\n5,e\n"))
+cur.execute("insert into it_psycopg2 (id, name) select id, name from it_psycopg2_copy")
+cur.execute("drop table it_psycopg2_copy")
+conn.commit()
+cur.execute("select count(*) from it_psycopg2")
+assert cur.fetchone() == (5,)
+
+# a named cursor fetches with DECLARE and FETCH in the transaction
+named = conn.cursor(name="it_cursor")
+named.itersize = 2
+named.execute("select id from it_psycopg2 order by id")
+assert [row[0] for row in named] == [1, 2, 3, 4, 5]
+named.close()
+conn.commit()
+
+try:
+    cur.execute("select * from it_psycopg2_missing")
+    raise AssertionError("query of a missing table succeeded")
+except psycopg2.Error:
+    conn.rollback()
+cur.execute("select 1")
+assert cur.fetchone() == (1,)
+
+cur.execute("savepoint s1")
+cur.execute("insert into it_psycopg2 (id, name) values (6, 'f')")
+cur.execute("rollback to savepoint s1")
+cur.execute("select count(*) from it_psycopg2 where id = 6")
+assert cur.fetchone() == (0,)
+conn.commit()
+
+cur.execute("drop table it_psycopg2")
+conn.commit()
+conn.close()
@@ -0,0 +1,43 @@
+# Connects with the postgresql dialect of SQLAlchemy like superset and reflects a schema.
+# Usage: python3 sqlalchemy_reflect.py PORT
+import sys
+
+import sqlalchemy as sa
+
+engine = sa.create_engine(f"postgresql+psycopg2://duckserver@127.0.0.1:{sys.argv[1]}/duckserver")
+with engine.begin() as conn:
+    conn.exec_driver_sql("drop schema if exists it_sqlalchemy cascade")
+    conn.exec_driver_sql("create schema it_sqlalchemy")
+    conn.exec_driver_sql("create table it_sqlalchemy.customers (id integer primary key, name varchar not null, score double)")
+    conn.exec_driver_sql("create table it_sqlalchemy.orders (id bigint, customer_id integer references it_sqlalchemy.customers (id), "
+                         "code varchar unique, status varchar default 'new', created_at timestamp, primary key (id))")
+    conn.exec_driver_sql("create index orders_status_created on it_sqlalchemy.orders (status, created_at)")
+
+insp = sa.inspect(engine)
+assert insp.default_schema_name == "main", insp.default_schema_name
+assert "it_sqlalchemy" in insp.get_schema_names()
+assert sorted(insp.get_table_names(schema="it_sqlalchemy")) == ["customers", "orders"]
+
+columns = {c["name"]: c for c in insp.get_columns("orders", schema="it_sqlalchemy")}
+assert list(columns) == ["id", "customer_id", "code", "status", "created_at"], list(columns)
+assert isinstance(columns["id"]["type"], sa.BigInteger), columns["id"]["type"]
+assert isinstance(columns["status"]["type"], sa.String), columns["status"]["type"]
+assert isinstance(columns["created_at"]["type"], sa.DateTime), columns["created_at"]["type"]
+assert columns["status"]["default"] == "'new'", columns["status"]["default"]
+assert not columns["id"]["nullable"]
+
+assert insp.get_pk_constraint("orders", schema="it_sqlalchemy")["constrained_columns"] == ["id"]
+fks = insp.get_foreign_keys("orders", schema="it_sqlalchemy")
+assert [(fk["constrained_columns"], fk["referred_table"], fk["referred_columns"]) for fk in fks] == [(["customer_id"], "customers", ["id"])], fks
+assert [u["column_names"] for u in insp.get_unique_constraints("orders", schema="it_sqlalchemy")] == [["code"]]
+indexes = insp.get_indexes("orders", schema="it_sqlalchemy")
+assert [(i["name"], i["column_names"]) for i in indexes] == [("orders_status_created", ["status", "created_at"])], indexes
+
+metadata = sa.MetaData()
+orders = sa.Table("orders", metadata, schema="it_sqlalchemy", autoload_with=engine)
+assert orders.c.customer_id.references(metadata.tables["it_sqlalchemy.customers"].c.id)
+with engine.begin() as conn:
+    conn.execute(metadata.tables["it_sqlalchemy.customers"].insert(), [{"id": 1, "name": "a"}])
+    conn.execute(orders.insert(), [{"id": 1, "customer_id": 1, "code": "x"}])
+    assert conn.execute(sa.select(sa.func.count()).select_from(orders)).scalar() == 1
+    conn.exec_driver_sql("drop schema it_sqlalchemy cascade")
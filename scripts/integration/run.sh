@@ -0,0 +1,122 @@
+#!/usr/bin/env bash
+# Integration tests with real clients: builds the server, starts it on a temporary database and runs
+# the psql scripts of psql/, the curl cases of clickhouse/, the wire protocol traces of wire/, the python
+# clients of python/ and the jdbc programs of jdbc/ against it.
+# Clients which aren't installed are skipped. Usage: scripts/integration/run.sh
+set -u
+
+ROOT="$(cd "$(dirname "$0")/../.." && pwd)"
+DIR="$ROOT/scripts/integration"
+PG_PORT="${PG_PORT:-25432}"
+CH_PORT="${CH_PORT:-28123}"
+WORK="$(mktemp -d)"
+FAILED=0
+PASSED=0
+
+cleanup() {
+	[ -n "${SERVER_PID:-}" ] && kill "$SERVER_PID" 2>/dev/null && wait "$SERVER_PID" 2>/dev/null
+	rm -rf "$WORK"
+}
+trap cleanup EXIT
+
+pass() {
+	PASSED=$((PASSED + 1))
+	echo "ok   $1"
+}
+
+fail() {
+	FAILED=$((FAILED + 1))
+	echo "FAIL $1"
+	[ -n "${2:-}" ] && diff -u "$2" "$3" | sed 's/^/     /'
+}
+
+(cd "$ROOT" && go build -o "$WORK/duckserver" .) || exit 1
+"$WORK/duckserver" -db_path "$WORK/test.db" -auth=false -grafana_compat -pg_listen ":$PG_PORT" -ch_listen ":$CH_PORT" >"$WORK/server.log" 2>&1 &
+SERVER_PID=$!
+for _ in $(seq 1 50); do
+	curl -sf "http://127.0.0.1:$CH_PORT/ping" >/dev/null && break
+	sleep 0.2
+done
+if ! curl -sf "http://127.0.0.1:$CH_PORT/ping" >/dev/null; then
+	echo "server did not start:"
+	cat "$WORK/server.log"
+	exit 1
+fi
+
+# clickhouse/*.case: the first line is the request "METHOD query-string", the body follows a line "--- body" and
+# the expected response follows a line "--- expect"
+for case in "$DIR"/clickhouse/*.case; do
+	name="clickhouse/$(basename "$case" .case)"
+	request="$(head -n 1 "$case")"
+	method="${request%% *}"
+	query="${request#* }"
+	sed -n '/^--- body$/,/^--- expect$/p' "$case" | sed '1d;$d' >"$WORK/body"
+	sed -n '/^--- expect$/,$p' "$case" | sed '1d' >"$WORK/expected"
+	curl -s -X "$method" "http://127.0.0.1:$CH_PORT/?$query" --data-binary @"$WORK/body" >"$WORK/actual"
+	if cmp -s "$WORK/expected" "$WORK/actual"; then
+		pass "$name"
+	else
+		fail "$name" "$WORK/expected" "$WORK/actual"
+	fi
+done
+
+# psql/*.sql run with unaligned tuples only output and are compared with psql/*.out
+if command -v psql >/dev/null; then
+	for script in "$DIR"/psql/*.sql; do
+		name="psql/$(basename "$script" .sql)"
+		psql -X -q -A -t -v ON_ERROR_STOP=1 -h 127.0.0.1 -p "$PG_PORT" -U duckserver -f "$script" >"$WORK/actual" 2>&1
+		if cmp -s "${script%.sql}.out" "$WORK/actual"; then
+			pass "$name"
+		else
+			fail "$name" "${script%.sql}.out" "$WORK/actual"
+		fi
+	done
+else
+	echo "skip psql: not installed"
+fi
+
+# wire/*.trace are postgresql protocol messages of clients replayed by wire/replay.go, the responses are
+# compared byte for byte
+(cd "$ROOT" && go build -o "$WORK/replay" scripts/integration/wire/replay.go) || exit 1
+for trace in "$DIR"/wire/*.trace; do
+	name="wire/$(basename "$trace" .trace)"
+	if "$WORK/replay" -addr "127.0.0.1:$PG_PORT" "$trace" >"$WORK/actual" 2>&1; then
+		pass "$name"
+	else
+		fail "$name"
+		sed 's/^/     /' "$WORK/actual"
+	fi
+done
+
+# python/*.py take the postgresql port and pass when they exit 0, they need sqlalchemy and psycopg2
+if python3 -c 'import sqlalchemy, psycopg2' 2>/dev/null; then
+	for script in "$DIR"/python/*.py; do
+		name="python/$(basename "$script" .py)"
+		if python3 "$script" "$PG_PORT" >"$WORK/actual" 2>&1; then
+			pass "$name"
+		else
+			fail "$name"
+			sed 's/^/     /' "$WORK/actual"
+		fi
+	done
+else
+	echo "skip python: sqlalchemy or psycopg2 not installed"
+fi
+
+# jdbc/*.java take the postgresql port and pass when they exit 0, they need java and the pgjdbc jar of PGJDBC_JAR
+if command -v java >/dev/null && [ -n "${PGJDBC_JAR:-}" ]; then
+	for program in "$DIR"/jdbc/*.java; do
+		name="jdbc/$(basename "$program" .java)"
+		if java -cp "$PGJDBC_JAR" "$program" "$PG_PORT" >"$WORK/actual" 2>&1; then
+			pass "$name"
+		else
+			fail "$name"
+			sed 's/^/     /' "$WORK/actual"
+		fi
+	done
+else
+	echo "skip jdbc: java or PGJDBC_JAR not available"
+fi
+
+echo "$PASSED passed, $FAILED failed"
+[ "$FAILED" -eq 0 ]
@@ -0,0 +1,329 @@
+//go:build ignore
+
+// replay runs postgresql wire protocol traces against the server and checks its responses byte for byte.
+//
+// A trace has a message per line, "> T payload" sent by the client and "< T payload" expected from the server. T is
+// the message type, or startup for the startup message, and the payload a Go quoted string of the message after its
+// length, or * for any payload like the random BackendKeyData. ParameterStatus messages received in a row may come in
+// any order. Lines starting with # are comments.
+//
+// Record a trace of a real client through a proxy, update the expected responses of traces after an intended change,
+// or replay them:
+//
+//	go run scripts/integration/wire/replay.go -record -listen :6432 -addr 127.0.0.1:5432 -o psql_simple.trace
+//	go run scripts/integration/wire/replay.go -update -addr 127.0.0.1:5432 scripts/integration/wire/*.trace
+//	go run scripts/integration/wire/replay.go -addr 127.0.0.1:5432 scripts/integration/wire/*.trace
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	sslRequestCode    = 80877103
+	gssEncRequestCode = 80877104
+	// idleTimeout ends reading the responses to the messages of a trace being updated
+	idleTimeout = time.Second
+)
+
+// answered are the messages the server answers at once, the others are answered at the next of these
+var answered = map[string]bool{"startup": true, "Q": true, "S": true, "H": true, "c": true, "f": true}
+
+type message struct {
+	typ     string
+	payload []byte
+	any     bool
+	line    int
+}
+
+func (m message) String() string {
+	if m.any {
+		return m.typ + " *"
+	}
+	return m.typ + " " + strconv.Quote(string(m.payload))
+}
+
+// traceLine is a line of a trace, a message or a comment kept verbatim
+type traceLine struct {
+	text     string
+	sent     bool
+	received bool
+	msg      message
+}
+
+func parseTrace(path string) ([]traceLine, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var lines []traceLine
+	for i, text := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		l := traceLine{text: text}
+		if strings.HasPrefix(text, "> ") || strings.HasPrefix(text, "< ") {
+			typ, payload, ok := strings.Cut(text[2:], " ")
+			if !ok || (typ != "startup" && len(typ) != 1) {
+				return nil, fmt.Errorf("%s:%d: expected a message type and payload", path, i+1)
+			}
+			l.msg = message{typ: typ, line: i + 1}
+			if payload == "*" {
+				l.msg.any = true
+			} else {
+				s, err := strconv.Unquote(payload)
+				if err != nil {
+					return nil, fmt.Errorf("%s:%d: invalid payload: %w", path, i+1, err)
+				}
+				l.msg.payload = []byte(s)
+			}
+			l.sent, l.received = text[0] == '>', text[0] == '<'
+		}
+		lines = append(lines, l)
+	}
+	return lines, nil
+}
+
+func writeMessage(w io.Writer, m message) error {
+	var buf bytes.Buffer
+	if m.typ != "startup" {
+		buf.WriteString(m.typ)
+	}
+	_ = binary.Write(&buf, binary.BigEndian, int32(len(m.payload)+4))
+	buf.Write(m.payload)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func readMessage(r io.Reader) (message, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return message{}, err
+	}
+	length := int(binary.BigEndian.Uint32(header[1:]))
+	if length < 4 || length > 1<<30 {
+		return message{}, fmt.Errorf("invalid length %d of message %q", length, header[0])
+	}
+	payload := make([]byte, length-4)
+	_, err := io.ReadFull(r, payload)
+	return message{typ: string(header[:1]), payload: payload}, err
+}
+
+// sortParameterStatus sorts the runs of ParameterStatus messages, the server sends them in any order
+func sortParameterStatus(messages []message) {
+	for i := 0; i < len(messages); {
+		j := i
+		for j < len(messages) && messages[j].typ == "S" {
+			j++
+		}
+		if j > i+1 {
+			run := messages[i:j]
+			sort.SliceStable(run, func(a, b int) bool { return bytes.Compare(run[a].payload, run[b].payload) < 0 })
+		}
+		i = j + 1
+	}
+}
+
+// replay sends the messages of a trace and compares the responses, with update the expected responses are replaced
+// by the received ones
+func replay(addr, path string, update bool) error {
+	lines, err := parseTrace(path)
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	var out []string
+	for i := 0; i < len(lines); {
+		if !lines[i].sent && !lines[i].received {
+			out = append(out, lines[i].text)
+			i++
+			continue
+		}
+		var last message
+		for i < len(lines) && lines[i].sent {
+			last = lines[i].msg
+			if err = writeMessage(conn, last); err != nil {
+				return fmt.Errorf("%s:%d: %w", path, last.line, err)
+			}
+			out = append(out, lines[i].text)
+			i++
+			// a trace being updated gets the responses of each message the server answers
+			if update && answered[last.typ] {
+				break
+			}
+		}
+		var expected []message
+		for ; i < len(lines) && lines[i].received; i++ {
+			expected = append(expected, lines[i].msg)
+		}
+		if update {
+			if last.typ == "X" {
+				continue
+			}
+			received, err := readResponses(conn, r)
+			if err != nil {
+				return fmt.Errorf("%s:%d: %w", path, last.line, err)
+			}
+			sortParameterStatus(received)
+			for _, m := range received {
+				if m.typ == "K" {
+					m.any = true
+				}
+				out = append(out, "< "+m.String())
+			}
+			continue
+		}
+		received := make([]message, len(expected))
+		_ = conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		for j := range received {
+			if received[j], err = readMessage(r); err != nil {
+				return fmt.Errorf("%s:%d: expected < %s, got %w", path, expected[j].line, expected[j], err)
+			}
+		}
+		sortParameterStatus(expected)
+		sortParameterStatus(received)
+		for j, m := range expected {
+			if m.typ != received[j].typ || !m.any && !bytes.Equal(m.payload, received[j].payload) {
+				return fmt.Errorf("%s:%d: expected\n  < %s\ngot\n  < %s", path, m.line, m, received[j])
+			}
+		}
+	}
+	if update {
+		return os.WriteFile(path, []byte(strings.Join(out, "\n")+"\n"), 0644)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if m, err := readMessage(r); err == nil {
+		return fmt.Errorf("%s: unexpected < %s at the end of the trace", path, m)
+	}
+	return nil
+}
+
+// readResponses reads the responses to the messages sent, until ReadyForQuery, CopyInResponse or the server going
+// quiet
+func readResponses(conn net.Conn, r *bufio.Reader) ([]message, error) {
+	var received []message
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		m, err := readMessage(r)
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() || err == io.EOF {
+			return received, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		received = append(received, m)
+		if m.typ == "Z" || m.typ == "G" {
+			return received, nil
+		}
+	}
+}
+
+// record proxies a client connection to the server and writes its messages as a trace, TLS is refused so the
+// messages can be read
+func record(listen, addr, path string) error {
+	l, err := net.Listen("tcp", listen)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	fmt.Fprintf(os.Stderr, "recording the next connection to %s\n", listen)
+	client, err := l.Accept()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	var startup []byte
+	for {
+		var length [4]byte
+		if _, err = io.ReadFull(client, length[:]); err != nil {
+			return err
+		}
+		startup = make([]byte, binary.BigEndian.Uint32(length[:])-4)
+		if _, err = io.ReadFull(client, startup); err != nil {
+			return err
+		}
+		if code := binary.BigEndian.Uint32(startup); code != sslRequestCode && code != gssEncRequestCode {
+			break
+		}
+		if _, err = client.Write([]byte{'N'}); err != nil {
+			return err
+		}
+	}
+	server, err := net.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer server.Close()
+	first := message{typ: "startup", payload: startup}
+	if err = writeMessage(server, first); err != nil {
+		return err
+	}
+	var mu sync.Mutex
+	out := []string{"> " + first.String()}
+	proxy := func(from io.Reader, to io.Writer, prefix string) {
+		for {
+			m, err := readMessage(from)
+			if err != nil {
+				return
+			}
+			if m.typ == "K" {
+				m.any = true
+			}
+			mu.Lock()
+			out = append(out, prefix+m.String())
+			mu.Unlock()
+			m.any = false
+			if err = writeMessage(to, m); err != nil {
+				return
+			}
+		}
+	}
+	done := make(chan struct{}, 2)
+	go func() { proxy(client, server, "> "); _ = server.Close(); done <- struct{}{} }()
+	go func() { proxy(server, client, "< "); _ = client.Close(); done <- struct{}{} }()
+	<-done
+	<-done
+	return os.WriteFile(path, []byte(strings.Join(out, "\n")+"\n"), 0644)
+}
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:5432", "address of the server")
+	update := flag.Bool("update", false, "replace the expected responses of the traces by the received ones")
+	recordMode := flag.Bool("record", false, "record a trace of a client connecting to -listen")
+	listen := flag.String("listen", ":6432", "address the clients connect to when recording")
+	output := flag.String("o", "client.trace", "trace file written when recording")
+	flag.Parse()
+	if *recordMode {
+		if err := record(*listen, *addr, *output); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	failed := false
+	for _, path := range flag.Args() {
+		if err := replay(*addr, path, *update); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"duckserver/pkg/duckserver"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// serviceName is the name of the Windows service, the launchd label and the systemd unit description
+const serviceName = "duckserver"
+
+// runServer starts the server, writes the pidfile and stops the server on SIGINT/SIGTERM or a service stop request
+func runServer(server *duckserver.Server, pidFile string) error {
+	if handled, err := runPlatformService(server, pidFile); handled {
+		return err
+	}
+	if err := server.Start(); err != nil {
+		return err
+	}
+	if pidFile != "" {
+		if err := os.WriteFile(pidFile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+			_ = server.Stop()
+			return err
+		}
+		defer os.Remove(pidFile)
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		logrus.Infof("received %s, stopping", sig)
+		_ = server.Stop()
+	}()
+	return server.Wait()
+}
+
+// detach starts the server again in the background without the detach flag and returns
+func detach() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	devNull, err := os.OpenFile(os.DevNull, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer devNull.Close()
+	cmd := exec.Command(exe, withoutFlag(os.Args[1:], "detach")...)
+	cmd.Stdin = devNull
+	cmd.Stdout = devNull
+	cmd.Stderr = devNull
+	cmd.SysProcAttr = detachAttr()
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+	logrus.Infof("started in background with pid %d", cmd.Process.Pid)
+	return cmd.Process.Release()
+}
+
+// withoutFlag removes a boolean flag from command line arguments
+func withoutFlag(args []string, name string) []string {
+	var out []string
+	for _, arg := range args {
+		flagName, _, _ := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if strings.HasPrefix(arg, "-") && flagName == name {
+			continue
+		}
+		out = append(out, arg)
+	}
+	return out
+}
+
+// runService runs the service subcommand: duck_server service systemd|launchd|install|uninstall [server flags]
+func runService(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: service systemd|launchd|install|uninstall [server flags]")
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if exe, err = filepath.Abs(exe); err != nil {
+		return err
+	}
+	serverArgs := withoutFlag(args[1:], "detach")
+	switch args[0] {
+	case "systemd":
+		fmt.Print(systemdUnit(exe, serverArgs))
+		return nil
+	case "launchd":
+		fmt.Print(launchdPlist(exe, serverArgs))
+		return nil
+	case "install":
+		return installService(exe, serverArgs)
+	case "uninstall":
+		return uninstallService()
+	}
+	return fmt.Errorf("unknown service command %s", args[0])
+}
+
+func systemdUnit(exe string, args []string) string {
+	command := []string{systemdQuote(exe)}
+	for _, arg := range args {
+		command = append(command, systemdQuote(arg))
+	}
+	return fmt.Sprintf(`[Unit]
+Description=DuckServer, postgresql and clickhouse protocol server of DuckDB
+After=network.target
+
+[Service]
+Type=simple
+ExecStart=%s
+Restart=on-failure
+LimitNOFILE=65536
+
+[Install]
+WantedBy=multi-user.target
+`, strings.Join(command, " "))
+}
+
+// systemdQuote quotes an ExecStart argument, % and $ are escaped from specifier and variable expansion
+func systemdQuote(arg string) string {
+	arg = strings.NewReplacer("%", "%%", "$", "$$").Replace(arg)
+	if arg != "" && !strings.ContainsAny(arg, " \t\"'\\;") {
+		return arg
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(arg) + `"`
+}
+
+func launchdPlist(exe string, args []string) string {
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	<string>` + serviceName + `</string>
+	<key>ProgramArguments</key>
+	<array>
+`)
+	for _, arg := range append([]string{exe}, args...) {
+		b.WriteString("\t\t<string>" + xmlEscape(arg) + "</string>\n")
+	}
+	b.WriteString(`	</array>
+	<key>RunAtLoad</key>
+	<true/>
+	<key>KeepAlive</key>
+	<true/>
+</dict>
+</plist>
+`)
+	return b.String()
+}
+
+func xmlEscape(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;", "'", "&apos;").Replace(s)
+}
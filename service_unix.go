@@ -0,0 +1,25 @@
+//go:build !windows
+
+package main
+
+import (
+	"duckserver/pkg/duckserver"
+	"errors"
+	"syscall"
+)
+
+func detachAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setsid: true}
+}
+
+func runPlatformService(server *duckserver.Server, pidFile string) (bool, error) {
+	return false, nil
+}
+
+func installService(exe string, args []string) error {
+	return errors.New("service install is only supported on windows, install the output of service systemd or service launchd")
+}
+
+func uninstallService() error {
+	return errors.New("service uninstall is only supported on windows")
+}
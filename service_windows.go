@@ -0,0 +1,107 @@
+//go:build windows
+
+package main
+
+import (
+	"duckserver/pkg/duckserver"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+func detachAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{CreationFlags: windows.DETACHED_PROCESS | windows.CREATE_NEW_PROCESS_GROUP, HideWindow: true}
+}
+
+// runPlatformService runs the server under the service control manager when started as a Windows service
+func runPlatformService(server *duckserver.Server, pidFile string) (bool, error) {
+	isService, err := svc.IsWindowsService()
+	if err != nil || !isService {
+		return false, err
+	}
+	return true, svc.Run(serviceName, &windowsService{server: server, pidFile: pidFile})
+}
+
+type windowsService struct {
+	server  *duckserver.Server
+	pidFile string
+}
+
+func (s *windowsService) Execute(args []string, requests <-chan svc.ChangeRequest, changes chan<- svc.Status) (bool, uint32) {
+	changes <- svc.Status{State: svc.StartPending}
+	if err := s.server.Start(); err != nil {
+		logrus.Errorf("start error: %v", err)
+		return true, 1
+	}
+	if s.pidFile != "" {
+		if err := os.WriteFile(s.pidFile, []byte(strconv.Itoa(os.Getpid())+"\r\n"), 0644); err != nil {
+			logrus.Warnf("write pidfile error: %v", err)
+		}
+		defer os.Remove(s.pidFile)
+	}
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- s.server.Wait()
+	}()
+	changes <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for {
+		select {
+		case err := <-stopped:
+			if err != nil {
+				logrus.Errorf("server error: %v", err)
+				return true, 1
+			}
+			return false, 0
+		case request := <-requests:
+			switch request.Cmd {
+			case svc.Interrogate:
+				changes <- request.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				changes <- svc.Status{State: svc.StopPending}
+				_ = s.server.Stop()
+				return false, 0
+			}
+		}
+	}
+}
+
+func installService(exe string, args []string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	service, err := m.CreateService(serviceName, exe, mgr.Config{
+		DisplayName: "DuckServer",
+		Description: "postgresql and clickhouse protocol server of DuckDB",
+		StartType:   mgr.StartAutomatic,
+	}, args...)
+	if err != nil {
+		return err
+	}
+	defer service.Close()
+	logrus.Infof("installed service %s", serviceName)
+	return nil
+}
+
+func uninstallService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	service, err := m.OpenService(serviceName)
+	if err != nil {
+		return err
+	}
+	defer service.Close()
+	if err = service.Delete(); err != nil {
+		return err
+	}
+	logrus.Infof("removed service %s", serviceName)
+	return nil
+}